@@ -8,10 +8,11 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/openshift/sdn/pkg/network/common/cniserver"
+	"github.com/openshift/sdn/pkg/util/restrictedexec"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -82,6 +83,11 @@ func (p *cniPlugin) doCNI(url string, req *cniserver.CNIRequest) ([]byte, error)
 	}
 
 	if resp.StatusCode != 200 {
+		// The server returns a CNI error object, which can be passed on as-is
+		cniErr := &types.Error{}
+		if err := json.Unmarshal(body, cniErr); err == nil && cniErr.Msg != "" {
+			return nil, cniErr
+		}
 		return nil, fmt.Errorf("CNI request failed with status %v: '%s'", resp.StatusCode, string(body))
 	}
 
@@ -142,30 +148,51 @@ func (p *cniPlugin) CmdAdd(args *skel.CmdArgs) error {
 
 	var hostVeth, contVeth net.Interface
 	err = ns.WithNetNSPath(args.Netns, func(hostNS ns.NetNS) error {
+		vethStart := time.Now()
 		hostVeth, contVeth, err = ip.SetupVeth(args.IfName, int(config.MTU), hostNS)
 		if err != nil {
 			return fmt.Errorf("failed to create container veth: %v", err)
 		}
+		req.VethSetup = &cniserver.StageTiming{Start: vethStart, End: time.Now()}
+
+		// Block access to certain things
+		iptablesStart := time.Now()
+		for _, args := range iptablesCommands {
+			out, err := restrictedexec.New(restrictedexec.DefaultConfig).Command("iptables", append([]string{"-w"}, args...)...).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("could not set up pod iptables rules: %s", string(out))
+			}
+		}
+		req.IPTablesSetup = &cniserver.StageTiming{Start: iptablesStart, End: time.Now()}
 		return nil
 	})
 	if err != nil {
 		return err
 	}
+	req.PodMAC = contVeth.HardwareAddr.String()
 	result, err := p.doCNIServerAdd(req, hostVeth.Name)
 	if err != nil {
 		return err
 	}
 
-	if err != nil || len(result.IPs) != 1 || result.IPs[0].Version != "4" {
-		return fmt.Errorf("Unexpected IPAM result: %v", err)
+	// The result has an IPv4 address, followed by an IPv6 address in dual-stack
+	// clusters
+	if len(result.IPs) == 0 || len(result.IPs) > 2 || result.IPs[0].Version != "4" ||
+		(len(result.IPs) == 2 && result.IPs[1].Version != "6") {
+		return fmt.Errorf("Unexpected IPAM result: %v", result)
 	}
 
 	// ipam.ConfigureIface thinks that a route with no gateway specified
 	// means to pass the default gateway as the next hop to ip.AddRoute,
 	// but that's not what we want; we want to pass nil as the next hop.
-	// So we need to clear the default gateway.
+	// So we need to clear the default gateway. (The default routes have
+	// explicit gateways.)
 	defaultGW := result.IPs[0].Gateway
-	result.IPs[0].Gateway = nil
+	gateways := make([]net.IP, len(result.IPs))
+	for i, ipc := range result.IPs {
+		gateways[i] = ipc.Gateway
+		ipc.Gateway = nil
+	}
 
 	// Add a sandbox interface record which ConfigureInterface expects.
 	// The only interface we report is the pod interface.
@@ -176,7 +203,9 @@ func (p *cniPlugin) CmdAdd(args *skel.CmdArgs) error {
 			Sandbox: args.Netns,
 		},
 	}
-	result.IPs[0].Interface = current.Int(0)
+	for _, ipc := range result.IPs {
+		ipc.Interface = current.Int(0)
+	}
 
 	err = ns.WithNetNSPath(args.Netns, func(hostNS ns.NetNS) error {
 		// Set up eth0
@@ -241,20 +270,23 @@ func (p *cniPlugin) CmdAdd(args *skel.CmdArgs) error {
 			}
 		}
 
-		// Block access to certain things
-		for _, args := range iptablesCommands {
-			out, err := exec.Command("iptables", append([]string{"-w"}, args...)...).CombinedOutput()
-			if err != nil {
-				return fmt.Errorf("could not set up pod iptables rules: %s", string(out))
-			}
-		}
-
 		return nil
 	})
 	if err != nil {
 		return err
 	}
 
+	// Report the gateways and the host side of the veth in the result, so that
+	// consumers of it (like Multus, which builds the pod's network-status
+	// annotation from the result of its default delegate) see the whole picture.
+	for i, ipc := range result.IPs {
+		ipc.Gateway = gateways[i]
+	}
+	result.Interfaces = append(result.Interfaces, &current.Interface{
+		Name: hostVeth.Name,
+		Mac:  hostVeth.HardwareAddr.String(),
+	})
+
 	convertedResult, err := convertToRequestedVersion(req.Config, result)
 	if err != nil {
 		return err
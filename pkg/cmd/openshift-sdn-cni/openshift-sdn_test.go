@@ -120,6 +120,7 @@ func TestOpenshiftSdnCNIPlugin(t *testing.T) {
 		reqType     cniserver.CNICommand
 		result      cnitypes.Result
 		errorPrefix string
+		errorCode   uint
 	}
 
 	testcases := []testcase{
@@ -248,7 +249,8 @@ func TestOpenshiftSdnCNIPlugin(t *testing.T) {
 				Path:        "/some/path",
 				StdinData:   []byte("{\"cniVersion\": \"0.1.0\",\"name\": \"openshift-sdn\",\"type\": \"openshift-sdn\"}"),
 			},
-			errorPrefix: "CNI request failed with status 400: 'invalid CNI_ARG",
+			errorPrefix: "missing K8S_POD_NAMESPACE",
+			errorCode:   cniserver.ErrInvalidEnvironmentVariables,
 		},
 	}
 
@@ -277,6 +279,8 @@ func TestOpenshiftSdnCNIPlugin(t *testing.T) {
 				}
 			} else if !strings.HasPrefix(fmt.Sprintf("%v", err), tc.errorPrefix) {
 				t.Fatalf("[%s] unexpected error message '%v'", tc.name, err)
+			} else if cniErr, ok := err.(*cnitypes.Error); !ok || cniErr.Code != tc.errorCode {
+				t.Fatalf("[%s] expected CNI error code %d but got %#v", tc.name, tc.errorCode, err)
 			}
 		})
 	}
@@ -3,22 +3,41 @@ package openshift_sdn_controller
 import (
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/coreos/go-systemd/daemon"
 	"github.com/spf13/cobra"
 	"k8s.io/klog/v2"
 
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/component-base/metrics/legacyregistry"
 	kcmdutil "k8s.io/kubectl/pkg/cmd/util"
 	"k8s.io/kubectl/pkg/util/templates"
 
 	"github.com/openshift/library-go/pkg/serviceability"
+	sdnmaster "github.com/openshift/sdn/pkg/network/master"
 )
 
 type OpenShiftNetworkController struct {
-	ConfigFilePath string
-	Output         io.Writer
+	ConfigFilePath     string
+	MetricsBindAddress string
+	// The debug endpoints are served if NodeDebugPort is set
+	NodeDebugPort    int
+	NodeDebugCAFile  string
+	DebugBindAddress string
+	DebugCertFile    string
+	DebugKeyFile     string
+	// IdleDetectionPeriod enables idle detection if non-zero
+	IdleDetectionPeriod time.Duration
+	// The admission webhook is served if WebhookBindAddress is set
+	WebhookBindAddress string
+	WebhookCertFile    string
+	WebhookKeyFile     string
+	Output             io.Writer
 }
 
 var longDescription = templates.LongDesc(`
@@ -55,20 +74,96 @@ func NewOpenShiftNetworkControllerCommand(name string, out, errout io.Writer) *c
 	// This command only supports reading from config
 	flags.StringVar(&options.ConfigFilePath, "config", options.ConfigFilePath, "Location of the master configuration file to run from.")
 	cmd.MarkFlagFilename("config", "yaml", "yml")
+	flags.StringVar(&options.MetricsBindAddress, "metrics-bind-address", options.MetricsBindAddress, "The address (eg, 0.0.0.0:9106) to serve metrics on; if empty, metrics are not served.")
+	flags.IntVar(&options.NodeDebugPort, "node-debug-port", options.NodeDebugPort, "The port on which the nodes serve their debug endpoints over TLS, on their node IPs (see the nodes' --debug-bind-address). If set, the controller serves /debug/trace on --debug-bind-address, to trace traffic between pods across nodes, and /unidling/pending, merging the nodes' /unidling/pending lists of idled services that need pods (for nodes run with the \"pending\" unidling signaler). Callers need a bearer token authorized for the path as a non-resource URL. The controller calls the nodes' /debug/trace, /debug/probe, and /unidling/pending endpoints as its own service account, which must be authorized for them.")
+	flags.StringVar(&options.NodeDebugCAFile, "node-debug-ca-file", options.NodeDebugCAFile, "The CA certificate file to verify the nodes' debug serving certificates with, for --node-debug-port; the certificates must be valid for the nodes' IPs.")
+	flags.StringVar(&options.DebugBindAddress, "debug-bind-address", options.DebugBindAddress, "The address (eg, 0.0.0.0:9107) to serve the debug endpoints on, over TLS, with --node-debug-port.")
+	flags.StringVar(&options.DebugCertFile, "debug-cert-file", options.DebugCertFile, "The TLS certificate file for --debug-bind-address.")
+	flags.StringVar(&options.DebugKeyFile, "debug-key-file", options.DebugKeyFile, "The TLS key file for --debug-bind-address.")
+
+	flags.DurationVar(&options.IdleDetectionPeriod, "idle-detection-period", options.IdleDetectionPeriod, "If non-zero, aggregate the service activity reported by the nodes (which must be run with the same --idle-detection-period), record on each Service when it last had new connections (network.openshift.io/last-activity), and mark Services that have had none on any node for this long as idle candidates (network.openshift.io/idle-candidate, and an IdleCandidate event) for the idling controller.")
+
+	flags.StringVar(&options.WebhookBindAddress, "webhook-bind-address", options.WebhookBindAddress, "The address (eg, 0.0.0.0:9443) to serve the NetNamespace admission webhook on, over TLS; if empty, it is not served. The webhook (at /admission/pod-network-change) records the user who requests each pod network join/isolate/global change, so the controller can audit it; it must be registered in a MutatingWebhookConfiguration for NetNamespace CREATE and UPDATE.")
+	flags.StringVar(&options.WebhookCertFile, "webhook-cert-file", options.WebhookCertFile, "The TLS certificate file for --webhook-bind-address.")
+	flags.StringVar(&options.WebhookKeyFile, "webhook-key-file", options.WebhookKeyFile, "The TLS key file for --webhook-bind-address.")
 
 	return cmd
 }
 
 func (o *OpenShiftNetworkController) Validate() error {
+	if o.NodeDebugPort < 0 || o.NodeDebugPort > 65535 {
+		return fmt.Errorf("invalid --node-debug-port %d", o.NodeDebugPort)
+	}
+	if o.NodeDebugPort != 0 && (o.NodeDebugCAFile == "" || o.DebugBindAddress == "" || o.DebugCertFile == "" || o.DebugKeyFile == "") {
+		return fmt.Errorf("--node-debug-port requires --node-debug-ca-file, --debug-bind-address, --debug-cert-file, and --debug-key-file")
+	}
+	if o.IdleDetectionPeriod < 0 {
+		return fmt.Errorf("invalid --idle-detection-period %v", o.IdleDetectionPeriod)
+	}
+	if o.WebhookBindAddress != "" && (o.WebhookCertFile == "" || o.WebhookKeyFile == "") {
+		return fmt.Errorf("--webhook-bind-address requires --webhook-cert-file and --webhook-key-file")
+	}
 	return nil
 }
 
 // StartNetworkController calls RunOpenShiftNetworkController and then waits forever
 func (o *OpenShiftNetworkController) StartNetworkController() error {
-	if err := RunOpenShiftNetworkController(); err != nil {
+	o.startMetricsServer()
+	o.startWebhookServer()
+	debugMux := o.startDebugServer()
+	if err := RunOpenShiftNetworkController(debugMux, o.NodeDebugPort, o.NodeDebugCAFile, o.IdleDetectionPeriod); err != nil {
 		return err
 	}
 
 	go daemon.SdNotify(false, "READY=1")
 	select {}
 }
+
+// startWebhookServer starts serving the admission webhook, if configured
+func (o *OpenShiftNetworkController) startWebhookServer() {
+	if o.WebhookBindAddress == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/admission/pod-network-change", sdnmaster.PodNetworkChangeAdmissionHandler())
+	go utilwait.Until(func() {
+		err := http.ListenAndServeTLS(o.WebhookBindAddress, o.WebhookCertFile, o.WebhookKeyFile, mux)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("starting webhook server failed: %v", err))
+		}
+	}, 5*time.Second, utilwait.NeverStop)
+}
+
+// startDebugServer starts serving the debug endpoints over TLS, if configured,
+// returning the server's mux (or nil if they are not served)
+func (o *OpenShiftNetworkController) startDebugServer() *http.ServeMux {
+	if o.NodeDebugPort == 0 {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	go utilwait.Until(func() {
+		err := http.ListenAndServeTLS(o.DebugBindAddress, o.DebugCertFile, o.DebugKeyFile, mux)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("starting debug server failed: %v", err))
+		}
+	}, 5*time.Second, utilwait.NeverStop)
+	return mux
+}
+
+// startMetricsServer starts serving metrics, if configured
+func (o *OpenShiftNetworkController) startMetricsServer() {
+	if o.MetricsBindAddress == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", legacyregistry.Handler())
+	go utilwait.Until(func() {
+		err := http.ListenAndServe(o.MetricsBindAddress, mux)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("starting metrics server failed: %v", err))
+		}
+	}, 5*time.Second, utilwait.NeverStop)
+}
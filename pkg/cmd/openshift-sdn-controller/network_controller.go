@@ -21,6 +21,7 @@ import (
 	configv1 "github.com/openshift/api/config/v1"
 	leaderelectionconverter "github.com/openshift/library-go/pkg/config/leaderelection"
 	"github.com/openshift/library-go/pkg/serviceability"
+	"github.com/openshift/sdn/pkg/network/common"
 	sdnmaster "github.com/openshift/sdn/pkg/network/master"
 
 	// for metrics
@@ -28,7 +29,13 @@ import (
 	_ "k8s.io/component-base/metrics/prometheus/version"
 )
 
-func RunOpenShiftNetworkController() error {
+// RunOpenShiftNetworkController starts the controller once it is elected leader.
+// If debugMux is not nil, the controller then serves /debug/trace and
+// /unidling/pending on it (to users authorized for those paths), using the nodes'
+// debug endpoints on nodeDebugPort, whose certificates are signed by the CA in
+// nodeDebugCAFile. If idleDetectionPeriod is non-zero, it also runs idle detection
+// with that period.
+func RunOpenShiftNetworkController(debugMux *http.ServeMux, nodeDebugPort int, nodeDebugCAFile string, idleDetectionPeriod time.Duration) error {
 	serviceability.InitLogrusFromKlog()
 
 	clientConfig, err := rest.InClusterConfig()
@@ -40,6 +47,18 @@ func RunOpenShiftNetworkController() error {
 	if err != nil {
 		return err
 	}
+	var nodeDebugClient *sdnmaster.NodeDebugClient
+	if debugMux != nil {
+		nodeDebugClient, err = sdnmaster.NewNodeDebugClient(clientConfig, nodeDebugCAFile, nodeDebugPort)
+		if err != nil {
+			return err
+		}
+	}
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(klog.Infof)
+	eventBroadcaster.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	eventRecorder := eventBroadcaster.NewRecorder(legacyscheme.Scheme, corev1.EventSource{Component: "openshift-network-controller"})
 
 	originControllerManager := func(ctx context.Context) {
 		if err := WaitForHealthyAPIServer(kubeClient.Discovery().RESTClient()); err != nil {
@@ -50,22 +69,27 @@ func RunOpenShiftNetworkController() error {
 		if err != nil {
 			klog.Fatal(err)
 		}
-		if err := sdnmaster.Start(
+		master, err := sdnmaster.Start(
 			controllerContext.kubernetesClient,
 			controllerContext.kubernetesInformers,
 			controllerContext.osdnClient,
 			controllerContext.osdnInformers,
-		); err != nil {
+			eventRecorder,
+		)
+		if err != nil {
 			klog.Fatalf("Error starting OpenShift Network Controller: %v", err)
 		}
+		if debugMux != nil {
+			debugMux.Handle("/debug/trace", common.RequireAuthorization(kubeClient, master.PodTraceHandler(nodeDebugClient)))
+			debugMux.Handle("/unidling/pending", common.RequireAuthorization(kubeClient, master.PendingWakesHandler(nodeDebugClient)))
+		}
+		if idleDetectionPeriod > 0 {
+			master.StartIdleDetection(controllerContext.kubernetesInformers, idleDetectionPeriod)
+		}
 		klog.Infof("Started OpenShift Network Controller")
 		controllerContext.StartInformers()
 	}
 
-	eventBroadcaster := record.NewBroadcaster()
-	eventBroadcaster.StartLogging(klog.Infof)
-	eventBroadcaster.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
-	eventRecorder := eventBroadcaster.NewRecorder(legacyscheme.Scheme, corev1.EventSource{Component: "openshift-network-controller"})
 	id, err := os.Hostname()
 	if err != nil {
 		return err
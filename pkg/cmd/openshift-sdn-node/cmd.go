@@ -1,28 +1,43 @@
 package openshift_sdn_node
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
 	"k8s.io/klog/v2"
 
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	utilwait "k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/component-base/traces"
 	kubeproxyconfig "k8s.io/kubernetes/pkg/proxy/apis/config"
 	"k8s.io/kubernetes/pkg/util/interrupt"
 	"k8s.io/kubernetes/pkg/util/iptables"
 	kexec "k8s.io/utils/exec"
 
 	"github.com/openshift/library-go/pkg/serviceability"
+	"github.com/openshift/sdn/pkg/network/common"
 	sdnnode "github.com/openshift/sdn/pkg/network/node"
+	sdnmetrics "github.com/openshift/sdn/pkg/network/node/metrics"
 	sdnproxy "github.com/openshift/sdn/pkg/network/proxy"
+	"github.com/openshift/sdn/pkg/network/proxy/unidler"
+	"github.com/openshift/sdn/pkg/util/restrictedexec"
 	"github.com/openshift/sdn/pkg/version"
 )
 
@@ -35,12 +50,79 @@ type openShiftSDN struct {
 	proxyConfigFilePath string
 	proxyConfig         *kubeproxyconfig.KubeProxyConfiguration
 
+	egressDNSServers    []string
+	egressDNSResolvConf string
+
+	kubeletConfigFilePath string
+	clusterDNS            []string
+	clusterDomain         string
+
+	unidlingSignalers        []string
+	unidlingWebhookURL       string
+	unidlingSignalerResource string
+	unidlingConnTimeout      time.Duration
+	unidlingPendingTTL       time.Duration
+	// unidlingPending is the "pending" unidling signaler, if it is enabled
+	unidlingPending *unidler.PendingWakeSignaler
+
+	idleDetectionPeriod time.Duration
+
+	debugBindAddress string
+	debugCertFile    string
+	debugKeyFile     string
+
+	reconcilePeriod     time.Duration
+	execTimeout         time.Duration
+	execNoNewPrivileges bool
+
+	tracingEndpoint     string
+	tracingSamplingRate float64
+
+	connectionLogPath    string
+	connectionLogQPS     float64
+	connectionLogMaxSize int64
+
+	migrationMode bool
+
+	nicOffloadCheck     bool
+	neighborGCThreshMax int
+	ovsFlowLimit        int
+	ovsTableFlowLimit   int
+
+	cniAllowedExecutables []string
+	podReattachWorkers    int
+
+	egressFirewallExemptNodeSelector string
+	multicastGatewayGroups           []string
+
+	ipam                string
+	ipamLeakCheckPeriod time.Duration
+	ipamLeakMinAge      time.Duration
+
+	podNetworkStatus bool
+
+	adminNetworkPolicy bool
+
+	bgpPeers   []string
+	bgpLocalAS uint32
+	bgpPeerAS  uint32
+	bgpGRTime  time.Duration
+
+	nativeRouting  bool
+	encapsulations []string
+
 	informers   *informers
 	osdnNode    *sdnnode.OsdnNode
 	sdnRecorder record.EventRecorder
 	osdnProxy   *sdnproxy.OsdnProxy
 
-	ipt iptables.Interface
+	// resyncNode is the node that resync reconciles or resyncs; normally osdnNode
+	resyncNode nodeResyncer
+	// resyncLock serializes reconciles (via HTTP) and full resyncs (via SIGUSR1)
+	resyncLock sync.Mutex
+
+	execer kexec.Interface
+	ipt    iptables.Interface
 }
 
 var networkLong = `
@@ -73,6 +155,47 @@ func NewOpenShiftSDNCommand(basename string, errout io.Writer) *cobra.Command {
 	cmd.MarkFlagRequired("node-ip")
 	flags.StringVar(&sdn.proxyConfigFilePath, "proxy-config", "", "Location of the kube-proxy configuration file")
 	cmd.MarkFlagRequired("proxy-config")
+	flags.StringSliceVar(&sdn.egressDNSServers, "egress-dns-servers", nil, "Nameservers (IP or IP:port) to use for resolving EgressNetworkPolicy dnsNames, such as a node-local DNS cache, instead of those in --egress-dns-resolv-conf")
+	flags.StringVar(&sdn.egressDNSResolvConf, "egress-dns-resolv-conf", common.DefaultResolvConf, "resolv.conf file to read the nameservers for resolving EgressNetworkPolicy dnsNames from, if --egress-dns-servers is not set")
+	flags.StringVar(&sdn.kubeletConfigFilePath, "kubelet-config", "", "Location of the kubelet configuration file, whose clusterDNS and clusterDomain are returned in the CNI result for each pod, for runtimes that configure pod DNS from the CNI result; if unset, the result has no DNS configuration")
+	flags.StringSliceVar(&sdn.unidlingSignalers, "unidling-signalers", []string{unidler.EventSignalerName}, "How to signal that an idled service needs pods: any of \"event\" (emit a NeedPods Event), \"webhook\" (POST to --unidling-webhook-url), \"resource\" (update the status of the --unidling-signaler-resource object with the same name as the service), or \"pending\" (list the service at /unidling/pending on the debug server, for authorized callers; the SDN controller merges all of the nodes' lists at its own /unidling/pending for external autoscalers to poll)")
+	flags.StringVar(&sdn.unidlingWebhookURL, "unidling-webhook-url", "", "URL to POST to when an idled service needs pods, with the \"webhook\" unidling signaler")
+	flags.StringVar(&sdn.unidlingSignalerResource, "unidling-signaler-resource", "", "Resource (in \"resource.version.group\" form) to update when an idled service needs pods, with the \"resource\" unidling signaler")
+	flags.DurationVar(&sdn.unidlingPendingTTL, "unidling-pending-ttl", unidler.DefaultPendingWakeTTL, "How long an idled service stays listed at /unidling/pending after it last needed pods (unless it gets endpoints first), with the \"pending\" unidling signaler")
+	flags.DurationVar(&sdn.unidlingConnTimeout, "unidling-connection-timeout", unidler.DefaultHeldConnectionTimeout, "How long to hold a TCP connection (or UDP datagrams) to an idled service while waiting for the service to be unidled")
+	flags.DurationVar(&sdn.idleDetectionPeriod, "idle-detection-period", 0, "If non-zero, count new connections to each service in the proxy's iptables rules and report when each service last had any, for the SDN controller's idle detection (which must be enabled with the same period)")
+
+	flags.StringVar(&sdn.debugBindAddress, "debug-bind-address", "", "The address (eg, 0.0.0.0:9108) to serve the debug endpoints (/debug/trace, /debug/probe, /debug/diag, /debug/reconcile, /unidling/pending, etc) on, over TLS; if empty, they are not served. Each endpoint requires a bearer token authorized for its path as a non-resource URL. To use the SDN controller's /debug/trace and /unidling/pending, serve these on the same port on every node, with a certificate valid for the node IP")
+	flags.StringVar(&sdn.debugCertFile, "debug-cert-file", "", "The TLS certificate file for --debug-bind-address")
+	flags.StringVar(&sdn.debugKeyFile, "debug-key-file", "", "The TLS key file for --debug-bind-address")
+	flags.DurationVar(&sdn.reconcilePeriod, "reconcile-period", sdnnode.DefaultReconcilePeriod, "How often to reconcile the node's VNID OVS flows and iptables rules (but not its pod, service or HostSubnet flows); 0 disables periodic reconciliation (except for the hourly removal of unused VNID flows), leaving only event-driven updates and on-demand reconciliation via an authorized POST to /debug/reconcile on the debug server. Send SIGUSR1 to rewrite all OVS flows and iptables rules instead")
+	flags.StringVar(&sdn.tracingEndpoint, "tracing-endpoint", "", "OTLP gRPC collector (host:port) to export OpenTelemetry traces of pod setup and teardown to; if empty, tracing is disabled")
+	flags.Float64Var(&sdn.tracingSamplingRate, "tracing-sampling-rate", 0.01, "Fraction of pod setups and teardowns to trace, with --tracing-endpoint")
+	flags.StringVar(&sdn.connectionLogPath, "connection-log-file", "", "File to append a JSON record of each new connection to or from a pod to (with the source and destination pods or services), and of traffic dropped by NetworkPolicy, for security auditing; if empty, connections are not logged")
+	flags.Float64Var(&sdn.connectionLogQPS, "connection-log-rate", sdnnode.DefaultConnectionLogQPS, "Maximum number of connections per second to record in --connection-log-file; connections beyond this rate are counted but not recorded")
+	flags.Int64Var(&sdn.connectionLogMaxSize, "connection-log-max-size", sdnnode.DefaultConnectionLogMaxSize, "Size in bytes at which --connection-log-file is rotated; the 5 most recent rotated files are kept as <file>.1 to <file>.5")
+	flags.BoolVar(&sdn.migrationMode, "migration-mode", false, "Run alongside OVN-Kubernetes during a live migration: keep existing pods working but refuse to set up new ones, stop hosting egress IPs, report progress at /debug/migration on the debug server, and remove the SDN bridge, iptables rules and CNI configuration once the Node has the network.openshift.io/sdn-migration-teardown=true annotation and no pods remain")
+	flags.BoolVar(&sdn.nicOffloadCheck, "nic-offload-check", false, "At startup, check the NIC carrying VXLAN traffic against known driver/firmware offload bugs and with a self-test sending large VXLAN frames to another node; if VXLAN traffic would be corrupted, emit an event on the Node naming the offloads to disable (the NIC is not modified)")
+	flags.IntVar(&sdn.neighborGCThreshMax, "neighbor-gc-thresh-max", 0, "If non-zero, raise the kernel's neighbor (ARP/NDP) table garbage collection thresholds (net.ipv4/ipv6.neigh.default.gc_thresh1-3) when the table is nearly full, up to this value for gc_thresh3; if 0, the thresholds are only monitored")
+	flags.IntVar(&sdn.ovsFlowLimit, "ovs-flow-limit", 0, "If non-zero, emit a warning event on the Node when the total number of OVS flows approaches this limit")
+	flags.IntVar(&sdn.ovsTableFlowLimit, "ovs-table-flow-limit", 0, "If non-zero, emit a warning event on the Node when the number of OVS flows in any one table approaches this limit")
+	flags.StringSliceVar(&sdn.cniAllowedExecutables, "cni-allowed-executables", nil, "If set, the CNI server only accepts connections from processes running one of these executables (eg, /opt/cni/bin/openshift-sdn), as verified via /proc; connections from non-root processes are always rejected")
+	flags.IntVar(&sdn.podReattachWorkers, "pod-reattach-workers", sdnnode.DefaultPodReattachWorkers, "Number of existing pods to set up again in parallel when the node restarts and has to rebuild its OVS bridge; namespace-wide flows are always set up before any of the pods")
+	flags.StringVar(&sdn.egressFirewallExemptNodeSelector, "egress-firewall-exempt-node-selector", "", "Label selector for nodes whose IPs are exempt from EgressNetworkPolicy rules, eg \"node-role.kubernetes.io/infra\"")
+	flags.StringSliceVar(&sdn.multicastGatewayGroups, "multicast-gateway-groups", nil, "IPv4 multicast groups (address:port) to bridge between pods in multicast-enabled namespaces and the node's network; the node joins each group on its interface while a local pod has joined it")
+	flags.StringVar(&sdn.ipam, "ipam", sdnnode.HostLocalIPAM, "How to allocate pod IPs from the node's subnet: \"host-local\" (recorded on the node's disk) or \"cluster\" (with a cluster-scoped sdn.openshift.io PodIPLease object per IP, named after the IP, as defined by manifests/sdn.openshift.io_podipleases.yaml; a lease created with spec.reserved=true, spec.podNamespace, and spec.podName and no sdn.openshift.io/node label reserves that IP for that pod). \"cluster\" does not support dual-stack clusters")
+	flags.DurationVar(&sdn.ipamLeakCheckPeriod, "ipam-leak-check-period", sdnnode.DefaultIPAMLeakCheckPeriod, "How often to look for pod IP allocations that belong to neither a running pod sandbox nor an OVS port, and release those older than --ipam-leak-min-age; the number found is reported in the openshift_sdn_pod_ip_leaks metric; 0 disables the check")
+	flags.DurationVar(&sdn.ipamLeakMinAge, "ipam-leak-min-age", sdnnode.DefaultIPAMLeakMinAge, "How old a leaked pod IP allocation must be before it is released, so that allocations for pods that are still being set up are never released")
+	flags.BoolVar(&sdn.adminNetworkPolicy, "admin-network-policy", false, "Enforce the ingress rules of AdminNetworkPolicies and the \"default\" BaselineAdminNetworkPolicy (policy.networking.k8s.io/v1alpha1) before and after NetworkPolicies; policies with egress rules are not enforced at all (with a PolicyRejected warning event), and Deny rules with named ports deny all ports. Requires the NetworkPolicy plugin and the AdminNetworkPolicy CRDs")
+	flags.BoolVar(&sdn.podNetworkStatus, "pod-network-status", false, "Write the k8s.v1.cni.cncf.io/network-status annotation (interface, IPs, MAC, and DNS of the pod network) on each new pod, as Multus does, for tooling that reads it; don't enable this when running under Multus, which writes the annotation itself")
+	flags.StringSliceVar(&sdn.bgpPeers, "bgp-peers", nil, "IPv4 routers (address or address:port) to advertise this node's HostSubnet to over BGP, from --bgp-local-as to --bgp-peer-as (iBGP if they are the same); if set, pod traffic to other nodes is routed by the node's network rather than sent over VXLAN (IPv6 traffic in dual-stack clusters still uses VXLAN). A peer may be a routing daemon such as FRR or GoBGP on the node itself, to handle redistribution, BFD, etc. Only supported with the subnet plugin; nodes that use neither this nor --native-routing are still reached over VXLAN (or Geneve)")
+	flags.Uint32Var(&sdn.bgpLocalAS, "bgp-local-as", 0, "Autonomous system number to advertise this node's HostSubnet from, with --bgp-peers")
+	flags.Uint32Var(&sdn.bgpPeerAS, "bgp-peer-as", 0, "Autonomous system number of the --bgp-peers routers")
+	flags.DurationVar(&sdn.bgpGRTime, "bgp-graceful-restart-time", 120*time.Second, "How long --bgp-peers that support graceful restart keep routing to this node's HostSubnet while its BGP session is down (eg, while openshift-sdn restarts); 0 disables graceful restart")
+	flags.BoolVar(&sdn.nativeRouting, "native-routing", false, "Route IPv4 pod traffic to nodes on the same network as this one directly to them rather than sending it over VXLAN, which is then only used for nodes on other networks. Only supported with the subnet plugin; nodes that don't use it are still reached over VXLAN (or Geneve)")
+	flags.StringSliceVar(&sdn.encapsulations, "encapsulations", nil, "Encapsulations other than VXLAN that this node can receive pod traffic with (currently only \"geneve\"); each pair of nodes uses the most preferred encapsulation that both support (no encapsulation, with --bgp-peers or --native-routing, then Geneve, then VXLAN), so nodes with different encapsulations can be mixed in a cluster")
+	flags.DurationVar(&sdn.execTimeout, "exec-timeout", restrictedexec.DefaultTimeout, "Kill helper commands (iptables, ovs-ofctl, ovs-vsctl, conntrack, etc) that run for longer than this; 0 for no limit")
+	flags.BoolVar(&sdn.execNoNewPrivileges, "exec-no-new-privileges", false, "Set no_new_privs for the helper commands that the node process runs, so that they can't gain privileges through setuid binaries or file capabilities")
 
 	return cmd
 }
@@ -94,6 +217,10 @@ func (sdn *openShiftSDN) run(c *cobra.Command, errout io.Writer, stopCh chan str
 		klog.Fatal(err)
 	}
 
+	if sdn.tracingEndpoint != "" {
+		sdn.startTracing()
+	}
+
 	// Set up a watch on our config file; if it changes, we should exit -
 	// (we don't have the ability to dynamically reload config changes).
 	if err := watchForChanges(sdn.proxyConfigFilePath, stopCh); err != nil {
@@ -112,9 +239,23 @@ func (sdn *openShiftSDN) run(c *cobra.Command, errout io.Writer, stopCh chan str
 	}
 
 	<-stopCh
+	sdn.osdnNode.Stop()
 	time.Sleep(500 * time.Millisecond) // gracefully shut down
 }
 
+// startTracing exports traces to sdn.tracingEndpoint
+func (sdn *openShiftSDN) startTracing() {
+	resourceOpts := []resource.Option{
+		resource.WithAttributes(
+			semconv.ServiceNameKey.String("openshift-sdn"),
+			semconv.HostNameKey.String(sdn.nodeName),
+		),
+	}
+	sampler := sdktrace.TraceIDRatioBased(sdn.tracingSamplingRate)
+	otel.SetTracerProvider(traces.NewProvider(context.Background(), sampler, resourceOpts, otlpgrpc.WithEndpoint(sdn.tracingEndpoint)))
+	klog.Infof("Exporting traces of %g of pod operations to %s", sdn.tracingSamplingRate, sdn.tracingEndpoint)
+}
+
 // validateAndParse validates the command line options, parses the node
 // configuration, and builds the upstream proxy configuration.
 func (sdn *openShiftSDN) validateAndParse() error {
@@ -125,6 +266,28 @@ func (sdn *openShiftSDN) validateAndParse() error {
 		return err
 	}
 
+	if sdn.kubeletConfigFilePath != "" {
+		klog.V(2).Infof("Reading kubelet configuration from %s", sdn.kubeletConfigFilePath)
+		sdn.clusterDNS, sdn.clusterDomain, err = readKubeletDNSConfig(sdn.kubeletConfigFilePath)
+		if err != nil {
+			return err
+		}
+	}
+	if sdn.debugBindAddress != "" && (sdn.debugCertFile == "" || sdn.debugKeyFile == "") {
+		return fmt.Errorf("--debug-bind-address requires --debug-cert-file and --debug-key-file")
+	}
+	if sdn.ipam != sdnnode.HostLocalIPAM && sdn.ipam != sdnnode.ClusterIPAM {
+		return fmt.Errorf("invalid --ipam %q", sdn.ipam)
+	}
+	if len(sdn.bgpPeers) > 0 && (sdn.bgpLocalAS == 0 || sdn.bgpPeerAS == 0) {
+		return fmt.Errorf("--bgp-local-as and --bgp-peer-as must be set with --bgp-peers")
+	}
+	for _, encap := range sdn.encapsulations {
+		if encap != common.EncapsulationVXLAN && encap != common.EncapsulationGeneve {
+			return fmt.Errorf("invalid --encapsulations value %q", encap)
+		}
+	}
+
 	return nil
 }
 
@@ -137,7 +300,23 @@ func (sdn *openShiftSDN) init() error {
 		return fmt.Errorf("failed to build informers: %v", err)
 	}
 
-	sdn.ipt = iptables.New(kexec.New(), iptables.ProtocolIPv4)
+	// All helper commands are run with a minimal environment and limits on
+	// their run time and output
+	execConfig := restrictedexec.Config{
+		Timeout:   sdn.execTimeout,
+		MaxOutput: restrictedexec.DefaultMaxOutput,
+		OnFailure: func(command, reason string) {
+			sdnmetrics.ExecFailures.WithLabelValues(command, reason).Inc()
+		},
+	}
+	if sdn.execNoNewPrivileges {
+		execConfig.Launcher, err = restrictedexec.NewLauncher(setNoNewPrivileges)
+		if err != nil {
+			return fmt.Errorf("failed to restrict helper commands: %v", err)
+		}
+	}
+	sdn.execer = restrictedexec.New(execConfig)
+	sdn.ipt = iptables.New(sdn.execer, iptables.ProtocolIPv4)
 
 	// Configure SDN
 	err = sdn.initSDN()
@@ -169,11 +348,16 @@ func (sdn *openShiftSDN) start(stopCh <-chan struct{}) error {
 
 	klog.V(2).Infof("openshift-sdn network plugin waiting for proxy startup to complete")
 	<-proxyInitChan
-	klog.V(2).Infof("openshift-sdn network plugin registering startup")
-	if err := sdn.writeConfigFile(); err != nil {
-		klog.Fatal(err)
+	if sdn.migrationMode {
+		klog.V(2).Infof("openshift-sdn network plugin in migration mode; not registering startup")
+	} else {
+		klog.V(2).Infof("openshift-sdn network plugin registering startup")
+		if err := sdn.writeConfigFile(); err != nil {
+			klog.Fatal(err)
+		}
 	}
 	klog.V(2).Infof("openshift-sdn network plugin ready")
+	sdn.handleResyncSignals()
 
 	go sdn.ipt.Monitor(iptables.Chain("OPENSHIFT-SDN-CANARY"),
 		[]iptables.Table{iptables.TableMangle, iptables.TableNAT, iptables.TableFilter},
@@ -196,6 +380,62 @@ func (sdn *openShiftSDN) reloadIPTables() {
 	}
 }
 
+// serveReconcile is an HTTP handler that reconciles the node's VNID flows and
+// iptables rules (see OsdnNode.Reconcile) and resyncs the proxy rules. The much
+// more expensive full resync is only available via SIGUSR1.
+func (sdn *openShiftSDN) serveReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := sdn.resync(false); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "reconciled\n")
+}
+
+// nodeResyncer is the part of OsdnNode used by resync
+type nodeResyncer interface {
+	Reconcile() error
+	Resync() error
+}
+
+// resync reconciles or (if full is true) fully resyncs the node rules, and then
+// resyncs the proxy rules
+func (sdn *openShiftSDN) resync(full bool) error {
+	sdn.resyncLock.Lock()
+	defer sdn.resyncLock.Unlock()
+
+	var err error
+	if full {
+		err = sdn.resyncNode.Resync()
+	} else {
+		err = sdn.resyncNode.Reconcile()
+	}
+	if err != nil {
+		return err
+	}
+	if sdn.osdnProxy != nil {
+		sdn.osdnProxy.Sync()
+	}
+	return nil
+}
+
+// handleResyncSignals does a full resync whenever the process receives SIGUSR1
+func (sdn *openShiftSDN) handleResyncSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			klog.Infof("Received SIGUSR1; doing a full resync")
+			if err := sdn.resync(true); err != nil {
+				utilruntime.HandleError(fmt.Errorf("Full resync failed: %v", err))
+			}
+		}
+	}()
+}
+
 // watchForChanges closes stopCh if the configuration file changed.
 func watchForChanges(configPath string, stopCh chan struct{}) error {
 	configPath, err := filepath.Abs(configPath)
@@ -0,0 +1,87 @@
+package openshift_sdn_node
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeResyncer is a nodeResyncer that records its calls
+type fakeResyncer struct {
+	reconciles int
+	resyncs    int
+	err        error
+}
+
+func (fr *fakeResyncer) Reconcile() error {
+	fr.reconciles++
+	return fr.err
+}
+
+func (fr *fakeResyncer) Resync() error {
+	fr.resyncs++
+	return fr.err
+}
+
+func TestServeReconcile(t *testing.T) {
+	node := &fakeResyncer{}
+	sdn := &openShiftSDN{resyncNode: node}
+
+	for _, tc := range []struct {
+		name       string
+		method     string
+		err        error
+		status     int
+		body       string
+		reconciles int
+	}{
+		{
+			name:       "GET",
+			method:     http.MethodGet,
+			status:     http.StatusMethodNotAllowed,
+			body:       "only POST is supported",
+			reconciles: 0,
+		},
+		{
+			name:       "POST",
+			method:     http.MethodPost,
+			status:     http.StatusOK,
+			body:       "reconciled",
+			reconciles: 1,
+		},
+		{
+			name:       "failed POST",
+			method:     http.MethodPost,
+			err:        fmt.Errorf("node has been torn down for migration"),
+			status:     http.StatusInternalServerError,
+			body:       "node has been torn down for migration",
+			reconciles: 2,
+		},
+	} {
+		node.err = tc.err
+		w := httptest.NewRecorder()
+		sdn.serveReconcile(w, httptest.NewRequest(tc.method, "/debug/reconcile", nil))
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, w.Code)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != tc.body {
+			t.Errorf("%s: expected body %q, got %q", tc.name, tc.body, body)
+		}
+		if node.reconciles != tc.reconciles {
+			t.Errorf("%s: expected %d reconciles, got %d", tc.name, tc.reconciles, node.reconciles)
+		}
+	}
+	if node.resyncs != 0 {
+		t.Fatalf("unexpected full resync from /debug/reconcile")
+	}
+
+	node.err = nil
+	if err := sdn.resync(true); err != nil {
+		t.Fatalf("unexpected error from full resync: %v", err)
+	}
+	if node.resyncs != 1 || node.reconciles != 2 {
+		t.Fatalf("expected a single full resync, got %d resyncs and %d reconciles", node.resyncs, node.reconciles)
+	}
+}
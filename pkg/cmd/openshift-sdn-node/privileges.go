@@ -0,0 +1,24 @@
+package openshift_sdn_node
+
+import (
+	"fmt"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+// prSetNoNewPrivs is PR_SET_NO_NEW_PRIVS from linux/prctl.h
+const prSetNoNewPrivs = 38
+
+// setNoNewPrivileges sets no_new_privs on the calling thread. It is inherited by
+// every command the thread executes, so none of them can gain privileges via
+// setuid/setgid binaries or file capabilities. no_new_privs is per-thread, so this
+// is called on the thread of the restrictedexec.Launcher that starts the helper
+// commands.
+func setNoNewPrivileges() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("could not set no_new_privs: %v", errno)
+	}
+	klog.Infof("Set no_new_privs for helper commands")
+	return nil
+}
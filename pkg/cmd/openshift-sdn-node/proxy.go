@@ -6,9 +6,13 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/openshift/sdn/pkg/network/common"
 	sdnproxy "github.com/openshift/sdn/pkg/network/proxy"
 	"github.com/openshift/sdn/pkg/network/proxy/unidler"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	utilnet "k8s.io/apimachinery/pkg/util/net"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
@@ -16,6 +20,8 @@ import (
 	"k8s.io/apiserver/pkg/server/mux"
 	"k8s.io/apiserver/pkg/server/routes"
 	utilfeature "k8s.io/apiserver/pkg/util/feature"
+	"k8s.io/client-go/dynamic"
+	kinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/events"
 	"k8s.io/component-base/metrics/legacyregistry"
@@ -52,7 +58,9 @@ func (sdn *openShiftSDN) initProxy() error {
 		sdn.informers.kubeInformers,
 		sdn.informers.osdnClient,
 		sdn.informers.osdnInformers,
-		sdn.proxyConfig.IPTables.MinSyncPeriod.Duration)
+		sdn.proxyConfig.IPTables.MinSyncPeriod.Duration,
+		sdn.egressDNSResolvConf,
+		sdn.egressDNSServers)
 	return err
 }
 
@@ -62,6 +70,7 @@ func (sdn *openShiftSDN) runProxy(waitChan chan<- bool) {
 	if string(sdn.proxyConfig.Mode) == "disabled" {
 		klog.Warningf("Built-in kube-proxy is disabled")
 		sdn.startMetricsServer()
+		sdn.startDebugServer()
 		close(waitChan)
 		return
 	}
@@ -88,10 +97,13 @@ func (sdn *openShiftSDN) runProxy(waitChan chan<- bool) {
 	eventBroadcaster.StartRecordingToSink(stopCh)
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, "kube-proxy")
 
+	// kube-proxy manages its own commands (eg, its iptables-restore calls may
+	// legitimately run for a long time on large clusters), so it doesn't use the
+	// restricted sdn.execer
 	execer := utilexec.New()
 	iptInterface := utiliptables.New(execer, protocol)
 
-	var healthzServer healthcheck.ProxierHealthUpdater
+	var proxyHealthzServer healthcheck.ProxierHealthUpdater
 	if len(sdn.proxyConfig.HealthzBindAddress) > 0 {
 		nodeRef := &corev1.ObjectReference{
 			Kind:      "Node",
@@ -99,8 +111,12 @@ func (sdn *openShiftSDN) runProxy(waitChan chan<- bool) {
 			UID:       types.UID(sdn.nodeName),
 			Namespace: "",
 		}
-		healthzServer = healthcheck.NewProxierHealthServer(sdn.proxyConfig.HealthzBindAddress, 2*sdn.proxyConfig.IPTables.SyncPeriod.Duration, recorder, nodeRef)
+		proxyHealthzServer = healthcheck.NewProxierHealthServer(sdn.proxyConfig.HealthzBindAddress, 2*sdn.proxyConfig.IPTables.SyncPeriod.Duration, recorder, nodeRef)
 	}
+	// syncHealth lets the node's aggregated /healthz report whether the proxy
+	// rules are up to date
+	syncHealth := sdnproxy.NewSyncHealthTracker(proxyHealthzServer, 2*sdn.proxyConfig.IPTables.SyncPeriod.Duration)
+	healthzServer := healthcheck.ProxierHealthUpdater(syncHealth)
 
 	enableUnidling := false
 	usingEndpointSlices := false
@@ -151,13 +167,16 @@ func (sdn *openShiftSDN) runProxy(waitChan chan<- bool) {
 		if err != nil {
 			klog.Fatalf("error: Could not initialize Kubernetes Proxy. You must run this process as root (and if containerized, in the host network namespace as privileged) to use the service proxy: %v", err)
 		}
+		sdn.osdnNode.AddHealthCheck("iptables", syncHealth.CheckHealth)
 		// No turning back. Remove artifacts that might still exist from the userspace Proxier.
 		klog.V(0).Info("Tearing down userspace rules.")
 		userspace.CleanupLeftovers(iptInterface)
+		if !enableUnidling {
+			unidler.CleanupLeftovers(iptInterface)
+		}
 	case "userspace":
 		klog.V(0).Info("Using userspace Proxier.")
 
-		execer := utilexec.New()
 		proxier, err = userspace.NewProxier(
 			userspace.NewLoadBalancerRR(),
 			bindAddr,
@@ -175,29 +194,33 @@ func (sdn *openShiftSDN) runProxy(waitChan chan<- bool) {
 		// Remove artifacts from the pure-iptables Proxier.
 		klog.V(0).Info("Tearing down pure-iptables proxy rules.")
 		iptables.CleanupLeftovers(iptInterface)
+		unidler.CleanupLeftovers(iptInterface)
 	default:
 		klog.Fatalf("Unknown proxy mode %q", sdn.proxyConfig.Mode)
 	}
 
 	if enableUnidling {
-		signaler := unidler.NewEventSignaler(recorder)
+		signaler, err := sdn.newUnidlingSignaler(recorder)
+		if err != nil {
+			klog.Fatalf("error: Could not initialize unidling: %v", err)
+		}
 		unidlingProxy, err = unidler.NewUnidlerProxier(
-			userspace.NewLoadBalancerRR(),
 			bindAddr,
 			iptInterface,
-			execer,
-			*portRange,
 			sdn.proxyConfig.IPTables.SyncPeriod.Duration,
 			sdn.proxyConfig.IPTables.MinSyncPeriod.Duration,
-			sdn.proxyConfig.UDPIdleTimeout.Duration,
-			sdn.proxyConfig.NodePortAddresses,
+			sdn.unidlingConnTimeout,
 			signaler)
 		if err != nil {
 			klog.Fatalf("error: Could not initialize Kubernetes Proxy. You must run this process as root (and if containerized, in the host network namespace as privileged) to use the service proxy: %v", err)
 		}
 	}
 
-	sdn.osdnProxy.SetBaseProxies(proxier, unidlingProxy)
+	sdn.osdnProxy.SetBaseProxies(proxier, unidlingProxy, healthzServer)
+	if sdn.unidlingPending != nil {
+		// A service no longer needs pods once it has endpoints again
+		sdn.osdnProxy.SetServiceUnidledHandler(sdn.unidlingPending.Forget)
+	}
 	if err := sdn.osdnProxy.Start(waitChan); err != nil {
 		klog.Fatalf("error: node proxy plugin startup failed: %v", err)
 	}
@@ -216,6 +239,19 @@ func (sdn *openShiftSDN) runProxy(waitChan chan<- bool) {
 		)
 		endpointSliceConfig.RegisterEventHandler(sdn.osdnProxy)
 		go endpointSliceConfig.Run(utilwait.NeverStop)
+
+		if utilfeature.DefaultFeatureGate.Enabled(features.TopologyAwareHints) {
+			// The proxy needs the labels of our own Node to honor EndpointSlice
+			// topology hints
+			nodeInformerFactory := kinformers.NewSharedInformerFactoryWithOptions(sdn.informers.kubeClient, sdn.proxyConfig.IPTables.SyncPeriod.Duration,
+				kinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+					options.FieldSelector = fields.OneTermEqualSelector("metadata.name", sdn.nodeName).String()
+				}))
+			nodeConfig := pconfig.NewNodeConfig(nodeInformerFactory.Core().V1().Nodes(), sdn.proxyConfig.IPTables.SyncPeriod.Duration)
+			nodeConfig.RegisterEventHandler(sdn.osdnProxy)
+			go nodeConfig.Run(utilwait.NeverStop)
+			nodeInformerFactory.Start(utilwait.NeverStop)
+		}
 	} else {
 		endpointsConfig := pconfig.NewEndpointsConfig(
 			sdn.informers.kubeInformers.Core().V1().Endpoints(),
@@ -230,8 +266,20 @@ func (sdn *openShiftSDN) runProxy(waitChan chan<- bool) {
 		serveHealthz(healthzServer)
 	}
 
-	// Start up a metrics server if requested
+	// Start up metrics and debug servers if requested
 	sdn.startMetricsServer()
+	sdn.startDebugServer()
+
+	if sdn.idleDetectionPeriod > 0 {
+		idleDetector := sdnproxy.NewIdleDetector(
+			sdn.informers.kubeClient,
+			sdn.informers.kubeInformers.Core().V1().Services().Lister(),
+			execer,
+			protocol,
+			sdn.nodeName,
+			sdn.idleDetectionPeriod)
+		go idleDetector.Run(utilwait.NeverStop)
+	}
 
 	// periodically sync k8s iptables rules
 	go utilwait.Forever(sdn.osdnProxy.SyncLoop, 0)
@@ -248,6 +296,7 @@ func (sdn *openShiftSDN) startMetricsServer() {
 		fmt.Fprintf(w, "%s", sdn.proxyConfig.Mode)
 	})
 	mux.Handle("/metrics", legacyregistry.Handler())
+	mux.HandleFunc("/healthz", sdn.osdnNode.ServeHealthz)
 	if sdn.proxyConfig.EnableProfiling {
 		routes.Profiling{}.Install(mux)
 	}
@@ -259,6 +308,40 @@ func (sdn *openShiftSDN) startMetricsServer() {
 	}, 5*time.Second, utilwait.NeverStop)
 }
 
+// startDebugServer starts serving the debug endpoints over TLS, if requested. They
+// take bearer tokens, so unlike the metrics they are never served in plaintext.
+func (sdn *openShiftSDN) startDebugServer() {
+	if sdn.debugBindAddress == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/networkpolicy/evaluate", sdn.authorized(sdn.osdnNode.ServeConnectionEvaluation))
+	mux.Handle("/debug/diag", sdn.authorized(sdn.osdnNode.ServeDiagnostics))
+	mux.Handle("/debug/trace", sdn.authorized(sdn.osdnNode.ServePacketTrace))
+	mux.Handle("/debug/probe", sdn.authorized(sdn.osdnNode.ServeProbe))
+	mux.Handle("/debug/reconcile", sdn.authorized(sdn.serveReconcile))
+	mux.Handle("/debug/migration", sdn.authorized(sdn.osdnNode.ServeMigrationStatus))
+	if sdn.osdnProxy != nil {
+		mux.Handle("/debug/proxy/services", sdn.authorized(sdn.osdnProxy.ServeServiceProxyStates))
+	}
+	if sdn.unidlingPending != nil {
+		mux.Handle("/unidling/pending", sdn.authorized(sdn.unidlingPending.ServeHTTP))
+	}
+	go utilwait.Until(func() {
+		err := http.ListenAndServeTLS(sdn.debugBindAddress, sdn.debugCertFile, sdn.debugKeyFile, mux)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("starting debug server failed: %v", err))
+		}
+	}, 5*time.Second, utilwait.NeverStop)
+}
+
+// authorized wraps a debug handler so that it can only be used with the bearer
+// token of a user who is authorized for its path
+func (sdn *openShiftSDN) authorized(handler http.HandlerFunc) http.Handler {
+	return common.RequireAuthorization(sdn.informers.kubeClient, handler)
+}
+
 func serveHealthz(hz healthcheck.ProxierHealthUpdater) {
 	go utilwait.Until(func() {
 		err := hz.Run()
@@ -271,3 +354,45 @@ func serveHealthz(hz healthcheck.ProxierHealthUpdater) {
 		}
 	}, 5*time.Second, utilwait.NeverStop)
 }
+
+// newUnidlingSignaler returns the NeedPodsSignaler for the configured unidling signalers
+func (sdn *openShiftSDN) newUnidlingSignaler(recorder events.EventRecorder) (unidler.NeedPodsSignaler, error) {
+	signalers := []unidler.NeedPodsSignaler{}
+	for _, name := range sdn.unidlingSignalers {
+		switch name {
+		case unidler.EventSignalerName:
+			signalers = append(signalers, unidler.NewEventSignaler(recorder))
+		case unidler.WebhookSignalerName:
+			if sdn.unidlingWebhookURL == "" {
+				return nil, fmt.Errorf("--unidling-webhook-url is required with the %q unidling signaler", name)
+			}
+			signalers = append(signalers, unidler.NewWebhookSignaler(sdn.unidlingWebhookURL))
+		case unidler.ResourceSignalerName:
+			gvr, _ := schema.ParseResourceArg(sdn.unidlingSignalerResource)
+			if gvr == nil {
+				return nil, fmt.Errorf("--unidling-signaler-resource must be of the form \"resource.version.group\" with the %q unidling signaler", name)
+			}
+			kubeConfig, err := getInClusterConfig()
+			if err != nil {
+				return nil, err
+			}
+			client, err := dynamic.NewForConfig(kubeConfig)
+			if err != nil {
+				return nil, err
+			}
+			signalers = append(signalers, unidler.NewResourceSignaler(client, *gvr))
+		case unidler.PendingSignalerName:
+			if sdn.unidlingPendingTTL <= 0 {
+				return nil, fmt.Errorf("--unidling-pending-ttl must be positive with the %q unidling signaler", name)
+			}
+			sdn.unidlingPending = unidler.NewPendingWakeSignaler(sdn.unidlingPendingTTL)
+			signalers = append(signalers, sdn.unidlingPending)
+		default:
+			return nil, fmt.Errorf("unknown unidling signaler %q", name)
+		}
+	}
+	if len(signalers) == 0 {
+		return nil, fmt.Errorf("no unidling signalers configured")
+	}
+	return unidler.NewMultiSignaler(signalers...), nil
+}
@@ -1,9 +1,15 @@
 package openshift_sdn_node
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
 
 	corev1 "k8s.io/api/core/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes/scheme"
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/record"
@@ -13,12 +19,55 @@ import (
 
 const openshiftCNIFile string = "/etc/cni/net.d/80-openshift-network.conf"
 
+// kubeletDNSConfig holds the fields of a KubeletConfiguration (kubelet.config.k8s.io)
+// that determine pod DNS
+type kubeletDNSConfig struct {
+	ClusterDNS    []string `json:"clusterDNS"`
+	ClusterDomain string   `json:"clusterDomain"`
+}
+
+// readKubeletDNSConfig returns the cluster DNS server IPs and cluster domain from
+// the kubelet configuration file filename
+func readKubeletDNSConfig(filename string) ([]string, string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, "", err
+	}
+	config := &kubeletDNSConfig{}
+	if err := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096).Decode(config); err != nil {
+		return nil, "", fmt.Errorf("could not parse kubelet configuration %s: %v", filename, err)
+	}
+	for _, ip := range config.ClusterDNS {
+		if net.ParseIP(ip) == nil {
+			return nil, "", fmt.Errorf("invalid clusterDNS IP %q in kubelet configuration %s", ip, filename)
+		}
+	}
+	return config.ClusterDNS, config.ClusterDomain, nil
+}
+
 // initSDN sets up the sdn process.
 func (sdn *openShiftSDN) initSDN() error {
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: sdn.informers.kubeClient.CoreV1().Events("")})
 	sdn.sdnRecorder = eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "openshift-sdn", Host: sdn.nodeName})
 
+	var dynamicClient, ipamClient, adminPolicyClient dynamic.Interface
+	if sdn.ipam == sdnnode.ClusterIPAM || sdn.adminNetworkPolicy {
+		kubeConfig, err := getInClusterConfig()
+		if err != nil {
+			return err
+		}
+		if dynamicClient, err = dynamic.NewForConfig(kubeConfig); err != nil {
+			return err
+		}
+	}
+	if sdn.ipam == sdnnode.ClusterIPAM {
+		ipamClient = dynamicClient
+	}
+	if sdn.adminNetworkPolicy {
+		adminPolicyClient = dynamicClient
+	}
+
 	var err error
 	sdn.osdnNode, err = sdnnode.New(&sdnnode.OsdnNodeConfig{
 		NodeName:      sdn.nodeName,
@@ -28,11 +77,57 @@ func (sdn *openShiftSDN) initSDN() error {
 		KubeInformers: sdn.informers.kubeInformers,
 		OSDNInformers: sdn.informers.osdnInformers,
 		IPTables:      sdn.ipt,
+		Exec:          sdn.execer,
 		MasqueradeBit: sdn.proxyConfig.IPTables.MasqueradeBit,
 		ProxyMode:     sdn.proxyConfig.Mode,
 		Recorder:      sdn.sdnRecorder,
+
+		EgressDNSServers:    sdn.egressDNSServers,
+		EgressDNSResolvConf: sdn.egressDNSResolvConf,
+		ClusterDNS:          sdn.clusterDNS,
+		ClusterDomain:       sdn.clusterDomain,
+		ReconcilePeriod:     sdn.reconcilePeriod,
+
+		ConnectionLogPath:    sdn.connectionLogPath,
+		ConnectionLogQPS:     sdn.connectionLogQPS,
+		ConnectionLogMaxSize: sdn.connectionLogMaxSize,
+
+		MigrationMode:       sdn.migrationMode,
+		MigrationTornDown:   sdn.removeConfigFile,
+		NICOffloadCheck:     sdn.nicOffloadCheck,
+		NeighborGCThreshMax: sdn.neighborGCThreshMax,
+		OVSFlowLimit:        sdn.ovsFlowLimit,
+		OVSTableFlowLimit:   sdn.ovsTableFlowLimit,
+
+		CNIAllowedExecutables: sdn.cniAllowedExecutables,
+		PodReattachWorkers:    sdn.podReattachWorkers,
+
+		EgressFirewallExemptNodeSelector: sdn.egressFirewallExemptNodeSelector,
+		MulticastGatewayGroups:           sdn.multicastGatewayGroups,
+
+		IPAM:       sdn.ipam,
+		IPAMClient: ipamClient,
+
+		IPAMLeakCheckPeriod: sdn.ipamLeakCheckPeriod,
+		IPAMLeakMinAge:      sdn.ipamLeakMinAge,
+
+		PodNetworkStatus: sdn.podNetworkStatus,
+
+		AdminNetworkPolicyClient: adminPolicyClient,
+
+		BGPPeers:               sdn.bgpPeers,
+		BGPLocalAS:             sdn.bgpLocalAS,
+		BGPPeerAS:              sdn.bgpPeerAS,
+		BGPGracefulRestartTime: sdn.bgpGRTime,
+
+		NativeRouting:  sdn.nativeRouting,
+		Encapsulations: sdn.encapsulations,
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	sdn.resyncNode = sdn.osdnNode
+	return nil
 }
 
 // runSDN starts the sdn node process. Returns.
@@ -54,3 +149,11 @@ func (sdn *openShiftSDN) writeConfigFile() error {
 }
 `), 0644)
 }
+
+// removeConfigFile removes our CNI config file, at the end of a migration
+func (sdn *openShiftSDN) removeConfigFile() error {
+	if err := os.Remove(openshiftCNIFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package cniserver
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,12 +9,21 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/klog/v2"
 
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
 	utilwait "k8s.io/apimachinery/pkg/util/wait"
 )
 
@@ -40,7 +50,10 @@ import (
 // by root and inaccessible to any other user, no unprivileged process may
 // access the CNIServer.  The Unix domain socket and its parent directory are
 // removed and re-created with 0700 permissions each time openshift-node is
-// started.
+// started. As defense-in-depth, the CNIServer also checks the credentials of
+// each connecting process with SO_PEERCRED, rejecting connections from
+// processes not running as root, and, if SetAllowedExecutables() has been
+// called, from processes not running one of the allowed executables.
 
 // Default directory for CNIServer runtime files
 const CNIServerRunDir string = "/var/run/openshift-sdn/cniserver"
@@ -53,12 +66,155 @@ const CNIServerSocketPath string = CNIServerRunDir + "/" + CNIServerSocketName
 const CNIServerConfigFileName string = "config.json"
 const CNIServerConfigFilePath string = CNIServerRunDir + "/" + CNIServerConfigFileName
 
+// How long CheckHealth waits to connect to the socket
+const healthCheckTimeout = 5 * time.Second
+
+// tracer traces pod requests. It does nothing unless a global TracerProvider has
+// been configured.
+var tracer = otel.Tracer("github.com/openshift/sdn/pkg/network/common/cniserver")
+
 // Server-to-plugin config data
 type Config struct {
 	MTU                uint32 `json:"mtu"`
 	ServiceNetworkCIDR string `json:"serviceNetworkCIDR"`
 }
 
+// PluginType is the "type" of the openshift-sdn plugin in CNI network configuration
+const PluginType string = "openshift-sdn"
+
+// NetConf is the CNI network configuration passed to the plugin. When the plugin
+// is invoked as a Multus delegate, the configuration may contain keys and runtime
+// capabilities (eg "portMappings" or "ips") that the plugin doesn't use; these are
+// ignored rather than rejected.
+type NetConf struct {
+	CNIVersion string `json:"cniVersion,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Type       string `json:"type,omitempty"`
+
+	// MTU is accepted for compatibility with generated configurations, but pods
+	// always get the SDN MTU, so it can't be larger than that
+	MTU int `json:"mtu,omitempty"`
+
+	RuntimeConfig map[string]json.RawMessage `json:"runtimeConfig,omitempty"`
+}
+
+// CNI error codes, as defined by the CNI specification. (The vendored CNI library
+// only defines the first few.)
+const (
+	ErrIncompatibleCNIVersion      uint = cnitypes.ErrIncompatibleCNIVersion
+	ErrUnsupportedField            uint = cnitypes.ErrUnsupportedField
+	ErrInvalidEnvironmentVariables uint = 4
+	ErrDecodingFailure             uint = 6
+	ErrInvalidNetworkConfig        uint = 7
+
+	// ErrInternal is the code for any other error, matching what skel uses for
+	// errors that aren't already a *types.Error
+	ErrInternal uint = 100
+
+	// ErrHostPortConflict is our own code for a pod whose hostPorts are already
+	// in use on the node; the error details list the conflicting ports as JSON
+	ErrHostPortConflict uint = 101
+)
+
+// newError returns a CNI error object with the given code. The CNIServer returns
+// these to the plugin as JSON, so that they can be passed on to the runtime as-is.
+func newError(code uint, details string, format string, args ...interface{}) error {
+	return &cnitypes.Error{Code: code, Msg: fmt.Sprintf(format, args...), Details: details}
+}
+
+// netConfKeys are the network configuration keys that the plugin accepts. Besides
+// our own keys, this includes the keys that the CNI specification allows a runtime
+// to add to any configuration.
+var netConfKeys = sets.NewString(
+	"cniVersion", "name", "type", "mtu",
+	"args", "capabilities", "runtimeConfig", "prevResult", "ipam", "dns",
+)
+
+// minMTU is the smallest MTU that can be set in the network configuration; every
+// IPv4 host must be able to accept 576-byte datagrams
+const minMTU = 576
+
+// parseNetConf parses and checks a CNIRequest's network configuration. maxMTU is
+// the SDN MTU, or 0 if unknown. The configuration is only enforced for ADD; for
+// other commands, problems are logged and ignored, since a pod must always be able
+// to be torn down, even if its configuration has since been changed to one that
+// would no longer be accepted.
+func parseNetConf(config []byte, cmd CNICommand, maxMTU uint32) (*NetConf, error) {
+	var conf NetConf
+	if len(config) == 0 {
+		return &conf, nil
+	}
+	var keys map[string]json.RawMessage
+	err := json.Unmarshal(config, &keys)
+	if err == nil {
+		err = json.Unmarshal(config, &conf)
+	}
+	if err != nil {
+		if cmd != CNI_ADD {
+			klog.Warningf("Ignoring invalid network configuration for %s: %v", cmd, err)
+			return &NetConf{}, nil
+		}
+		return nil, newError(ErrDecodingFailure, err.Error(), "invalid network configuration")
+	}
+	if err := checkNetConf(&conf, keys, maxMTU); err != nil {
+		if cmd != CNI_ADD {
+			klog.Warningf("Ignoring invalid network configuration for %s: %v", cmd, err)
+			return &conf, nil
+		}
+		return nil, err
+	}
+
+	if len(conf.RuntimeConfig) > 0 {
+		keys := make([]string, 0, len(conf.RuntimeConfig))
+		for key := range conf.RuntimeConfig {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		klog.V(5).Infof("Ignoring unsupported runtime capabilities %s", strings.Join(keys, ", "))
+	}
+	return &conf, nil
+}
+
+// checkNetConf checks a parsed network configuration (with its raw keys)
+func checkNetConf(conf *NetConf, keys map[string]json.RawMessage, maxMTU uint32) error {
+	// If we are one of several delegates (eg, of Multus), make sure we've been
+	// given our own configuration and not another plugin's
+	if conf.Type != "" && conf.Type != PluginType {
+		return newError(ErrInvalidNetworkConfig, "", "network configuration %q is for plugin %q, not %q", conf.Name, conf.Type, PluginType)
+	}
+
+	var unknown []string
+	for key := range keys {
+		if !netConfKeys.Has(key) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return newError(ErrUnsupportedField, fmt.Sprintf("supported keys are %s", strings.Join(netConfKeys.List(), ", ")),
+			"unsupported network configuration keys %s", strings.Join(unknown, ", "))
+	}
+
+	confVersion := conf.CNIVersion
+	if confVersion == "" {
+		confVersion = "0.1.0"
+	}
+	if !sets.NewString(version.All.SupportedVersions()...).Has(confVersion) {
+		return newError(ErrIncompatibleCNIVersion, fmt.Sprintf("supported versions are %s", strings.Join(version.All.SupportedVersions(), ", ")),
+			"unsupported CNI version %q", conf.CNIVersion)
+	}
+
+	if conf.MTU != 0 {
+		if conf.MTU < minMTU {
+			return newError(ErrInvalidNetworkConfig, fmt.Sprintf("the minimum MTU is %d", minMTU), "invalid MTU %d", conf.MTU)
+		}
+		if maxMTU != 0 && conf.MTU > int(maxMTU) {
+			return newError(ErrInvalidNetworkConfig, fmt.Sprintf("the SDN MTU is %d", maxMTU), "invalid MTU %d", conf.MTU)
+		}
+	}
+	return nil
+}
+
 // Explicit type for CNI commands the server handles
 type CNICommand string
 
@@ -74,6 +230,20 @@ type CNIRequest struct {
 	Config []byte `json:"config,omitempty"`
 	// Host side of the veth pair (for an ADD command)
 	HostVeth string `json:"hostVeth,omitempty"`
+	// MAC address of the container side of the veth pair (for an ADD command)
+	PodMAC string `json:"podMAC,omitempty"`
+	// When the plugin created the veth pair and set up the pod's iptables rules
+	// (for an ADD command), so that they can be included in the request's trace
+	// and metrics
+	VethSetup     *StageTiming `json:"vethSetup,omitempty"`
+	IPTablesSetup *StageTiming `json:"iptablesSetup,omitempty"`
+}
+
+// StageTiming is the start and end time of a stage of pod setup performed by the
+// plugin
+type StageTiming struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
 }
 
 // Request structure built from CNIRequest which is passed to the
@@ -91,10 +261,41 @@ type PodRequest struct {
 	Netns string
 	// for an ADD request, the host side of the created veth
 	HostVeth string
+	// for an ADD request, the MAC address of the container side of the veth, if
+	// the plugin reported it
+	PodMAC string
 	// for an ADD request, the (optional) already-assigned IP
 	AssignedIP string
+	// for an ADD request, the (optional) already-assigned IPv6 address
+	AssignedIPv6 string
+	// the name of the network from the CNI configuration, if any
+	NetworkName string
+	// for an ADD request, the stages of pod setup already performed by the plugin,
+	// if it reported them
+	VethSetup     *StageTiming
+	IPTablesSetup *StageTiming
 	// Channel for returning the operation result to the CNIServer
 	Result chan *PodResult
+
+	// ctx carries the request's trace span
+	ctx context.Context
+}
+
+// Context returns the request's context, which carries its trace span
+func (req *PodRequest) Context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+	return req.ctx
+}
+
+// TraceID returns the ID of the request's trace, or "" if it is not being traced
+func (req *PodRequest) TraceID() string {
+	sc := trace.SpanContextFromContext(req.Context())
+	if !sc.IsSampled() {
+		return ""
+	}
+	return sc.TraceID().String()
 }
 
 // Result of a PodRequest sent through the PodRequest's Result channel.
@@ -114,6 +315,8 @@ type CNIServer struct {
 	requestFunc cniRequestFunc
 	rundir      string
 	config      *Config
+
+	allowedExecutables []string
 }
 
 // Create and return a new CNIServer object which will listen on a socket in the given path
@@ -132,6 +335,13 @@ func NewCNIServer(rundir string, config *Config) *CNIServer {
 	return s
 }
 
+// SetAllowedExecutables restricts connections to the CNIServer to processes
+// running one of the given executables (in addition to the server's own process).
+// It must be called before Start().
+func (s *CNIServer) SetAllowedExecutables(paths []string) {
+	s.allowedExecutables = paths
+}
+
 // Start the CNIServer's local HTTP server on a root-owned Unix domain socket.
 // requestFunc will be called to handle pod setup/teardown operations on each
 // request to the CNIServer's HTTP server, and should return a PodResult
@@ -191,14 +401,26 @@ func (s *CNIServer) Start(requestFunc cniRequestFunc) error {
 	}
 
 	s.SetKeepAlivesEnabled(false)
+	pcl := newPeerCredListener(l, s.allowedExecutables)
 	go utilwait.Forever(func() {
-		if err := s.Serve(l); err != nil {
+		if err := s.Serve(pcl); err != nil {
 			utilruntime.HandleError(fmt.Errorf("CNI server Serve() failed: %v", err))
 		}
 	}, 0)
 	return nil
 }
 
+// CheckHealth checks that the CNIServer is accepting connections on its socket
+func (s *CNIServer) CheckHealth() error {
+	socketPath := filepath.Join(s.rundir, CNIServerSocketName)
+	conn, err := net.DialTimeout("unix", socketPath, healthCheckTimeout)
+	if err != nil {
+		return fmt.Errorf("could not connect to CNI server socket: %v", err)
+	}
+	conn.Close()
+	return nil
+}
+
 func ReadConfig(configPath string) (*Config, error) {
 	bytes, err := ioutil.ReadFile(configPath)
 	if err != nil {
@@ -222,49 +444,62 @@ func ReadConfig(configPath string) (*Config, error) {
 func gatherCNIArgs(env map[string]string) (map[string]string, error) {
 	cniArgs, ok := env["CNI_ARGS"]
 	if !ok {
-		return nil, fmt.Errorf("missing CNI_ARGS: '%s'", env)
+		return nil, newError(ErrInvalidEnvironmentVariables, "", "missing CNI_ARGS")
 	}
 
+	// Runtimes and meta-plugins like Multus may pass additional arguments (eg,
+	// "IgnoreUnknown=1;K8S_POD_UID=..."), possibly with a trailing ";"
 	mapArgs := make(map[string]string)
 	for _, arg := range strings.Split(cniArgs, ";") {
-		parts := strings.Split(arg, "=")
+		if strings.TrimSpace(arg) == "" {
+			continue
+		}
+		parts := strings.SplitN(arg, "=", 2)
 		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid CNI_ARG '%s'", arg)
+			return nil, newError(ErrInvalidEnvironmentVariables, "", "invalid CNI_ARG '%s'", arg)
 		}
 		mapArgs[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
 	}
 	return mapArgs, nil
 }
 
-func cniRequestToPodRequest(r *http.Request) (*PodRequest, error) {
+func cniRequestToPodRequest(r *http.Request, config *Config) (*PodRequest, error) {
 	var cr CNIRequest
 	b, _ := ioutil.ReadAll(r.Body)
 	if err := json.Unmarshal(b, &cr); err != nil {
-		return nil, fmt.Errorf("JSON unmarshal error: %v", err)
+		return nil, newError(ErrDecodingFailure, err.Error(), "JSON unmarshal error")
 	}
 
 	cmd, ok := cr.Env["CNI_COMMAND"]
 	if !ok {
-		return nil, fmt.Errorf("unexpected or missing CNI_COMMAND")
+		return nil, newError(ErrInvalidEnvironmentVariables, "", "unexpected or missing CNI_COMMAND")
+	}
+	conf, err := parseNetConf(cr.Config, CNICommand(cmd), config.MTU)
+	if err != nil {
+		return nil, err
 	}
 
 	req := &PodRequest{
-		Command: CNICommand(cmd),
-		Result:  make(chan *PodResult),
+		Command:     CNICommand(cmd),
+		NetworkName: conf.Name,
+		Result:      make(chan *PodResult),
 	}
 
 	req.SandboxID, ok = cr.Env["CNI_CONTAINERID"]
 	if !ok {
-		return nil, fmt.Errorf("missing CNI_CONTAINERID")
+		return nil, newError(ErrInvalidEnvironmentVariables, "", "missing CNI_CONTAINERID")
 	}
 	req.Netns, ok = cr.Env["CNI_NETNS"]
 	if !ok {
-		return nil, fmt.Errorf("missing CNI_NETNS")
+		return nil, newError(ErrInvalidEnvironmentVariables, "", "missing CNI_NETNS")
 	}
 
 	req.HostVeth = cr.HostVeth
+	req.PodMAC = cr.PodMAC
+	req.VethSetup = cr.VethSetup
+	req.IPTablesSetup = cr.IPTablesSetup
 	if req.HostVeth == "" && req.Command == CNI_ADD {
-		return nil, fmt.Errorf("missing HostVeth")
+		return nil, newError(ErrInternal, "", "missing HostVeth")
 	}
 
 	cniArgs, err := gatherCNIArgs(cr.Env)
@@ -274,30 +509,62 @@ func cniRequestToPodRequest(r *http.Request) (*PodRequest, error) {
 
 	req.PodNamespace, ok = cniArgs["K8S_POD_NAMESPACE"]
 	if !ok {
-		return nil, fmt.Errorf("missing K8S_POD_NAMESPACE")
+		return nil, newError(ErrInvalidEnvironmentVariables, "", "missing K8S_POD_NAMESPACE")
 	}
 
 	req.PodName, ok = cniArgs["K8S_POD_NAME"]
 	if !ok {
-		return nil, fmt.Errorf("missing K8S_POD_NAME")
+		return nil, newError(ErrInvalidEnvironmentVariables, "", "missing K8S_POD_NAME")
 	}
 
 	return req, nil
 }
 
+// writeError returns err to the CNI server client as a CNI error object
+func writeError(w http.ResponseWriter, err error) {
+	cniErr, ok := err.(*cnitypes.Error)
+	if !ok {
+		cniErr = &cnitypes.Error{Code: ErrInternal, Msg: err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(w).Encode(cniErr); err != nil {
+		klog.Warningf("Error writing CNI error response: %v", err)
+	}
+}
+
 // Dispatch a pod request to the request handler and return the result to the
 // CNI server client
 func (s *CNIServer) handleCNIRequest(w http.ResponseWriter, r *http.Request) {
-	req, err := cniRequestToPodRequest(r)
+	req, err := cniRequestToPodRequest(r, s.config)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("%v", err), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
+	ctx, span := tracer.Start(r.Context(), "CNI "+string(req.Command), trace.WithAttributes(
+		attribute.String("k8s.pod.namespace", req.PodNamespace),
+		attribute.String("k8s.pod.name", req.PodName),
+		attribute.String("sandbox", req.SandboxID),
+	))
+	defer span.End()
+	for name, stage := range map[string]*StageTiming{"veth": req.VethSetup, "iptables": req.IPTablesSetup} {
+		if stage != nil {
+			_, stageSpan := tracer.Start(ctx, name, trace.WithTimestamp(stage.Start))
+			stageSpan.End(trace.WithTimestamp(stage.End))
+		}
+	}
+	req.ctx = ctx
+	if traceID := req.TraceID(); traceID != "" {
+		klog.Infof("Tracing %s for pod %s/%s as trace %s", req.Command, req.PodNamespace, req.PodName, traceID)
+	}
+
 	klog.V(5).Infof("Waiting for %s result for pod %s/%s", req.Command, req.PodNamespace, req.PodName)
 	result, err := s.requestFunc(req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("%v", err), http.StatusBadRequest)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		writeError(w, err)
 	} else {
 		// Empty response JSON means success with no body
 		w.Header().Set("Content-Type", "application/json")
@@ -2,6 +2,7 @@ package cniserver
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -11,8 +12,13 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
 	utiltesting "k8s.io/client-go/util/testing"
 
 	cnitypes "github.com/containernetworking/cni/pkg/types"
@@ -88,6 +94,7 @@ func TestCNIServer(t *testing.T) {
 		request     *CNIRequest
 		result      cnitypes.Result
 		errorPrefix string
+		errorCode   uint
 	}
 
 	testcases := []testcase{
@@ -120,6 +127,20 @@ func TestCNIServer(t *testing.T) {
 			},
 			result: nil,
 		},
+		// DEL with a configuration that ADD would reject
+		{
+			name: "DEL2",
+			request: &CNIRequest{
+				Env: map[string]string{
+					"CNI_COMMAND":     string(CNI_DEL),
+					"CNI_CONTAINERID": "adsfadsfasfdasdfasf",
+					"CNI_NETNS":       "/path/to/something",
+					"CNI_ARGS":        "K8S_POD_NAMESPACE=awesome-namespace;K8S_POD_NAME=awesome-name",
+				},
+				Config: []byte("{\"cniVersion\": \"1.0.0\",\"name\": \"openshift-sdn\",\"type\": \"openshift-sdn\",\"bridge\": \"br1\",\"mtu\": 9000}"),
+			},
+			result: nil,
+		},
 		// Normal UPDATE request
 		{
 			name: "UPDATE",
@@ -148,6 +169,7 @@ func TestCNIServer(t *testing.T) {
 			},
 			result:      nil,
 			errorPrefix: "missing CNI_ARGS",
+			errorCode:   ErrInvalidEnvironmentVariables,
 		},
 		// Missing CNI_NETNS
 		{
@@ -194,6 +216,104 @@ func TestCNIServer(t *testing.T) {
 			result:      nil,
 			errorPrefix: "missing HostVeth",
 		},
+		// ADD request from Multus, with extra CNI_ARGS and runtime capabilities
+		{
+			name: "MULTUS",
+			request: &CNIRequest{
+				Env: map[string]string{
+					"CNI_COMMAND":     string(CNI_ADD),
+					"CNI_CONTAINERID": "adsfadsfasfdasdfasf",
+					"CNI_NETNS":       "/path/to/something",
+					"CNI_ARGS":        "IgnoreUnknown=true;K8S_POD_NAMESPACE=awesome-namespace;K8S_POD_NAME=awesome-name;K8S_POD_INFRA_CONTAINER_ID=adsfadsfasfdasdfasf;K8S_POD_UID=3e0b4a8c-0d4e-4a3b-9b5e-3c5a0a0e2f51;",
+				},
+				Config:   []byte("{\"cniVersion\": \"0.3.1\",\"name\": \"openshift-sdn\",\"type\": \"openshift-sdn\",\"runtimeConfig\": {\"portMappings\": [], \"mac\": \"0a:58:0a:80:00:05\"}}"),
+				HostVeth: "vethABC",
+			},
+			result: expectedResult,
+		},
+		// Another plugin's configuration
+		{
+			name: "CONFIG",
+			request: &CNIRequest{
+				Env: map[string]string{
+					"CNI_COMMAND":     string(CNI_ADD),
+					"CNI_CONTAINERID": "adsfadsfasfdasdfasf",
+					"CNI_NETNS":       "/path/to/something",
+					"CNI_ARGS":        "K8S_POD_NAMESPACE=awesome-namespace;K8S_POD_NAME=awesome-name",
+				},
+				Config:   []byte("{\"cniVersion\": \"0.3.1\",\"name\": \"macvlan-net\",\"type\": \"macvlan\"}"),
+				HostVeth: "vethABC",
+			},
+			result:      nil,
+			errorPrefix: "network configuration \"macvlan-net\" is for plugin \"macvlan\"",
+			errorCode:   ErrInvalidNetworkConfig,
+		},
+		// Unknown configuration key
+		{
+			name: "CONFIG2",
+			request: &CNIRequest{
+				Env: map[string]string{
+					"CNI_COMMAND":     string(CNI_ADD),
+					"CNI_CONTAINERID": "adsfadsfasfdasdfasf",
+					"CNI_NETNS":       "/path/to/something",
+					"CNI_ARGS":        "K8S_POD_NAMESPACE=awesome-namespace;K8S_POD_NAME=awesome-name",
+				},
+				Config:   []byte("{\"cniVersion\": \"0.3.1\",\"name\": \"openshift-sdn\",\"type\": \"openshift-sdn\",\"bridge\": \"br1\"}"),
+				HostVeth: "vethABC",
+			},
+			result:      nil,
+			errorPrefix: "unsupported network configuration keys bridge",
+			errorCode:   ErrUnsupportedField,
+		},
+		// Unsupported CNI version
+		{
+			name: "CONFIG3",
+			request: &CNIRequest{
+				Env: map[string]string{
+					"CNI_COMMAND":     string(CNI_ADD),
+					"CNI_CONTAINERID": "adsfadsfasfdasdfasf",
+					"CNI_NETNS":       "/path/to/something",
+					"CNI_ARGS":        "K8S_POD_NAMESPACE=awesome-namespace;K8S_POD_NAME=awesome-name",
+				},
+				Config:   []byte("{\"cniVersion\": \"1.0.0\",\"name\": \"openshift-sdn\",\"type\": \"openshift-sdn\"}"),
+				HostVeth: "vethABC",
+			},
+			result:      nil,
+			errorPrefix: "unsupported CNI version \"1.0.0\"",
+			errorCode:   ErrIncompatibleCNIVersion,
+		},
+		// MTU larger than the SDN MTU
+		{
+			name: "CONFIG4",
+			request: &CNIRequest{
+				Env: map[string]string{
+					"CNI_COMMAND":     string(CNI_ADD),
+					"CNI_CONTAINERID": "adsfadsfasfdasdfasf",
+					"CNI_NETNS":       "/path/to/something",
+					"CNI_ARGS":        "K8S_POD_NAMESPACE=awesome-namespace;K8S_POD_NAME=awesome-name",
+				},
+				Config:   []byte("{\"cniVersion\": \"0.3.1\",\"name\": \"openshift-sdn\",\"type\": \"openshift-sdn\",\"mtu\": 9000}"),
+				HostVeth: "vethABC",
+			},
+			result:      nil,
+			errorPrefix: "invalid MTU 9000",
+			errorCode:   ErrInvalidNetworkConfig,
+		},
+		// Valid MTU
+		{
+			name: "CONFIG5",
+			request: &CNIRequest{
+				Env: map[string]string{
+					"CNI_COMMAND":     string(CNI_ADD),
+					"CNI_CONTAINERID": "adsfadsfasfdasdfasf",
+					"CNI_NETNS":       "/path/to/something",
+					"CNI_ARGS":        "K8S_POD_NAMESPACE=awesome-namespace;K8S_POD_NAME=awesome-name",
+				},
+				Config:   []byte("{\"cniVersion\": \"0.3.1\",\"name\": \"openshift-sdn\",\"type\": \"openshift-sdn\",\"mtu\": 1450}"),
+				HostVeth: "vethABC",
+			},
+			result: expectedResult,
+		},
 	}
 
 	for _, tc := range testcases {
@@ -215,8 +335,15 @@ func TestCNIServer(t *testing.T) {
 			if code != http.StatusBadRequest {
 				t.Fatalf("[%s] expected status %v but got %v", tc.name, http.StatusBadRequest, code)
 			}
-			if !strings.HasPrefix(string(body), tc.errorPrefix) {
-				t.Fatalf("[%s] unexpected error message '%v'", tc.name, string(body))
+			cniErr := &cnitypes.Error{}
+			if err := json.Unmarshal(body, cniErr); err != nil {
+				t.Fatalf("[%s] failed to unmarshal error '%s': %v", tc.name, string(body), err)
+			}
+			if !strings.HasPrefix(cniErr.Msg, tc.errorPrefix) {
+				t.Fatalf("[%s] unexpected error message '%v'", tc.name, cniErr.Msg)
+			}
+			if tc.errorCode != 0 && cniErr.Code != tc.errorCode {
+				t.Fatalf("[%s] expected error code %d but got %d", tc.name, tc.errorCode, cniErr.Code)
 			}
 		}
 	}
@@ -291,3 +418,161 @@ func TestCNIServerDirectory(t *testing.T) {
 		t.Fatalf("rundir was deleted (%v)", err)
 	}
 }
+
+func TestCNIServerCheckHealth(t *testing.T) {
+	tmpDir, err := utiltesting.MkTmpdir("cniserver")
+	if err != nil {
+		t.Fatalf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	s := NewCNIServer(tmpDir, &Config{MTU: 1500, ServiceNetworkCIDR: "172.30.0.0/16"})
+	if err := s.CheckHealth(); err == nil {
+		t.Fatalf("unexpected success checking health of unstarted CNI server")
+	}
+	if err := s.Start(serverHandleCNI); err != nil {
+		t.Fatalf("error starting CNI server: %v", err)
+	}
+	if err := s.CheckHealth(); err != nil {
+		t.Fatalf("unexpected error checking health of CNI server: %v", err)
+	}
+}
+
+func TestCNIServerPeerCred(t *testing.T) {
+	tmpDir, err := utiltesting.MkTmpdir("cniserver")
+	if err != nil {
+		t.Fatalf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The server's own process is always allowed, even if it isn't listed
+	s := NewCNIServer(tmpDir, &Config{MTU: 1500, ServiceNetworkCIDR: "172.30.0.0/16"})
+	s.SetAllowedExecutables([]string{"/opt/cni/bin/openshift-sdn"})
+	if err := s.Start(serverHandleCNI); err != nil {
+		t.Fatalf("error starting CNI server: %v", err)
+	}
+	if err := s.CheckHealth(); err != nil {
+		t.Fatalf("unexpected error checking health of CNI server: %v", err)
+	}
+
+	pcl := newPeerCredListener(nil, []string{"/opt/cni/bin/openshift-sdn"})
+	if err := pcl.checkPeerCred(1234, 0, "/opt/cni/bin/openshift-sdn"); err != nil {
+		t.Fatalf("unexpected error checking allowed peer: %v", err)
+	}
+	if err := pcl.checkPeerCred(1234, 0, "/usr/bin/curl"); err == nil {
+		t.Fatalf("unexpected success checking peer with wrong executable")
+	}
+	if uid := uint32(os.Geteuid()) + 1; uid != 0 {
+		if err := pcl.checkPeerCred(1234, uid, "/opt/cni/bin/openshift-sdn"); err == nil {
+			t.Fatalf("unexpected success checking peer with wrong uid")
+		}
+	}
+
+	pcl = newPeerCredListener(nil, nil)
+	if err := pcl.checkPeerCred(1234, 0, "/usr/bin/curl"); err != nil {
+		t.Fatalf("unexpected error checking peer with no executable restriction: %v", err)
+	}
+}
+
+// spanRecorder is a SpanProcessor that records ended spans
+type spanRecorder struct {
+	lock  sync.Mutex
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (sr *spanRecorder) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+func (sr *spanRecorder) Shutdown(context.Context) error                  { return nil }
+func (sr *spanRecorder) ForceFlush(context.Context) error                { return nil }
+
+func (sr *spanRecorder) OnEnd(span sdktrace.ReadOnlySpan) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	sr.spans = append(sr.spans, span)
+}
+
+func (sr *spanRecorder) ended() []sdktrace.ReadOnlySpan {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	return append([]sdktrace.ReadOnlySpan{}, sr.spans...)
+}
+
+func TestCNIServerTracing(t *testing.T) {
+	recorder := &spanRecorder{}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	tmpDir, err := utiltesting.MkTmpdir("cniserver")
+	if err != nil {
+		t.Fatalf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := filepath.Join(tmpDir, CNIServerSocketName)
+
+	traceIDs := make(chan string, 1)
+	s := NewCNIServer(tmpDir, &Config{MTU: 1500, ServiceNetworkCIDR: "172.30.0.0/16"})
+	err = s.Start(func(request *PodRequest) ([]byte, error) {
+		traceIDs <- request.TraceID()
+		_, span := tracer.Start(request.Context(), "handler")
+		span.End()
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("error starting CNI server: %v", err)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(proto, addr string) (net.Conn, error) {
+				return net.Dial("unix", socketPath)
+			},
+		},
+	}
+
+	vethStart := time.Now().Add(-time.Second)
+	_, code := clientDoCNI(t, client, &CNIRequest{
+		Env: map[string]string{
+			"CNI_COMMAND":     string(CNI_ADD),
+			"CNI_CONTAINERID": "adsfadsfasfdasdfasf",
+			"CNI_NETNS":       "/path/to/something",
+			"CNI_ARGS":        "K8S_POD_NAMESPACE=awesome-namespace;K8S_POD_NAME=awesome-name",
+		},
+		Config:    []byte("{\"cniVersion\": \"0.1.0\",\"name\": \"openshift-sdn\",\"type\": \"openshift-sdn\"}"),
+		HostVeth:  "vethABC",
+		VethSetup: &StageTiming{Start: vethStart, End: vethStart.Add(500 * time.Millisecond)},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("unexpected response code %d", code)
+	}
+	traceID := <-traceIDs
+	if traceID == "" {
+		t.Fatalf("request was not traced")
+	}
+
+	// The request span is ended after the response is written
+	err = utilwait.PollImmediate(10*time.Millisecond, time.Second, func() (bool, error) {
+		return len(recorder.ended()) == 3, nil
+	})
+	if err != nil {
+		t.Fatalf("expected 3 spans, got %d", len(recorder.ended()))
+	}
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.ended() {
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Fatalf("span %q has unexpected trace ID %s", span.Name(), span.SpanContext().TraceID())
+		}
+		spans[span.Name()] = span
+	}
+	root := spans["CNI ADD"]
+	if root == nil {
+		t.Fatalf("no request span in %v", spans)
+	}
+	for _, name := range []string{"veth", "handler"} {
+		if spans[name] == nil {
+			t.Fatalf("no %q span in %v", name, spans)
+		}
+		if spans[name].Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Fatalf("%q span is not a child of the request span", name)
+		}
+	}
+	if !spans["veth"].StartTime().Equal(vethStart) {
+		t.Fatalf("veth span has unexpected start time %v", spans["veth"].StartTime())
+	}
+}
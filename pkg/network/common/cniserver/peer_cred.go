@@ -0,0 +1,98 @@
+package cniserver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+// peerCredListener wraps the CNIServer's listener, checking the credentials of
+// each connecting process with SO_PEERCRED and rejecting connections from anything
+// other than root (or the user the server is running as), and, if
+// allowedExecutables is set, from anything other than those executables. This is
+// defense-in-depth in case the permissions of the socket directory are ever wrong.
+type peerCredListener struct {
+	net.Listener
+
+	allowedUIDs        sets.Int
+	allowedExecutables sets.String
+}
+
+func newPeerCredListener(l net.Listener, allowedExecutables []string) *peerCredListener {
+	pcl := &peerCredListener{
+		Listener:    l,
+		allowedUIDs: sets.NewInt(0, os.Geteuid()),
+	}
+	if len(allowedExecutables) > 0 {
+		pcl.allowedExecutables = sets.NewString(allowedExecutables...)
+		// Allow the server's own process, for CheckHealth()
+		if self, err := os.Executable(); err == nil {
+			pcl.allowedExecutables.Insert(self)
+		}
+	}
+	return pcl
+}
+
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := l.checkPeer(conn); err != nil {
+			klog.Warningf("Rejecting CNI server connection: %v", err)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+func getPeerCred(conn net.Conn) (*syscall.Ucred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("not a unix socket connection")
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ucred, credErr
+}
+
+func (l *peerCredListener) checkPeer(conn net.Conn) error {
+	ucred, err := getPeerCred(conn)
+	if err != nil {
+		return fmt.Errorf("could not get peer credentials: %v", err)
+	}
+	exe := ""
+	if l.allowedExecutables != nil {
+		exe, err = os.Readlink(fmt.Sprintf("/proc/%d/exe", ucred.Pid))
+		if err != nil {
+			return fmt.Errorf("could not get executable of peer pid %d: %v", ucred.Pid, err)
+		}
+	}
+	return l.checkPeerCred(ucred.Pid, ucred.Uid, exe)
+}
+
+func (l *peerCredListener) checkPeerCred(pid int32, uid uint32, exe string) error {
+	if !l.allowedUIDs.Has(int(uid)) {
+		return fmt.Errorf("peer pid %d has unexpected uid %d", pid, uid)
+	}
+	if l.allowedExecutables != nil && !l.allowedExecutables.Has(exe) {
+		return fmt.Errorf("peer pid %d is running unexpected executable %q", pid, exe)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -15,6 +16,12 @@ import (
 	"github.com/openshift/library-go/pkg/network/networkutils"
 )
 
+// DuplicateHostIPAnnotation is set by the master on a HostSubnet whose HostIP is
+// already used by an older HostSubnet (eg, because a node was cloned, or a stale
+// HostSubnet was left behind), to the name of that HostSubnet. Nodes do not create
+// flows for HostSubnets with this annotation.
+const DuplicateHostIPAnnotation = "network.openshift.io/duplicate-host-ip"
+
 func HostSubnetToString(subnet *osdnv1.HostSubnet) string {
 	return fmt.Sprintf("%s (host: %q, ip: %q, subnet: %q)", subnet.Name, subnet.Host, subnet.HostIP, subnet.Subnet)
 }
@@ -38,6 +45,18 @@ type ParsedClusterNetwork struct {
 	ServiceNetwork  *net.IPNet
 	VXLANPort       uint32
 	MTU             uint32
+
+	// IPv6ClusterNetworks is set in dual-stack clusters; see IPv6ClusterNetworksAnnotation
+	IPv6ClusterNetworks []ParsedClusterNetworkEntry
+
+	// EgressIPFailbackDelay is set from EgressIPFailbackDelayAnnotation
+	EgressIPFailbackDelay time.Duration
+
+	// MinVNID and MaxVNID are the VNID allocation range; see VNIDRangeAnnotation
+	MinVNID uint32
+	MaxVNID uint32
+	// VNIDBlocks are set from VNIDBlocksAnnotation
+	VNIDBlocks []VNIDBlock
 }
 
 type ParsedClusterNetworkEntry struct {
@@ -64,6 +83,11 @@ func ParseClusterNetwork(cn *osdnv1.ClusterNetwork) (*ParsedClusterNetwork, erro
 	}
 
 	var err error
+	pcn.IPv6ClusterNetworks, err = parseIPv6ClusterNetworks(cn)
+	if err != nil {
+		return nil, err
+	}
+
 	pcn.ServiceNetwork, err = networkutils.ParseCIDRMask(cn.ServiceNetwork)
 	if err != nil {
 		_, pcn.ServiceNetwork, err = net.ParseCIDR(cn.ServiceNetwork)
@@ -85,6 +109,20 @@ func ParseClusterNetwork(cn *osdnv1.ClusterNetwork) (*ParsedClusterNetwork, erro
 		pcn.MTU = 1450
 	}
 
+	pcn.EgressIPFailbackDelay, err = parseEgressIPFailbackDelay(cn)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Ignoring %v", err))
+	}
+
+	pcn.MinVNID, pcn.MaxVNID, err = parseVNIDRange(cn)
+	if err != nil {
+		return nil, err
+	}
+	pcn.VNIDBlocks, err = parseVNIDBlocks(cn, pcn.MinVNID, pcn.MaxVNID)
+	if err != nil {
+		return nil, err
+	}
+
 	return pcn, nil
 }
 
@@ -198,6 +236,7 @@ func GetParsedClusterNetwork(osdnClient osdnclient.Interface) (*ParsedClusterNet
 	if err != nil {
 		return nil, err
 	}
+	cn = GetAcceptedClusterNetwork(cn)
 	if err = ValidateClusterNetwork(cn); err != nil {
 		return nil, fmt.Errorf("ClusterNetwork is invalid (%v)", err)
 	}
@@ -206,8 +245,13 @@ func GetParsedClusterNetwork(osdnClient osdnclient.Interface) (*ParsedClusterNet
 
 // Generate the default gateway IP Address for a subnet
 func GenerateDefaultGateway(sna *net.IPNet) net.IP {
-	ip := sna.IP.To4()
-	return net.IPv4(ip[0], ip[1], ip[2], ip[3]|0x1)
+	if ip := sna.IP.To4(); ip != nil {
+		return net.IPv4(ip[0], ip[1], ip[2], ip[3]|0x1)
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, sna.IP.To16())
+	ip[net.IPv6len-1] |= 0x1
+	return ip
 }
 
 // Return Host IP Networks
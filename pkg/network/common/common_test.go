@@ -28,6 +28,18 @@ func TestGenerateGateway(t *testing.T) {
 	if gatewayIP.String() != "10.1.0.1" {
 		t.Fatalf("Did not get expected gateway IP Address (gatewayIP=%s)", gatewayIP.String())
 	}
+
+	_, ipNet, err = net.ParseCIDR("fd01:0:0:5::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatewayIP = GenerateDefaultGateway(ipNet)
+	if gatewayIP.String() != "fd01:0:0:5::1" {
+		t.Fatalf("Did not get expected IPv6 gateway IP Address (gatewayIP=%s)", gatewayIP.String())
+	}
+	if ipNet.IP.String() != "fd01:0:0:5::" {
+		t.Fatalf("GenerateDefaultGateway modified its argument (%s)", ipNet.IP.String())
+	}
 }
 
 func TestCheckHostNetworks(t *testing.T) {
@@ -259,6 +271,140 @@ func TestParseClusterNetwork(t *testing.T) {
 			},
 			err: "172.30.0.0i/16",
 		},
+		{
+			name: "valid IPv6 clusterNetwork",
+			cn: osdnv1.ClusterNetwork{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						IPv6ClusterNetworksAnnotation: `[{"CIDR": "fd01::/48", "hostSubnetLength": 64}]`,
+					},
+				},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "10.0.0.0/16"}},
+				ServiceNetwork:  "172.30.0.0/16",
+			},
+			err: "",
+		},
+		{
+			name: "IPv4 CIDR in IPv6 clusterNetworks",
+			cn: osdnv1.ClusterNetwork{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						IPv6ClusterNetworksAnnotation: `[{"CIDR": "10.4.0.0/16", "hostSubnetLength": 8}]`,
+					},
+				},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "10.0.0.0/16"}},
+				ServiceNetwork:  "172.30.0.0/16",
+			},
+			err: "not an IPv6 network",
+		},
+		{
+			name: "bad IPv6 hostSubnetLength",
+			cn: osdnv1.ClusterNetwork{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						IPv6ClusterNetworksAnnotation: `[{"CIDR": "fd01::/48", "hostSubnetLength": 96}]`,
+					},
+				},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "10.0.0.0/16"}},
+				ServiceNetwork:  "172.30.0.0/16",
+			},
+			err: "invalid hostSubnetLength",
+		},
+		{
+			name: "valid VNID range",
+			cn: osdnv1.ClusterNetwork{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						VNIDRangeAnnotation: "100-99999",
+					},
+				},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "10.0.0.0/16"}},
+				ServiceNetwork:  "172.30.0.0/16",
+			},
+			err: "",
+		},
+		{
+			name: "VNID range includes reserved VNIDs",
+			cn: osdnv1.ClusterNetwork{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						VNIDRangeAnnotation: "1-99999",
+					},
+				},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "10.0.0.0/16"}},
+				ServiceNetwork:  "172.30.0.0/16",
+			},
+			err: "must be a range within",
+		},
+		{
+			name: "bad VNID range",
+			cn: osdnv1.ClusterNetwork{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						VNIDRangeAnnotation: "100",
+					},
+				},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "10.0.0.0/16"}},
+				ServiceNetwork:  "172.30.0.0/16",
+			},
+			err: "expected MIN-MAX",
+		},
+		{
+			name: "valid VNID blocks",
+			cn: osdnv1.ClusterNetwork{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						VNIDRangeAnnotation:  "100-99999",
+						VNIDBlocksAnnotation: `[{"name": "finance", "namespaceSelector": {"matchLabels": {"tenant": "finance"}}, "range": "1000-1999"}, {"name": "hr", "namespaceSelector": {"matchLabels": {"tenant": "hr"}}, "range": "2000-2999"}]`,
+					},
+				},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "10.0.0.0/16"}},
+				ServiceNetwork:  "172.30.0.0/16",
+			},
+			err: "",
+		},
+		{
+			name: "overlapping VNID blocks",
+			cn: osdnv1.ClusterNetwork{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						VNIDRangeAnnotation:  "100-99999",
+						VNIDBlocksAnnotation: `[{"name": "finance", "namespaceSelector": {"matchLabels": {"tenant": "finance"}}, "range": "1000-1999"}, {"name": "hr", "namespaceSelector": {"matchLabels": {"tenant": "hr"}}, "range": "1500-2999"}]`,
+					},
+				},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "10.0.0.0/16"}},
+				ServiceNetwork:  "172.30.0.0/16",
+			},
+			err: "overlaps",
+		},
+		{
+			name: "VNID block outside of range",
+			cn: osdnv1.ClusterNetwork{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						VNIDRangeAnnotation:  "100-99999",
+						VNIDBlocksAnnotation: `[{"name": "finance", "namespaceSelector": {"matchLabels": {"tenant": "finance"}}, "range": "10-99"}]`,
+					},
+				},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "10.0.0.0/16"}},
+				ServiceNetwork:  "172.30.0.0/16",
+			},
+			err: "must be a range within",
+		},
+		{
+			name: "VNID block with empty selector",
+			cn: osdnv1.ClusterNetwork{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						VNIDRangeAnnotation:  "100-99999",
+						VNIDBlocksAnnotation: `[{"name": "finance", "namespaceSelector": {}, "range": "1000-1999"}]`,
+					},
+				},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "10.0.0.0/16"}},
+				ServiceNetwork:  "172.30.0.0/16",
+			},
+			err: "must not be empty",
+		},
 	}
 	for _, test := range tests {
 		_, err := ParseClusterNetwork(&test.cn)
@@ -0,0 +1,77 @@
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+// RequireAuthorization wraps handler so that it only serves requests that carry a
+// bearer token for a user who is allowed to use the request's path as a
+// non-resource URL (like kube-rbac-proxy does for metrics endpoints). The token is
+// checked with a TokenReview and the user's access with a SubjectAccessReview;
+// GET and HEAD requests need the "get" verb and other requests need "create". eg:
+//
+//	rules:
+//	- nonResourceURLs: ["/debug/trace"]
+//	  verbs: ["get"]
+func RequireAuthorization(kClient kubernetes.Interface, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if token == "" || token == r.Header.Get("Authorization") {
+			http.Error(w, "a bearer token is required", http.StatusUnauthorized)
+			return
+		}
+
+		review, err := kClient.AuthenticationV1().TokenReviews().Create(r.Context(), &authenticationv1.TokenReview{
+			Spec: authenticationv1.TokenReviewSpec{Token: token},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("could not review token for %s: %v", r.URL.Path, err))
+			http.Error(w, "could not authenticate request", http.StatusInternalServerError)
+			return
+		}
+		if !review.Status.Authenticated {
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		verb := "create"
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			verb = "get"
+		}
+		user := review.Status.User
+		extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+		for k, v := range user.Extra {
+			extra[k] = authorizationv1.ExtraValue(v)
+		}
+		sar, err := kClient.AuthorizationV1().SubjectAccessReviews().Create(r.Context(), &authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				User:   user.Username,
+				UID:    user.UID,
+				Groups: user.Groups,
+				Extra:  extra,
+				NonResourceAttributes: &authorizationv1.NonResourceAttributes{
+					Path: r.URL.Path,
+					Verb: verb,
+				},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("could not authorize %s for %q: %v", r.URL.Path, user.Username, err))
+			http.Error(w, "could not authorize request", http.StatusInternalServerError)
+			return
+		}
+		if !sar.Status.Allowed {
+			http.Error(w, fmt.Sprintf("user %q cannot %s %s", user.Username, verb, r.URL.Path), http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
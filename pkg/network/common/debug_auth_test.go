@@ -0,0 +1,64 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestRequireAuthorization(t *testing.T) {
+	kClient := fake.NewSimpleClientset()
+	kClient.PrependReactor("create", "tokenreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		review := action.(clienttesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "admin-token" || review.Spec.Token == "user-token" {
+			review.Status.Authenticated = true
+			review.Status.User.Username = review.Spec.Token[:len(review.Spec.Token)-len("-token")]
+		}
+		return true, review, nil
+	})
+	var sarPath, sarVerb string
+	kClient.PrependReactor("create", "subjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		sar := action.(clienttesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		sarPath, sarVerb = sar.Spec.NonResourceAttributes.Path, sar.Spec.NonResourceAttributes.Verb
+		sar.Status.Allowed = sar.Spec.User == "admin"
+		return true, sar, nil
+	})
+
+	handler := RequireAuthorization(kClient, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	for _, tc := range []struct {
+		name   string
+		method string
+		auth   string
+		status int
+		verb   string
+	}{
+		{name: "no token", method: "GET", status: http.StatusUnauthorized},
+		{name: "basic auth", method: "GET", auth: "Basic YWRtaW46YWRtaW4=", status: http.StatusUnauthorized},
+		{name: "invalid token", method: "GET", auth: "Bearer bad-token", status: http.StatusUnauthorized},
+		{name: "unauthorized user", method: "GET", auth: "Bearer user-token", status: http.StatusForbidden, verb: "get"},
+		{name: "admin get", method: "GET", auth: "Bearer admin-token", status: http.StatusOK, verb: "get"},
+		{name: "admin post", method: "POST", auth: "Bearer admin-token", status: http.StatusOK, verb: "create"},
+	} {
+		sarPath, sarVerb = "", ""
+		req := httptest.NewRequest(tc.method, "/debug/trace?srcIP=10.128.0.2", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d (%s)", tc.name, tc.status, rec.Code, rec.Body.String())
+		}
+		if sarVerb != tc.verb || (tc.verb != "" && sarPath != "/debug/trace") {
+			t.Errorf("%s: unexpected SubjectAccessReview for %q %q", tc.name, sarVerb, sarPath)
+		}
+	}
+}
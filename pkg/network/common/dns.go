@@ -77,13 +77,40 @@ func NewDNS(resolverConfigFile string, ipv4, ipv6 bool) (*DNS, error) {
 		return nil, fmt.Errorf("cannot initialize the resolver: %v", err)
 	}
 
+	return newDNS(fixupNameservers(config.Servers, config.Port, ipv4, ipv6), ipv4, ipv6), nil
+}
+
+// NewDNSWithNameservers returns a DNS that queries the given nameservers (as "IP" or
+// "IP:port") rather than the ones listed in the host's resolver configuration; eg, to
+// use a node-local DNS cache.
+func NewDNSWithNameservers(nameservers []string, ipv4, ipv6 bool) (*DNS, error) {
+	if !ipv4 && !ipv6 {
+		return nil, fmt.Errorf("must support at least one of IPv4 or IPv6")
+	}
+	if len(nameservers) == 0 {
+		return nil, fmt.Errorf("no nameservers specified")
+	}
+	for _, server := range nameservers {
+		host := server
+		if h, _, err := net.SplitHostPort(server); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid nameserver %q", server)
+		}
+	}
+
+	return newDNS(fixupNameservers(nameservers, "53", ipv4, ipv6), ipv4, ipv6), nil
+}
+
+func newDNS(nameservers []string, ipv4, ipv6 bool) *DNS {
 	return &DNS{
 		dnsMap:      map[string]dnsValue{},
-		nameservers: fixupNameservers(config.Servers, config.Port, ipv4, ipv6),
+		nameservers: nameservers,
 		ipv4:        ipv4,
 		ipv6:        ipv6,
 		timeout:     5 * time.Second,
-	}, nil
+	}
 }
 
 func (d *DNS) Size() int {
@@ -216,6 +243,12 @@ func (d *DNS) doOneQuery(server, domain string, rtype uint16) ([]net.IP, int, er
 	c := new(dns.Client)
 	c.Timeout = d.timeout
 	in, _, err := c.Exchange(msg, server)
+	if in != nil && (err == nil || err == dns.ErrTruncated) && in.Truncated {
+		// The answer didn't fit in a UDP response; retry over TCP
+		klog.V(5).Infof("Truncated DNS response for %q from %s; retrying over TCP", domain, server)
+		c.Net = "tcp"
+		in, _, err = c.Exchange(msg, server)
+	}
 	if in == nil || err != nil {
 		return ips, ttl, err
 	}
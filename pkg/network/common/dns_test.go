@@ -615,3 +615,64 @@ options rotate timeout:1 attempts:1`, addr)
 
 	return configFile.Name(), nil
 }
+
+func TestDNSTCPFallback(t *testing.T) {
+	s, addr, err := runLocalUDPServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to run test server: %v", err)
+	}
+	defer s.Shutdown()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("unable to run test TCP server: %v", err)
+	}
+	tcpServer := &dns.Server{Listener: l, ReadTimeout: time.Hour, WriteTimeout: time.Hour}
+	go tcpServer.ActivateAndServe()
+	defer tcpServer.Shutdown()
+
+	// The UDP server returns a truncated (empty) response; only the TCP server
+	// returns the actual answer
+	answer, _ := dns.NewRR("big.example.com. 600 IN A 10.11.12.13")
+	dns.HandleFunc("big.example.com", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if _, isTCP := w.RemoteAddr().(*net.TCPAddr); isTCP {
+			m.Answer = []dns.RR{answer}
+		} else {
+			m.Truncated = true
+		}
+		w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("big.example.com")
+
+	n, err := NewDNSWithNameservers([]string{addr}, true, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating DNS: %v", err)
+	}
+	n.timeout = time.Second
+
+	if err := n.Add("big.example.com"); err != nil {
+		t.Fatalf("unexpected error adding domain: %v", err)
+	}
+	if ips := n.Get("big.example.com").ips; !ipsEqual(ips, []net.IP{net.ParseIP("10.11.12.13")}) {
+		t.Fatalf("expected IPs from TCP response, got %v", ips)
+	}
+}
+
+func TestNewDNSWithNameservers(t *testing.T) {
+	n, err := NewDNSWithNameservers([]string{"169.254.20.10", "[fd00::10]:5353"}, true, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(n.nameservers, []string{"169.254.20.10:53"}) {
+		t.Fatalf("unexpected nameservers %v", n.nameservers)
+	}
+
+	if _, err := NewDNSWithNameservers([]string{"dns.example.com"}, true, false); err == nil {
+		t.Fatalf("unexpected lack of error for non-IP nameserver")
+	}
+	if _, err := NewDNSWithNameservers(nil, true, false); err == nil {
+		t.Fatalf("unexpected lack of error for empty nameservers")
+	}
+}
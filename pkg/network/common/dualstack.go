@@ -0,0 +1,71 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+const (
+	// IPv6ClusterNetworksAnnotation can be set on the ClusterNetwork to a JSON list of
+	// ClusterNetworkEntries (eg, `[{"CIDR": "fd01::/48", "hostSubnetLength": 64}]`)
+	// to allocate an IPv6 subnet to each node alongside its IPv4 subnet. (The
+	// clusterNetworks field itself only allows IPv4 CIDRs.)
+	IPv6ClusterNetworksAnnotation = "network.openshift.io/ipv6-cluster-networks"
+
+	// HostSubnetIPv6Annotation is set on a HostSubnet by the master to the node's
+	// IPv6 subnet, in dual-stack clusters
+	HostSubnetIPv6Annotation = "network.openshift.io/ipv6-subnet"
+)
+
+// parseIPv6ClusterNetworks parses cn's IPv6ClusterNetworksAnnotation
+func parseIPv6ClusterNetworks(cn *osdnv1.ClusterNetwork) ([]ParsedClusterNetworkEntry, error) {
+	value, ok := cn.Annotations[IPv6ClusterNetworksAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var entries []osdnv1.ClusterNetworkEntry
+	if err := json.Unmarshal([]byte(value), &entries); err != nil {
+		return nil, fmt.Errorf("could not parse %s annotation: %v", IPv6ClusterNetworksAnnotation, err)
+	}
+
+	parsed := make([]ParsedClusterNetworkEntry, 0, len(entries))
+	for _, entry := range entries {
+		_, cidr, err := net.ParseCIDR(entry.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse IPv6 ClusterNetwork CIDR %s: %v", entry.CIDR, err)
+		}
+		if cidr.IP.To4() != nil {
+			return nil, fmt.Errorf("IPv6 ClusterNetwork CIDR %s is not an IPv6 network", entry.CIDR)
+		}
+		maskLen, addrLen := cidr.Mask.Size()
+		if entry.HostSubnetLength < 2 || entry.HostSubnetLength > uint32(addrLen-maskLen) {
+			return nil, fmt.Errorf("invalid hostSubnetLength %d for IPv6 ClusterNetwork CIDR %s", entry.HostSubnetLength, entry.CIDR)
+		}
+		for _, other := range parsed {
+			if cidrsOverlap(cidr, other.ClusterCIDR) {
+				return nil, fmt.Errorf("IPv6 ClusterNetwork CIDR %s overlaps with %s", cidr, other.ClusterCIDR)
+			}
+		}
+		parsed = append(parsed, ParsedClusterNetworkEntry{ClusterCIDR: cidr, HostSubnetLength: entry.HostSubnetLength})
+	}
+	return parsed, nil
+}
+
+// GetHostSubnetIPv6 returns hs's IPv6 subnet, or nil if it doesn't have one
+func GetHostSubnetIPv6(hs *osdnv1.HostSubnet) (*net.IPNet, error) {
+	value, ok := hs.Annotations[HostSubnetIPv6Annotation]
+	if !ok {
+		return nil, nil
+	}
+	_, subnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, err
+	}
+	if subnet.IP.To4() != nil {
+		return nil, fmt.Errorf("%s is not an IPv6 subnet", value)
+	}
+	return subnet, nil
+}
@@ -1,8 +1,10 @@
 package common
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
@@ -15,6 +17,19 @@ import (
 	utiltrace "k8s.io/utils/trace"
 )
 
+// EgressDNSResolvedAnnotation is set by the master on EgressNetworkPolicies with
+// dnsName rules, holding a JSON map from each dnsName to its resolved IPs, so that
+// all nodes enforce the policy using the same addresses.
+const EgressDNSResolvedAnnotation = "network.openshift.io/resolved-dns-names"
+
+// DefaultResolvConf is the resolver configuration used by EgressDNS if no other
+// configuration or nameservers are given
+const DefaultResolvConf = "/etc/resolv.conf"
+
+// egressDNSWorkers is the maximum number of dnsNames that EgressDNS will re-resolve
+// in parallel
+const egressDNSWorkers = 10
+
 type EgressDNSUpdate struct {
 	UID       ktypes.UID
 	Namespace string
@@ -22,6 +37,10 @@ type EgressDNSUpdate struct {
 
 type EgressDNSUpdates []EgressDNSUpdate
 
+// EgressDNSObserver is called after each resolution of a dnsName, with how long it
+// took and its error (if any), eg to record metrics
+type EgressDNSObserver func(latency time.Duration, err error)
+
 type EgressDNS struct {
 	// Protects pdMap/namespaces operations
 	lock sync.Mutex
@@ -43,10 +62,27 @@ type EgressDNS struct {
 
 	// Notify when a dns query is responded
 	stopCh chan struct{}
+
+	// Maximum number of concurrent queries
+	workers int
+
+	observer EgressDNSObserver
 }
 
-func NewEgressDNS(ipv4, ipv6 bool) (*EgressDNS, error) {
-	dnsInfo, err := NewDNS("/etc/resolv.conf", ipv4, ipv6)
+// NewEgressDNS returns a new EgressDNS. If nameservers is empty, it will use the
+// nameservers from resolvConf (or /etc/resolv.conf, if resolvConf is empty). If
+// observer is non-nil, it is called after each resolution.
+func NewEgressDNS(ipv4, ipv6 bool, resolvConf string, nameservers []string, observer EgressDNSObserver) (*EgressDNS, error) {
+	var dnsInfo *DNS
+	var err error
+	if len(nameservers) > 0 {
+		dnsInfo, err = NewDNSWithNameservers(nameservers, ipv4, ipv6)
+	} else {
+		if resolvConf == "" {
+			resolvConf = DefaultResolvConf
+		}
+		dnsInfo, err = NewDNS(resolvConf, ipv4, ipv6)
+	}
 	if err != nil {
 		utilruntime.HandleError(err)
 		return nil, err
@@ -59,6 +95,8 @@ func NewEgressDNS(ipv4, ipv6 bool) (*EgressDNS, error) {
 		Updates:            make(chan EgressDNSUpdates),
 		dnsResponse:        make(chan DNSResponseNotification),
 		stopCh:             make(chan struct{}),
+		workers:            egressDNSWorkers,
+		observer:           observer,
 	}, nil
 }
 
@@ -67,11 +105,14 @@ func (e *EgressDNS) Add(policy osdnv1.EgressNetworkPolicy) {
 	defer e.lock.Unlock()
 
 	for _, rule := range policy.Spec.Egress {
-		if len(rule.To.DNSName) > 0 {
+		if isExternalDNSName(rule.To.DNSName) {
 			if uids, exists := e.dnsNamesToPolicies[rule.To.DNSName]; !exists {
 				e.dnsNamesToPolicies[rule.To.DNSName] = sets.NewString(string(policy.UID))
 				//only call Add if the dnsName doesn't exist in the dnsNamesToPolicies
-				if err := e.dns.Add(rule.To.DNSName); err != nil {
+				start := time.Now()
+				err := e.dns.Add(rule.To.DNSName)
+				e.observe(start, err)
+				if err != nil {
 					utilruntime.HandleError(err)
 				}
 				e.signalAdded()
@@ -90,7 +131,7 @@ func (e *EgressDNS) Delete(policy osdnv1.EgressNetworkPolicy) {
 	//if the slice is empty at this point, delete the entry from the dns object too
 	//also remove the policy entry from the namespaces map.
 	for _, rule := range policy.Spec.Egress {
-		if len(rule.To.DNSName) > 0 {
+		if isExternalDNSName(rule.To.DNSName) {
 			if uids, ok := e.dnsNamesToPolicies[rule.To.DNSName]; ok {
 				uids.Delete(string(policy.UID))
 				if uids.Len() == 0 {
@@ -108,8 +149,37 @@ func (e *EgressDNS) Delete(policy osdnv1.EgressNetworkPolicy) {
 	}
 }
 
+// isExternalDNSName returns true if dnsName is set and needs to be resolved via DNS
+// (ie, it does not refer to an in-cluster Service)
+func isExternalDNSName(dnsName string) bool {
+	if len(dnsName) == 0 {
+		return false
+	}
+	_, _, isService := ParseEgressServiceDNSName(dnsName)
+	return !isService
+}
+
+// HasExternalDNSNames returns true if any of policy's rules have a dnsName that needs
+// to be resolved via DNS
+func HasExternalDNSNames(policy *osdnv1.EgressNetworkPolicy) bool {
+	for _, rule := range policy.Spec.Egress {
+		if isExternalDNSName(rule.To.DNSName) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *EgressDNS) observe(start time.Time, err error) {
+	if e.observer != nil {
+		e.observer(time.Since(start), err)
+	}
+}
+
 func (e *EgressDNS) update(dns string) {
+	start := time.Now()
 	changed, err := e.dns.Update(dns)
+	e.observe(start, err)
 	if err != nil {
 		klog.Errorf("Unable to update ip addreses for %q: %v", dns, err)
 	}
@@ -119,27 +189,34 @@ func (e *EgressDNS) update(dns string) {
 	e.dnsResponse <- DNSResponseNotification{Changed: changed, Name: dns}
 }
 
+// Sync re-resolves each dnsName when its TTL expires, running up to e.workers
+// queries in parallel so that one slow or unresponsive name doesn't delay the others.
 func (e *EgressDNS) Sync() {
-	var duration time.Duration
+	inFlight := 0
 	for {
-		tm, dnsName, ok := e.dns.GetNextQueryTime()
-		if !ok {
-			duration = 30 * time.Minute
-		} else {
+		// Start queries for every name that is due, until all workers are busy
+		duration := 30 * time.Minute
+		for inFlight < e.workers {
+			tm, dnsName, ok := e.dns.GetNextQueryTime()
+			if !ok {
+				break
+			}
 			now := time.Now()
 			if tm.After(now) {
 				// Item needs to wait for this duration before it can be processed
 				duration = tm.Sub(now)
-			} else {
-				e.dns.SetUpdating(dnsName)
-				go e.update(dnsName)
+				break
 			}
+			e.dns.SetUpdating(dnsName)
+			inFlight++
+			go e.update(dnsName)
 		}
 
 		// Wait for the the next query time, until there is a reply,
 		// or until a new name is added.
 		select {
 		case response := <-e.dnsResponse:
+			inFlight--
 			go e.handleDNSResponse(response)
 		case <-e.added:
 		case <-e.stopCh:
@@ -183,9 +260,71 @@ func (e *EgressDNS) GetIPs(dnsName string) []net.IP {
 }
 
 func (e *EgressDNS) GetNetCIDRs(dnsName string) []net.IPNet {
+	return ipsToNetCIDRs(e.GetIPs(dnsName))
+}
+
+// GetPolicyIPs returns the IPs for dnsName in policy, preferring the cluster-wide
+// resolution published by the master in EgressDNSResolvedAnnotation (if any) over
+// our own local resolution.
+func (e *EgressDNS) GetPolicyIPs(policy *osdnv1.EgressNetworkPolicy, dnsName string) []net.IP {
+	if resolved := GetResolvedDNSNames(policy); resolved != nil {
+		if ips, ok := resolved[dnsName]; ok {
+			return ips
+		}
+	}
+	return e.GetIPs(dnsName)
+}
+
+// GetPolicyNetCIDRs is like GetNetCIDRs but uses GetPolicyIPs
+func (e *EgressDNS) GetPolicyNetCIDRs(policy *osdnv1.EgressNetworkPolicy, dnsName string) []net.IPNet {
+	return ipsToNetCIDRs(e.GetPolicyIPs(policy, dnsName))
+}
+
+// GetResolvedDNSNames returns the contents of policy's EgressDNSResolvedAnnotation, or
+// nil if it is unset or invalid.
+func GetResolvedDNSNames(policy *osdnv1.EgressNetworkPolicy) map[string][]net.IP {
+	value, ok := policy.Annotations[EgressDNSResolvedAnnotation]
+	if !ok {
+		return nil
+	}
+	var resolvedStrings map[string][]string
+	if err := json.Unmarshal([]byte(value), &resolvedStrings); err != nil {
+		utilruntime.HandleError(fmt.Errorf("invalid %s annotation on EgressNetworkPolicy %s/%s: %v", EgressDNSResolvedAnnotation, policy.Namespace, policy.Name, err))
+		return nil
+	}
+	resolved := make(map[string][]net.IP, len(resolvedStrings))
+	for dnsName, ipStrings := range resolvedStrings {
+		ips := make([]net.IP, 0, len(ipStrings))
+		for _, ipString := range ipStrings {
+			if ip := net.ParseIP(ipString); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		resolved[dnsName] = ips
+	}
+	return resolved
+}
+
+// FormatResolvedDNSNames returns a value for EgressDNSResolvedAnnotation
+func FormatResolvedDNSNames(resolved map[string][]net.IP) (string, error) {
+	resolvedStrings := make(map[string][]string, len(resolved))
+	for dnsName, ips := range resolved {
+		ipStrings := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			ipStrings = append(ipStrings, ip.String())
+		}
+		sort.Strings(ipStrings)
+		resolvedStrings[dnsName] = ipStrings
+	}
+	// json.Marshal sorts map keys, so the result is canonical
+	value, err := json.Marshal(resolvedStrings)
+	return string(value), err
+}
+
+func ipsToNetCIDRs(ips []net.IP) []net.IPNet {
 	cidrs := []net.IPNet{}
 	masklen := 0
-	for _, ip := range e.GetIPs(dnsName) {
+	for _, ip := range ips {
 		if utilnet.IsIPv6(ip) {
 			masklen = 128
 		} else {
@@ -1,7 +1,12 @@
 package common
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
@@ -74,6 +79,7 @@ func TestSync(t *testing.T) {
 		Updates:            make(chan EgressDNSUpdates),
 		dnsResponse:        make(chan DNSResponseNotification),
 		stopCh:             make(chan struct{}),
+		workers:            egressDNSWorkers,
 	}
 
 	egressDNS.Add(newEgressNetworkPolicy("domain1.com", "fake-ns-1"))
@@ -121,3 +127,170 @@ func TestSync(t *testing.T) {
 	}
 	egressDNS.Stop()
 }
+
+func TestSyncParallel(t *testing.T) {
+	now := time.Now()
+	var DNSReplies []fakeDNSReply
+	for i := 0; i < 6; i++ {
+		DNSReplies = append(DNSReplies, fakeDNSReply{
+			name:          fmt.Sprintf("domain%d.com", i),
+			ttl:           1 * time.Second,
+			ips:           []net.IP{net.ParseIP(fmt.Sprintf("1.1.1.%d", i))},
+			delay:         200 * time.Millisecond,
+			nextQueryTime: now,
+		})
+	}
+
+	dnsInfo := NewFakeDNS(DNSReplies)
+	egressDNS := EgressDNS{
+		dns:                dnsInfo,
+		dnsNamesToPolicies: map[string]sets.String{},
+		namespaces:         map[ktypes.UID]string{},
+		added:              make(chan bool),
+		Updates:            make(chan EgressDNSUpdates),
+		dnsResponse:        make(chan DNSResponseNotification),
+		stopCh:             make(chan struct{}),
+		workers:            3,
+	}
+	for i := range DNSReplies {
+		egressDNS.Add(newEgressNetworkPolicy(DNSReplies[i].name, fmt.Sprintf("fake-ns-%d", i)))
+	}
+
+	go egressDNS.Sync()
+	defer egressDNS.Stop()
+
+	// Resolving serially would take 1.2s
+	timeout := time.After(1 * time.Second)
+	updated := sets.NewString()
+	for updated.Len() < len(DNSReplies) {
+		select {
+		case update := <-egressDNS.Updates:
+			for _, u := range update {
+				updated.Insert(u.Namespace)
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for updates; only got %v", updated.List())
+		}
+	}
+
+	dnsInfo.lock.Lock()
+	defer dnsInfo.lock.Unlock()
+	if dnsInfo.maxInFlight != 3 {
+		t.Fatalf("expected 3 concurrent queries, got %d", dnsInfo.maxInFlight)
+	}
+}
+
+func TestNewEgressDNSResolvConf(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "egress-dns")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	resolvConf := filepath.Join(tmpDir, "resolv.conf")
+	if err := ioutil.WriteFile(resolvConf, []byte("nameserver 10.0.0.10\nnameserver 10.0.0.11\n"), 0644); err != nil {
+		t.Fatalf("failed to write resolv.conf: %v", err)
+	}
+
+	egressDNS, err := NewEgressDNS(true, false, resolvConf, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"10.0.0.10:53", "10.0.0.11:53"}
+	if nameservers := egressDNS.dns.(*DNS).nameservers; !reflect.DeepEqual(nameservers, expected) {
+		t.Fatalf("expected nameservers %v, got %v", expected, nameservers)
+	}
+
+	// Explicit nameservers override resolvConf
+	egressDNS, err = NewEgressDNS(true, false, resolvConf, []string{"10.0.0.12"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = []string{"10.0.0.12:53"}
+	if nameservers := egressDNS.dns.(*DNS).nameservers; !reflect.DeepEqual(nameservers, expected) {
+		t.Fatalf("expected nameservers %v, got %v", expected, nameservers)
+	}
+
+	if _, err := NewEgressDNS(true, false, filepath.Join(tmpDir, "missing"), nil, nil); err == nil {
+		t.Fatalf("unexpected success with missing resolv.conf")
+	}
+}
+
+func TestResolvedDNSNames(t *testing.T) {
+	policy := newEgressNetworkPolicy("domain1.com", "fake-ns-1")
+	if resolved := GetResolvedDNSNames(&policy); resolved != nil {
+		t.Fatalf("unexpected resolved names on unannotated policy: %v", resolved)
+	}
+
+	value, err := FormatResolvedDNSNames(map[string][]net.IP{
+		"domain1.com": {net.ParseIP("1.1.1.2"), net.ParseIP("1.1.1.1")},
+		"domain2.com": {net.ParseIP("1.2.3.4")},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error formatting resolved names: %v", err)
+	}
+	expected := `{"domain1.com":["1.1.1.1","1.1.1.2"],"domain2.com":["1.2.3.4"]}`
+	if value != expected {
+		t.Fatalf("unexpected formatted value: expected %q, got %q", expected, value)
+	}
+
+	policy.Annotations = map[string]string{EgressDNSResolvedAnnotation: value}
+	resolved := GetResolvedDNSNames(&policy)
+	if len(resolved) != 2 || len(resolved["domain1.com"]) != 2 || !resolved["domain2.com"][0].Equal(net.ParseIP("1.2.3.4")) {
+		t.Fatalf("unexpected parsed resolved names: %v", resolved)
+	}
+
+	egressDNS := EgressDNS{dns: NewFakeDNS(nil)}
+	ips := egressDNS.GetPolicyIPs(&policy, "domain1.com")
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("1.1.1.1")) {
+		t.Fatalf("expected IPs from annotation, got %v", ips)
+	}
+	if ips := egressDNS.GetPolicyIPs(&policy, "domain3.com"); len(ips) != 0 {
+		t.Fatalf("expected no IPs for unresolved name, got %v", ips)
+	}
+
+	policy.Annotations[EgressDNSResolvedAnnotation] = "not json"
+	if resolved := GetResolvedDNSNames(&policy); resolved != nil {
+		t.Fatalf("unexpected resolved names from invalid annotation: %v", resolved)
+	}
+}
+
+func TestEgressServiceDNSNames(t *testing.T) {
+	testcases := []struct {
+		dnsName   string
+		namespace string
+		name      string
+		ok        bool
+	}{
+		{dnsName: "db.prod.svc", namespace: "prod", name: "db", ok: true},
+		{dnsName: "db.prod.svc.", namespace: "prod", name: "db", ok: true},
+		{dnsName: "db.prod.svc.example.com"},
+		{dnsName: "prod.svc"},
+		{dnsName: "www.example.com"},
+		{dnsName: ""},
+	}
+	for _, tc := range testcases {
+		namespace, name, ok := ParseEgressServiceDNSName(tc.dnsName)
+		if namespace != tc.namespace || name != tc.name || ok != tc.ok {
+			t.Fatalf("%q: expected %q/%q/%v, got %q/%q/%v", tc.dnsName, tc.namespace, tc.name, tc.ok, namespace, name, ok)
+		}
+	}
+
+	policy := newEgressNetworkPolicy("db.prod.svc", "fake-ns-1")
+	if HasExternalDNSNames(&policy) {
+		t.Fatalf("service name was treated as an external DNS name")
+	}
+	egressDNS := EgressDNS{
+		dns:                NewFakeDNS(nil),
+		dnsNamesToPolicies: map[string]sets.String{},
+		namespaces:         map[ktypes.UID]string{},
+	}
+	egressDNS.Add(policy)
+	if len(egressDNS.dnsNamesToPolicies) != 0 {
+		t.Fatalf("service name was added for DNS resolution: %v", egressDNS.dnsNamesToPolicies)
+	}
+
+	policy = newEgressNetworkPolicy("www.example.com", "fake-ns-1")
+	if !HasExternalDNSNames(&policy) {
+		t.Fatalf("external DNS name was not recognized")
+	}
+}
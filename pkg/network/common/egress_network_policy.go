@@ -0,0 +1,76 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+// EgressNetworkPolicyPriorityAnnotation can be set on an EgressNetworkPolicy to
+// control the order in which its rules are applied relative to other
+// EgressNetworkPolicies in the same namespace. Policies with a higher priority are
+// evaluated first; the default priority is 0. This allows, eg, a baseline policy
+// with a negative priority to be layered underneath other policies in the
+// namespace.
+const EgressNetworkPolicyPriorityAnnotation = "network.openshift.io/egress-policy-priority"
+
+// EgressNetworkPolicyAuditAnnotation, when set to "true" on an EgressNetworkPolicy,
+// puts it in audit-only mode: traffic that it would deny is allowed, but counted and
+// logged, so that a policy can be validated before it is enforced.
+const EgressNetworkPolicyAuditAnnotation = "network.openshift.io/egress-policy-audit"
+
+// egressServiceDNSSuffix is the suffix of an EgressNetworkPolicy dnsName that refers
+// to an in-cluster Service; see ParseEgressServiceDNSName
+const egressServiceDNSSuffix = "svc"
+
+// GetEgressNetworkPolicyPriority returns policy's priority
+func GetEgressNetworkPolicyPriority(policy *osdnv1.EgressNetworkPolicy) int {
+	value, ok := policy.Annotations[EgressNetworkPolicyPriorityAnnotation]
+	if !ok {
+		return 0
+	}
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("invalid %s annotation %q on EgressNetworkPolicy %s/%s; using 0", EgressNetworkPolicyPriorityAnnotation, value, policy.Namespace, policy.Name))
+		return 0
+	}
+	return priority
+}
+
+// SortEgressNetworkPolicies sorts policies into the order in which their rules should
+// be evaluated: by decreasing priority, and then by name.
+func SortEgressNetworkPolicies(policies []osdnv1.EgressNetworkPolicy) {
+	priorities := make(map[string]int, len(policies))
+	for i := range policies {
+		priorities[policies[i].Name] = GetEgressNetworkPolicyPriority(&policies[i])
+	}
+	sort.SliceStable(policies, func(i, j int) bool {
+		pi, pj := priorities[policies[i].Name], priorities[policies[j].Name]
+		if pi != pj {
+			return pi > pj
+		}
+		return policies[i].Name < policies[j].Name
+	})
+}
+
+// IsEgressNetworkPolicyAuditOnly returns whether policy is in audit-only mode
+func IsEgressNetworkPolicyAuditOnly(policy *osdnv1.EgressNetworkPolicy) bool {
+	return policy.Annotations[EgressNetworkPolicyAuditAnnotation] == "true"
+}
+
+// ParseEgressServiceDNSName checks whether dnsName (from an EgressNetworkPolicy rule)
+// has the form "<name>.<namespace>.svc", referring to an in-cluster Service. Such
+// names are not resolved via DNS; instead the rule applies to the Service's cluster
+// IPs and endpoint IPs, and is updated as they change.
+func ParseEgressServiceDNSName(dnsName string) (namespace, name string, ok bool) {
+	parts := strings.Split(strings.TrimSuffix(dnsName, "."), ".")
+	if len(parts) != 3 || parts[2] != egressServiceDNSSuffix || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[0], true
+}
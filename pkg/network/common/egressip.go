@@ -4,12 +4,16 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"k8s.io/klog/v2"
 
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ktypes "k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/sets"
@@ -21,6 +25,37 @@ import (
 	osdninformers "github.com/openshift/client-go/network/informers/externalversions/network/v1"
 )
 
+// EgressIPHealthAnnotation is set on a node's HostSubnet by the SDN process on that
+// node to a JSON-encoded EgressIPHealth, describing the reachability of the egress
+// nodes that it is sending egress IP traffic to. It is intended for consumption by
+// cluster monitoring. It is only rewritten when a peer's egress IPs or reachability
+// change; the node's SDN Lease (see NodeSDNLeaseName) indicates whether it is
+// still current.
+const EgressIPHealthAnnotation = "network.openshift.io/egress-ip-health"
+
+// EgressIPHealth is the value of EgressIPHealthAnnotation
+type EgressIPHealth struct {
+	// LastUpdate is when the annotation was last written (ie, when the peers or
+	// their reachability last changed)
+	LastUpdate metav1.Time `json:"lastUpdate"`
+	// Peers describes each egress node being monitored
+	Peers []EgressIPPeerHealth `json:"peers,omitempty"`
+}
+
+// EgressIPPeerHealth describes a single monitored egress node
+type EgressIPPeerHealth struct {
+	// NodeIP is the egress node's IP
+	NodeIP string `json:"nodeIP"`
+	// EgressIPs are the egress IPs hosted on the node that this node is using
+	EgressIPs []string `json:"egressIPs"`
+	// Reachable is false if the node has been declared offline
+	Reachable bool `json:"reachable"`
+	// LastProbe is when the node was last probed, and LastSuccess is when it
+	// last responded
+	LastProbe   *metav1.Time `json:"lastProbe,omitempty"`
+	LastSuccess *metav1.Time `json:"lastSuccess,omitempty"`
+}
+
 type nodeEgress struct {
 	nodeName string
 	nodeIP   string
@@ -31,6 +66,86 @@ type nodeEgress struct {
 	parsedCIDRs    map[string]*net.IPNet
 
 	offline bool
+	// failbackTimer is set while an offline node that has come back is waiting
+	// out the failback delay
+	failbackTimer *time.Timer
+}
+
+// EgressIPFailbackDelayAnnotation can be set on the ClusterNetwork to a duration
+// (eg, "5m") to stop egress IPs from flapping between nodes. After an egress node
+// is declared offline, it is not considered to be back online until it has been
+// reachable for this long.
+const EgressIPFailbackDelayAnnotation = "network.openshift.io/egress-ip-failback-delay"
+
+// parseEgressIPFailbackDelay parses cn's EgressIPFailbackDelayAnnotation
+func parseEgressIPFailbackDelay(cn *osdnv1.ClusterNetwork) (time.Duration, error) {
+	value, ok := cn.Annotations[EgressIPFailbackDelayAnnotation]
+	if !ok {
+		return 0, nil
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil || delay < 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q", EgressIPFailbackDelayAnnotation, value)
+	}
+	return delay, nil
+}
+
+// EgressIPBandwidthAnnotation can be set on a NetNamespace with EgressIPs to a
+// bandwidth in bits per second (eg, "100M"). Traffic leaving the cluster via each
+// of the namespace's egress IPs is limited to that rate, with excess packets
+// dropped on the egress node.
+const EgressIPBandwidthAnnotation = "network.openshift.io/egress-ip-bandwidth"
+
+// parseEgressIPBandwidth parses netns's EgressIPBandwidthAnnotation, returning 0 if
+// it is unset
+func parseEgressIPBandwidth(netns *osdnv1.NetNamespace) (int64, error) {
+	value, ok := netns.Annotations[EgressIPBandwidthAnnotation]
+	if !ok {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth %q: %v", value, err)
+	}
+	// Anything less than 8 bits per second would round down to 0 bytes per second
+	if q.Value() < 8 {
+		return 0, fmt.Errorf("bandwidth %q is too small", value)
+	}
+	return q.Value(), nil
+}
+
+// EgressIPDestinationsAnnotation can be set on a NetNamespace with EgressIPs to a
+// comma-separated list of IPv4 CIDRs, to restrict the namespace's use of its egress
+// IPs to traffic to those destinations. Traffic to other destinations leaves the
+// cluster from the pod's node as though the namespace had no egress IPs.
+const EgressIPDestinationsAnnotation = "network.openshift.io/egress-ip-destinations"
+
+// parseEgressIPDestinations parses netns's EgressIPDestinationsAnnotation, returning
+// a sorted list of CIDRs, or nil if it is unset
+func parseEgressIPDestinations(netns *osdnv1.NetNamespace) ([]string, error) {
+	value, ok := netns.Annotations[EgressIPDestinationsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	dests := sets.NewString()
+	for _, cidr := range strings.Split(value, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", cidr)
+		}
+		if ipnet.IP.To4() == nil {
+			return nil, fmt.Errorf("CIDR %q is not IPv4", cidr)
+		}
+		dests.Insert(ipnet.String())
+	}
+	if dests.Len() == 0 {
+		return nil, fmt.Errorf("no destinations")
+	}
+	return dests.List(), nil
 }
 
 type namespaceEgress struct {
@@ -38,6 +153,16 @@ type namespaceEgress struct {
 	requestedIPs      []string
 	shouldDropTraffic bool
 
+	// destinations is the parsed EgressIPDestinationsAnnotation; if it is
+	// non-empty, only traffic to these CIDRs uses the egress IPs.
+	// destinationsChanged is set if the watcher needs to be updated for a change
+	// to destinations.
+	destinations        []string
+	destinationsChanged bool
+
+	// bandwidth is the parsed EgressIPBandwidthAnnotation, or 0 if unlimited
+	bandwidth int64
+
 	activeEgressIPs []EgressIPAssignment
 }
 
@@ -55,6 +180,8 @@ type egressIPInfo struct {
 
 	assignedNodeIP string
 	assignedVNID   uint32
+	// assignedBandwidth is the bandwidth limit last passed to SetEgressIPBandwidth
+	assignedBandwidth int64
 }
 
 type EgressIPWatcher interface {
@@ -62,10 +189,20 @@ type EgressIPWatcher interface {
 
 	ClaimEgressIP(vnid uint32, egressIP, nodeIP string)
 	ReleaseEgressIP(egressIP, nodeIP string)
-
+	// SetEgressIPBandwidth sets the bandwidth limit, in bits per second, for a
+	// claimed egress IP; 0 means unlimited
+	SetEgressIPBandwidth(egressIP, nodeIP string, bandwidth int64)
+
+	// BeginNamespaceEgressChanges and CommitNamespaceEgressChanges are called
+	// before and after each set of SetNamespaceEgress* calls, so that the watcher
+	// can report the errors from a set of changes together
+	BeginNamespaceEgressChanges()
+	CommitNamespaceEgressChanges()
 	SetNamespaceEgressNormal(vnid uint32)
-	SetNamespaceEgressDropped(vnid uint32)
-	SetNamespaceEgressViaEgressIPs(vnid uint32, activeEgressIPs []EgressIPAssignment)
+	// SetNamespaceEgressDropped and SetNamespaceEgressViaEgressIPs apply only
+	// to traffic to destinations, if it is non-empty
+	SetNamespaceEgressDropped(vnid uint32, destinations []string)
+	SetNamespaceEgressViaEgressIPs(vnid uint32, destinations []string, activeEgressIPs []EgressIPAssignment)
 
 	UpdateEgressCIDRs()
 }
@@ -84,6 +221,8 @@ type EgressIPTracker struct {
 	changedEgressIPs  map[*egressIPInfo]bool
 	changedNamespaces map[*namespaceEgress]bool
 	updateEgressCIDRs bool
+
+	failbackDelay time.Duration
 }
 
 func NewEgressIPTracker(watcher EgressIPWatcher) *EgressIPTracker {
@@ -100,6 +239,31 @@ func NewEgressIPTracker(watcher EgressIPWatcher) *EgressIPTracker {
 	}
 }
 
+// SetFailbackDelay sets how long a node that was offline must be back online before
+// it is used again; see EgressIPFailbackDelayAnnotation. It can be called at any
+// time; nodes that are already waiting keep their old delay, unless the delay is
+// now 0, in which case they are used again immediately.
+func (eit *EgressIPTracker) SetFailbackDelay(delay time.Duration) {
+	eit.Lock()
+	defer eit.Unlock()
+
+	if delay == eit.failbackDelay {
+		return
+	}
+	klog.Infof("Egress IP failback delay is now %v", delay)
+	eit.failbackDelay = delay
+	if delay > 0 {
+		return
+	}
+	for _, node := range eit.nodesByNodeIP {
+		if node.failbackTimer != nil {
+			node.failbackTimer.Stop()
+			node.failbackTimer = nil
+			eit.setNodeOffline(node, false)
+		}
+	}
+}
+
 func (eit *EgressIPTracker) Start(hostSubnetInformer osdninformers.HostSubnetInformer, netNamespaceInformer osdninformers.NetNamespaceInformer) {
 	eit.watchHostSubnets(hostSubnetInformer)
 	eit.watchNetNamespaces(netNamespaceInformer)
@@ -331,6 +495,21 @@ func (eit *EgressIPTracker) UpdateNetNamespaceEgress(netns *osdnv1.NetNamespace)
 	}
 	newRequestedIPs := sets.NewString(ns.requestedIPs...)
 
+	destinations, err := parseEgressIPDestinations(netns)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Ignoring invalid %s annotation on NetNamespace %q: %v", EgressIPDestinationsAnnotation, netns.Name, err))
+		destinations = nil
+	}
+	ns.bandwidth, err = parseEgressIPBandwidth(netns)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Ignoring invalid %s annotation on NetNamespace %q: %v", EgressIPBandwidthAnnotation, netns.Name, err))
+	}
+	if !reflect.DeepEqual(ns.destinations, destinations) {
+		ns.destinations = destinations
+		ns.destinationsChanged = true
+		eit.changedNamespaces[ns] = true
+	}
+
 	// Process new and removed EgressIPs
 	for _, ip := range newRequestedIPs.Difference(oldRequestedIPs).UnsortedList() {
 		eit.addNamespaceEgressIP(ns, ip)
@@ -390,8 +569,12 @@ func (eit *EgressIPTracker) syncEgressIPs() {
 		eit.syncEgressNodeState(eg, active)
 	}
 
-	for ns := range changedNamespaces {
-		eit.syncEgressNamespaceState(ns)
+	if len(changedNamespaces) > 0 {
+		eit.watcher.BeginNamespaceEgressChanges()
+		for ns := range changedNamespaces {
+			eit.syncEgressNamespaceState(ns)
+		}
+		eit.watcher.CommitNamespaceEgressChanges()
 	}
 
 	for eg := range changedEgressIPs {
@@ -412,11 +595,18 @@ func (eit *EgressIPTracker) syncEgressNodeState(eg *egressIPInfo, active bool) {
 	if active && eg.assignedNodeIP != eg.nodes[0].nodeIP {
 		klog.V(4).Infof("Assigning egress IP %s to node %s", eg.ip, eg.nodes[0].nodeIP)
 		eg.assignedNodeIP = eg.nodes[0].nodeIP
+		eg.assignedBandwidth = 0
 		eit.watcher.ClaimEgressIP(eg.namespaces[0].vnid, eg.ip, eg.assignedNodeIP)
 	} else if !active && eg.assignedNodeIP != "" {
 		klog.V(4).Infof("Removing egress IP %s from node %s", eg.ip, eg.assignedNodeIP)
 		eit.watcher.ReleaseEgressIP(eg.ip, eg.assignedNodeIP)
 		eg.assignedNodeIP = ""
+		eg.assignedBandwidth = 0
+	}
+
+	if active && eg.assignedBandwidth != eg.namespaces[0].bandwidth {
+		eg.assignedBandwidth = eg.namespaces[0].bandwidth
+		eit.watcher.SetEgressIPBandwidth(eg.ip, eg.assignedNodeIP, eg.assignedBandwidth)
 	}
 
 	if eg.assignedNodeIP == "" {
@@ -455,21 +645,63 @@ func (eit *EgressIPTracker) syncEgressNamespaceState(ns *namespaceEgress) {
 		}
 	}
 
+	destinationsChanged := ns.destinationsChanged
+	ns.destinationsChanged = false
 	if len(activeEgressIPs) > 0 {
-		if !activeEgressIPsTheSame(ns.activeEgressIPs, activeEgressIPs) {
+		if !activeEgressIPsTheSame(ns.activeEgressIPs, activeEgressIPs) || destinationsChanged {
 			ns.activeEgressIPs = activeEgressIPs
 			ns.shouldDropTraffic = false
-			eit.watcher.SetNamespaceEgressViaEgressIPs(ns.vnid, ns.activeEgressIPs)
+			eit.watcher.SetNamespaceEgressViaEgressIPs(ns.vnid, ns.destinations, ns.activeEgressIPs)
 		}
 	} else {
-		if !ns.shouldDropTraffic {
+		if !ns.shouldDropTraffic || destinationsChanged {
 			ns.activeEgressIPs = []EgressIPAssignment{}
 			ns.shouldDropTraffic = true
-			eit.watcher.SetNamespaceEgressDropped(ns.vnid)
+			eit.watcher.SetNamespaceEgressDropped(ns.vnid, ns.destinations)
 		}
 	}
 }
 
+// ResyncNamespaceEgress passes the egress state of every namespace with egress IPs
+// to the watcher again, whether or not it has changed, so that the watcher can
+// rewrite its rules
+func (eit *EgressIPTracker) ResyncNamespaceEgress() {
+	eit.Lock()
+	defer eit.Unlock()
+
+	for _, ns := range eit.namespacesByVNID {
+		if len(ns.requestedIPs) > 0 {
+			ns.destinationsChanged = true
+			eit.changedNamespaces[ns] = true
+		}
+	}
+	eit.syncEgressIPs()
+}
+
+// ReclaimEgressIPs passes each egress IP assigned to the node with IP nodeIP to the
+// watcher's ClaimEgressIP again, and passes the egress state of the namespaces that
+// use them to the watcher again, so that the watcher can redo its setup for them
+// (eg, because it has learned that nodeIP is now its own IP).
+func (eit *EgressIPTracker) ReclaimEgressIPs(nodeIP string) {
+	eit.Lock()
+	defer eit.Unlock()
+
+	for _, eg := range eit.egressIPs {
+		if eg.assignedNodeIP != nodeIP || len(eg.namespaces) == 0 {
+			continue
+		}
+		eit.watcher.ClaimEgressIP(eg.namespaces[0].vnid, eg.ip, nodeIP)
+		if eg.assignedBandwidth != 0 {
+			eit.watcher.SetEgressIPBandwidth(eg.ip, nodeIP, eg.assignedBandwidth)
+		}
+		for _, ns := range eg.namespaces {
+			ns.destinationsChanged = true
+			eit.changedNamespaces[ns] = true
+		}
+	}
+	eit.syncEgressIPs()
+}
+
 func (eit *EgressIPTracker) SetNodeOffline(nodeIP string, offline bool) {
 	eit.Lock()
 	defer eit.Unlock()
@@ -479,6 +711,44 @@ func (eit *EgressIPTracker) SetNodeOffline(nodeIP string, offline bool) {
 		return
 	}
 
+	if offline {
+		if node.failbackTimer != nil {
+			klog.Infof("Node %s went offline again during its failback delay", nodeIP)
+			node.failbackTimer.Stop()
+			node.failbackTimer = nil
+		}
+	} else if node.offline && eit.failbackDelay > 0 {
+		if node.failbackTimer == nil {
+			klog.Infof("Node %s is back online; waiting %v before using it again", nodeIP, eit.failbackDelay)
+			var timer *time.Timer
+			timer = time.AfterFunc(eit.failbackDelay, func() {
+				eit.endFailbackDelay(node, timer)
+			})
+			node.failbackTimer = timer
+		}
+		return
+	}
+
+	eit.setNodeOffline(node, offline)
+}
+
+// endFailbackDelay marks node online once its failback delay has passed, unless it
+// went offline again (or was deleted) in the meantime
+func (eit *EgressIPTracker) endFailbackDelay(node *nodeEgress, timer *time.Timer) {
+	eit.Lock()
+	defer eit.Unlock()
+
+	if node.failbackTimer != timer || eit.nodesByNodeIP[node.nodeIP] != node {
+		return
+	}
+	node.failbackTimer = nil
+	klog.Infof("Failback delay for node %s has passed", node.nodeIP)
+	eit.setNodeOffline(node, false)
+}
+
+// setNodeOffline updates node's offline status and resyncs. Must be called with the
+// lock held.
+func (eit *EgressIPTracker) setNodeOffline(node *nodeEgress, offline bool) {
 	node.offline = offline
 	for _, ip := range node.requestedIPs.UnsortedList() {
 		eg := eit.egressIPs[ip]
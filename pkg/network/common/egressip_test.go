@@ -4,8 +4,11 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ktypes "k8s.io/apimachinery/pkg/types"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
 
 	osdnv1 "github.com/openshift/api/network/v1"
 )
@@ -26,20 +29,37 @@ func (w *testEIPWatcher) ReleaseEgressIP(egressIP, nodeIP string) {
 	w.changes = append(w.changes, fmt.Sprintf("release %s on %s", egressIP, nodeIP))
 }
 
+func (w *testEIPWatcher) SetEgressIPBandwidth(egressIP, nodeIP string, bandwidth int64) {
+	w.changes = append(w.changes, fmt.Sprintf("limit %s on %s to %d", egressIP, nodeIP, bandwidth))
+}
+
+func (w *testEIPWatcher) BeginNamespaceEgressChanges() {
+}
+
+func (w *testEIPWatcher) CommitNamespaceEgressChanges() {
+}
+
 func (w *testEIPWatcher) SetNamespaceEgressNormal(vnid uint32) {
 	w.changes = append(w.changes, fmt.Sprintf("namespace %d normal", int(vnid)))
 }
 
-func (w *testEIPWatcher) SetNamespaceEgressDropped(vnid uint32) {
-	w.changes = append(w.changes, fmt.Sprintf("namespace %d dropped", int(vnid)))
+func (w *testEIPWatcher) SetNamespaceEgressDropped(vnid uint32, destinations []string) {
+	w.changes = append(w.changes, fmt.Sprintf("namespace %d dropped%s", int(vnid), destinationsSuffix(destinations)))
 }
 
-func (w *testEIPWatcher) SetNamespaceEgressViaEgressIPs(vnid uint32, activeEgressIPs []EgressIPAssignment) {
+func (w *testEIPWatcher) SetNamespaceEgressViaEgressIPs(vnid uint32, destinations []string, activeEgressIPs []EgressIPAssignment) {
 	for _, activeEgressIP := range activeEgressIPs {
-		w.changes = append(w.changes, fmt.Sprintf("namespace %d via %s on %s", int(vnid), activeEgressIP.EgressIP, activeEgressIP.NodeIP))
+		w.changes = append(w.changes, fmt.Sprintf("namespace %d via %s on %s%s", int(vnid), activeEgressIP.EgressIP, activeEgressIP.NodeIP, destinationsSuffix(destinations)))
 	}
 }
 
+func destinationsSuffix(destinations []string) string {
+	if len(destinations) == 0 {
+		return ""
+	}
+	return " to " + strings.Join(destinations, ",")
+}
+
 func (w *testEIPWatcher) UpdateEgressCIDRs() {
 	w.changes = append(w.changes, "update egress CIDRs")
 }
@@ -803,6 +823,232 @@ func TestOfflineEgressIPs(t *testing.T) {
 	}
 }
 
+func TestEgressIPFailbackDelay(t *testing.T) {
+	eit, w := setupEgressIPTracker(t)
+	eit.SetFailbackDelay(200 * time.Millisecond)
+
+	updateHostSubnetEgress(eit, &osdnv1.HostSubnet{
+		HostIP:    "172.17.0.3",
+		EgressIPs: []osdnv1.HostSubnetEgressIP{"172.17.0.100"},
+	})
+	updateHostSubnetEgress(eit, &osdnv1.HostSubnet{
+		HostIP:    "172.17.0.4",
+		EgressIPs: []osdnv1.HostSubnetEgressIP{"172.17.0.101"},
+	})
+	updateNetNamespaceEgress(eit, &osdnv1.NetNamespace{
+		NetID:     42,
+		EgressIPs: []osdnv1.NetNamespaceEgressIP{"172.17.0.100", "172.17.0.101"},
+	})
+	w.flushChanges()
+
+	// Going offline takes effect immediately
+	eit.SetNodeOffline("172.17.0.3", true)
+	err := w.assertChanges(
+		"namespace 42 via 172.17.0.101 on 172.17.0.4",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Coming back online doesn't, and going offline again during the delay
+	// restarts it
+	eit.SetNodeOffline("172.17.0.3", false)
+	eit.SetNodeOffline("172.17.0.3", true)
+	eit.SetNodeOffline("172.17.0.3", false)
+	err = w.assertNoChanges()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Once the delay has passed, the node gets used again
+	err = utilwait.PollImmediate(50*time.Millisecond, 5*time.Second, func() (bool, error) {
+		eit.Lock()
+		defer eit.Unlock()
+		return len(w.changes) > 0, nil
+	})
+	if err != nil {
+		t.Fatalf("node was not used again after failback delay")
+	}
+	eit.Lock()
+	err = w.assertChanges(
+		"namespace 42 via 172.17.0.100 on 172.17.0.3",
+		"namespace 42 via 172.17.0.101 on 172.17.0.4",
+	)
+	eit.Unlock()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Clearing the delay ends any pending failback immediately
+	eit.SetFailbackDelay(time.Hour)
+	eit.SetNodeOffline("172.17.0.3", true)
+	eit.SetNodeOffline("172.17.0.3", false)
+	w.flushChanges()
+	eit.SetFailbackDelay(0)
+	err = w.assertChanges(
+		"namespace 42 via 172.17.0.100 on 172.17.0.3",
+		"namespace 42 via 172.17.0.101 on 172.17.0.4",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestEgressIPBandwidth(t *testing.T) {
+	eit, w := setupEgressIPTracker(t)
+
+	updateHostSubnetEgress(eit, &osdnv1.HostSubnet{
+		HostIP:    "172.17.0.3",
+		EgressIPs: []osdnv1.HostSubnetEgressIP{"172.17.0.100"},
+	})
+	updateHostSubnetEgress(eit, &osdnv1.HostSubnet{
+		HostIP: "172.17.0.4",
+	})
+	ns := &osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				EgressIPBandwidthAnnotation: "10M",
+			},
+		},
+		NetID:     42,
+		EgressIPs: []osdnv1.NetNamespaceEgressIP{"172.17.0.100"},
+	}
+	updateNetNamespaceEgress(eit, ns)
+	err := w.assertChanges(
+		"claim 172.17.0.100 on 172.17.0.3 for namespace 42",
+		"limit 172.17.0.100 on 172.17.0.3 to 10000000",
+		"namespace 42 via 172.17.0.100 on 172.17.0.3",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Changing the bandwidth updates the limit
+	ns.Annotations[EgressIPBandwidthAnnotation] = "1Gi"
+	updateNetNamespaceEgress(eit, ns)
+	err = w.assertChanges(
+		"limit 172.17.0.100 on 172.17.0.3 to 1073741824",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Moving the egress IP sets the limit on the new node
+	updateHostSubnetEgress(eit, &osdnv1.HostSubnet{
+		HostIP: "172.17.0.3",
+	})
+	updateHostSubnetEgress(eit, &osdnv1.HostSubnet{
+		HostIP:    "172.17.0.4",
+		EgressIPs: []osdnv1.HostSubnetEgressIP{"172.17.0.100"},
+	})
+	err = w.assertChanges(
+		"release 172.17.0.100 on 172.17.0.3",
+		"namespace 42 dropped",
+		"claim 172.17.0.100 on 172.17.0.4 for namespace 42",
+		"limit 172.17.0.100 on 172.17.0.4 to 1073741824",
+		"namespace 42 via 172.17.0.100 on 172.17.0.4",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Removing (or breaking) the annotation removes the limit
+	ns.Annotations[EgressIPBandwidthAnnotation] = "fast"
+	updateNetNamespaceEgress(eit, ns)
+	err = w.assertChanges(
+		"limit 172.17.0.100 on 172.17.0.4 to 0",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestEgressIPDestinations(t *testing.T) {
+	eit, w := setupEgressIPTracker(t)
+
+	updateHostSubnetEgress(eit, &osdnv1.HostSubnet{
+		HostIP:    "172.17.0.3",
+		EgressIPs: []osdnv1.HostSubnetEgressIP{"172.17.0.100"},
+	})
+	ns := &osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				EgressIPDestinationsAnnotation: "192.168.1.0/24, 10.0.0.0/8",
+			},
+		},
+		NetID:     42,
+		EgressIPs: []osdnv1.NetNamespaceEgressIP{"172.17.0.100"},
+	}
+	updateNetNamespaceEgress(eit, ns)
+	err := w.assertChanges(
+		"claim 172.17.0.100 on 172.17.0.3 for namespace 42",
+		"namespace 42 via 172.17.0.100 on 172.17.0.3 to 10.0.0.0/8,192.168.1.0/24",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Reordering the destinations is not a change
+	ns.Annotations[EgressIPDestinationsAnnotation] = "10.0.0.0/8,192.168.1.0/24"
+	updateNetNamespaceEgress(eit, ns)
+	err = w.assertNoChanges()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Changing the destinations updates the namespace even though its egress IPs
+	// haven't changed
+	ns.Annotations[EgressIPDestinationsAnnotation] = "192.168.1.0/24"
+	updateNetNamespaceEgress(eit, ns)
+	err = w.assertChanges(
+		"namespace 42 via 172.17.0.100 on 172.17.0.3 to 192.168.1.0/24",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Only traffic to the destinations is dropped when the egress IP is unavailable
+	updateHostSubnetEgress(eit, &osdnv1.HostSubnet{
+		HostIP: "172.17.0.3",
+	})
+	err = w.assertChanges(
+		"release 172.17.0.100 on 172.17.0.3",
+		"namespace 42 dropped to 192.168.1.0/24",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	updateHostSubnetEgress(eit, &osdnv1.HostSubnet{
+		HostIP:    "172.17.0.3",
+		EgressIPs: []osdnv1.HostSubnetEgressIP{"172.17.0.100"},
+	})
+	w.flushChanges()
+
+	// An invalid annotation is ignored
+	ns.Annotations[EgressIPDestinationsAnnotation] = "192.168.1.0/24,bob"
+	updateNetNamespaceEgress(eit, ns)
+	err = w.assertChanges(
+		"namespace 42 via 172.17.0.100 on 172.17.0.3",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Removing the egress IPs returns the namespace to normal
+	ns.Annotations[EgressIPDestinationsAnnotation] = "192.168.1.0/24"
+	updateNetNamespaceEgress(eit, ns)
+	w.flushChanges()
+	ns.EgressIPs = nil
+	updateNetNamespaceEgress(eit, ns)
+	err = w.assertChanges(
+		"release 172.17.0.100 on 172.17.0.3",
+		"namespace 42 normal",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
 func updateAllocations(eit *EgressIPTracker, allocation map[string][]string) {
 	for nodeName, egressIPs := range allocation {
 		for _, node := range eit.nodesByNodeIP {
@@ -1326,3 +1572,41 @@ func TestEgressCIDRAllocationOffline(t *testing.T) {
 	}
 	updateAllocations(eit, allocation)
 }
+
+func TestEgressIPResync(t *testing.T) {
+	eit, w := setupEgressIPTracker(t)
+
+	updateHostSubnetEgress(eit, &osdnv1.HostSubnet{
+		HostIP:    "172.17.0.3",
+		EgressIPs: []osdnv1.HostSubnetEgressIP{"172.17.0.100"},
+	})
+	updateNetNamespaceEgress(eit, &osdnv1.NetNamespace{
+		NetID:     42,
+		EgressIPs: []osdnv1.NetNamespaceEgressIP{"172.17.0.100"},
+	})
+	updateNetNamespaceEgress(eit, &osdnv1.NetNamespace{
+		NetID:     43,
+		EgressIPs: []osdnv1.NetNamespaceEgressIP{"172.17.0.101"},
+	})
+	updateNetNamespaceEgress(eit, &osdnv1.NetNamespace{
+		NetID: 44,
+	})
+	err := w.assertChanges(
+		"claim 172.17.0.100 on 172.17.0.3 for namespace 42",
+		"namespace 42 via 172.17.0.100 on 172.17.0.3",
+		"namespace 43 dropped",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Resyncing re-sends the state of every namespace with egress IPs
+	eit.ResyncNamespaceEgress()
+	err = w.assertChanges(
+		"namespace 42 via 172.17.0.100 on 172.17.0.3",
+		"namespace 43 dropped",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package common
+
+import (
+	"strings"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	// HostSubnetEncapsulationsAnnotation is set on a HostSubnet by its node to a
+	// comma-separated list of the encapsulations that it can receive pod traffic
+	// with, in addition to VXLAN (which every node supports). Two nodes send pod
+	// traffic to each other with the first of EncapsulationNone, EncapsulationGeneve,
+	// and EncapsulationVXLAN that they both support.
+	HostSubnetEncapsulationsAnnotation = "network.openshift.io/encapsulations"
+
+	EncapsulationVXLAN  = "vxlan"
+	EncapsulationGeneve = "geneve"
+	// EncapsulationNone sends pod traffic unencapsulated, for the nodes' network
+	// to route
+	EncapsulationNone = "none"
+)
+
+// Encapsulations are the supported encapsulations, in order of preference
+var Encapsulations = []string{EncapsulationNone, EncapsulationGeneve, EncapsulationVXLAN}
+
+// GetHostSubnetEncapsulations returns the encapsulations that the node with
+// HostSubnet hs supports, including EncapsulationVXLAN. Unknown values in the
+// annotation are ignored.
+func GetHostSubnetEncapsulations(hs *osdnv1.HostSubnet) sets.String {
+	encapsulations := sets.NewString(EncapsulationVXLAN)
+	if value, ok := hs.Annotations[HostSubnetEncapsulationsAnnotation]; ok {
+		for _, encap := range strings.Split(value, ",") {
+			encap = strings.TrimSpace(encap)
+			if encap == EncapsulationNone || encap == EncapsulationGeneve {
+				encapsulations.Insert(encap)
+			}
+		}
+	}
+	return encapsulations
+}
@@ -4,6 +4,8 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
 )
 
 type fakeDNSReply struct {
@@ -24,11 +26,18 @@ type FakeDNS struct {
 	lock sync.Mutex
 	// Holds DNS name and its corresponding information
 	dnsReplies []fakeDNSReply
+	// Names passed to SetUpdating whose Update has not finished
+	updating sets.String
+
+	// Number of Update calls currently running, and the maximum seen
+	inFlight    int
+	maxInFlight int
 }
 
 func NewFakeDNS(dnsReplies []fakeDNSReply) *FakeDNS {
 	return &FakeDNS{
 		dnsReplies: dnsReplies,
+		updating:   sets.NewString(),
 	}
 }
 
@@ -49,6 +58,9 @@ func (f *FakeDNS) Delete(dns string) {
 
 }
 func (f *FakeDNS) SetUpdating(dns string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.updating.Insert(dns)
 	return nil
 }
 
@@ -68,8 +80,17 @@ func (f *FakeDNS) Update(dns string) (bool, error) {
 			break
 		}
 	}
+	f.inFlight++
+	if f.inFlight > f.maxInFlight {
+		f.maxInFlight = f.inFlight
+	}
 	f.lock.Unlock()
 	time.Sleep(delay)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.inFlight--
+	f.updating.Delete(dns)
 	return changed, nil
 }
 
@@ -81,7 +102,7 @@ func (f *FakeDNS) GetNextQueryTime() (time.Time, string, bool) {
 	var dns string
 
 	for i := range f.dnsReplies {
-		if !f.dnsReplies[i].hasBeenUpdated {
+		if !f.dnsReplies[i].hasBeenUpdated && !f.updating.Has(f.dnsReplies[i].name) {
 			timeSet = true
 			dns = f.dnsReplies[i].name
 			minTime = f.dnsReplies[i].nextQueryTime
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"time"
+)
+
+const (
+	// LastActivityAnnotation is set on a Service by the SDN controller, when idle
+	// detection is enabled, to the time (in RFC3339 format) that any node last saw
+	// new connections to it
+	LastActivityAnnotation = "network.openshift.io/last-activity"
+	// IdleCandidateAnnotation is set on a Service by the SDN controller, when idle
+	// detection is enabled, to the time that it became a candidate for idling, after
+	// having no new connections on any node for the idle detection period. It is
+	// removed when new connections are seen.
+	IdleCandidateAnnotation = "network.openshift.io/idle-candidate"
+
+	// IdleCandidateReason is the reason of the event emitted on a Service when it
+	// becomes a candidate for idling
+	IdleCandidateReason = "IdleCandidate"
+
+	// ServiceActivityLabel is set (to "true") on the ConfigMaps in which each node
+	// reports the services it has seen new connections to. Each ConfigMap is in
+	// NodeSDNLeaseNamespace and maps ServiceActivityKey() to the time (in RFC3339
+	// format) that the node last saw new connections to that service.
+	ServiceActivityLabel = "network.openshift.io/service-activity"
+)
+
+// ServiceActivityConfigMapName returns the name of the ConfigMap in which nodeName
+// reports service activity
+func ServiceActivityConfigMapName(nodeName string) string {
+	return "sdn-service-activity-" + nodeName
+}
+
+// ServiceActivityKey returns the ConfigMap key for the service namespace/name. (This
+// is unambiguous since namespace names can't contain ".".)
+func ServiceActivityKey(namespace, name string) string {
+	return namespace + "." + name
+}
+
+// IdleDetectionReportInterval returns how often nodes report service activity when
+// the idle detection period is period: often enough that the controller's idea of
+// when a service was last active is accurate to within a tenth of the period, but
+// no more than once a minute.
+func IdleDetectionReportInterval(period time.Duration) time.Duration {
+	interval := period / 10
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	return interval
+}
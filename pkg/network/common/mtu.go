@@ -0,0 +1,31 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+// HostSubnetUnderlayMTUAnnotation is set on a HostSubnet by its node to the MTU of
+// the interface that carries its VXLAN traffic, so that other nodes can detect
+// mismatches (which cause large packets between the nodes' pods to be silently
+// dropped).
+const HostSubnetUnderlayMTUAnnotation = "network.openshift.io/underlay-mtu"
+
+// GetHostSubnetUnderlayMTU returns the MTU in hs's HostSubnetUnderlayMTUAnnotation,
+// or 0 if it is unset or invalid.
+func GetHostSubnetUnderlayMTU(hs *osdnv1.HostSubnet) uint32 {
+	value, ok := hs.Annotations[HostSubnetUnderlayMTUAnnotation]
+	if !ok {
+		return 0
+	}
+	mtu, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || mtu == 0 {
+		utilruntime.HandleError(fmt.Errorf("invalid %s annotation %q on HostSubnet %q", HostSubnetUnderlayMTUAnnotation, value, hs.Name))
+		return 0
+	}
+	return uint32(mtu)
+}
@@ -1,5 +1,17 @@
 package common
 
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
 const (
 	// Maximum VXLAN Virtual Network Identifier(VNID) as per RFC#7348
 	MaxVNID = uint32((1 << 24) - 1)
@@ -9,3 +21,106 @@ const (
 	GlobalVNID = uint32(0)
 	// VNID: 1 reserved for control plane namespaces that need to reach each other in multitenant
 )
+
+// VNIDRangeAnnotation can be set on the ClusterNetwork to a range of VNIDs (eg,
+// "10-99999") to restrict the master's VNID allocation to, to leave the rest of the
+// VNIs free for other VXLAN users on the same fabric. The range must be within
+// MinVNID-MaxVNID, and the master refuses to start if any existing NetNamespace
+// (other than those with GlobalVNID) has a VNID outside of it. Changes take effect
+// when the master is restarted.
+const VNIDRangeAnnotation = "network.openshift.io/vnid-range"
+
+// parseVNIDRangeValue parses a "MIN-MAX" VNID range, which must be within
+// minVNID-maxVNID
+func parseVNIDRangeValue(value string, minVNID, maxVNID uint32) (uint32, uint32, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected MIN-MAX")
+	}
+	min, err1 := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+	max, err2 := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+	if err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("expected MIN-MAX")
+	}
+	if min < uint64(minVNID) || max > uint64(maxVNID) || min > max {
+		return 0, 0, fmt.Errorf("must be a range within %d-%d", minVNID, maxVNID)
+	}
+	return uint32(min), uint32(max), nil
+}
+
+// parseVNIDRange parses cn's VNIDRangeAnnotation, returning MinVNID and MaxVNID if
+// it is unset
+func parseVNIDRange(cn *osdnv1.ClusterNetwork) (uint32, uint32, error) {
+	value, ok := cn.Annotations[VNIDRangeAnnotation]
+	if !ok {
+		return MinVNID, MaxVNID, nil
+	}
+	min, max, err := parseVNIDRangeValue(value, MinVNID, MaxVNID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid %s annotation %q: %v", VNIDRangeAnnotation, value, err)
+	}
+	return min, max, nil
+}
+
+// VNIDBlocksAnnotation can be set on the ClusterNetwork to a JSON list of
+// VNIDBlockConfigs (eg, `[{"name": "finance", "namespaceSelector": {"matchLabels":
+// {"tenant": "finance"}}, "range": "1000-1999"}]`) to reserve contiguous blocks of
+// VNIDs for the namespaces matching each selector, so that tools that filter
+// traffic by VNI can tell which tenant it belongs to. The blocks must be within the
+// VNID allocation range (see VNIDRangeAnnotation) and must not overlap. A
+// namespace's block is chosen when its NetNamespace is created; changing its labels
+// later does not renumber it. Changes take effect when the master is restarted.
+const VNIDBlocksAnnotation = "network.openshift.io/vnid-blocks"
+
+// VNIDBlockConfig is an element of VNIDBlocksAnnotation
+type VNIDBlockConfig struct {
+	Name              string               `json:"name"`
+	NamespaceSelector metav1.LabelSelector `json:"namespaceSelector"`
+	Range             string               `json:"range"`
+}
+
+// VNIDBlock is a parsed VNIDBlockConfig
+type VNIDBlock struct {
+	Name     string
+	Selector labels.Selector
+	MinVNID  uint32
+	MaxVNID  uint32
+}
+
+// parseVNIDBlocks parses cn's VNIDBlocksAnnotation; the blocks must be within
+// minVNID-maxVNID
+func parseVNIDBlocks(cn *osdnv1.ClusterNetwork, minVNID, maxVNID uint32) ([]VNIDBlock, error) {
+	value, ok := cn.Annotations[VNIDBlocksAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var configs []VNIDBlockConfig
+	if err := json.Unmarshal([]byte(value), &configs); err != nil {
+		return nil, fmt.Errorf("could not parse %s annotation: %v", VNIDBlocksAnnotation, err)
+	}
+
+	blocks := make([]VNIDBlock, 0, len(configs))
+	for _, config := range configs {
+		if config.Name == "" {
+			return nil, fmt.Errorf("invalid %s annotation: block with no name", VNIDBlocksAnnotation)
+		}
+		selector, err := metav1.LabelSelectorAsSelector(&config.NamespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespaceSelector for VNID block %q: %v", config.Name, err)
+		}
+		if selector.Empty() {
+			return nil, fmt.Errorf("invalid namespaceSelector for VNID block %q: must not be empty", config.Name)
+		}
+		min, max, err := parseVNIDRangeValue(config.Range, minVNID, maxVNID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q for VNID block %q: %v", config.Range, config.Name, err)
+		}
+		for _, other := range blocks {
+			if min <= other.MaxVNID && other.MinVNID <= max {
+				return nil, fmt.Errorf("VNID block %q overlaps with %q", config.Name, other.Name)
+			}
+		}
+		blocks = append(blocks, VNIDBlock{Name: config.Name, Selector: selector, MinVNID: min, MaxVNID: max})
+	}
+	return blocks, nil
+}
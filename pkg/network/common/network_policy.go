@@ -0,0 +1,81 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// NetworkPolicyStatusAnnotation is set on NetworkPolicies by the SDN controller,
+	// indicating whether all of the policy can be implemented by openshift-sdn.
+	// (Failures to program a policy on a particular node are reported as Events.)
+	NetworkPolicyStatusAnnotation = "network.openshift.io/policy-status"
+
+	NetworkPolicyStatusProgrammed          = "Programmed"
+	NetworkPolicyStatusPartiallyProgrammed = "PartiallyProgrammed"
+
+	// NodePluginAnnotation is set on a Node by the master, during a migration from
+	// the multitenant plugin to the NetworkPolicy plugin, to the name of the
+	// NetworkPolicy plugin. The SDN process on that node then runs the NetworkPolicy
+	// plugin even though the ClusterNetwork still specifies the multitenant plugin,
+	// restarting if the annotation is added or removed while it is running.
+	NodePluginAnnotation = "network.openshift.io/sdn-plugin"
+)
+
+// NetworkPolicyUnsupportedFeatures returns a description of each part of policy that
+// openshift-sdn ignores when converting it to flows
+func NetworkPolicyUnsupportedFeatures(policy *networkingv1.NetworkPolicy) []string {
+	var unsupported []string
+
+	affectsIngress := false
+	for _, ptype := range policy.Spec.PolicyTypes {
+		if ptype == networkingv1.PolicyTypeIngress {
+			affectsIngress = true
+		}
+	}
+	for _, ptype := range policy.Spec.PolicyTypes {
+		if ptype == networkingv1.PolicyTypeEgress {
+			unsupported = append(unsupported, "egress rules are not supported")
+			break
+		}
+	}
+	if !affectsIngress {
+		return unsupported
+	}
+
+	for _, rule := range policy.Spec.Ingress {
+		for _, port := range rule.Ports {
+			if port.Protocol != nil && *port.Protocol != corev1.ProtocolTCP && *port.Protocol != corev1.ProtocolUDP && *port.Protocol != corev1.ProtocolSCTP {
+				unsupported = append(unsupported, fmt.Sprintf("unrecognized protocol %q", *port.Protocol))
+			} else if port.Port != nil && port.Port.Type != intstr.Int {
+				unsupported = append(unsupported, fmt.Sprintf("named port %q is not supported", port.Port.StrVal))
+			}
+		}
+		for _, peer := range rule.From {
+			if peer.IPBlock == nil {
+				continue
+			}
+			for _, cidr := range append([]string{peer.IPBlock.CIDR}, peer.IPBlock.Except...) {
+				if _, _, err := net.ParseCIDR(cidr); err != nil {
+					unsupported = append(unsupported, fmt.Sprintf("invalid ipBlock: %v", err))
+					break
+				}
+			}
+		}
+	}
+	return unsupported
+}
+
+// NetworkPolicyStatus returns the value of NetworkPolicyStatusAnnotation for policy
+func NetworkPolicyStatus(policy *networkingv1.NetworkPolicy) string {
+	unsupported := NetworkPolicyUnsupportedFeatures(policy)
+	if len(unsupported) == 0 {
+		return NetworkPolicyStatusProgrammed
+	}
+	return fmt.Sprintf("%s: %s", NetworkPolicyStatusPartiallyProgrammed, strings.Join(unsupported, "; "))
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+// NodeSDNStatusAnnotation is set on a node's HostSubnet by the SDN process on that
+// node to a JSON-encoded NodeSDNStatus, describing the result of its health checks.
+// It is only rewritten when the status changes; the node shows that it is still
+// running by renewing its SDN Lease (see NodeSDNLeaseName). The master aggregates
+// these into a cluster-wide status.
+const NodeSDNStatusAnnotation = "network.openshift.io/node-sdn-status"
+
+// NodeSDNLeaseNamespace is the namespace of the nodes' SDN Leases
+const NodeSDNLeaseNamespace = "openshift-sdn"
+
+// NodeSDNLeaseName returns the name of the Lease in NodeSDNLeaseNamespace that the
+// SDN process on nodeName renews while it is running
+func NodeSDNLeaseName(nodeName string) string {
+	return "sdn-" + nodeName
+}
+
+// NodeSDNStatus is the value of NodeSDNStatusAnnotation
+type NodeSDNStatus struct {
+	// LastUpdate is when the annotation was last written (ie, when the status
+	// last changed)
+	LastUpdate metav1.Time `json:"lastUpdate"`
+	// Ready is true if all of the node's health checks are passing
+	Ready bool `json:"ready"`
+	// Failures maps each failing subsystem to a description of the problem
+	Failures map[string]string `json:"failures,omitempty"`
+	// PluginName is the plugin the node is running
+	PluginName string `json:"pluginName,omitempty"`
+}
+
+// GetNodeSDNStatus returns the contents of hs's NodeSDNStatusAnnotation, or nil if
+// it is unset or invalid.
+func GetNodeSDNStatus(hs *osdnv1.HostSubnet) *NodeSDNStatus {
+	value, ok := hs.Annotations[NodeSDNStatusAnnotation]
+	if !ok {
+		return nil
+	}
+	status := &NodeSDNStatus{}
+	if err := json.Unmarshal([]byte(value), status); err != nil {
+		utilruntime.HandleError(fmt.Errorf("invalid %s annotation on HostSubnet %q: %v", NodeSDNStatusAnnotation, hs.Name, err))
+		return nil
+	}
+	return status
+}
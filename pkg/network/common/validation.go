@@ -1,10 +1,12 @@
 package common
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 
 	"k8s.io/apimachinery/pkg/api/validation/path"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	utilvalidation "k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/kubernetes/pkg/apis/core/validation"
@@ -140,6 +142,9 @@ func ValidateHostSubnet(hs *osdnv1.HostSubnet) error {
 			allErrs = append(allErrs, field.Invalid(field.NewPath("subnet"), hs.Subnet, err.Error()))
 		}
 	}
+	if _, err := GetHostSubnetIPv6(hs); err != nil {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("metadata", "annotations").Key(HostSubnetIPv6Annotation), hs.Annotations[HostSubnetIPv6Annotation], err.Error()))
+	}
 	// In theory this has to be IPv4, but it's possible some clusters might be limping along with IPv6 values?
 	if net.ParseIP(hs.HostIP) == nil {
 		allErrs = append(allErrs, field.Invalid(field.NewPath("hostIP"), hs.HostIP, "invalid IP address"))
@@ -178,3 +183,101 @@ func ValidateHostSubnetEgress(hs *osdnv1.HostSubnet) error {
 func cidrsOverlap(cidr1, cidr2 *net.IPNet) bool {
 	return cidr1.Contains(cidr2.IP) || cidr2.Contains(cidr1.IP)
 }
+
+// ClusterNetworkValidationAnnotation is set on the ClusterNetwork by the master, to
+// a JSON-encoded ClusterNetworkValidation indicating whether it has accepted the
+// current configuration, and recording the last configuration it accepted. The
+// master and nodes use that configuration (see GetAcceptedClusterNetwork) rather
+// than the ClusterNetwork itself, so a rejected change has no effect even after
+// they restart.
+const ClusterNetworkValidationAnnotation = "network.openshift.io/cluster-network-validation"
+
+// ClusterNetworkValidation is the value of ClusterNetworkValidationAnnotation
+type ClusterNetworkValidation struct {
+	// ClusterNetworks are the clusterNetworks CIDRs that were validated
+	ClusterNetworks []string `json:"clusterNetworks"`
+	// Accepted is whether the master accepted the ClusterNetwork
+	Accepted bool `json:"accepted"`
+	// Message explains why the ClusterNetwork was rejected
+	Message string `json:"message,omitempty"`
+	// AcceptedNetwork is the last configuration that the master accepted (which is
+	// the current configuration if Accepted is true)
+	AcceptedNetwork *AcceptedClusterNetwork `json:"acceptedNetwork,omitempty"`
+}
+
+// AcceptedClusterNetwork holds the ClusterNetwork fields that the master validates
+// changes to
+type AcceptedClusterNetwork struct {
+	ClusterNetworks []osdnv1.ClusterNetworkEntry `json:"clusterNetworks"`
+	ServiceNetwork  string                       `json:"serviceNetwork"`
+	PluginName      string                       `json:"pluginName"`
+	VXLANPort       uint32                       `json:"vxlanPort"`
+	MTU             uint32                       `json:"mtu"`
+}
+
+// NewAcceptedClusterNetwork returns the AcceptedClusterNetwork corresponding to pcn
+func NewAcceptedClusterNetwork(pcn *ParsedClusterNetwork) *AcceptedClusterNetwork {
+	accepted := &AcceptedClusterNetwork{
+		ClusterNetworks: make([]osdnv1.ClusterNetworkEntry, 0, len(pcn.ClusterNetworks)),
+		ServiceNetwork:  pcn.ServiceNetwork.String(),
+		PluginName:      pcn.PluginName,
+		VXLANPort:       pcn.VXLANPort,
+		MTU:             pcn.MTU,
+	}
+	for _, entry := range pcn.ClusterNetworks {
+		accepted.ClusterNetworks = append(accepted.ClusterNetworks, osdnv1.ClusterNetworkEntry{
+			CIDR:             entry.ClusterCIDR.String(),
+			HostSubnetLength: entry.HostSubnetLength,
+		})
+	}
+	return accepted
+}
+
+// ClusterNetworkCIDRs returns the clusterNetworks CIDRs of cn, as used in
+// ClusterNetworkValidation
+func ClusterNetworkCIDRs(cn *osdnv1.ClusterNetwork) []string {
+	cidrs := make([]string, 0, len(cn.ClusterNetworks))
+	for _, entry := range cn.ClusterNetworks {
+		cidrs = append(cidrs, entry.CIDR)
+	}
+	return cidrs
+}
+
+// GetClusterNetworkValidation returns the contents of cn's
+// ClusterNetworkValidationAnnotation, or nil if it is unset or invalid
+func GetClusterNetworkValidation(cn *osdnv1.ClusterNetwork) *ClusterNetworkValidation {
+	value, ok := cn.Annotations[ClusterNetworkValidationAnnotation]
+	if !ok {
+		return nil
+	}
+	validation := &ClusterNetworkValidation{}
+	if err := json.Unmarshal([]byte(value), validation); err != nil {
+		utilruntime.HandleError(fmt.Errorf("invalid %s annotation on ClusterNetwork: %v", ClusterNetworkValidationAnnotation, err))
+		return nil
+	}
+	return validation
+}
+
+// GetAcceptedClusterNetwork returns a copy of cn with the configuration that the
+// master last accepted, or cn itself if the master has not recorded one (eg,
+// because the ClusterNetwork has never been validated).
+func GetAcceptedClusterNetwork(cn *osdnv1.ClusterNetwork) *osdnv1.ClusterNetwork {
+	validation := GetClusterNetworkValidation(cn)
+	if validation == nil || validation.AcceptedNetwork == nil {
+		return cn
+	}
+	accepted := validation.AcceptedNetwork
+	cn = cn.DeepCopy()
+	cn.ClusterNetworks = append([]osdnv1.ClusterNetworkEntry{}, accepted.ClusterNetworks...)
+	cn.ServiceNetwork = accepted.ServiceNetwork
+	cn.PluginName = accepted.PluginName
+	cn.VXLANPort = &accepted.VXLANPort
+	cn.MTU = &accepted.MTU
+	// Keep the deprecated single-network fields consistent with ClusterNetworks,
+	// as ValidateClusterNetwork requires
+	if len(cn.ClusterNetworks) > 0 {
+		cn.Network = cn.ClusterNetworks[0].CIDR
+		cn.HostSubnetLength = cn.ClusterNetworks[0].HostSubnetLength
+	}
+	return cn
+}
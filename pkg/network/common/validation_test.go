@@ -1,6 +1,7 @@
 package common
 
 import (
+	"reflect"
 	"testing"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -248,6 +249,36 @@ func TestValidateHostSubnet(t *testing.T) {
 			},
 			expectedErrors: 0,
 		},
+		{
+			name: "good IPv6 subnet",
+			hs: &osdnv1.HostSubnet{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "abc.def.com",
+					Annotations: map[string]string{
+						HostSubnetIPv6Annotation: "fd01:0:0:1::/64",
+					},
+				},
+				Host:   "abc.def.com",
+				HostIP: "10.20.30.40",
+				Subnet: "8.8.8.0/24",
+			},
+			expectedErrors: 0,
+		},
+		{
+			name: "bad IPv6 subnet",
+			hs: &osdnv1.HostSubnet{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "abc.def.com",
+					Annotations: map[string]string{
+						HostSubnetIPv6Annotation: "8.8.9.0/24",
+					},
+				},
+				Host:   "abc.def.com",
+				HostIP: "10.20.30.40",
+				Subnet: "8.8.8.0/24",
+			},
+			expectedErrors: 1,
+		},
 	}
 
 	for _, tc := range tests {
@@ -260,3 +291,49 @@ func TestValidateHostSubnet(t *testing.T) {
 		}
 	}
 }
+
+func TestGetAcceptedClusterNetwork(t *testing.T) {
+	cn := &osdnv1.ClusterNetwork{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: osdnv1.ClusterNetworkDefault,
+		},
+		ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "10.128.0.0/14", HostSubnetLength: 9}},
+		ServiceNetwork:  "172.30.0.0/16",
+		PluginName:      "redhat/openshift-ovs-networkpolicy",
+	}
+	if accepted := GetAcceptedClusterNetwork(cn); accepted != cn {
+		t.Fatalf("ClusterNetwork without validation status should be used as-is")
+	}
+
+	// A rejected change: the previously-accepted configuration is used instead
+	cn.ClusterNetworks = append(cn.ClusterNetworks, osdnv1.ClusterNetworkEntry{CIDR: "10.132.0.0/14", HostSubnetLength: 8})
+	cn.Annotations = map[string]string{ClusterNetworkValidationAnnotation: `{"clusterNetworks":["10.128.0.0/14","10.132.0.0/14"],"accepted":false,"message":"bad",` +
+		`"acceptedNetwork":{"clusterNetworks":[{"CIDR":"10.128.0.0/14","hostSubnetLength":9}],"serviceNetwork":"172.30.0.0/16","pluginName":"redhat/openshift-ovs-networkpolicy","vxlanPort":4789,"mtu":1450}}`}
+	if validation := GetClusterNetworkValidation(cn); validation == nil || validation.Message != "bad" {
+		t.Fatalf("unexpected validation status %#v", validation)
+	}
+	accepted := GetAcceptedClusterNetwork(cn)
+	if len(accepted.ClusterNetworks) != 1 || accepted.ClusterNetworks[0].CIDR != "10.128.0.0/14" || *accepted.MTU != 1450 {
+		t.Fatalf("unexpected accepted ClusterNetwork %#v", accepted)
+	}
+	if len(cn.ClusterNetworks) != 2 {
+		t.Fatalf("original ClusterNetwork was modified")
+	}
+	if err := ValidateClusterNetwork(accepted); err != nil {
+		t.Fatalf("unexpected error validating accepted ClusterNetwork: %v", err)
+	}
+
+	// The recorded configuration round-trips through NewAcceptedClusterNetwork
+	pcn, err := ParseClusterNetwork(accepted)
+	if err != nil {
+		t.Fatalf("unexpected error parsing accepted ClusterNetwork: %v", err)
+	}
+	if validation := GetClusterNetworkValidation(cn); !reflect.DeepEqual(NewAcceptedClusterNetwork(pcn), validation.AcceptedNetwork) {
+		t.Fatalf("expected %#v, got %#v", validation.AcceptedNetwork, NewAcceptedClusterNetwork(pcn))
+	}
+
+	cn.Annotations[ClusterNetworkValidationAnnotation] = "not json"
+	if accepted := GetAcceptedClusterNetwork(cn); accepted != cn {
+		t.Fatalf("ClusterNetwork with invalid validation status should be used as-is")
+	}
+}
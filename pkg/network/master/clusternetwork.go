@@ -0,0 +1,406 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/util/retry"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/library-go/pkg/network/networkutils"
+	"github.com/openshift/sdn/pkg/network/common"
+	"github.com/openshift/sdn/pkg/network/master/metrics"
+)
+
+const (
+	// DrainingClusterNetworksAnnotation can be set on the ClusterNetwork to a
+	// comma-separated list of clusterNetworks CIDRs that no new HostSubnets should be
+	// allocated from. To move a node to another clusterNetwork, drain it, delete its
+	// HostSubnet (which the master will then re-create), and restart its SDN pod.
+	// Once no HostSubnets remain in a draining clusterNetwork, it can be removed from
+	// the ClusterNetwork.
+	DrainingClusterNetworksAnnotation = "network.openshift.io/draining-cluster-networks"
+
+	// ClusterNetworkMigrationStatusAnnotation is set on the ClusterNetwork by the
+	// master, to a JSON-encoded list of clusterNetworkStatus
+	ClusterNetworkMigrationStatusAnnotation = "network.openshift.io/cluster-network-migration-status"
+
+	clusterNetworkActive   = "Active"
+	clusterNetworkDraining = "Draining"
+	clusterNetworkDrained  = "Drained"
+	clusterNetworkRemoving = "Removing"
+
+	clusterNetworkSyncInterval = time.Minute
+
+	// A warning event is emitted when fewer than this fraction of a
+	// clusterNetwork's host subnets remain available
+	subnetCapacityWarningFraction = 0.1
+)
+
+// clusterNetworkStatus is the migration status of a single clusterNetworks entry
+type clusterNetworkStatus struct {
+	CIDR        string `json:"cidr"`
+	State       string `json:"state"`
+	HostSubnets int    `json:"hostSubnets"`
+}
+
+func (master *OsdnMaster) startClusterNetworkMaster() {
+	funcs := common.InformerFuncs(&osdnv1.ClusterNetwork{}, master.handleAddOrUpdateClusterNetwork, nil)
+	master.clusterNetworkInformer.Informer().AddEventHandler(funcs)
+
+	// HostSubnets move between clusterNetworks gradually, so resync periodically to
+	// keep the status up to date
+	go utilwait.Forever(master.syncClusterNetwork, clusterNetworkSyncInterval)
+}
+
+func (master *OsdnMaster) handleAddOrUpdateClusterNetwork(obj, _ interface{}, eventType watch.EventType) {
+	cn := obj.(*osdnv1.ClusterNetwork)
+	if cn.Name != osdnv1.ClusterNetworkDefault {
+		return
+	}
+	klog.V(5).Infof("Watch %s event for ClusterNetwork %q", eventType, cn.Name)
+
+	master.syncClusterNetwork()
+}
+
+// getNetworkInfo returns the last ClusterNetwork that passed validation
+func (master *OsdnMaster) getNetworkInfo() *common.ParsedClusterNetwork {
+	master.clusterNetworkLock.Lock()
+	defer master.clusterNetworkLock.Unlock()
+	return master.networkInfo
+}
+
+// syncClusterNetwork updates master.networkInfo and the subnet allocator's ranges to
+// match the ClusterNetwork and updates the ClusterNetwork's migration status
+func (master *OsdnMaster) syncClusterNetwork() {
+	master.clusterNetworkLock.Lock()
+	defer master.clusterNetworkLock.Unlock()
+
+	cn, err := master.clusterNetworkInformer.Lister().Get(osdnv1.ClusterNetworkDefault)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not get ClusterNetwork: %v", err))
+		return
+	}
+	subnets, err := master.hostSubnetInformer.Lister().List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not list HostSubnets: %v", err))
+		return
+	}
+
+	draining := parseDrainingClusterNetworks(cn)
+	pcn, err := master.validateClusterNetwork(cn, draining, subnets)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Rejecting ClusterNetwork change: %v", err))
+		master.updateClusterNetworkValidation(cn, err)
+		return
+	}
+	if !reflect.DeepEqual(master.networkInfo, pcn) {
+		klog.V(2).Infof("Reloaded ClusterNetwork configuration")
+	}
+	master.networkInfo = pcn
+	master.updateClusterNetworkValidation(cn, nil)
+	if master.egressIPManager != nil {
+		master.egressIPManager.tracker.SetFailbackDelay(pcn.EgressIPFailbackDelay)
+	}
+
+	cidrs := make([]string, 0, len(pcn.ClusterNetworks))
+	for _, entry := range pcn.ClusterNetworks {
+		cidr := entry.ClusterCIDR.String()
+		cidrs = append(cidrs, cidr)
+		if !master.subnetAllocator.HasNetworkRange(cidr) {
+			if err := master.subnetAllocator.AddNetworkRange(cidr, entry.HostSubnetLength); err != nil {
+				utilruntime.HandleError(fmt.Errorf("could not add clusterNetwork %s: %v", cidr, err))
+				continue
+			}
+			klog.Infof("Added clusterNetwork %s", cidr)
+		}
+		if err := master.subnetAllocator.SetNetworkRangeDraining(cidr, draining.Has(cidr)); err != nil {
+			utilruntime.HandleError(err)
+		}
+	}
+
+	var removing []string
+	current := sets.NewString(cidrs...)
+	for _, cidr := range master.subnetAllocator.NetworkRanges() {
+		if current.Has(cidr) {
+			continue
+		}
+		if err := master.subnetAllocator.SetNetworkRangeDraining(cidr, true); err != nil {
+			utilruntime.HandleError(err)
+		}
+		if err := master.subnetAllocator.RemoveNetworkRange(cidr); err != nil {
+			klog.V(2).Infof("Not removing clusterNetwork %s yet: %v", cidr, err)
+			removing = append(removing, cidr)
+		} else {
+			klog.Infof("Removed clusterNetwork %s", cidr)
+			metrics.HostSubnetsAllocated.DeleteLabelValues(cidr)
+			metrics.HostSubnetsAvailable.DeleteLabelValues(cidr)
+		}
+	}
+	master.updateSubnetCapacity(cn)
+
+	status := getClusterNetworkStatus(cidrs, draining, removing, subnets)
+	if clusterNetworkStatusEqual(cn, status) {
+		return
+	}
+	if err := master.setClusterNetworkStatus(status); err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not update ClusterNetwork status: %v", err))
+	}
+}
+
+// validateClusterNetwork validates cn and checks that it is a safe change from the
+// last ClusterNetwork that was accepted, returning the parsed ClusterNetwork
+func (master *OsdnMaster) validateClusterNetwork(cn *osdnv1.ClusterNetwork, draining sets.String, subnets []*osdnv1.HostSubnet) (*common.ParsedClusterNetwork, error) {
+	if err := common.ValidateClusterNetwork(cn); err != nil {
+		return nil, err
+	}
+	pcn, err := common.ParseClusterNetwork(cn)
+	if err != nil {
+		return nil, err
+	}
+	hostIPNets, _, err := common.GetHostIPNetworks([]string{tun0})
+	if err != nil {
+		return nil, err
+	}
+	old := master.networkInfo
+	if old.PluginName == networkutils.MultiTenantPluginName && pcn.PluginName == networkutils.NetworkPolicyPluginName &&
+		master.npMigrator != nil && master.npMigrator.migrationComplete() {
+		// Every node is already running the NetworkPolicy plugin (see
+		// NetworkPolicyMigrationAnnotation), so this is the last step of the migration
+		migrated := *old
+		migrated.PluginName = pcn.PluginName
+		old = &migrated
+	}
+	if err := validateClusterNetworkChange(old, pcn, draining, subnets, hostIPNets); err != nil {
+		return nil, err
+	}
+	return pcn, nil
+}
+
+// validateClusterNetworkChange checks that changing the ClusterNetwork from old to
+// pcn is safe: the clusterNetworks may be added to, but existing entries may only
+// be removed once they are draining (or have no HostSubnets) and can't otherwise be
+// modified; the other fields can't be changed at all; and the new clusterNetworks
+// must not overlap the host networks or any node's IP.
+func validateClusterNetworkChange(old, pcn *common.ParsedClusterNetwork, draining sets.String, subnets []*osdnv1.HostSubnet, hostIPNets []*net.IPNet) error {
+	var errs []error
+
+	if pcn.PluginName != old.PluginName {
+		errs = append(errs, fmt.Errorf("pluginName cannot be changed from %q to %q", old.PluginName, pcn.PluginName))
+	}
+	if pcn.ServiceNetwork.String() != old.ServiceNetwork.String() {
+		errs = append(errs, fmt.Errorf("serviceNetwork cannot be changed from %s to %s", old.ServiceNetwork.String(), pcn.ServiceNetwork.String()))
+	}
+	if pcn.VXLANPort != old.VXLANPort {
+		errs = append(errs, fmt.Errorf("vxlanPort cannot be changed from %d to %d", old.VXLANPort, pcn.VXLANPort))
+	}
+	if pcn.MTU != old.MTU {
+		errs = append(errs, fmt.Errorf("mtu cannot be changed from %d to %d", old.MTU, pcn.MTU))
+	}
+
+	newEntries := make(map[string]uint32, len(pcn.ClusterNetworks))
+	for _, entry := range pcn.ClusterNetworks {
+		newEntries[entry.ClusterCIDR.String()] = entry.HostSubnetLength
+	}
+	for _, entry := range old.ClusterNetworks {
+		cidr := entry.ClusterCIDR.String()
+		hostSubnetLength, ok := newEntries[cidr]
+		if !ok {
+			if !draining.Has(cidr) && countHostSubnetsIn(cidr, subnets) > 0 {
+				errs = append(errs, fmt.Errorf("clusterNetwork %s cannot be removed until it is drained (see the %s annotation)", cidr, DrainingClusterNetworksAnnotation))
+			}
+		} else if hostSubnetLength != entry.HostSubnetLength {
+			errs = append(errs, fmt.Errorf("hostSubnetLength of clusterNetwork %s cannot be changed from %d to %d", cidr, entry.HostSubnetLength, hostSubnetLength))
+		}
+	}
+
+	if err := pcn.CheckHostNetworks(hostIPNets); err != nil {
+		errs = append(errs, err)
+	}
+	for _, hs := range subnets {
+		if err := pcn.ValidateNodeIP(hs.HostIP); err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %v", hs.Host, err))
+		}
+	}
+
+	return kerrors.NewAggregate(errs)
+}
+
+// updateClusterNetworkValidation updates the ClusterNetwork's validation status
+// annotation to reflect err and to record master.networkInfo, and emits an
+// event if it is newly rejected
+func (master *OsdnMaster) updateClusterNetworkValidation(cn *osdnv1.ClusterNetwork, err error) {
+	validation := &common.ClusterNetworkValidation{
+		ClusterNetworks: common.ClusterNetworkCIDRs(cn),
+		Accepted:        err == nil,
+		AcceptedNetwork: common.NewAcceptedClusterNetwork(master.networkInfo),
+	}
+	if err != nil {
+		validation.Message = err.Error()
+	}
+	if reflect.DeepEqual(common.GetClusterNetworkValidation(cn), validation) {
+		return
+	}
+	if err != nil {
+		master.recorder.Eventf(clusterNetworkRef(cn), corev1.EventTypeWarning, "ClusterNetworkChangeRejected",
+			"ClusterNetwork change rejected: %v", err)
+	}
+
+	data, err := json.Marshal(validation)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cn, err := master.osdnClient.NetworkV1().ClusterNetworks().Get(context.TODO(), osdnv1.ClusterNetworkDefault, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if cn.Annotations[common.ClusterNetworkValidationAnnotation] == string(data) {
+			return nil
+		}
+		if cn.Annotations == nil {
+			cn.Annotations = make(map[string]string)
+		}
+		cn.Annotations[common.ClusterNetworkValidationAnnotation] = string(data)
+		_, err = master.osdnClient.NetworkV1().ClusterNetworks().Update(context.TODO(), cn, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not update ClusterNetwork validation status: %v", err))
+	}
+}
+
+// updateSubnetCapacity updates the host subnet capacity metrics, and emits an event
+// when a clusterNetwork that new HostSubnets are allocated from starts to run out
+// of subnets
+func (master *OsdnMaster) updateSubnetCapacity(cn *osdnv1.ClusterNetwork) {
+	for _, u := range master.subnetAllocator.Usage() {
+		var available uint64
+		if !u.Draining && u.Total > u.Allocated {
+			available = u.Total - u.Allocated
+		}
+		metrics.HostSubnetsAllocated.WithLabelValues(u.Network).Set(float64(u.Allocated))
+		metrics.HostSubnetsAvailable.WithLabelValues(u.Network).Set(float64(available))
+
+		low := !u.Draining && float64(available) < float64(u.Total)*subnetCapacityWarningFraction
+		if low && !master.lowCapacityNetworks.Has(u.Network) {
+			klog.Warningf("Only %d of %d host subnets remain available in clusterNetwork %s", available, u.Total, u.Network)
+			master.recorder.Eventf(clusterNetworkRef(cn), corev1.EventTypeWarning, "HostSubnetCapacityLow",
+				"Only %d of %d host subnets remain available in clusterNetwork %s", available, u.Total, u.Network)
+			master.lowCapacityNetworks.Insert(u.Network)
+		} else if !low {
+			master.lowCapacityNetworks.Delete(u.Network)
+		}
+	}
+}
+
+func clusterNetworkRef(cn *osdnv1.ClusterNetwork) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		Kind:       "ClusterNetwork",
+		APIVersion: "network.openshift.io/v1",
+		Name:       cn.Name,
+		UID:        cn.UID,
+	}
+}
+
+func parseDrainingClusterNetworks(cn *osdnv1.ClusterNetwork) sets.String {
+	draining := sets.NewString()
+	for _, cidr := range strings.Split(cn.Annotations[DrainingClusterNetworksAnnotation], ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("Ignoring invalid CIDR %q in annotation %s: %v", cidr, DrainingClusterNetworksAnnotation, err))
+			continue
+		}
+		draining.Insert(ipnet.String())
+	}
+	return draining
+}
+
+// getClusterNetworkStatus returns the status of each clusterNetworks entry in cidrs
+// (some of which may be draining) and of each entry in removing (which has been
+// removed from the ClusterNetwork but still has HostSubnets allocated from it)
+func getClusterNetworkStatus(cidrs []string, draining sets.String, removing []string, subnets []*osdnv1.HostSubnet) []clusterNetworkStatus {
+	status := make([]clusterNetworkStatus, 0, len(cidrs)+len(removing))
+	for _, cidr := range cidrs {
+		cns := clusterNetworkStatus{CIDR: cidr, State: clusterNetworkActive, HostSubnets: countHostSubnetsIn(cidr, subnets)}
+		if draining.Has(cidr) {
+			if cns.HostSubnets > 0 {
+				cns.State = clusterNetworkDraining
+			} else {
+				cns.State = clusterNetworkDrained
+			}
+		}
+		status = append(status, cns)
+	}
+	for _, cidr := range removing {
+		status = append(status, clusterNetworkStatus{CIDR: cidr, State: clusterNetworkRemoving, HostSubnets: countHostSubnetsIn(cidr, subnets)})
+	}
+	return status
+}
+
+func countHostSubnetsIn(cidr string, subnets []*osdnv1.HostSubnet) int {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, hs := range subnets {
+		if ip, _, err := net.ParseCIDR(hs.Subnet); err == nil && ipnet.Contains(ip) {
+			count++
+		}
+	}
+	return count
+}
+
+// clusterNetworkStatusEqual returns whether cn's migration status annotation is
+// already status
+func clusterNetworkStatusEqual(cn *osdnv1.ClusterNetwork, status []clusterNetworkStatus) bool {
+	old, ok := cn.Annotations[ClusterNetworkMigrationStatusAnnotation]
+	if !ok {
+		return false
+	}
+	var oldStatus []clusterNetworkStatus
+	return json.Unmarshal([]byte(old), &oldStatus) == nil && reflect.DeepEqual(oldStatus, status)
+}
+
+func (master *OsdnMaster) setClusterNetworkStatus(status []clusterNetworkStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cn, err := master.osdnClient.NetworkV1().ClusterNetworks().Get(context.TODO(), osdnv1.ClusterNetworkDefault, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if clusterNetworkStatusEqual(cn, status) {
+			return nil
+		}
+		if cn.Annotations == nil {
+			cn.Annotations = make(map[string]string)
+		}
+		cn.Annotations[ClusterNetworkMigrationStatusAnnotation] = string(data)
+		_, err = master.osdnClient.NetworkV1().ClusterNetworks().Update(context.TODO(), cn, metav1.UpdateOptions{})
+		return err
+	})
+}
@@ -0,0 +1,213 @@
+package master
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/sdn/pkg/network/common"
+	masterutil "github.com/openshift/sdn/pkg/network/master/util"
+)
+
+func TestClusterNetworkStatus(t *testing.T) {
+	cn := &osdnv1.ClusterNetwork{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: osdnv1.ClusterNetworkDefault,
+			Annotations: map[string]string{
+				DrainingClusterNetworksAnnotation: "10.128.0.0/14, 10.200.0.0/16,bad",
+			},
+		},
+	}
+	draining := parseDrainingClusterNetworks(cn)
+	if !reflect.DeepEqual(draining.List(), []string{"10.128.0.0/14", "10.200.0.0/16"}) {
+		t.Fatalf("unexpected draining clusterNetworks %v", draining.List())
+	}
+
+	subnets := []*osdnv1.HostSubnet{
+		{Subnet: "10.128.0.0/23"},
+		{Subnet: "10.128.2.0/23"},
+		{Subnet: "10.132.0.0/23"},
+		{Subnet: "10.150.4.0/24"},
+	}
+	status := getClusterNetworkStatus(
+		[]string{"10.128.0.0/14", "10.132.0.0/14", "10.200.0.0/16"},
+		draining,
+		[]string{"10.150.0.0/16"},
+		subnets,
+	)
+	expected := []clusterNetworkStatus{
+		{CIDR: "10.128.0.0/14", State: clusterNetworkDraining, HostSubnets: 2},
+		{CIDR: "10.132.0.0/14", State: clusterNetworkActive, HostSubnets: 1},
+		{CIDR: "10.200.0.0/16", State: clusterNetworkDrained, HostSubnets: 0},
+		{CIDR: "10.150.0.0/16", State: clusterNetworkRemoving, HostSubnets: 1},
+	}
+	if !reflect.DeepEqual(status, expected) {
+		t.Fatalf("unexpected status:\nexpected %#v\ngot %#v", expected, status)
+	}
+
+	if clusterNetworkStatusEqual(cn, status) {
+		t.Fatalf("unexpectedly found status on ClusterNetwork with no status")
+	}
+	cn.Annotations[ClusterNetworkMigrationStatusAnnotation] = `[{"cidr":"10.128.0.0/14","state":"Draining","hostSubnets":2},{"cidr":"10.132.0.0/14","state":"Active","hostSubnets":1},{"cidr":"10.200.0.0/16","state":"Drained","hostSubnets":0},{"cidr":"10.150.0.0/16","state":"Removing","hostSubnets":1}]`
+	if !clusterNetworkStatusEqual(cn, status) {
+		t.Fatalf("failed to match existing status")
+	}
+}
+
+func TestSubnetCapacityEvents(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	master := &OsdnMaster{
+		recorder:            recorder,
+		subnetAllocator:     masterutil.NewSubnetAllocator(),
+		lowCapacityNetworks: sets.NewString(),
+	}
+	cn := &osdnv1.ClusterNetwork{ObjectMeta: metav1.ObjectMeta{Name: osdnv1.ClusterNetworkDefault}}
+	if err := master.subnetAllocator.AddNetworkRange("10.128.0.0/20", 8); err != nil {
+		t.Fatal(err)
+	}
+
+	allocate := func(n int) {
+		for i := 0; i < n; i++ {
+			if _, err := master.subnetAllocator.AllocateNetwork(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expectEvents := func(n int) {
+		if len(recorder.Events) != n {
+			t.Fatalf("expected %d events, got %d", n, len(recorder.Events))
+		}
+		for i := 0; i < n; i++ {
+			if event := <-recorder.Events; !strings.Contains(event, "HostSubnetCapacityLow") {
+				t.Fatalf("unexpected event %q", event)
+			}
+		}
+	}
+
+	// 14 of 16 subnets allocated is still above the threshold
+	allocate(14)
+	master.updateSubnetCapacity(cn)
+	expectEvents(0)
+
+	// Running low warns once
+	allocate(1)
+	master.updateSubnetCapacity(cn)
+	expectEvents(1)
+	master.updateSubnetCapacity(cn)
+	expectEvents(0)
+
+	// Recovering and running low again warns again
+	if err := master.subnetAllocator.ReleaseNetwork("10.128.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if err := master.subnetAllocator.ReleaseNetwork("10.128.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	master.updateSubnetCapacity(cn)
+	expectEvents(0)
+	allocate(2)
+	master.updateSubnetCapacity(cn)
+	expectEvents(1)
+
+	// A draining clusterNetwork doesn't warn
+	if err := master.subnetAllocator.SetNetworkRangeDraining("10.128.0.0/20", true); err != nil {
+		t.Fatal(err)
+	}
+	master.lowCapacityNetworks = sets.NewString()
+	master.updateSubnetCapacity(cn)
+	expectEvents(0)
+}
+
+func TestValidateClusterNetworkChange(t *testing.T) {
+	// parse returns a ParsedClusterNetwork with the given clusterNetworks, which
+	// have a hostSubnetLength of 9, or 8 if suffixed with "=8"
+	parse := func(cidrs ...string) *common.ParsedClusterNetwork {
+		cn := &osdnv1.ClusterNetwork{
+			PluginName:     "redhat/openshift-ovs-networkpolicy",
+			ServiceNetwork: "172.30.0.0/16",
+		}
+		for _, cidr := range cidrs {
+			hostSubnetLength := uint32(9)
+			if parts := strings.Split(cidr, "="); len(parts) == 2 {
+				cidr = parts[0]
+				hostSubnetLength = 8
+			}
+			cn.ClusterNetworks = append(cn.ClusterNetworks, osdnv1.ClusterNetworkEntry{CIDR: cidr, HostSubnetLength: hostSubnetLength})
+		}
+		pcn, err := common.ParseClusterNetwork(cn)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %v: %v", cidrs, err)
+		}
+		return pcn
+	}
+	_, hostNet, _ := net.ParseCIDR("192.168.1.0/24")
+	hostIPNets := []*net.IPNet{hostNet}
+	subnets := []*osdnv1.HostSubnet{
+		{Host: "node1", HostIP: "192.168.1.10", Subnet: "10.128.0.0/23"},
+		{Host: "node2", HostIP: "192.168.1.11", Subnet: "10.132.0.0/23"},
+	}
+	old := parse("10.128.0.0/14", "10.132.0.0/14")
+
+	tests := []struct {
+		name     string
+		pcn      *common.ParsedClusterNetwork
+		draining []string
+		err      string
+	}{
+		{
+			name: "unchanged",
+			pcn:  parse("10.128.0.0/14", "10.132.0.0/14"),
+		},
+		{
+			name: "added",
+			pcn:  parse("10.128.0.0/14", "10.132.0.0/14", "10.200.0.0/16"),
+		},
+		{
+			name: "removed without draining",
+			pcn:  parse("10.128.0.0/14"),
+			err:  "clusterNetwork 10.132.0.0/14 cannot be removed until it is drained",
+		},
+		{
+			name:     "removed after draining",
+			pcn:      parse("10.128.0.0/14"),
+			draining: []string{"10.132.0.0/14"},
+		},
+		{
+			name: "changed hostSubnetLength",
+			pcn:  parse("10.128.0.0/14", "10.132.0.0/14=8"),
+			err:  "hostSubnetLength of clusterNetwork 10.132.0.0/14 cannot be changed from 9 to 8",
+		},
+		{
+			name: "overlaps host network",
+			pcn:  parse("10.128.0.0/14", "10.132.0.0/14", "192.168.0.0/16"),
+			err:  "conflicts with host network",
+		},
+	}
+	for _, tc := range tests {
+		err := validateClusterNetworkChange(old, tc.pcn, sets.NewString(tc.draining...), subnets, hostIPNets)
+		if tc.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		} else if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	// An empty clusterNetwork can be removed without draining
+	old = parse("10.128.0.0/14", "10.132.0.0/14", "10.200.0.0/16")
+	if err := validateClusterNetworkChange(old, parse("10.128.0.0/14", "10.132.0.0/14"), sets.NewString(), subnets, hostIPNets); err != nil {
+		t.Errorf("unexpected error removing empty clusterNetwork: %v", err)
+	}
+
+	// Other fields can't change
+	pcn := parse("10.128.0.0/14", "10.132.0.0/14", "10.200.0.0/16")
+	pcn.VXLANPort = 4790
+	if err := validateClusterNetworkChange(old, pcn, sets.NewString(), subnets, hostIPNets); err == nil || !strings.Contains(err.Error(), "vxlanPort cannot be changed") {
+		t.Errorf("expected vxlanPort error, got %v", err)
+	}
+}
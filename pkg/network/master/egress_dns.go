@@ -0,0 +1,170 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/klog/v2"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	osdnclient "github.com/openshift/client-go/network/clientset/versioned"
+	osdninformers "github.com/openshift/client-go/network/informers/externalversions/network/v1"
+	"github.com/openshift/sdn/pkg/network/common"
+	"github.com/openshift/sdn/pkg/network/master/metrics"
+)
+
+// egressDNSMaster resolves the dnsNames in EgressNetworkPolicies and publishes the
+// results in common.EgressDNSResolvedAnnotation, so that every node enforces the
+// policy against the same set of IPs, rather than each node resolving the names
+// independently (and possibly getting different answers from a load-balancing DNS
+// server).
+type egressDNSMaster struct {
+	sync.Mutex
+
+	osdnClient     osdnclient.Interface
+	policyInformer osdninformers.EgressNetworkPolicyInformer
+	egressDNS      *common.EgressDNS
+
+	// policies we are tracking, by UID
+	policies map[ktypes.UID]*osdnv1.EgressNetworkPolicy
+}
+
+func newEgressDNSMaster() (*egressDNSMaster, error) {
+	egressDNS, err := common.NewEgressDNS(true, false, "", nil, metrics.ObserveEgressDNSResolution)
+	if err != nil {
+		return nil, err
+	}
+	return &egressDNSMaster{
+		egressDNS: egressDNS,
+		policies:  make(map[ktypes.UID]*osdnv1.EgressNetworkPolicy),
+	}, nil
+}
+
+func (edm *egressDNSMaster) Start(osdnClient osdnclient.Interface, policyInformer osdninformers.EgressNetworkPolicyInformer) {
+	edm.osdnClient = osdnClient
+	edm.policyInformer = policyInformer
+
+	funcs := common.InformerFuncs(&osdnv1.EgressNetworkPolicy{}, edm.handleAddOrUpdateEgressNetworkPolicy, edm.handleDeleteEgressNetworkPolicy)
+	policyInformer.Informer().AddEventHandler(funcs)
+
+	go utilwait.Forever(edm.egressDNS.Sync, 0)
+	go utilwait.Forever(edm.watchDNSUpdates, 0)
+}
+
+func (edm *egressDNSMaster) handleAddOrUpdateEgressNetworkPolicy(obj, _ interface{}, eventType watch.EventType) {
+	policy := obj.(*osdnv1.EgressNetworkPolicy)
+	klog.V(5).Infof("Watch %s event for EgressNetworkPolicy %s/%s", eventType, policy.Namespace, policy.Name)
+
+	edm.Lock()
+	defer edm.Unlock()
+
+	// We get an update event for every annotation change we make ourselves, so only
+	// re-add the policy to egressDNS if its spec actually changed.
+	if oldPolicy, exists := edm.policies[policy.UID]; exists {
+		if reflect.DeepEqual(oldPolicy.Spec, policy.Spec) {
+			edm.policies[policy.UID] = policy
+			edm.publish(policy)
+			return
+		}
+		edm.egressDNS.Delete(*oldPolicy)
+		delete(edm.policies, policy.UID)
+	}
+
+	if common.HasExternalDNSNames(policy) {
+		edm.policies[policy.UID] = policy
+		edm.egressDNS.Add(*policy)
+	}
+	edm.publish(policy)
+}
+
+func (edm *egressDNSMaster) handleDeleteEgressNetworkPolicy(obj interface{}) {
+	policy := obj.(*osdnv1.EgressNetworkPolicy)
+	klog.V(5).Infof("Watch %s event for EgressNetworkPolicy %s/%s", watch.Deleted, policy.Namespace, policy.Name)
+
+	edm.Lock()
+	defer edm.Unlock()
+
+	if oldPolicy, exists := edm.policies[policy.UID]; exists {
+		edm.egressDNS.Delete(*oldPolicy)
+		delete(edm.policies, policy.UID)
+	}
+}
+
+func (edm *egressDNSMaster) watchDNSUpdates() {
+	for policyUpdates := range edm.egressDNS.Updates {
+		func() {
+			edm.Lock()
+			defer edm.Unlock()
+
+			for _, policyUpdate := range policyUpdates {
+				klog.V(5).Infof("Egress DNS sync: updating policy: %v", policyUpdate.UID)
+				if policy, exists := edm.policies[policyUpdate.UID]; exists {
+					edm.publish(policy)
+				}
+			}
+		}()
+	}
+}
+
+// publish updates policy's EgressDNSResolvedAnnotation, if needed. Must be called
+// with the lock held.
+func (edm *egressDNSMaster) publish(policy *osdnv1.EgressNetworkPolicy) {
+	var value *string
+	if common.HasExternalDNSNames(policy) {
+		resolved := make(map[string][]net.IP)
+		for _, rule := range policy.Spec.Egress {
+			if len(rule.To.DNSName) == 0 {
+				continue
+			}
+			// Leave out names that haven't been resolved yet; nodes will fall
+			// back to resolving those themselves.
+			if ips := edm.egressDNS.GetIPs(rule.To.DNSName); len(ips) > 0 {
+				resolved[rule.To.DNSName] = ips
+			}
+		}
+		formatted, err := common.FormatResolvedDNSNames(resolved)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("could not format resolved DNS names for EgressNetworkPolicy %s/%s: %v", policy.Namespace, policy.Name, err))
+			return
+		}
+		value = &formatted
+	}
+
+	oldValue, exists := policy.Annotations[common.EgressDNSResolvedAnnotation]
+	if value == nil && !exists {
+		return
+	} else if value != nil && exists && *value == oldValue {
+		return
+	}
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{
+				common.EgressDNSResolvedAnnotation: value,
+			},
+		},
+	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not create patch for EgressNetworkPolicy %s/%s: %v", policy.Namespace, policy.Name, err))
+		return
+	}
+
+	namespace, name := policy.Namespace, policy.Name
+	go func() {
+		_, err := edm.osdnClient.NetworkV1().EgressNetworkPolicies(namespace).Patch(context.TODO(), name, ktypes.MergePatchType, patchBytes, metav1.PatchOptions{})
+		if err != nil && !kerrors.IsNotFound(err) {
+			utilruntime.HandleError(fmt.Errorf("could not update resolved DNS names for EgressNetworkPolicy %s/%s: %v", namespace, name, err))
+		}
+	}()
+}
@@ -234,11 +234,20 @@ func (eim *egressIPManager) ClaimEgressIP(vnid uint32, egressIP, nodeIP string)
 func (eim *egressIPManager) ReleaseEgressIP(egressIP, nodeIP string) {
 }
 
+func (eim *egressIPManager) SetEgressIPBandwidth(egressIP, nodeIP string, bandwidth int64) {
+}
+
+func (eim *egressIPManager) BeginNamespaceEgressChanges() {
+}
+
+func (eim *egressIPManager) CommitNamespaceEgressChanges() {
+}
+
 func (eim *egressIPManager) SetNamespaceEgressNormal(vnid uint32) {
 }
 
-func (eim *egressIPManager) SetNamespaceEgressDropped(vnid uint32) {
+func (eim *egressIPManager) SetNamespaceEgressDropped(vnid uint32, destinations []string) {
 }
 
-func (eim *egressIPManager) SetNamespaceEgressViaEgressIPs(vnid uint32, activeEgressIPs []common.EgressIPAssignment) {
+func (eim *egressIPManager) SetNamespaceEgressViaEgressIPs(vnid uint32, destinations []string, activeEgressIPs []common.EgressIPAssignment) {
 }
@@ -0,0 +1,134 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// hostSubnetHostIPIndex is the name of the HostSubnet informer index by HostIP
+const hostSubnetHostIPIndex = "hostIP"
+
+func hostSubnetHostIPIndexFunc(obj interface{}) ([]string, error) {
+	hs, ok := obj.(*osdnv1.HostSubnet)
+	if !ok || hs.HostIP == "" {
+		return nil, nil
+	}
+	return []string{hs.HostIP}, nil
+}
+
+// addHostSubnetHostIPIndex adds hostSubnetHostIPIndex to the HostSubnet informer;
+// it must be called before the informer is started
+func (master *OsdnMaster) addHostSubnetHostIPIndex() error {
+	return master.hostSubnetInformer.Informer().AddIndexers(cache.Indexers{hostSubnetHostIPIndex: hostSubnetHostIPIndexFunc})
+}
+
+// duplicateHostIPAnnotations returns, for each HostSubnet in subnets with the given
+// HostIP, the expected value of its DuplicateHostIPAnnotation: "" for the oldest
+// one (which keeps the IP), and the name of the oldest one for the others.
+func duplicateHostIPAnnotations(subnets []*osdnv1.HostSubnet, hostIP string) map[string]string {
+	var matching []*osdnv1.HostSubnet
+	for _, hs := range subnets {
+		if hs.HostIP == hostIP {
+			matching = append(matching, hs)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		ti, tj := matching[i].CreationTimestamp, matching[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return matching[i].Name < matching[j].Name
+	})
+
+	annotations := make(map[string]string, len(matching))
+	for i, hs := range matching {
+		if i == 0 {
+			annotations[hs.Name] = ""
+		} else {
+			annotations[hs.Name] = matching[0].Name
+		}
+	}
+	return annotations
+}
+
+// checkDuplicateHostIPs ensures that if more than one HostSubnet has the given
+// HostIP, all but the oldest are marked with DuplicateHostIPAnnotation (so that
+// nodes ignore them), and that no other HostSubnet with that IP is marked.
+func (master *OsdnMaster) checkDuplicateHostIPs(hostIP string) {
+	if hostIP == "" {
+		return
+	}
+	objs, err := master.hostSubnetInformer.Informer().GetIndexer().ByIndex(hostSubnetHostIPIndex, hostIP)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not look up HostSubnets by HostIP: %v", err))
+		return
+	}
+	subnets := make([]*osdnv1.HostSubnet, 0, len(objs))
+	for _, obj := range objs {
+		subnets = append(subnets, obj.(*osdnv1.HostSubnet))
+	}
+
+	annotations := duplicateHostIPAnnotations(subnets, hostIP)
+	for _, hs := range subnets {
+		owner, ok := annotations[hs.Name]
+		if !ok || hs.Annotations[common.DuplicateHostIPAnnotation] == owner {
+			continue
+		}
+		if err := master.setDuplicateHostIPAnnotation(hs.Name, hostIP, owner); err != nil {
+			utilruntime.HandleError(fmt.Errorf("could not update duplicate HostIP annotation on HostSubnet %q: %v", hs.Name, err))
+			continue
+		}
+
+		ref := &corev1.ObjectReference{Kind: "Node", Name: hs.Host}
+		if owner != "" {
+			klog.Warningf("HostSubnet %q has the same HostIP %s as HostSubnet %q; ignoring it", hs.Name, hostIP, owner)
+			master.recorder.Eventf(ref, corev1.EventTypeWarning, "DuplicateHostIP",
+				"HostSubnet %q has the same HostIP %s as HostSubnet %q; it will be ignored until the conflict is resolved", hs.Name, hostIP, owner)
+		} else {
+			klog.Infof("HostSubnet %q no longer has a duplicate HostIP", hs.Name)
+			master.recorder.Eventf(ref, corev1.EventTypeNormal, "DuplicateHostIPResolved",
+				"HostSubnet %q no longer has a duplicate HostIP", hs.Name)
+		}
+	}
+}
+
+// setDuplicateHostIPAnnotation sets DuplicateHostIPAnnotation on the named
+// HostSubnet to owner, or removes it if owner is "". If the HostSubnet no longer
+// has hostIP (ie, the informer's cache was out of date), it is left alone; the
+// event for its change will cause it to be checked again.
+func (master *OsdnMaster) setDuplicateHostIPAnnotation(name, hostIP, owner string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		hs, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), name, metav1.GetOptions{})
+		if kerrors.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hs.HostIP != hostIP || hs.Annotations[common.DuplicateHostIPAnnotation] == owner {
+			return nil
+		}
+		if owner == "" {
+			delete(hs.Annotations, common.DuplicateHostIPAnnotation)
+		} else {
+			if hs.Annotations == nil {
+				hs.Annotations = make(map[string]string)
+			}
+			hs.Annotations[common.DuplicateHostIPAnnotation] = owner
+		}
+		_, err = master.osdnClient.NetworkV1().HostSubnets().Update(context.TODO(), hs, metav1.UpdateOptions{})
+		return err
+	})
+}
@@ -0,0 +1,58 @@
+package master
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+func TestDuplicateHostIPAnnotations(t *testing.T) {
+	now := time.Now()
+	hostSubnet := func(name, hostIP string, age time.Duration) *osdnv1.HostSubnet {
+		return &osdnv1.HostSubnet{
+			ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: metav1.NewTime(now.Add(-age))},
+			Host:       name,
+			HostIP:     hostIP,
+		}
+	}
+	subnets := []*osdnv1.HostSubnet{
+		hostSubnet("node-clone", "192.168.1.10", time.Minute),
+		hostSubnet("node1", "192.168.1.10", time.Hour),
+		hostSubnet("node2", "192.168.1.11", time.Hour),
+		hostSubnet("node-clone-b", "192.168.1.10", time.Minute),
+	}
+
+	annotations := duplicateHostIPAnnotations(subnets, "192.168.1.10")
+	expected := map[string]string{
+		"node1":        "",
+		"node-clone":   "node1",
+		"node-clone-b": "node1",
+	}
+	if !reflect.DeepEqual(annotations, expected) {
+		t.Fatalf("expected %v, got %v", expected, annotations)
+	}
+
+	annotations = duplicateHostIPAnnotations(subnets, "192.168.1.11")
+	expected = map[string]string{"node2": ""}
+	if !reflect.DeepEqual(annotations, expected) {
+		t.Fatalf("expected %v, got %v", expected, annotations)
+	}
+
+	// Once the original is deleted, the oldest remaining HostSubnet keeps the IP,
+	// with ties broken by name
+	annotations = duplicateHostIPAnnotations(subnets[2:], "192.168.1.10")
+	expected = map[string]string{"node-clone-b": ""}
+	if !reflect.DeepEqual(annotations, expected) {
+		t.Fatalf("expected %v, got %v", expected, annotations)
+	}
+	subnets[3].CreationTimestamp = subnets[0].CreationTimestamp
+	annotations = duplicateHostIPAnnotations([]*osdnv1.HostSubnet{subnets[0], subnets[3]}, "192.168.1.10")
+	expected = map[string]string{"node-clone": "", "node-clone-b": "node-clone"}
+	if !reflect.DeepEqual(annotations, expected) {
+		t.Fatalf("expected %v, got %v", expected, annotations)
+	}
+}
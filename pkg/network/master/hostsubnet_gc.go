@@ -0,0 +1,134 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+const (
+	// OrphanedHostSubnetGracePeriodAnnotation can be set on the ClusterNetwork to a
+	// duration (eg, "30m") to control how long a HostSubnet whose Node has been
+	// deleted is kept before being garbage-collected
+	OrphanedHostSubnetGracePeriodAnnotation = "network.openshift.io/orphaned-host-subnet-grace-period"
+
+	defaultOrphanedHostSubnetGracePeriod = 10 * time.Minute
+	orphanedHostSubnetGCInterval         = time.Minute
+)
+
+// startHostSubnetGC starts periodically deleting HostSubnets whose Node no longer
+// exists. Normally the HostSubnet is deleted when the Node is, but if the master
+// misses the Node deletion event, the HostSubnet would otherwise be leaked.
+func (master *OsdnMaster) startHostSubnetGC() {
+	go utilwait.Forever(master.gcOrphanedHostSubnets, orphanedHostSubnetGCInterval)
+}
+
+func (master *OsdnMaster) gcOrphanedHostSubnets() {
+	subnets, err := master.hostSubnetInformer.Lister().List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not list HostSubnets: %v", err))
+		return
+	}
+
+	for _, hs := range master.expiredOrphanedHostSubnets(subnets, master.orphanedHostSubnetGracePeriod(), time.Now()) {
+		// Make sure the Node is really gone, not just missing from the informer cache
+		if _, err := master.kClient.CoreV1().Nodes().Get(context.TODO(), hs.Name, metav1.GetOptions{}); err == nil {
+			continue
+		} else if !kerrs.IsNotFound(err) {
+			utilruntime.HandleError(fmt.Errorf("error fetching node for HostSubnet %q: %v", hs.Name, err))
+			continue
+		}
+
+		err := master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), hs.Name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &hs.UID}})
+		if err != nil && !kerrs.IsNotFound(err) {
+			utilruntime.HandleError(fmt.Errorf("error deleting orphaned HostSubnet %q: %v", hs.Name, err))
+			continue
+		}
+		// The subnet is returned to the allocator by handleDeleteSubnet
+		klog.Infof("Deleted orphaned HostSubnet %s", hs.Name)
+		master.recorder.Eventf(hostSubnetRef(hs), corev1.EventTypeNormal, "OrphanedHostSubnetDeleted",
+			"Deleted HostSubnet %s (subnet %s) for deleted node", hs.Name, hs.Subnet)
+		delete(master.orphanedHostSubnets, hs.UID)
+	}
+}
+
+// expiredOrphanedHostSubnets updates master.orphanedHostSubnets from subnets, and
+// returns the HostSubnets that have been orphaned for longer than gracePeriod
+func (master *OsdnMaster) expiredOrphanedHostSubnets(subnets []*osdnv1.HostSubnet, gracePeriod time.Duration, now time.Time) []*osdnv1.HostSubnet {
+	var expired []*osdnv1.HostSubnet
+	orphaned := make(map[ktypes.UID]bool)
+	for _, hs := range subnets {
+		if !master.isOrphanedHostSubnet(hs) {
+			continue
+		}
+		orphaned[hs.UID] = true
+
+		since, ok := master.orphanedHostSubnets[hs.UID]
+		if !ok {
+			since = now
+			master.orphanedHostSubnets[hs.UID] = since
+			klog.Warningf("HostSubnet %s (subnet %s) belongs to a deleted node; it will be deleted after %v", hs.Name, hs.Subnet, gracePeriod)
+			master.recorder.Eventf(hostSubnetRef(hs), corev1.EventTypeWarning, "HostSubnetOrphaned",
+				"HostSubnet %s (subnet %s) belongs to a deleted node; it will be deleted after %v", hs.Name, hs.Subnet, gracePeriod)
+		}
+		if now.Sub(since) >= gracePeriod {
+			expired = append(expired, hs)
+		}
+	}
+
+	// Forget about HostSubnets that were deleted or whose Node came back
+	for uid := range master.orphanedHostSubnets {
+		if !orphaned[uid] {
+			delete(master.orphanedHostSubnets, uid)
+		}
+	}
+	return expired
+}
+
+// isOrphanedHostSubnet returns whether hs was created for a Node that no longer exists
+func (master *OsdnMaster) isOrphanedHostSubnet(hs *osdnv1.HostSubnet) bool {
+	if len(hs.Annotations[osdnv1.NodeUIDAnnotation]) == 0 {
+		// F5 HostSubnet, or not yet reconciled
+		return false
+	}
+	_, err := master.nodeInformer.Lister().Get(hs.Name)
+	return kerrs.IsNotFound(err)
+}
+
+func (master *OsdnMaster) orphanedHostSubnetGracePeriod() time.Duration {
+	cn, err := master.clusterNetworkInformer.Lister().Get(osdnv1.ClusterNetworkDefault)
+	if err != nil {
+		return defaultOrphanedHostSubnetGracePeriod
+	}
+	value, ok := cn.Annotations[OrphanedHostSubnetGracePeriodAnnotation]
+	if !ok {
+		return defaultOrphanedHostSubnetGracePeriod
+	}
+	gracePeriod, err := time.ParseDuration(value)
+	if err != nil || gracePeriod < 0 {
+		utilruntime.HandleError(fmt.Errorf("Ignoring invalid %s annotation %q", OrphanedHostSubnetGracePeriodAnnotation, value))
+		return defaultOrphanedHostSubnetGracePeriod
+	}
+	return gracePeriod
+}
+
+func hostSubnetRef(hs *osdnv1.HostSubnet) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		Kind:       "HostSubnet",
+		APIVersion: "network.openshift.io/v1",
+		Name:       hs.Name,
+		UID:        hs.UID,
+	}
+}
@@ -0,0 +1,105 @@
+package master
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+func TestOrphanedHostSubnets(t *testing.T) {
+	kubeInformers := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	nodeIndexer := kubeInformers.Core().V1().Nodes().Informer().GetIndexer()
+	recorder := record.NewFakeRecorder(10)
+	master := &OsdnMaster{
+		recorder:            recorder,
+		nodeInformer:        kubeInformers.Core().V1().Nodes(),
+		orphanedHostSubnets: map[ktypes.UID]time.Time{},
+	}
+
+	node1 := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", UID: "node1-uid"}}
+	node2 := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2", UID: "node2-uid"}}
+	if err := nodeIndexer.Add(node1); err != nil {
+		t.Fatal(err)
+	}
+
+	hostSubnet := func(name, uid, nodeUID, subnet string) *osdnv1.HostSubnet {
+		hs := &osdnv1.HostSubnet{
+			ObjectMeta: metav1.ObjectMeta{Name: name, UID: ktypes.UID(uid), Annotations: map[string]string{}},
+			Host:       name,
+			Subnet:     subnet,
+		}
+		if nodeUID != "" {
+			hs.Annotations[osdnv1.NodeUIDAnnotation] = nodeUID
+		}
+		return hs
+	}
+	subnets := []*osdnv1.HostSubnet{
+		hostSubnet("node1", "hs1-uid", "node1-uid", "10.128.0.0/23"),
+		hostSubnet("node2", "hs2-uid", "node2-uid", "10.128.2.0/23"),
+		// F5 HostSubnet; has no Node
+		hostSubnet("f5", "hs3-uid", "", "10.128.4.0/23"),
+	}
+
+	expectEvents := func(n int) {
+		t.Helper()
+		if len(recorder.Events) != n {
+			t.Fatalf("expected %d events, got %d", n, len(recorder.Events))
+		}
+		for i := 0; i < n; i++ {
+			<-recorder.Events
+		}
+	}
+
+	start := time.Now()
+	gracePeriod := 10 * time.Minute
+	expired := master.expiredOrphanedHostSubnets(subnets, gracePeriod, start)
+	if len(expired) != 0 {
+		t.Fatalf("unexpected expired HostSubnets %v", expired)
+	}
+	if _, ok := master.orphanedHostSubnets["hs2-uid"]; !ok || len(master.orphanedHostSubnets) != 1 {
+		t.Fatalf("unexpected orphaned HostSubnets %v", master.orphanedHostSubnets)
+	}
+	expectEvents(1)
+
+	expired = master.expiredOrphanedHostSubnets(subnets, gracePeriod, start.Add(5*time.Minute))
+	if len(expired) != 0 {
+		t.Fatalf("unexpected expired HostSubnets %v", expired)
+	}
+	expectEvents(0)
+
+	expired = master.expiredOrphanedHostSubnets(subnets, gracePeriod, start.Add(gracePeriod))
+	if len(expired) != 1 || expired[0].Name != "node2" {
+		t.Fatalf("unexpected expired HostSubnets %v", expired)
+	}
+	expectEvents(0)
+
+	// If the Node comes back, the HostSubnet is no longer orphaned
+	if err := nodeIndexer.Add(node2); err != nil {
+		t.Fatal(err)
+	}
+	expired = master.expiredOrphanedHostSubnets(subnets, gracePeriod, start.Add(gracePeriod))
+	if len(expired) != 0 {
+		t.Fatalf("unexpected expired HostSubnets %v", expired)
+	}
+	if len(master.orphanedHostSubnets) != 0 {
+		t.Fatalf("unexpected orphaned HostSubnets %v", master.orphanedHostSubnets)
+	}
+
+	// And if it goes away again, the grace period starts over
+	if err := nodeIndexer.Delete(node2); err != nil {
+		t.Fatal(err)
+	}
+	expired = master.expiredOrphanedHostSubnets(subnets, gracePeriod, start.Add(2*gracePeriod))
+	if len(expired) != 0 {
+		t.Fatalf("unexpected expired HostSubnets %v", expired)
+	}
+	expectEvents(1)
+}
@@ -3,16 +3,21 @@ package master
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ktypes "k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	kcoreinformers "k8s.io/client-go/informers/core/v1"
+	knetworkinginformers "k8s.io/client-go/informers/networking/v1"
 	kclientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 
 	osdnv1 "github.com/openshift/api/network/v1"
@@ -21,6 +26,7 @@ import (
 	osdninformersv1 "github.com/openshift/client-go/network/informers/externalversions/network/v1"
 	"github.com/openshift/library-go/pkg/network/networkutils"
 	"github.com/openshift/sdn/pkg/network/common"
+	"github.com/openshift/sdn/pkg/network/master/metrics"
 	masterutil "github.com/openshift/sdn/pkg/network/master/util"
 )
 
@@ -29,49 +35,78 @@ const (
 )
 
 type OsdnMaster struct {
-	kClient     kclientset.Interface
-	osdnClient  osdnclient.Interface
+	kClient    kclientset.Interface
+	osdnClient osdnclient.Interface
+	// The last ClusterNetwork that passed validation. Once the ClusterNetwork master
+	// is started it is updated by syncClusterNetwork (under clusterNetworkLock), so
+	// it must be read with getNetworkInfo() after that.
 	networkInfo *common.ParsedClusterNetwork
 	vnids       *masterVNIDMap
-
-	nodeInformer         kcoreinformers.NodeInformer
-	namespaceInformer    kcoreinformers.NamespaceInformer
-	hostSubnetInformer   osdninformersv1.HostSubnetInformer
-	netNamespaceInformer osdninformersv1.NetNamespaceInformer
+	recorder    record.EventRecorder
+
+	nodeInformer           kcoreinformers.NodeInformer
+	namespaceInformer      kcoreinformers.NamespaceInformer
+	hostSubnetInformer     osdninformersv1.HostSubnetInformer
+	netNamespaceInformer   osdninformersv1.NetNamespaceInformer
+	egressPolicyInformer   osdninformersv1.EgressNetworkPolicyInformer
+	clusterNetworkInformer osdninformersv1.ClusterNetworkInformer
+	// networkPolicyInformer is only set when using the NetworkPolicy plugin
+	networkPolicyInformer knetworkinginformers.NetworkPolicyInformer
+	// npMigrator is only set when using the multitenant plugin
+	npMigrator *networkPolicyMigrator
+	// egressIPManager is created before the ClusterNetwork master is started, so
+	// that syncClusterNetwork can update its failback delay
+	egressIPManager *egressIPManager
 
 	// Used for allocating subnets in order
 	subnetAllocator *masterutil.SubnetAllocator
+	// Used for allocating IPv6 subnets in dual-stack clusters; nil otherwise
+	subnetAllocatorV6 *masterutil.SubnetAllocator
+	// Serializes syncClusterNetwork
+	clusterNetworkLock sync.Mutex
+	// clusterNetworks that are running out of subnets; protected by clusterNetworkLock
+	lowCapacityNetworks sets.String
 
 	// Holds Node IP used in creating host subnet for a node
 	hostSubnetNodeIPs map[ktypes.UID]string
+	// When each HostSubnet whose Node was deleted was first noticed; only accessed
+	// from the HostSubnet GC goroutine
+	orphanedHostSubnets map[ktypes.UID]time.Time
 }
 
 func Start(kClient kclientset.Interface,
 	kubeInformers informers.SharedInformerFactory,
 	osdnClient osdnclient.Interface,
-	osdnInformers osdninformers.SharedInformerFactory) error {
+	osdnInformers osdninformers.SharedInformerFactory,
+	recorder record.EventRecorder) (*OsdnMaster, error) {
 	klog.Infof("Initializing SDN master")
+	metrics.RegisterMetrics()
 
 	networkInfo, err := common.GetParsedClusterNetwork(osdnClient)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	master := &OsdnMaster{
 		kClient:     kClient,
 		osdnClient:  osdnClient,
 		networkInfo: networkInfo,
-
-		nodeInformer:         kubeInformers.Core().V1().Nodes(),
-		namespaceInformer:    kubeInformers.Core().V1().Namespaces(),
-		hostSubnetInformer:   osdnInformers.Network().V1().HostSubnets(),
-		netNamespaceInformer: osdnInformers.Network().V1().NetNamespaces(),
-
-		hostSubnetNodeIPs: map[ktypes.UID]string{},
+		recorder:    recorder,
+
+		nodeInformer:           kubeInformers.Core().V1().Nodes(),
+		namespaceInformer:      kubeInformers.Core().V1().Namespaces(),
+		hostSubnetInformer:     osdnInformers.Network().V1().HostSubnets(),
+		netNamespaceInformer:   osdnInformers.Network().V1().NetNamespaces(),
+		egressPolicyInformer:   osdnInformers.Network().V1().EgressNetworkPolicies(),
+		clusterNetworkInformer: osdnInformers.Network().V1().ClusterNetworks(),
+
+		hostSubnetNodeIPs:   map[ktypes.UID]string{},
+		lowCapacityNetworks: sets.NewString(),
+		orphanedHostSubnets: map[ktypes.UID]time.Time{},
 	}
 
 	if err = master.checkClusterNetworkAgainstLocalNetworks(); err != nil {
-		return err
+		return nil, err
 	}
 	if err = master.checkClusterNetworkAgainstClusterObjects(); err != nil {
 		utilruntime.HandleError(fmt.Errorf("Cluster contains objects incompatible with ClusterNetwork: %v", err))
@@ -82,11 +117,20 @@ func Start(kClient kclientset.Interface,
 	master.nodeInformer.Informer().GetController()
 	master.namespaceInformer.Informer().GetController()
 	master.hostSubnetInformer.Informer().GetController()
+	if err := master.addHostSubnetHostIPIndex(); err != nil {
+		return nil, err
+	}
 	master.netNamespaceInformer.Informer().GetController()
+	master.egressPolicyInformer.Informer().GetController()
+	master.clusterNetworkInformer.Informer().GetController()
+	if networkInfo.PluginName == networkutils.NetworkPolicyPluginName {
+		master.networkPolicyInformer = kubeInformers.Networking().V1().NetworkPolicies()
+		master.networkPolicyInformer.Informer().GetController()
+	}
 
 	go master.startSubSystems(master.networkInfo.PluginName)
 
-	return nil
+	return master, nil
 }
 
 func (master *OsdnMaster) startSubSystems(pluginName string) {
@@ -95,19 +139,29 @@ func (master *OsdnMaster) startSubSystems(pluginName string) {
 		master.nodeInformer.Informer().GetController().HasSynced,
 		master.namespaceInformer.Informer().GetController().HasSynced,
 		master.hostSubnetInformer.Informer().GetController().HasSynced,
-		master.netNamespaceInformer.Informer().GetController().HasSynced) {
+		master.netNamespaceInformer.Informer().GetController().HasSynced,
+		master.egressPolicyInformer.Informer().GetController().HasSynced,
+		master.clusterNetworkInformer.Informer().GetController().HasSynced) {
 		klog.Fatalf("failed to sync SDN master informers")
 	}
 
 	if err := master.startSubnetMaster(); err != nil {
 		klog.Fatalf("failed to start subnet master: %v", err)
 	}
+	if pluginName == networkutils.MultiTenantPluginName {
+		master.npMigrator = newNetworkPolicyMigrator(master.kClient, master.namespaceInformer, master.netNamespaceInformer)
+		master.npMigrator.Start(master.clusterNetworkInformer, master.nodeInformer, master.hostSubnetInformer)
+	}
+	master.egressIPManager = newEgressIPManager()
+	master.startClusterNetworkMaster()
+	master.startSDNStatusMaster()
 
+	networkInfo := master.getNetworkInfo()
 	switch pluginName {
 	case networkutils.MultiTenantPluginName:
-		master.vnids = newMasterVNIDMap(true)
+		master.vnids = newMasterVNIDMap(true, networkInfo.MinVNID, networkInfo.MaxVNID, networkInfo.VNIDBlocks)
 	case networkutils.NetworkPolicyPluginName:
-		master.vnids = newMasterVNIDMap(false)
+		master.vnids = newMasterVNIDMap(false, networkInfo.MinVNID, networkInfo.MaxVNID, networkInfo.VNIDBlocks)
 	}
 	if master.vnids != nil {
 		if err := master.startVNIDMaster(); err != nil {
@@ -115,8 +169,18 @@ func (master *OsdnMaster) startSubSystems(pluginName string) {
 		}
 	}
 
-	eim := newEgressIPManager()
-	eim.Start(master.osdnClient, master.hostSubnetInformer, master.netNamespaceInformer, master.nodeInformer)
+	if master.networkPolicyInformer != nil {
+		npsc := newNetworkPolicyStatusController(master.kClient, master.networkPolicyInformer)
+		npsc.Start()
+	}
+
+	master.egressIPManager.Start(master.osdnClient, master.hostSubnetInformer, master.netNamespaceInformer, master.nodeInformer)
+
+	if edm, err := newEgressDNSMaster(); err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not start egress DNS resolver: %v", err))
+	} else {
+		edm.Start(master.osdnClient, master.egressPolicyInformer)
+	}
 }
 
 func (master *OsdnMaster) checkClusterNetworkAgainstLocalNetworks() error {
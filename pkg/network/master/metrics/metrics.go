@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	SDNNamespace = "openshift"
+	SDNSubsystem = "sdn_controller"
+
+	VNIDsAllocatedKey   = "vnids_allocated"
+	VNIDsFreeKey        = "vnids_free"
+	VNIDsQuarantinedKey = "vnids_quarantined"
+	VNIDsReclaimedKey   = "vnids_reclaimed"
+
+	HostSubnetsAllocatedKey = "host_subnets_allocated"
+	HostSubnetsAvailableKey = "host_subnets_available"
+
+	SDNDegradedNodesKey = "degraded_nodes"
+
+	EgressDNSResolutionLatencyKey = "egress_dns_resolution_latency_seconds"
+	EgressDNSResolutionErrorsKey  = "egress_dns_resolution_errors_total"
+)
+
+var (
+	VNIDsAllocated = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      VNIDsAllocatedKey,
+			Help:      "Number of VNIDs currently allocated to NetNamespaces",
+		},
+	)
+	VNIDsFree = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      VNIDsFreeKey,
+			Help:      "Number of VNIDs available for allocation",
+		},
+	)
+	VNIDsQuarantined = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      VNIDsQuarantinedKey,
+			Help:      "Number of released VNIDs waiting to be reclaimed",
+		},
+	)
+	VNIDsReclaimed = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      VNIDsReclaimedKey,
+			Help:      "Cumulative number of released VNIDs returned to the allocator",
+		},
+	)
+
+	HostSubnetsAllocated = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      HostSubnetsAllocatedKey,
+			Help:      "Number of host subnets allocated from each clusterNetwork entry",
+		},
+		[]string{"cluster_network"},
+	)
+	HostSubnetsAvailable = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      HostSubnetsAvailableKey,
+			Help:      "Number of host subnets still available in each clusterNetwork entry",
+		},
+		[]string{"cluster_network"},
+	)
+
+	SDNDegradedNodes = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      SDNDegradedNodesKey,
+			Help:      "Number of nodes whose SDN is not ready or has not reported its status",
+		},
+	)
+
+	EgressDNSResolutionLatency = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      EgressDNSResolutionLatencyKey,
+			Help:      "Time in seconds taken to resolve each EgressNetworkPolicy dnsName",
+			Buckets:   metrics.ExponentialBuckets(0.001, 2, 15),
+		},
+	)
+	EgressDNSResolutionErrors = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      EgressDNSResolutionErrorsKey,
+			Help:      "Cumulative number of failed EgressNetworkPolicy dnsName resolutions",
+		},
+	)
+)
+
+var registerMetrics sync.Once
+
+// Register all master metrics.
+func RegisterMetrics() {
+	registerMetrics.Do(func() {
+		legacyregistry.MustRegister(VNIDsAllocated)
+		legacyregistry.MustRegister(VNIDsFree)
+		legacyregistry.MustRegister(VNIDsQuarantined)
+		legacyregistry.MustRegister(VNIDsReclaimed)
+		legacyregistry.MustRegister(HostSubnetsAllocated)
+		legacyregistry.MustRegister(HostSubnetsAvailable)
+		legacyregistry.MustRegister(SDNDegradedNodes)
+		legacyregistry.MustRegister(EgressDNSResolutionLatency)
+		legacyregistry.MustRegister(EgressDNSResolutionErrors)
+	})
+}
+
+// ObserveEgressDNSResolution records an EgressNetworkPolicy dnsName resolution; it
+// is a common.EgressDNSObserver
+func ObserveEgressDNSResolution(latency time.Duration, err error) {
+	EgressDNSResolutionLatency.Observe(latency.Seconds())
+	if err != nil {
+		EgressDNSResolutionErrors.Inc()
+	}
+}
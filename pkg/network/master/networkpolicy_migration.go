@@ -0,0 +1,410 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	kapierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	kcoreinformers "k8s.io/client-go/informers/core/v1"
+	kclientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	osdninformersv1 "github.com/openshift/client-go/network/informers/externalversions/network/v1"
+	"github.com/openshift/library-go/pkg/network/networkutils"
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+const (
+	// NetworkPolicyMigrationAnnotation, when set to "true" on the default
+	// ClusterNetwork of a cluster using the multitenant plugin, causes the master to
+	// generate NetworkPolicies that reproduce the isolation provided by the
+	// multitenant plugin, and then (once they are all in place) to switch the nodes
+	// to the NetworkPolicy plugin one at a time (see common.NodePluginAnnotation),
+	// waiting for each to report that it is running the NetworkPolicy plugin before
+	// moving on to the next. This works without any change in connectivity because
+	// the two plugins assign VNIDs the same way. Once every node has been switched,
+	// the ClusterNetwork's pluginName can be changed to the NetworkPolicy plugin to
+	// complete the migration.
+	//
+	// The policies continue to be reconciled (including for new namespaces) until
+	// the annotation is removed. Removing it does not switch nodes back; to roll
+	// back, remove common.NodePluginAnnotation from the nodes first.
+	NetworkPolicyMigrationAnnotation = "network.openshift.io/network-policy-migration"
+
+	// MultitenantVNIDLabel is set on each Namespace to its VNID, so that the
+	// generated policies can select namespaces that shared a pod network.
+	MultitenantVNIDLabel = "network.openshift.io/vnid"
+
+	// multitenantPolicyName is the name of the generated NetworkPolicy in each
+	// namespace
+	multitenantPolicyName = "openshift-sdn-multitenant-isolation"
+	// multitenantPolicyLabel marks the generated NetworkPolicies
+	multitenantPolicyLabel = "network.openshift.io/generated-by-migration"
+
+	// networkPolicyMigrationNodeInterval is how often the migration checks whether
+	// it can switch another node to the NetworkPolicy plugin
+	networkPolicyMigrationNodeInterval = 30 * time.Second
+)
+
+// networkPolicyMigrator converts multitenant isolation (separate VNIDs, joined
+// VNIDs, and global namespaces) into equivalent NetworkPolicies, and then switches
+// the nodes to the NetworkPolicy plugin
+type networkPolicyMigrator struct {
+	kClient              kclientset.Interface
+	namespaceInformer    kcoreinformers.NamespaceInformer
+	netNamespaceInformer osdninformersv1.NetNamespaceInformer
+	nodeInformer         kcoreinformers.NodeInformer
+	hostSubnetInformer   osdninformersv1.HostSubnetInformer
+
+	lock sync.Mutex
+	// enabled is whether NetworkPolicyMigrationAnnotation is set
+	enabled bool
+	// reconciled is the set of namespaces whose generated NetworkPolicy is known to
+	// be up to date
+	reconciled sets.String
+}
+
+func newNetworkPolicyMigrator(kClient kclientset.Interface, namespaceInformer kcoreinformers.NamespaceInformer, netNamespaceInformer osdninformersv1.NetNamespaceInformer) *networkPolicyMigrator {
+	return &networkPolicyMigrator{
+		kClient:              kClient,
+		namespaceInformer:    namespaceInformer,
+		netNamespaceInformer: netNamespaceInformer,
+		reconciled:           sets.NewString(),
+	}
+}
+
+func (npm *networkPolicyMigrator) Start(clusterNetworkInformer osdninformersv1.ClusterNetworkInformer, nodeInformer kcoreinformers.NodeInformer, hostSubnetInformer osdninformersv1.HostSubnetInformer) {
+	npm.nodeInformer = nodeInformer
+	npm.hostSubnetInformer = hostSubnetInformer
+
+	funcs := common.InformerFuncs(&osdnv1.ClusterNetwork{}, npm.handleAddOrUpdateClusterNetwork, nil)
+	clusterNetworkInformer.Informer().AddEventHandler(funcs)
+	funcs = common.InformerFuncs(&osdnv1.NetNamespace{}, npm.handleAddOrUpdateNetNamespace, npm.handleDeleteNetNamespace)
+	npm.netNamespaceInformer.Informer().AddEventHandler(funcs)
+	funcs = common.InformerFuncs(&corev1.Namespace{}, npm.handleAddOrUpdateNamespace, npm.handleDeleteNamespace)
+	npm.namespaceInformer.Informer().AddEventHandler(funcs)
+
+	go utilwait.Forever(npm.migrateNextNode, networkPolicyMigrationNodeInterval)
+}
+
+func (npm *networkPolicyMigrator) isEnabled() bool {
+	npm.lock.Lock()
+	defer npm.lock.Unlock()
+	return npm.enabled
+}
+
+func (npm *networkPolicyMigrator) handleAddOrUpdateClusterNetwork(obj, _ interface{}, eventType watch.EventType) {
+	cn := obj.(*osdnv1.ClusterNetwork)
+	if cn.Name != osdnv1.ClusterNetworkDefault {
+		return
+	}
+	enabled := cn.Annotations[NetworkPolicyMigrationAnnotation] == "true"
+
+	npm.lock.Lock()
+	if enabled == npm.enabled {
+		npm.lock.Unlock()
+		return
+	}
+	npm.enabled = enabled
+	npm.reconciled = sets.NewString()
+	npm.lock.Unlock()
+
+	if !enabled {
+		klog.Infof("Stopped migration from multitenant isolation to NetworkPolicy")
+		return
+	}
+
+	klog.Infof("Generating NetworkPolicies for migration from multitenant isolation")
+	netnamespaces, err := npm.netNamespaceInformer.Lister().List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not list NetNamespaces: %v", err))
+		return
+	}
+	for _, netns := range netnamespaces {
+		npm.reconcileNamespace(netns)
+	}
+}
+
+func (npm *networkPolicyMigrator) handleAddOrUpdateNetNamespace(obj, _ interface{}, eventType watch.EventType) {
+	netns := obj.(*osdnv1.NetNamespace)
+	klog.V(5).Infof("Watch %s event for NetNamespace %q", eventType, netns.Name)
+
+	npm.reconcileNamespace(netns)
+}
+
+func (npm *networkPolicyMigrator) handleDeleteNetNamespace(obj interface{}) {
+	netns := obj.(*osdnv1.NetNamespace)
+	klog.V(5).Infof("Watch %s event for NetNamespace %q", watch.Deleted, netns.Name)
+
+	npm.forgetNamespace(netns.NetName)
+}
+
+func (npm *networkPolicyMigrator) handleAddOrUpdateNamespace(obj, _ interface{}, eventType watch.EventType) {
+	ns := obj.(*corev1.Namespace)
+	klog.V(5).Infof("Watch %s event for Namespace %q", eventType, ns.Name)
+
+	// The Namespace is normally created before its NetNamespace, in which case
+	// we'll reconcile when the NetNamespace shows up.
+	netns, err := npm.netNamespaceInformer.Lister().Get(ns.Name)
+	if err != nil {
+		return
+	}
+	npm.reconcileNamespace(netns)
+}
+
+func (npm *networkPolicyMigrator) handleDeleteNamespace(obj interface{}) {
+	ns := obj.(*corev1.Namespace)
+	klog.V(5).Infof("Watch %s event for Namespace %q", watch.Deleted, ns.Name)
+
+	// The generated policy is deleted along with the namespace
+	npm.forgetNamespace(ns.Name)
+}
+
+// reconcileNamespace calls reconcile if the migration is enabled, and records
+// whether netns's policy is now up to date
+func (npm *networkPolicyMigrator) reconcileNamespace(netns *osdnv1.NetNamespace) {
+	if !npm.isEnabled() {
+		return
+	}
+	err := npm.reconcile(netns)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not reconcile multitenant NetworkPolicy for namespace %q: %v", netns.NetName, err))
+	}
+
+	npm.lock.Lock()
+	defer npm.lock.Unlock()
+	if err == nil && npm.enabled {
+		npm.reconciled.Insert(netns.NetName)
+	} else {
+		npm.reconciled.Delete(netns.NetName)
+	}
+}
+
+func (npm *networkPolicyMigrator) forgetNamespace(namespace string) {
+	npm.lock.Lock()
+	defer npm.lock.Unlock()
+	npm.reconciled.Delete(namespace)
+}
+
+// allReconciled returns whether the migration is enabled and every namespace's
+// generated policy is up to date
+func (npm *networkPolicyMigrator) allReconciled() bool {
+	netnamespaces, err := npm.netNamespaceInformer.Lister().List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not list NetNamespaces: %v", err))
+		return false
+	}
+
+	npm.lock.Lock()
+	defer npm.lock.Unlock()
+	if !npm.enabled {
+		return false
+	}
+	for _, netns := range netnamespaces {
+		if !npm.reconciled.Has(netns.NetName) {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeSwitched returns whether node has been switched to the NetworkPolicy plugin,
+// and whether it has reported (via its HostSubnet) that it is running it
+func (npm *networkPolicyMigrator) nodeSwitched(node *corev1.Node) (bool, bool) {
+	if node.Annotations[common.NodePluginAnnotation] != networkutils.NetworkPolicyPluginName {
+		return false, false
+	}
+	hs, err := npm.hostSubnetInformer.Lister().Get(node.Name)
+	if err != nil {
+		return true, false
+	}
+	status := common.GetNodeSDNStatus(hs)
+	return true, status != nil && status.Ready && status.PluginName == networkutils.NetworkPolicyPluginName
+}
+
+// migrateNextNode switches the next node to the NetworkPolicy plugin, once all of
+// the policies are in place and every node that was already switched is running it
+func (npm *networkPolicyMigrator) migrateNextNode() {
+	if !npm.allReconciled() {
+		return
+	}
+	nodes, err := npm.nodeInformer.Lister().List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not list Nodes: %v", err))
+		return
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+
+	var next *corev1.Node
+	for _, node := range nodes {
+		switched, running := npm.nodeSwitched(node)
+		if !switched {
+			if next == nil {
+				next = node
+			}
+		} else if !running {
+			klog.V(2).Infof("Waiting for node %q to start the NetworkPolicy plugin", node.Name)
+			return
+		}
+	}
+	if next == nil {
+		klog.V(2).Infof("All nodes are running the NetworkPolicy plugin; the ClusterNetwork's pluginName can now be changed to %q", networkutils.NetworkPolicyPluginName)
+		return
+	}
+
+	klog.Infof("Switching node %q to the NetworkPolicy plugin", next.Name)
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				common.NodePluginAnnotation: networkutils.NetworkPolicyPluginName,
+			},
+		},
+	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	if _, err := npm.kClient.CoreV1().Nodes().Patch(context.TODO(), next.Name, ktypes.MergePatchType, patchBytes, metav1.PatchOptions{}); err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not switch node %q to the NetworkPolicy plugin: %v", next.Name, err))
+	}
+}
+
+// migrationComplete returns whether every node has been switched to, and is
+// running, the NetworkPolicy plugin
+func (npm *networkPolicyMigrator) migrationComplete() bool {
+	if !npm.allReconciled() {
+		return false
+	}
+	nodes, err := npm.nodeInformer.Lister().List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not list Nodes: %v", err))
+		return false
+	}
+	for _, node := range nodes {
+		if _, running := npm.nodeSwitched(node); !running {
+			return false
+		}
+	}
+	return true
+}
+
+// reconcile ensures that netns's Namespace has the right MultitenantVNIDLabel and
+// that its generated NetworkPolicy is up to date
+func (npm *networkPolicyMigrator) reconcile(netns *osdnv1.NetNamespace) error {
+	ns, err := npm.namespaceInformer.Lister().Get(netns.NetName)
+	if err != nil {
+		if kapierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if ns.DeletionTimestamp != nil {
+		return nil
+	}
+
+	vnidLabel := strconv.FormatUint(uint64(netns.NetID), 10)
+	if ns.Labels[MultitenantVNIDLabel] != vnidLabel {
+		patch := map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels": map[string]string{
+					MultitenantVNIDLabel: vnidLabel,
+				},
+			},
+		}
+		patchBytes, err := json.Marshal(patch)
+		if err != nil {
+			return err
+		}
+		if _, err := npm.kClient.CoreV1().Namespaces().Patch(context.TODO(), ns.Name, ktypes.MergePatchType, patchBytes, metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("could not label namespace: %v", err)
+		}
+	}
+
+	client := npm.kClient.NetworkingV1().NetworkPolicies(ns.Name)
+	existing, err := client.Get(context.TODO(), multitenantPolicyName, metav1.GetOptions{})
+	if err != nil && !kapierrors.IsNotFound(err) {
+		return err
+	} else if err != nil {
+		existing = nil
+	} else if existing.Labels[multitenantPolicyLabel] != "true" {
+		return fmt.Errorf("NetworkPolicy %s/%s already exists and was not created by the migration", ns.Name, multitenantPolicyName)
+	}
+
+	policy := multitenantIsolationPolicy(ns.Name, netns.NetID)
+	switch {
+	case policy == nil && existing == nil:
+		return nil
+	case policy == nil:
+		klog.Infof("Deleting multitenant NetworkPolicy for global namespace %q", ns.Name)
+		err = client.Delete(context.TODO(), multitenantPolicyName, metav1.DeleteOptions{})
+		if kapierrors.IsNotFound(err) {
+			err = nil
+		}
+	case existing == nil:
+		klog.Infof("Creating multitenant NetworkPolicy for namespace %q (netid %d)", ns.Name, netns.NetID)
+		_, err = client.Create(context.TODO(), policy, metav1.CreateOptions{})
+	case !reflect.DeepEqual(existing.Spec, policy.Spec):
+		klog.Infof("Updating multitenant NetworkPolicy for namespace %q (netid %d)", ns.Name, netns.NetID)
+		existing = existing.DeepCopy()
+		existing.Spec = policy.Spec
+		_, err = client.Update(context.TODO(), existing, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// multitenantIsolationPolicy returns a NetworkPolicy for namespace that allows the
+// same ingress traffic that the multitenant plugin would for netid: traffic from
+// namespaces with the same VNID, and from global (VNID 0) namespaces (which
+// includes traffic from the nodes themselves). It returns nil for global
+// namespaces, which accept traffic from everywhere.
+func multitenantIsolationPolicy(namespace string, netid uint32) *networkingv1.NetworkPolicy {
+	if netid == common.GlobalVNID {
+		return nil
+	}
+
+	vnidPeer := func(vnid uint32) networkingv1.NetworkPolicyPeer {
+		return networkingv1.NetworkPolicyPeer{
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					MultitenantVNIDLabel: strconv.FormatUint(uint64(vnid), 10),
+				},
+			},
+		}
+	}
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      multitenantPolicyName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				multitenantPolicyLabel: "true",
+			},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				From: []networkingv1.NetworkPolicyPeer{
+					vnidPeer(netid),
+					vnidPeer(common.GlobalVNID),
+				},
+			}},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+		},
+	}
+}
@@ -0,0 +1,185 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	osdninformers "github.com/openshift/client-go/network/informers/externalversions"
+	"github.com/openshift/library-go/pkg/network/networkutils"
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+func TestNetworkPolicyMigration(t *testing.T) {
+	kClient := fake.NewSimpleClientset()
+	kubeInformers := informers.NewSharedInformerFactory(kClient, 0)
+	namespaceInformer := kubeInformers.Core().V1().Namespaces()
+	npm := newNetworkPolicyMigrator(kClient, namespaceInformer, nil)
+
+	for _, name := range []string{"alpha", "bravo"} {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if _, err := kClient.CoreV1().Namespaces().Create(context.TODO(), ns, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("unexpected error creating namespace: %v", err)
+		}
+		if err := namespaceInformer.Informer().GetIndexer().Add(ns); err != nil {
+			t.Fatalf("unexpected error adding namespace: %v", err)
+		}
+	}
+
+	netns := &osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "alpha"},
+		NetName:    "alpha",
+		NetID:      42,
+	}
+	if err := npm.reconcile(netns); err != nil {
+		t.Fatalf("unexpected error reconciling: %v", err)
+	}
+
+	ns, err := kClient.CoreV1().Namespaces().Get(context.TODO(), "alpha", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting namespace: %v", err)
+	}
+	if ns.Labels[MultitenantVNIDLabel] != "42" {
+		t.Fatalf("expected namespace to be labeled with its VNID, got %v", ns.Labels)
+	}
+	policy, err := kClient.NetworkingV1().NetworkPolicies("alpha").Get(context.TODO(), multitenantPolicyName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting policy: %v", err)
+	}
+	from := policy.Spec.Ingress[0].From
+	if len(from) != 2 || from[0].NamespaceSelector.MatchLabels[MultitenantVNIDLabel] != "42" || from[1].NamespaceSelector.MatchLabels[MultitenantVNIDLabel] != "0" {
+		t.Fatalf("unexpected policy peers: %#v", from)
+	}
+
+	// Joining another network updates the policy
+	netns.NetID = 43
+	if err := npm.reconcile(netns); err != nil {
+		t.Fatalf("unexpected error reconciling: %v", err)
+	}
+	policy, err = kClient.NetworkingV1().NetworkPolicies("alpha").Get(context.TODO(), multitenantPolicyName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting policy: %v", err)
+	}
+	if label := policy.Spec.Ingress[0].From[0].NamespaceSelector.MatchLabels[MultitenantVNIDLabel]; label != "43" {
+		t.Fatalf("expected policy to be updated to VNID 43, got %q", label)
+	}
+
+	// Making the namespace global deletes the policy
+	netns.NetID = 0
+	if err := npm.reconcile(netns); err != nil {
+		t.Fatalf("unexpected error reconciling: %v", err)
+	}
+	if _, err := kClient.NetworkingV1().NetworkPolicies("alpha").Get(context.TODO(), multitenantPolicyName, metav1.GetOptions{}); err == nil {
+		t.Fatalf("expected policy to be deleted")
+	}
+
+	// Pre-existing policies with the same name are not overwritten
+	existing := multitenantIsolationPolicy("bravo", 44)
+	existing.Labels = nil
+	if _, err := kClient.NetworkingV1().NetworkPolicies("bravo").Create(context.TODO(), existing, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unexpected error creating policy: %v", err)
+	}
+	netns = &osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "bravo"},
+		NetName:    "bravo",
+		NetID:      45,
+	}
+	if err := npm.reconcile(netns); err == nil {
+		t.Fatalf("expected error reconciling over a user-created policy")
+	}
+}
+
+func TestNetworkPolicyMigrationNodes(t *testing.T) {
+	kClient := fake.NewSimpleClientset()
+	kubeInformers := informers.NewSharedInformerFactory(kClient, 0)
+	osdnInformers := osdninformers.NewSharedInformerFactory(nil, 0)
+	npm := newNetworkPolicyMigrator(kClient, kubeInformers.Core().V1().Namespaces(), osdnInformers.Network().V1().NetNamespaces())
+	npm.nodeInformer = kubeInformers.Core().V1().Nodes()
+	npm.hostSubnetInformer = osdnInformers.Network().V1().HostSubnets()
+
+	nodeIndexer := npm.nodeInformer.Informer().GetIndexer()
+	for _, name := range []string{"node2", "node1"} {
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if _, err := kClient.CoreV1().Nodes().Create(context.TODO(), node, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("unexpected error creating node: %v", err)
+		}
+		if err := nodeIndexer.Add(node); err != nil {
+			t.Fatalf("unexpected error adding node: %v", err)
+		}
+	}
+	netns := &osdnv1.NetNamespace{ObjectMeta: metav1.ObjectMeta{Name: "alpha"}, NetName: "alpha", NetID: 42}
+	if err := npm.netNamespaceInformer.Informer().GetIndexer().Add(netns); err != nil {
+		t.Fatalf("unexpected error adding NetNamespace: %v", err)
+	}
+
+	// syncNodes runs migrateNextNode and copies the Nodes back into the informer
+	syncNodes := func() map[string]bool {
+		npm.migrateNextNode()
+		switched := make(map[string]bool)
+		for _, name := range []string{"node1", "node2"} {
+			node, err := kClient.CoreV1().Nodes().Get(context.TODO(), name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error getting node: %v", err)
+			}
+			if err := nodeIndexer.Update(node); err != nil {
+				t.Fatalf("unexpected error updating node: %v", err)
+			}
+			switched[name] = node.Annotations[common.NodePluginAnnotation] == networkutils.NetworkPolicyPluginName
+		}
+		return switched
+	}
+	setRunning := func(name string) {
+		status, _ := json.Marshal(&common.NodeSDNStatus{Ready: true, PluginName: networkutils.NetworkPolicyPluginName})
+		hs := &osdnv1.HostSubnet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Annotations: map[string]string{common.NodeSDNStatusAnnotation: string(status)},
+			},
+			Host: name,
+		}
+		if err := npm.hostSubnetInformer.Informer().GetIndexer().Add(hs); err != nil {
+			t.Fatalf("unexpected error adding HostSubnet: %v", err)
+		}
+	}
+
+	// Nothing happens until the migration is enabled and the policies are in place
+	if switched := syncNodes(); switched["node1"] || switched["node2"] {
+		t.Fatalf("unexpected switch before migration was enabled: %v", switched)
+	}
+	npm.enabled = true
+	if switched := syncNodes(); switched["node1"] || switched["node2"] {
+		t.Fatalf("unexpected switch before policies were reconciled: %v", switched)
+	}
+	npm.reconciled.Insert("alpha")
+
+	// Nodes are switched one at a time, waiting for each to report the new plugin
+	if switched := syncNodes(); !switched["node1"] || switched["node2"] {
+		t.Fatalf("expected only node1 to be switched, got %v", switched)
+	}
+	if switched := syncNodes(); switched["node2"] {
+		t.Fatalf("unexpected switch of node2 before node1 was running: %v", switched)
+	}
+	setRunning("node1")
+	if switched := syncNodes(); !switched["node2"] {
+		t.Fatalf("expected node2 to be switched, got %v", switched)
+	}
+	if npm.migrationComplete() {
+		t.Fatalf("unexpected completion before node2 was running")
+	}
+	setRunning("node2")
+	if !npm.migrationComplete() {
+		t.Fatalf("expected migration to be complete")
+	}
+
+	// A namespace whose policy failed to reconcile blocks the migration
+	npm.forgetNamespace("alpha")
+	if npm.migrationComplete() {
+		t.Fatalf("unexpected completion with an unreconciled namespace")
+	}
+}
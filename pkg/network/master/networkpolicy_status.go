@@ -0,0 +1,65 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	kapierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	knetworkinginformers "k8s.io/client-go/informers/networking/v1"
+	kclientset "k8s.io/client-go/kubernetes"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// networkPolicyStatusController sets common.NetworkPolicyStatusAnnotation on each
+// NetworkPolicy. Since every node parses policies the same way, the status is
+// computed once here rather than being written by every node.
+type networkPolicyStatusController struct {
+	kClient        kclientset.Interface
+	policyInformer knetworkinginformers.NetworkPolicyInformer
+}
+
+func newNetworkPolicyStatusController(kClient kclientset.Interface, policyInformer knetworkinginformers.NetworkPolicyInformer) *networkPolicyStatusController {
+	return &networkPolicyStatusController{
+		kClient:        kClient,
+		policyInformer: policyInformer,
+	}
+}
+
+func (npsc *networkPolicyStatusController) Start() {
+	funcs := common.InformerFuncs(&networkingv1.NetworkPolicy{}, npsc.handleAddOrUpdateNetworkPolicy, nil)
+	npsc.policyInformer.Informer().AddEventHandler(funcs)
+}
+
+func (npsc *networkPolicyStatusController) handleAddOrUpdateNetworkPolicy(obj, _ interface{}, eventType watch.EventType) {
+	policy := obj.(*networkingv1.NetworkPolicy)
+	status := common.NetworkPolicyStatus(policy)
+	if policy.Annotations[common.NetworkPolicyStatusAnnotation] == status {
+		return
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"uid":             policy.UID,
+			"resourceVersion": policy.ResourceVersion,
+			"annotations": map[string]string{
+				common.NetworkPolicyStatusAnnotation: status,
+			},
+		},
+	})
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not build status patch for NetworkPolicy %s/%s: %v", policy.Namespace, policy.Name, err))
+		return
+	}
+	_, err = npsc.kClient.NetworkingV1().NetworkPolicies(policy.Namespace).Patch(context.TODO(), policy.Name, ktypes.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil && !kapierrors.IsNotFound(err) && !kapierrors.IsConflict(err) {
+		// (On a conflict, the informer will deliver the newer version.)
+		utilruntime.HandleError(fmt.Errorf("could not update status of NetworkPolicy %s/%s: %v", policy.Namespace, policy.Name, err))
+	}
+}
@@ -0,0 +1,58 @@
+package master
+
+import (
+	"context"
+	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+func TestNetworkPolicyStatus(t *testing.T) {
+	namedPort := intstr.FromString("http")
+	policy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "alpha", Name: "web", UID: "uid"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				Ports: []networkingv1.NetworkPolicyPort{{Port: &namedPort}},
+			}},
+		},
+	}
+	kClient := fake.NewSimpleClientset(policy)
+	kubeInformers := informers.NewSharedInformerFactory(kClient, 0)
+	npsc := newNetworkPolicyStatusController(kClient, kubeInformers.Networking().V1().NetworkPolicies())
+
+	npsc.handleAddOrUpdateNetworkPolicy(policy, nil, watch.Added)
+	updated, err := kClient.NetworkingV1().NetworkPolicies("alpha").Get(context.TODO(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting policy: %v", err)
+	}
+	if status := updated.Annotations[common.NetworkPolicyStatusAnnotation]; status != `PartiallyProgrammed: named port "http" is not supported` {
+		t.Fatalf("unexpected status %q", status)
+	}
+
+	// An unchanged status is not written again
+	kClient.ClearActions()
+	npsc.handleAddOrUpdateNetworkPolicy(updated, nil, watch.Modified)
+	if actions := kClient.Actions(); len(actions) != 0 {
+		t.Fatalf("unexpected actions %v", actions)
+	}
+
+	port := intstr.FromInt(80)
+	updated.Spec.Ingress[0].Ports[0].Port = &port
+	npsc.handleAddOrUpdateNetworkPolicy(updated, nil, watch.Modified)
+	updated, err = kClient.NetworkingV1().NetworkPolicies("alpha").Get(context.TODO(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting policy: %v", err)
+	}
+	if status := updated.Annotations[common.NetworkPolicyStatusAnnotation]; status != common.NetworkPolicyStatusProgrammed {
+		t.Fatalf("unexpected status %q", status)
+	}
+}
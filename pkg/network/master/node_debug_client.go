@@ -0,0 +1,79 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+// nodeDebugTimeout is how long the master waits for a node debug endpoint
+const nodeDebugTimeout = 15 * time.Second
+
+// NodeDebugClient calls the nodes' debug endpoints over TLS, authenticating as the
+// master itself. The master authorizes its own callers (see
+// common.RequireAuthorization) and never passes their credentials on to the nodes,
+// so the master's service account must be authorized for the nodes' endpoints.
+type NodeDebugClient struct {
+	client *http.Client
+	// nodeURL returns the base URL of the debug endpoints of the node with IP nodeIP
+	nodeURL func(nodeIP string) string
+}
+
+// NewNodeDebugClient returns a NodeDebugClient for nodes serving their debug
+// endpoints at port on their node IPs, with certificates signed by the CA in
+// caFile (and valid for their node IPs). It authenticates with the credentials in
+// clientConfig.
+func NewNodeDebugClient(clientConfig *rest.Config, caFile string, port int) (*NodeDebugClient, error) {
+	config := rest.CopyConfig(clientConfig)
+	config.TLSClientConfig = rest.TLSClientConfig{
+		CAFile:   caFile,
+		CertFile: clientConfig.CertFile,
+		KeyFile:  clientConfig.KeyFile,
+		CertData: clientConfig.CertData,
+		KeyData:  clientConfig.KeyData,
+	}
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not create node debug client: %v", err)
+	}
+	return &NodeDebugClient{
+		client: &http.Client{Transport: transport, Timeout: nodeDebugTimeout},
+		nodeURL: func(nodeIP string) string {
+			return "https://" + net.JoinHostPort(nodeIP, strconv.Itoa(port))
+		},
+	}, nil
+}
+
+// getJSON fetches path with params from the debug server of the node with IP
+// nodeIP, returning the raw JSON result and decoding it into into
+func (nc *NodeDebugClient) getJSON(ctx context.Context, nodeIP, path string, params url.Values, into interface{}) (json.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", nc.nodeURL(nodeIP)+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := nc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d: %s", path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, into); err != nil {
+		return nil, fmt.Errorf("could not parse %s result: %v", path, err)
+	}
+	return json.RawMessage(body), nil
+}
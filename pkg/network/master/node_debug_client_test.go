@@ -0,0 +1,73 @@
+package master
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/client-go/rest"
+	certutil "k8s.io/client-go/util/cert"
+)
+
+func TestNodeDebugClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer controller-token" {
+			http.Error(w, fmt.Sprintf("unexpected Authorization %q", auth), http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"result":"Connected"}`)
+	}))
+	defer server.Close()
+
+	tmpDir, err := ioutil.TempDir("", "node-debug-client")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	caFile := filepath.Join(tmpDir, "ca.crt")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatalf("unexpected error writing CA file: %v", err)
+	}
+
+	nc, err := NewNodeDebugClient(&rest.Config{BearerToken: "controller-token"}, caFile, 0)
+	if err != nil {
+		t.Fatalf("unexpected error creating client: %v", err)
+	}
+	if nc.nodeURL("192.168.0.1") != "https://192.168.0.1:0" {
+		t.Fatalf("unexpected node URL %q", nc.nodeURL("192.168.0.1"))
+	}
+	nc.nodeURL = func(string) string { return server.URL }
+
+	var result nodeProbeResult
+	if _, err := nc.getJSON(context.TODO(), "192.168.0.1", "/debug/probe", nil, &result); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Result != "Connected" {
+		t.Fatalf("unexpected result %#v", result)
+	}
+
+	// The node's certificate must be signed by the CA
+	otherCAFile := filepath.Join(tmpDir, "other-ca.crt")
+	otherPEM, _, err := certutil.GenerateSelfSignedCertKey("other-ca", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error generating CA: %v", err)
+	}
+	if err := ioutil.WriteFile(otherCAFile, otherPEM, 0644); err != nil {
+		t.Fatalf("unexpected error writing CA file: %v", err)
+	}
+	nc, err = NewNodeDebugClient(&rest.Config{BearerToken: "controller-token"}, otherCAFile, 0)
+	if err != nil {
+		t.Fatalf("unexpected error creating client: %v", err)
+	}
+	nc.nodeURL = func(string) string { return server.URL }
+	if _, err := nc.getJSON(context.TODO(), "192.168.0.1", "/debug/probe", nil, &result); err == nil {
+		t.Fatalf("unexpectedly connected to node with untrusted certificate")
+	}
+}
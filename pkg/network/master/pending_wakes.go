@@ -0,0 +1,164 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/openshift/sdn/pkg/network/proxy/unidler"
+)
+
+// maxConcurrentPendingWakeQueries is how many nodes the master queries at once
+// when aggregating their pending wakes
+const maxConcurrentPendingWakeQueries = 10
+
+// ClusterPendingWakeList is the result of the master's /unidling/pending handler:
+// the pending wakes of all of the nodes, merged by service
+type ClusterPendingWakeList struct {
+	unidler.PendingWakeList
+
+	// Errors are the errors contacting the nodes, if any. If there are any, the
+	// list may be incomplete.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// pendingWakeAggregator merges the nodes' /unidling/pending results
+type pendingWakeAggregator struct {
+	master *OsdnMaster
+	nodes  *NodeDebugClient
+}
+
+// PendingWakesHandler returns an HTTP handler that returns the services that need
+// pods according to any node's "pending" unidling signaler, as a JSON-encoded
+// ClusterPendingWakeList. It takes the same "namespace" and "service" query
+// parameters as the nodes' /unidling/pending. The handler does no authorization of
+// its own; it must only be served to callers authorized to see every node's list.
+func (master *OsdnMaster) PendingWakesHandler(nodes *NodeDebugClient) http.HandlerFunc {
+	pwa := &pendingWakeAggregator{
+		master: master,
+		nodes:  nodes,
+	}
+	return pwa.serveHTTP
+}
+
+func (pwa *pendingWakeAggregator) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if params.Get("service") != "" && params.Get("namespace") == "" {
+		http.Error(w, "\"service\" requires \"namespace\"", http.StatusBadRequest)
+		return
+	}
+
+	list, err := pwa.getPendingWakes(r.Context(), params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// getPendingWakes queries every node's /unidling/pending with params, and merges
+// the results
+func (pwa *pendingWakeAggregator) getPendingWakes(ctx context.Context, params url.Values) (*ClusterPendingWakeList, error) {
+	subnets, err := pwa.master.hostSubnetInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]*unidler.PendingWakeList, len(subnets))
+	var errs []string
+	sem := make(chan struct{}, maxConcurrentPendingWakeQueries)
+	for _, hs := range subnets {
+		node, nodeIP := hs.Host, hs.HostIP
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			result := &unidler.PendingWakeList{}
+			_, err := pwa.nodes.getJSON(ctx, nodeIP, "/unidling/pending", params, result)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("node %s: %v", node, err))
+			} else {
+				results[node] = result
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Strings(errs)
+	return &ClusterPendingWakeList{
+		PendingWakeList: mergePendingWakes(results),
+		Errors:          errs,
+	}, nil
+}
+
+// mergePendingWakes merges the nodes' pending wakes by service, combining their
+// ports and signal counts and taking the earliest first and latest last signal
+func mergePendingWakes(results map[string]*unidler.PendingWakeList) unidler.PendingWakeList {
+	merged := make(map[types.NamespacedName]*unidler.PendingWake)
+	for _, result := range results {
+		for _, wake := range result.Services {
+			name := types.NamespacedName{Namespace: wake.Namespace, Name: wake.Service}
+			mw := merged[name]
+			if mw == nil {
+				mw = &unidler.PendingWake{
+					Namespace:   wake.Namespace,
+					Service:     wake.Service,
+					FirstSignal: wake.FirstSignal,
+					LastSignal:  wake.LastSignal,
+				}
+				merged[name] = mw
+			}
+			if wake.FirstSignal.Before(&mw.FirstSignal) {
+				mw.FirstSignal = wake.FirstSignal
+			}
+			if mw.LastSignal.Before(&wake.LastSignal) {
+				mw.LastSignal = wake.LastSignal
+			}
+			mw.Signals += wake.Signals
+			for _, port := range wake.Ports {
+				found := false
+				for _, p := range mw.Ports {
+					if p == port {
+						found = true
+						break
+					}
+				}
+				if !found {
+					mw.Ports = append(mw.Ports, port)
+				}
+			}
+		}
+	}
+
+	list := unidler.PendingWakeList{Services: make([]unidler.PendingWake, 0, len(merged))}
+	for _, wake := range merged {
+		sort.Strings(wake.Ports)
+		list.Services = append(list.Services, *wake)
+	}
+	sort.Slice(list.Services, func(i, j int) bool {
+		if list.Services[i].Namespace != list.Services[j].Namespace {
+			return list.Services[i].Namespace < list.Services[j].Namespace
+		}
+		return list.Services[i].Service < list.Services[j].Service
+	})
+	list.Count = len(list.Services)
+	return list
+}
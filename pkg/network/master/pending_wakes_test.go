@@ -0,0 +1,87 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	osdninformers "github.com/openshift/client-go/network/informers/externalversions"
+)
+
+func TestPendingWakes(t *testing.T) {
+	osdnInformers := osdninformers.NewSharedInformerFactory(nil, 0)
+	for _, hs := range []*osdnv1.HostSubnet{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node1"}, Host: "node1", HostIP: "192.168.0.1", Subnet: "10.128.0.0/23"},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node2"}, Host: "node2", HostIP: "192.168.0.2", Subnet: "10.129.0.0/23"},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node3"}, Host: "node3", HostIP: "192.168.0.3", Subnet: "10.130.0.0/23"},
+	} {
+		osdnInformers.Network().V1().HostSubnets().Informer().GetIndexer().Add(hs)
+	}
+	master := &OsdnMaster{
+		hostSubnetInformer: osdnInformers.Network().V1().HostSubnets(),
+	}
+
+	// All of the nodes are served by server, under "/NODEIP/"
+	responses := map[string]string{
+		"/192.168.0.1/unidling/pending": `{"count": 2, "services": [
+			{"namespace": "testns", "service": "idled", "ports": ["http"], "firstSignal": "2021-01-01T10:00:00Z", "lastSignal": "2021-01-01T10:05:00Z", "signals": 2},
+			{"namespace": "testns", "service": "other", "ports": ["dns"], "firstSignal": "2021-01-01T10:00:00Z", "lastSignal": "2021-01-01T10:00:00Z", "signals": 1}
+		]}`,
+		"/192.168.0.2/unidling/pending": `{"count": 1, "services": [
+			{"namespace": "testns", "service": "idled", "ports": ["http", "https"], "firstSignal": "2021-01-01T09:00:00Z", "lastSignal": "2021-01-01T10:01:00Z", "signals": 3}
+		]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ns := r.URL.Query().Get("namespace"); ns != "testns" {
+			t.Errorf("unexpected query %q", r.URL.RawQuery)
+		}
+		if resp, ok := responses[r.URL.Path]; ok {
+			fmt.Fprint(w, resp)
+		} else {
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	pwa := &pendingWakeAggregator{
+		master: master,
+		nodes: &NodeDebugClient{
+			client: server.Client(),
+			nodeURL: func(nodeIP string) string {
+				return server.URL + "/" + nodeIP
+			},
+		},
+	}
+
+	list, err := pwa.getPendingWakes(context.TODO(), url.Values{"namespace": {"testns"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(list.Errors) != 1 || !strings.HasPrefix(list.Errors[0], "node node3:") {
+		t.Fatalf("unexpected errors %v", list.Errors)
+	}
+	if list.Count != 2 || len(list.Services) != 2 {
+		t.Fatalf("unexpected list %#v", list)
+	}
+	idled, other := list.Services[0], list.Services[1]
+	if idled.Service != "idled" || other.Service != "other" {
+		t.Fatalf("unexpected services %#v", list.Services)
+	}
+	if !reflect.DeepEqual(idled.Ports, []string{"http", "https"}) || idled.Signals != 5 {
+		t.Fatalf("unexpected merged wake %#v", idled)
+	}
+	if idled.FirstSignal.UTC().Hour() != 9 || idled.LastSignal.UTC().Minute() != 5 {
+		t.Fatalf("unexpected merged signal times %#v", idled)
+	}
+	if other.Signals != 1 || !reflect.DeepEqual(other.Ports, []string{"dns"}) {
+		t.Fatalf("unexpected wake %#v", other)
+	}
+}
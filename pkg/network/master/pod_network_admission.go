@@ -0,0 +1,125 @@
+package master
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+// PodNetworkChangeRequesterAnnotation is set on a NetNamespace, by the admission
+// webhook served by PodNetworkChangeAdmissionHandler, to the name of the user who
+// set its ChangePodNetworkAnnotation. The webhook overwrites any value that the
+// user set themselves, so that the master can record who requested the change.
+const PodNetworkChangeRequesterAnnotation = "network.openshift.io/pod-network-change-requester"
+
+// PodNetworkChangeAdmissionHandler returns an http.Handler implementing a mutating
+// admission webhook for NetNamespace creates and updates, which sets
+// PodNetworkChangeRequesterAnnotation to the requesting user whenever
+// ChangePodNetworkAnnotation is set or changed, and otherwise prevents users from
+// setting it.
+func PodNetworkChangeAdmissionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not read request: %v", err), http.StatusBadRequest)
+			return
+		}
+		review := &admissionv1.AdmissionReview{}
+		if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+			http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+			return
+		}
+
+		review.Response = admitPodNetworkChange(review.Request)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(review); err != nil {
+			utilruntime.HandleError(fmt.Errorf("could not write admission response: %v", err))
+		}
+	}
+}
+
+// admitPodNetworkChange returns the response to an admission request for a
+// NetNamespace
+func admitPodNetworkChange(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	resp := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+
+	netns := &osdnv1.NetNamespace{}
+	if err := json.Unmarshal(req.Object.Raw, netns); err != nil {
+		resp.Allowed = false
+		resp.Result = &metav1.Status{Message: fmt.Sprintf("could not decode NetNamespace: %v", err)}
+		return resp
+	}
+	oldNetns := &osdnv1.NetNamespace{}
+	if len(req.OldObject.Raw) > 0 {
+		if err := json.Unmarshal(req.OldObject.Raw, oldNetns); err != nil {
+			resp.Allowed = false
+			resp.Result = &metav1.Status{Message: fmt.Sprintf("could not decode old NetNamespace: %v", err)}
+			return resp
+		}
+	}
+
+	patch := podNetworkChangeRequesterPatch(oldNetns, netns, req.UserInfo.Username)
+	if patch == nil {
+		return resp
+	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		resp.Allowed = false
+		resp.Result = &metav1.Status{Message: err.Error()}
+		return resp
+	}
+	klog.V(5).Infof("Setting %s on NetNamespace %q: %s", PodNetworkChangeRequesterAnnotation, netns.Name, string(patchBytes))
+	patchType := admissionv1.PatchTypeJSONPatch
+	resp.Patch = patchBytes
+	resp.PatchType = &patchType
+	return resp
+}
+
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// podNetworkChangeRequesterPatch returns a JSON patch that makes netns's
+// PodNetworkChangeRequesterAnnotation correct for a change from oldNetns made by
+// username, or nil if it is already correct. The annotation is set to username if
+// the request sets or changes ChangePodNetworkAnnotation, kept as it was if the
+// request leaves that alone, and removed along with it.
+func podNetworkChangeRequesterPatch(oldNetns, netns *osdnv1.NetNamespace, username string) []jsonPatchOp {
+	change, changeRequested := netns.Annotations[osdnv1.ChangePodNetworkAnnotation]
+	oldChange, oldChangeRequested := oldNetns.Annotations[osdnv1.ChangePodNetworkAnnotation]
+
+	requester, hasRequester := netns.Annotations[PodNetworkChangeRequesterAnnotation]
+	wantRequester, wantHasRequester := "", false
+	if changeRequested {
+		if oldChangeRequested && change == oldChange {
+			wantRequester, wantHasRequester = oldNetns.Annotations[PodNetworkChangeRequesterAnnotation]
+		} else {
+			wantRequester, wantHasRequester = username, true
+		}
+	}
+	if hasRequester == wantHasRequester && requester == wantRequester {
+		return nil
+	}
+
+	path := "/metadata/annotations/" + strings.ReplaceAll(strings.ReplaceAll(PodNetworkChangeRequesterAnnotation, "~", "~0"), "/", "~1")
+	switch {
+	case !wantHasRequester:
+		return []jsonPatchOp{{Op: "remove", Path: path}}
+	case netns.Annotations == nil:
+		return []jsonPatchOp{{Op: "add", Path: "/metadata/annotations", Value: map[string]string{PodNetworkChangeRequesterAnnotation: wantRequester}}}
+	default:
+		return []jsonPatchOp{{Op: "add", Path: path, Value: wantRequester}}
+	}
+}
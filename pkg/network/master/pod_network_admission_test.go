@@ -0,0 +1,110 @@
+package master
+
+import (
+	"encoding/json"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+func TestPodNetworkChangeRequesterPatch(t *testing.T) {
+	netns := func(annotations map[string]string) *osdnv1.NetNamespace {
+		return &osdnv1.NetNamespace{
+			ObjectMeta: metav1.ObjectMeta{Name: "alpha", Annotations: annotations},
+			NetName:    "alpha",
+		}
+	}
+	const path = "/metadata/annotations/network.openshift.io~1pod-network-change-requester"
+
+	tests := []struct {
+		name     string
+		old      *osdnv1.NetNamespace
+		new      *osdnv1.NetNamespace
+		expected string
+	}{
+		{
+			name:     "no change requested",
+			old:      netns(nil),
+			new:      netns(map[string]string{"other": "value"}),
+			expected: "null",
+		},
+		{
+			name:     "change requested",
+			old:      netns(nil),
+			new:      netns(map[string]string{osdnv1.ChangePodNetworkAnnotation: "join:bravo"}),
+			expected: `[{"op":"add","path":"` + path + `","value":"alice"}]`,
+		},
+		{
+			name: "spoofed requester",
+			old:  netns(nil),
+			new: netns(map[string]string{
+				osdnv1.ChangePodNetworkAnnotation:   "join:bravo",
+				PodNetworkChangeRequesterAnnotation: "bob",
+			}),
+			expected: `[{"op":"add","path":"` + path + `","value":"alice"}]`,
+		},
+		{
+			name: "unrelated update keeps requester",
+			old: netns(map[string]string{
+				osdnv1.ChangePodNetworkAnnotation:   "join:bravo",
+				PodNetworkChangeRequesterAnnotation: "bob",
+			}),
+			new: netns(map[string]string{
+				osdnv1.ChangePodNetworkAnnotation:   "join:bravo",
+				PodNetworkChangeRequesterAnnotation: "bob",
+			}),
+			expected: "null",
+		},
+		{
+			name: "requester without change",
+			old:  netns(nil),
+			new: netns(map[string]string{
+				PodNetworkChangeRequesterAnnotation: "bob",
+			}),
+			expected: `[{"op":"remove","path":"` + path + `"}]`,
+		},
+	}
+	for _, test := range tests {
+		patch, err := json.Marshal(podNetworkChangeRequesterPatch(test.old, test.new, "alice"))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if string(patch) != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, string(patch))
+		}
+	}
+}
+
+func TestAdmitPodNetworkChange(t *testing.T) {
+	netns := &osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "alpha"},
+		NetName:    "alpha",
+	}
+	raw, _ := json.Marshal(netns)
+	netns.Annotations = map[string]string{osdnv1.ChangePodNetworkAnnotation: "global"}
+	newRaw, _ := json.Marshal(netns)
+
+	resp := admitPodNetworkChange(&admissionv1.AdmissionRequest{
+		UID:       "1234",
+		UserInfo:  authenticationv1.UserInfo{Username: "alice"},
+		Object:    runtime.RawExtension{Raw: newRaw},
+		OldObject: runtime.RawExtension{Raw: raw},
+	})
+	if !resp.Allowed || resp.UID != "1234" || resp.PatchType == nil || *resp.PatchType != admissionv1.PatchTypeJSONPatch {
+		t.Fatalf("unexpected response %#v", resp)
+	}
+	expected := `[{"op":"add","path":"/metadata/annotations/network.openshift.io~1pod-network-change-requester","value":"alice"}]`
+	if string(resp.Patch) != expected {
+		t.Fatalf("expected patch %s, got %s", expected, string(resp.Patch))
+	}
+
+	resp = admitPodNetworkChange(&admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: []byte("garbage")}})
+	if resp.Allowed {
+		t.Fatalf("expected invalid object to be rejected")
+	}
+}
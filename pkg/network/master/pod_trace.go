@@ -0,0 +1,208 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Where a PodTrace found that traffic is dropped
+const (
+	podTraceDroppedSource      = "SourceNode"
+	podTraceDroppedDestination = "DestinationNode"
+	podTraceDroppedNetwork     = "Network"
+)
+
+// PodTraceQuery describes the traffic to trace between two pods
+type PodTraceQuery struct {
+	// SrcPod and DstPod are "namespace/name"
+	SrcPod   string `json:"srcPod"`
+	DstPod   string `json:"dstPod"`
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+}
+
+// podTraceEndpoint describes one of the pods in a PodTrace
+type podTraceEndpoint struct {
+	Pod    string `json:"pod"`
+	IP     string `json:"ip"`
+	Node   string `json:"node"`
+	NodeIP string `json:"nodeIP"`
+}
+
+// nodePacketTrace is the part of a node's /debug/trace result that the master
+// looks at
+type nodePacketTrace struct {
+	Dropped bool   `json:"dropped"`
+	Verdict string `json:"verdict"`
+}
+
+// nodeProbeResult is the part of a node's /debug/probe result that the master
+// looks at
+type nodeProbeResult struct {
+	Result string `json:"result"`
+	Error  string `json:"error"`
+}
+
+// PodTrace is the combined result of tracing traffic from one pod to another on
+// the source node and the destination node, and of probing the destination from
+// the source node
+type PodTrace struct {
+	Source      podTraceEndpoint `json:"source"`
+	Destination podTraceEndpoint `json:"destination"`
+
+	// SourceTrace and DestinationTrace are the nodes' packet traces, and Probe the
+	// source node's probe result, as returned by the nodes
+	SourceTrace      json.RawMessage `json:"sourceTrace,omitempty"`
+	DestinationTrace json.RawMessage `json:"destinationTrace,omitempty"`
+	Probe            json.RawMessage `json:"probe,omitempty"`
+
+	// Errors are the errors contacting the nodes, if any
+	Errors []string `json:"errors,omitempty"`
+
+	// DroppedAt is "SourceNode", "DestinationNode", or "Network" if the traffic is
+	// dropped, and empty if it isn't (or it couldn't be determined)
+	DroppedAt string `json:"droppedAt,omitempty"`
+	Verdict   string `json:"verdict"`
+}
+
+// podTracer coordinates PodTraces using the nodes' debug endpoints
+type podTracer struct {
+	master *OsdnMaster
+	nodes  *NodeDebugClient
+}
+
+// PodTraceHandler returns an HTTP handler that traces traffic between two pods,
+// taking the fields of a PodTraceQuery as query parameters, eg
+// "?srcPod=ns1/client&dstPod=ns2/server&protocol=tcp&port=8080", using the nodes'
+// /debug/trace and /debug/probe endpoints. The handler does no authorization of
+// its own; it must only be served to callers authorized to trace any pods.
+func (master *OsdnMaster) PodTraceHandler(nodes *NodeDebugClient) http.HandlerFunc {
+	pt := &podTracer{
+		master: master,
+		nodes:  nodes,
+	}
+	return pt.serveHTTP
+}
+
+func (pt *podTracer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := &PodTraceQuery{
+		SrcPod:   params.Get("srcPod"),
+		DstPod:   params.Get("dstPod"),
+		Protocol: params.Get("protocol"),
+	}
+	if portStr := params.Get("port"); portStr != "" {
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid port %q", portStr), http.StatusBadRequest)
+			return
+		}
+		q.Port = port
+	}
+
+	trace, err := pt.tracePods(r.Context(), q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(trace); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// getEndpoint looks up the pod "namespace/name" and its node
+func (pt *podTracer) getEndpoint(ctx context.Context, podName string) (*podTraceEndpoint, error) {
+	parts := strings.Split(podName, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid pod %q: must be namespace/name", podName)
+	}
+	pod, err := pt.master.kClient.CoreV1().Pods(parts[0]).Get(ctx, parts[1], metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if pod.Spec.HostNetwork {
+		return nil, fmt.Errorf("pod %q is host-network", podName)
+	}
+	if pod.Spec.NodeName == "" || pod.Status.PodIP == "" || pod.Status.Phase != corev1.PodRunning {
+		return nil, fmt.Errorf("pod %q is not running", podName)
+	}
+	hs, err := pt.master.hostSubnetInformer.Lister().Get(pod.Spec.NodeName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get HostSubnet of node %q: %v", pod.Spec.NodeName, err)
+	}
+	return &podTraceEndpoint{Pod: podName, IP: pod.Status.PodIP, Node: pod.Spec.NodeName, NodeIP: hs.HostIP}, nil
+}
+
+// tracePods traces q's traffic on the source node and (if it is different) the
+// destination node, and (for TCP) probes the destination pod from the source pod,
+// and combines the results into a verdict
+func (pt *podTracer) tracePods(ctx context.Context, q *PodTraceQuery) (*PodTrace, error) {
+	src, err := pt.getEndpoint(ctx, q.SrcPod)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := pt.getEndpoint(ctx, q.DstPod)
+	if err != nil {
+		return nil, err
+	}
+	protocol := strings.ToLower(q.Protocol)
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	trace := &PodTrace{Source: *src, Destination: *dst}
+
+	params := url.Values{
+		"srcIP":        {src.IP},
+		"srcNamespace": {strings.Split(src.Pod, "/")[0]},
+		"dstIP":        {dst.IP},
+		"protocol":     {protocol},
+		"port":         {strconv.Itoa(q.Port)},
+	}
+	var srcResult, dstResult nodePacketTrace
+	trace.SourceTrace, err = pt.nodes.getJSON(ctx, src.NodeIP, "/debug/trace", params, &srcResult)
+	if err != nil {
+		trace.Errors = append(trace.Errors, fmt.Sprintf("tracing on source node %s: %v", src.Node, err))
+	}
+	if dst.Node != src.Node {
+		trace.DestinationTrace, err = pt.nodes.getJSON(ctx, dst.NodeIP, "/debug/trace", params, &dstResult)
+		if err != nil {
+			trace.Errors = append(trace.Errors, fmt.Sprintf("tracing on destination node %s: %v", dst.Node, err))
+		}
+	}
+	var probeResult nodeProbeResult
+	if protocol == "tcp" {
+		probeParams := url.Values{"srcIP": {src.IP}, "dstIP": {dst.IP}, "port": {strconv.Itoa(q.Port)}}
+		trace.Probe, err = pt.nodes.getJSON(ctx, src.NodeIP, "/debug/probe", probeParams, &probeResult)
+		if err != nil {
+			trace.Errors = append(trace.Errors, fmt.Sprintf("probing from source node %s: %v", src.Node, err))
+		}
+	}
+
+	switch {
+	case trace.SourceTrace != nil && srcResult.Dropped:
+		trace.DroppedAt = podTraceDroppedSource
+		trace.Verdict = fmt.Sprintf("Dropped on source node %s: %s", src.Node, srcResult.Verdict)
+	case trace.DestinationTrace != nil && dstResult.Dropped:
+		trace.DroppedAt = podTraceDroppedDestination
+		trace.Verdict = fmt.Sprintf("Dropped on destination node %s: %s", dst.Node, dstResult.Verdict)
+	case trace.Probe != nil && probeResult.Result == "Failed":
+		trace.DroppedAt = podTraceDroppedNetwork
+		trace.Verdict = fmt.Sprintf("OVS allows the traffic, but pod %s could not reach %s: %s", src.Pod, dst.IP, probeResult.Error)
+	case len(trace.Errors) > 0:
+		trace.Verdict = "Unknown: could not get results from every node"
+	case trace.Probe != nil && probeResult.Result == "Refused":
+		trace.Verdict = fmt.Sprintf("Allowed, but nothing is listening on port %d in pod %s", q.Port, dst.Pod)
+	default:
+		trace.Verdict = "Allowed"
+	}
+	return trace, nil
+}
@@ -0,0 +1,163 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	osdninformers "github.com/openshift/client-go/network/informers/externalversions"
+)
+
+func TestPodTrace(t *testing.T) {
+	pod := func(namespace, name, node, ip string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Spec:       corev1.PodSpec{NodeName: node},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: ip},
+		}
+	}
+	kClient := fake.NewSimpleClientset(
+		pod("alpha", "client", "node1", "10.128.0.5"),
+		pod("alpha", "local", "node1", "10.128.0.6"),
+		pod("beta", "server", "node2", "10.129.0.8"),
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "beta", Name: "pending"}},
+	)
+	osdnInformers := osdninformers.NewSharedInformerFactory(nil, 0)
+	for _, hs := range []*osdnv1.HostSubnet{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node1"}, Host: "node1", HostIP: "192.168.0.1", Subnet: "10.128.0.0/23"},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node2"}, Host: "node2", HostIP: "192.168.0.2", Subnet: "10.129.0.0/23"},
+	} {
+		osdnInformers.Network().V1().HostSubnets().Informer().GetIndexer().Add(hs)
+	}
+	master := &OsdnMaster{
+		kClient:            kClient,
+		hostSubnetInformer: osdnInformers.Network().V1().HostSubnets(),
+	}
+
+	// All of the nodes are served by server, under "/NODEIP/"; responses maps
+	// "/NODEIP/path" to the node's response
+	var responses map[string]string
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/debug/trace") && r.URL.Query().Get("srcNamespace") != "alpha" {
+			t.Errorf("unexpected trace query %q", r.URL.RawQuery)
+		}
+		if strings.HasSuffix(r.URL.Path, "/debug/probe") && r.URL.Query().Get("srcIP") != "10.128.0.5" {
+			t.Errorf("unexpected probe query %q", r.URL.RawQuery)
+		}
+		if resp, ok := responses[r.URL.Path]; ok {
+			fmt.Fprint(w, resp)
+		} else {
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	pt := &podTracer{
+		master: master,
+		nodes: &NodeDebugClient{
+			client: server.Client(),
+			nodeURL: func(nodeIP string) string {
+				return server.URL + "/" + nodeIP
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name      string
+		query     PodTraceQuery
+		responses map[string]string
+		droppedAt string
+		verdict   string
+		requests  int
+	}{
+		{
+			name:  "allowed",
+			query: PodTraceQuery{SrcPod: "alpha/client", DstPod: "beta/server", Port: 8080},
+			responses: map[string]string{
+				"/192.168.0.1/debug/trace": `{"dropped":false,"verdict":"output to vxlan0"}`,
+				"/192.168.0.2/debug/trace": `{"dropped":false,"verdict":"output to veth8"}`,
+				"/192.168.0.1/debug/probe": `{"result":"Connected"}`,
+			},
+			verdict:  "Allowed",
+			requests: 3,
+		},
+		{
+			name:  "dropped by destination",
+			query: PodTraceQuery{SrcPod: "alpha/client", DstPod: "beta/server", Protocol: "TCP", Port: 8080},
+			responses: map[string]string{
+				"/192.168.0.1/debug/trace": `{"dropped":false,"verdict":"output to vxlan0"}`,
+				"/192.168.0.2/debug/trace": `{"dropped":true,"verdict":"dropped in table 80 (IP policy enforcement)"}`,
+				"/192.168.0.1/debug/probe": `{"result":"Connected"}`,
+			},
+			droppedAt: podTraceDroppedDestination,
+			verdict:   "Dropped on destination node node2: dropped in table 80 (IP policy enforcement)",
+			requests:  3,
+		},
+		{
+			name:  "dropped in network",
+			query: PodTraceQuery{SrcPod: "alpha/client", DstPod: "beta/server", Port: 8080},
+			responses: map[string]string{
+				"/192.168.0.1/debug/trace": `{"dropped":false,"verdict":"output to vxlan0"}`,
+				"/192.168.0.2/debug/trace": `{"dropped":false,"verdict":"output to veth8"}`,
+				"/192.168.0.1/debug/probe": `{"result":"Failed","error":"i/o timeout"}`,
+			},
+			droppedAt: podTraceDroppedNetwork,
+			verdict:   "OVS allows the traffic, but pod alpha/client could not reach 10.129.0.8: i/o timeout",
+			requests:  3,
+		},
+		{
+			name:  "same node UDP",
+			query: PodTraceQuery{SrcPod: "alpha/client", DstPod: "alpha/local", Protocol: "udp", Port: 53},
+			responses: map[string]string{
+				"/192.168.0.1/debug/trace": `{"dropped":true,"verdict":"dropped in table 21"}`,
+			},
+			droppedAt: podTraceDroppedSource,
+			verdict:   "Dropped on source node node1: dropped in table 21",
+			requests:  1,
+		},
+		{
+			name:  "unreachable node",
+			query: PodTraceQuery{SrcPod: "alpha/client", DstPod: "beta/server", Port: 8080},
+			responses: map[string]string{
+				"/192.168.0.1/debug/trace": `{"dropped":false,"verdict":"output to vxlan0"}`,
+				"/192.168.0.1/debug/probe": `{"result":"Refused"}`,
+			},
+			verdict:  "Unknown: could not get results from every node",
+			requests: 3,
+		},
+	} {
+		responses = tc.responses
+		requests = nil
+		trace, err := pt.tracePods(context.TODO(), &tc.query)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if trace.DroppedAt != tc.droppedAt || trace.Verdict != tc.verdict {
+			t.Errorf("%s: expected %q/%q, got %q/%q", tc.name, tc.droppedAt, tc.verdict, trace.DroppedAt, trace.Verdict)
+		}
+		if len(requests) != tc.requests {
+			t.Errorf("%s: expected %d requests, got %v", tc.name, tc.requests, requests)
+		}
+	}
+
+	for _, query := range []PodTraceQuery{
+		{SrcPod: "alpha/client", DstPod: "beta/pending", Port: 80},
+		{SrcPod: "alpha/client", DstPod: "beta/nonexistent", Port: 80},
+		{SrcPod: "client", DstPod: "beta/server", Port: 80},
+	} {
+		if _, err := pt.tracePods(context.TODO(), &query); err == nil {
+			t.Errorf("unexpected success tracing %#v", query)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/sdn/pkg/network/common"
+	"github.com/openshift/sdn/pkg/network/master/metrics"
+)
+
+const (
+	// ClusterSDNStatusAnnotation is set on the ClusterNetwork by the master, to a
+	// JSON-encoded clusterSDNStatus aggregating the NodeSDNStatusAnnotation of every
+	// node's HostSubnet, so that admins and the operator can see which nodes have
+	// broken datapaths.
+	ClusterSDNStatusAnnotation = "network.openshift.io/sdn-status"
+
+	// SDNDegradedCondition is the condition in the clusterSDNStatus that is true if
+	// any node is not ready
+	SDNDegradedCondition = "Degraded"
+
+	sdnStatusSyncInterval = 30 * time.Second
+
+	// A node whose SDN Lease hasn't been renewed in this long is considered to be
+	// degraded. (Nodes renew it every 2 minutes.)
+	sdnStatusStaleAge = 5 * time.Minute
+
+	// Reasons for a node being degraded
+	nodeSDNNotReady     = "NotReady"
+	nodeSDNStale        = "StatusStale"
+	nodeSDNNoStatus     = "NoStatus"
+	sdnDegradedReason   = "NodesDegraded"
+	sdnAsExpectedReason = "AsExpected"
+)
+
+// clusterSDNStatus is the aggregated SDN status of the cluster
+type clusterSDNStatus struct {
+	Conditions []metav1.Condition `json:"conditions"`
+	// Nodes is the number of nodes, and ReadyNodes the number that are ready
+	Nodes      int `json:"nodes"`
+	ReadyNodes int `json:"readyNodes"`
+	// DegradedNodes describes each node that is not ready
+	DegradedNodes []degradedNodeStatus `json:"degradedNodes,omitempty"`
+}
+
+// degradedNodeStatus describes a single node that is not ready
+type degradedNodeStatus struct {
+	Node    string `json:"node"`
+	Reason  string `json:"reason"`
+	Message string `json:"message,omitempty"`
+}
+
+func (master *OsdnMaster) startSDNStatusMaster() {
+	go utilwait.Forever(master.syncSDNStatus, sdnStatusSyncInterval)
+}
+
+// syncSDNStatus updates ClusterSDNStatusAnnotation from the nodes' HostSubnets
+func (master *OsdnMaster) syncSDNStatus() {
+	subnets, err := master.hostSubnetInformer.Lister().List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not list HostSubnets: %v", err))
+		return
+	}
+	// Only consider HostSubnets that belong to actual nodes
+	var nodeSubnets []*osdnv1.HostSubnet
+	for _, hs := range subnets {
+		if _, err := master.nodeInformer.Lister().Get(hs.Host); err == nil {
+			nodeSubnets = append(nodeSubnets, hs)
+		}
+	}
+	renewals, err := master.getSDNLeaseRenewals()
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not list SDN leases: %v", err))
+		return
+	}
+	cn, err := master.clusterNetworkInformer.Lister().Get(osdnv1.ClusterNetworkDefault)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not get ClusterNetwork: %v", err))
+		return
+	}
+
+	old := getClusterSDNStatusAnnotation(cn)
+	var oldConditions []metav1.Condition
+	if old != nil {
+		oldConditions = old.Conditions
+	}
+	status := getClusterSDNStatus(nodeSubnets, renewals, oldConditions, time.Now())
+	metrics.SDNDegradedNodes.Set(float64(len(status.DegradedNodes)))
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	if cn.Annotations[ClusterSDNStatusAnnotation] == string(data) {
+		return
+	}
+	if old == nil || len(old.DegradedNodes) != len(status.DegradedNodes) {
+		klog.Infof("SDN status: %d of %d nodes ready", status.ReadyNodes, status.Nodes)
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cn, err := master.osdnClient.NetworkV1().ClusterNetworks().Get(context.TODO(), osdnv1.ClusterNetworkDefault, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if cn.Annotations == nil {
+			cn.Annotations = make(map[string]string)
+		}
+		cn.Annotations[ClusterSDNStatusAnnotation] = string(data)
+		_, err = master.osdnClient.NetworkV1().ClusterNetworks().Update(context.TODO(), cn, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not update cluster SDN status: %v", err))
+	}
+}
+
+// getSDNLeaseRenewals returns the time that each node's SDN Lease was last renewed
+func (master *OsdnMaster) getSDNLeaseRenewals() (map[string]time.Time, error) {
+	leases, err := master.kClient.CoordinationV1().Leases(common.NodeSDNLeaseNamespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	renewals := make(map[string]time.Time, len(leases.Items))
+	for _, lease := range leases.Items {
+		if lease.Spec.HolderIdentity == nil || lease.Spec.RenewTime == nil || lease.Name != common.NodeSDNLeaseName(*lease.Spec.HolderIdentity) {
+			continue
+		}
+		renewals[*lease.Spec.HolderIdentity] = lease.Spec.RenewTime.Time
+	}
+	return renewals, nil
+}
+
+func getClusterSDNStatusAnnotation(cn *osdnv1.ClusterNetwork) *clusterSDNStatus {
+	value, ok := cn.Annotations[ClusterSDNStatusAnnotation]
+	if !ok {
+		return nil
+	}
+	status := &clusterSDNStatus{}
+	if err := json.Unmarshal([]byte(value), status); err != nil {
+		return nil
+	}
+	return status
+}
+
+// getClusterSDNStatus returns the aggregated status of the nodes with the given
+// HostSubnets and SDN Lease renewal times, updating the conditions from oldConditions
+func getClusterSDNStatus(subnets []*osdnv1.HostSubnet, renewals map[string]time.Time, oldConditions []metav1.Condition, now time.Time) *clusterSDNStatus {
+	status := &clusterSDNStatus{
+		Conditions: oldConditions,
+		Nodes:      len(subnets),
+	}
+	for _, hs := range subnets {
+		nodeStatus := common.GetNodeSDNStatus(hs)
+		// The status is current as of the later of when it was written and when
+		// the node last renewed its lease
+		var current time.Time
+		if nodeStatus != nil {
+			current = nodeStatus.LastUpdate.Time
+			if renewal := renewals[hs.Host]; renewal.After(current) {
+				current = renewal
+			}
+		}
+		switch {
+		case nodeStatus == nil:
+			status.DegradedNodes = append(status.DegradedNodes, degradedNodeStatus{Node: hs.Host, Reason: nodeSDNNoStatus})
+		case now.Sub(current) > sdnStatusStaleAge:
+			status.DegradedNodes = append(status.DegradedNodes, degradedNodeStatus{
+				Node:    hs.Host,
+				Reason:  nodeSDNStale,
+				Message: fmt.Sprintf("status last confirmed at %s", current.UTC().Format(time.RFC3339)),
+			})
+		case !nodeStatus.Ready:
+			status.DegradedNodes = append(status.DegradedNodes, degradedNodeStatus{
+				Node:    hs.Host,
+				Reason:  nodeSDNNotReady,
+				Message: formatNodeSDNFailures(nodeStatus.Failures),
+			})
+		default:
+			status.ReadyNodes++
+		}
+	}
+	sort.Slice(status.DegradedNodes, func(i, j int) bool {
+		return status.DegradedNodes[i].Node < status.DegradedNodes[j].Node
+	})
+
+	condition := metav1.Condition{
+		Type:    SDNDegradedCondition,
+		Status:  metav1.ConditionFalse,
+		Reason:  sdnAsExpectedReason,
+		Message: fmt.Sprintf("All %d nodes are ready", status.Nodes),
+	}
+	if len(status.DegradedNodes) > 0 {
+		names := make([]string, 0, len(status.DegradedNodes))
+		for _, dn := range status.DegradedNodes {
+			names = append(names, dn.Node)
+		}
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = sdnDegradedReason
+		condition.Message = fmt.Sprintf("%d of %d nodes are not ready: %s", len(status.DegradedNodes), status.Nodes, strings.Join(names, ", "))
+	}
+	meta.SetStatusCondition(&status.Conditions, condition)
+	return status
+}
+
+// formatNodeSDNFailures returns a description of failures, sorted by subsystem
+func formatNodeSDNFailures(failures map[string]string) string {
+	names := make([]string, 0, len(failures))
+	for name := range failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	descriptions := make([]string, 0, len(names))
+	for _, name := range names {
+		descriptions = append(descriptions, fmt.Sprintf("%s: %s", name, failures[name]))
+	}
+	return strings.Join(descriptions, "; ")
+}
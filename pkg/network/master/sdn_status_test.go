@@ -0,0 +1,84 @@
+package master
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+func TestClusterSDNStatus(t *testing.T) {
+	now := time.Now()
+	hostSubnet := func(name string, status *common.NodeSDNStatus) *osdnv1.HostSubnet {
+		hs := &osdnv1.HostSubnet{ObjectMeta: metav1.ObjectMeta{Name: name}, Host: name}
+		if status != nil {
+			value, err := json.Marshal(status)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			hs.Annotations = map[string]string{common.NodeSDNStatusAnnotation: string(value)}
+		}
+		return hs
+	}
+
+	subnets := []*osdnv1.HostSubnet{
+		hostSubnet("node1", &common.NodeSDNStatus{LastUpdate: metav1.NewTime(now.Add(-time.Minute)), Ready: true}),
+		hostSubnet("node2", &common.NodeSDNStatus{LastUpdate: metav1.NewTime(now.Add(-time.Hour)), Ready: true}),
+	}
+	// node2's status is old, but its lease was renewed recently
+	renewals := map[string]time.Time{
+		"node2": now.Add(-time.Minute),
+		"node4": now.Add(-time.Hour),
+	}
+	status := getClusterSDNStatus(subnets, renewals, nil, now)
+	if status.Nodes != 2 || status.ReadyNodes != 2 || len(status.DegradedNodes) != 0 {
+		t.Fatalf("unexpected status %#v", status)
+	}
+	if len(status.Conditions) != 1 || status.Conditions[0].Type != SDNDegradedCondition || status.Conditions[0].Status != metav1.ConditionFalse {
+		t.Fatalf("unexpected conditions %#v", status.Conditions)
+	}
+	transitionTime := status.Conditions[0].LastTransitionTime
+
+	subnets = append(subnets,
+		hostSubnet("node5", &common.NodeSDNStatus{
+			LastUpdate: metav1.NewTime(now),
+			Ready:      false,
+			Failures:   map[string]string{"ovs": "could not connect to OVS", "cni-server": "CNI server has not been started"},
+		}),
+		hostSubnet("node4", &common.NodeSDNStatus{LastUpdate: metav1.NewTime(now.Add(-time.Hour)), Ready: true}),
+		hostSubnet("node3", nil),
+	)
+	status = getClusterSDNStatus(subnets, renewals, status.Conditions, now)
+	if status.Nodes != 5 || status.ReadyNodes != 2 {
+		t.Fatalf("unexpected status %#v", status)
+	}
+	expected := []degradedNodeStatus{
+		{Node: "node3", Reason: nodeSDNNoStatus},
+		{Node: "node4", Reason: nodeSDNStale, Message: "status last confirmed at " + now.Add(-time.Hour).UTC().Format(time.RFC3339)},
+		{Node: "node5", Reason: nodeSDNNotReady, Message: "cni-server: CNI server has not been started; ovs: could not connect to OVS"},
+	}
+	if !reflect.DeepEqual(status.DegradedNodes, expected) {
+		t.Fatalf("unexpected degraded nodes:\nexpected %#v\ngot %#v", expected, status.DegradedNodes)
+	}
+	condition := status.Conditions[0]
+	if condition.Status != metav1.ConditionTrue || condition.Reason != sdnDegradedReason || condition.Message != "3 of 5 nodes are not ready: node3, node4, node5" {
+		t.Fatalf("unexpected condition %#v", condition)
+	}
+
+	// The transition time only changes when the status does
+	subnets = subnets[:2]
+	status = getClusterSDNStatus(subnets, renewals, status.Conditions, now)
+	if status.Conditions[0].Status != metav1.ConditionFalse || status.Conditions[0].LastTransitionTime == transitionTime {
+		t.Fatalf("expected condition to transition, got %#v", status.Conditions[0])
+	}
+	transitionTime = status.Conditions[0].LastTransitionTime
+	status = getClusterSDNStatus(subnets, renewals, status.Conditions, now)
+	if status.Conditions[0].LastTransitionTime != transitionTime {
+		t.Fatalf("unexpected condition transition %#v", status.Conditions[0])
+	}
+}
@@ -0,0 +1,179 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	kcoreinformers "k8s.io/client-go/informers/core/v1"
+	kclientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	unidlingapi "github.com/openshift/api/unidling/v1alpha1"
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// serviceIdleController aggregates the service activity reported by the nodes (see
+// common.ServiceActivityLabel) and maintains common.LastActivityAnnotation and
+// common.IdleCandidateAnnotation on each Service, so that each Service is written
+// by a single controller rather than by every node.
+type serviceIdleController struct {
+	kClient         kclientset.Interface
+	serviceInformer kcoreinformers.ServiceInformer
+	recorder        record.EventRecorder
+
+	// period is how long a service must have had no new connections to become an
+	// idle candidate, and activityUpdateInterval is how often LastActivityAnnotation
+	// is updated while it has them
+	period                 time.Duration
+	activityUpdateInterval time.Duration
+
+	startedAt time.Time
+}
+
+// StartIdleDetection starts marking services that have had no new connections on
+// any node for period as idle candidates. It must be called before kubeInformers
+// is started.
+func (master *OsdnMaster) StartIdleDetection(kubeInformers informers.SharedInformerFactory, period time.Duration) {
+	sic := &serviceIdleController{
+		kClient:                master.kClient,
+		serviceInformer:        kubeInformers.Core().V1().Services(),
+		recorder:               master.recorder,
+		period:                 period,
+		activityUpdateInterval: common.IdleDetectionReportInterval(period),
+	}
+	sic.serviceInformer.Informer().GetController()
+	go sic.run()
+}
+
+func (sic *serviceIdleController) run() {
+	if !cache.WaitForCacheSync(utilwait.NeverStop, sic.serviceInformer.Informer().GetController().HasSynced) {
+		klog.Fatalf("failed to sync service informer for idle detection")
+	}
+	klog.Infof("Starting service idle detection with period %v", sic.period)
+	sic.startedAt = time.Now()
+	utilwait.Until(func() { sic.check(time.Now()) }, sic.activityUpdateInterval, utilwait.NeverStop)
+}
+
+// getServiceActivity returns the latest time that any node reported new
+// connections to each service, by common.ServiceActivityKey
+func (sic *serviceIdleController) getServiceActivity() (map[string]time.Time, error) {
+	configMaps, err := sic.kClient.CoreV1().ConfigMaps(common.NodeSDNLeaseNamespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: common.ServiceActivityLabel + "=true",
+	})
+	if err != nil {
+		return nil, err
+	}
+	activity := make(map[string]time.Time)
+	for _, cm := range configMaps.Items {
+		for key, value := range cm.Data {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				continue
+			}
+			if t.After(activity[key]) {
+				activity[key] = t
+			}
+		}
+	}
+	return activity, nil
+}
+
+func (sic *serviceIdleController) check(now time.Time) {
+	activity, err := sic.getServiceActivity()
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to get service activity for idle detection: %v", err))
+		return
+	}
+	services, err := sic.serviceInformer.Lister().List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to list services for idle detection: %v", err))
+		return
+	}
+	for _, service := range services {
+		annotations, candidate := sic.getAnnotationUpdate(service, activity[common.ServiceActivityKey(service.Namespace, service.Name)], now)
+		if annotations == nil {
+			continue
+		}
+		if err := sic.patchAnnotations(service, annotations); err != nil {
+			utilruntime.HandleError(fmt.Errorf("failed to update idle detection annotations on service %s/%s: %v", service.Namespace, service.Name, err))
+			continue
+		}
+		if candidate {
+			klog.V(2).Infof("Service %s/%s has had no new connections for %v; marking it as an idle candidate", service.Namespace, service.Name, sic.period)
+			sic.recorder.Eventf(service, corev1.EventTypeNormal, common.IdleCandidateReason, "Service has had no new connections for %v", sic.period)
+		}
+	}
+}
+
+// getAnnotationUpdate returns the annotations that need to be changed on service
+// (with a nil value for annotations to remove), given the latest time any node
+// reported new connections to it (or the zero time), or nil if nothing needs to
+// change. It also returns whether service has just become an idle candidate.
+func (sic *serviceIdleController) getAnnotationUpdate(service *corev1.Service, lastSeen time.Time, now time.Time) (map[string]interface{}, bool) {
+	if service.Spec.ClusterIP == "" || service.Spec.ClusterIP == corev1.ClusterIPNone {
+		return nil, false
+	}
+	if _, idled := service.Annotations[unidlingapi.IdledAtAnnotation]; idled {
+		// already idled; the unidler will notice any new connections
+		return nil, false
+	}
+
+	var lastActivity time.Time
+	if value, ok := service.Annotations[common.LastActivityAnnotation]; ok {
+		lastActivity, _ = time.Parse(time.RFC3339, value)
+	}
+	_, isCandidate := service.Annotations[common.IdleCandidateAnnotation]
+
+	if lastSeen.After(lastActivity) && (isCandidate || lastSeen.Sub(lastActivity) >= sic.activityUpdateInterval) {
+		return map[string]interface{}{
+			common.LastActivityAnnotation:  lastSeen.UTC().Format(time.RFC3339),
+			common.IdleCandidateAnnotation: nil,
+		}, false
+	}
+
+	if isCandidate {
+		return nil, false
+	}
+	if lastSeen.After(lastActivity) {
+		lastActivity = lastSeen
+	}
+	if lastActivity.IsZero() {
+		// We don't know when the service was last used, but it can't have been
+		// before it was created, and we can only vouch for the time since we
+		// started
+		lastActivity = service.CreationTimestamp.Time
+		if lastActivity.Before(sic.startedAt) {
+			lastActivity = sic.startedAt
+		}
+	}
+	if now.Sub(lastActivity) < sic.period {
+		return nil, false
+	}
+	return map[string]interface{}{
+		common.IdleCandidateAnnotation: now.UTC().Format(time.RFC3339),
+	}, true
+}
+
+func (sic *serviceIdleController) patchAnnotations(service *corev1.Service, annotations map[string]interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sic.kClient.CoreV1().Services(service.Namespace).Patch(context.TODO(), service.Name, ktypes.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
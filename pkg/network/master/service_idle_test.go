@@ -0,0 +1,147 @@
+package master
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	unidlingapi "github.com/openshift/api/unidling/v1alpha1"
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+func TestServiceIdleAnnotations(t *testing.T) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	sic := &serviceIdleController{
+		period:                 time.Hour,
+		activityUpdateInterval: common.IdleDetectionReportInterval(time.Hour),
+		startedAt:              start,
+	}
+
+	newService := func(annotations map[string]string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         "ns1",
+				Name:              "web",
+				CreationTimestamp: metav1.NewTime(start.Add(-24 * time.Hour)),
+				Annotations:       annotations,
+			},
+			Spec: corev1.ServiceSpec{ClusterIP: "172.30.0.10"},
+		}
+	}
+
+	testcases := []struct {
+		name        string
+		service     *corev1.Service
+		lastSeen    time.Time
+		now         time.Time
+		expected    map[string]interface{}
+		isCandidate bool
+	}{
+		{
+			name:     "active with no annotation",
+			service:  newService(nil),
+			lastSeen: start.Add(time.Minute),
+			now:      start.Add(time.Minute),
+			expected: map[string]interface{}{common.LastActivityAnnotation: "2021-06-01T12:01:00Z", common.IdleCandidateAnnotation: nil},
+		},
+		{
+			name:     "active with recent annotation",
+			service:  newService(map[string]string{common.LastActivityAnnotation: "2021-06-01T12:00:00Z"}),
+			lastSeen: start.Add(time.Minute),
+			now:      start.Add(time.Minute),
+		},
+		{
+			name:     "active with old annotation",
+			service:  newService(map[string]string{common.LastActivityAnnotation: "2021-06-01T12:00:00Z"}),
+			lastSeen: start.Add(10 * time.Minute),
+			now:      start.Add(10 * time.Minute),
+			expected: map[string]interface{}{common.LastActivityAnnotation: "2021-06-01T12:10:00Z", common.IdleCandidateAnnotation: nil},
+		},
+		{
+			name:     "active idle candidate",
+			service:  newService(map[string]string{common.LastActivityAnnotation: "2021-06-01T12:00:00Z", common.IdleCandidateAnnotation: "2021-06-01T13:00:00Z"}),
+			lastSeen: start.Add(65 * time.Minute),
+			now:      start.Add(65 * time.Minute),
+			expected: map[string]interface{}{common.LastActivityAnnotation: "2021-06-01T13:05:00Z", common.IdleCandidateAnnotation: nil},
+		},
+		{
+			name:    "recently active elsewhere",
+			service: newService(map[string]string{common.LastActivityAnnotation: "2021-06-01T12:30:00Z"}),
+			now:     start.Add(time.Hour),
+		},
+		{
+			name:     "recently active, annotation not yet updated",
+			service:  newService(map[string]string{common.LastActivityAnnotation: "2021-06-01T12:00:00Z"}),
+			lastSeen: start.Add(3 * time.Minute),
+			now:      start.Add(time.Hour),
+		},
+		{
+			name:        "quiet for the period",
+			service:     newService(map[string]string{common.LastActivityAnnotation: "2021-06-01T12:00:00Z"}),
+			now:         start.Add(time.Hour),
+			expected:    map[string]interface{}{common.IdleCandidateAnnotation: "2021-06-01T13:00:00Z"},
+			isCandidate: true,
+		},
+		{
+			name:    "already a candidate",
+			service: newService(map[string]string{common.LastActivityAnnotation: "2021-06-01T12:00:00Z", common.IdleCandidateAnnotation: "2021-06-01T13:00:00Z"}),
+			now:     start.Add(2 * time.Hour),
+		},
+		{
+			name:    "no annotation, not quiet since startup",
+			service: newService(nil),
+			now:     start.Add(30 * time.Minute),
+		},
+		{
+			name:        "no annotation, quiet since startup",
+			service:     newService(nil),
+			now:         start.Add(time.Hour),
+			expected:    map[string]interface{}{common.IdleCandidateAnnotation: "2021-06-01T13:00:00Z"},
+			isCandidate: true,
+		},
+		{
+			name:    "already idled",
+			service: newService(map[string]string{unidlingapi.IdledAtAnnotation: "2021-06-01T11:00:00Z"}),
+			now:     start.Add(2 * time.Hour),
+		},
+	}
+	for _, tc := range testcases {
+		annotations, isCandidate := sic.getAnnotationUpdate(tc.service, tc.lastSeen, tc.now)
+		if !reflect.DeepEqual(annotations, tc.expected) || isCandidate != tc.isCandidate {
+			t.Fatalf("%s: expected %v/%v, got %v/%v", tc.name, tc.expected, tc.isCandidate, annotations, isCandidate)
+		}
+	}
+}
+
+func TestServiceActivityAggregation(t *testing.T) {
+	activityConfigMap := func(node string, data map[string]string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: common.NodeSDNLeaseNamespace,
+				Name:      common.ServiceActivityConfigMapName(node),
+				Labels:    map[string]string{common.ServiceActivityLabel: "true"},
+			},
+			Data: data,
+		}
+	}
+	kClient := fake.NewSimpleClientset(
+		activityConfigMap("node1", map[string]string{"ns1.web": "2021-06-01T12:00:00Z", "ns2.dns": "2021-06-01T12:30:00Z"}),
+		activityConfigMap("node2", map[string]string{"ns1.web": "2021-06-01T12:10:00Z", "ns2.dns": "bad"}),
+	)
+	sic := &serviceIdleController{kClient: kClient}
+	activity, err := sic.getServiceActivity()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]time.Time{
+		"ns1.web": time.Date(2021, 6, 1, 12, 10, 0, 0, time.UTC),
+		"ns2.dns": time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(activity, expected) {
+		t.Fatalf("expected %v, got %v", expected, activity)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	kerrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ktypes "k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/util/retry"
@@ -19,6 +20,13 @@ import (
 	masterutil "github.com/openshift/sdn/pkg/network/master/util"
 )
 
+// HostSubnetLengthAnnotation can be set on a Node (or on a HostSubnet created with
+// AssignHostSubnetAnnotation) to request a subnet with a different number of host
+// bits than the ClusterNetwork's hostSubnetLength. It is only honored when the
+// HostSubnet is first created. In dual-stack clusters, the node's IPv6 subnet is
+// given the same number of host bits more or fewer than the IPv6 default.
+const HostSubnetLengthAnnotation = "network.openshift.io/host-subnet-length"
+
 func (master *OsdnMaster) startSubnetMaster() error {
 	master.subnetAllocator = masterutil.NewSubnetAllocator()
 	for _, cn := range master.networkInfo.ClusterNetworks {
@@ -28,6 +36,16 @@ func (master *OsdnMaster) startSubnetMaster() error {
 		}
 	}
 
+	if len(master.networkInfo.IPv6ClusterNetworks) > 0 {
+		master.subnetAllocatorV6 = masterutil.NewSubnetAllocator()
+		for _, cn := range master.networkInfo.IPv6ClusterNetworks {
+			err := master.subnetAllocatorV6.AddNetworkRange(cn.ClusterCIDR.String(), cn.HostSubnetLength)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	// Populate subnet allocator
 	subnets, err := master.osdnClient.NetworkV1().HostSubnets().List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
@@ -37,10 +55,16 @@ func (master *OsdnMaster) startSubnetMaster() error {
 		if err := master.subnetAllocator.MarkAllocatedNetwork(sn.Subnet); err != nil {
 			utilruntime.HandleError(err)
 		}
+		if subnetV6, ok := sn.Annotations[common.HostSubnetIPv6Annotation]; ok && master.subnetAllocatorV6 != nil {
+			if err := master.subnetAllocatorV6.MarkAllocatedNetwork(subnetV6); err != nil {
+				utilruntime.HandleError(err)
+			}
+		}
 	}
 
 	master.watchNodes()
 	master.watchSubnets()
+	master.startHostSubnetGC()
 
 	return nil
 }
@@ -60,14 +84,18 @@ func (master *OsdnMaster) handleAddOrUpdateNode(obj, _ interface{}, eventType wa
 	}
 
 	if oldNodeIP, ok := master.hostSubnetNodeIPs[node.UID]; ok && (nodeIP == oldNodeIP) {
-		return
+		// Re-create the HostSubnet if it has been deleted (eg, to move the node
+		// to a different clusterNetwork)
+		if _, err := master.hostSubnetInformer.Lister().Get(node.Name); err == nil || !kerrs.IsNotFound(err) {
+			return
+		}
 	}
 	// Node status is frequently updated by kubelet, so log only if the above condition is not met
 	klog.V(5).Infof("Watch %s event for Node %q", eventType, node.Name)
 
 	master.clearInitialNodeNetworkUnavailableCondition(node)
 
-	usedNodeIP, err := master.addNode(node.Name, string(node.UID), nodeIP, nil)
+	usedNodeIP, err := master.addNode(node.Name, string(node.UID), nodeIP, nil, hostSubnetLengthOverride(node.Name, node.Annotations))
 	if err != nil {
 		utilruntime.HandleError(fmt.Errorf("Error creating subnet for node %s, ip %s: %v", node.Name, nodeIP, err))
 		return
@@ -91,12 +119,28 @@ func (master *OsdnMaster) handleDeleteNode(obj interface{}) {
 	}
 }
 
-// addNode takes the nodeName, a preferred nodeIP and the node's annotations
+// hostSubnetLengthOverride returns the number of host bits requested by
+// HostSubnetLengthAnnotation in annotations, or 0 if there is no (valid) request.
+func hostSubnetLengthOverride(name string, annotations map[string]string) uint32 {
+	value, ok := annotations[HostSubnetLengthAnnotation]
+	if !ok {
+		return 0
+	}
+	hostBits, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || hostBits < 2 || hostBits > 31 {
+		utilruntime.HandleError(fmt.Errorf("%q is an invalid value for annotation %s on %q; using the default host subnet length", value, HostSubnetLengthAnnotation, name))
+		return 0
+	}
+	return uint32(hostBits)
+}
+
+// addNode takes the nodeName, a preferred nodeIP, the node's annotations and the
+// requested number of host bits (0 for the cluster default).
 // Creates or updates a HostSubnet if needed
 // Returns the IP address used for hostsubnet (either the preferred or one from the otherValidAddresses) and any error
-func (master *OsdnMaster) addNode(nodeName string, nodeUID string, nodeIP string, hsAnnotations map[string]string) (string, error) {
+func (master *OsdnMaster) addNode(nodeName string, nodeUID string, nodeIP string, hsAnnotations map[string]string, hostBits uint32) (string, error) {
 	// Validate node IP before proceeding
-	if err := master.networkInfo.ValidateNodeIP(nodeIP); err != nil {
+	if err := master.getNetworkInfo().ValidateNodeIP(nodeIP); err != nil {
 		return "", err
 	}
 
@@ -107,16 +151,28 @@ func (master *OsdnMaster) addNode(nodeName string, nodeUID string, nodeIP string
 			utilruntime.HandleError(fmt.Errorf("Deleting invalid HostSubnet %q: %v", nodeName, err))
 			_ = master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), nodeName, metav1.DeleteOptions{})
 			// fall through to create new subnet below
-		} else if sub.HostIP == nodeIP {
+		} else if sub.HostIP == nodeIP && !master.needsIPv6Subnet(sub) {
 			return nodeIP, nil
 		} else {
-			// Node IP changed, update old subnet
+			// Node IP changed, or the cluster became dual-stack; update old subnet.
+			// Other nodes will update their flows for the node when they see the
+			// change, and the node itself switches to the new IP.
+			oldNodeIP := sub.HostIP
 			sub.HostIP = nodeIP
-			sub, err = master.osdnClient.NetworkV1().HostSubnets().Update(context.TODO(), sub, metav1.UpdateOptions{})
+			networkV6, err := master.allocateIPv6Subnet(sub)
+			if err != nil {
+				return "", fmt.Errorf("error allocating IPv6 network for node %s: %v", nodeName, err)
+			}
+			updated, err := master.osdnClient.NetworkV1().HostSubnets().Update(context.TODO(), sub, metav1.UpdateOptions{})
 			if err != nil {
+				master.releaseIPv6Subnet(networkV6)
 				return "", fmt.Errorf("error updating subnet %s for node %s: %v", sub.Subnet, nodeName, err)
 			}
-			klog.Infof("Updated HostSubnet %s", common.HostSubnetToString(sub))
+			klog.Infof("Updated HostSubnet %s", common.HostSubnetToString(updated))
+			if oldNodeIP != nodeIP && len(nodeUID) != 0 {
+				master.recorder.Eventf(&corev1.ObjectReference{Kind: "Node", Name: nodeName, UID: ktypes.UID(nodeUID)},
+					corev1.EventTypeNormal, "HostSubnetIPChanged", "Updated HostSubnet IP from %s to %s", oldNodeIP, nodeIP)
+			}
 			return nodeIP, nil
 		}
 	}
@@ -128,8 +184,17 @@ func (master *OsdnMaster) addNode(nodeName string, nodeUID string, nodeIP string
 		}
 		hsAnnotations[osdnv1.NodeUIDAnnotation] = nodeUID
 	}
-	network, err := master.subnetAllocator.AllocateNetwork()
+	var network string
+	if hostBits != 0 {
+		network, err = master.subnetAllocator.AllocateNetworkWithHostBits(hostBits)
+	} else {
+		network, err = master.subnetAllocator.AllocateNetwork()
+	}
 	if err != nil {
+		if len(nodeUID) != 0 {
+			master.recorder.Eventf(&corev1.ObjectReference{Kind: "Node", Name: nodeName, UID: ktypes.UID(nodeUID)},
+				corev1.EventTypeWarning, "HostSubnetAllocationFailed", "Could not allocate a HostSubnet: %v", err)
+		}
 		return "", fmt.Errorf("error allocating network for node %s: %v", nodeName, err)
 	}
 	sub = &osdnv1.HostSubnet{
@@ -139,17 +204,69 @@ func (master *OsdnMaster) addNode(nodeName string, nodeUID string, nodeIP string
 		HostIP:     nodeIP,
 		Subnet:     network,
 	}
+	networkV6, err := master.allocateIPv6Subnet(sub)
+	if err != nil {
+		if er := master.subnetAllocator.ReleaseNetwork(network); er != nil {
+			utilruntime.HandleError(er)
+		}
+		return "", fmt.Errorf("error allocating IPv6 network for node %s: %v", nodeName, err)
+	}
 	sub, err = master.osdnClient.NetworkV1().HostSubnets().Create(context.TODO(), sub, metav1.CreateOptions{})
 	if err != nil {
 		if er := master.subnetAllocator.ReleaseNetwork(network); er != nil {
 			utilruntime.HandleError(er)
 		}
+		master.releaseIPv6Subnet(networkV6)
 		return "", fmt.Errorf("error allocating subnet for node %q: %v", nodeName, err)
 	}
 	klog.Infof("Created HostSubnet %s", common.HostSubnetToString(sub))
 	return nodeIP, nil
 }
 
+// needsIPv6Subnet returns whether hs needs to be allocated an IPv6 subnet
+func (master *OsdnMaster) needsIPv6Subnet(hs *osdnv1.HostSubnet) bool {
+	_, hasIPv6 := hs.Annotations[common.HostSubnetIPv6Annotation]
+	return master.subnetAllocatorV6 != nil && !hasIPv6
+}
+
+// allocateIPv6Subnet allocates an IPv6 subnet for hs and records it in hs's
+// annotations, if needed. The subnet is larger or smaller than the default in the
+// same proportion as hs's IPv4 subnet (see HostSubnetLengthAnnotation). It returns
+// the allocated subnet, if any.
+func (master *OsdnMaster) allocateIPv6Subnet(hs *osdnv1.HostSubnet) (string, error) {
+	if !master.needsIPv6Subnet(hs) {
+		return "", nil
+	}
+	delta, err := master.subnetAllocator.HostBitsDelta(hs.Subnet)
+	if err != nil {
+		// Not in a current clusterNetwork; just use the default size
+		delta = 0
+	}
+	var networkV6 string
+	if delta != 0 {
+		networkV6, err = master.subnetAllocatorV6.AllocateNetworkWithHostBitsDelta(delta)
+	} else {
+		networkV6, err = master.subnetAllocatorV6.AllocateNetwork()
+	}
+	if err != nil {
+		return "", err
+	}
+	if hs.Annotations == nil {
+		hs.Annotations = make(map[string]string)
+	}
+	hs.Annotations[common.HostSubnetIPv6Annotation] = networkV6
+	return networkV6, nil
+}
+
+func (master *OsdnMaster) releaseIPv6Subnet(networkV6 string) {
+	if networkV6 == "" || master.subnetAllocatorV6 == nil {
+		return
+	}
+	if err := master.subnetAllocatorV6.ReleaseNetwork(networkV6); err != nil {
+		utilruntime.HandleError(err)
+	}
+}
+
 func (master *OsdnMaster) deleteNode(nodeName string) error {
 	subInfo := nodeName
 	// If create and delete events for the same node are called in quick succession,
@@ -228,7 +345,7 @@ func (master *OsdnMaster) watchSubnets() {
 	master.hostSubnetInformer.Informer().AddEventHandler(funcs)
 }
 
-func (master *OsdnMaster) handleAddOrUpdateSubnet(obj, _ interface{}, eventType watch.EventType) {
+func (master *OsdnMaster) handleAddOrUpdateSubnet(obj, oldObj interface{}, eventType watch.EventType) {
 	hs := obj.(*osdnv1.HostSubnet)
 	klog.V(5).Infof("Watch %s event for HostSubnet %q", eventType, hs.Name)
 
@@ -237,10 +354,17 @@ func (master *OsdnMaster) handleAddOrUpdateSubnet(obj, _ interface{}, eventType
 		return
 	}
 
+	master.checkDuplicateHostIPs(hs.HostIP)
+	if oldObj != nil {
+		if oldHS := oldObj.(*osdnv1.HostSubnet); oldHS.HostIP != hs.HostIP {
+			master.checkDuplicateHostIPs(oldHS.HostIP)
+		}
+	}
+
 	if err := master.reconcileHostSubnet(hs); err != nil {
 		utilruntime.HandleError(err)
 	}
-	if err := master.networkInfo.ValidateNodeIP(hs.HostIP); err != nil {
+	if err := master.getNetworkInfo().ValidateNodeIP(hs.HostIP); err != nil {
 		// Don't error out; just warn so the error can be corrected with 'oc'
 		utilruntime.HandleError(fmt.Errorf("Failed to validate HostSubnet %s: %v", common.HostSubnetToString(hs), err))
 	}
@@ -257,6 +381,8 @@ func (master *OsdnMaster) handleDeleteSubnet(obj interface{}) {
 	hs := obj.(*osdnv1.HostSubnet)
 	klog.V(5).Infof("Watch %s event for HostSubnet %q", watch.Deleted, hs.Name)
 
+	master.checkDuplicateHostIPs(hs.HostIP)
+
 	if _, ok := hs.Annotations[osdnv1.AssignHostSubnetAnnotation]; ok {
 		return
 	}
@@ -264,6 +390,7 @@ func (master *OsdnMaster) handleDeleteSubnet(obj interface{}) {
 	if err := master.subnetAllocator.ReleaseNetwork(hs.Subnet); err != nil {
 		utilruntime.HandleError(err)
 	}
+	master.releaseIPv6Subnet(hs.Annotations[common.HostSubnetIPv6Annotation])
 }
 
 // reconcileHostSubnet verifies and corrects the state of the hostsubnet.
@@ -298,11 +425,9 @@ func (master *OsdnMaster) reconcileHostSubnet(subnet *osdnv1.HostSubnet) error {
 			return fmt.Errorf("error updating subnet %v for node %s: %v", sn, sn.Name, err)
 		}
 	} else if node == nil && len(subnet.Annotations[osdnv1.NodeUIDAnnotation]) > 0 {
-		// Missed Node event, delete stale subnet.
-		klog.Infof("Setup found no node associated with hostsubnet %s, deleting the hostsubnet", subnet.Name)
-		if err = master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), subnet.Name, metav1.DeleteOptions{}); err != nil {
-			return fmt.Errorf("error deleting subnet %v: %v", subnet, err)
-		}
+		// Missed Node event; the stale subnet will be deleted by the HostSubnet GC
+		// once its grace period expires.
+		klog.V(2).Infof("Found no node associated with hostsubnet %s", subnet.Name)
 	} else if string(node.UID) != subnet.Annotations[osdnv1.NodeUIDAnnotation] {
 		// Missed Node event, node with the same name exists delete stale subnet.
 		klog.Infof("Missed node event, hostsubnet %s has the UID of an incorrect object, deleting the hostsubnet", subnet.Name)
@@ -337,7 +462,15 @@ func (master *OsdnMaster) handleAssignHostSubnetAnnotation(hs *osdnv1.HostSubnet
 		}
 	}
 
-	if _, err := master.addNode(hs.Name, "", hs.HostIP, hsAnnotations); err != nil {
+	hostBits := hostSubnetLengthOverride(hs.Name, hs.Annotations)
+	if hostBits != 0 {
+		if hsAnnotations == nil {
+			hsAnnotations = make(map[string]string)
+		}
+		hsAnnotations[HostSubnetLengthAnnotation] = hs.Annotations[HostSubnetLengthAnnotation]
+	}
+
+	if _, err := master.addNode(hs.Name, "", hs.HostIP, hsAnnotations, hostBits); err != nil {
 		return fmt.Errorf("error creating subnet: %s, %v", hs.Name, err)
 	}
 	klog.Infof("Created HostSubnet not backed by node: %s", common.HostSubnetToString(hs))
@@ -2,7 +2,9 @@ package util
 
 import (
 	"fmt"
+	"math/big"
 	"net"
+	"sort"
 	"sync"
 )
 
@@ -34,6 +36,104 @@ func (sna *SubnetAllocator) AddNetworkRange(network string, hostBits uint32) err
 	return nil
 }
 
+// HasNetworkRange returns whether network has been added with AddNetworkRange
+func (sna *SubnetAllocator) HasNetworkRange(network string) bool {
+	sna.Lock()
+	defer sna.Unlock()
+
+	return sna.findRange(network) != nil
+}
+
+// NetworkRanges returns the CIDRs of all of the allocator's ranges
+func (sna *SubnetAllocator) NetworkRanges() []string {
+	sna.Lock()
+	defer sna.Unlock()
+
+	networks := make([]string, 0, len(sna.ranges))
+	for _, snr := range sna.ranges {
+		networks = append(networks, snr.network.String())
+	}
+	return networks
+}
+
+// SetNetworkRangeDraining sets whether new subnets can be allocated from network.
+// Subnets in a draining range can still be marked as allocated and released.
+func (sna *SubnetAllocator) SetNetworkRangeDraining(network string, draining bool) error {
+	sna.Lock()
+	defer sna.Unlock()
+
+	snr := sna.findRange(network)
+	if snr == nil {
+		return fmt.Errorf("network %s is not a known range", network)
+	}
+	snr.draining = draining
+	return nil
+}
+
+// RemoveNetworkRange removes network from the allocator. It fails if any subnets
+// are still allocated from it.
+func (sna *SubnetAllocator) RemoveNetworkRange(network string) error {
+	sna.Lock()
+	defer sna.Unlock()
+
+	snr := sna.findRange(network)
+	if snr == nil {
+		return fmt.Errorf("network %s is not a known range", network)
+	}
+	for _, allocated := range snr.allocMap {
+		if allocated {
+			return fmt.Errorf("network %s still has allocated subnets", network)
+		}
+	}
+	for i := range sna.ranges {
+		if sna.ranges[i] == snr {
+			sna.ranges = append(sna.ranges[:i], sna.ranges[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// NetworkRangeUsage describes how many of a range's default-sized subnets are in use
+type NetworkRangeUsage struct {
+	Network   string
+	Draining  bool
+	Allocated uint64
+	Total     uint64
+}
+
+// Usage returns the usage of each of the allocator's ranges. A default-sized subnet
+// that has been split into smaller subnets counts as allocated.
+func (sna *SubnetAllocator) Usage() []NetworkRangeUsage {
+	sna.Lock()
+	defer sna.Unlock()
+
+	usage := make([]NetworkRangeUsage, 0, len(sna.ranges))
+	for _, snr := range sna.ranges {
+		u := NetworkRangeUsage{Network: snr.network.String(), Draining: snr.draining, Total: snr.numSubnets()}
+		for _, allocated := range snr.allocMap {
+			if allocated {
+				u.Allocated++
+			}
+		}
+		usage = append(usage, u)
+	}
+	return usage
+}
+
+func (sna *SubnetAllocator) findRange(network string) *subnetAllocatorRange {
+	_, ipnet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil
+	}
+	for _, snr := range sna.ranges {
+		if snr.network.String() == ipnet.String() {
+			return snr
+		}
+	}
+	return nil
+}
+
 func (sna *SubnetAllocator) MarkAllocatedNetwork(subnet string) error {
 	sna.Lock()
 	defer sna.Unlock()
@@ -43,8 +143,8 @@ func (sna *SubnetAllocator) MarkAllocatedNetwork(subnet string) error {
 		return err
 	}
 	for _, snr := range sna.ranges {
-		if snr.markAllocatedNetwork(ipnet) {
-			return nil
+		if ok, err := snr.markAllocatedNetwork(ipnet); ok || err != nil {
+			return err
 		}
 	}
 	return fmt.Errorf("network %s does not belong to any known range", subnet)
@@ -55,6 +155,9 @@ func (sna *SubnetAllocator) AllocateNetwork() (string, error) {
 	defer sna.Unlock()
 
 	for _, snr := range sna.ranges {
+		if snr.draining {
+			continue
+		}
 		sn := snr.allocateNetwork()
 		if sn != nil {
 			return sn.String(), nil
@@ -63,6 +166,73 @@ func (sna *SubnetAllocator) AllocateNetwork() (string, error) {
 	return "", ErrSubnetAllocatorFull
 }
 
+// AllocateNetworkWithHostBits is like AllocateNetwork, but allocates a subnet with
+// hostBits host bits, rather than the default for the range it is allocated from.
+// Subnets larger than the default are made up of several adjacent default-sized
+// subnets; smaller ones are carved out of a single default-sized subnet.
+func (sna *SubnetAllocator) AllocateNetworkWithHostBits(hostBits uint32) (string, error) {
+	sna.Lock()
+	defer sna.Unlock()
+
+	for _, snr := range sna.ranges {
+		if snr.draining {
+			continue
+		}
+		sn, err := snr.allocateNetworkWithHostBits(hostBits)
+		if err != nil {
+			return "", err
+		} else if sn != nil {
+			return sn.String(), nil
+		}
+	}
+	return "", ErrSubnetAllocatorFull
+}
+
+// AllocateNetworkWithHostBitsDelta is like AllocateNetworkWithHostBits, but the
+// number of host bits is relative to each range's default (eg, 2 for a subnet 4
+// times as large as the default), so it can be used with ranges of different
+// address families.
+func (sna *SubnetAllocator) AllocateNetworkWithHostBitsDelta(delta int) (string, error) {
+	sna.Lock()
+	defer sna.Unlock()
+
+	for _, snr := range sna.ranges {
+		if snr.draining {
+			continue
+		}
+		hostBits := int(snr.hostBits) + delta
+		if hostBits <= 0 {
+			continue
+		}
+		sn, err := snr.allocateNetworkWithHostBits(uint32(hostBits))
+		if err != nil {
+			return "", err
+		} else if sn != nil {
+			return sn.String(), nil
+		}
+	}
+	return "", ErrSubnetAllocatorFull
+}
+
+// HostBitsDelta returns the difference between the number of host bits of subnet
+// and the default for the range it belongs to
+func (sna *SubnetAllocator) HostBitsDelta(subnet string) (int, error) {
+	sna.Lock()
+	defer sna.Unlock()
+
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return 0, err
+	}
+	for _, snr := range sna.ranges {
+		if snr.network.Contains(ipnet.IP) {
+			prefixLen, _ := ipnet.Mask.Size()
+			return snr.defaultPrefixLen() - prefixLen, nil
+		}
+	}
+	return 0, fmt.Errorf("network %s does not belong to any known range", subnet)
+}
+
 func (sna *SubnetAllocator) ReleaseNetwork(subnet string) error {
 	sna.Lock()
 	defer sna.Unlock()
@@ -72,8 +242,8 @@ func (sna *SubnetAllocator) ReleaseNetwork(subnet string) error {
 		return err
 	}
 	for _, snr := range sna.ranges {
-		if snr.releaseNetwork(ipnet) {
-			return nil
+		if ok, err := snr.releaseNetwork(ipnet); ok || err != nil {
+			return err
 		}
 	}
 	return fmt.Errorf("network %s does not belong to any known range", subnet)
@@ -87,6 +257,13 @@ type subnetAllocatorRange struct {
 	next       uint32
 	allocMap   map[string]bool
 
+	// draining is set when no new subnets should be allocated from the range
+	draining bool
+
+	// partial maps default-sized subnets that have been split into smaller subnets
+	// to the set of smaller subnets allocated from them
+	partial map[string]map[string]*net.IPNet
+
 	// IPv4-only address-alignment hackery; see below
 	leftShift  uint32
 	leftMask   uint32
@@ -109,6 +286,7 @@ func newSubnetAllocatorRange(network *net.IPNet, hostBits uint32) (*subnetAlloca
 		subnetBits: subnetBits,
 		next:       0,
 		allocMap:   make(map[string]bool),
+		partial:    make(map[string]map[string]*net.IPNet),
 	}
 
 	// In the simple case, the subnet part of the 32-bit IP address is just the subnet
@@ -144,26 +322,192 @@ func newSubnetAllocatorRange(network *net.IPNet, hostBits uint32) (*subnetAlloca
 
 // markAllocatedNetwork marks network as being in use, if it is part of snr's range.
 // It returns whether the network was in snr's range.
-func (snr *subnetAllocatorRange) markAllocatedNetwork(network *net.IPNet) bool {
-	str := network.String()
-	if snr.network.Contains(network.IP) {
-		snr.allocMap[str] = true
+func (snr *subnetAllocatorRange) markAllocatedNetwork(network *net.IPNet) (bool, error) {
+	if !snr.network.Contains(network.IP) {
+		return false, nil
 	}
-	return snr.allocMap[str]
+
+	prefixLen, _ := network.Mask.Size()
+	switch defaultLen := snr.defaultPrefixLen(); {
+	case prefixLen < defaultLen:
+		subnets, err := subnetsWithin(network, defaultLen)
+		if err != nil {
+			return true, err
+		}
+		for _, sn := range subnets {
+			snr.allocMap[sn.String()] = true
+		}
+	case prefixLen > defaultLen:
+		container := containingSubnet(network, defaultLen)
+		snr.allocMap[container.String()] = true
+		if snr.partial[container.String()] == nil {
+			snr.partial[container.String()] = make(map[string]*net.IPNet)
+		}
+		snr.partial[container.String()][network.String()] = network
+	default:
+		snr.allocMap[network.String()] = true
+	}
+	return true, nil
+}
+
+// defaultPrefixLen returns the prefix length of snr's default-sized subnets
+func (snr *subnetAllocatorRange) defaultPrefixLen() int {
+	_, addrLen := snr.network.Mask.Size()
+	return addrLen - int(snr.hostBits)
+}
+
+// maxSubnetsWithinBits limits the number of subnets subnetsWithin will return (and
+// so how far a subnet's size can be from the default) to 1<<maxSubnetsWithinBits
+const maxSubnetsWithinBits = 16
+
+// subnetsWithin returns all of the subnets of network with the given prefix length,
+// in order. It returns an error if there would be more than 1<<maxSubnetsWithinBits
+// of them.
+func subnetsWithin(network *net.IPNet, prefixLen int) ([]*net.IPNet, error) {
+	netPrefixLen, addrLen := network.Mask.Size()
+	if prefixLen < netPrefixLen || prefixLen > addrLen {
+		return nil, fmt.Errorf("cannot divide %s into /%d subnets", network.String(), prefixLen)
+	}
+	if prefixLen-netPrefixLen > maxSubnetsWithinBits {
+		return nil, fmt.Errorf("cannot divide %s into /%d subnets: too many subnets", network.String(), prefixLen)
+	}
+	subnets := make([]*net.IPNet, 0, 1<<uint(prefixLen-netPrefixLen))
+	walkSubnetsWithin(network, prefixLen, func(sn *net.IPNet) bool {
+		subnets = append(subnets, sn)
+		return true
+	})
+	return subnets, nil
+}
+
+// walkSubnetsWithin calls f on each of the subnets of network with the given prefix
+// length (which must not be shorter than network's), in order, until f returns false
+func walkSubnetsWithin(network *net.IPNet, prefixLen int, f func(*net.IPNet) bool) {
+	netPrefixLen, addrLen := network.Mask.Size()
+	base := new(big.Int).SetBytes(network.IP.Mask(network.Mask))
+	step := new(big.Int).Lsh(big.NewInt(1), uint(addrLen-prefixLen))
+	count := new(big.Int).Lsh(big.NewInt(1), uint(prefixLen-netPrefixLen))
+	one := big.NewInt(1)
+	for i := new(big.Int); i.Cmp(count) < 0; i.Add(i, one) {
+		ip := make(net.IP, addrLen/8)
+		base.FillBytes(ip)
+		if !f(&net.IPNet{IP: ip, Mask: net.CIDRMask(prefixLen, addrLen)}) {
+			return
+		}
+		base.Add(base, step)
+	}
+}
+
+// containingSubnet returns the subnet with the given prefix length that contains network
+func containingSubnet(network *net.IPNet, prefixLen int) *net.IPNet {
+	_, addrLen := network.Mask.Size()
+	mask := net.CIDRMask(prefixLen, addrLen)
+	return &net.IPNet{IP: network.IP.Mask(mask), Mask: mask}
+}
+
+// allocateNetworkWithHostBits returns a new subnet with hostBits host bits, or nil if
+// there is no room for one. It returns an error if hostBits is too far from snr's
+// default to be handled.
+func (snr *subnetAllocatorRange) allocateNetworkWithHostBits(hostBits uint32) (*net.IPNet, error) {
+	netPrefixLen, addrLen := snr.network.Mask.Size()
+	prefixLen := addrLen - int(hostBits)
+	defaultLen := snr.defaultPrefixLen()
+
+	switch {
+	case hostBits == 0 || prefixLen < netPrefixLen:
+		return nil, nil
+
+	case prefixLen < defaultLen:
+		if defaultLen-prefixLen > maxSubnetsWithinBits {
+			return nil, fmt.Errorf("cannot allocate a /%d subnet from %s: too large compared to the default /%d", prefixLen, snr.network.String(), defaultLen)
+		}
+		// Find an aligned block of default-sized subnets that are all free. Each
+		// block that we skip contains an allocated subnet, so this examines at
+		// most len(snr.allocMap)+1 blocks, however large the range is.
+		var found *net.IPNet
+		var err error
+		walkSubnetsWithin(snr.network, prefixLen, func(block *net.IPNet) bool {
+			var subnets []*net.IPNet
+			subnets, err = subnetsWithin(block, defaultLen)
+			if err != nil {
+				return false
+			}
+			for _, sn := range subnets {
+				if snr.allocMap[sn.String()] {
+					return true
+				}
+			}
+			for _, sn := range subnets {
+				snr.allocMap[sn.String()] = true
+			}
+			found = block
+			return false
+		})
+		return found, err
+
+	case prefixLen > defaultLen:
+		if prefixLen-defaultLen > maxSubnetsWithinBits {
+			return nil, fmt.Errorf("cannot allocate a /%d subnet from %s: too small compared to the default /%d", prefixLen, snr.network.String(), defaultLen)
+		}
+		// Try to fit it into an already-split subnet first
+		containers := make([]string, 0, len(snr.partial))
+		for container := range snr.partial {
+			containers = append(containers, container)
+		}
+		sort.Strings(containers)
+		for _, container := range containers {
+			allocated := snr.partial[container]
+			_, containerNet, _ := net.ParseCIDR(container)
+			candidates, err := subnetsWithin(containerNet, prefixLen)
+			if err != nil {
+				return nil, err
+			}
+			for _, candidate := range candidates {
+				overlaps := false
+				for _, sn := range allocated {
+					if sn.Contains(candidate.IP) || candidate.Contains(sn.IP) {
+						overlaps = true
+						break
+					}
+				}
+				if !overlaps {
+					allocated[candidate.String()] = candidate
+					return candidate, nil
+				}
+			}
+		}
+
+		container := snr.allocateNetwork()
+		if container == nil {
+			return nil, nil
+		}
+		sn := &net.IPNet{IP: container.IP, Mask: net.CIDRMask(prefixLen, addrLen)}
+		snr.partial[container.String()] = map[string]*net.IPNet{sn.String(): sn}
+		return sn, nil
+
+	default:
+		return snr.allocateNetwork(), nil
+	}
+}
+
+// numSubnets returns the number of default-sized subnets that can be allocated
+// from snr
+func (snr *subnetAllocatorRange) numSubnets() uint64 {
+	if snr.subnetBits > 24 {
+		// We need to make sure that the uint32 math in allocateNetwork won't
+		// overflow. If snr.subnetBits > 32 then 1<<subnetBits would overflow, but
+		// also if numSubnets is between 1<<24 and 1<<32 then
+		// "base << (snr.hostBits % 8)" could overflow if snr.hostBits%8 is non-0.
+		// So we cap numSubnets at 1<<24. "16M subnets ought to be enough for
+		// anybody."
+		return 1 << 24
+	}
+	return 1 << snr.subnetBits
 }
 
 // allocateNetwork returns a new subnet, or nil if the range is full
 func (snr *subnetAllocatorRange) allocateNetwork() *net.IPNet {
 	netMaskSize, addrLen := snr.network.Mask.Size()
-	numSubnets := uint32(1) << snr.subnetBits
-	if snr.subnetBits > 24 {
-		// We need to make sure that the uint32 math below won't overflow. If
-		// snr.subnetBits > 32 then numSubnets has already overflowed, but also if
-		// numSubnets is between 1<<24 and 1<<32 then "base << (snr.hostBits % 8)"
-		// below could overflow if snr.hostBits%8 is non-0. So we cap numSubnets
-		// at 1<<24. "16M subnets ought to be enough for anybody."
-		numSubnets = 1 << 24
-	}
+	numSubnets := uint32(snr.numSubnets())
 
 	var i uint32
 	for i = 0; i < numSubnets; i++ {
@@ -203,11 +547,32 @@ func (snr *subnetAllocatorRange) allocateNetwork() *net.IPNet {
 
 // releaseNetwork marks network as being not in use, if it is part of snr's range.
 // It returns whether the network was in snr's range.
-func (snr *subnetAllocatorRange) releaseNetwork(network *net.IPNet) bool {
+func (snr *subnetAllocatorRange) releaseNetwork(network *net.IPNet) (bool, error) {
 	if !snr.network.Contains(network.IP) {
-		return false
+		return false, nil
 	}
 
-	snr.allocMap[network.String()] = false
-	return true
+	prefixLen, _ := network.Mask.Size()
+	switch defaultLen := snr.defaultPrefixLen(); {
+	case prefixLen > defaultLen:
+		container := containingSubnet(network, defaultLen).String()
+		if allocated, ok := snr.partial[container]; ok {
+			delete(allocated, network.String())
+			if len(allocated) == 0 {
+				delete(snr.partial, container)
+				snr.allocMap[container] = false
+			}
+		}
+	case prefixLen < defaultLen:
+		subnets, err := subnetsWithin(network, defaultLen)
+		if err != nil {
+			return true, err
+		}
+		for _, sn := range subnets {
+			snr.allocMap[sn.String()] = false
+		}
+	default:
+		snr.allocMap[network.String()] = false
+	}
+	return true, nil
 }
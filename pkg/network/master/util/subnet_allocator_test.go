@@ -3,6 +3,7 @@ package util
 import (
 	"fmt"
 	"net"
+	"reflect"
 	"testing"
 )
 
@@ -404,3 +405,182 @@ func TestMultipleSubnets(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestAllocateSubnetWithHostBits(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/16", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize IP allocator: ", err)
+	}
+
+	// Default-sized subnets
+	for i := 0; i < 3; i++ {
+		if err := allocateExpected(sna, i, fmt.Sprintf("10.1.%d.0/24", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A /22 has to skip the partially-used 10.1.0.0/22
+	sn, err := sna.AllocateNetworkWithHostBits(10)
+	if err != nil || sn != "10.1.4.0/22" {
+		t.Fatalf("Expected to allocate 10.1.4.0/22, got %q, %v", sn, err)
+	}
+
+	// /25s are carved out of a single /24, which the next default allocation
+	// will skip
+	sn, err = sna.AllocateNetworkWithHostBits(7)
+	if err != nil || sn != "10.1.3.0/25" {
+		t.Fatalf("Expected to allocate 10.1.3.0/25, got %q, %v", sn, err)
+	}
+	sn, err = sna.AllocateNetworkWithHostBits(7)
+	if err != nil || sn != "10.1.3.128/25" {
+		t.Fatalf("Expected to allocate 10.1.3.128/25, got %q, %v", sn, err)
+	}
+	if err := allocateExpected(sna, -1, "10.1.8.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Releasing both /25s frees the /24; releasing the /22 frees its /24s
+	if err := sna.ReleaseNetwork("10.1.3.0/25"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sna.ReleaseNetwork("10.1.3.128/25"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sna.ReleaseNetwork("10.1.4.0/22"); err != nil {
+		t.Fatal(err)
+	}
+	sn, err = sna.AllocateNetworkWithHostBits(10)
+	if err != nil || sn != "10.1.4.0/22" {
+		t.Fatalf("Expected to allocate 10.1.4.0/22, got %q, %v", sn, err)
+	}
+
+	// Marking existing subnets of non-default size works the same way
+	sna, err = newSubnetAllocator("10.1.0.0/16", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize IP allocator: ", err)
+	}
+	if err := sna.MarkAllocatedNetwork("10.1.0.0/23"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sna.MarkAllocatedNetwork("10.1.2.0/25"); err != nil {
+		t.Fatal(err)
+	}
+	if err := allocateExpected(sna, -1, "10.1.3.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	sn, err = sna.AllocateNetworkWithHostBits(7)
+	if err != nil || sn != "10.1.2.128/25" {
+		t.Fatalf("Expected to allocate 10.1.2.128/25, got %q, %v", sn, err)
+	}
+
+	// Can't allocate a subnet larger than the range
+	if _, err := sna.AllocateNetworkWithHostBits(17); err != ErrSubnetAllocatorFull {
+		t.Fatalf("Expected ErrSubnetAllocatorFull, got %v", err)
+	}
+}
+
+func TestAllocateSubnetWithHostBitsLimits(t *testing.T) {
+	// Subnets too far from the default size are rejected rather than
+	// partially tracked
+	sna, err := newSubnetAllocator("fd01::/32", 64)
+	if err != nil {
+		t.Fatal("Failed to initialize IP allocator: ", err)
+	}
+	if err := sna.MarkAllocatedNetwork("fd01::/40"); err == nil {
+		t.Fatal("Unexpectedly marked a subnet with too many default-sized subnets")
+	}
+	if _, err := sna.AllocateNetworkWithHostBits(90); err == nil {
+		t.Fatal("Unexpectedly allocated a subnet with too many default-sized subnets")
+	}
+	if _, err := sna.AllocateNetworkWithHostBits(40); err == nil {
+		t.Fatal("Unexpectedly allocated a subnet much smaller than the default")
+	}
+
+	// IPv6 subnets can be allocated relative to the default size
+	sn, err := sna.AllocateNetworkWithHostBitsDelta(2)
+	if err != nil || sn != "fd01::/62" {
+		t.Fatalf("Expected to allocate fd01::/62, got %q, %v", sn, err)
+	}
+	if delta, err := sna.HostBitsDelta(sn); err != nil || delta != 2 {
+		t.Fatalf("Expected delta 2, got %d, %v", delta, err)
+	}
+	sn, err = sna.AllocateNetworkWithHostBitsDelta(-2)
+	if err != nil || sn != "fd01:0:0:4::/66" {
+		t.Fatalf("Expected to allocate fd01:0:0:4::/66, got %q, %v", sn, err)
+	}
+	if delta, err := sna.HostBitsDelta(sn); err != nil || delta != -2 {
+		t.Fatalf("Expected delta -2, got %d, %v", delta, err)
+	}
+}
+
+func TestDrainAndRemoveNetworkRange(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/16", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize IP allocator: ", err)
+	}
+	if err := allocateExpected(sna, 0, "10.1.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sna.AddNetworkRange("10.2.0.0/16", 8); err != nil {
+		t.Fatal(err)
+	}
+	if !sna.HasNetworkRange("10.2.0.0/16") || sna.HasNetworkRange("10.3.0.0/16") {
+		t.Fatalf("Unexpected ranges %v", sna.NetworkRanges())
+	}
+
+	// Once the first range is draining, new subnets come from the second one
+	if err := sna.SetNetworkRangeDraining("10.1.0.0/16", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := allocateExpected(sna, -1, "10.2.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	sn, err := sna.AllocateNetworkWithHostBits(7)
+	if err != nil || sn != "10.2.1.0/25" {
+		t.Fatalf("Expected to allocate 10.2.1.0/25, got %q, %v", sn, err)
+	}
+
+	// A range can only be removed once it's empty
+	if err := sna.RemoveNetworkRange("10.1.0.0/16"); err == nil {
+		t.Fatal("Unexpectedly removed range with allocated subnets")
+	}
+	if err := sna.ReleaseNetwork("10.1.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sna.RemoveNetworkRange("10.1.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	if ranges := sna.NetworkRanges(); len(ranges) != 1 || ranges[0] != "10.2.0.0/16" {
+		t.Fatalf("Unexpected ranges %v", ranges)
+	}
+	if err := sna.MarkAllocatedNetwork("10.1.0.0/24"); err == nil {
+		t.Fatal("Unexpectedly marked network in removed range")
+	}
+}
+
+func TestSubnetAllocatorUsage(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/22", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize IP allocator: ", err)
+	}
+	if err := sna.AddNetworkRange("10.2.0.0/16", 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := allocateExpected(sna, 0, "10.1.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sna.AllocateNetworkWithHostBits(7); err != nil {
+		t.Fatal(err)
+	}
+	if err := sna.SetNetworkRangeDraining("10.2.0.0/16", true); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []NetworkRangeUsage{
+		{Network: "10.1.0.0/22", Allocated: 2, Total: 4},
+		{Network: "10.2.0.0/16", Draining: true, Allocated: 0, Total: 256},
+	}
+	if usage := sna.Usage(); !reflect.DeepEqual(usage, expected) {
+		t.Fatalf("Unexpected usage: expected %#v, got %#v", expected, usage)
+	}
+}
@@ -2,25 +2,139 @@ package master
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"k8s.io/klog/v2"
 
 	corev1 "k8s.io/api/core/v1"
 	kapierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/sets"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
+	kclientset "k8s.io/client-go/kubernetes"
+	kcorelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
 
 	osdnv1 "github.com/openshift/api/network/v1"
 	osdnclient "github.com/openshift/client-go/network/clientset/versioned"
 	osdnapihelpers "github.com/openshift/library-go/pkg/network/networkapihelpers"
 	"github.com/openshift/sdn/pkg/network/common"
+	"github.com/openshift/sdn/pkg/network/master/metrics"
 	pnetid "github.com/openshift/sdn/pkg/network/master/netid"
 )
 
+const (
+	// vnidReclaimDelay is how long a released VNID is held before it can be given
+	// to another namespace. Nodes remove their flows for a VNID when they see the
+	// NetNamespace that used it go away, so this gives slow or briefly-disconnected
+	// nodes time to catch up, so the new namespace doesn't inherit stale flows.
+	vnidReclaimDelay = 10 * time.Minute
+
+	// vnidReclaimInterval is how often we look for VNIDs to reclaim
+	vnidReclaimInterval = time.Minute
+)
+
+// RequestedVNIDAnnotation can be set on a Namespace when creating it to request that
+// its NetNamespace be given a specific VNID (eg, when restoring a namespace from a
+// backup, or to keep VNIDs consistent across clusters). Since anyone who can create
+// a Namespace can set it, the request is only honored if a cluster administrator
+// has also reserved that VNID for the namespace in the VNIDReservationsConfigMap.
+// The VNID must be in the normal allocation range and not already in use; if it
+// can't be honored, the namespace is allocated a VNID as usual. The annotation is
+// ignored once the NetNamespace exists.
+const RequestedVNIDAnnotation = "network.openshift.io/requested-vnid"
+
+const (
+	// VNIDReservationsNamespace and VNIDReservationsConfigMap name a ConfigMap,
+	// which only cluster administrators should be able to write, whose data maps
+	// namespace names to the VNIDs that they may request with
+	// RequestedVNIDAnnotation
+	VNIDReservationsNamespace = "openshift-sdn"
+	VNIDReservationsConfigMap = "vnid-reservations"
+
+	// vnidQuarantineConfigMap is the name of the ConfigMap in
+	// VNIDReservationsNamespace where the master records its quarantined VNIDs
+	// (mapping each to the time it was released), so that they stay quarantined
+	// across master restarts
+	vnidQuarantineConfigMap = "vnid-quarantine"
+)
+
+// PodNetworkStatusAnnotation is set on a NetNamespace by the master after it has
+// applied a ChangePodNetworkAnnotation (join, isolate or make global), to record
+// what was done. Its value is a JSON-encoded podNetworkStatus.
+const PodNetworkStatusAnnotation = "network.openshift.io/pod-network-status"
+
+// podNetworkStatus records the last pod network action applied to a NetNamespace
+type podNetworkStatus struct {
+	Action      osdnapihelpers.PodNetworkAction `json:"action"`
+	Args        string                          `json:"args,omitempty"`
+	NetID       uint32                          `json:"netID"`
+	RequestedBy string                          `json:"requestedBy,omitempty"`
+	Timestamp   metav1.Time                     `json:"timestamp"`
+}
+
+// setPodNetworkStatus records in netns that action was applied (at the request of
+// requestedBy) with the result netid
+func setPodNetworkStatus(netns *osdnv1.NetNamespace, action osdnapihelpers.PodNetworkAction, args, requestedBy string, netid uint32, now time.Time) error {
+	status := podNetworkStatus{
+		Action:      action,
+		Args:        args,
+		NetID:       netid,
+		RequestedBy: requestedBy,
+		Timestamp:   metav1.NewTime(now),
+	}
+	value, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	if netns.Annotations == nil {
+		netns.Annotations = make(map[string]string)
+	}
+	netns.Annotations[PodNetworkStatusAnnotation] = string(value)
+	return nil
+}
+
+// podNetworkChangeRequester returns the user who set netns's
+// ChangePodNetworkAnnotation, as recorded by the admission webhook (see
+// PodNetworkChangeRequesterAnnotation), or "unknown" if the webhook is not in use.
+func podNetworkChangeRequester(netns *osdnv1.NetNamespace) string {
+	if requester := netns.Annotations[PodNetworkChangeRequesterAnnotation]; requester != "" {
+		return requester
+	}
+	return "unknown"
+}
+
+// deletePodNetworkChange removes netns's ChangePodNetworkAnnotation and
+// PodNetworkChangeRequesterAnnotation
+func deletePodNetworkChange(netns *osdnv1.NetNamespace) {
+	osdnapihelpers.DeleteChangePodNetworkAnnotation(netns)
+	delete(netns.Annotations, PodNetworkChangeRequesterAnnotation)
+}
+
+// auditPodNetworkChange logs a structured record of a pod network change, since
+// these change tenant isolation boundaries
+func auditPodNetworkChange(netns *osdnv1.NetNamespace, action osdnapihelpers.PodNetworkAction, args, requestedBy string, oldNetID, netid uint32, result string) {
+	klog.InfoS("Pod network change", "netNamespace", netns.Name, "action", action, "args", args,
+		"requestedBy", requestedBy, "oldNetID", oldNetID, "netID", netid, "result", result)
+}
+
+func netNamespaceRef(netns *osdnv1.NetNamespace) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		Kind:       "NetNamespace",
+		APIVersion: "network.openshift.io/v1",
+		Name:       netns.Name,
+		UID:        netns.UID,
+	}
+}
+
 type masterVNIDMap struct {
 	// Synchronizes assign, revoke and update VNID
 	lock         sync.Mutex
@@ -29,20 +143,116 @@ type masterVNIDMap struct {
 
 	adminNamespaces  sets.String
 	allowRenumbering bool
+
+	// minVNID and maxVNID are the range netIDManager allocates from
+	minVNID uint32
+	maxVNID uint32
+	// blocks are reserved for the namespaces matching their selectors; their
+	// netids are always marked as allocated in netIDManager
+	blocks []*vnidBlock
+	// namespaceLister is used to find the labels of namespaces with blocks; it
+	// may be nil if there are no blocks
+	namespaceLister kcorelisters.NamespaceLister
+
+	// reclaimDelay is how long released VNIDs are quarantined before being
+	// returned to netIDManager; if 0 they are returned immediately.
+	reclaimDelay time.Duration
+	// quarantined maps released VNIDs to the time they were released
+	quarantined map[uint32]time.Time
+	// kClient is used to persist quarantined to vnidQuarantineConfigMap; it may be
+	// nil (in tests). quarantineDirty is set if the last attempt to do so failed.
+	kClient         kclientset.Interface
+	quarantineDirty bool
+	// orphaned maps the names of NetNamespaces with no corresponding Namespace to
+	// the time we first noticed that
+	orphaned map[string]time.Time
 }
 
-func newMasterVNIDMap(allowRenumbering bool) *masterVNIDMap {
-	netIDRange, err := pnetid.NewNetIDRange(common.MinVNID, common.MaxVNID)
+// vnidBlock is a block of netids reserved for the namespaces matching its selector
+type vnidBlock struct {
+	common.VNIDBlock
+	netIDManager *pnetid.Allocator
+}
+
+func newMasterVNIDMap(allowRenumbering bool, minVNID, maxVNID uint32, blocks []common.VNIDBlock) *masterVNIDMap {
+	netIDRange, err := pnetid.NewNetIDRange(minVNID, maxVNID)
 	if err != nil {
 		panic(err)
 	}
 
-	return &masterVNIDMap{
+	vmap := &masterVNIDMap{
 		netIDManager:     pnetid.NewInMemory(netIDRange),
 		adminNamespaces:  sets.NewString(metav1.NamespaceDefault),
 		ids:              make(map[string]uint32),
 		allowRenumbering: allowRenumbering,
+		minVNID:          minVNID,
+		maxVNID:          maxVNID,
+		reclaimDelay:     vnidReclaimDelay,
+		quarantined:      make(map[uint32]time.Time),
+		orphaned:         make(map[string]time.Time),
+	}
+
+	// (ParseClusterNetwork has already checked that the blocks are within the
+	// range and don't overlap.)
+	for _, block := range blocks {
+		blockRange, err := pnetid.NewNetIDRange(block.MinVNID, block.MaxVNID)
+		if err != nil {
+			panic(err)
+		}
+		for netid := block.MinVNID; netid <= block.MaxVNID; netid++ {
+			if err := vmap.netIDManager.Allocate(netid); err != nil {
+				panic(fmt.Sprintf("could not reserve netid %d for VNID block %q: %v", netid, block.Name, err))
+			}
+		}
+		vmap.blocks = append(vmap.blocks, &vnidBlock{VNIDBlock: block, netIDManager: pnetid.NewInMemory(blockRange)})
 	}
+	return vmap
+}
+
+// blockForNetID returns the block that netid is in, or nil
+func (vmap *masterVNIDMap) blockForNetID(netid uint32) *vnidBlock {
+	for _, block := range vmap.blocks {
+		if netid >= block.MinVNID && netid <= block.MaxVNID {
+			return block
+		}
+	}
+	return nil
+}
+
+// blockForNamespace returns the block whose selector matches the namespace nsName,
+// or nil
+func (vmap *masterVNIDMap) blockForNamespace(nsName string) *vnidBlock {
+	if len(vmap.blocks) == 0 || vmap.namespaceLister == nil {
+		return nil
+	}
+	ns, err := vmap.namespaceLister.Get(nsName)
+	if err != nil {
+		return nil
+	}
+	for _, block := range vmap.blocks {
+		if block.Selector.Matches(labels.Set(ns.Labels)) {
+			return block
+		}
+	}
+	return nil
+}
+
+// allocatorFor returns the allocator for block, which may be nil
+func (vmap *masterVNIDMap) allocatorFor(block *vnidBlock) *pnetid.Allocator {
+	if block != nil {
+		return block.netIDManager
+	}
+	return vmap.netIDManager
+}
+
+// allocateNextFor allocates a new netid for nsName, from its block if it has one
+func (vmap *masterVNIDMap) allocateNextFor(nsName string) (uint32, error) {
+	block := vmap.blockForNamespace(nsName)
+	netid, err := vmap.allocatorFor(block).AllocateNext()
+	if err != nil && block != nil {
+		return 0, fmt.Errorf("could not allocate netid for namespace %q from VNID block %q: %v", nsName, block.Name, err)
+	}
+	return netid, err
 }
 
 func (vmap *masterVNIDMap) getVNID(name string) (uint32, bool) {
@@ -83,7 +293,7 @@ func (vmap *masterVNIDMap) markAllocatedNetID(netid uint32) error {
 		return nil
 	}
 
-	switch err := vmap.netIDManager.Allocate(netid); err {
+	switch err := vmap.allocatorFor(vmap.blockForNetID(netid)).Allocate(netid); err {
 	case nil: // Expected normal case
 	case pnetid.ErrAllocated: // Expected when project networks are joined
 	default:
@@ -92,6 +302,27 @@ func (vmap *masterVNIDMap) markAllocatedNetID(netid uint32) error {
 	return nil
 }
 
+// checkNetIDRange returns an error if any of netnsList has a (non-reserved) netid
+// outside of vmap's allocation range
+func (vmap *masterVNIDMap) checkNetIDRange(netnsList []osdnv1.NetNamespace) error {
+	var outOfRange []string
+	for _, netns := range netnsList {
+		if netns.NetID < common.MinVNID || (netns.NetID >= vmap.minVNID && netns.NetID <= vmap.maxVNID) {
+			continue
+		}
+		outOfRange = append(outOfRange, fmt.Sprintf("%s (%d)", netns.Name, netns.NetID))
+		if len(outOfRange) >= 10 {
+			outOfRange = append(outOfRange, "...")
+			break
+		}
+	}
+	if len(outOfRange) > 0 {
+		return fmt.Errorf("existing NetNamespaces have netids outside of the allocation range %d-%d (see %s): %s",
+			vmap.minVNID, vmap.maxVNID, common.VNIDRangeAnnotation, strings.Join(outOfRange, ", "))
+	}
+	return nil
+}
+
 func (vmap *masterVNIDMap) allocateNetID(nsName string) (uint32, bool, error) {
 	// Nothing to do if the netid is in the vnid map
 	exists := false
@@ -106,7 +337,7 @@ func (vmap *masterVNIDMap) allocateNetID(nsName string) (uint32, bool, error) {
 		netid = common.GlobalVNID
 	} else {
 		var err error
-		netid, err = vmap.netIDManager.AllocateNext()
+		netid, err = vmap.allocateNextFor(nsName)
 		if err != nil {
 			return 0, exists, err
 		}
@@ -117,6 +348,52 @@ func (vmap *masterVNIDMap) allocateNetID(nsName string) (uint32, bool, error) {
 	return netid, exists, nil
 }
 
+// allocateRequestedNetID is like allocateNetID but tries to allocate the specific
+// netid requested for nsName. If nsName already has a netid, that is returned instead.
+func (vmap *masterVNIDMap) allocateRequestedNetID(nsName string, requested uint32) (uint32, bool, error) {
+	if netid, found := vmap.getVNID(nsName); found {
+		if netid != requested {
+			klog.Warningf("Ignoring requested netid %d for namespace %q which already has netid %d", requested, nsName, netid)
+		}
+		return netid, true, nil
+	}
+
+	if requested < vmap.minVNID || requested > vmap.maxVNID {
+		return 0, false, fmt.Errorf("requested netid %d for namespace %q is not in the valid range %d-%d", requested, nsName, vmap.minVNID, vmap.maxVNID)
+	}
+	block := vmap.blockForNetID(requested)
+	if nsBlock := vmap.blockForNamespace(nsName); nsBlock != block {
+		if nsBlock != nil {
+			return 0, false, fmt.Errorf("requested netid %d for namespace %q is not in its VNID block %q (%d-%d)", requested, nsName, nsBlock.Name, nsBlock.MinVNID, nsBlock.MaxVNID)
+		}
+		return 0, false, fmt.Errorf("requested netid %d for namespace %q is reserved for VNID block %q", requested, nsName, block.Name)
+	}
+	switch err := vmap.allocatorFor(block).Allocate(requested); err {
+	case nil:
+	case pnetid.ErrAllocated:
+		return 0, false, fmt.Errorf("requested netid %d for namespace %q is already in use", requested, nsName)
+	default:
+		return 0, false, fmt.Errorf("unable to allocate requested netid %d for namespace %q: %v", requested, nsName, err)
+	}
+
+	vmap.setVNID(nsName, requested)
+	klog.Infof("Allocated requested netid %d for namespace %q", requested, nsName)
+	return requested, false, nil
+}
+
+// allocateNetIDFromAnnotation allocates a netid for nsName, honoring its
+// RequestedVNIDAnnotation value (requestedVNID) if it has one.
+func (vmap *masterVNIDMap) allocateNetIDFromAnnotation(nsName, requestedVNID string) (uint32, bool, error) {
+	if requestedVNID == "" || vmap.isAdminNamespace(nsName) {
+		return vmap.allocateNetID(nsName)
+	}
+	requested, err := strconv.ParseUint(requestedVNID, 10, 32)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid %s annotation %q on namespace %q", RequestedVNIDAnnotation, requestedVNID, nsName)
+	}
+	return vmap.allocateRequestedNetID(nsName, uint32(requested))
+}
+
 func (vmap *masterVNIDMap) releaseNetID(nsName string) error {
 	// Remove NetID from vnid map
 	netid, found := vmap.unsetVNID(nsName)
@@ -132,7 +409,14 @@ func (vmap *masterVNIDMap) releaseNetID(nsName string) error {
 	// Check if this netid is used by any other namespaces
 	// If not, then release the netid
 	if count := vmap.getVNIDCount(netid); count == 0 {
-		if err := vmap.netIDManager.Release(netid); err != nil {
+		if vmap.reclaimDelay > 0 {
+			// Keep it allocated until reclaimNetIDs() decides it's safe to reuse
+			vmap.quarantined[netid] = time.Now()
+			klog.Infof("Released netid %d for namespace %q; it will be reclaimed after %v", netid, nsName, vmap.reclaimDelay)
+			vmap.persistQuarantine()
+			return nil
+		}
+		if err := vmap.allocatorFor(vmap.blockForNetID(netid)).Release(netid); err != nil {
 			return fmt.Errorf("error while releasing netid %d for namespace %q, %v", netid, nsName, err)
 		}
 		klog.Infof("Released netid %d for namespace %q", netid, nsName)
@@ -142,6 +426,122 @@ func (vmap *masterVNIDMap) releaseNetID(nsName string) error {
 	return nil
 }
 
+// reclaimNetIDs returns quarantined netids that were released at least reclaimDelay
+// before now to the allocator, and returns the number reclaimed.
+func (vmap *masterVNIDMap) reclaimNetIDs(now time.Time) int {
+	reclaimed := 0
+	for netid, released := range vmap.quarantined {
+		if now.Sub(released) < vmap.reclaimDelay {
+			continue
+		}
+		delete(vmap.quarantined, netid)
+		// Shouldn't happen, since nothing allocates a quarantined netid
+		if vmap.getVNIDCount(netid) > 0 {
+			continue
+		}
+		if err := vmap.allocatorFor(vmap.blockForNetID(netid)).Release(netid); err != nil {
+			utilruntime.HandleError(fmt.Errorf("error while reclaiming netid %d: %v", netid, err))
+			continue
+		}
+		klog.V(5).Infof("Reclaimed netid %d", netid)
+		reclaimed++
+	}
+	if reclaimed > 0 || vmap.quarantineDirty {
+		vmap.persistQuarantine()
+	}
+	return reclaimed
+}
+
+// persistQuarantine writes quarantined to vnidQuarantineConfigMap
+func (vmap *masterVNIDMap) persistQuarantine() {
+	if vmap.kClient == nil {
+		return
+	}
+	data := make(map[string]string, len(vmap.quarantined))
+	for netid, released := range vmap.quarantined {
+		data[strconv.FormatUint(uint64(netid), 10)] = released.UTC().Format(time.RFC3339)
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: VNIDReservationsNamespace,
+			Name:      vnidQuarantineConfigMap,
+		},
+		Data: data,
+	}
+
+	client := vmap.kClient.CoreV1().ConfigMaps(VNIDReservationsNamespace)
+	_, err := client.Update(context.TODO(), cm, metav1.UpdateOptions{})
+	if kapierrors.IsNotFound(err) {
+		_, err = client.Create(context.TODO(), cm, metav1.CreateOptions{})
+	}
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not record quarantined netids: %v", err))
+		vmap.quarantineDirty = true
+		return
+	}
+	vmap.quarantineDirty = false
+}
+
+// loadQuarantine re-quarantines the netids recorded in cm (the
+// vnidQuarantineConfigMap) that are not in use
+func (vmap *masterVNIDMap) loadQuarantine(cm *corev1.ConfigMap) {
+	for key, value := range cm.Data {
+		netid, err := strconv.ParseUint(key, 10, 32)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("invalid quarantined netid %q", key))
+			continue
+		}
+		released, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("invalid release time %q for quarantined netid %d", value, netid))
+			continue
+		}
+		if netid < uint64(vmap.minVNID) || netid > uint64(vmap.maxVNID) || vmap.getVNIDCount(uint32(netid)) > 0 {
+			continue
+		}
+		if err := vmap.markAllocatedNetID(uint32(netid)); err != nil {
+			utilruntime.HandleError(err)
+			continue
+		}
+		vmap.quarantined[uint32(netid)] = released
+	}
+}
+
+// findOrphanedNamespaces returns the names of namespaces that have had a VNID but no
+// Namespace for at least reclaimDelay before now. (This can happen if a Namespace
+// is deleted while the master isn't running.)
+func (vmap *masterVNIDMap) findOrphanedNamespaces(namespaceLister kcorelisters.NamespaceLister, now time.Time) []string {
+	var orphans []string
+	for name := range vmap.ids {
+		if _, err := namespaceLister.Get(name); err == nil || !kapierrors.IsNotFound(err) {
+			delete(vmap.orphaned, name)
+			continue
+		}
+		if since, exists := vmap.orphaned[name]; !exists {
+			vmap.orphaned[name] = now
+		} else if now.Sub(since) >= vmap.reclaimDelay {
+			orphans = append(orphans, name)
+		}
+	}
+	for name := range vmap.orphaned {
+		if _, exists := vmap.ids[name]; !exists {
+			delete(vmap.orphaned, name)
+		}
+	}
+	return orphans
+}
+
+func (vmap *masterVNIDMap) updateMetrics() {
+	free := vmap.netIDManager.Free()
+	for _, block := range vmap.blocks {
+		free += block.netIDManager.Free()
+	}
+	total := int(vmap.maxVNID-vmap.minVNID) + 1
+	metrics.VNIDsFree.Set(float64(free))
+	metrics.VNIDsQuarantined.Set(float64(len(vmap.quarantined)))
+	metrics.VNIDsAllocated.Set(float64(total - free - len(vmap.quarantined)))
+}
+
 func (vmap *masterVNIDMap) updateNetID(nsName string, action osdnapihelpers.PodNetworkAction, args string) (uint32, error) {
 	var netid uint32
 	allocated := false
@@ -172,7 +572,7 @@ func (vmap *masterVNIDMap) updateNetID(nsName string, action osdnapihelpers.PodN
 		}
 
 		var err error
-		netid, err = vmap.netIDManager.AllocateNext()
+		netid, err = vmap.allocateNextFor(nsName)
 		if err != nil {
 			return 0, err
 		}
@@ -184,7 +584,7 @@ func (vmap *masterVNIDMap) updateNetID(nsName string, action osdnapihelpers.PodN
 	// Release old network ID
 	if err := vmap.releaseNetID(nsName); err != nil {
 		if allocated {
-			vmap.netIDManager.Release(netid)
+			vmap.allocatorFor(vmap.blockForNetID(netid)).Release(netid)
 		}
 		return 0, err
 	}
@@ -196,11 +596,15 @@ func (vmap *masterVNIDMap) updateNetID(nsName string, action osdnapihelpers.PodN
 }
 
 // assignVNID, revokeVNID and updateVNID methods updates in-memory structs and persists etcd objects
-func (vmap *masterVNIDMap) assignVNID(osdnClient osdnclient.Interface, nsName string) error {
+func (vmap *masterVNIDMap) assignVNID(osdnClient osdnclient.Interface, nsName, requestedVNID string) error {
 	vmap.lock.Lock()
 	defer vmap.lock.Unlock()
 
-	netid, exists, err := vmap.allocateNetID(nsName)
+	netid, exists, err := vmap.allocateNetIDFromAnnotation(nsName, requestedVNID)
+	if err != nil && requestedVNID != "" {
+		utilruntime.HandleError(fmt.Errorf("%v; allocating a new netid instead", err))
+		netid, exists, err = vmap.allocateNetID(nsName)
+	}
 	if err != nil {
 		return err
 	}
@@ -243,7 +647,7 @@ func (vmap *masterVNIDMap) revokeVNID(osdnClient osdnclient.Interface, nsName st
 	return nil
 }
 
-func (vmap *masterVNIDMap) updateVNID(osdnClient osdnclient.Interface, origNetns *osdnv1.NetNamespace) error {
+func (vmap *masterVNIDMap) updateVNID(osdnClient osdnclient.Interface, recorder record.EventRecorder, origNetns *osdnv1.NetNamespace) error {
 	// Informer cache should not be mutated, so get a copy of the object
 	netns := origNetns.DeepCopy()
 
@@ -251,9 +655,15 @@ func (vmap *masterVNIDMap) updateVNID(osdnClient osdnclient.Interface, origNetns
 	if err == osdnapihelpers.ErrorPodNetworkAnnotationNotFound {
 		// Nothing to update
 		return nil
-	} else if !vmap.allowRenumbering {
-		osdnapihelpers.DeleteChangePodNetworkAnnotation(netns)
+	}
+	requestedBy := podNetworkChangeRequester(netns)
+	oldNetID := netns.NetID
+	if !vmap.allowRenumbering {
+		deletePodNetworkChange(netns)
 		_, _ = osdnClient.NetworkV1().NetNamespaces().Update(context.TODO(), netns, metav1.UpdateOptions{})
+		auditPodNetworkChange(netns, action, args, requestedBy, oldNetID, oldNetID, "rejected")
+		recorder.Eventf(netNamespaceRef(netns), corev1.EventTypeWarning, "PodNetworkChangeRejected",
+			"Pod network change %q requested by %s ignored: network plugin does not allow NetNamespace renumbering", action, requestedBy)
 		return fmt.Errorf("network plugin does not allow NetNamespace renumbering")
 	}
 
@@ -262,20 +672,31 @@ func (vmap *masterVNIDMap) updateVNID(osdnClient osdnclient.Interface, origNetns
 
 	netid, err := vmap.updateNetID(netns.NetName, action, args)
 	if err != nil {
+		auditPodNetworkChange(netns, action, args, requestedBy, oldNetID, oldNetID, "failed")
+		recorder.Eventf(netNamespaceRef(netns), corev1.EventTypeWarning, "PodNetworkChangeFailed",
+			"Could not apply pod network change %q requested by %s: %v", action, requestedBy, err)
 		return err
 	}
 	netns.NetID = netid
-	osdnapihelpers.DeleteChangePodNetworkAnnotation(netns)
+	deletePodNetworkChange(netns)
+	if err := setPodNetworkStatus(netns, action, args, requestedBy, netid, time.Now()); err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not record pod network status for NetNamespace %q: %v", netns.Name, err))
+	}
 
 	if _, err := osdnClient.NetworkV1().NetNamespaces().Update(context.TODO(), netns, metav1.UpdateOptions{}); err != nil {
 		return err
 	}
+	auditPodNetworkChange(netns, action, args, requestedBy, oldNetID, netid, "applied")
+	recorder.Eventf(netNamespaceRef(netns), corev1.EventTypeNormal, "PodNetworkChanged",
+		"Applied pod network change %q requested by %s; netid changed from %d to %d", action, requestedBy, oldNetID, netid)
 	return nil
 }
 
 //--------------------- Master methods ----------------------
 
 func (master *OsdnMaster) startVNIDMaster() error {
+	master.vnids.namespaceLister = master.namespaceInformer.Lister()
+	master.vnids.kClient = master.kClient
 	if err := master.initNetIDAllocator(); err != nil {
 		return err
 	}
@@ -283,14 +704,42 @@ func (master *OsdnMaster) startVNIDMaster() error {
 	master.watchNamespaces()
 	master.watchNetNamespaces()
 
+	go utilwait.Forever(master.reclaimVNIDs, vnidReclaimInterval)
+
 	return nil
 }
 
+// reclaimVNIDs cleans up the NetNamespaces of namespaces that were deleted while the
+// master wasn't running, and returns quarantined VNIDs to the allocator once it is
+// safe to reuse them.
+func (master *OsdnMaster) reclaimVNIDs() {
+	master.vnids.lock.Lock()
+	orphans := master.vnids.findOrphanedNamespaces(master.namespaceInformer.Lister(), time.Now())
+	master.vnids.lock.Unlock()
+
+	for _, name := range orphans {
+		klog.Infof("Cleaning up NetNamespace %q for deleted Namespace", name)
+		if err := master.vnids.revokeVNID(master.osdnClient, name); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Error revoking netid: %v", err))
+		}
+	}
+
+	master.vnids.lock.Lock()
+	defer master.vnids.lock.Unlock()
+	if reclaimed := master.vnids.reclaimNetIDs(time.Now()); reclaimed > 0 {
+		metrics.VNIDsReclaimed.Add(float64(reclaimed))
+	}
+	master.vnids.updateMetrics()
+}
+
 func (master *OsdnMaster) initNetIDAllocator() error {
 	netnsList, err := master.osdnClient.NetworkV1().NetNamespaces().List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
 		return err
 	}
+	if err := master.vnids.checkNetIDRange(netnsList.Items); err != nil {
+		return err
+	}
 
 	for _, netns := range netnsList.Items {
 		if err := master.vnids.markAllocatedNetID(netns.NetID); err != nil {
@@ -299,6 +748,13 @@ func (master *OsdnMaster) initNetIDAllocator() error {
 		master.vnids.setVNID(netns.Name, netns.NetID)
 	}
 
+	cm, err := master.kClient.CoreV1().ConfigMaps(VNIDReservationsNamespace).Get(context.TODO(), vnidQuarantineConfigMap, metav1.GetOptions{})
+	if err == nil {
+		master.vnids.loadQuarantine(cm)
+	} else if !kapierrors.IsNotFound(err) {
+		return fmt.Errorf("could not get quarantined netids: %v", err)
+	}
+
 	return nil
 }
 
@@ -311,11 +767,47 @@ func (master *OsdnMaster) handleAddOrUpdateNamespace(obj, _ interface{}, eventTy
 	ns := obj.(*corev1.Namespace)
 	klog.V(5).Infof("Watch %s event for Namespace %q", eventType, ns.Name)
 
-	if err := master.vnids.assignVNID(master.osdnClient, ns.Name); err != nil {
+	requestedVNID := ns.Annotations[RequestedVNIDAnnotation]
+	if requestedVNID != "" {
+		if _, err := master.netNamespaceInformer.Lister().Get(ns.Name); err == nil {
+			requestedVNID = ""
+		} else if err := master.checkVNIDReservation(ns.Name, requestedVNID); err != nil {
+			utilruntime.HandleError(fmt.Errorf("%v; allocating a new netid instead", err))
+			requestedVNID = ""
+		}
+	}
+	if err := master.vnids.assignVNID(master.osdnClient, ns.Name, requestedVNID); err != nil {
 		utilruntime.HandleError(fmt.Errorf("Error assigning netid: %v", err))
 	}
 }
 
+// checkVNIDReservation returns an error unless requestedVNID is reserved for nsName
+// in the VNIDReservationsConfigMap
+func (master *OsdnMaster) checkVNIDReservation(nsName, requestedVNID string) error {
+	cm, err := master.kClient.CoreV1().ConfigMaps(VNIDReservationsNamespace).Get(context.TODO(), VNIDReservationsConfigMap, metav1.GetOptions{})
+	if kapierrors.IsNotFound(err) {
+		cm = nil
+	} else if err != nil {
+		return fmt.Errorf("could not get VNID reservations: %v", err)
+	}
+	return vnidReserved(cm, nsName, requestedVNID)
+}
+
+// vnidReserved returns an error unless cm reserves requestedVNID for nsName
+func vnidReserved(cm *corev1.ConfigMap, nsName, requestedVNID string) error {
+	var reserved string
+	if cm != nil {
+		reserved = cm.Data[nsName]
+	}
+	if reserved == "" {
+		return fmt.Errorf("requested netid %s for namespace %q is not reserved in ConfigMap %s/%s", requestedVNID, nsName, VNIDReservationsNamespace, VNIDReservationsConfigMap)
+	}
+	if reserved != requestedVNID {
+		return fmt.Errorf("requested netid %s for namespace %q does not match its reserved netid %s", requestedVNID, nsName, reserved)
+	}
+	return nil
+}
+
 func (master *OsdnMaster) handleDeleteNamespace(obj interface{}) {
 	ns := obj.(*corev1.Namespace)
 	klog.V(5).Infof("Watch %s event for Namespace %q", watch.Deleted, ns.Name)
@@ -333,7 +825,7 @@ func (master *OsdnMaster) handleAddOrUpdateNetNamespace(obj, _ interface{}, even
 	netns := obj.(*osdnv1.NetNamespace)
 	klog.V(5).Infof("Watch %s event for NetNamespace %q", eventType, netns.Name)
 
-	if err := master.vnids.updateVNID(master.osdnClient, netns); err != nil {
+	if err := master.vnids.updateVNID(master.osdnClient, master.recorder, netns); err != nil {
 		utilruntime.HandleError(fmt.Errorf("Error updating netid: %v", err))
 	}
 }
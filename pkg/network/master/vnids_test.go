@@ -1,16 +1,27 @@
 package master
 
 import (
+	"context"
+	"fmt"
 	"testing"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+	kcorelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 
+	osdnv1 "github.com/openshift/api/network/v1"
 	osdnapihelpers "github.com/openshift/library-go/pkg/network/networkapihelpers"
 	"github.com/openshift/sdn/pkg/network/common"
 )
 
 func TestMasterVNIDMap(t *testing.T) {
-	vmap := newMasterVNIDMap(true)
+	vmap := newMasterVNIDMap(true, common.MinVNID, common.MaxVNID, nil)
+	// Release netids immediately; see TestReclaimNetIDs
+	vmap.reclaimDelay = 0
 
 	// empty vmap
 	checkCurrentVNIDs(t, vmap, 0, 0)
@@ -68,6 +79,258 @@ func TestMasterVNIDMap(t *testing.T) {
 	checkCurrentVNIDs(t, vmap, 0, 0)
 }
 
+func TestPodNetworkChangeRequester(t *testing.T) {
+	netns := &osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "alpha",
+			Annotations: map[string]string{
+				osdnv1.ChangePodNetworkAnnotation: "join:bravo",
+			},
+		},
+		NetName: "alpha",
+		NetID:   42,
+	}
+	if requester := podNetworkChangeRequester(netns); requester != "unknown" {
+		t.Fatalf("expected unknown requester, got %q", requester)
+	}
+
+	netns.Annotations[PodNetworkChangeRequesterAnnotation] = "alice"
+	if requester := podNetworkChangeRequester(netns); requester != "alice" {
+		t.Fatalf("expected requester \"alice\", got %q", requester)
+	}
+
+	deletePodNetworkChange(netns)
+	if len(netns.Annotations) != 0 {
+		t.Fatalf("expected annotations to be removed, got %v", netns.Annotations)
+	}
+}
+
+func TestRequestedNetID(t *testing.T) {
+	vmap := newMasterVNIDMap(true, common.MinVNID, common.MaxVNID, nil)
+
+	netid, exists, err := vmap.allocateNetIDFromAnnotation("alpha", "1234")
+	checkNoErr(t, err)
+	if netid != 1234 || exists {
+		t.Fatalf("Expected new netid 1234, got %d (exists %v)", netid, exists)
+	}
+	// Request is ignored once the namespace has a netid
+	netid, exists, err = vmap.allocateNetIDFromAnnotation("alpha", "5678")
+	checkNoErr(t, err)
+	if netid != 1234 || !exists {
+		t.Fatalf("Expected existing netid 1234, got %d (exists %v)", netid, exists)
+	}
+
+	// Can't request a netid that is in use, out of range, or invalid
+	_, _, err = vmap.allocateNetIDFromAnnotation("bravo", "1234")
+	checkErr(t, err)
+	_, _, err = vmap.allocateNetIDFromAnnotation("bravo", "0")
+	checkErr(t, err)
+	_, _, err = vmap.allocateNetIDFromAnnotation("bravo", fmt.Sprintf("%d", common.MaxVNID+1))
+	checkErr(t, err)
+	_, _, err = vmap.allocateNetIDFromAnnotation("bravo", "bogus")
+	checkErr(t, err)
+	checkCurrentVNIDs(t, vmap, 1, 1)
+
+	// Admin namespaces always get the global netid
+	netid, _, err = vmap.allocateNetIDFromAnnotation(metav1.NamespaceDefault, "2345")
+	checkNoErr(t, err)
+	if netid != common.GlobalVNID {
+		t.Fatalf("Expected global netid for %q, got %d", metav1.NamespaceDefault, netid)
+	}
+	checkCurrentVNIDs(t, vmap, 2, 1)
+}
+
+func TestVNIDReserved(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: VNIDReservationsNamespace, Name: VNIDReservationsConfigMap},
+		Data:       map[string]string{"alpha": "1234"},
+	}
+	checkNoErr(t, vnidReserved(cm, "alpha", "1234"))
+	// Wrong netid, unreserved namespace, or no ConfigMap
+	checkErr(t, vnidReserved(cm, "alpha", "5678"))
+	checkErr(t, vnidReserved(cm, "bravo", "1234"))
+	checkErr(t, vnidReserved(nil, "alpha", "1234"))
+}
+
+func TestReclaimNetIDs(t *testing.T) {
+	vmap := newMasterVNIDMap(true, common.MinVNID, common.MaxVNID, nil)
+
+	alpha, _, err := vmap.allocateNetID("alpha")
+	checkNoErr(t, err)
+	_, _, err = vmap.allocateNetID("bravo")
+	checkNoErr(t, err)
+	_, err = vmap.updateNetID("bravo", osdnapihelpers.JoinPodNetwork, "alpha")
+	checkNoErr(t, err)
+	checkCurrentVNIDs(t, vmap, 2, 2)
+
+	// bravo's original netid stays allocated until it is reclaimed
+	released := time.Now()
+	if len(vmap.quarantined) != 1 {
+		t.Fatalf("Expected 1 quarantined netid, got %v", vmap.quarantined)
+	}
+	if n := vmap.reclaimNetIDs(released.Add(vmap.reclaimDelay / 2)); n != 0 {
+		t.Fatalf("Unexpectedly reclaimed %d netids", n)
+	}
+	checkCurrentVNIDs(t, vmap, 2, 2)
+	if n := vmap.reclaimNetIDs(released.Add(vmap.reclaimDelay)); n != 1 {
+		t.Fatalf("Expected to reclaim 1 netid, reclaimed %d", n)
+	}
+	checkCurrentVNIDs(t, vmap, 2, 1)
+
+	// alpha's netid is still in use by bravo after alpha is released
+	checkNoErr(t, vmap.releaseNetID("alpha"))
+	if len(vmap.quarantined) != 0 {
+		t.Fatalf("Unexpectedly quarantined netid: %v", vmap.quarantined)
+	}
+	checkNoErr(t, vmap.releaseNetID("bravo"))
+	if _, exists := vmap.quarantined[alpha]; !exists {
+		t.Fatalf("Expected netid %d to be quarantined, got %v", alpha, vmap.quarantined)
+	}
+	if n := vmap.reclaimNetIDs(time.Now().Add(vmap.reclaimDelay)); n != 1 {
+		t.Fatalf("Expected to reclaim 1 netid, reclaimed %d", n)
+	}
+	checkCurrentVNIDs(t, vmap, 0, 0)
+}
+
+func TestPersistQuarantine(t *testing.T) {
+	kClient := fake.NewSimpleClientset()
+	vmap := newMasterVNIDMap(true, common.MinVNID, common.MaxVNID, nil)
+	vmap.kClient = kClient
+
+	alpha, _, err := vmap.allocateNetID("alpha")
+	checkNoErr(t, err)
+	checkNoErr(t, vmap.releaseNetID("alpha"))
+	cm, err := kClient.CoreV1().ConfigMaps(VNIDReservationsNamespace).Get(context.TODO(), vnidQuarantineConfigMap, metav1.GetOptions{})
+	checkNoErr(t, err)
+	if _, exists := cm.Data[fmt.Sprintf("%d", alpha)]; !exists || len(cm.Data) != 1 {
+		t.Fatalf("Expected netid %d to be recorded as quarantined, got %v", alpha, cm.Data)
+	}
+
+	// A restarted master keeps it quarantined
+	restarted := newMasterVNIDMap(true, common.MinVNID, common.MaxVNID, nil)
+	restarted.kClient = kClient
+	restarted.loadQuarantine(cm)
+	if _, exists := restarted.quarantined[alpha]; !exists {
+		t.Fatalf("Expected netid %d to be quarantined after restart, got %v", alpha, restarted.quarantined)
+	}
+	checkCurrentVNIDs(t, restarted, 0, 1)
+
+	if n := restarted.reclaimNetIDs(time.Now().Add(restarted.reclaimDelay)); n != 1 {
+		t.Fatalf("Expected to reclaim 1 netid, reclaimed %d", n)
+	}
+	checkCurrentVNIDs(t, restarted, 0, 0)
+	cm, err = kClient.CoreV1().ConfigMaps(VNIDReservationsNamespace).Get(context.TODO(), vnidQuarantineConfigMap, metav1.GetOptions{})
+	checkNoErr(t, err)
+	if len(cm.Data) != 0 {
+		t.Fatalf("Expected no recorded quarantined netids, got %v", cm.Data)
+	}
+}
+
+func TestFindOrphanedNamespaces(t *testing.T) {
+	vmap := newMasterVNIDMap(true, common.MinVNID, common.MaxVNID, nil)
+	_, _, err := vmap.allocateNetID("alpha")
+	checkNoErr(t, err)
+	_, _, err = vmap.allocateNetID("bravo")
+	checkNoErr(t, err)
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	err = indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alpha"}})
+	checkNoErr(t, err)
+	lister := kcorelisters.NewNamespaceLister(indexer)
+
+	// bravo isn't considered orphaned until it has been missing for reclaimDelay
+	now := time.Now()
+	if orphans := vmap.findOrphanedNamespaces(lister, now); len(orphans) != 0 {
+		t.Fatalf("Unexpected orphans: %v", orphans)
+	}
+	orphans := vmap.findOrphanedNamespaces(lister, now.Add(vmap.reclaimDelay))
+	if len(orphans) != 1 || orphans[0] != "bravo" {
+		t.Fatalf("Expected bravo to be orphaned, got %v", orphans)
+	}
+
+	// If the Namespace reappears it is no longer orphaned
+	err = indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "bravo"}})
+	checkNoErr(t, err)
+	if orphans := vmap.findOrphanedNamespaces(lister, now.Add(2*vmap.reclaimDelay)); len(orphans) != 0 {
+		t.Fatalf("Unexpected orphans: %v", orphans)
+	}
+	if len(vmap.orphaned) != 0 {
+		t.Fatalf("Unexpected orphaned state: %v", vmap.orphaned)
+	}
+}
+
+func TestVNIDRange(t *testing.T) {
+	vmap := newMasterVNIDMap(true, 100, 102, nil)
+	vmap.reclaimDelay = 0
+
+	for _, name := range []string{"alpha", "bravo", "charlie"} {
+		netid, _, err := vmap.allocateNetID(name)
+		checkNoErr(t, err)
+		if netid < 100 || netid > 102 {
+			t.Fatalf("Allocated netid %d for %q outside of range", netid, name)
+		}
+	}
+	checkCurrentVNIDs(t, vmap, 3, 3)
+	_, _, err := vmap.allocateNetID("delta")
+	checkErr(t, err)
+
+	checkNoErr(t, vmap.releaseNetID("alpha"))
+	_, _, err = vmap.allocateRequestedNetID("delta", 50)
+	checkErr(t, err)
+	_, _, err = vmap.allocateNetID("delta")
+	checkNoErr(t, err)
+
+	netnsList := []osdnv1.NetNamespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "default"}, NetID: common.GlobalVNID},
+		{ObjectMeta: metav1.ObjectMeta{Name: "alpha"}, NetID: 101},
+	}
+	checkNoErr(t, vmap.checkNetIDRange(netnsList))
+	netnsList = append(netnsList, osdnv1.NetNamespace{ObjectMeta: metav1.ObjectMeta{Name: "bravo"}, NetID: 5000})
+	checkErr(t, vmap.checkNetIDRange(netnsList))
+}
+
+func TestVNIDBlocks(t *testing.T) {
+	blocks := []common.VNIDBlock{
+		{Name: "finance", Selector: labels.SelectorFromSet(labels.Set{"tenant": "finance"}), MinVNID: 100, MaxVNID: 101},
+	}
+	vmap := newMasterVNIDMap(true, 100, 199, blocks)
+	vmap.reclaimDelay = 0
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, name := range []string{"alpha", "bravo", "charlie"} {
+		err := indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"tenant": "finance"}}})
+		checkNoErr(t, err)
+	}
+	err := indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "delta"}})
+	checkNoErr(t, err)
+	vmap.namespaceLister = kcorelisters.NewNamespaceLister(indexer)
+
+	// Namespaces matching the block get netids from it, until it is full
+	for _, name := range []string{"alpha", "bravo"} {
+		netid, _, err := vmap.allocateNetID(name)
+		checkNoErr(t, err)
+		if netid < 100 || netid > 101 {
+			t.Fatalf("Allocated netid %d for %q outside of its block", netid, name)
+		}
+	}
+	_, _, err = vmap.allocateNetID("charlie")
+	checkErr(t, err)
+
+	// Other namespaces never get netids from the block
+	netid, _, err := vmap.allocateNetID("delta")
+	checkNoErr(t, err)
+	if netid < 102 {
+		t.Fatalf("Allocated netid %d for %q inside of a block", netid, "delta")
+	}
+	_, _, err = vmap.allocateRequestedNetID("echo", 101)
+	checkErr(t, err)
+
+	// Released netids go back to the block
+	checkNoErr(t, vmap.releaseNetID("alpha"))
+	_, _, err = vmap.allocateNetID("charlie")
+	checkNoErr(t, err)
+}
+
 func checkNoErr(t *testing.T, err error) {
 	if err != nil {
 		t.Fatal(err)
@@ -86,7 +349,7 @@ func checkCurrentVNIDs(t *testing.T, vmap *masterVNIDMap, expectedMapCount, expe
 	}
 
 	// Check bitmap allocator
-	expected_free := int(common.MaxVNID-common.MinVNID) + 1 - expectedAllocatorCount
+	expected_free := int(vmap.maxVNID-vmap.minVNID) + 1 - expectedAllocatorCount
 	if vmap.netIDManager.Free() != expected_free {
 		t.Fatalf("Allocator mismatch: %d vs %d", vmap.netIDManager.Free(), expected_free)
 	}
@@ -99,3 +362,27 @@ func checkCurrentVNIDs(t *testing.T, vmap *masterVNIDMap, expectedMapCount, expe
 		}
 	}
 }
+
+func TestPodNetworkStatus(t *testing.T) {
+	netns := &osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "alpha"},
+		NetName:    "alpha",
+		NetID:      42,
+	}
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	err := setPodNetworkStatus(netns, osdnapihelpers.JoinPodNetwork, "bravo", "oc", 43, now)
+	checkNoErr(t, err)
+
+	expected := `{"action":"join","args":"bravo","netID":43,"requestedBy":"oc","timestamp":"2021-03-04T05:06:07Z"}`
+	if value := netns.Annotations[PodNetworkStatusAnnotation]; value != expected {
+		t.Fatalf("unexpected status annotation: expected %s, got %s", expected, value)
+	}
+
+	// Overwrites the previous status
+	err = setPodNetworkStatus(netns, osdnapihelpers.GlobalPodNetwork, "", "", 0, now)
+	checkNoErr(t, err)
+	expected = `{"action":"global","netID":0,"timestamp":"2021-03-04T05:06:07Z"}`
+	if value := netns.Annotations[PodNetworkStatusAnnotation]; value != expected {
+		t.Fatalf("unexpected status annotation: expected %s, got %s", expected, value)
+	}
+}
@@ -0,0 +1,562 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/sdn/pkg/network/common"
+	"github.com/openshift/sdn/pkg/util/ovs"
+)
+
+// AdminNetworkPolicy and BaselineAdminNetworkPolicy (from sigs.k8s.io/network-policy-api)
+// are cluster-scoped policies that are evaluated before and after NetworkPolicies.
+// The API isn't vendored, so they are watched with the dynamic client and converted
+// to the subset of the v1alpha1 types below.
+//
+// Traffic that reaches table 80 without being accepted as part of an existing
+// connection is first sent to table 82, which has the AdminNetworkPolicy rules, in
+// order. "Allow" and "Deny" rules are final; "Pass" rules, and traffic that matches
+// no rule, set anpPassedReg and resubmit to table 80 to be evaluated against the
+// NetworkPolicies. Traffic to pods that no NetworkPolicy selects then goes to table
+// 83, which has the BaselineAdminNetworkPolicy rules, rather than directly to table
+// 81. Only ingress rules are supported, as with NetworkPolicy; policies with egress
+// rules are rejected entirely, with a warning event, rather than partially
+// enforced. Ports that can't be converted to flows make Deny rules deny all ports,
+// so that they fail closed.
+var (
+	adminNetworkPolicyResource         = schema.GroupVersionResource{Group: "policy.networking.k8s.io", Version: "v1alpha1", Resource: "adminnetworkpolicies"}
+	baselineAdminNetworkPolicyResource = schema.GroupVersionResource{Group: "policy.networking.k8s.io", Version: "v1alpha1", Resource: "baselineadminnetworkpolicies"}
+)
+
+const (
+	// baselineAdminNetworkPolicyName is the name of the only BaselineAdminNetworkPolicy
+	// that is used
+	baselineAdminNetworkPolicyName = "default"
+
+	// anpPassedReg is set on traffic that has been through the AdminNetworkPolicy tier
+	// without matching an "Allow" or "Deny" rule
+	anpPassedReg = "NXM_NX_REG3[0]"
+
+	// adminPolicyMaxPriority is the OVS priority of the first rule in tables 82 and 83;
+	// each later rule gets the next lower priority
+	adminPolicyMaxPriority = 60000
+
+	anpActionAllow = "Allow"
+	anpActionDeny  = "Deny"
+	anpActionPass  = "Pass"
+)
+
+type adminNetworkPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              adminNetworkPolicySpec `json:"spec"`
+}
+
+type adminNetworkPolicySpec struct {
+	Priority int32                    `json:"priority"`
+	Subject  adminPolicySubject       `json:"subject"`
+	Ingress  []adminPolicyIngressRule `json:"ingress,omitempty"`
+	Egress   []interface{}            `json:"egress,omitempty"`
+}
+
+type baselineAdminNetworkPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              baselineAdminNetworkPolicySpec `json:"spec"`
+}
+
+type baselineAdminNetworkPolicySpec struct {
+	Subject adminPolicySubject       `json:"subject"`
+	Ingress []adminPolicyIngressRule `json:"ingress,omitempty"`
+	Egress  []interface{}            `json:"egress,omitempty"`
+}
+
+// adminPolicySubject selects the pods that a policy applies to; exactly one field is set
+type adminPolicySubject struct {
+	Namespaces *metav1.LabelSelector `json:"namespaces,omitempty"`
+	Pods       *adminPolicyPods      `json:"pods,omitempty"`
+}
+
+type adminPolicyPods struct {
+	NamespaceSelector metav1.LabelSelector `json:"namespaceSelector"`
+	PodSelector       metav1.LabelSelector `json:"podSelector"`
+}
+
+type adminPolicyIngressRule struct {
+	Name   string             `json:"name,omitempty"`
+	Action string             `json:"action"`
+	From   []adminPolicyPeer  `json:"from"`
+	Ports  *[]adminPolicyPort `json:"ports,omitempty"`
+}
+
+// adminPolicyPeer selects the pods that a rule applies to; exactly one field is set
+type adminPolicyPeer struct {
+	Namespaces *metav1.LabelSelector `json:"namespaces,omitempty"`
+	Pods       *adminPolicyPods      `json:"pods,omitempty"`
+}
+
+// adminPolicyPort is a port or port range; exactly one field is set
+type adminPolicyPort struct {
+	PortNumber *adminPolicyPortNumber `json:"portNumber,omitempty"`
+	NamedPort  *string                `json:"namedPort,omitempty"`
+	PortRange  *adminPolicyPortRange  `json:"portRange,omitempty"`
+}
+
+type adminPolicyPortNumber struct {
+	Protocol corev1.Protocol `json:"protocol"`
+	Port     int32           `json:"port"`
+}
+
+type adminPolicyPortRange struct {
+	Protocol corev1.Protocol `json:"protocol"`
+	Start    int32           `json:"start"`
+	End      int32           `json:"end"`
+}
+
+// npAdminPolicies tracks the AdminNetworkPolicies and BaselineAdminNetworkPolicy
+type npAdminPolicies struct {
+	anps map[string]*adminNetworkPolicy
+	banp *baselineAdminNetworkPolicy
+
+	// mustSync is true if tables 82 and 83 need to be regenerated
+	mustSync bool
+}
+
+// startAdminPolicies sets up the AdminNetworkPolicy tier flows and starts watching
+// AdminNetworkPolicies and BaselineAdminNetworkPolicies with client
+func (np *networkPolicyPlugin) startAdminPolicies(client dynamic.Interface) error {
+	np.adminPolicies = &npAdminPolicies{anps: make(map[string]*adminNetworkPolicy)}
+
+	otx := np.node.oc.NewTransaction()
+	np.addAdminPolicyTierFlows(otx)
+	np.generateAdminPolicyFlows(otx)
+	if err := otx.Commit(); err != nil {
+		return err
+	}
+
+	anpInformer := newAdminPolicyInformer(client, adminNetworkPolicyResource)
+	anpInformer.AddEventHandler(common.InformerFuncs(&unstructured.Unstructured{}, np.handleAddOrUpdateAdminNetworkPolicy, np.handleDeleteAdminNetworkPolicy))
+	go anpInformer.Run(utilwait.NeverStop)
+
+	banpInformer := newAdminPolicyInformer(client, baselineAdminNetworkPolicyResource)
+	banpInformer.AddEventHandler(common.InformerFuncs(&unstructured.Unstructured{}, np.handleAddOrUpdateBaselineAdminNetworkPolicy, np.handleDeleteBaselineAdminNetworkPolicy))
+	go banpInformer.Run(utilwait.NeverStop)
+	return nil
+}
+
+// addAdminPolicyTierFlows adds the table 80 flows sending traffic that hasn't been
+// through the AdminNetworkPolicy tier yet to table 82
+func (np *networkPolicyPlugin) addAdminPolicyTierFlows(otx ovs.Transaction) {
+	families := []string{"ip"}
+	if np.dualStack {
+		families = append(families, "ipv6")
+	}
+	for _, family := range families {
+		otx.AddFlow("table=80, priority=190, %s, reg3=0, actions=goto_table:82", family)
+	}
+}
+
+func newAdminPolicyInformer(client dynamic.Interface, resource schema.GroupVersionResource) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.Resource(resource).List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return client.Resource(resource).Watch(context.TODO(), options)
+			},
+		},
+		&unstructured.Unstructured{},
+		0,
+		cache.Indexers{},
+	)
+}
+
+// baselineAction returns the table 80 action for traffic to pods that are not
+// selected by any NetworkPolicy
+func (np *networkPolicyPlugin) baselineAction() string {
+	if np.adminPolicies != nil {
+		return "goto_table:83"
+	}
+	return policyAllowAction
+}
+
+// invalidateAdminPolicies marks the admin policy flows as needing to be regenerated,
+// after a change that may affect which pods or namespaces they select
+func (np *networkPolicyPlugin) invalidateAdminPolicies() {
+	if np.adminPolicies == nil || (len(np.adminPolicies.anps) == 0 && np.adminPolicies.banp == nil) {
+		return
+	}
+	if !np.adminPolicies.mustSync {
+		np.adminPolicies.mustSync = true
+		np.runner.Run()
+	}
+}
+
+func (np *networkPolicyPlugin) handleAddOrUpdateAdminNetworkPolicy(obj, _ interface{}, eventType watch.EventType) {
+	anp := &adminNetworkPolicy{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.(*unstructured.Unstructured).UnstructuredContent(), anp); err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not parse AdminNetworkPolicy: %v", err))
+		return
+	}
+	klog.V(5).Infof("Watch %s event for AdminNetworkPolicy %s", eventType, anp.Name)
+	if len(anp.Spec.Egress) > 0 {
+		np.rejectAdminPolicy(obj.(*unstructured.Unstructured), "egress rules are not supported")
+		np.handleDeleteAdminNetworkPolicy(obj)
+		return
+	}
+	if unsupported := adminPolicyUnsupportedFeatures(anp.Spec.Ingress); len(unsupported) > 0 {
+		klog.Warningf("Unsupported parts of AdminNetworkPolicy %s: %s", anp.Name, strings.Join(unsupported, "; "))
+	}
+
+	np.lock.Lock()
+	defer np.lock.Unlock()
+	np.adminPolicies.anps[anp.Name] = anp
+	np.invalidateAdminPolicies()
+}
+
+func (np *networkPolicyPlugin) handleDeleteAdminNetworkPolicy(obj interface{}) {
+	name := obj.(*unstructured.Unstructured).GetName()
+	klog.V(5).Infof("Watch %s event for AdminNetworkPolicy %s", watch.Deleted, name)
+
+	np.lock.Lock()
+	defer np.lock.Unlock()
+	if _, exists := np.adminPolicies.anps[name]; exists {
+		np.adminPolicies.mustSync = true
+		np.runner.Run()
+		delete(np.adminPolicies.anps, name)
+	}
+}
+
+func (np *networkPolicyPlugin) handleAddOrUpdateBaselineAdminNetworkPolicy(obj, _ interface{}, eventType watch.EventType) {
+	banp := &baselineAdminNetworkPolicy{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.(*unstructured.Unstructured).UnstructuredContent(), banp); err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not parse BaselineAdminNetworkPolicy: %v", err))
+		return
+	}
+	klog.V(5).Infof("Watch %s event for BaselineAdminNetworkPolicy %s", eventType, banp.Name)
+	if banp.Name != baselineAdminNetworkPolicyName {
+		klog.Warningf("Ignoring BaselineAdminNetworkPolicy %q; only %q is used", banp.Name, baselineAdminNetworkPolicyName)
+		return
+	}
+	if len(banp.Spec.Egress) > 0 {
+		np.rejectAdminPolicy(obj.(*unstructured.Unstructured), "egress rules are not supported")
+		np.handleDeleteBaselineAdminNetworkPolicy(obj)
+		return
+	}
+	if unsupported := adminPolicyUnsupportedFeatures(banp.Spec.Ingress); len(unsupported) > 0 {
+		klog.Warningf("Unsupported parts of BaselineAdminNetworkPolicy %s: %s", banp.Name, strings.Join(unsupported, "; "))
+	}
+
+	np.lock.Lock()
+	defer np.lock.Unlock()
+	np.adminPolicies.banp = banp
+	np.invalidateAdminPolicies()
+}
+
+func (np *networkPolicyPlugin) handleDeleteBaselineAdminNetworkPolicy(obj interface{}) {
+	name := obj.(*unstructured.Unstructured).GetName()
+	klog.V(5).Infof("Watch %s event for BaselineAdminNetworkPolicy %s", watch.Deleted, name)
+	if name != baselineAdminNetworkPolicyName {
+		return
+	}
+
+	np.lock.Lock()
+	defer np.lock.Unlock()
+	if np.adminPolicies.banp != nil {
+		np.adminPolicies.mustSync = true
+		np.runner.Run()
+		np.adminPolicies.banp = nil
+	}
+}
+
+// rejectAdminPolicy logs and records an event about an admin policy that is not
+// enforced at all, for reason
+func (np *networkPolicyPlugin) rejectAdminPolicy(obj *unstructured.Unstructured, reason string) {
+	klog.Warningf("Not enforcing %s %s: %s", obj.GetKind(), obj.GetName(), reason)
+	if np.node.recorder == nil {
+		return
+	}
+	ref := &corev1.ObjectReference{
+		APIVersion: obj.GetAPIVersion(),
+		Kind:       obj.GetKind(),
+		Name:       obj.GetName(),
+		UID:        obj.GetUID(),
+	}
+	np.node.recorder.Eventf(ref, corev1.EventTypeWarning, "PolicyRejected", "%s is not enforced on node %s: %s", obj.GetKind(), np.node.hostName, reason)
+}
+
+// adminPolicyUnsupportedFeatures returns a description of each part of an admin
+// policy's ingress rules that can't be converted to flows as written
+func adminPolicyUnsupportedFeatures(ingress []adminPolicyIngressRule) []string {
+	var unsupported []string
+	for _, rule := range ingress {
+		if rule.Action != anpActionAllow && rule.Action != anpActionDeny && rule.Action != anpActionPass {
+			unsupported = append(unsupported, fmt.Sprintf("rule %q has unrecognized action %q", rule.Name, rule.Action))
+		}
+		if rule.Ports == nil {
+			continue
+		}
+		for _, port := range *rule.Ports {
+			switch {
+			case port.NamedPort != nil:
+				unsupported = append(unsupported, fmt.Sprintf("rule %q: named port %q is not supported", rule.Name, *port.NamedPort))
+			case port.PortNumber != nil && adminPolicyProtocol(port.PortNumber.Protocol) == "":
+				unsupported = append(unsupported, fmt.Sprintf("rule %q: protocol %q is not supported", rule.Name, port.PortNumber.Protocol))
+			case port.PortRange != nil && adminPolicyProtocol(port.PortRange.Protocol) == "":
+				unsupported = append(unsupported, fmt.Sprintf("rule %q: protocol %q is not supported", rule.Name, port.PortRange.Protocol))
+			default:
+				continue
+			}
+			if rule.Action == anpActionDeny {
+				unsupported = append(unsupported, fmt.Sprintf("rule %q denies all ports instead", rule.Name))
+			} else {
+				unsupported = append(unsupported, fmt.Sprintf("rule %q ignores that port", rule.Name))
+			}
+		}
+	}
+	return unsupported
+}
+
+// generateAdminPolicyFlows regenerates tables 82 and 83 from the current admin
+// policies
+func (np *networkPolicyPlugin) generateAdminPolicyFlows(otx ovs.Transaction) {
+	otx.DeleteFlows("table=82")
+	otx.DeleteFlows("table=83")
+	otx.AddFlow("table=82, priority=0, actions=load:1->%s, resubmit(,80)", anpPassedReg)
+	otx.AddFlow("table=83, priority=0, actions=resubmit(,81)")
+
+	// Lower priority values take precedence; the spec leaves the order of policies
+	// with the same priority undefined, so they are ordered by name.
+	anps := make([]*adminNetworkPolicy, 0, len(np.adminPolicies.anps))
+	for _, anp := range np.adminPolicies.anps {
+		anps = append(anps, anp)
+	}
+	sort.Slice(anps, func(i, j int) bool {
+		if anps[i].Spec.Priority != anps[j].Spec.Priority {
+			return anps[i].Spec.Priority < anps[j].Spec.Priority
+		}
+		return anps[i].Name < anps[j].Name
+	})
+
+	priority := adminPolicyMaxPriority
+	for _, anp := range anps {
+		priority = np.generateAdminPolicyRuleFlows(otx, 82, priority, "AdminNetworkPolicy "+anp.Name, &anp.Spec.Subject, anp.Spec.Ingress)
+	}
+	if np.adminPolicies.banp != nil {
+		np.generateAdminPolicyRuleFlows(otx, 83, adminPolicyMaxPriority, "BaselineAdminNetworkPolicy "+np.adminPolicies.banp.Name, &np.adminPolicies.banp.Spec.Subject, np.adminPolicies.banp.Spec.Ingress)
+	}
+}
+
+// generateAdminPolicyRuleFlows adds the flows for a policy's ingress rules to table,
+// giving each rule its own priority, starting at priority. It returns the priority
+// for the next rule.
+func (np *networkPolicyPlugin) generateAdminPolicyRuleFlows(otx ovs.Transaction, table, priority int, policyName string, subject *adminPolicySubject, rules []adminPolicyIngressRule) int {
+	destFlows := np.selectAdminPolicySubject(subject)
+	for _, rule := range rules {
+		var action string
+		switch rule.Action {
+		case anpActionAllow:
+			action = "resubmit(,81)"
+		case anpActionDeny:
+			action = "drop"
+		case anpActionPass:
+			if table != 82 {
+				continue
+			}
+			action = fmt.Sprintf("load:1->%s, resubmit(,80)", anpPassedReg)
+		default:
+			continue
+		}
+		if priority <= 0 {
+			utilruntime.HandleError(fmt.Errorf("too many admin network policy rules; ignoring %s rule %q and later rules", policyName, rule.Name))
+			return priority
+		}
+
+		peerFlows := np.selectAdminPolicyPeers(rule.From)
+		portFlows, complete := adminPolicyPortFlows(rule.Ports)
+		if !complete && rule.Action == anpActionDeny {
+			// Deny too much rather than too little
+			portFlows = []string{""}
+		}
+		for _, destFlow := range destFlows {
+			for _, peerFlow := range peerFlows {
+				for _, portFlow := range portFlows {
+					for _, flow := range combinePolicyMatches(np.dualStack, destFlow, peerFlow, portFlow) {
+						otx.AddFlow("table=%d, priority=%d, %sactions=%s", table, priority, flow, action)
+					}
+				}
+			}
+		}
+		priority--
+	}
+	return priority
+}
+
+// selectAdminPolicySubject returns the destination matches for the pods selected by
+// subject. Since table 80 only sees traffic to local pods, only local pods are
+// matched when the subject selects pods.
+func (np *networkPolicyPlugin) selectAdminPolicySubject(subject *adminPolicySubject) []string {
+	var flows []string
+	if subject.Namespaces != nil {
+		sel, err := metav1.LabelSelectorAsSelector(subject.Namespaces)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("invalid admin network policy subject namespace selector: %v", err))
+			return nil
+		}
+		if sel.Empty() {
+			return []string{""}
+		}
+		for _, vnid := range np.selectNamespacesInternal(sel) {
+			flows = append(flows, fmt.Sprintf("reg1=%d, ", vnid))
+		}
+	} else if subject.Pods != nil {
+		for _, pod := range np.selectAdminPolicyPods(subject.Pods, true) {
+			for _, ip := range pod.ips() {
+				flows = append(flows, fmt.Sprintf("reg1=%d, %s, ", pod.vnid, ipMatch("dst", ip)))
+			}
+		}
+	}
+	sort.Strings(flows)
+	return flows
+}
+
+// selectAdminPolicyPeers returns the source matches for the pods selected by peers
+func (np *networkPolicyPlugin) selectAdminPolicyPeers(peers []adminPolicyPeer) []string {
+	var flows []string
+	for _, peer := range peers {
+		if peer.Namespaces != nil {
+			sel, err := metav1.LabelSelectorAsSelector(peer.Namespaces)
+			if err != nil {
+				utilruntime.HandleError(fmt.Errorf("invalid admin network policy peer namespace selector: %v", err))
+				continue
+			}
+			if sel.Empty() {
+				flows = append(flows, "")
+				continue
+			}
+			for _, vnid := range np.selectNamespacesInternal(sel) {
+				flows = append(flows, fmt.Sprintf("reg0=%d, ", vnid))
+			}
+		} else if peer.Pods != nil {
+			for _, pod := range np.selectAdminPolicyPods(peer.Pods, false) {
+				for _, ip := range pod.ips() {
+					flows = append(flows, fmt.Sprintf("reg0=%d, %s, ", pod.vnid, ipMatch("src", ip)))
+				}
+			}
+		}
+	}
+	sort.Strings(flows)
+	return flows
+}
+
+// selectAdminPolicyPods returns the pods selected by pods (only those on this node,
+// if localOnly is set), sorted by IP
+func (np *networkPolicyPlugin) selectAdminPolicyPods(pods *adminPolicyPods, localOnly bool) []npSelectedPod {
+	nsSel, err := metav1.LabelSelectorAsSelector(&pods.NamespaceSelector)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("invalid admin network policy namespace selector: %v", err))
+		return nil
+	}
+	podSel, err := metav1.LabelSelectorAsSelector(&pods.PodSelector)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("invalid admin network policy pod selector: %v", err))
+		return nil
+	}
+
+	var selected []npSelectedPod
+	podLister := np.node.kubeInformers.Core().V1().Pods().Lister()
+	for namespace, vnid := range np.selectNamespacesInternal(nsSel) {
+		pods, err := podLister.Pods(namespace).List(podSel)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("could not find matching pods in namespace %q: %v", namespace, err))
+			continue
+		}
+		for _, pod := range pods {
+			if isOnPodNetwork(pod) && (!localOnly || pod.Spec.NodeName == np.node.hostName) {
+				selected = append(selected, npSelectedPod{vnid: vnid, ip: pod.Status.PodIP, ipv6: podIPv6(pod)})
+			}
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].ip < selected[j].ip
+	})
+	return selected
+}
+
+// adminPolicyPortFlows returns the port matches for ports, and whether every port
+// could be converted to matches
+func adminPolicyPortFlows(ports *[]adminPolicyPort) ([]string, bool) {
+	if ports == nil {
+		return []string{""}, true
+	}
+	var flows []string
+	complete := true
+	for _, port := range *ports {
+		switch {
+		case port.PortNumber != nil:
+			if protocol := adminPolicyProtocol(port.PortNumber.Protocol); protocol != "" {
+				flows = append(flows, fmt.Sprintf("%s, tp_dst=%d, ", protocol, port.PortNumber.Port))
+			} else {
+				complete = false
+			}
+		case port.PortRange != nil:
+			if protocol := adminPolicyProtocol(port.PortRange.Protocol); protocol != "" {
+				for _, match := range portRangeMatches(int(port.PortRange.Start), int(port.PortRange.End)) {
+					flows = append(flows, fmt.Sprintf("%s, tp_dst=%s, ", protocol, match))
+				}
+			} else {
+				complete = false
+			}
+		default:
+			complete = false
+		}
+	}
+	return flows, complete
+}
+
+func adminPolicyProtocol(protocol corev1.Protocol) string {
+	switch protocol {
+	case "", corev1.ProtocolTCP:
+		return "tcp"
+	case corev1.ProtocolUDP:
+		return "udp"
+	case corev1.ProtocolSCTP:
+		return "sctp"
+	}
+	return ""
+}
+
+// portRangeMatches returns a minimal list of OVS port matches ("port" or
+// "port/mask") that together match exactly the ports from start to end
+func portRangeMatches(start, end int) []string {
+	var matches []string
+	for start <= end {
+		// Find the largest aligned block starting at start that doesn't go past end
+		size := 1
+		for start&(size<<1-1) == 0 && start+size<<1-1 <= end && size<<1 <= 0x10000 {
+			size <<= 1
+		}
+		if size == 1 {
+			matches = append(matches, fmt.Sprintf("%d", start))
+		} else {
+			matches = append(matches, fmt.Sprintf("0x%04x/0x%04x", start, 0xffff&^(size-1)))
+		}
+		start += size
+	}
+	return matches
+}
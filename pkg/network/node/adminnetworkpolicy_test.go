@@ -0,0 +1,260 @@
+package node
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/kubernetes/pkg/util/async"
+)
+
+func adminPolicyObject(t *testing.T, kind, spec string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal([]byte(spec), &obj.Object); err != nil {
+		t.Fatalf("bad test object: %v", err)
+	}
+	obj.SetAPIVersion("policy.networking.k8s.io/v1alpha1")
+	obj.SetKind(kind)
+	return obj
+}
+
+func TestAdminNetworkPolicyFlows(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+	kubeClient := fake.NewSimpleClientset()
+	np := &networkPolicyPlugin{
+		node: &OsdnNode{
+			oc:            oc,
+			hostName:      "node1",
+			kubeInformers: informers.NewSharedInformerFactory(kubeClient, time.Hour),
+		},
+		namespaces:       make(map[uint32]*npNamespace),
+		namespacesByName: make(map[string]*npNamespace),
+		nsMatchCache:     make(map[string]*npCacheEntry),
+		adminPolicies:    &npAdminPolicies{anps: make(map[string]*adminNetworkPolicy)},
+		runner:           async.NewBoundedFrequencyRunner("adminnetworkpolicy_test", func() {}, time.Second, time.Hour, 1),
+	}
+	for name, vnid := range map[string]uint32{"tenant": 10, "monitoring": 20, "untrusted": 30} {
+		np.namespaces[vnid] = &npNamespace{
+			name:            name,
+			vnid:            vnid,
+			labels:          map[string]string{"name": name},
+			gotNamespace:    true,
+			gotNetNamespace: true,
+		}
+	}
+	podStore := np.node.kubeInformers.Core().V1().Pods().Informer().GetStore()
+	for _, pod := range []*corev1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "local", Labels: map[string]string{"app": "db"}},
+			Spec:       corev1.PodSpec{NodeName: "node1"},
+			Status:     corev1.PodStatus{PodIP: "10.128.0.2"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "remote", Labels: map[string]string{"app": "db"}},
+			Spec:       corev1.PodSpec{NodeName: "node2"},
+			Status:     corev1.PodStatus{PodIP: "10.129.0.2"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "prometheus", Labels: map[string]string{"app": "prometheus"}},
+			Spec:       corev1.PodSpec{NodeName: "node2"},
+			Status:     corev1.PodStatus{PodIP: "10.129.0.5"},
+		},
+	} {
+		if err := podStore.Add(pod); err != nil {
+			t.Fatalf("unexpected error adding pod: %v", err)
+		}
+	}
+
+	np.handleAddOrUpdateAdminNetworkPolicy(adminPolicyObject(t, "AdminNetworkPolicy", `{
+		"metadata": {"name": "monitoring"},
+		"spec": {
+			"priority": 10,
+			"subject": {"namespaces": {}},
+			"ingress": [{
+				"name": "allow-prometheus",
+				"action": "Allow",
+				"from": [{"pods": {"namespaceSelector": {"matchLabels": {"name": "monitoring"}}, "podSelector": {"matchLabels": {"app": "prometheus"}}}}],
+				"ports": [{"portNumber": {"protocol": "TCP", "port": 9100}}]
+			}]
+		}
+	}`), nil, watch.Added)
+	np.handleAddOrUpdateAdminNetworkPolicy(adminPolicyObject(t, "AdminNetworkPolicy", `{
+		"metadata": {"name": "db"},
+		"spec": {
+			"priority": 20,
+			"subject": {"pods": {"namespaceSelector": {"matchLabels": {"name": "tenant"}}, "podSelector": {"matchLabels": {"app": "db"}}}},
+			"ingress": [{
+				"name": "deny-untrusted",
+				"action": "Deny",
+				"from": [{"namespaces": {"matchLabels": {"name": "untrusted"}}}],
+				"ports": [{"portRange": {"protocol": "TCP", "start": 5432, "end": 5439}}]
+			}, {
+				"name": "pass-tenant",
+				"action": "Pass",
+				"from": [{"namespaces": {"matchLabels": {"name": "tenant"}}}]
+			}]
+		}
+	}`), nil, watch.Added)
+	np.handleAddOrUpdateAdminNetworkPolicy(adminPolicyObject(t, "AdminNetworkPolicy", `{
+		"metadata": {"name": "named-ports"},
+		"spec": {
+			"priority": 30,
+			"subject": {"namespaces": {"matchLabels": {"name": "tenant"}}},
+			"ingress": [{
+				"name": "deny-untrusted-http",
+				"action": "Deny",
+				"from": [{"namespaces": {"matchLabels": {"name": "untrusted"}}}],
+				"ports": [{"namedPort": "http"}]
+			}, {
+				"name": "allow-monitoring-metrics",
+				"action": "Allow",
+				"from": [{"namespaces": {"matchLabels": {"name": "monitoring"}}}],
+				"ports": [{"namedPort": "metrics"}]
+			}]
+		}
+	}`), nil, watch.Added)
+	np.handleAddOrUpdateBaselineAdminNetworkPolicy(adminPolicyObject(t, "BaselineAdminNetworkPolicy", `{
+		"metadata": {"name": "default"},
+		"spec": {
+			"subject": {"namespaces": {"matchLabels": {"name": "tenant"}}},
+			"ingress": [{
+				"name": "deny-all",
+				"action": "Deny",
+				"from": [{"namespaces": {}}]
+			}]
+		}
+	}`), nil, watch.Added)
+	if !np.adminPolicies.mustSync {
+		t.Fatalf("admin policies not marked for sync")
+	}
+
+	otx := oc.NewTransaction()
+	np.generateAdminPolicyFlows(otx)
+	npns := np.namespaces[10]
+	npns.inUse = true
+	np.generateNamespaceFlows(otx, npns)
+	if err := otx.Commit(); err != nil {
+		t.Fatalf("unexpected error generating flows: %v", err)
+	}
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("unexpected error dumping flows: %v", err)
+	}
+
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{kind: flowAdded, match: []string{"table=82", "priority=0", "actions=load:1->NXM_NX_REG3[0],resubmit(,80)"}},
+		flowChange{kind: flowAdded, match: []string{"table=83", "priority=0", "actions=resubmit(,81)"}},
+		// The lowest-priority-value policy comes first, and applies to every namespace
+		flowChange{kind: flowAdded, match: []string{"table=82", "priority=60000", "reg0=20", "nw_src=10.129.0.5", "tp_dst=9100", "actions=resubmit(,81)"}, noMatch: []string{"reg1="}},
+		// Only the local pod is a subject, and the port range becomes masked matches
+		flowChange{kind: flowAdded, match: []string{"table=82", "priority=59999", "reg1=10", "nw_dst=10.128.0.2", "reg0=30", "tp_dst=0x1538/0xfff8", "actions=drop"}},
+		flowChange{kind: flowAdded, match: []string{"table=82", "priority=59998", "reg1=10", "nw_dst=10.128.0.2", "reg0=10", "actions=load:1->NXM_NX_REG3[0],resubmit(,80)"}},
+		// A Deny rule whose ports can't be converted denies all ports; an Allow rule
+		// allows none
+		flowChange{kind: flowAdded, match: []string{"table=82", "priority=59997", "reg1=10", "reg0=30", "actions=drop"}, noMatch: []string{"tp_dst"}},
+		flowChange{kind: flowAdded, match: []string{"table=83", "priority=60000", "reg1=10", "actions=drop"}},
+		// Traffic to pods with no NetworkPolicy goes to the baseline tier
+		flowChange{kind: flowAdded, match: []string{"table=80", "priority=50", "reg1=10", "actions=goto_table:83"}},
+	)
+	if err != nil {
+		t.Fatalf("unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	np.handleDeleteAdminNetworkPolicy(adminPolicyObject(t, "AdminNetworkPolicy", `{"metadata": {"name": "db"}}`))
+	if _, exists := np.adminPolicies.anps["db"]; exists {
+		t.Fatalf("AdminNetworkPolicy not deleted")
+	}
+}
+
+func TestPortRangeMatches(t *testing.T) {
+	for _, tc := range []struct {
+		start, end int
+		expected   []string
+	}{
+		{80, 80, []string{"80"}},
+		{5432, 5439, []string{"0x1538/0xfff8"}},
+		{1000, 1003, []string{"0x03e8/0xfffc"}},
+		{7, 9, []string{"7", "0x0008/0xfffe"}},
+		{0, 65535, []string{"0x0000/0x0000"}},
+	} {
+		if matches := portRangeMatches(tc.start, tc.end); !reflect.DeepEqual(matches, tc.expected) {
+			t.Errorf("%d-%d: expected %v, got %v", tc.start, tc.end, tc.expected, matches)
+		}
+	}
+}
+
+func TestAdminNetworkPolicyRejected(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	np := &networkPolicyPlugin{
+		node:          &OsdnNode{hostName: "node1", recorder: recorder},
+		adminPolicies: &npAdminPolicies{anps: make(map[string]*adminNetworkPolicy)},
+		runner:        async.NewBoundedFrequencyRunner("adminnetworkpolicy_test", func() {}, time.Second, time.Hour, 1),
+	}
+
+	ingress := `{
+		"metadata": {"name": "egress"},
+		"spec": {
+			"priority": 10,
+			"subject": {"namespaces": {}},
+			"ingress": [{"name": "deny-all", "action": "Deny", "from": [{"namespaces": {}}]}]
+		}
+	}`
+	np.handleAddOrUpdateAdminNetworkPolicy(adminPolicyObject(t, "AdminNetworkPolicy", ingress), nil, watch.Added)
+	if _, exists := np.adminPolicies.anps["egress"]; !exists {
+		t.Fatalf("AdminNetworkPolicy not added")
+	}
+
+	// Adding an egress rule makes the whole policy be rejected
+	egress := `{
+		"metadata": {"name": "egress"},
+		"spec": {
+			"priority": 10,
+			"subject": {"namespaces": {}},
+			"ingress": [{"name": "deny-all", "action": "Deny", "from": [{"namespaces": {}}]}],
+			"egress": [{"name": "deny-all", "action": "Deny", "to": [{"namespaces": {}}]}]
+		}
+	}`
+	np.handleAddOrUpdateAdminNetworkPolicy(adminPolicyObject(t, "AdminNetworkPolicy", egress), nil, watch.Modified)
+	if _, exists := np.adminPolicies.anps["egress"]; exists {
+		t.Fatalf("AdminNetworkPolicy with egress rules not rejected")
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "PolicyRejected") || !strings.Contains(event, "egress rules are not supported") {
+			t.Fatalf("unexpected event %q", event)
+		}
+	default:
+		t.Fatalf("no event for rejected AdminNetworkPolicy")
+	}
+}
+
+func TestAdminNetworkPolicyTierFlows(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+	np := &networkPolicyPlugin{node: &OsdnNode{oc: oc}, dualStack: true}
+
+	otx := oc.NewTransaction()
+	np.addAdminPolicyTierFlows(otx)
+	if err := otx.Commit(); err != nil {
+		t.Fatalf("unexpected error adding flows: %v", err)
+	}
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{kind: flowAdded, match: []string{"table=80", "priority=190", "ip", "reg3=0", "actions=goto_table:82"}, noMatch: []string{"ipv6"}},
+		flowChange{kind: flowAdded, match: []string{"table=80", "priority=190", "ipv6", "reg3=0", "actions=goto_table:82"}},
+	)
+	if err != nil {
+		t.Fatalf("unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+}
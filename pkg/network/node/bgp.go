@@ -0,0 +1,65 @@
+package node
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/sdn/pkg/util/bgp"
+)
+
+// parseBGPPeers parses OsdnNodeConfig.BGPPeers
+func parseBGPPeers(peers []string, peerAS uint32) ([]bgp.Peer, error) {
+	var bgpPeers []bgp.Peer
+	for _, peer := range peers {
+		host, port := peer, strconv.Itoa(bgp.Port)
+		if h, p, err := net.SplitHostPort(peer); err == nil {
+			host, port = h, p
+		}
+		if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid BGP peer %q: not an IPv4 address", peer)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return nil, fmt.Errorf("invalid BGP peer %q: bad port", peer)
+		}
+		bgpPeers = append(bgpPeers, bgp.Peer{Address: net.JoinHostPort(host, port), AS: peerAS})
+	}
+	return bgpPeers, nil
+}
+
+// startBGP starts advertising the node's HostSubnet to its BGP peers, with the node
+// IP as the next hop. restarted indicates that the node's OVS flows survived a
+// restart, so peers doing graceful restart can keep using our routes.
+func (node *OsdnNode) startBGP(restarted bool) error {
+	_, subnet, err := net.ParseCIDR(node.localSubnetCIDR)
+	if err != nil {
+		return err
+	}
+	speaker, err := bgp.NewSpeaker(bgp.Config{
+		LocalAS:  node.bgpLocalAS,
+		RouterID: net.ParseIP(node.localIP),
+		NextHop:  net.ParseIP(node.localIP),
+		Prefixes: []*net.IPNet{subnet},
+
+		GracefulRestartTime: node.bgpGRTime,
+		Restarted:           restarted,
+	}, node.bgpPeers)
+	if err != nil {
+		return fmt.Errorf("could not start BGP speaker: %v", err)
+	}
+	klog.Infof("Advertising HostSubnet %s to BGP peers %v", node.localSubnetCIDR, node.bgpPeers)
+	node.bgpSpeaker = speaker
+	node.bgpSpeaker.Run(utilwait.NeverStop)
+	node.AddHealthCheck("bgp", node.checkBGPHealth)
+	return nil
+}
+
+func (node *OsdnNode) checkBGPHealth() error {
+	if len(node.bgpSpeaker.Established()) == 0 {
+		return fmt.Errorf("no BGP session is established; other nodes can't reach this node's pods")
+	}
+	return nil
+}
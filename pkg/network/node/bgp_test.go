@@ -0,0 +1,28 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/openshift/sdn/pkg/util/bgp"
+)
+
+func TestParseBGPPeers(t *testing.T) {
+	peers, err := parseBGPPeers([]string{"192.168.0.1", "192.168.1.1:1179"}, 64512)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []bgp.Peer{
+		{Address: "192.168.0.1:179", AS: 64512},
+		{Address: "192.168.1.1:1179", AS: 64512},
+	}
+	if !reflect.DeepEqual(peers, expected) {
+		t.Fatalf("Expected %v, got %v", expected, peers)
+	}
+
+	for _, bad := range []string{"router.example.com", "fd00::1", "[fd00::1]:179", "192.168.0.1:http", "192.168.0.1:100000"} {
+		if _, err := parseBGPPeers([]string{bad}, 64512); err == nil {
+			t.Fatalf("Unexpected success parsing %q", bad)
+		}
+	}
+}
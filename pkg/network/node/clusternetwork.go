@@ -0,0 +1,146 @@
+package node
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
+
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/watch"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	osdninformers "github.com/openshift/client-go/network/informers/externalversions"
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// clusterNetworkWatcher handles clusterNetworks entries being added to or removed
+// from the ClusterNetwork while the node is running, so that pods can reach pods on
+// nodes whose HostSubnets were allocated from a newly-added clusterNetwork, and
+// changes to the egress IP failback delay. Other changes to the ClusterNetwork
+// still require restarting the node.
+//
+// Pods that are already running keep the routes they were created with, but since
+// those include a default route via the node's gateway, traffic to the new
+// clusterNetwork still reaches OVS.
+type clusterNetworkWatcher struct {
+	node *OsdnNode
+}
+
+func newClusterNetworkWatcher(node *OsdnNode) *clusterNetworkWatcher {
+	return &clusterNetworkWatcher{node: node}
+}
+
+func (cnw *clusterNetworkWatcher) Start(osdnInformers osdninformers.SharedInformerFactory) {
+	funcs := common.InformerFuncs(&osdnv1.ClusterNetwork{}, cnw.handleAddOrUpdateClusterNetwork, nil)
+	osdnInformers.Network().V1().ClusterNetworks().Informer().AddEventHandler(funcs)
+}
+
+func (cnw *clusterNetworkWatcher) handleAddOrUpdateClusterNetwork(obj, _ interface{}, eventType watch.EventType) {
+	cn := obj.(*osdnv1.ClusterNetwork)
+	if cn.Name != osdnv1.ClusterNetworkDefault {
+		return
+	}
+	klog.V(5).Infof("Watch %s event for ClusterNetwork %q", eventType, cn.Name)
+
+	// Changes only take effect once the master has accepted them
+	cn = common.GetAcceptedClusterNetwork(cn)
+	if err := common.ValidateClusterNetwork(cn); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Ignoring invalid ClusterNetwork: %v", err))
+		return
+	}
+	pcn, err := common.ParseClusterNetwork(cn)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Ignoring invalid ClusterNetwork: %v", err))
+		return
+	}
+
+	if err := cnw.updateClusterCIDRs(pcn); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Error updating clusterNetworks: %v", err))
+	}
+	cnw.node.egressIP.tracker.SetFailbackDelay(pcn.EgressIPFailbackDelay)
+}
+
+func (cnw *clusterNetworkWatcher) updateClusterCIDRs(pcn *common.ParsedClusterNetwork) error {
+	node := cnw.node
+
+	oldCIDRs := node.getClusterCIDRs()
+	newCIDRs := make([]string, 0, len(pcn.ClusterNetworks))
+	for _, cn := range pcn.ClusterNetworks {
+		newCIDRs = append(newCIDRs, cn.ClusterCIDR.String())
+	}
+	added := sets.NewString(newCIDRs...).Difference(sets.NewString(oldCIDRs...))
+	removed := sets.NewString(oldCIDRs...).Difference(sets.NewString(newCIDRs...))
+	if added.Len() == 0 && removed.Len() == 0 {
+		return nil
+	}
+
+	_, localSubnet, err := net.ParseCIDR(node.localSubnetCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid local subnet CIDR: %v", err)
+	}
+	localSubnetGateway := common.GenerateDefaultGateway(localSubnet).String()
+
+	errList := []error{}
+	for _, cidr := range added.List() {
+		klog.Infof("Adding clusterNetwork %s", cidr)
+		if err := node.oc.AddClusterNetworkRules(cidr, node.localSubnetCIDR, localSubnetGateway); err != nil {
+			errList = append(errList, fmt.Errorf("error adding OVS flows for clusterNetwork %s: %v", cidr, err))
+		}
+		if err := updateClusterNetworkRoute(cidr, true); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	for _, cidr := range removed.List() {
+		klog.Infof("Removing clusterNetwork %s", cidr)
+		if err := node.oc.DeleteClusterNetworkRules(cidr); err != nil {
+			errList = append(errList, fmt.Errorf("error deleting OVS flows for clusterNetwork %s: %v", cidr, err))
+		}
+		if err := updateClusterNetworkRoute(cidr, false); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	if np, ok := node.policy.(*networkPolicyPlugin); ok {
+		if err := np.updateClusterNetworkFlows(added.List(), removed.List()); err != nil {
+			errList = append(errList, fmt.Errorf("error updating NetworkPolicy flows for clusterNetworks: %v", err))
+		}
+	}
+
+	node.setClusterCIDRs(newCIDRs)
+	if err := node.nodeIPTables.SetClusterNetworkCIDRs(newCIDRs); err != nil {
+		errList = append(errList, fmt.Errorf("error updating iptables rules for clusterNetworks: %v", err))
+	}
+
+	return kerrors.NewAggregate(errList)
+}
+
+// updateClusterNetworkRoute adds or deletes the route to clusterCIDR via tun0
+func updateClusterNetworkRoute(clusterCIDR string, add bool) error {
+	l, err := netlink.LinkByName(Tun0)
+	if err != nil {
+		return fmt.Errorf("could not get interface %s: %v", Tun0, err)
+	}
+	dst, err := netlink.ParseIPNet(clusterCIDR)
+	if err != nil {
+		return err
+	}
+	route := &netlink.Route{
+		LinkIndex: l.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       dst,
+	}
+	if add {
+		if err := netlink.RouteAdd(route); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("could not add route to %s: %v", clusterCIDR, err)
+		}
+	} else {
+		if err := netlink.RouteDel(route); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("could not delete route to %s: %v", clusterCIDR, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,412 @@
+package node
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	// DefaultConnectionLogQPS is the default limit on the number of connection
+	// records written per second. Connections beyond this rate are counted but
+	// not logged.
+	DefaultConnectionLogQPS = 100.0
+
+	// DefaultConnectionLogMaxSize is the default size (in bytes) at which the
+	// connection log is rotated
+	DefaultConnectionLogMaxSize = 100 * 1024 * 1024
+
+	connectionLogBurst = 1000
+
+	// connectionLogBackups is the number of rotated connection logs to keep
+	connectionLogBackups = 5
+
+	// connectionVerdictDenied is the connectionRecord.Verdict of traffic dropped by
+	// NetworkPolicy
+	connectionVerdictDenied = "denied"
+
+	// serviceClusterIPIndex is the name of the Service informer index by cluster IP
+	serviceClusterIPIndex = "clusterIP"
+)
+
+// connectionEvent is the parsed form of a conntrack NEW event
+type connectionEvent struct {
+	protocol string
+	srcIP    string
+	dstIP    string
+	srcPort  string
+	dstPort  string
+	// replySrcIP and replySrcPort are the source of the reply direction, which
+	// differ from dstIP and dstPort if the connection was DNATted (eg, to a
+	// service endpoint)
+	replySrcIP   string
+	replySrcPort string
+}
+
+// connectionRecord is the structured log entry written for each new connection
+type connectionRecord struct {
+	Time     string `json:"time"`
+	Protocol string `json:"protocol"`
+	SrcIP    string `json:"srcIP"`
+	SrcPort  string `json:"srcPort,omitempty"`
+	DstIP    string `json:"dstIP"`
+	DstPort  string `json:"dstPort,omitempty"`
+
+	SrcNamespace string `json:"srcNamespace,omitempty"`
+	SrcPod       string `json:"srcPod,omitempty"`
+	DstNamespace string `json:"dstNamespace,omitempty"`
+	DstPod       string `json:"dstPod,omitempty"`
+	DstService   string `json:"dstService,omitempty"`
+	// EndpointIP and EndpointPort are set when the destination was a service
+	EndpointIP   string `json:"endpointIP,omitempty"`
+	EndpointPort string `json:"endpointPort,omitempty"`
+
+	// Verdict is "denied" for traffic dropped by NetworkPolicy. Records of new
+	// connections from conntrack have no verdict, since some connections (eg, to
+	// services) are tracked by the host before NetworkPolicy is applied to them.
+	Verdict string `json:"verdict,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// connectionLogger monitors conntrack for new connections to or from pods, and the
+// NetworkPolicy deny logger for traffic dropped by policy, and writes a JSON record
+// describing each one, for consumption by audit tooling
+type connectionLogger struct {
+	node    *OsdnNode
+	path    string
+	maxSize int64
+	limiter flowcontrol.RateLimiter
+
+	lock       sync.Mutex
+	out        io.Writer
+	suppressed int
+}
+
+func newConnectionLogger(node *OsdnNode, path string, qps float64, maxSize int64) *connectionLogger {
+	return &connectionLogger{
+		node:    node,
+		path:    path,
+		maxSize: maxSize,
+		limiter: flowcontrol.NewTokenBucketRateLimiter(float32(qps), connectionLogBurst),
+	}
+}
+
+func (cl *connectionLogger) Start() error {
+	f, err := openRotatingFile(cl.path, cl.maxSize, connectionLogBackups)
+	if err != nil {
+		return fmt.Errorf("could not open connection log: %v", err)
+	}
+	cl.out = f
+
+	// Index the Pod and Service informers by IP (which also makes sure that they
+	// get started). The NetworkPolicy plugin may have added podIPIndex already.
+	if err := addPodIPIndex(cl.node.kubeInformers.Core().V1().Pods().Informer()); err != nil {
+		return fmt.Errorf("could not index pods by IP: %v", err)
+	}
+	err = cl.node.kubeInformers.Core().V1().Services().Informer().AddIndexers(cache.Indexers{serviceClusterIPIndex: serviceClusterIPIndexFunc})
+	if err != nil {
+		return fmt.Errorf("could not index services by IP: %v", err)
+	}
+
+	go utilwait.Forever(cl.monitor, 10*time.Second)
+	go utilwait.Forever(cl.reportSuppressed, time.Minute)
+	klog.Infof("Logging new pod connections to %s", cl.path)
+	return nil
+}
+
+// monitor runs "conntrack -E" until it exits, logging each new connection
+func (cl *connectionLogger) monitor() {
+	cmd := cl.node.execer.Command("conntrack", "-E", "-e", "NEW")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not monitor connections: %v", err))
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not monitor connections: %v", err))
+		return
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		ev, err := parseConnectionEvent(line)
+		if err != nil {
+			klog.V(5).Infof("Ignoring conntrack event: %v", err)
+			continue
+		}
+		cl.log(ev)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		utilruntime.HandleError(fmt.Errorf("connection monitor exited: %v", err))
+	}
+}
+
+// parseConnectionEvent parses a line of "conntrack -E" output; eg:
+//
+//	[NEW] tcp      6 120 SYN_SENT src=10.128.0.5 dst=172.30.0.10 sport=43210 dport=80 [UNREPLIED] src=10.129.0.7 dst=10.128.0.5 sport=8080 dport=43210 zone=1
+//
+// The first set of addresses is the original direction and the second is the reply.
+func parseConnectionEvent(line string) (*connectionEvent, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "[NEW]" {
+		return nil, fmt.Errorf("not a NEW event: %q", line)
+	}
+	ev := &connectionEvent{protocol: fields[1]}
+
+	var replySrcSeen bool
+	for _, field := range fields[2:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "src":
+			if ev.srcIP == "" {
+				ev.srcIP = kv[1]
+			} else if !replySrcSeen {
+				ev.replySrcIP = kv[1]
+				replySrcSeen = true
+			}
+		case "dst":
+			if ev.dstIP == "" {
+				ev.dstIP = kv[1]
+			}
+		case "sport":
+			if ev.srcPort == "" {
+				ev.srcPort = kv[1]
+			} else if replySrcSeen && ev.replySrcPort == "" {
+				ev.replySrcPort = kv[1]
+			}
+		case "dport":
+			if ev.dstPort == "" {
+				ev.dstPort = kv[1]
+			}
+		}
+	}
+	if ev.srcIP == "" || ev.dstIP == "" {
+		return nil, fmt.Errorf("event %q has no addresses", line)
+	}
+	return ev, nil
+}
+
+// reportSuppressed logs the number of connections that were not logged due to
+// rate limiting since the last report
+func (cl *connectionLogger) reportSuppressed() {
+	cl.lock.Lock()
+	suppressed := cl.suppressed
+	cl.suppressed = 0
+	cl.lock.Unlock()
+
+	if suppressed > 0 {
+		klog.Warningf("Connection log rate limit exceeded; %d connections were not logged", suppressed)
+	}
+}
+
+func (cl *connectionLogger) log(ev *connectionEvent) {
+	srcIP := net.ParseIP(ev.srcIP)
+	dstIP := net.ParseIP(ev.dstIP)
+	if srcIP == nil || dstIP == nil {
+		return
+	}
+	ni := cl.node.networkInfo
+	if !ni.PodNetworkContains(srcIP) && !ni.PodNetworkContains(dstIP) && !ni.ServiceNetworkContains(dstIP) {
+		return
+	}
+
+	if cl.allow() {
+		cl.write(cl.describeConnection(ev))
+	}
+}
+
+// logDenied logs a packet dropped by NetworkPolicy, as reported by the deny logger
+func (cl *connectionLogger) logDenied(pkt *deniedPacket) {
+	if !cl.allow() {
+		return
+	}
+	rec := &connectionRecord{
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		Protocol: pkt.protocol,
+		SrcIP:    pkt.srcIP,
+		SrcPort:  pkt.srcPort,
+		DstIP:    pkt.dstIP,
+		DstPort:  pkt.dstPort,
+		Verdict:  connectionVerdictDenied,
+		Reason:   "dropped by NetworkPolicy",
+	}
+	if pod := cl.findPod(pkt.srcIP); pod != nil {
+		rec.SrcNamespace, rec.SrcPod = pod.Namespace, pod.Name
+	}
+	if pod := cl.findPod(pkt.dstIP); pod != nil {
+		rec.DstNamespace, rec.DstPod = pod.Namespace, pod.Name
+	}
+	cl.write(rec)
+}
+
+// allow applies the rate limit, counting the records that are suppressed
+func (cl *connectionLogger) allow() bool {
+	if cl.limiter.TryAccept() {
+		return true
+	}
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	cl.suppressed++
+	return false
+}
+
+func (cl *connectionLogger) write(rec *connectionRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not encode connection record: %v", err))
+		return
+	}
+	data = append(data, '\n')
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if _, err := cl.out.Write(data); err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not write connection log: %v", err))
+	}
+}
+
+// describeConnection fills in the pod and service information for a connection
+func (cl *connectionLogger) describeConnection(ev *connectionEvent) *connectionRecord {
+	rec := &connectionRecord{
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		Protocol: ev.protocol,
+		SrcIP:    ev.srcIP,
+		SrcPort:  ev.srcPort,
+		DstIP:    ev.dstIP,
+		DstPort:  ev.dstPort,
+	}
+	if pod := cl.findPod(ev.srcIP); pod != nil {
+		rec.SrcNamespace, rec.SrcPod = pod.Namespace, pod.Name
+	}
+
+	endpointIP, endpointPort := ev.dstIP, ev.dstPort
+	if dstIP := net.ParseIP(ev.dstIP); dstIP != nil && cl.node.networkInfo.ServiceNetworkContains(dstIP) {
+		if svc := cl.findService(ev.dstIP); svc != nil {
+			rec.DstNamespace, rec.DstService = svc.Namespace, svc.Name
+		}
+		if ev.replySrcIP != "" && ev.replySrcIP != ev.dstIP {
+			endpointIP, endpointPort = ev.replySrcIP, ev.replySrcPort
+			rec.EndpointIP, rec.EndpointPort = endpointIP, endpointPort
+		}
+	}
+	if dstPod := cl.findPod(endpointIP); dstPod != nil {
+		rec.DstNamespace, rec.DstPod = dstPod.Namespace, dstPod.Name
+	}
+	return rec
+}
+
+func (cl *connectionLogger) findPod(ip string) *corev1.Pod {
+	objs, err := cl.node.kubeInformers.Core().V1().Pods().Informer().GetIndexer().ByIndex(podIPIndex, ip)
+	if err != nil || len(objs) == 0 {
+		return nil
+	}
+	return objs[0].(*corev1.Pod)
+}
+
+func serviceClusterIPIndexFunc(obj interface{}) ([]string, error) {
+	svc, ok := obj.(*corev1.Service)
+	if !ok || svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == corev1.ClusterIPNone {
+		return nil, nil
+	}
+	return []string{svc.Spec.ClusterIP}, nil
+}
+
+func (cl *connectionLogger) findService(ip string) *corev1.Service {
+	objs, err := cl.node.kubeInformers.Core().V1().Services().Informer().GetIndexer().ByIndex(serviceClusterIPIndex, ip)
+	if err != nil || len(objs) == 0 {
+		return nil
+	}
+	return objs[0].(*corev1.Service)
+}
+
+// rotatingFile is an append-only file that is renamed to "<path>.1" (after renaming
+// the older backups to "<path>.2", etc) once it would grow beyond maxSize
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file, rf.size = f, info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.file.Close()
+	rf.file = nil
+	for i := rf.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	var err error
+	if rf.backups > 0 {
+		err = os.Rename(rf.path, rf.path+".1")
+	} else {
+		err = os.Remove(rf.path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return rf.open()
+}
+
+// Write writes data to the file, rotating it first if necessary. The caller must
+// serialize calls.
+func (rf *rotatingFile) Write(data []byte) (int, error) {
+	if rf.file == nil {
+		// A previous rotation failed to reopen the file
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(data)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, fmt.Errorf("could not rotate %s: %v", rf.path, err)
+		}
+	}
+	n, err := rf.file.Write(data)
+	rf.size += int64(n)
+	return n, err
+}
@@ -0,0 +1,118 @@
+package node
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseConnectionEvent(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		result *connectionEvent
+	}{
+		{
+			name: "TCP to service",
+			line: "[NEW] tcp      6 120 SYN_SENT src=10.128.0.5 dst=172.30.0.10 sport=43210 dport=80 [UNREPLIED] src=10.129.0.7 dst=10.128.0.5 sport=8080 dport=43210",
+			result: &connectionEvent{
+				protocol:     "tcp",
+				srcIP:        "10.128.0.5",
+				dstIP:        "172.30.0.10",
+				srcPort:      "43210",
+				dstPort:      "80",
+				replySrcIP:   "10.129.0.7",
+				replySrcPort: "8080",
+			},
+		},
+		{
+			name: "UDP to pod",
+			line: "[NEW] udp      17 30 src=10.128.0.5 dst=10.128.0.6 sport=5353 dport=53 [UNREPLIED] src=10.128.0.6 dst=10.128.0.5 sport=53 dport=5353 zone=1",
+			result: &connectionEvent{
+				protocol:     "udp",
+				srcIP:        "10.128.0.5",
+				dstIP:        "10.128.0.6",
+				srcPort:      "5353",
+				dstPort:      "53",
+				replySrcIP:   "10.128.0.6",
+				replySrcPort: "53",
+			},
+		},
+		{
+			name: "ICMP",
+			line: "[NEW] icmp     1 30 src=10.128.0.5 dst=10.129.0.3 type=8 code=0 id=1 [UNREPLIED] src=10.129.0.3 dst=10.128.0.5 type=0 code=0 id=1",
+			result: &connectionEvent{
+				protocol:   "icmp",
+				srcIP:      "10.128.0.5",
+				dstIP:      "10.129.0.3",
+				replySrcIP: "10.129.0.3",
+			},
+		},
+		{
+			name:   "not NEW",
+			line:   "[DESTROY] tcp      6 src=10.128.0.5 dst=10.128.0.6 sport=43210 dport=80 src=10.128.0.6 dst=10.128.0.5 sport=80 dport=43210",
+			result: nil,
+		},
+		{
+			name:   "no addresses",
+			line:   "[NEW] tcp      6 120 SYN_SENT",
+			result: nil,
+		},
+	}
+
+	for _, test := range tests {
+		ev, err := parseConnectionEvent(test.line)
+		if test.result == nil {
+			if err == nil {
+				t.Errorf("%s: expected error, got %#v", test.name, ev)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !reflect.DeepEqual(ev, test.result) {
+			t.Errorf("%s: expected %#v, got %#v", test.name, test.result, ev)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "connection-log")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "connections.log")
+
+	rf, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("could not open file: %v", err)
+	}
+	// Each write of 6 bytes rotates the file, except into an empty one
+	for i := 0; i < 4; i++ {
+		if _, err := fmt.Fprintf(rf, "line%d\n", i); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "line3\n",
+		path + ".1": "line2\n",
+		path + ".2": "line1\n",
+	}
+	for file, contents := range expected {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("could not read %s: %v", file, err)
+		}
+		if string(data) != contents {
+			t.Errorf("expected %s to contain %q, got %q", file, contents, string(data))
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups, got %v", err)
+	}
+}
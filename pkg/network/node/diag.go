@@ -0,0 +1,234 @@
+package node
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/kubernetes/pkg/util/iptables"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+// diagFile is a single file in the diagnostic archive
+type diagFile struct {
+	name string
+	data []byte
+}
+
+// egressIPDiagState is the egress IP state included in the diagnostic archive
+type egressIPDiagState struct {
+	Synced          bool                `json:"synced"`
+	LocalEgressIPs  map[string]string   `json:"localEgressIPs"`
+	FailedEgressIPs []string            `json:"failedEgressIPs,omitempty"`
+	MonitoredNodes  map[string][]string `json:"monitoredNodes,omitempty"`
+	OfflineNodes    []string            `json:"offlineNodes,omitempty"`
+}
+
+// collectDiagnostics gathers the node's OVS, iptables, cache, and egress IP state.
+// Cached objects are reduced to the fields that describe the SDN configuration;
+// their metadata (other than the name) is not included.
+// A file that cannot be collected is replaced by a ".error" file describing the
+// problem, so that one failure doesn't prevent collecting everything else.
+func (node *OsdnNode) collectDiagnostics() []diagFile {
+	files := []diagFile{}
+	add := func(name string, collect func() ([]byte, error)) {
+		data, err := collect()
+		if err != nil {
+			files = append(files, diagFile{name: name + ".error", data: []byte(err.Error() + "\n")})
+		} else {
+			files = append(files, diagFile{name: name, data: data})
+		}
+	}
+
+	add("ovs-flows.txt", func() ([]byte, error) {
+		flows, err := node.oc.ovs.DumpFlows("")
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.Join(flows, "\n") + "\n"), nil
+	})
+	add("ovs-ports.json", func() ([]byte, error) {
+		ports, err := node.oc.ovs.Find("interface", []string{"name", "ofport", "external_ids"}, "name!=\"\"")
+		if err != nil {
+			return nil, err
+		}
+		return marshalDiag(ports)
+	})
+	add("iptables.txt", node.collectIPTables)
+	add("hostsubnets.json", func() ([]byte, error) {
+		subnets, err := node.osdnInformers.Network().V1().HostSubnets().Lister().List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(subnets, func(i, j int) bool { return subnets[i].Name < subnets[j].Name })
+		sanitized := make([]*osdnv1.HostSubnet, 0, len(subnets))
+		for _, hs := range subnets {
+			sanitized = append(sanitized, &osdnv1.HostSubnet{
+				ObjectMeta:  metav1.ObjectMeta{Name: hs.Name},
+				Host:        hs.Host,
+				HostIP:      hs.HostIP,
+				Subnet:      hs.Subnet,
+				EgressIPs:   hs.EgressIPs,
+				EgressCIDRs: hs.EgressCIDRs,
+			})
+		}
+		return marshalDiag(sanitized)
+	})
+	add("netnamespaces.json", func() ([]byte, error) {
+		netnss, err := node.osdnInformers.Network().V1().NetNamespaces().Lister().List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(netnss, func(i, j int) bool { return netnss[i].Name < netnss[j].Name })
+		sanitized := make([]*osdnv1.NetNamespace, 0, len(netnss))
+		for _, netns := range netnss {
+			sanitized = append(sanitized, &osdnv1.NetNamespace{
+				ObjectMeta: metav1.ObjectMeta{Name: netns.Name},
+				NetName:    netns.NetName,
+				NetID:      netns.NetID,
+				EgressIPs:  netns.EgressIPs,
+			})
+		}
+		return marshalDiag(sanitized)
+	})
+	add("vnids.json", func() ([]byte, error) {
+		var vnids *nodeVNIDMap
+		switch policy := node.policy.(type) {
+		case *multiTenantPlugin:
+			vnids = policy.vnids
+		case *networkPolicyPlugin:
+			vnids = policy.vnids
+		default:
+			return nil, fmt.Errorf("%s plugin does not use VNIDs", node.policy.Name())
+		}
+		return marshalDiag(vnids.getVNIDs())
+	})
+	if node.policy.SupportsVNIDs() {
+		add("egressips.json", func() ([]byte, error) {
+			return marshalDiag(node.egressIP.diagState())
+		})
+	}
+
+	return files
+}
+
+// collectIPTables returns the openshift-sdn and kube-proxy chains from each table
+func (node *OsdnNode) collectIPTables() ([]byte, error) {
+	var out bytes.Buffer
+	for _, table := range []iptables.Table{iptables.TableFilter, iptables.TableNAT, iptables.TableMangle} {
+		var buf bytes.Buffer
+		if err := node.ipt.SaveInto(table, &buf); err != nil {
+			return nil, fmt.Errorf("could not save %s table: %v", table, err)
+		}
+		fmt.Fprintf(&out, "*%s\n", table)
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.Contains(line, "OPENSHIFT-") || strings.Contains(line, "KUBE-") {
+				fmt.Fprintf(&out, "%s\n", line)
+			}
+		}
+	}
+	return out.Bytes(), nil
+}
+
+func marshalDiag(obj interface{}) ([]byte, error) {
+	data, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// getVNIDs returns a copy of the namespace-to-VNID map
+func (vmap *nodeVNIDMap) getVNIDs() map[string]uint32 {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+
+	ids := make(map[string]uint32, len(vmap.ids))
+	for name, id := range vmap.ids {
+		ids[name] = id
+	}
+	return ids
+}
+
+func (eip *egressIPWatcher) diagState() *egressIPDiagState {
+	state := &egressIPDiagState{
+		LocalEgressIPs: make(map[string]string),
+		MonitoredNodes: make(map[string][]string),
+	}
+
+	eip.statusLock.Lock()
+	state.Synced = eip.synced
+	state.FailedEgressIPs = eip.failedEgressIPs.List()
+	eip.statusLock.Unlock()
+
+	if eip.iptables != nil {
+		eip.iptables.mu.Lock()
+		for egressIP, mark := range eip.iptables.egressIPs {
+			state.LocalEgressIPs[egressIP] = mark
+		}
+		eip.iptables.mu.Unlock()
+	}
+
+	eip.monitorNodesLock.Lock()
+	for nodeIP, node := range eip.monitorNodes {
+		state.MonitoredNodes[nodeIP] = node.egressIPs.List()
+		if node.offline {
+			state.OfflineNodes = append(state.OfflineNodes, nodeIP)
+		}
+	}
+	eip.monitorNodesLock.Unlock()
+	sort.Strings(state.OfflineNodes)
+
+	return state
+}
+
+// ServeDiagnostics is an HTTP handler returning the output of collectDiagnostics as
+// a gzipped tar archive.
+func (node *OsdnNode) ServeDiagnostics(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	dir := fmt.Sprintf("sdn-diag-%s-%s", node.hostName, now.UTC().Format("20060102-150405"))
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, file := range node.collectDiagnostics() {
+		hdr := &tar.Header{
+			Name:    dir + "/" + file.name,
+			Mode:    0644,
+			Size:    int64(len(file.data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tw.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := gzw.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", dir+".tar.gz"))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not write diagnostics: %v", err))
+	}
+}
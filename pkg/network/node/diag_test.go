@@ -0,0 +1,111 @@
+package node
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/pkg/util/iptables"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	osdninformers "github.com/openshift/client-go/network/informers/externalversions"
+)
+
+// fakeSaveIPTables implements just enough of iptables.Interface for collectIPTables
+type fakeSaveIPTables struct {
+	iptables.Interface
+	tables map[iptables.Table]string
+}
+
+func (f *fakeSaveIPTables) SaveInto(table iptables.Table, buffer *bytes.Buffer) error {
+	buffer.WriteString(f.tables[table])
+	return nil
+}
+
+func TestServeDiagnostics(t *testing.T) {
+	_, oc, _ := setupOVSController(t)
+	mp := NewMultiTenantPlugin().(*multiTenantPlugin)
+	mp.vnids = newNodeVNIDMap(mp, nil)
+	mp.vnids.setVNID("alpha", 11, false)
+
+	osdnInformers := osdninformers.NewSharedInformerFactory(nil, 0)
+	hs := makeHostSubnet("node1", "192.168.0.2", "10.128.0.0/23")
+	hs.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "sdn-controller"}}
+	hs.Annotations = map[string]string{"example.com/secret": "hunter2"}
+	osdnInformers.Network().V1().HostSubnets().Informer().GetIndexer().Add(hs)
+	osdnInformers.Network().V1().NetNamespaces().Informer().GetIndexer().Add(&osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "alpha"},
+		NetName:    "alpha",
+		NetID:      11,
+	})
+
+	node := &OsdnNode{
+		hostName:      "node0",
+		oc:            oc,
+		policy:        mp,
+		osdnInformers: osdnInformers,
+		egressIP:      newEgressIPWatcher(oc, "172.17.0.4", nil),
+		ipt: &fakeSaveIPTables{
+			tables: map[iptables.Table]string{
+				iptables.TableFilter: "*filter\n:INPUT ACCEPT [0:0]\n:OPENSHIFT-FIREWALL-ALLOW - [0:0]\n-A INPUT -j OPENSHIFT-FIREWALL-ALLOW\n-A INPUT -j SOMETHING-ELSE\nCOMMIT\n",
+			},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	node.ServeDiagnostics(w, httptest.NewRequest("GET", "/debug/diag", nil))
+	if w.Code != 200 {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+
+	gzr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("could not read gzip data: %v", err)
+	}
+	files := make(map[string]string)
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("could not read tar data: %v", err)
+		}
+		if !strings.HasPrefix(hdr.Name, "sdn-diag-node0-") {
+			t.Fatalf("unexpected file name %q", hdr.Name)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("could not read %s: %v", hdr.Name, err)
+		}
+		files[path.Base(hdr.Name)] = string(data)
+	}
+
+	for _, name := range []string{"ovs-flows.txt", "ovs-ports.json", "iptables.txt", "hostsubnets.json", "netnamespaces.json", "vnids.json", "egressips.json"} {
+		if _, ok := files[name]; !ok {
+			t.Fatalf("archive is missing %s (has %v)", name, files)
+		}
+	}
+
+	if !strings.Contains(files["ovs-flows.txt"], "table=253") {
+		t.Fatalf("unexpected OVS flows %q", files["ovs-flows.txt"])
+	}
+	if files["iptables.txt"] != "*filter\n:OPENSHIFT-FIREWALL-ALLOW - [0:0]\n-A INPUT -j OPENSHIFT-FIREWALL-ALLOW\n*nat\n*mangle\n" {
+		t.Fatalf("unexpected iptables %q", files["iptables.txt"])
+	}
+	if strings.Contains(files["hostsubnets.json"], "managedFields") || strings.Contains(files["hostsubnets.json"], "hunter2") || !strings.Contains(files["hostsubnets.json"], "10.128.0.0/23") {
+		t.Fatalf("unexpected HostSubnets %q", files["hostsubnets.json"])
+	}
+	vnids := map[string]uint32{}
+	if err := json.Unmarshal([]byte(files["vnids.json"]), &vnids); err != nil || len(vnids) != 1 || vnids["alpha"] != 11 {
+		t.Fatalf("unexpected VNIDs %q (%v)", files["vnids.json"], err)
+	}
+}
@@ -0,0 +1,160 @@
+package node
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+const (
+	// DirectAttachAnnotation, when set to "true" on a Namespace, makes its pods
+	// directly reachable on the nodes' underlay network: their off-cluster traffic
+	// leaves the node with the pod's IP rather than being masqueraded to the node's.
+	// The pods are otherwise attached to OVS as usual, so their traffic is still
+	// subject to NetworkPolicy, EgressNetworkPolicy, and egress IPs (which take
+	// precedence). For replies to reach the pods, the underlay network must route
+	// each node's HostSubnet to the node.
+	//
+	// Since the traffic is matched by VNID, namespaces with the global VNID
+	// (including all namespaces in the subnet plugin) can't use direct-attach.
+	DirectAttachAnnotation = "network.openshift.io/direct-attach"
+)
+
+// getDirectAttachMode returns whether namespace uses direct-attach
+func getDirectAttachMode(namespace *corev1.Namespace) (bool, error) {
+	value, ok := namespace.Annotations[DirectAttachAnnotation]
+	if !ok || value == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %q annotation %q on namespace %s: must be \"true\" or \"false\"",
+			DirectAttachAnnotation, value, namespace.Name)
+	}
+	return enabled, nil
+}
+
+// directAttachNamespaces tracks the namespaces using direct-attach, and the VNIDs
+// whose flows are installed for them
+type directAttachNamespaces struct {
+	lock sync.Mutex
+	// namespaces maps each direct-attach namespace to its VNID
+	namespaces map[string]uint32
+}
+
+func newDirectAttachNamespaces() *directAttachNamespaces {
+	return &directAttachNamespaces{
+		namespaces: make(map[string]uint32),
+	}
+}
+
+// vnidInUse returns whether any direct-attach namespace has vnid. Must be called
+// with the lock held.
+func (da *directAttachNamespaces) vnidInUse(vnid uint32) bool {
+	for _, id := range da.namespaces {
+		if id == vnid {
+			return true
+		}
+	}
+	return false
+}
+
+func (node *OsdnNode) watchDirectAttachNamespaces() {
+	funcs := common.InformerFuncs(&corev1.Namespace{}, node.handleAddOrUpdateDirectAttachNamespace, node.handleDeleteDirectAttachNamespace)
+	node.kubeInformers.Core().V1().Namespaces().Informer().AddEventHandler(funcs)
+	// A namespace's VNID can change (eg, when it is joined to another project)
+	funcs = common.InformerFuncs(&osdnv1.NetNamespace{}, node.handleAddOrUpdateDirectAttachNetNamespace, node.handleDeleteDirectAttachNetNamespace)
+	node.osdnInformers.Network().V1().NetNamespaces().Informer().AddEventHandler(funcs)
+}
+
+func (node *OsdnNode) handleAddOrUpdateDirectAttachNamespace(obj, _ interface{}, eventType watch.EventType) {
+	node.syncDirectAttachNamespace(obj.(*corev1.Namespace).Name)
+}
+
+func (node *OsdnNode) handleDeleteDirectAttachNamespace(obj interface{}) {
+	node.syncDirectAttachNamespace(obj.(*corev1.Namespace).Name)
+}
+
+func (node *OsdnNode) handleAddOrUpdateDirectAttachNetNamespace(obj, _ interface{}, eventType watch.EventType) {
+	node.syncDirectAttachNamespace(obj.(*osdnv1.NetNamespace).NetName)
+}
+
+func (node *OsdnNode) handleDeleteDirectAttachNetNamespace(obj interface{}) {
+	node.syncDirectAttachNamespace(obj.(*osdnv1.NetNamespace).NetName)
+}
+
+// syncDirectAttachNamespace updates the direct-attach flows for namespace's VNID
+// (and its old VNID, if that changed) from the informers' caches
+func (node *OsdnNode) syncDirectAttachNamespace(namespace string) {
+	enabled, vnid, err := node.getDirectAttachVNID(namespace)
+	if err != nil {
+		utilruntime.HandleError(err)
+	}
+
+	da := node.directAttach
+	da.lock.Lock()
+	defer da.lock.Unlock()
+
+	oldVNID, wasEnabled := da.namespaces[namespace]
+	if enabled == wasEnabled && (!enabled || vnid == oldVNID) {
+		return
+	}
+	if enabled {
+		klog.V(2).Infof("Namespace %q (VNID %d) now uses direct-attach", namespace, vnid)
+		da.namespaces[namespace] = vnid
+	} else {
+		klog.V(2).Infof("Namespace %q no longer uses direct-attach", namespace)
+		delete(da.namespaces, namespace)
+	}
+
+	if wasEnabled && !da.vnidInUse(oldVNID) {
+		if err := node.oc.SetNamespaceDirectAttach(oldVNID, false); err != nil {
+			utilruntime.HandleError(fmt.Errorf("could not remove direct-attach flows for VNID %d: %v", oldVNID, err))
+		}
+	}
+	if enabled {
+		if err := node.oc.SetNamespaceDirectAttach(vnid, true); err != nil {
+			utilruntime.HandleError(fmt.Errorf("could not add direct-attach flows for namespace %q: %v", namespace, err))
+		}
+	}
+}
+
+// getDirectAttachVNID returns whether namespace currently uses direct-attach, and
+// if so, its VNID
+func (node *OsdnNode) getDirectAttachVNID(namespace string) (bool, uint32, error) {
+	kns, err := node.kubeInformers.Core().V1().Namespaces().Lister().Get(namespace)
+	if kerrors.IsNotFound(err) {
+		return false, 0, nil
+	} else if err != nil {
+		return false, 0, err
+	}
+	enabled, err := getDirectAttachMode(kns)
+	if !enabled {
+		return false, 0, err
+	}
+
+	netns, err := node.osdnInformers.Network().V1().NetNamespaces().Lister().Get(namespace)
+	if kerrors.IsNotFound(err) {
+		// Either the master hasn't created it yet (in which case we'll be called
+		// again when it does), or this is the subnet plugin
+		klog.V(2).Infof("Namespace %q uses direct-attach but has no NetNamespace", namespace)
+		return false, 0, nil
+	} else if err != nil {
+		return false, 0, err
+	}
+	if netns.NetID == common.GlobalVNID {
+		return false, 0, fmt.Errorf("namespace %q uses direct-attach but has the global VNID", namespace)
+	}
+	return true, netns.NetID, nil
+}
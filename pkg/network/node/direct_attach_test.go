@@ -0,0 +1,53 @@
+package node
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetDirectAttachMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		enabled     bool
+		err         bool
+	}{
+		{
+			name: "no annotation",
+		},
+		{
+			name:        "true",
+			annotations: map[string]string{DirectAttachAnnotation: "true"},
+			enabled:     true,
+		},
+		{
+			name:        "false",
+			annotations: map[string]string{DirectAttachAnnotation: "false"},
+		},
+		{
+			name:        "empty",
+			annotations: map[string]string{DirectAttachAnnotation: ""},
+		},
+		{
+			name:        "invalid",
+			annotations: map[string]string{DirectAttachAnnotation: "macvlan"},
+			err:         true,
+		},
+	}
+
+	for _, test := range tests {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns1", Annotations: test.annotations}}
+		enabled, err := getDirectAttachMode(ns)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", test.name, enabled)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if enabled != test.enabled {
+			t.Errorf("%s: expected %v, got %v", test.name, test.enabled, enabled)
+		}
+	}
+}
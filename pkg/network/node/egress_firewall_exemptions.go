@@ -0,0 +1,127 @@
+package node
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// egressFirewallExemptions tracks the IPs of the nodes matching selector, which are
+// exempt from EgressNetworkPolicy rules
+type egressFirewallExemptions struct {
+	selector labels.Selector
+
+	lock sync.Mutex
+	// ips is the sorted list of exempt IPs currently in OVS; synced is set once
+	// the node informer has synced and the flows have first been written
+	ips    []string
+	synced bool
+}
+
+// setupEgressFirewallExemptions starts keeping the egress firewall exemption flows
+// up to date with the nodes matching EgressFirewallExemptNodeSelector, or removes
+// any left over from a previous run if it is not set
+func (node *OsdnNode) setupEgressFirewallExemptions() error {
+	if node.egressExemptions == nil {
+		return node.oc.UpdateEgressFirewallExemptions(nil)
+	}
+
+	funcs := common.InformerFuncs(&corev1.Node{}, node.handleAddOrUpdateExemptNode, node.handleDeleteExemptNode)
+	informer := node.kubeInformers.Core().V1().Nodes().Informer()
+	informer.AddEventHandler(funcs)
+
+	// Leave the existing flows in place until we know the full set of nodes
+	go func() {
+		if !cache.WaitForCacheSync(utilwait.NeverStop, informer.HasSynced) {
+			return
+		}
+		node.egressExemptions.lock.Lock()
+		node.egressExemptions.synced = true
+		node.egressExemptions.lock.Unlock()
+		node.syncEgressFirewallExemptions(true)
+	}()
+	return nil
+}
+
+func (node *OsdnNode) handleAddOrUpdateExemptNode(obj, oldObj interface{}, eventType watch.EventType) {
+	kNode := obj.(*corev1.Node)
+	matches := node.egressExemptions.selector.Matches(labels.Set(kNode.Labels))
+	if oldNode, ok := oldObj.(*corev1.Node); ok {
+		oldMatches := node.egressExemptions.selector.Matches(labels.Set(oldNode.Labels))
+		if matches == oldMatches && (!matches || reflect.DeepEqual(exemptNodeIPs(oldNode), exemptNodeIPs(kNode))) {
+			return
+		}
+	} else if !matches {
+		return
+	}
+	klog.V(5).Infof("Watch %s event for egress firewall exempt Node %q", eventType, kNode.Name)
+	node.syncEgressFirewallExemptions(false)
+}
+
+func (node *OsdnNode) handleDeleteExemptNode(obj interface{}) {
+	kNode := obj.(*corev1.Node)
+	if !node.egressExemptions.selector.Matches(labels.Set(kNode.Labels)) {
+		return
+	}
+	klog.V(5).Infof("Watch %s event for egress firewall exempt Node %q", watch.Deleted, kNode.Name)
+	node.syncEgressFirewallExemptions(false)
+}
+
+// syncEgressFirewallExemptions updates the exemption flows from the node lister, if
+// the set of exempt IPs has changed (or force is set)
+func (node *OsdnNode) syncEgressFirewallExemptions(force bool) {
+	ee := node.egressExemptions
+	ee.lock.Lock()
+	defer ee.lock.Unlock()
+	if !ee.synced {
+		return
+	}
+
+	kNodes, err := node.kubeInformers.Core().V1().Nodes().Lister().List(ee.selector)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not list egress firewall exempt nodes: %v", err))
+		return
+	}
+	ipSet := sets.NewString()
+	for _, kNode := range kNodes {
+		ipSet.Insert(exemptNodeIPs(kNode)...)
+	}
+	ips := ipSet.List()
+	if !force && reflect.DeepEqual(ips, ee.ips) {
+		return
+	}
+
+	if err := node.oc.UpdateEgressFirewallExemptions(ips); err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not update egress firewall exemptions: %v", err))
+		return
+	}
+	klog.Infof("Egress firewall exempt node IPs: %v", ips)
+	ee.ips = ips
+}
+
+// exemptNodeIPs returns kNode's IPv4 InternalIP addresses
+func exemptNodeIPs(kNode *corev1.Node) []string {
+	var ips []string
+	for _, addr := range kNode.Status.Addresses {
+		if addr.Type != corev1.NodeInternalIP {
+			continue
+		}
+		if ip := net.ParseIP(addr.Address); ip != nil && ip.To4() != nil {
+			ips = append(ips, ip.String())
+		}
+	}
+	return ips
+}
@@ -0,0 +1,113 @@
+package node
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newExemptTestNode(name, ip string, infra bool) *corev1.Node {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{},
+		},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeHostName, Address: name},
+				{Type: corev1.NodeInternalIP, Address: ip},
+				{Type: corev1.NodeInternalIP, Address: "fd00::" + strings.TrimPrefix(name, "node")},
+			},
+		},
+	}
+	if infra {
+		node.Labels["node-role.kubernetes.io/infra"] = ""
+	}
+	return node
+}
+
+func TestEgressFirewallExemptions(t *testing.T) {
+	ovsif, oc, _ := setupOVSController(t)
+
+	// Leftover flows from a previous run
+	if err := oc.UpdateEgressFirewallExemptions([]string{"192.168.1.99"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	kClient := fake.NewSimpleClientset(
+		newExemptTestNode("node1", "192.168.1.1", true),
+		newExemptTestNode("node2", "192.168.1.2", false),
+	)
+	kubeInformers := informers.NewSharedInformerFactory(kClient, 0)
+	selector, _ := labels.Parse("node-role.kubernetes.io/infra")
+	node := &OsdnNode{
+		oc:               oc,
+		kubeInformers:    kubeInformers,
+		egressExemptions: &egressFirewallExemptions{selector: selector},
+	}
+	if err := node.setupEgressFirewallExemptions(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	kubeInformers.Start(stopCh)
+
+	waitForExemptions := func(expected ...string) {
+		t.Helper()
+		var ips []string
+		err := utilwait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			node.egressExemptions.lock.Lock()
+			defer node.egressExemptions.lock.Unlock()
+			flows, err := ovsif.DumpFlows("table=99, cookie=%s/%s", egressExemptCookie, flowKindMask)
+			if err != nil {
+				return false, err
+			}
+			ips = nil
+			for _, flow := range flows {
+				for _, field := range strings.Split(flow, ", ") {
+					if strings.HasPrefix(field, "nw_dst=") {
+						ips = append(ips, strings.TrimPrefix(field, "nw_dst="))
+					}
+				}
+			}
+			sort.Strings(ips)
+			return reflect.DeepEqual(ips, expected) || (len(ips) == 0 && len(expected) == 0), nil
+		})
+		if err != nil {
+			t.Fatalf("expected exempt IPs %v, got %v", expected, ips)
+		}
+	}
+	waitForExemptions("192.168.1.1")
+
+	// Labeling a node exempts it
+	node2, _ := kClient.CoreV1().Nodes().Get(context.TODO(), "node2", metav1.GetOptions{})
+	node2.Labels["node-role.kubernetes.io/infra"] = ""
+	if _, err := kClient.CoreV1().Nodes().Update(context.TODO(), node2, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForExemptions("192.168.1.1", "192.168.1.2")
+
+	// Deleting a node removes its exemption
+	if err := kClient.CoreV1().Nodes().Delete(context.TODO(), "node1", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForExemptions("192.168.1.2")
+
+	// Unlabeling a node removes its exemption
+	node2, _ = kClient.CoreV1().Nodes().Get(context.TODO(), "node2", metav1.GetOptions{})
+	delete(node2.Labels, "node-role.kubernetes.io/infra")
+	if _, err := kClient.CoreV1().Nodes().Update(context.TODO(), node2, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForExemptions()
+}
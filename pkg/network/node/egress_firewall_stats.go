@@ -0,0 +1,205 @@
+package node
+
+import (
+	"strconv"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/klog/v2"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/sdn/pkg/network/common"
+	"github.com/openshift/sdn/pkg/network/node/metrics"
+	"github.com/openshift/sdn/pkg/util/ovs"
+)
+
+const (
+	// EgressFirewallEventsAnnotation, when set to "true" on an EgressNetworkPolicy,
+	// causes the node to emit events on the policy naming the destinations that
+	// traffic from the namespace was blocked to.
+	EgressFirewallEventsAnnotation = "network.openshift.io/egress-firewall-events"
+
+	// Per-namespace rate limit for egress firewall denial events
+	egressFirewallEventQPS   = 1.0 / 60
+	egressFirewallEventBurst = 5
+)
+
+// egressDropKey identifies a single egress firewall "drop" flow, or audit-only
+// "would drop" flow
+type egressDropKey struct {
+	vnid     uint32
+	priority int
+	// dst is the flow's nw_dst, or "" if it matches all destinations
+	dst string
+	// audit is true for audit-only flows (which don't actually drop the traffic)
+	audit bool
+}
+
+// egressFirewallStats tracks the packet counts of the egress firewall drop flows,
+// so that we can tell how much traffic each one has dropped since the last check
+type egressFirewallStats struct {
+	lock       sync.Mutex
+	lastCounts map[egressDropKey]uint64
+	limiters   map[uint32]flowcontrol.RateLimiter
+}
+
+func newEgressFirewallStats() *egressFirewallStats {
+	return &egressFirewallStats{
+		lastCounts: make(map[egressDropKey]uint64),
+		limiters:   make(map[uint32]flowcontrol.RateLimiter),
+	}
+}
+
+// parseEgressDrops parses the output of "ovs-ofctl dump-flows br0" for tables 22,
+// 23, 99 and 100 and returns the packet counts of the "drop" and audit-only "would drop"
+// flows.
+func parseEgressDrops(flows []string) map[egressDropKey]uint64 {
+	drops := make(map[egressDropKey]uint64)
+	for _, flow := range flows {
+		parsed, err := ovs.ParseFlow(ovs.ParseForDump, flow)
+		if err != nil {
+			continue
+		}
+		audit := false
+		switch parsed.Table {
+		case 22, 99:
+			if flowCookieKind(parsed.Cookie) != egressAuditCookie {
+				continue
+			}
+			audit = true
+		case 23, 100:
+			if _, isDrop := parsed.FindAction("drop"); !isDrop {
+				continue
+			}
+		default:
+			continue
+		}
+		reg0, ok := parsed.FindField("reg0")
+		if !ok {
+			continue
+		}
+		vnid, err := strconv.ParseUint(reg0.Value, 0, 32)
+		if err != nil {
+			continue
+		}
+		nPackets, ok := parsed.FindField("n_packets")
+		if !ok {
+			continue
+		}
+		count, err := strconv.ParseUint(nPackets.Value, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		key := egressDropKey{vnid: uint32(vnid), priority: parsed.Priority, audit: audit}
+		if dst, ok := parsed.FindField("nw_dst"); ok {
+			key.dst = dst.Value
+		} else if dst, ok := parsed.FindField("ipv6_dst"); ok {
+			key.dst = dst.Value
+		}
+		// (A rule for a Service has flows with the same key in tables 22 and 23
+		// as in 99 and 100)
+		drops[key] += count
+	}
+	return drops
+}
+
+// update records the latest packet counts and returns the number of new drops for
+// each flow since the last call. If a flow's count went down (because the flow was
+// replaced), its full count is treated as new.
+func (efs *egressFirewallStats) update(drops map[egressDropKey]uint64) map[egressDropKey]uint64 {
+	efs.lock.Lock()
+	defer efs.lock.Unlock()
+
+	deltas := make(map[egressDropKey]uint64)
+	for key, count := range drops {
+		last, existed := efs.lastCounts[key]
+		if !existed || count < last {
+			last = 0
+		}
+		if count > last {
+			deltas[key] = count - last
+		}
+	}
+	efs.lastCounts = drops
+	return deltas
+}
+
+func (efs *egressFirewallStats) allowEvent(vnid uint32) bool {
+	efs.lock.Lock()
+	defer efs.lock.Unlock()
+
+	limiter := efs.limiters[vnid]
+	if limiter == nil {
+		limiter = flowcontrol.NewTokenBucketRateLimiter(egressFirewallEventQPS, egressFirewallEventBurst)
+		efs.limiters[vnid] = limiter
+	}
+	return limiter.TryAccept()
+}
+
+// updateEgressFirewallStats reads the egress firewall flow counters from flows,
+// updates the drop metrics, and emits events for policies that request them (and
+// for audit-only policies).
+func (node *OsdnNode) updateEgressFirewallStats(flows []string) {
+	deltas := node.egressFirewallStats.update(parseEgressDrops(flows))
+	for key, delta := range deltas {
+		namespaces := node.policy.GetNamespaces(key.vnid)
+		if len(namespaces) == 0 {
+			continue
+		}
+		dst := key.dst
+		if dst == "" {
+			dst = "any destination"
+		}
+
+		if key.audit {
+			metrics.EgressFirewallAuditedPackets.WithLabelValues(namespaces[0]).Add(float64(delta))
+			klog.Infof("Audit-only egress firewall would have dropped %d packets from namespace %s to %s", delta, namespaces[0], dst)
+		} else {
+			metrics.EgressFirewallDroppedPackets.WithLabelValues(namespaces[0]).Add(float64(delta))
+			klog.V(5).Infof("Egress firewall dropped %d packets from namespace %s to %s", delta, namespaces[0], dst)
+		}
+
+		policy := node.egressFirewallEventTarget(key.vnid, key.audit)
+		if policy == nil || !node.egressFirewallStats.allowEvent(key.vnid) {
+			continue
+		}
+		if key.audit {
+			node.recorder.Eventf(egressNetworkPolicyRef(policy), corev1.EventTypeNormal, "EgressFirewallAuditDenied",
+				"Audit-only egress firewall on node %s would have dropped %d packets from namespace %s to %s", node.hostName, delta, policy.Namespace, dst)
+		} else {
+			node.recorder.Eventf(egressNetworkPolicyRef(policy), corev1.EventTypeWarning, "EgressFirewallDenied",
+				"Egress firewall on node %s dropped %d packets from namespace %s to %s", node.hostName, delta, policy.Namespace, dst)
+		}
+	}
+}
+
+// egressFirewallEventTarget returns the EgressNetworkPolicy for vnid that events
+// should be recorded against, if any. For audit events, that is the first audit-only
+// policy; otherwise it is the first enforcing policy with events enabled.
+func (node *OsdnNode) egressFirewallEventTarget(vnid uint32, audit bool) *osdnv1.EgressNetworkPolicy {
+	node.egressPoliciesLock.Lock()
+	defer node.egressPoliciesLock.Unlock()
+
+	for i := range node.egressPolicies[vnid] {
+		policy := &node.egressPolicies[vnid][i]
+		if common.IsEgressNetworkPolicyAuditOnly(policy) != audit {
+			continue
+		}
+		if audit || policy.Annotations[EgressFirewallEventsAnnotation] == "true" {
+			return policy.DeepCopy()
+		}
+	}
+	return nil
+}
+
+func egressNetworkPolicyRef(policy *osdnv1.EgressNetworkPolicy) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		Kind:       "EgressNetworkPolicy",
+		APIVersion: "network.openshift.io/v1",
+		Namespace:  policy.Namespace,
+		Name:       policy.Name,
+		UID:        policy.UID,
+	}
+}
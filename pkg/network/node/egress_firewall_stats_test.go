@@ -0,0 +1,56 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEgressFirewallStats(t *testing.T) {
+	flows := []string{
+		" cookie=0x0, duration=120.5s, table=100, n_packets=7, n_bytes=420, idle_age=3, priority=3,ip,reg0=0x2a,nw_dst=192.168.1.1 actions=goto_table:101",
+		" cookie=0x0, duration=120.5s, table=100, n_packets=12, n_bytes=720, idle_age=3, priority=2,ip,reg0=0x2a,nw_dst=192.168.1.0/24 actions=drop",
+		" cookie=0x0, duration=120.5s, table=100, n_packets=4, n_bytes=240, idle_age=3, priority=1,ip,reg0=0x2a actions=drop",
+		" cookie=0x0, duration=120.5s, table=100, n_packets=0, n_bytes=0, idle_age=3, priority=1,reg0=0x2b actions=drop",
+		" cookie=0x0, duration=120.5s, table=100, n_packets=99, n_bytes=0, idle_age=3, priority=0 actions=goto_table:101",
+		" cookie=0xea, duration=120.5s, table=99, n_packets=5, n_bytes=300, idle_age=3, priority=199,ip,reg0=0x2c,nw_dst=10.0.0.0/8 actions=goto_table:100",
+		" cookie=0x0, duration=120.5s, table=99, n_packets=8, n_bytes=480, idle_age=3, priority=198,ip,reg0=0x2c actions=goto_table:100",
+		" cookie=0x0, duration=120.5s, table=99, n_packets=99, n_bytes=0, idle_age=3, priority=0 actions=goto_table:100",
+	}
+
+	drops := parseEgressDrops(flows)
+	expected := map[egressDropKey]uint64{
+		{vnid: 42, priority: 2, dst: "192.168.1.0/24"}:            12,
+		{vnid: 42, priority: 1}:                                   4,
+		{vnid: 43, priority: 1}:                                   0,
+		{vnid: 44, priority: 199, dst: "10.0.0.0/8", audit: true}: 5,
+	}
+	if !reflect.DeepEqual(drops, expected) {
+		t.Fatalf("unexpected drops: expected %v, got %v", expected, drops)
+	}
+
+	efs := newEgressFirewallStats()
+	deltas := efs.update(drops)
+	expected = map[egressDropKey]uint64{
+		{vnid: 42, priority: 2, dst: "192.168.1.0/24"}:            12,
+		{vnid: 42, priority: 1}:                                   4,
+		{vnid: 44, priority: 199, dst: "10.0.0.0/8", audit: true}: 5,
+	}
+	if !reflect.DeepEqual(deltas, expected) {
+		t.Fatalf("unexpected initial deltas: expected %v, got %v", expected, deltas)
+	}
+
+	// Counter increases give deltas; a counter that went down (because the flow
+	// was replaced) counts from 0
+	deltas = efs.update(map[egressDropKey]uint64{
+		{vnid: 42, priority: 2, dst: "192.168.1.0/24"}: 15,
+		{vnid: 42, priority: 1}:                        2,
+		{vnid: 43, priority: 1}:                        0,
+	})
+	expected = map[egressDropKey]uint64{
+		{vnid: 42, priority: 2, dst: "192.168.1.0/24"}: 3,
+		{vnid: 42, priority: 1}:                        2,
+	}
+	if !reflect.DeepEqual(deltas, expected) {
+		t.Fatalf("unexpected deltas: expected %v, got %v", expected, deltas)
+	}
+}
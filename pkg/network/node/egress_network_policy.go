@@ -35,12 +35,15 @@ func (plugin *OsdnNode) SetupEgressNetworkPolicy() error {
 		plugin.egressDNS.Add(policy)
 	}
 
+	vnids := make([]uint32, 0, len(plugin.egressPolicies))
 	for vnid := range plugin.egressPolicies {
-		plugin.updateEgressNetworkPolicyRules(vnid)
+		vnids = append(vnids, vnid)
 	}
+	plugin.updateEgressNetworkPolicyRules(vnids...)
 
 	go utilwait.Forever(plugin.syncEgressDNSPolicyRules, 0)
 	plugin.watchEgressNetworkPolicies()
+	plugin.watchEgressServices()
 	return nil
 }
 
@@ -92,24 +95,22 @@ func (plugin *OsdnNode) handleEgressNetworkPolicy(policy *osdnv1.EgressNetworkPo
 }
 
 func (plugin *OsdnNode) UpdateEgressNetworkPolicyVNID(namespace string, oldVnid, newVnid uint32) {
-	var policy *osdnv1.EgressNetworkPolicy
-
 	plugin.egressPoliciesLock.Lock()
 	defer plugin.egressPoliciesLock.Unlock()
 
-	policies := plugin.egressPolicies[oldVnid]
-	for i, oldPolicy := range policies {
-		if oldPolicy.Namespace == namespace {
-			policy = &oldPolicy
-			plugin.egressPolicies[oldVnid] = append(policies[:i], policies[i+1:]...)
-			plugin.updateEgressNetworkPolicyRules(oldVnid)
-			break
+	var moved, remaining []osdnv1.EgressNetworkPolicy
+	for _, policy := range plugin.egressPolicies[oldVnid] {
+		if policy.Namespace == namespace {
+			moved = append(moved, policy)
+		} else {
+			remaining = append(remaining, policy)
 		}
 	}
 
-	if policy != nil {
-		plugin.egressPolicies[newVnid] = append(plugin.egressPolicies[newVnid], *policy)
-		plugin.updateEgressNetworkPolicyRules(newVnid)
+	if len(moved) > 0 {
+		plugin.egressPolicies[oldVnid] = remaining
+		plugin.egressPolicies[newVnid] = append(plugin.egressPolicies[newVnid], moved...)
+		plugin.updateEgressNetworkPolicyRules(oldVnid, newVnid)
 	}
 }
 
@@ -118,6 +119,8 @@ func (plugin *OsdnNode) syncEgressDNSPolicyRules() {
 
 	for {
 		policyUpdates := <-plugin.egressDNS.Updates
+		var vnids []uint32
+		seen := make(map[uint32]bool)
 		for _, policyUpdate := range policyUpdates {
 			klog.V(5).Infof("Egress dns sync: updating policy: %v", policyUpdate.UID)
 			vnid, err := plugin.policy.GetVNID(policyUpdate.Namespace)
@@ -125,13 +128,20 @@ func (plugin *OsdnNode) syncEgressDNSPolicyRules() {
 				klog.Warningf("Could not find netid for namespace %q: %v", policyUpdate.Namespace, err)
 				continue
 			}
+			if !seen[vnid] {
+				seen[vnid] = true
+				vnids = append(vnids, vnid)
+			}
+		}
+		if len(vnids) == 0 {
+			continue
+		}
 
-			func() {
-				plugin.egressPoliciesLock.Lock()
-				defer plugin.egressPoliciesLock.Unlock()
+		func() {
+			plugin.egressPoliciesLock.Lock()
+			defer plugin.egressPoliciesLock.Unlock()
 
-				plugin.updateEgressNetworkPolicyRules(vnid)
-			}()
-		}
+			plugin.updateEgressNetworkPolicyRules(vnids...)
+		}()
 	}
 }
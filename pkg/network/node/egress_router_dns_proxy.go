@@ -0,0 +1,358 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+const (
+	// EgressRouterDNSProxyAnnotation, when set on an egress router pod (ie, one with
+	// the assign-macvlan annotation), causes the node to run a TCP proxy inside the
+	// pod's network namespace which resolves each destination name when a
+	// connection is made, rather than requiring static destination IPs. The value
+	// has one destination per line, in the same format as the egress-dns-proxy
+	// image's EGRESS_DNS_PROXY_DESTINATION:
+	//
+	//	# <local port> <destination name or IP> [<destination port>]
+	//	80 www.example.com
+	//	8443 api.example.com 443
+	EgressRouterDNSProxyAnnotation = "pod.network.openshift.io/egress-router-dns-proxy"
+
+	// egressRouterDNSProxyStateDir holds a record of each running proxy, so that
+	// they can be restarted along with the node process
+	egressRouterDNSProxyStateDir = "/var/run/openshift-sdn/egress-router-dns-proxy"
+
+	egressRouterDialTimeout = 30 * time.Second
+
+	// maxEgressRouterDNSProxyConnections is the maximum number of connections that
+	// each proxy forwards (or resolves the destination of) at once. Further
+	// connections wait in the listen queue until one finishes.
+	maxEgressRouterDNSProxyConnections = 256
+)
+
+// egressRouterDestination is a single entry from EgressRouterDNSProxyAnnotation
+type egressRouterDestination struct {
+	localPort int
+	host      string
+	port      int
+}
+
+// parseEgressRouterDestinations parses the value of EgressRouterDNSProxyAnnotation
+func parseEgressRouterDestinations(value string) ([]egressRouterDestination, error) {
+	var dests []egressRouterDestination
+	localPorts := make(map[int]bool)
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("bad destination %q: expected \"<local port> <destination> [<destination port>]\"", line)
+		}
+
+		localPort, err := strconv.Atoi(fields[0])
+		if err != nil || localPort < 1 || localPort > 65535 {
+			return nil, fmt.Errorf("bad destination %q: invalid local port %q", line, fields[0])
+		}
+		if localPorts[localPort] {
+			return nil, fmt.Errorf("bad destination %q: local port %d is already used", line, localPort)
+		}
+		localPorts[localPort] = true
+
+		port := localPort
+		if len(fields) == 3 {
+			port, err = strconv.Atoi(fields[2])
+			if err != nil || port < 1 || port > 65535 {
+				return nil, fmt.Errorf("bad destination %q: invalid destination port %q", line, fields[2])
+			}
+		}
+		dests = append(dests, egressRouterDestination{localPort: localPort, host: fields[1], port: port})
+	}
+	if len(dests) == 0 {
+		return nil, fmt.Errorf("no destinations")
+	}
+	return dests, nil
+}
+
+// egressRouterDNSProxy forwards TCP connections to an egress router pod on to its
+// destinations. The listening sockets, the DNS queries, and the outgoing
+// connections are all created in the pod's network namespace, so traffic leaves
+// through the pod's interfaces just as it would with a proxy running inside the
+// pod.
+type egressRouterDNSProxy struct {
+	name  string
+	netns ns.NetNS
+	// nameservers are the pod's DNS servers; if empty, the node's are used (but
+	// still queried from the pod's network namespace)
+	nameservers []string
+	resolver    *net.Resolver
+	// slots limits the number of connections being forwarded at once
+	slots chan struct{}
+
+	lock      sync.Mutex
+	listeners []net.Listener
+	stopped   bool
+}
+
+// egressRouterDNSProxyState is the record of a running proxy saved in
+// egressRouterDNSProxyStateDir
+type egressRouterDNSProxyState struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Netns     string `json:"netns"`
+}
+
+func newEgressRouterDNSProxy(name string, netns ns.NetNS, nameservers []string) *egressRouterDNSProxy {
+	p := &egressRouterDNSProxy{
+		name:        name,
+		netns:       netns,
+		nameservers: nameservers,
+		slots:       make(chan struct{}, maxEgressRouterDNSProxyConnections),
+	}
+	p.resolver = &net.Resolver{PreferGo: true, Dial: p.dialDNS}
+	return p
+}
+
+// dialDNS connects to a DNS server from the pod's network namespace, for
+// p.resolver. The resolver passes the address of one of the node's nameservers,
+// which is replaced by the pod's nameserver if it has one.
+func (p *egressRouterDNSProxy) dialDNS(ctx context.Context, network, address string) (net.Conn, error) {
+	if len(p.nameservers) > 0 {
+		address = net.JoinHostPort(p.nameservers[0], "53")
+	}
+	var conn net.Conn
+	err := p.netns.Do(func(ns.NetNS) error {
+		var dialer net.Dialer
+		var err error
+		conn, err = dialer.DialContext(ctx, network, address)
+		return err
+	})
+	return conn, err
+}
+
+// Start starts listening for connections to dests
+func (p *egressRouterDNSProxy) Start(dests []egressRouterDestination) error {
+	var listeners []net.Listener
+	err := p.netns.Do(func(ns.NetNS) error {
+		for _, dest := range dests {
+			l, err := net.Listen("tcp", fmt.Sprintf(":%d", dest.localPort))
+			if err != nil {
+				return err
+			}
+			listeners = append(listeners, l)
+		}
+		return nil
+	})
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return fmt.Errorf("could not start egress router DNS proxy for %s: %v", p.name, err)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.listeners = listeners
+	for i := range dests {
+		go p.serve(listeners[i], dests[i])
+	}
+	klog.Infof("Started egress router DNS proxy for %s with %d destinations", p.name, len(dests))
+	return nil
+}
+
+// Stop closes the proxy's listening sockets. Connections that are already
+// established are left to finish on their own.
+func (p *egressRouterDNSProxy) Stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stopped {
+		return
+	}
+	p.stopped = true
+	for _, l := range p.listeners {
+		l.Close()
+	}
+	p.netns.Close()
+	klog.Infof("Stopped egress router DNS proxy for %s", p.name)
+}
+
+func (p *egressRouterDNSProxy) serve(l net.Listener, dest egressRouterDestination) {
+	for {
+		p.slots <- struct{}{}
+		conn, err := l.Accept()
+		if err != nil {
+			<-p.slots
+			p.lock.Lock()
+			stopped := p.stopped
+			p.lock.Unlock()
+			if !stopped {
+				utilruntime.HandleError(fmt.Errorf("egress router DNS proxy for %s stopped accepting connections on port %d: %v", p.name, dest.localPort, err))
+			}
+			return
+		}
+		go func() {
+			defer func() { <-p.slots }()
+			p.forward(conn, dest)
+		}()
+	}
+}
+
+// forward resolves dest and copies data between conn and a new connection to it
+func (p *egressRouterDNSProxy) forward(conn net.Conn, dest egressRouterDestination) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), egressRouterDialTimeout)
+	defer cancel()
+	addrs, err := p.resolver.LookupHost(ctx, dest.host)
+	if err != nil {
+		klog.Warningf("Egress router DNS proxy for %s could not resolve %s: %v", p.name, dest.host, err)
+		return
+	}
+
+	var out net.Conn
+	err = p.netns.Do(func(ns.NetNS) error {
+		var dialer net.Dialer
+		for _, addr := range addrs {
+			out, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, strconv.Itoa(dest.port)))
+			if err == nil {
+				return nil
+			}
+		}
+		return err
+	})
+	if err != nil {
+		klog.Warningf("Egress router DNS proxy for %s could not connect to %s port %d: %v", p.name, dest.host, dest.port, err)
+		return
+	}
+	defer out.Close()
+	klog.V(5).Infof("Egress router DNS proxy for %s forwarding %s to %s", p.name, conn.RemoteAddr(), out.RemoteAddr())
+
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(out, conn)
+	go copyHalf(conn, out)
+	<-done
+	<-done
+}
+
+// maybeStartEgressRouterDNSProxy starts an egressRouterDNSProxy for pod if it has
+// EgressRouterDNSProxyAnnotation.
+func (m *podManager) maybeStartEgressRouterDNSProxy(pod *corev1.Pod, sandboxID, netnsPath string) error {
+	value, ok := pod.Annotations[EgressRouterDNSProxyAnnotation]
+	if !ok {
+		return nil
+	}
+	if _, ok := pod.Annotations[osdnv1.AssignMacvlanAnnotation]; !ok {
+		return fmt.Errorf("pod has %q annotation but not %q", EgressRouterDNSProxyAnnotation, osdnv1.AssignMacvlanAnnotation)
+	}
+	dests, err := parseEgressRouterDestinations(value)
+	if err != nil {
+		return fmt.Errorf("invalid %q annotation: %v", EgressRouterDNSProxyAnnotation, err)
+	}
+
+	podNs, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return fmt.Errorf("could not open netns %q: %v", netnsPath, err)
+	}
+	proxy := newEgressRouterDNSProxy(getPodKey(pod.Namespace, pod.Name), podNs, m.getPodDNS(pod.Namespace).Nameservers)
+	if err := proxy.Start(dests); err != nil {
+		podNs.Close()
+		return err
+	}
+
+	m.egressRouterProxiesLock.Lock()
+	defer m.egressRouterProxiesLock.Unlock()
+	if old := m.egressRouterProxies[sandboxID]; old != nil {
+		old.Stop()
+	}
+	m.egressRouterProxies[sandboxID] = proxy
+
+	if m.egressRouterStateDir != "" {
+		state := egressRouterDNSProxyState{Namespace: pod.Namespace, Name: pod.Name, Netns: netnsPath}
+		data, _ := json.Marshal(&state)
+		if err := os.MkdirAll(m.egressRouterStateDir, 0700); err == nil {
+			err = ioutil.WriteFile(filepath.Join(m.egressRouterStateDir, sandboxID), data, 0600)
+		}
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("could not save egress router DNS proxy state for %s; it will not be restarted if the node restarts: %v", proxy.name, err))
+		}
+	}
+	return nil
+}
+
+// stopEgressRouterDNSProxy stops the egressRouterDNSProxy for sandboxID, if any
+func (m *podManager) stopEgressRouterDNSProxy(sandboxID string) {
+	m.egressRouterProxiesLock.Lock()
+	defer m.egressRouterProxiesLock.Unlock()
+	if proxy := m.egressRouterProxies[sandboxID]; proxy != nil {
+		proxy.Stop()
+		delete(m.egressRouterProxies, sandboxID)
+	}
+	if m.egressRouterStateDir != "" {
+		os.Remove(filepath.Join(m.egressRouterStateDir, sandboxID))
+	}
+}
+
+// restartEgressRouterDNSProxies restarts the proxies that were running when the
+// node process last exited, for the pods that are still running.
+func (m *podManager) restartEgressRouterDNSProxies() {
+	if m.egressRouterStateDir == "" {
+		return
+	}
+	files, err := ioutil.ReadDir(m.egressRouterStateDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			utilruntime.HandleError(fmt.Errorf("could not read egress router DNS proxy state: %v", err))
+		}
+		return
+	}
+	for _, file := range files {
+		sandboxID := file.Name()
+		path := filepath.Join(m.egressRouterStateDir, sandboxID)
+		var state egressRouterDNSProxyState
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &state)
+		}
+		if err != nil || !m.isRunning(getPodKey(state.Namespace, state.Name)) {
+			os.Remove(path)
+			continue
+		}
+
+		pod, err := m.kClient.CoreV1().Pods(state.Namespace).Get(context.TODO(), state.Name, metav1.GetOptions{})
+		if err == nil {
+			err = m.maybeStartEgressRouterDNSProxy(pod, sandboxID, state.Netns)
+		}
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("could not restart egress router DNS proxy for %s/%s: %v", state.Namespace, state.Name, err))
+			os.Remove(path)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package node
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+func TestParseEgressRouterDestinations(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		result []egressRouterDestination
+	}{
+		{
+			name: "valid",
+			value: `# comment
+80 www.example.com
+8443 api.example.com 443
+
+9000 203.0.113.10 22
+`,
+			result: []egressRouterDestination{
+				{localPort: 80, host: "www.example.com", port: 80},
+				{localPort: 8443, host: "api.example.com", port: 443},
+				{localPort: 9000, host: "203.0.113.10", port: 22},
+			},
+		},
+		{
+			name:  "bad local port",
+			value: "http www.example.com",
+		},
+		{
+			name:  "bad destination port",
+			value: "80 www.example.com 100000",
+		},
+		{
+			name:  "too many fields",
+			value: "80 www.example.com 80 tcp",
+		},
+		{
+			name:  "duplicate local port",
+			value: "80 www.example.com\n80 www.example.org",
+		},
+		{
+			name:  "empty",
+			value: "# nothing\n",
+		},
+	}
+
+	for _, test := range tests {
+		dests, err := parseEgressRouterDestinations(test.value)
+		if test.result == nil {
+			if err == nil {
+				t.Errorf("%s: expected error, got %#v", test.name, dests)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !reflect.DeepEqual(dests, test.result) {
+			t.Errorf("%s: expected %#v, got %#v", test.name, test.result, dests)
+		}
+	}
+}
+
+func TestEgressRouterDNSProxy(t *testing.T) {
+	// Run the proxy in the test's own network namespace
+	netns, err := ns.GetCurrentNS()
+	if err != nil {
+		t.Skipf("could not open current netns: %v", err)
+	}
+	if err := netns.Do(func(ns.NetNS) error { return nil }); err != nil {
+		t.Skipf("could not enter current netns: %v", err)
+	}
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not create backend: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				fmt.Fprintf(conn, "echo %s", line)
+			}()
+		}
+	}()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not find free port: %v", err)
+	}
+	localPort := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	proxy := newEgressRouterDNSProxy("test/egress-router", netns, nil)
+	dests := []egressRouterDestination{{localPort: localPort, host: "localhost", port: backend.Addr().(*net.TCPAddr).Port}}
+	if err := proxy.Start(dests); err != nil {
+		t.Fatalf("could not start proxy: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatalf("could not connect to proxy: %v", err)
+	}
+	fmt.Fprintf(conn, "hello\n")
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if err != nil {
+		t.Fatalf("could not read reply: %v", err)
+	}
+	if reply != "echo hello\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+
+	proxy.Stop()
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort)); err == nil {
+		conn.Close()
+		t.Fatalf("unexpected success connecting to stopped proxy")
+	}
+}
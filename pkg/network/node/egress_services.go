@@ -0,0 +1,156 @@
+package node
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// egressServiceIPsFunc returns the IPs that an EgressNetworkPolicy rule referring to
+// the given Service (see common.ParseEgressServiceDNSName) should match
+type egressServiceIPsFunc func(namespace, name string) []net.IP
+
+// endpointSliceServiceIndex is the name of the EndpointSlice informer index of
+// slices by the "namespace/name" of their Service
+const endpointSliceServiceIndex = "service"
+
+func endpointSliceServiceIndexFunc(obj interface{}) ([]string, error) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return nil, nil
+	}
+	name := slice.Labels[discoveryv1.LabelServiceName]
+	if name == "" {
+		return nil, nil
+	}
+	return []string{slice.Namespace + "/" + name}, nil
+}
+
+// getEgressServiceIPs returns the cluster IPs and endpoint IPs of the given Service
+func (plugin *OsdnNode) getEgressServiceIPs(namespace, name string) []net.IP {
+	var ips []net.IP
+	if svc, err := plugin.kubeInformers.Core().V1().Services().Lister().Services(namespace).Get(name); err == nil {
+		for _, clusterIP := range svc.Spec.ClusterIPs {
+			if ip := net.ParseIP(clusterIP); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	slices, err := plugin.kubeInformers.Discovery().V1().EndpointSlices().Informer().GetIndexer().ByIndex(endpointSliceServiceIndex, namespace+"/"+name)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not get EndpointSlices of service %s/%s: %v", namespace, name, err))
+	}
+	for _, obj := range slices {
+		for _, endpoint := range obj.(*discoveryv1.EndpointSlice).Endpoints {
+			for _, addr := range endpoint.Addresses {
+				if ip := net.ParseIP(addr); ip != nil {
+					ips = append(ips, ip)
+				}
+			}
+		}
+	}
+	return ips
+}
+
+// watchEgressServices watches for changes to Services and EndpointSlices that are
+// referred to by EgressNetworkPolicy rules, so their flows can be kept up to date
+func (plugin *OsdnNode) watchEgressServices() {
+	funcs := common.InformerFuncs(&corev1.Service{}, plugin.handleAddOrUpdateEgressService, plugin.handleDeleteEgressService)
+	plugin.kubeInformers.Core().V1().Services().Informer().AddEventHandler(funcs)
+
+	informer := plugin.kubeInformers.Discovery().V1().EndpointSlices().Informer()
+	if err := informer.AddIndexers(cache.Indexers{endpointSliceServiceIndex: endpointSliceServiceIndexFunc}); err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not index EndpointSlices by service: %v", err))
+	}
+	funcs = common.InformerFuncs(&discoveryv1.EndpointSlice{}, plugin.handleAddOrUpdateEgressEndpointSlice, plugin.handleDeleteEgressEndpointSlice)
+	informer.AddEventHandler(funcs)
+}
+
+func (plugin *OsdnNode) handleAddOrUpdateEgressService(obj, oldObj interface{}, eventType watch.EventType) {
+	svc := obj.(*corev1.Service)
+	if oldSvc, ok := oldObj.(*corev1.Service); ok && reflect.DeepEqual(oldSvc.Spec.ClusterIPs, svc.Spec.ClusterIPs) {
+		return
+	}
+	plugin.updateEgressServiceRules(svc.Namespace, svc.Name)
+}
+
+func (plugin *OsdnNode) handleDeleteEgressService(obj interface{}) {
+	svc := obj.(*corev1.Service)
+	plugin.updateEgressServiceRules(svc.Namespace, svc.Name)
+}
+
+func (plugin *OsdnNode) handleAddOrUpdateEgressEndpointSlice(obj, oldObj interface{}, eventType watch.EventType) {
+	slice := obj.(*discoveryv1.EndpointSlice)
+	if oldSlice, ok := oldObj.(*discoveryv1.EndpointSlice); ok && reflect.DeepEqual(oldSlice.Endpoints, slice.Endpoints) {
+		return
+	}
+	if name := slice.Labels[discoveryv1.LabelServiceName]; name != "" {
+		plugin.updateEgressServiceRules(slice.Namespace, name)
+	}
+}
+
+func (plugin *OsdnNode) handleDeleteEgressEndpointSlice(obj interface{}) {
+	slice := obj.(*discoveryv1.EndpointSlice)
+	if name := slice.Labels[discoveryv1.LabelServiceName]; name != "" {
+		plugin.updateEgressServiceRules(slice.Namespace, name)
+	}
+}
+
+// updateEgressServiceRules updates the EgressNetworkPolicy flows of each VNID that
+// has a policy referring to the given Service
+func (plugin *OsdnNode) updateEgressServiceRules(namespace, name string) {
+	plugin.egressPoliciesLock.Lock()
+	defer plugin.egressPoliciesLock.Unlock()
+
+	vnids, ok := plugin.egressServiceVNIDs[namespace+"/"+name]
+	if !ok {
+		return
+	}
+	klog.V(5).Infof("Updating EgressNetworkPolicy flows for VNIDs %v after change to Service %s/%s", vnids.List(), namespace, name)
+	for _, vnid := range vnids.List() {
+		plugin.updateEgressNetworkPolicyRules(uint32(vnid))
+	}
+}
+
+// indexEgressServices updates egressServiceVNIDs for the current policies of vnid.
+// Must be called with egressPoliciesLock held.
+func (plugin *OsdnNode) indexEgressServices(vnid uint32) {
+	for key, vnids := range plugin.egressServiceVNIDs {
+		vnids.Delete(int(vnid))
+		if vnids.Len() == 0 {
+			delete(plugin.egressServiceVNIDs, key)
+		}
+	}
+	for _, key := range egressPolicyServices(plugin.egressPolicies[vnid]) {
+		if _, ok := plugin.egressServiceVNIDs[key]; !ok {
+			plugin.egressServiceVNIDs[key] = sets.NewInt()
+		}
+		plugin.egressServiceVNIDs[key].Insert(int(vnid))
+	}
+}
+
+// egressPolicyServices returns the "namespace/name" of each Service referred to by a
+// rule of policies
+func egressPolicyServices(policies []osdnv1.EgressNetworkPolicy) []string {
+	var services []string
+	for _, policy := range policies {
+		for _, rule := range policy.Spec.Egress {
+			if namespace, name, ok := common.ParseEgressServiceDNSName(rule.To.DNSName); ok {
+				services = append(services, namespace+"/"+name)
+			}
+		}
+	}
+	return services
+}
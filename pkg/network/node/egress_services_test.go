@@ -0,0 +1,145 @@
+package node
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestEgressNetworkPolicyServiceRules(t *testing.T) {
+	ovsif, oc, _ := setupOVSController(t)
+
+	policy := osdnv1.EgressNetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "enp",
+			Namespace: "ns1",
+		},
+		Spec: osdnv1.EgressNetworkPolicySpec{
+			Egress: []osdnv1.EgressNetworkPolicyRule{
+				{
+					Type: osdnv1.EgressNetworkPolicyRuleAllow,
+					To:   osdnv1.EgressNetworkPolicyPeer{DNSName: "db.prod.svc"},
+				},
+				{
+					Type: osdnv1.EgressNetworkPolicyRuleDeny,
+					To:   osdnv1.EgressNetworkPolicyPeer{CIDRSelector: "0.0.0.0/0"},
+				},
+			},
+		},
+	}
+	policies := []osdnv1.EgressNetworkPolicy{policy}
+
+	if services := egressPolicyServices(policies); !reflect.DeepEqual(services, []string{"prod/db"}) {
+		t.Fatalf("unexpected services %v", services)
+	}
+
+	serviceIPs := map[string][]net.IP{
+		"prod/db": {net.ParseIP("172.30.99.1"), net.ParseIP("203.0.113.5"), net.ParseIP("fd00::5")},
+	}
+	resolve := func(namespace, name string) []net.IP {
+		return serviceIPs[namespace+"/"+name]
+	}
+
+	// The rule is applied both in table 100 (for endpoints outside the cluster) and
+	// in table 23 (for cluster IPs and pod IPs, which never reach table 100)
+	checkFlows := func(expected, unexpected []string) {
+		t.Helper()
+		for table, allow := range map[int]string{100: "goto_table:101", 23: "goto_table:30"} {
+			flows, err := ovsif.DumpFlows("table=%d", table)
+			if err != nil {
+				t.Fatalf("Unexpected error dumping flows: %v", err)
+			}
+			for _, ip := range expected {
+				found := false
+				for _, flow := range flows {
+					if strings.Contains(flow, "nw_dst="+ip+",") && strings.Contains(flow, allow) {
+						found = true
+					}
+				}
+				if !found {
+					t.Fatalf("No allow flow for %s in %v", ip, flows)
+				}
+			}
+			for _, ip := range unexpected {
+				for _, flow := range flows {
+					if strings.Contains(flow, ip) {
+						t.Fatalf("Unexpected flow for %s: %s", ip, flow)
+					}
+				}
+			}
+			if table == 23 {
+				for _, flow := range flows {
+					if strings.Contains(flow, "actions=drop") {
+						t.Fatalf("Unexpected non-Service rule in table 23: %s", flow)
+					}
+				}
+			}
+		}
+	}
+
+	err := oc.UpdateEgressNetworkPolicyRules(policies, 42, []string{"ns1"}, nil, resolve)
+	if err != nil {
+		t.Fatalf("Unexpected error updating egress network policy: %v", err)
+	}
+	checkFlows([]string{"172.30.99.1", "203.0.113.5"}, []string{"fd00::5"})
+
+	// Endpoints change
+	serviceIPs["prod/db"] = []net.IP{net.ParseIP("172.30.99.1"), net.ParseIP("203.0.113.6")}
+	err = oc.UpdateEgressNetworkPolicyRules(policies, 42, []string{"ns1"}, nil, resolve)
+	if err != nil {
+		t.Fatalf("Unexpected error updating egress network policy: %v", err)
+	}
+	checkFlows([]string{"172.30.99.1", "203.0.113.6"}, []string{"203.0.113.5"})
+
+	// Service deleted
+	delete(serviceIPs, "prod/db")
+	err = oc.UpdateEgressNetworkPolicyRules(policies, 42, []string{"ns1"}, nil, resolve)
+	if err != nil {
+		t.Fatalf("Unexpected error updating egress network policy: %v", err)
+	}
+	checkFlows(nil, []string{"172.30.99.1", "203.0.113.6"})
+}
+
+func TestEgressServiceIndex(t *testing.T) {
+	plugin := &OsdnNode{
+		egressPolicies:     make(map[uint32][]osdnv1.EgressNetworkPolicy),
+		egressServiceVNIDs: make(map[string]sets.Int),
+	}
+	policy := func(dnsNames ...string) osdnv1.EgressNetworkPolicy {
+		policy := osdnv1.EgressNetworkPolicy{}
+		for _, dnsName := range dnsNames {
+			policy.Spec.Egress = append(policy.Spec.Egress, osdnv1.EgressNetworkPolicyRule{
+				Type: osdnv1.EgressNetworkPolicyRuleAllow,
+				To:   osdnv1.EgressNetworkPolicyPeer{DNSName: dnsName},
+			})
+		}
+		return policy
+	}
+
+	plugin.egressPolicies[42] = []osdnv1.EgressNetworkPolicy{policy("db.prod.svc", "www.example.com")}
+	plugin.indexEgressServices(42)
+	plugin.egressPolicies[43] = []osdnv1.EgressNetworkPolicy{policy("db.prod.svc"), policy("cache.prod.svc")}
+	plugin.indexEgressServices(43)
+	expected := map[string]sets.Int{
+		"prod/db":    sets.NewInt(42, 43),
+		"prod/cache": sets.NewInt(43),
+	}
+	if !reflect.DeepEqual(plugin.egressServiceVNIDs, expected) {
+		t.Fatalf("expected %v, got %v", expected, plugin.egressServiceVNIDs)
+	}
+
+	delete(plugin.egressPolicies, 43)
+	plugin.indexEgressServices(43)
+	expected = map[string]sets.Int{
+		"prod/db": sets.NewInt(42),
+	}
+	if !reflect.DeepEqual(plugin.egressServiceVNIDs, expected) {
+		t.Fatalf("expected %v, got %v", expected, plugin.egressServiceVNIDs)
+	}
+}
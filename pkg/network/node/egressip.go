@@ -2,17 +2,20 @@ package node
 
 import (
 	"fmt"
-	"os/exec"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"k8s.io/klog/v2"
 
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/sets"
 	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	kexec "k8s.io/utils/exec"
 
+	osdnclient "github.com/openshift/client-go/network/clientset/versioned"
 	osdninformers "github.com/openshift/client-go/network/informers/externalversions"
 	"github.com/openshift/sdn/pkg/network/common"
 	"github.com/vishvananda/netlink"
@@ -30,6 +33,11 @@ type egressNode struct {
 
 	egressIPs sets.String
 	retries   int
+
+	// lastProbe and lastSuccess are the times the node was last pinged and last
+	// responded, for EgressIPHealthAnnotation
+	lastProbe   time.Time
+	lastSuccess time.Time
 }
 
 type egressIPWatcher struct {
@@ -43,11 +51,35 @@ type egressIPWatcher struct {
 
 	iptables     *NodeIPTables
 	iptablesMark map[string]string
+	execer       kexec.Interface
+	// bandwidth holds the bandwidth limit requested for each egress IP assigned to
+	// this node, which can't be applied until the IP has been claimed
+	bandwidth map[string]int64
+
+	// migrating is set in migration mode, in which the node doesn't host egress
+	// IPs (and releases any left over from before)
+	migrating bool
+
+	// namespaceEgressErrs collects the errors from the namespace egress changes of
+	// a sync, so that they can be reported together
+	namespaceEgressErrs []error
 
 	monitorNodesLock sync.Mutex
 	monitorNodes     map[string]*egressNode
 	stop             chan struct{}
 
+	// statusLock protects synced and failedEgressIPs, which are read by checkHealth
+	statusLock      sync.Mutex
+	synced          bool
+	failedEgressIPs sets.String
+
+	// osdnClient and nodeName are used to publish EgressIPHealthAnnotation on
+	// our HostSubnet; healthLock protects lastHealth, the last published value
+	osdnClient osdnclient.Interface
+	nodeName   string
+	healthLock sync.Mutex
+	lastHealth *common.EgressIPHealth
+
 	testModeChan chan string
 }
 
@@ -62,6 +94,9 @@ func newEgressIPWatcher(oc *ovsController, localIP string, masqueradeBit *int32)
 		localIP:      localIP,
 		monitorNodes: make(map[string]*egressNode),
 		iptablesMark: make(map[string]string),
+		bandwidth:    make(map[string]int64),
+
+		failedEgressIPs: sets.NewString(),
 	}
 	if masqueradeBit != nil {
 		eip.masqueradeBit = 1 << uint32(*masqueradeBit)
@@ -71,13 +106,22 @@ func newEgressIPWatcher(oc *ovsController, localIP string, masqueradeBit *int32)
 	return eip
 }
 
-func (eip *egressIPWatcher) Start(osdnInformers osdninformers.SharedInformerFactory, iptables *NodeIPTables) error {
+func (eip *egressIPWatcher) Start(osdnClient osdnclient.Interface, nodeName string, osdnInformers osdninformers.SharedInformerFactory, iptables *NodeIPTables, execer kexec.Interface) error {
+	eip.osdnClient = osdnClient
+	eip.nodeName = nodeName
 	eip.iptables = iptables
+	eip.execer = execer
 	eip.tracker.Start(osdnInformers.Network().V1().HostSubnets(), osdnInformers.Network().V1().NetNamespaces())
 	return nil
 }
 
 func (eip *egressIPWatcher) Synced() {
+	defer func() {
+		eip.statusLock.Lock()
+		defer eip.statusLock.Unlock()
+		eip.synced = true
+	}()
+
 	link, _, err := GetLinkDetails(eip.localIP)
 	if err != nil {
 		// shouldn't happen, but obviously there's nothing to clean up...
@@ -108,6 +152,30 @@ func (eip *egressIPWatcher) Synced() {
 	eip.iptables.SyncEgressIPRules()
 }
 
+// checkHealth reports whether the initial egress IP sync has completed and whether
+// all of the egress IPs assigned to this node were successfully set up.
+func (eip *egressIPWatcher) checkHealth() error {
+	eip.statusLock.Lock()
+	defer eip.statusLock.Unlock()
+
+	if !eip.synced {
+		return fmt.Errorf("egress IPs have not been synced")
+	} else if eip.failedEgressIPs.Len() > 0 {
+		return fmt.Errorf("could not assign egress IPs: %s", strings.Join(eip.failedEgressIPs.List(), ", "))
+	}
+	return nil
+}
+
+func (eip *egressIPWatcher) setEgressIPFailed(egressIP string, failed bool) {
+	eip.statusLock.Lock()
+	defer eip.statusLock.Unlock()
+	if failed {
+		eip.failedEgressIPs.Insert(egressIP)
+	} else {
+		eip.failedEgressIPs.Delete(egressIP)
+	}
+}
+
 func egressIPLabel(link netlink.Link) (string, error) {
 	// An address label must start with the link name plus ":", and must be at most 15
 	// characters long. If the link name is too long then we can't label egress IPs.
@@ -131,21 +199,31 @@ func getMarkForVNID(vnid, masqueradeBit uint32) string {
 }
 
 func (eip *egressIPWatcher) ClaimEgressIP(vnid uint32, egressIP, nodeIP string) {
-	if nodeIP == eip.localIP {
+	if nodeIP == eip.localIP && eip.migrating {
+		klog.Warningf("Not claiming egress IP %q in migration mode", egressIP)
+	} else if nodeIP == eip.localIP {
 		mark := getMarkForVNID(vnid, eip.masqueradeBit)
 		eip.iptablesMark[egressIP] = mark
-		if err := eip.assignEgressIP(egressIP, mark); err != nil {
+		err := eip.assignEgressIP(egressIP, mark)
+		if err != nil {
 			utilruntime.HandleError(fmt.Errorf("Error assigning Egress IP %q: %v", egressIP, err))
+		} else if bandwidth := eip.bandwidth[egressIP]; bandwidth != 0 {
+			eip.applyEgressIPBandwidth(egressIP, mark, bandwidth)
 		}
+		eip.setEgressIPFailed(egressIP, err != nil)
 	} else {
 		eip.addEgressIP(nodeIP, egressIP)
 	}
 }
 
 func (eip *egressIPWatcher) ReleaseEgressIP(egressIP, nodeIP string) {
-	if nodeIP == eip.localIP {
+	if nodeIP == eip.localIP && eip.migrating {
+		return
+	} else if nodeIP == eip.localIP {
 		mark := eip.iptablesMark[egressIP]
 		delete(eip.iptablesMark, egressIP)
+		delete(eip.bandwidth, egressIP)
+		eip.setEgressIPFailed(egressIP, false)
 		if err := eip.releaseEgressIP(egressIP, mark); err != nil {
 			utilruntime.HandleError(fmt.Errorf("Error releasing Egress IP %q: %v", egressIP, err))
 		}
@@ -154,6 +232,37 @@ func (eip *egressIPWatcher) ReleaseEgressIP(egressIP, nodeIP string) {
 	}
 }
 
+func (eip *egressIPWatcher) SetEgressIPBandwidth(egressIP, nodeIP string, bandwidth int64) {
+	if nodeIP != eip.localIP {
+		return
+	}
+	if eip.testModeChan != nil {
+		eip.testModeChan <- fmt.Sprintf("limit %s to %d", egressIP, bandwidth)
+		return
+	}
+	if eip.migrating {
+		return
+	}
+
+	if bandwidth == 0 {
+		delete(eip.bandwidth, egressIP)
+	} else {
+		eip.bandwidth[egressIP] = bandwidth
+	}
+	mark := eip.iptablesMark[egressIP]
+	if mark == "" {
+		klog.V(2).Infof("Egress IP %q is not claimed yet; will limit it to %d bits/s once it is", egressIP, bandwidth)
+		return
+	}
+	eip.applyEgressIPBandwidth(egressIP, mark, bandwidth)
+}
+
+func (eip *egressIPWatcher) applyEgressIPBandwidth(egressIP, mark string, bandwidth int64) {
+	if err := eip.iptables.SetEgressIPBandwidth(egressIP, mark, bandwidth); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Error setting bandwidth limit for Egress IP %q: %v", egressIP, err))
+	}
+}
+
 func (eip *egressIPWatcher) addEgressIP(nodeIP, egressIP string) {
 	eip.monitorNodesLock.Lock()
 	defer eip.monitorNodesLock.Unlock()
@@ -188,16 +297,30 @@ func (eip *egressIPWatcher) removeEgressIP(nodeIP, egressIP string) {
 		if len(eip.monitorNodes) == 0 && eip.stop != nil {
 			close(eip.stop)
 			eip.stop = nil
+			// The poller won't publish again, so clear out the old peers now
+			go eip.publishHealth()
 		}
 	}
 }
 
+// monitoredEgressIPs returns the egress IPs that we are monitoring nodeIP for
+func (eip *egressIPWatcher) monitoredEgressIPs(nodeIP string) []string {
+	eip.monitorNodesLock.Lock()
+	defer eip.monitorNodesLock.Unlock()
+
+	if eip.monitorNodes[nodeIP] == nil {
+		return nil
+	}
+	return eip.monitorNodes[nodeIP].egressIPs.List()
+}
+
 func (eip *egressIPWatcher) poll() (bool, error) {
 	retry := eip.check(false)
 	for retry {
 		time.Sleep(repollInterval)
 		retry = eip.check(true)
 	}
+	eip.publishHealth()
 	return false, nil
 }
 
@@ -228,6 +351,10 @@ func (eip *egressIPWatcher) getOfflineResult(retrying bool) (map[string]bool, bo
 		}
 
 		online := eip.tracker.Ping(node.nodeIP, timeout)
+		node.lastProbe = time.Now()
+		if online {
+			node.lastSuccess = node.lastProbe
+		}
 		if node.offline && online {
 			klog.Infof("Node %s is back online", node.nodeIP)
 			node.offline = false
@@ -248,28 +375,82 @@ func (eip *egressIPWatcher) getOfflineResult(retrying bool) (map[string]bool, bo
 	return offlineResult, needRetry
 }
 
+// updateLocalIP changes the node IP to localIP, after the master has changed our
+// HostSubnet's HostIP. The tracker may see the new HostIP before or after we do.
+// Egress IPs that it still has assigned to the old IP are moved to localIP's
+// interface now, and will be claimed again for localIP when it catches up. Egress
+// IPs that it has already assigned to localIP were treated as belonging to a remote
+// node, and are claimed again now.
+func (eip *egressIPWatcher) updateLocalIP(localIP string) {
+	// Tracker callbacks are made with the tracker locked
+	eip.tracker.Lock()
+	for egressIP, mark := range eip.iptablesMark {
+		if err := eip.releaseEgressIP(egressIP, mark); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Error releasing Egress IP %q from old node IP: %v", egressIP, err))
+		}
+	}
+	eip.localIP = localIP
+	for egressIP, mark := range eip.iptablesMark {
+		err := eip.assignEgressIP(egressIP, mark)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("Error assigning Egress IP %q: %v", egressIP, err))
+		} else if bandwidth := eip.bandwidth[egressIP]; bandwidth != 0 {
+			eip.applyEgressIPBandwidth(egressIP, mark, bandwidth)
+		}
+		eip.setEgressIPFailed(egressIP, err != nil)
+	}
+	for _, egressIP := range eip.monitoredEgressIPs(localIP) {
+		eip.removeEgressIP(localIP, egressIP)
+	}
+	eip.tracker.Unlock()
+
+	eip.tracker.ReclaimEgressIPs(localIP)
+}
+
 func (eip *egressIPWatcher) UpdateEgressCIDRs() {
 }
 
+// Resync rewrites the egress flows of every namespace with egress IPs, in case
+// they have drifted
+func (eip *egressIPWatcher) Resync() {
+	eip.oc.forgetEgressGroupDestinations()
+	eip.tracker.ResyncNamespaceEgress()
+}
+
+// BeginNamespaceEgressChanges and CommitNamespaceEgressChanges bracket the
+// SetNamespaceEgress* calls of a sync. Each namespace's changes are committed
+// separately, so that one failure doesn't affect the others; the errors are
+// reported together at the end.
+func (eip *egressIPWatcher) BeginNamespaceEgressChanges() {
+	eip.namespaceEgressErrs = nil
+}
+
+func (eip *egressIPWatcher) CommitNamespaceEgressChanges() {
+	if len(eip.namespaceEgressErrs) > 0 {
+		utilruntime.HandleError(fmt.Errorf("Error updating Namespace egress rules: %v", kerrors.NewAggregate(eip.namespaceEgressErrs)))
+	}
+	eip.namespaceEgressErrs = nil
+}
+
 func (eip *egressIPWatcher) SetNamespaceEgressNormal(vnid uint32) {
 	if err := eip.oc.SetNamespaceEgressNormal(vnid); err != nil {
-		utilruntime.HandleError(fmt.Errorf("Error updating Namespace egress rules for VNID %d: %v", vnid, err))
+		eip.namespaceEgressErrs = append(eip.namespaceEgressErrs, fmt.Errorf("VNID %d: %v", vnid, err))
 	}
 }
 
-func (eip *egressIPWatcher) SetNamespaceEgressDropped(vnid uint32) {
-	if err := eip.oc.SetNamespaceEgressDropped(vnid); err != nil {
-		utilruntime.HandleError(fmt.Errorf("Error updating Namespace egress rules for VNID %d: %v", vnid, err))
+func (eip *egressIPWatcher) SetNamespaceEgressDropped(vnid uint32, destinations []string) {
+	if err := eip.oc.SetNamespaceEgressDropped(vnid, destinations); err != nil {
+		eip.namespaceEgressErrs = append(eip.namespaceEgressErrs, fmt.Errorf("VNID %d: %v", vnid, err))
 	}
 }
 
-func (eip *egressIPWatcher) SetNamespaceEgressViaEgressIPs(vnid uint32, activeEgressIPs []common.EgressIPAssignment) {
+func (eip *egressIPWatcher) SetNamespaceEgressViaEgressIPs(vnid uint32, destinations []string, activeEgressIPs []common.EgressIPAssignment) {
 	egressIPsMetaData := []egressIPMetaData{}
 	for _, egressIPAssignment := range activeEgressIPs {
 		egressIPsMetaData = append(egressIPsMetaData, egressIPMetaData{nodeIP: egressIPAssignment.NodeIP, packetMark: eip.iptablesMark[egressIPAssignment.EgressIP]})
 	}
-	if err := eip.oc.SetNamespaceEgressViaEgressIPs(vnid, egressIPsMetaData); err != nil {
-		utilruntime.HandleError(fmt.Errorf("Error updating Namespace egress rules for VNID %d: %v", vnid, err))
+	if err := eip.oc.SetNamespaceEgressViaEgressIPs(vnid, destinations, egressIPsMetaData); err != nil {
+		eip.namespaceEgressErrs = append(eip.namespaceEgressErrs, fmt.Errorf("VNID %d: %v", vnid, err))
 	}
 }
 
@@ -309,13 +490,13 @@ func (eip *egressIPWatcher) assignEgressIP(egressIP, mark string) error {
 	// Use arping to try to update other hosts ARP caches, in case this IP was
 	// previously active on another node. (Based on code from "ifup".)
 	go func() {
-		out, err := exec.Command("/sbin/arping", "-q", "-A", "-c", "1", "-I", localEgressLink.Attrs().Name, egressIP).CombinedOutput()
+		out, err := eip.execer.Command("/sbin/arping", "-q", "-A", "-c", "1", "-I", localEgressLink.Attrs().Name, egressIP).CombinedOutput()
 		if err != nil {
 			klog.Warningf("Failed to send ARP claim for egress IP %q: %v (%s)", egressIP, err, string(out))
 			return
 		}
 		time.Sleep(2 * time.Second)
-		_ = exec.Command("/sbin/arping", "-q", "-U", "-c", "1", "-I", localEgressLink.Attrs().Name, egressIP).Run()
+		_ = eip.execer.Command("/sbin/arping", "-q", "-U", "-c", "1", "-I", localEgressLink.Attrs().Name, egressIP).Run()
 	}()
 
 	if err := eip.iptables.AddEgressIPRules(egressIP, mark); err != nil {
@@ -0,0 +1,101 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"k8s.io/klog/v2"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// getEgressIPHealth returns the current EgressIPHealth, sorted by node IP
+func (eip *egressIPWatcher) getEgressIPHealth() *common.EgressIPHealth {
+	eip.monitorNodesLock.Lock()
+	defer eip.monitorNodesLock.Unlock()
+
+	health := &common.EgressIPHealth{LastUpdate: metav1.Now()}
+	for _, node := range eip.monitorNodes {
+		peer := common.EgressIPPeerHealth{
+			NodeIP:    node.nodeIP,
+			EgressIPs: node.egressIPs.List(),
+			Reachable: !node.offline,
+		}
+		if !node.lastProbe.IsZero() {
+			t := metav1.NewTime(node.lastProbe)
+			peer.LastProbe = &t
+		}
+		if !node.lastSuccess.IsZero() {
+			t := metav1.NewTime(node.lastSuccess)
+			peer.LastSuccess = &t
+		}
+		health.Peers = append(health.Peers, peer)
+	}
+	sort.Slice(health.Peers, func(i, j int) bool {
+		return health.Peers[i].NodeIP < health.Peers[j].NodeIP
+	})
+	return health
+}
+
+// egressIPHealthChanged returns true if the peers, their egress IPs, or their
+// reachability differ between old and new (ignoring timestamps)
+func egressIPHealthChanged(old, new *common.EgressIPHealth) bool {
+	if old == nil || len(old.Peers) != len(new.Peers) {
+		return true
+	}
+	for i := range old.Peers {
+		oldPeer, newPeer := &old.Peers[i], &new.Peers[i]
+		if oldPeer.NodeIP != newPeer.NodeIP || oldPeer.Reachable != newPeer.Reachable || !reflect.DeepEqual(oldPeer.EgressIPs, newPeer.EgressIPs) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishHealth writes EgressIPHealthAnnotation to our HostSubnet if the peers or
+// their reachability have changed. (Since every node watches HostSubnets, the
+// annotation is not rewritten just to update the probe timestamps; the node's SDN
+// Lease shows whether it is still current.)
+func (eip *egressIPWatcher) publishHealth() {
+	if eip.osdnClient == nil {
+		return
+	}
+	health := eip.getEgressIPHealth()
+
+	eip.healthLock.Lock()
+	defer eip.healthLock.Unlock()
+	if !egressIPHealthChanged(eip.lastHealth, health) {
+		return
+	}
+
+	value, err := json.Marshal(health)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Could not encode egress IP health: %v", err))
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				common.EgressIPHealthAnnotation: string(value),
+			},
+		},
+	})
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Could not encode egress IP health: %v", err))
+		return
+	}
+	_, err = eip.osdnClient.NetworkV1().HostSubnets().Patch(context.TODO(), eip.nodeName, ktypes.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Could not update egress IP health on HostSubnet %q: %v", eip.nodeName, err))
+		return
+	}
+	klog.V(5).Infof("Updated egress IP health: %s", string(value))
+	eip.lastHealth = health
+}
@@ -0,0 +1,67 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestEgressIPHealthAnnotation(t *testing.T) {
+	eip, _ := setupEgressIPWatcher(t)
+
+	probed := time.Now().Add(-10 * time.Second)
+	succeeded := probed.Add(-time.Minute)
+	eip.monitorNodes["172.17.0.5"] = &egressNode{
+		nodeIP:      "172.17.0.5",
+		egressIPs:   sets.NewString("172.17.0.101", "172.17.0.100"),
+		lastProbe:   probed,
+		lastSuccess: probed,
+	}
+	eip.monitorNodes["172.17.0.3"] = &egressNode{
+		nodeIP:      "172.17.0.3",
+		offline:     true,
+		egressIPs:   sets.NewString("172.17.0.102"),
+		lastProbe:   probed,
+		lastSuccess: succeeded,
+	}
+
+	health := eip.getEgressIPHealth()
+	if len(health.Peers) != 2 {
+		t.Fatalf("unexpected peers %#v", health.Peers)
+	}
+	peer := health.Peers[0]
+	if peer.NodeIP != "172.17.0.3" || peer.Reachable || !reflect.DeepEqual(peer.EgressIPs, []string{"172.17.0.102"}) ||
+		!peer.LastProbe.Time.Equal(probed) || !peer.LastSuccess.Time.Equal(succeeded) {
+		t.Fatalf("unexpected health for 172.17.0.3: %#v", peer)
+	}
+	peer = health.Peers[1]
+	if peer.NodeIP != "172.17.0.5" || !peer.Reachable || !reflect.DeepEqual(peer.EgressIPs, []string{"172.17.0.100", "172.17.0.101"}) ||
+		!peer.LastProbe.Time.Equal(probed) || !peer.LastSuccess.Time.Equal(probed) {
+		t.Fatalf("unexpected health for 172.17.0.5: %#v", peer)
+	}
+
+	// Only reachability and egress IP changes count as changes
+	if egressIPHealthChanged(health, eip.getEgressIPHealth()) {
+		t.Fatalf("unexpected change in health")
+	}
+	eip.monitorNodes["172.17.0.5"].lastProbe = time.Now()
+	if egressIPHealthChanged(health, eip.getEgressIPHealth()) {
+		t.Fatalf("unexpected change in health after probe")
+	}
+	eip.monitorNodes["172.17.0.3"].offline = false
+	if !egressIPHealthChanged(health, eip.getEgressIPHealth()) {
+		t.Fatalf("expected change in health after node came back online")
+	}
+	health = eip.getEgressIPHealth()
+	eip.monitorNodes["172.17.0.5"].egressIPs.Delete("172.17.0.101")
+	if !egressIPHealthChanged(health, eip.getEgressIPHealth()) {
+		t.Fatalf("expected change in health after egress IP removed")
+	}
+	health = eip.getEgressIPHealth()
+	delete(eip.monitorNodes, "172.17.0.3")
+	if !egressIPHealthChanged(health, eip.getEgressIPHealth()) {
+		t.Fatalf("expected change in health after node removed")
+	}
+}
@@ -1073,3 +1073,154 @@ func TestEgressNodeRenumbering(t *testing.T) {
 		t.Fatalf("the egress is not properly set up: %s\n", groups)
 	}
 }
+
+func TestEgressLocalIPChange(t *testing.T) {
+	localHostSubnet := func(hostIP string) *osdnv1.HostSubnet {
+		return &osdnv1.HostSubnet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "local",
+				UID:  ktypes.UID("local"),
+			},
+			Host:      "local",
+			HostIP:    hostIP,
+			EgressIPs: []osdnv1.HostSubnetEgressIP{"172.17.0.100"},
+		}
+	}
+	localGroup := fmt.Sprintf("group_id=42,type=select,bucket=actions=set_field:c6:ac:2c:13:48:4b->eth_dst,set_field:%s->pkt_mark,output:tun0", getMarkForVNID(42, 0))
+	remoteGroup := "group_id=42,type=select,bucket=actions=ct(commit),move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:172.17.0.5->tun_dst,output:vxlan0"
+	assertGroup := func(eip *egressIPWatcher, expected string) {
+		t.Helper()
+		groups, _ := eip.oc.ovs.DumpGroups()
+		theSame, err := compareGroups(groups, []string{expected})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !theSame {
+			t.Fatalf("the egress is not properly set up: %s\n", groups)
+		}
+	}
+
+	for _, trackerFirst := range []bool{false, true} {
+		eip, _ := setupEgressIPWatcher(t)
+		eip.tracker.UpdateHostSubnetEgress(localHostSubnet("172.17.0.4"))
+		updateNamespaceEgress(eip, 42, []string{"172.17.0.100"})
+		if err := assertNetlinkChange(eip, "claim 172.17.0.100"); err != nil {
+			t.Fatalf("%v", err)
+		}
+		assertGroup(eip, localGroup)
+
+		// The master changes our HostIP; the tracker and the node may see the
+		// change in either order
+		if trackerFirst {
+			eip.tracker.UpdateHostSubnetEgress(localHostSubnet("172.17.0.5"))
+			// Until the node sees the change, the tracker's view is that the
+			// egress IP moved to a remote node
+			if err := assertNetlinkChange(eip, "release 172.17.0.100"); err != nil {
+				t.Fatalf("%v", err)
+			}
+			assertGroup(eip, remoteGroup)
+		}
+
+		if err := eip.oc.SetLocalIP("172.17.0.5"); err != nil {
+			t.Fatalf("unexpected error setting local IP: %v", err)
+		}
+		eip.updateLocalIP("172.17.0.5")
+		if trackerFirst {
+			if err := assertNetlinkChange(eip, "claim 172.17.0.100"); err != nil {
+				t.Fatalf("%v", err)
+			}
+		} else {
+			// The egress IP is moved to the new IP's interface
+			if err := assertNetlinkChange(eip, "release 172.17.0.100", "claim 172.17.0.100"); err != nil {
+				t.Fatalf("%v", err)
+			}
+			eip.tracker.UpdateHostSubnetEgress(localHostSubnet("172.17.0.5"))
+			if err := assertNetlinkChange(eip, "claim 172.17.0.100"); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+		if err := assertNoNetlinkChanges(eip); err != nil {
+			t.Fatalf("%v", err)
+		}
+		assertGroup(eip, localGroup)
+		if ips := eip.monitoredEgressIPs("172.17.0.5"); len(ips) != 0 {
+			t.Fatalf("unexpectedly monitoring own node IP for %v", ips)
+		}
+	}
+}
+
+// failingVNIDOVS is an ovs.Interface whose transactions fail to commit if they add
+// a flow for vnid
+type failingVNIDOVS struct {
+	ovs.Interface
+	vnid uint32
+}
+
+func (f *failingVNIDOVS) NewTransaction() ovs.Transaction {
+	return &failingVNIDTx{Transaction: f.Interface.NewTransaction(), match: fmt.Sprintf("reg0=%d,", f.vnid)}
+}
+
+type failingVNIDTx struct {
+	ovs.Transaction
+	match string
+	fail  bool
+}
+
+func (tx *failingVNIDTx) AddFlow(flow string, args ...interface{}) {
+	if len(args) > 0 {
+		flow = fmt.Sprintf(flow, args...)
+	}
+	if strings.Contains(flow, tx.match) {
+		tx.fail = true
+	}
+	tx.Transaction.AddFlow(flow)
+}
+
+func (tx *failingVNIDTx) Commit() error {
+	if tx.fail {
+		return fmt.Errorf("injected failure")
+	}
+	return tx.Transaction.Commit()
+}
+
+func TestEgressIPNamespaceFailure(t *testing.T) {
+	eip, flows := setupEgressIPWatcher(t)
+
+	updateNamespaceEgress(eip, 42, []string{"172.17.0.100"})
+	updateNamespaceEgress(eip, 43, []string{"172.17.0.101"})
+	err := assertOVSChanges(eip, &flows,
+		egressOVSChange{vnid: 42, egress: Dropped},
+		egressOVSChange{vnid: 43, egress: Dropped},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Both namespaces' egress IPs become available in the same sync, but the
+	// changes for VNID 43 can't be applied; the changes for VNID 42 still are
+	eip.oc.ovs = &failingVNIDOVS{Interface: eip.oc.ovs, vnid: 43}
+	updateNodeEgress(eip, "172.17.0.3", []string{"172.17.0.100", "172.17.0.101"})
+	err = assertOVSChanges(eip, &flows,
+		egressOVSChange{vnid: 42, egress: Remote, remote: "group:42"},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestEgressIPBandwidthRule(t *testing.T) {
+	for _, tc := range []struct {
+		bandwidth int64
+		rate      string
+	}{
+		{bandwidth: 8 * 1024 * 1024 * 100, rate: "100mb/s"},
+		{bandwidth: 8 * 1024 * 10, rate: "10kb/s"},
+		{bandwidth: 100000000, rate: "12500000b/s"},
+	} {
+		rule := egressIPBandwidthRule("0x0000002a", tc.bandwidth)
+		expected := []string{"-m", "mark", "--mark", "0x0000002a", "-m", "hashlimit", "--hashlimit-name", "eip-0000002a", "--hashlimit-above", tc.rate, "-j", "DROP"}
+		if !reflect.DeepEqual(rule, expected) {
+			t.Errorf("bandwidth %d: expected %v, got %v", tc.bandwidth, expected, rule)
+		}
+	}
+}
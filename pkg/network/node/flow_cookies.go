@@ -0,0 +1,175 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/openshift/sdn/pkg/network/node/metrics"
+	"github.com/openshift/sdn/pkg/util/ovs"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Flows that belong to a particular pod, service, or namespace have cookies that
+// identify their owner, so that all of the owner's flows can be deleted (or counted)
+// with a single cookie/mask match. The cookie is laid out as:
+//
+//	bits 56-63: the owner class (flowOwnerPod, etc)
+//	bits 8-55:  the owner hash (the pod IP, a hash of the service name, or the VNID)
+//	bits 0-7:   the kind of flow, for flows that are treated specially (eg, trafficPodCookie)
+//
+// Flows without an owner class (eg, the static flows, and the HostSubnet flows, which
+// use hostSubnetCookie) don't follow this layout.
+type flowOwnerClass uint8
+
+const (
+	flowOwnerNone flowOwnerClass = iota
+	flowOwnerPod
+	flowOwnerService
+	flowOwnerPolicy
+	flowOwnerEgress
+)
+
+var flowOwnerClassNames = map[flowOwnerClass]string{
+	flowOwnerNone:    "none",
+	flowOwnerPod:     "pod",
+	flowOwnerService: "service",
+	flowOwnerPolicy:  "policy",
+	flowOwnerEgress:  "egress",
+}
+
+func (class flowOwnerClass) String() string {
+	if name, ok := flowOwnerClassNames[class]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown-%d", uint8(class))
+}
+
+const (
+	flowOwnerClassShift = 56
+	flowOwnerHashShift  = 8
+	flowOwnerHashBits   = 48
+
+	// flowOwnerMask is the cookie mask matching a flow's owner class and hash
+	flowOwnerMask = "0xffffffffffffff00"
+	// flowKindMask is the cookie mask matching a flow's kind
+	flowKindMask = "0xff"
+)
+
+// flowOwner identifies the object that a set of flows belongs to
+type flowOwner struct {
+	class flowOwnerClass
+	hash  uint64
+}
+
+// podFlowOwner returns the owner of a pod's flows. Pods are identified by their
+// IPv4 address, which is unique on the node.
+func podFlowOwner(podIP net.IP) flowOwner {
+	var hash uint64
+	if ip4 := podIP.To4(); ip4 != nil {
+		hash = uint64(binary.BigEndian.Uint32(ip4))
+	}
+	return flowOwner{class: flowOwnerPod, hash: hash}
+}
+
+// serviceFlowOwner returns the owner of a service's flows
+func serviceFlowOwner(service *corev1.Service) flowOwner {
+	sum := sha256.Sum256([]byte(service.Namespace + "/" + service.Name))
+	return flowOwner{class: flowOwnerService, hash: binary.BigEndian.Uint64(sum[:8]) >> (64 - flowOwnerHashBits)}
+}
+
+// policyFlowOwner returns the owner of the table 80 policy flows for vnid
+func policyFlowOwner(vnid uint32) flowOwner {
+	return flowOwner{class: flowOwnerPolicy, hash: uint64(vnid)}
+}
+
+// sharedServicesFlowOwner returns the owner of the shared-services flow allowing
+// traffic from srcVNID to dstVNID. (Since VNIDs are 24 bits and 0 is never a
+// source, this can't collide with policyFlowOwner.)
+func sharedServicesFlowOwner(srcVNID, dstVNID uint32) flowOwner {
+	return flowOwner{class: flowOwnerPolicy, hash: uint64(srcVNID)<<24 | uint64(dstVNID)}
+}
+
+// egressFlowOwner returns the owner of the egress firewall and egress IP flows for vnid
+func egressFlowOwner(vnid uint32) flowOwner {
+	return flowOwner{class: flowOwnerEgress, hash: uint64(vnid)}
+}
+
+func (owner flowOwner) value() uint64 {
+	hash := owner.hash & (1<<flowOwnerHashBits - 1)
+	return uint64(owner.class)<<flowOwnerClassShift | hash<<flowOwnerHashShift
+}
+
+// cookie returns the cookie for one of owner's flows of the given kind ("0" for
+// an ordinary flow)
+func (owner flowOwner) cookie(kind string) string {
+	k, _ := strconv.ParseUint(kind, 0, 8)
+	return fmt.Sprintf("0x%x", owner.value()|k)
+}
+
+// match returns a cookie match for all of owner's flows, for use in DeleteFlows
+func (owner flowOwner) match() string {
+	return fmt.Sprintf("cookie=0x%x/%s", owner.value(), flowOwnerMask)
+}
+
+// kindMatch returns a cookie match for owner's flows of the given kind ("0" for its
+// ordinary flows), for use in DeleteFlows
+func (owner flowOwner) kindMatch(kind string) string {
+	return fmt.Sprintf("cookie=%s/0xffffffffffffffff", owner.cookie(kind))
+}
+
+// parseFlowCookie returns the owner class and kind of a flow, given its cookie
+func parseFlowCookie(cookie string) (flowOwnerClass, string) {
+	value, err := strconv.ParseUint(cookie, 0, 64)
+	if err != nil {
+		return flowOwnerNone, ""
+	}
+	return flowOwnerClass(value >> flowOwnerClassShift), fmt.Sprintf("0x%x", value&0xff)
+}
+
+// parseFlowOwner returns the owner of a flow, given its cookie, or false if the
+// cookie does not identify an owner
+func parseFlowOwner(cookie string) (flowOwner, bool) {
+	value, err := strconv.ParseUint(cookie, 0, 64)
+	if err != nil {
+		return flowOwner{}, false
+	}
+	class := flowOwnerClass(value >> flowOwnerClassShift)
+	if _, ok := flowOwnerClassNames[class]; !ok || class == flowOwnerNone {
+		return flowOwner{}, false
+	}
+	return flowOwner{class: class, hash: (value >> flowOwnerHashShift) & (1<<flowOwnerHashBits - 1)}, true
+}
+
+// flowCookieKind returns the kind of a flow, given its cookie
+func flowCookieKind(cookie string) string {
+	_, kind := parseFlowCookie(cookie)
+	return kind
+}
+
+// countFlowsByOwner returns the number of flows belonging to each class of owner
+func countFlowsByOwner(flows []string) map[flowOwnerClass]int {
+	counts := make(map[flowOwnerClass]int)
+	for class := range flowOwnerClassNames {
+		counts[class] = 0
+	}
+	for _, flow := range flows {
+		parsed, err := ovs.ParseFlow(ovs.ParseForDump, flow)
+		if err != nil || parsed.Table == ruleVersionTable {
+			continue
+		}
+		class, _ := parseFlowCookie(parsed.Cookie)
+		counts[class]++
+	}
+	return counts
+}
+
+// updateFlowOwnerStats updates the per-owner flow count metrics from flows
+func (node *OsdnNode) updateFlowOwnerStats(flows []string) {
+	for class, count := range countFlowsByOwner(flows) {
+		metrics.OVSFlowsByOwner.WithLabelValues(class.String()).Set(float64(count))
+	}
+}
@@ -0,0 +1,119 @@
+package node
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFlowCookies(t *testing.T) {
+	pod := podFlowOwner(net.ParseIP("10.128.0.2"))
+	if cookie := pod.cookie("0"); cookie != "0x100000a80000200" {
+		t.Fatalf("unexpected pod cookie %q", cookie)
+	}
+	if cookie := pod.cookie(trafficPodCookie); cookie != "0x100000a800002a1" {
+		t.Fatalf("unexpected pod traffic cookie %q", cookie)
+	}
+	if match := pod.match(); match != "cookie=0x100000a80000200/0xffffffffffffff00" {
+		t.Fatalf("unexpected pod match %q", match)
+	}
+
+	svc1 := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ns1", Name: "svc"}}
+	svc2 := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ns2", Name: "svc"}}
+	if serviceFlowOwner(svc1) == serviceFlowOwner(svc2) {
+		t.Fatalf("services have the same owner")
+	}
+	if policyFlowOwner(42) == egressFlowOwner(42) {
+		t.Fatalf("policy and egress owners are the same")
+	}
+
+	for _, tc := range []struct {
+		cookie string
+		class  flowOwnerClass
+		kind   string
+	}{
+		{cookie: "0", class: flowOwnerNone, kind: "0x0"},
+		{cookie: "0xa1", class: flowOwnerNone, kind: "0xa1"},
+		{cookie: pod.cookie(trafficServiceCookie), class: flowOwnerPod, kind: trafficServiceCookie},
+		{cookie: serviceFlowOwner(svc1).cookie(lbSourceRangeCookie), class: flowOwnerService, kind: lbSourceRangeCookie},
+		{cookie: sharedServicesFlowOwner(10, 11).cookie(sharedServicesCookie), class: flowOwnerPolicy, kind: sharedServicesCookie},
+		{cookie: egressFlowOwner(42).cookie(egressAuditCookie), class: flowOwnerEgress, kind: egressAuditCookie},
+	} {
+		class, kind := parseFlowCookie(tc.cookie)
+		if class != tc.class || kind != tc.kind {
+			t.Errorf("cookie %s: expected %s/%s, got %s/%s", tc.cookie, tc.class, tc.kind, class, kind)
+		}
+	}
+}
+
+func TestFlowOwnerCleanup(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+
+	_, err := oc.SetUpPod(context.TODO(), "pod1", "veth1", net.ParseIP("10.128.0.2"), nil, 42)
+	if err != nil {
+		t.Fatalf("Unexpected error adding pod rules: %v", err)
+	}
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	pod1Flows := len(flows) - len(origFlows)
+
+	_, err = oc.SetUpPod(context.TODO(), "pod2", "veth2", net.ParseIP("10.128.0.3"), nil, 42)
+	if err != nil {
+		t.Fatalf("Unexpected error adding pod rules: %v", err)
+	}
+	if err := oc.SetNamespaceEgressDropped(42, nil); err != nil {
+		t.Fatalf("Unexpected error setting egress: %v", err)
+	}
+
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	counts := countFlowsByOwner(flows)
+	expected := map[flowOwnerClass]int{
+		flowOwnerNone:    len(origFlows) - 1,
+		flowOwnerPod:     2 * pod1Flows,
+		flowOwnerService: 0,
+		flowOwnerPolicy:  0,
+		flowOwnerEgress:  1,
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("Unexpected flow counts: expected %v, got %v", expected, counts)
+	}
+
+	// Deleting one pod's flows shouldn't affect the other's
+	if err := oc.cleanupPodFlows(net.ParseIP("10.128.0.2"), nil); err != nil {
+		t.Fatalf("Unexpected error deleting pod rules: %v", err)
+	}
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	counts = countFlowsByOwner(flows)
+	if counts[flowOwnerPod] != pod1Flows || counts[flowOwnerEgress] != 1 {
+		t.Fatalf("Unexpected flow counts after deleting pod: %v", counts)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{kind: flowAdded, match: []string{"table=20", "nw_src=10.128.0.3", "10.128.0.0/14"}},
+		flowChange{kind: flowAdded, match: []string{"table=20", "nw_src=10.128.0.3", "172.30.0.0/16"}},
+		flowChange{kind: flowAdded, match: []string{"table=20", "nw_src=10.128.0.3", "10.128.0.1,"}},
+		flowChange{kind: flowAdded, match: []string{"table=20", "arp_spa=10.128.0.3"}},
+		flowChange{kind: flowAdded, match: []string{"table=20", "priority=100", "ip", "nw_src=10.128.0.3"}},
+		flowChange{kind: flowAdded, match: []string{"table=25", "nw_src=10.128.0.3"}},
+		flowChange{kind: flowAdded, match: []string{"table=40", "arp_tpa=10.128.0.3"}},
+		flowChange{kind: flowAdded, match: []string{"table=70", "nw_dst=10.128.0.3", "10.128.0.0/14"}},
+		flowChange{kind: flowAdded, match: []string{"table=70", "nw_dst=10.128.0.3", "172.30.0.0/16"}},
+		flowChange{kind: flowAdded, match: []string{"table=70", "nw_dst=10.128.0.3", "nw_src=10.128.0.1,"}},
+		flowChange{kind: flowAdded, match: []string{"table=70", "priority=100", "nw_dst=10.128.0.3"}},
+		flowChange{kind: flowAdded, match: []string{"table=101", "reg0=42", "drop"}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+}
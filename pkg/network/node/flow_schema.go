@@ -0,0 +1,143 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/openshift/sdn/pkg/util/ovs"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// flowTableVersions is the layout version of each OVS table. When the static flows
+// that SetupOVS or SetupOVSIPv6 creates in a table change, or the flows added to it
+// later change in a way that old flows would not be cleaned up correctly (eg, they
+// are given new cookies), bump that table's version (or add the table, if it is
+// new). At startup, if only table versions have changed, the node rebuilds just the
+// changed tables rather than recreating the whole bridge.
+// (Changes that can't be made by rebuilding individual tables, such as changes to
+// the bridge's ports, require bumping ruleVersion instead.)
+var flowTableVersions = map[int]int{
+	0:   2,
+	10:  1,
+	20:  2,
+	21:  2,
+	22:  1,
+	23:  1,
+	25:  2,
+	30:  2,
+	40:  2,
+	50:  1,
+	60:  2,
+	70:  2,
+	80:  4,
+	81:  1,
+	90:  1,
+	99:  2,
+	100: 2,
+	101: 2,
+	110: 1,
+	111: 1,
+	120: 1,
+}
+
+// podFlowTables are the tables containing per-pod flows, which can only be restored
+// after a table is rebuilt by reattaching the pods
+var podFlowTables = sets.NewInt(20, 25, 40, 70, 120)
+
+// flowSchema is the information recorded in the table 253 version note: the plugin
+// ID, ruleVersion, and a (table, version) pair for each table in flowTableVersions.
+type flowSchema struct {
+	pluginId    int
+	ruleVersion int
+	// tables is nil if the note was written before tables were versioned
+	tables map[int]int
+}
+
+// String returns the note for fs; eg, "00.0C.00.01.0A.01"
+func (fs *flowSchema) String() string {
+	tables := make([]int, 0, len(fs.tables))
+	for table := range fs.tables {
+		tables = append(tables, table)
+	}
+	sort.Ints(tables)
+
+	note := fmt.Sprintf("%02X.%02X", fs.pluginId, fs.ruleVersion)
+	for _, table := range tables {
+		note += fmt.Sprintf(".%02X.%02X", table, fs.tables[table])
+	}
+	return note
+}
+
+// parseFlowSchema parses a version note. OVS pads notes with zero bytes, so pairs
+// with a version of 0 (and any unpaired final byte) are ignored.
+func parseFlowSchema(note string) (*flowSchema, error) {
+	var bytes []int
+	for _, field := range strings.Split(note, ".") {
+		b, err := strconv.ParseUint(field, 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("bad version note %q", note)
+		}
+		bytes = append(bytes, int(b))
+	}
+	if len(bytes) < 2 {
+		return nil, fmt.Errorf("bad version note %q", note)
+	}
+
+	fs := &flowSchema{pluginId: bytes[0], ruleVersion: bytes[1]}
+	for i := 2; i+1 < len(bytes); i += 2 {
+		if bytes[i+1] == 0 {
+			continue
+		}
+		if fs.tables == nil {
+			fs.tables = make(map[int]int)
+		}
+		fs.tables[bytes[i]] = bytes[i+1]
+	}
+	return fs, nil
+}
+
+// outdatedTables returns the tables whose versions in fs differ from those in
+// tables, including tables that are no longer used at all
+func (fs *flowSchema) outdatedTables(tables map[int]int) sets.Int {
+	outdated := sets.NewInt()
+	for table, version := range tables {
+		if fs.tables[table] != version {
+			outdated.Insert(table)
+		}
+	}
+	for table := range fs.tables {
+		if _, ok := tables[table]; !ok {
+			outdated.Insert(table)
+		}
+	}
+	return outdated
+}
+
+// flowTablesOutdatedError is returned by OsdnNode.alreadySetUp() when the bridge is
+// set up but some of its tables need to be rebuilt
+type flowTablesOutdatedError struct {
+	tables sets.Int
+}
+
+func (err *flowTablesOutdatedError) Error() string {
+	return fmt.Sprintf("OVS tables %v are out of date", err.tables.List())
+}
+
+// tableFilterTransaction is an ovs.Transaction that drops the flows that are added
+// to tables other than the given ones, so that the flows from SetupOVS can be used
+// to rebuild individual tables
+type tableFilterTransaction struct {
+	ovs.Transaction
+	tables sets.Int
+}
+
+func (tft *tableFilterTransaction) AddFlow(flow string, args ...interface{}) {
+	parsed, err := ovs.ParseFlow(ovs.ParseForAdd, flow, args...)
+	if err != nil || tft.tables.Has(parsed.Table) {
+		// (if the flow can't be parsed, let Commit() return the error)
+		tft.Transaction.AddFlow(flow, args...)
+	}
+}
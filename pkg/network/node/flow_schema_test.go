@@ -0,0 +1,75 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestParseFlowSchema(t *testing.T) {
+	withRemovedTable := map[int]int{35: 1}
+	for table, version := range flowTableVersions {
+		withRemovedTable[table] = version
+	}
+
+	tests := []struct {
+		name     string
+		note     string
+		schema   *flowSchema
+		outdated []int
+	}{
+		{
+			name:     "current",
+			note:     (&flowSchema{pluginId: 1, ruleVersion: 12, tables: flowTableVersions}).String(),
+			schema:   &flowSchema{pluginId: 1, ruleVersion: 12, tables: flowTableVersions},
+			outdated: []int{},
+		},
+		{
+			name:   "legacy",
+			note:   "00.0c.00.00.00.00",
+			schema: &flowSchema{pluginId: 0, ruleVersion: 12},
+		},
+		{
+			name:   "padded",
+			note:   "00.0c.00.01.1e.02.00.00.00.00.00",
+			schema: &flowSchema{pluginId: 0, ruleVersion: 12, tables: map[int]int{0: 1, 30: 2}},
+		},
+		{
+			name:     "removed table",
+			note:     (&flowSchema{pluginId: 0, ruleVersion: 12, tables: withRemovedTable}).String(),
+			schema:   &flowSchema{pluginId: 0, ruleVersion: 12, tables: withRemovedTable},
+			outdated: []int{35},
+		},
+		{
+			name: "too short",
+			note: "00",
+		},
+		{
+			name: "bad byte",
+			note: "00.0c.100.01",
+		},
+	}
+
+	for _, test := range tests {
+		schema, err := parseFlowSchema(test.note)
+		if test.schema == nil {
+			if err == nil {
+				t.Errorf("%s: expected error, got %#v", test.name, schema)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(schema, test.schema) {
+			t.Errorf("%s: expected %#v, got %#v", test.name, test.schema, schema)
+		}
+		if test.outdated != nil {
+			if outdated := schema.outdatedTables(flowTableVersions); !outdated.Equal(sets.NewInt(test.outdated...)) {
+				t.Errorf("%s: expected outdated tables %v, got %v", test.name, test.outdated, outdated.List())
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/openshift/sdn/pkg/network/node/metrics"
+	"github.com/openshift/sdn/pkg/util/ovs"
+)
+
+// flowLimitWarningFraction is the fraction of a flow limit at which the node starts
+// warning that it is being approached
+const flowLimitWarningFraction = 0.8
+
+// flowTableStats tracks which OVS tables are approaching their flow limits
+type flowTableStats struct {
+	limit      int
+	tableLimit int
+
+	// warned holds the tables (and "total", for the total) that are currently
+	// above the warning level, so that only one event is emitted each time a
+	// table crosses it
+	warned sets.String
+}
+
+func newFlowTableStats(limit, tableLimit int) *flowTableStats {
+	return &flowTableStats{limit: limit, tableLimit: tableLimit, warned: sets.NewString()}
+}
+
+// countFlowsByTable returns the number of flows in each table
+func countFlowsByTable(flows []string) map[int]int {
+	counts := make(map[int]int)
+	for table := range flowTableVersions {
+		counts[table] = 0
+	}
+	for _, flow := range flows {
+		parsed, err := ovs.ParseFlow(ovs.ParseForDump, flow)
+		if err != nil {
+			continue
+		}
+		counts[parsed.Table]++
+	}
+	return counts
+}
+
+// update records the current per-table flow counts, and returns a warning for each
+// limit that is newly being approached
+func (fts *flowTableStats) update(counts map[int]int) []string {
+	var warnings []string
+	check := func(name string, count, limit int) {
+		if limit <= 0 {
+			return
+		}
+		if float64(count) < flowLimitWarningFraction*float64(limit) {
+			if fts.warned.Has(name) {
+				klog.Infof("OVS flows in %s (%d) are no longer approaching the limit of %d", name, count, limit)
+				fts.warned.Delete(name)
+			}
+			return
+		}
+		if !fts.warned.Has(name) {
+			fts.warned.Insert(name)
+			warnings = append(warnings, fmt.Sprintf("%s has %d OVS flows, approaching the limit of %d", name, count, limit))
+		}
+	}
+
+	tables := make([]int, 0, len(counts))
+	for table := range counts {
+		tables = append(tables, table)
+	}
+	sort.Ints(tables)
+
+	total := 0
+	for _, table := range tables {
+		total += counts[table]
+		check(fmt.Sprintf("table %d", table), counts[table], fts.tableLimit)
+	}
+	check("total", total, fts.limit)
+	return warnings
+}
+
+// updateFlowTableStats updates the per-table flow count metrics from flows, and
+// emits an event if the flows are approaching the configured limits
+func (node *OsdnNode) updateFlowTableStats(flows []string) {
+	counts := countFlowsByTable(flows)
+	for table, count := range counts {
+		metrics.OVSTableFlows.WithLabelValues(strconv.Itoa(table)).Set(float64(count))
+	}
+
+	for _, warning := range node.flowTableStats.update(counts) {
+		klog.Warningf("%s", warning)
+		node.recorder.Eventf(&corev1.ObjectReference{Kind: "Node", Name: node.hostName}, corev1.EventTypeWarning, "OVSFlowLimitApproaching", "%s", warning)
+	}
+}
+
+// updateFlowStats updates all of the metrics that are computed from the OVS flows,
+// from a single dump of the flows
+func (node *OsdnNode) updateFlowStats() {
+	flows, err := node.oc.ovs.DumpFlows("")
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not dump OVS flows for metrics: %v", err))
+		return
+	}
+	node.updateEgressFirewallStats(flows)
+	node.updateTrafficStats(flows)
+	node.updateFlowOwnerStats(flows)
+	node.updateFlowTableStats(flows)
+}
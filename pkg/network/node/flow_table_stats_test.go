@@ -0,0 +1,54 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFlowTableStats(t *testing.T) {
+	counts := countFlowsByTable([]string{
+		" cookie=0, table=0, priority=100, actions=drop",
+		" cookie=0, table=80, priority=100, reg1=42, actions=drop",
+		" cookie=0, table=80, priority=0, actions=drop",
+		" cookie=0, table=254, priority=0, actions=drop",
+	})
+	if counts[0] != 1 || counts[80] != 2 || counts[254] != 1 || counts[10] != 0 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+	if _, ok := counts[10]; !ok {
+		t.Fatalf("expected known tables to be counted even if empty")
+	}
+
+	fts := newFlowTableStats(100, 50)
+	warnings := fts.update(map[int]int{20: 10, 80: 30})
+	if len(warnings) != 0 {
+		t.Fatalf("unexpected warnings %v", warnings)
+	}
+
+	warnings = fts.update(map[int]int{20: 10, 80: 45})
+	expected := []string{"table 80 has 45 OVS flows, approaching the limit of 50"}
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Fatalf("expected %v, got %v", expected, warnings)
+	}
+
+	// No repeated warnings while still over the warning level
+	warnings = fts.update(map[int]int{20: 35, 80: 45})
+	expected = []string{"total has 80 OVS flows, approaching the limit of 100"}
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Fatalf("expected %v, got %v", expected, warnings)
+	}
+
+	// ... but warn again after dropping below it and crossing it again
+	_ = fts.update(map[int]int{20: 10, 80: 10})
+	warnings = fts.update(map[int]int{20: 10, 80: 45})
+	expected = []string{"table 80 has 45 OVS flows, approaching the limit of 50"}
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Fatalf("expected %v, got %v", expected, warnings)
+	}
+
+	// Limits of 0 are disabled
+	fts = newFlowTableStats(0, 0)
+	if warnings := fts.update(map[int]int{80: 1000000}); len(warnings) != 0 {
+		t.Fatalf("unexpected warnings %v", warnings)
+	}
+}
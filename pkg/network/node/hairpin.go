@@ -0,0 +1,213 @@
+package node
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/kubernetes/pkg/apis/core/v1/helper"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+const (
+	// HairpinModeAnnotation can be set on a Namespace to choose the source address
+	// of "hairpin" traffic to the namespace's services: traffic from a pod to a
+	// service IP that kube-proxy sends back to the same pod. Since a pod can't
+	// accept traffic from its own IP (and its replies would never be un-NATted), the
+	// source address always has to be rewritten.
+	HairpinModeAnnotation = "network.openshift.io/hairpin-mode"
+
+	// HairpinModeMasquerade, the default, masquerades hairpin traffic to the node's
+	// tun0 IP, which is also the source of traffic from the node itself
+	HairpinModeMasquerade = "Masquerade"
+	// HairpinModeServiceIP NATs hairpin traffic to the service's cluster IP, so that
+	// the pod sees the connection as coming from the address it connected to, for
+	// protocols that check the peer address or that break when it is the node's.
+	// Only IPv4 cluster IPs are supported.
+	HairpinModeServiceIP = "ServiceIP"
+)
+
+// parseHairpinMode parses ns's HairpinModeAnnotation
+func parseHairpinMode(ns *corev1.Namespace) (string, error) {
+	switch mode := ns.Annotations[HairpinModeAnnotation]; mode {
+	case "", HairpinModeMasquerade:
+		return HairpinModeMasquerade, nil
+	case HairpinModeServiceIP:
+		return mode, nil
+	default:
+		return HairpinModeMasquerade, fmt.Errorf("invalid %s annotation %q on namespace %q", HairpinModeAnnotation, mode, ns.Name)
+	}
+}
+
+// hairpinService is a service that has HairpinModeServiceIP rules
+type hairpinService struct {
+	service *corev1.Service
+	vnid    uint32
+}
+
+// hairpinServices tracks the namespaces using HairpinModeServiceIP and the services
+// that have rules for it
+type hairpinServices struct {
+	lock sync.Mutex
+	// serviceIPNamespaces are the namespaces using HairpinModeServiceIP
+	serviceIPNamespaces map[string]bool
+	// active are the services whose rules are currently installed
+	active map[ktypes.NamespacedName]hairpinService
+}
+
+func newHairpinServices() *hairpinServices {
+	return &hairpinServices{
+		serviceIPNamespaces: make(map[string]bool),
+		active:              make(map[ktypes.NamespacedName]hairpinService),
+	}
+}
+
+func (node *OsdnNode) watchHairpinServices() {
+	funcs := common.InformerFuncs(&corev1.Namespace{}, node.handleAddOrUpdateHairpinNamespace, node.handleDeleteHairpinNamespace)
+	node.kubeInformers.Core().V1().Namespaces().Informer().AddEventHandler(funcs)
+	funcs = common.InformerFuncs(&corev1.Service{}, node.handleAddOrUpdateHairpinService, node.handleDeleteHairpinService)
+	node.kubeInformers.Core().V1().Services().Informer().AddEventHandler(funcs)
+}
+
+func (node *OsdnNode) handleAddOrUpdateHairpinNamespace(obj, _ interface{}, eventType watch.EventType) {
+	ns := obj.(*corev1.Namespace)
+	mode, err := parseHairpinMode(ns)
+	if err != nil {
+		utilruntime.HandleError(err)
+	}
+	node.setHairpinMode(ns.Name, mode)
+}
+
+func (node *OsdnNode) handleDeleteHairpinNamespace(obj interface{}) {
+	ns := obj.(*corev1.Namespace)
+	node.setHairpinMode(ns.Name, HairpinModeMasquerade)
+}
+
+// setHairpinMode updates the rules of namespace's services for its hairpin mode
+func (node *OsdnNode) setHairpinMode(namespace, mode string) {
+	hs := node.hairpin
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	serviceIP := mode == HairpinModeServiceIP
+	if hs.serviceIPNamespaces[namespace] == serviceIP {
+		return
+	}
+	klog.V(2).Infof("Hairpin mode of namespace %q is now %s", namespace, mode)
+	if serviceIP {
+		hs.serviceIPNamespaces[namespace] = true
+	} else {
+		delete(hs.serviceIPNamespaces, namespace)
+	}
+
+	services, err := node.kubeInformers.Core().V1().Services().Lister().Services(namespace).List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Could not list services in namespace %q: %v", namespace, err))
+	}
+	for _, service := range services {
+		node.syncHairpinService(service, false)
+	}
+	// Services that are no longer in the cache have been deleted
+	for key, active := range hs.active {
+		if key.Namespace == namespace && !serviceIP {
+			node.syncHairpinService(active.service, true)
+		}
+	}
+}
+
+func (node *OsdnNode) handleAddOrUpdateHairpinService(obj, oldObj interface{}, eventType watch.EventType) {
+	service := obj.(*corev1.Service)
+	if oldService, ok := oldObj.(*corev1.Service); ok && oldService.Spec.ClusterIP == service.Spec.ClusterIP {
+		return
+	}
+	node.resyncHairpinService(service)
+}
+
+func (node *OsdnNode) handleDeleteHairpinService(obj interface{}) {
+	service := obj.(*corev1.Service)
+	node.hairpin.lock.Lock()
+	defer node.hairpin.lock.Unlock()
+	node.syncHairpinService(service, true)
+}
+
+// resyncHairpinService updates service's hairpin rules, eg after its namespace's
+// VNID changes
+func (node *OsdnNode) resyncHairpinService(service *corev1.Service) {
+	node.hairpin.lock.Lock()
+	defer node.hairpin.lock.Unlock()
+	node.syncHairpinService(service, false)
+}
+
+// resyncHairpinRules rewrites the HairpinModeServiceIP rules of every service that
+// has them, in case they have drifted
+func (node *OsdnNode) resyncHairpinRules() {
+	hs := node.hairpin
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	for key, active := range hs.active {
+		if err := node.oc.AddHairpinRules(active.service, active.vnid); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Error adding OVS flows for hairpin traffic of service %s: %v", key, err))
+		}
+		if err := node.nodeIPTables.AddHairpinServiceIP(active.service.Spec.ClusterIP); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Error adding iptables rule for hairpin traffic of service %s: %v", key, err))
+		}
+	}
+}
+
+// syncHairpinService adds, updates, or deletes service's HairpinModeServiceIP
+// rules. Must be called with the hairpin lock held.
+func (node *OsdnNode) syncHairpinService(service *corev1.Service, deleted bool) {
+	hs := node.hairpin
+	key := ktypes.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+
+	want := !deleted && hs.serviceIPNamespaces[service.Namespace] && helper.IsServiceIPSet(service)
+	if want {
+		if ip := net.ParseIP(service.Spec.ClusterIP); ip == nil || ip.To4() == nil {
+			want = false
+		}
+	}
+	var vnid uint32
+	if want {
+		var err error
+		if vnid, err = node.policy.GetVNID(service.Namespace); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Could not add hairpin rules for service %s: %v", key, err))
+			want = false
+		}
+	}
+
+	if active, ok := hs.active[key]; ok {
+		if want && active.service.Spec.ClusterIP == service.Spec.ClusterIP && active.vnid == vnid {
+			return
+		}
+		if err := node.oc.DeleteHairpinRules(active.service); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Error deleting OVS flows for hairpin traffic of service %s: %v", key, err))
+		}
+		if err := node.nodeIPTables.DeleteHairpinServiceIP(active.service.Spec.ClusterIP); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Error deleting iptables rule for hairpin traffic of service %s: %v", key, err))
+		}
+		delete(hs.active, key)
+	}
+	if !want {
+		return
+	}
+
+	klog.V(5).Infof("Adding hairpin rules for service %s (%s)", key, service.Spec.ClusterIP)
+	if err := node.oc.AddHairpinRules(service, vnid); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Error adding OVS flows for hairpin traffic of service %s: %v", key, err))
+		return
+	}
+	if err := node.nodeIPTables.AddHairpinServiceIP(service.Spec.ClusterIP); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Error adding iptables rule for hairpin traffic of service %s: %v", key, err))
+		return
+	}
+	hs.active[key] = hairpinService{service: service, vnid: vnid}
+}
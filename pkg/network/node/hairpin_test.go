@@ -0,0 +1,88 @@
+package node
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseHairpinMode(t *testing.T) {
+	for _, tc := range []struct {
+		annotation string
+		mode       string
+		err        bool
+	}{
+		{annotation: "", mode: HairpinModeMasquerade},
+		{annotation: "Masquerade", mode: HairpinModeMasquerade},
+		{annotation: "ServiceIP", mode: HairpinModeServiceIP},
+		{annotation: "serviceip", mode: HairpinModeMasquerade, err: true},
+		{annotation: "PreserveSource", mode: HairpinModeMasquerade, err: true},
+	} {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns"}}
+		if tc.annotation != "" {
+			ns.Annotations = map[string]string{HairpinModeAnnotation: tc.annotation}
+		}
+		mode, err := parseHairpinMode(ns)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: unexpected error %v", tc.annotation, err)
+		}
+		if mode != tc.mode {
+			t.Errorf("%q: expected %q, got %q", tc.annotation, tc.mode, mode)
+		}
+	}
+}
+
+func TestOVSHairpinRules(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+	// The table 60 flow is only needed without conntrack
+	oc.useConnTrack = false
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "service"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "172.30.99.99",
+			Ports:     []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80}},
+		},
+	}
+	if err := oc.AddServiceRules(svc, 42); err != nil {
+		t.Fatalf("Unexpected error adding service rules: %v", err)
+	}
+	if err := oc.AddHairpinRules(svc, 42); err != nil {
+		t.Fatalf("Unexpected error adding hairpin rules: %v", err)
+	}
+	// Deleting the service's other flows leaves the hairpin flows
+	if err := oc.DeleteServiceRules(svc); err != nil {
+		t.Fatalf("Unexpected error deleting service rules: %v", err)
+	}
+
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{
+			kind:    flowAdded,
+			match:   []string{"table=60", "reg0=42", "nw_dst=172.30.99.99", "42->NXM_NX_REG1", "goto_table:80"},
+			noMatch: []string{"tcp"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=80", "priority=300", "in_port=2", "nw_src=172.30.99.99", "output:NXM_NX_REG2[]"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	if err := oc.DeleteHairpinRules(svc); err != nil {
+		t.Fatalf("Unexpected error deleting hairpin rules: %v", err)
+	}
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	if err := assertFlowChanges(origFlows, flows); err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+}
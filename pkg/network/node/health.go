@@ -0,0 +1,149 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// SubsystemHealth is the health of a single node subsystem
+type SubsystemHealth struct {
+	Healthy bool   `json:"healthy"`
+	Message string `json:"message,omitempty"`
+}
+
+// NodeHealth is the aggregated health of the node, as returned by ServeHealthz
+type NodeHealth struct {
+	Healthy    bool                       `json:"healthy"`
+	Subsystems map[string]SubsystemHealth `json:"subsystems"`
+}
+
+// healthChecks holds the checks that make up the node's aggregated health
+type healthChecks struct {
+	lock   sync.Mutex
+	checks map[string]func() error
+}
+
+// AddHealthCheck adds a check to the node's aggregated health. check should return
+// nil if the named subsystem is healthy, or an error describing the problem.
+func (node *OsdnNode) AddHealthCheck(name string, check func() error) {
+	node.health.lock.Lock()
+	defer node.health.lock.Unlock()
+	if node.health.checks == nil {
+		node.health.checks = make(map[string]func() error)
+	}
+	node.health.checks[name] = check
+}
+
+// CheckHealth runs all of the node's health checks
+func (node *OsdnNode) CheckHealth() *NodeHealth {
+	node.health.lock.Lock()
+	checks := make(map[string]func() error, len(node.health.checks))
+	for name, check := range node.health.checks {
+		checks[name] = check
+	}
+	node.health.lock.Unlock()
+
+	health := &NodeHealth{
+		Healthy:    true,
+		Subsystems: make(map[string]SubsystemHealth, len(checks)),
+	}
+	if len(checks) == 0 {
+		health.Healthy = false
+	}
+	for name, check := range checks {
+		if err := check(); err != nil {
+			health.Subsystems[name] = SubsystemHealth{Healthy: false, Message: err.Error()}
+			health.Healthy = false
+		} else {
+			health.Subsystems[name] = SubsystemHealth{Healthy: true}
+		}
+	}
+	return health
+}
+
+// ServeHealthz is an HTTP handler returning the node's aggregated health as JSON.
+// The status is 200 if every subsystem is healthy and 503 otherwise.
+func (node *OsdnNode) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	health := node.CheckHealth()
+	w.Header().Set("Content-Type", "application/json")
+	if health.Healthy {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not write health response: %v", err))
+	}
+}
+
+// addDefaultHealthChecks adds the health checks for the subsystems managed by
+// OsdnNode itself. It is called from Start().
+func (node *OsdnNode) addDefaultHealthChecks() {
+	node.AddHealthCheck("ovs", node.checkOVSHealth)
+	node.AddHealthCheck("cni-server", node.checkCNIServerHealth)
+	node.AddHealthCheck("informers", node.checkInformerHealth)
+	node.AddHealthCheck("startup", node.podManager.checkReady)
+	node.AddHealthCheck("node-ip", node.checkNodeIPHealth)
+	if node.policy.SupportsVNIDs() {
+		node.AddHealthCheck("egress-ip", node.egressIP.checkHealth)
+	}
+}
+
+func (node *OsdnNode) checkOVSHealth() error {
+	dialErr, pingErr := dialAndPing(ovsDialDefaultNetwork, ovsDialDefaultAddress)
+	if dialErr != nil {
+		return fmt.Errorf("could not connect to OVS: %v", dialErr)
+	} else if pingErr != nil {
+		return fmt.Errorf("could not ping OVS: %v", pingErr)
+	}
+	return node.alreadySetUp()
+}
+
+func (node *OsdnNode) checkCNIServerHealth() error {
+	return node.podManager.checkCNIServerHealth()
+}
+
+func (m *podManager) checkCNIServerHealth() error {
+	m.cniServerLock.Lock()
+	defer m.cniServerLock.Unlock()
+	if m.cniServer == nil {
+		return fmt.Errorf("CNI server has not been started")
+	}
+	return m.cniServer.CheckHealth()
+}
+
+func (node *OsdnNode) checkInformerHealth() error {
+	// Passing a closed channel makes WaitForCacheSync return the current state
+	// rather than blocking.
+	stopCh := make(chan struct{})
+	close(stopCh)
+
+	notSynced := []string{}
+	started := 0
+	for informer, ok := range node.kubeInformers.WaitForCacheSync(stopCh) {
+		if !ok {
+			notSynced = append(notSynced, informer.String())
+		}
+		started++
+	}
+	for informer, ok := range node.osdnInformers.WaitForCacheSync(stopCh) {
+		if !ok {
+			notSynced = append(notSynced, informer.String())
+		}
+		started++
+	}
+
+	if started == 0 {
+		return fmt.Errorf("informers have not been started")
+	} else if len(notSynced) > 0 {
+		sort.Strings(notSynced)
+		return fmt.Errorf("informers not yet synced: %s", strings.Join(notSynced, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestServeHealthz(t *testing.T) {
+	node := &OsdnNode{}
+
+	checkHealthz := func(expectedStatus int, expected *NodeHealth) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		node.ServeHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+		if w.Code != expectedStatus {
+			t.Fatalf("expected status %d, got %d", expectedStatus, w.Code)
+		}
+		health := &NodeHealth{}
+		if err := json.Unmarshal(w.Body.Bytes(), health); err != nil {
+			t.Fatalf("could not decode response %q: %v", w.Body.String(), err)
+		}
+		if !reflect.DeepEqual(health, expected) {
+			t.Fatalf("expected %#v, got %#v", expected, health)
+		}
+	}
+
+	// With no checks registered, the node is not (yet) healthy
+	checkHealthz(http.StatusServiceUnavailable, &NodeHealth{Healthy: false, Subsystems: map[string]SubsystemHealth{}})
+
+	var ovsErr error
+	node.AddHealthCheck("ovs", func() error { return ovsErr })
+	node.AddHealthCheck("iptables", func() error { return nil })
+	checkHealthz(http.StatusOK, &NodeHealth{
+		Healthy: true,
+		Subsystems: map[string]SubsystemHealth{
+			"ovs":      {Healthy: true},
+			"iptables": {Healthy: true},
+		},
+	})
+
+	ovsErr = fmt.Errorf("could not connect to OVS")
+	checkHealthz(http.StatusServiceUnavailable, &NodeHealth{
+		Healthy: false,
+		Subsystems: map[string]SubsystemHealth{
+			"ovs":      {Healthy: false, Message: "could not connect to OVS"},
+			"iptables": {Healthy: true},
+		},
+	})
+}
+
+func TestEgressIPHealth(t *testing.T) {
+	eip := newEgressIPWatcher(nil, "172.17.0.3", nil)
+	if err := eip.checkHealth(); err == nil {
+		t.Fatalf("unexpected success before sync")
+	}
+
+	eip.statusLock.Lock()
+	eip.synced = true
+	eip.statusLock.Unlock()
+	if err := eip.checkHealth(); err != nil {
+		t.Fatalf("unexpected error after sync: %v", err)
+	}
+
+	eip.setEgressIPFailed("172.17.0.100", true)
+	if err := eip.checkHealth(); err == nil || err.Error() != "could not assign egress IPs: 172.17.0.100" {
+		t.Fatalf("unexpected health result with failed egress IP: %v", err)
+	}
+	eip.setEgressIPFailed("172.17.0.100", false)
+	if err := eip.checkHealth(); err != nil {
+		t.Fatalf("unexpected error after egress IP recovered: %v", err)
+	}
+}
+
+func TestSDNStatus(t *testing.T) {
+	node := &OsdnNode{}
+	var ovsErr error
+	node.AddHealthCheck("ovs", func() error { return ovsErr })
+	node.AddHealthCheck("iptables", func() error { return nil })
+
+	status := node.getSDNStatus()
+	if !status.Ready || status.Failures != nil {
+		t.Fatalf("unexpected status %#v", status)
+	}
+	if !sdnStatusChanged(nil, status) {
+		t.Fatalf("expected initial status to be a change")
+	}
+	if sdnStatusChanged(status, node.getSDNStatus()) {
+		t.Fatalf("unexpected change with same health")
+	}
+
+	ovsErr = fmt.Errorf("could not connect to OVS")
+	newStatus := node.getSDNStatus()
+	if newStatus.Ready || !reflect.DeepEqual(newStatus.Failures, map[string]string{"ovs": "could not connect to OVS"}) {
+		t.Fatalf("unexpected status %#v", newStatus)
+	}
+	if !sdnStatusChanged(status, newStatus) {
+		t.Fatalf("expected failure to be a change")
+	}
+}
@@ -3,12 +3,14 @@ package node
 import (
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	utilwait "k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 
+	"github.com/openshift/sdn/pkg/network/node/metrics"
 	"github.com/openshift/sdn/pkg/util/ovsclient"
 )
 
@@ -16,6 +18,7 @@ const (
 	ovsDialTimeout         = 5 * time.Second
 	ovsHealthcheckInterval = 30 * time.Second
 	ovsRecoveryTimeout     = 10 * time.Second
+	ovsCheckpointInterval  = 5 * time.Minute
 	ovsDialDefaultNetwork  = "unix"
 	ovsDialDefaultAddress  = "/var/run/openvswitch/db.sock"
 )
@@ -53,8 +56,34 @@ func waitForOVS(network, addr string) error {
 // runOVSHealthCheck runs two background loops - one that waits for disconnection
 // from the OVS server and then checks healthFn, and one that periodically checks
 // healthFn. If healthFn returns false in either of these two cases while the OVS
-// server is responsive the node process will terminate.
-func runOVSHealthCheck(network, addr string, healthFn func() error) {
+// server is responsive, OVS has presumably been restarted and lost its state, and
+// recoverFn (if non-nil) is called to restore it. If there is no recoverFn, or if
+// healthFn still fails afterward, the node process will terminate.
+func runOVSHealthCheck(network, addr string, healthFn, recoverFn func() error) {
+	var recoverLock sync.Mutex
+	checkHealth := func() error {
+		recoverLock.Lock()
+		defer recoverLock.Unlock()
+
+		err := healthFn()
+		if err == nil {
+			return nil
+		}
+		if recoverFn != nil {
+			klog.Warningf("SDN healthcheck detected OVS server change, restoring OVS state: %v", err)
+			if err = recoverFn(); err == nil {
+				err = healthFn()
+			}
+			if err == nil {
+				metrics.OVSRestarts.WithLabelValues(metrics.OVSRestartRecovered).Inc()
+				klog.Infof("SDN healthcheck restored OVS state after OVS server change")
+				return nil
+			}
+		}
+		metrics.OVSRestarts.WithLabelValues(metrics.OVSRestartFailed).Inc()
+		return err
+	}
+
 	// this loop holds an open socket connection to OVS until it times out, then
 	// checks for health
 	go utilwait.Until(func() {
@@ -72,14 +101,13 @@ func runOVSHealthCheck(network, addr string, healthFn func() error) {
 			if dialErr, pingErr := dialAndPing(network, addr); dialErr != nil || pingErr != nil {
 				return false, nil
 			}
-			if err := healthFn(); err != nil {
+			if err := checkHealth(); err != nil {
 				return false, fmt.Errorf("OVS reinitialization required: %v", err)
 			}
 			return true, nil
 		})
 		if err != nil {
-			// If OVS restarts and our health check fails, we exit
-			// TODO: make openshift-sdn able to reconcile without a restart
+			// If OVS restarts and we can't recover, we exit
 			klog.Warningf("SDN healthcheck detected OVS server change, restarting: %v", err)
 			os.Exit(1)
 		}
@@ -97,7 +125,7 @@ func runOVSHealthCheck(network, addr string, healthFn func() error) {
 			klog.V(2).Infof("SDN healthcheck unable to ping OVS server: %v", pingErr)
 			return
 		}
-		if err := healthFn(); err != nil {
+		if err := checkHealth(); err != nil {
 			klog.Warningf("SDN healthcheck detected unhealthy OVS server, restarting: %v", err)
 			os.Exit(1)
 		}
@@ -0,0 +1,157 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+
+	"github.com/openshift/sdn/pkg/network/common/cniserver"
+)
+
+// hostPort is a port that a pod asks to have forwarded from the node
+type hostPort struct {
+	HostIP   string          `json:"hostIP,omitempty"`
+	HostPort int32           `json:"hostPort"`
+	Protocol corev1.Protocol `json:"protocol"`
+}
+
+func (hp hostPort) String() string {
+	return fmt.Sprintf("%s/%s", net.JoinHostPort(hp.HostIP, strconv.Itoa(int(hp.HostPort))), hp.Protocol)
+}
+
+// overlaps returns true if hp and other can't both be forwarded
+func (hp hostPort) overlaps(other hostPort) bool {
+	if hp.HostPort != other.HostPort || hp.Protocol != other.Protocol {
+		return false
+	}
+	return isWildcardHostIP(hp.HostIP) || isWildcardHostIP(other.HostIP) || net.ParseIP(hp.HostIP).Equal(net.ParseIP(other.HostIP))
+}
+
+func isWildcardHostIP(hostIP string) bool {
+	ip := net.ParseIP(hostIP)
+	return ip == nil || ip.IsUnspecified()
+}
+
+// hostPortConflict is an entry in the details of an ErrHostPortConflict error
+type hostPortConflict struct {
+	hostPort
+	// Pod is the conflicting pod ("namespace/name"), if the port is used by a pod
+	Pod string `json:"pod,omitempty"`
+	// Error is the error binding the port, if it is used by a process on the node
+	Error string `json:"error,omitempty"`
+}
+
+func (c hostPortConflict) String() string {
+	if c.Pod != "" {
+		return fmt.Sprintf("%s is used by pod %s", c.hostPort, c.Pod)
+	}
+	return fmt.Sprintf("%s is in use on the node (%s)", c.hostPort, c.Error)
+}
+
+// getHostPorts returns the hostPorts requested by pod
+func getHostPorts(pod *corev1.Pod) []hostPort {
+	var hostPorts []hostPort
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.HostPort <= 0 {
+				continue
+			}
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = corev1.ProtocolTCP
+			}
+			hostPorts = append(hostPorts, hostPort{HostIP: port.HostIP, HostPort: port.HostPort, Protocol: protocol})
+		}
+	}
+	return hostPorts
+}
+
+// probeHostPort returns an error if hp can't be bound on the node
+func probeHostPort(hp hostPort) error {
+	hostIP := hp.HostIP
+	if isWildcardHostIP(hostIP) {
+		hostIP = ""
+	}
+	addr := net.JoinHostPort(hostIP, strconv.Itoa(int(hp.HostPort)))
+	switch hp.Protocol {
+	case corev1.ProtocolTCP:
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		return listener.Close()
+	case corev1.ProtocolUDP:
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	// We can't check SCTP ports without an SCTP socket implementation
+	return nil
+}
+
+// checkHostPorts returns an ErrHostPortConflict error if any of pod's hostPorts
+// are already used by another pod on this node or by a process on the node, so
+// that the pod fails cleanly rather than ending up with only some of its ports
+// forwarded. It also emits a HostPortConflict event on the pod.
+func (m *podManager) checkHostPorts(ctx context.Context, pod *corev1.Pod) error {
+	hostPorts := getHostPorts(pod)
+	if len(hostPorts) == 0 {
+		return nil
+	}
+
+	var conflicts []hostPortConflict
+	podList, err := m.kClient.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", m.nodeName).String(),
+	})
+	if err != nil {
+		return fmt.Errorf("could not list pods to check hostPorts: %v", err)
+	}
+	m.runningPodsLock.Lock()
+	for i := range podList.Items {
+		other := &podList.Items[i]
+		if other.UID == pod.UID || other.Spec.NodeName != m.nodeName || m.runningPods[getPodKey(other.Namespace, other.Name)] == nil {
+			continue
+		}
+		for _, otherPort := range getHostPorts(other) {
+			for _, hp := range hostPorts {
+				if hp.overlaps(otherPort) {
+					conflicts = append(conflicts, hostPortConflict{hostPort: hp, Pod: getPodKey(other.Namespace, other.Name)})
+				}
+			}
+		}
+	}
+	m.runningPodsLock.Unlock()
+
+	if len(conflicts) == 0 {
+		for _, hp := range hostPorts {
+			if err := m.probeHostPort(hp); err != nil {
+				conflicts = append(conflicts, hostPortConflict{hostPort: hp, Error: err.Error()})
+			}
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	var descriptions []string
+	for _, conflict := range conflicts {
+		descriptions = append(descriptions, conflict.String())
+	}
+	msg := fmt.Sprintf("hostPort conflict: %s", strings.Join(descriptions, "; "))
+	if m.recorder != nil {
+		m.recorder.Eventf(pod, corev1.EventTypeWarning, "HostPortConflict", "Could not set up pod network: %s", msg)
+	}
+	details, _ := json.Marshal(conflicts)
+	return &cnitypes.Error{Code: cniserver.ErrHostPortConflict, Msg: msg, Details: string(details)}
+}
@@ -0,0 +1,98 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/openshift/sdn/pkg/network/common/cniserver"
+)
+
+func hostPortPod(namespace, name, nodeName string, ports ...corev1.ContainerPort) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: ktypes.UID(namespace + "-" + name)},
+		Spec: corev1.PodSpec{
+			NodeName:   nodeName,
+			Containers: []corev1.Container{{Name: "c", Ports: ports}},
+		},
+	}
+}
+
+func TestCheckHostPorts(t *testing.T) {
+	running := hostPortPod("ns", "running", "node1",
+		corev1.ContainerPort{ContainerPort: 80, HostPort: 8080},
+		corev1.ContainerPort{ContainerPort: 53, HostPort: 5353, HostIP: "10.0.0.1", Protocol: corev1.ProtocolUDP},
+	)
+	// Pods that aren't running on this node don't conflict
+	stopped := hostPortPod("ns", "stopped", "node1", corev1.ContainerPort{ContainerPort: 80, HostPort: 9090})
+	elsewhere := hostPortPod("ns", "elsewhere", "node2", corev1.ContainerPort{ContainerPort: 80, HostPort: 9090})
+
+	recorder := record.NewFakeRecorder(10)
+	m := newDefaultPodManager()
+	m.kClient = fake.NewSimpleClientset(running, stopped, elsewhere)
+	m.nodeName = "node1"
+	m.recorder = recorder
+	m.runningPods[getPodKey("ns", "running")] = &runningPod{vnid: 1, ofport: 3}
+	m.runningPods[getPodKey("ns", "elsewhere")] = &runningPod{vnid: 1, ofport: 4}
+	inUse := map[string]bool{}
+	m.probeHostPort = func(hp hostPort) error {
+		if inUse[hp.String()] {
+			return fmt.Errorf("address already in use")
+		}
+		return nil
+	}
+
+	// No conflicts
+	pod := hostPortPod("ns", "new", "node1",
+		corev1.ContainerPort{ContainerPort: 80, HostPort: 9090},
+		corev1.ContainerPort{ContainerPort: 53, HostPort: 5353, HostIP: "10.0.0.2", Protocol: corev1.ProtocolUDP},
+		corev1.ContainerPort{ContainerPort: 80, HostPort: 8080, Protocol: corev1.ProtocolUDP},
+	)
+	if err := m.checkHostPorts(context.TODO(), pod); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Conflicts with another pod
+	pod = hostPortPod("ns", "new", "node1",
+		corev1.ContainerPort{ContainerPort: 80, HostPort: 8080, HostIP: "10.0.0.5"},
+		corev1.ContainerPort{ContainerPort: 53, HostPort: 5353, Protocol: corev1.ProtocolUDP},
+	)
+	err := m.checkHostPorts(context.TODO(), pod)
+	cniErr, ok := err.(*cnitypes.Error)
+	if !ok || cniErr.Code != cniserver.ErrHostPortConflict {
+		t.Fatalf("Expected hostPort conflict error, got %#v", err)
+	}
+	var conflicts []hostPortConflict
+	if err := json.Unmarshal([]byte(cniErr.Details), &conflicts); err != nil {
+		t.Fatalf("Could not parse error details %q: %v", cniErr.Details, err)
+	}
+	if len(conflicts) != 2 || conflicts[0].HostPort != 8080 || conflicts[0].Pod != "ns/running" || conflicts[1].HostPort != 5353 || conflicts[1].Protocol != corev1.ProtocolUDP {
+		t.Fatalf("Unexpected conflicts %#v", conflicts)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "HostPortConflict") || !strings.Contains(event, "ns/running") {
+			t.Fatalf("Unexpected event %q", event)
+		}
+	default:
+		t.Fatalf("No event emitted for hostPort conflict")
+	}
+
+	// Conflicts with a process on the node
+	inUse["10.0.0.2:9090/TCP"] = true
+	pod = hostPortPod("ns", "new", "node1", corev1.ContainerPort{ContainerPort: 80, HostPort: 9090, HostIP: "10.0.0.2"})
+	err = m.checkHostPorts(context.TODO(), pod)
+	if cniErr, ok := err.(*cnitypes.Error); !ok || cniErr.Code != cniserver.ErrHostPortConflict || !strings.Contains(cniErr.Msg, "in use on the node") {
+		t.Fatalf("Expected hostPort conflict error, got %#v", err)
+	}
+}
@@ -0,0 +1,437 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+
+	kapierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	utilpointer "k8s.io/utils/pointer"
+
+	"github.com/openshift/sdn/pkg/network/common"
+	"github.com/openshift/sdn/pkg/network/common/cniserver"
+)
+
+const (
+	// HostLocalIPAM allocates pod IPs from the node's subnet with the CNI
+	// "host-local" plugin, which records the allocations on the node's disk
+	HostLocalIPAM = "host-local"
+	// ClusterIPAM allocates pod IPs from the node's subnet by creating a
+	// PodIPLease object for each IP, so that allocations are visible
+	// cluster-wide and IPs can be reserved for specific pods
+	ClusterIPAM = "cluster"
+
+	// PodIPLeaseNodeLabel is set on each bound PodIPLease to the name of the node
+	// the IP is allocated on
+	PodIPLeaseNodeLabel = "sdn.openshift.io/node"
+
+	// podIPLeaseSyncTimeout is how long to wait for the PodIPLease informers to sync
+	// at startup (eg, in case the CRD is not installed)
+	podIPLeaseSyncTimeout = 2 * time.Minute
+)
+
+// PodIPLeaseResource is the (cluster-scoped) resource used by ClusterIPAM, defined
+// by manifests/sdn.openshift.io_podipleases.yaml. Each PodIPLease is named after
+// the IP it leases, and has a spec of:
+//
+//	node:         the node the IP is allocated on, if bound
+//	sandboxID:    the sandbox the IP is allocated to, if bound
+//	podNamespace: the namespace of the pod the IP is allocated or reserved for
+//	podName:      the name of the pod the IP is allocated or reserved for
+//	allocatedAt:  when the lease was bound to sandboxID (RFC 3339)
+//	reserved:     if true, the lease was created by an administrator to reserve
+//	              the IP for podNamespace/podName; it is bound to each sandbox of
+//	              that pod in turn and is not deleted when the pod goes away
+var PodIPLeaseResource = schema.GroupVersionResource{Group: "sdn.openshift.io", Version: "v1alpha1", Resource: "podipleases"}
+
+// ipamBackend allocates and releases pod IPs
+type ipamBackend interface {
+	// Allocate allocates IPs for the sandbox sandboxID of pod namespace/name
+	Allocate(netnsPath, sandboxID, namespace, name string) (*current.Result, error)
+	// Release releases the IPs allocated to sandboxID, if any
+	Release(sandboxID string) error
+	// Allocations returns the IDs of the sandboxes that have IPs allocated, and
+	// when each was allocated
+	Allocations() (map[string]time.Time, error)
+}
+
+// newIPAMBackend returns the IPAM backend of type ipamType for a node with the
+// given subnets
+func newIPAMBackend(ipamType string, client dynamic.Interface, nodeName string, clusterNetworks []common.ParsedClusterNetworkEntry, localSubnet string, ipv6ClusterNetworks []common.ParsedClusterNetworkEntry, localSubnetIPv6 string) (ipamBackend, error) {
+	switch ipamType {
+	case HostLocalIPAM, "":
+		config, err := getIPAMConfig(clusterNetworks, localSubnet, ipv6ClusterNetworks, localSubnetIPv6)
+		if err != nil {
+			return nil, err
+		}
+		return &hostLocalIPAM{config: config}, nil
+	case ClusterIPAM:
+		if localSubnetIPv6 != "" {
+			return nil, fmt.Errorf("%q IPAM does not support dual-stack clusters", ClusterIPAM)
+		}
+		if client == nil {
+			return nil, fmt.Errorf("%q IPAM requires a client", ClusterIPAM)
+		}
+		_, nodeNet, err := net.ParseCIDR(localSubnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local subnet %q: %v", localSubnet, err)
+		}
+		// Only our own leases, and the unbound reservations, are of interest
+		leaseInformer := newPodIPLeaseInformer(client, PodIPLeaseNodeLabel+"="+nodeName, cache.Indexers{})
+		reservationInformer := newPodIPLeaseInformer(client, "!"+PodIPLeaseNodeLabel, cache.Indexers{podIPLeasePodIndex: podIPLeasePodIndexFunc})
+		go leaseInformer.Run(utilwait.NeverStop)
+		go reservationInformer.Run(utilwait.NeverStop)
+		stop := make(chan struct{})
+		timer := time.AfterFunc(podIPLeaseSyncTimeout, func() { close(stop) })
+		defer timer.Stop()
+		if !cache.WaitForCacheSync(stop, leaseInformer.HasSynced, reservationInformer.HasSynced) {
+			return nil, fmt.Errorf("could not sync %s (is the CRD installed?)", PodIPLeaseResource.GroupResource())
+		}
+		return newClusterIPAM(client, nodeName, clusterNetworks, nodeNet, leaseInformer.GetIndexer(), reservationInformer.GetIndexer()), nil
+	default:
+		return nil, fmt.Errorf("unknown IPAM type %q", ipamType)
+	}
+}
+
+// hostLocalIPAM runs the CNI host-local plugin with config
+type hostLocalIPAM struct {
+	config []byte
+}
+
+func createIPAMArgs(netnsPath string, action cniserver.CNICommand, id string) *invoke.Args {
+	return &invoke.Args{
+		Command:     string(action),
+		ContainerID: id,
+		NetNS:       netnsPath,
+		IfName:      podInterfaceName,
+		Path:        containerLocalCniPluginsBinDir,
+	}
+}
+
+func (hl *hostLocalIPAM) Allocate(netnsPath, sandboxID, namespace, name string) (*current.Result, error) {
+	args := createIPAMArgs(netnsPath, cniserver.CNI_ADD, sandboxID)
+	r, err := invoke.ExecPluginWithResult(containerLocalCniPluginsBinDir+"/osdn-host-local", hl.config, args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run CNI IPAM ADD: %v", err)
+	}
+
+	// We gave the IPAM plugin 0.3.1 config, so the plugin must return a 0.3.1 result
+	result, err := current.GetResult(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CNI IPAM ADD result: %v", err)
+	}
+	return result, nil
+}
+
+func (hl *hostLocalIPAM) Release(sandboxID string) error {
+	args := createIPAMArgs("", cniserver.CNI_DEL, sandboxID)
+	err := invoke.ExecPluginWithoutResult(containerLocalCniPluginsBinDir+"/osdn-host-local", hl.config, args)
+	if err != nil {
+		return fmt.Errorf("failed to run CNI IPAM DEL: %v", err)
+	}
+	return nil
+}
+
+func (hl *hostLocalIPAM) Allocations() (map[string]time.Time, error) {
+	return getIPAMAllocations(filepath.Join(hostLocalDataDir, "openshift-sdn"))
+}
+
+// clusterIPAM allocates IPs from subnet by creating PodIPLeases. Since leases are
+// named after their IP, the API server ensures that an IP is never leased twice,
+// and reserved IPs (whose leases already exist) are skipped for other pods.
+type clusterIPAM struct {
+	client   dynamic.ResourceInterface
+	nodeName string
+	subnet   *net.IPNet
+	gateway  net.IP
+	routes   []cnitypes.Route
+
+	// leases holds the leases bound to this node, and reservations holds the
+	// unbound reservations (indexed by podIPLeasePodIndex). They are maintained by
+	// informers, so they may lag behind our own changes; the API server rejects
+	// any conflicting change made on the basis of stale data.
+	leases       cache.Store
+	reservations cache.Indexer
+
+	// lock serializes allocations; last is the last IP allocated, so that IPs are
+	// not immediately reused; and allocated maps the sandboxes that IPs have been
+	// allocated to since we started to their IPs, in case they are released before
+	// leases catches up
+	lock      sync.Mutex
+	last      net.IP
+	allocated map[string]string
+}
+
+func newClusterIPAM(client dynamic.Interface, nodeName string, clusterNetworks []common.ParsedClusterNetworkEntry, subnet *net.IPNet, leases cache.Store, reservations cache.Indexer) *clusterIPAM {
+	return &clusterIPAM{
+		client:       client.Resource(PodIPLeaseResource),
+		nodeName:     nodeName,
+		subnet:       subnet,
+		gateway:      common.GenerateDefaultGateway(subnet),
+		routes:       getPodRoutes(clusterNetworks, subnet),
+		leases:       leases,
+		reservations: reservations,
+		allocated:    make(map[string]string),
+	}
+}
+
+// podIPLeasePodIndex indexes PodIPLeases by the namespace/name of their pod
+const podIPLeasePodIndex = "pod"
+
+func podIPLeasePodIndexFunc(obj interface{}) ([]string, error) {
+	lease := parsePodIPLease(obj.(*unstructured.Unstructured))
+	return []string{lease.podNamespace + "/" + lease.podName}, nil
+}
+
+func newPodIPLeaseInformer(client dynamic.Interface, labelSelector string, indexers cache.Indexers) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = labelSelector
+				return client.Resource(PodIPLeaseResource).List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = labelSelector
+				return client.Resource(PodIPLeaseResource).Watch(context.TODO(), options)
+			},
+		},
+		&unstructured.Unstructured{},
+		0,
+		indexers,
+	)
+}
+
+// podIPLease is the parsed spec of a PodIPLease
+type podIPLease struct {
+	ip           net.IP
+	node         string
+	sandboxID    string
+	podNamespace string
+	podName      string
+	allocated    time.Time
+	reserved     bool
+}
+
+func parsePodIPLease(obj *unstructured.Unstructured) *podIPLease {
+	spec, _, _ := unstructured.NestedMap(obj.Object, "spec")
+	lease := &podIPLease{ip: net.ParseIP(obj.GetName())}
+	lease.node, _, _ = unstructured.NestedString(spec, "node")
+	lease.sandboxID, _, _ = unstructured.NestedString(spec, "sandboxID")
+	lease.podNamespace, _, _ = unstructured.NestedString(spec, "podNamespace")
+	lease.podName, _, _ = unstructured.NestedString(spec, "podName")
+	lease.reserved, _, _ = unstructured.NestedBool(spec, "reserved")
+	if allocatedAt, _, _ := unstructured.NestedString(spec, "allocatedAt"); allocatedAt != "" {
+		lease.allocated, _ = time.Parse(time.RFC3339, allocatedAt)
+	}
+	return lease
+}
+
+// bindPodIPLease sets the fields of obj binding it to (or, if sandboxID is "",
+// unbinding it from) a sandbox on node
+func bindPodIPLease(obj *unstructured.Unstructured, node, sandboxID string) {
+	labels := obj.GetLabels()
+	if sandboxID != "" {
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[PodIPLeaseNodeLabel] = node
+		_ = unstructured.SetNestedField(obj.Object, node, "spec", "node")
+		_ = unstructured.SetNestedField(obj.Object, sandboxID, "spec", "sandboxID")
+		_ = unstructured.SetNestedField(obj.Object, time.Now().UTC().Format(time.RFC3339), "spec", "allocatedAt")
+	} else {
+		delete(labels, PodIPLeaseNodeLabel)
+		unstructured.RemoveNestedField(obj.Object, "spec", "node")
+		unstructured.RemoveNestedField(obj.Object, "spec", "sandboxID")
+		unstructured.RemoveNestedField(obj.Object, "spec", "allocatedAt")
+	}
+	obj.SetLabels(labels)
+}
+
+func (ci *clusterIPAM) Allocate(netnsPath, sandboxID, namespace, name string) (*current.Result, error) {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	ip, err := ci.claimReservation(sandboxID, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if ip == nil {
+		if ip, err = ci.allocateNew(sandboxID, namespace, name); err != nil {
+			return nil, err
+		}
+	}
+	ci.allocated[sandboxID] = ip.String()
+
+	result := &current.Result{
+		CNIVersion: "0.3.1",
+		IPs: []*current.IPConfig{{
+			Version: "4",
+			Address: net.IPNet{IP: ip, Mask: ci.subnet.Mask},
+			Gateway: ci.gateway,
+		}},
+	}
+	for i := range ci.routes {
+		route := ci.routes[i]
+		result.Routes = append(result.Routes, &route)
+	}
+	return result, nil
+}
+
+// claimReservation binds the unbound reserved lease for namespace/name, if there is
+// one in our subnet, to sandboxID and returns its IP
+func (ci *clusterIPAM) claimReservation(sandboxID, namespace, name string) (net.IP, error) {
+	objs, err := ci.reservations.ByIndex(podIPLeasePodIndex, namespace+"/"+name)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range objs {
+		lease := parsePodIPLease(o.(*unstructured.Unstructured))
+		if !lease.reserved {
+			continue
+		}
+		if lease.ip == nil || !ci.subnet.Contains(lease.ip) {
+			// The pod may be rescheduled to the right node later, but there's
+			// no point in failing it here forever
+			klog.Warningf("Pod IP %s reserved for %s/%s is not in this node's subnet %s; allocating another IP", lease.ip, namespace, name, ci.subnet)
+			continue
+		}
+		obj := o.(*unstructured.Unstructured).DeepCopy()
+		bindPodIPLease(obj, ci.nodeName, sandboxID)
+		if _, err := ci.client.Update(context.TODO(), obj, metav1.UpdateOptions{}); err != nil {
+			return nil, fmt.Errorf("could not claim pod IP %s reserved for %s/%s: %v", lease.ip, namespace, name, err)
+		}
+		klog.V(5).Infof("Claimed reserved pod IP %s for %s/%s", lease.ip, namespace, name)
+		return lease.ip, nil
+	}
+	return nil, nil
+}
+
+// allocateNew creates a lease for the next free IP in the subnet
+func (ci *clusterIPAM) allocateNew(sandboxID, namespace, name string) (net.IP, error) {
+	inUse := sets.NewString(ci.leases.ListKeys()...)
+	for _, ip := range ci.allocated {
+		inUse.Insert(ip)
+	}
+
+	base := ci.subnet.IP.To4()
+	ones, bits := ci.subnet.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	start := uint32(0)
+	if ci.last != nil && ci.subnet.Contains(ci.last) {
+		start = ipv4ToUint32(ci.last) - ipv4ToUint32(base)
+	}
+	for n := uint32(1); n <= size; n++ {
+		offset := (start + n) % size
+		// Skip the network and broadcast addresses
+		if offset == 0 || offset == size-1 {
+			continue
+		}
+		ip := uint32ToIPv4(ipv4ToUint32(base) + offset)
+		if ip.Equal(ci.gateway) || inUse.Has(ip.String()) {
+			continue
+		}
+
+		obj := &unstructured.Unstructured{}
+		obj.SetAPIVersion(PodIPLeaseResource.GroupVersion().String())
+		obj.SetKind("PodIPLease")
+		obj.SetName(ip.String())
+		_ = unstructured.SetNestedField(obj.Object, namespace, "spec", "podNamespace")
+		_ = unstructured.SetNestedField(obj.Object, name, "spec", "podName")
+		bindPodIPLease(obj, ci.nodeName, sandboxID)
+		if _, err := ci.client.Create(context.TODO(), obj, metav1.CreateOptions{}); err != nil {
+			if kapierrors.IsAlreadyExists(err) {
+				// Reserved, or leased by a stale allocation
+				continue
+			}
+			return nil, fmt.Errorf("could not create pod IP lease for %s: %v", ip, err)
+		}
+		ci.last = ip
+		return ip, nil
+	}
+	return nil, fmt.Errorf("no free pod IPs in subnet %s", ci.subnet)
+}
+
+func (ci *clusterIPAM) Release(sandboxID string) error {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	ips := sets.NewString()
+	for _, o := range ci.leases.List() {
+		if lease := parsePodIPLease(o.(*unstructured.Unstructured)); lease.sandboxID == sandboxID {
+			ips.Insert(lease.ip.String())
+		}
+	}
+	if ip, ok := ci.allocated[sandboxID]; ok {
+		ips.Insert(ip)
+	}
+	for _, ip := range ips.List() {
+		if err := ci.releaseIP(ip, sandboxID); err != nil {
+			return fmt.Errorf("could not release pod IP %s: %v", ip, err)
+		}
+	}
+	delete(ci.allocated, sandboxID)
+	return nil
+}
+
+// releaseIP deletes the lease for ip, or unbinds it if it is a reservation, if it
+// is still bound to sandboxID
+func (ci *clusterIPAM) releaseIP(ip, sandboxID string) error {
+	obj, err := ci.client.Get(context.TODO(), ip, metav1.GetOptions{})
+	if kapierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	lease := parsePodIPLease(obj)
+	if lease.node != ci.nodeName || lease.sandboxID != sandboxID {
+		return nil
+	}
+	if lease.reserved {
+		bindPodIPLease(obj, "", "")
+		_, err = ci.client.Update(context.TODO(), obj, metav1.UpdateOptions{})
+	} else {
+		err = ci.client.Delete(context.TODO(), ip, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: utilpointer.String(obj.GetResourceVersion())},
+		})
+		if kapierrors.IsNotFound(err) {
+			err = nil
+		}
+	}
+	return err
+}
+
+func (ci *clusterIPAM) Allocations() (map[string]time.Time, error) {
+	allocations := make(map[string]time.Time)
+	for _, o := range ci.leases.List() {
+		if lease := parsePodIPLease(o.(*unstructured.Unstructured)); lease.sandboxID != "" {
+			allocations[lease.sandboxID] = lease.allocated
+		}
+	}
+	return allocations, nil
+}
+
+func ipv4ToUint32(ip net.IP) uint32 {
+	ip = ip.To4()
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+func uint32ToIPv4(n uint32) net.IP {
+	return net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)).To4()
+}
@@ -0,0 +1,99 @@
+package node
+
+import (
+	"fmt"
+	"time"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/sdn/pkg/network/node/metrics"
+)
+
+const (
+	// DefaultIPAMLeakCheckPeriod is the default value of
+	// OsdnNodeConfig.IPAMLeakCheckPeriod
+	DefaultIPAMLeakCheckPeriod = 10 * time.Minute
+
+	// DefaultIPAMLeakMinAge is the default value of OsdnNodeConfig.IPAMLeakMinAge
+	DefaultIPAMLeakMinAge = 10 * time.Minute
+)
+
+// ipamLeakScanner periodically looks for pod IP allocations that don't belong to
+// any running sandbox (eg, because the runtime never sent a CNI DEL for a sandbox,
+// or a DEL failed part of the way through) and releases them, so that they don't
+// slowly exhaust the node's subnet.
+type ipamLeakScanner struct {
+	node *OsdnNode
+	// minAge is how old an allocation must be before it can be reclaimed, so
+	// that allocations for sandboxes that are being set up (and so may not show
+	// up in the runtime's sandbox list yet) are left alone
+	minAge time.Duration
+}
+
+func (s *ipamLeakScanner) scan() {
+	if s.node.isTornDown() {
+		return
+	}
+
+	// Get the sandboxes before the allocations; any sandbox created in between
+	// has a recent allocation, so its IP won't be reclaimed
+	sandboxes, err := s.node.getSDNPodSandboxes()
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Could not scan for leaked pod IPs: %v", err))
+		return
+	}
+	leaked, reclaimed, err := s.node.podManager.reclaimLeakedIPs(sets.StringKeySet(sandboxes), s.minAge, time.Now())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Could not scan for leaked pod IPs: %v", err))
+		return
+	}
+	metrics.PodIPLeaks.Set(float64(leaked))
+	if reclaimed > 0 {
+		klog.Infof("Released %d leaked pod IP allocations", reclaimed)
+	}
+}
+
+// reclaimLeakedIPs releases the IPs of sandboxes that are neither in
+// runningSandboxes nor attached to OVS, if they were allocated more than minAge
+// before now. It returns the number of leaked allocations found (including those
+// too recent to release) and the number released.
+func (m *podManager) reclaimLeakedIPs(runningSandboxes sets.String, minAge time.Duration, now time.Time) (int, int, error) {
+	// Don't race with CNI requests setting up or tearing down sandboxes
+	m.requestLock.Lock()
+	defer m.requestLock.Unlock()
+
+	allocations, err := m.ipam.Allocations()
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not read IPAM allocations: %v", err)
+	}
+	podNetworks, err := m.ovs.GetPodNetworkInfo()
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not get pod network info: %v", err)
+	}
+
+	leaked, reclaimed := 0, 0
+	for sandboxID, allocated := range allocations {
+		if runningSandboxes.Has(sandboxID) {
+			continue
+		}
+		if _, attached := podNetworks[sandboxID]; attached {
+			continue
+		}
+		leaked++
+		if now.Sub(allocated) < minAge {
+			klog.V(5).Infof("Pod IP allocation for sandbox %s has no sandbox, but is too recent to release", sandboxID)
+			continue
+		}
+
+		klog.Warningf("Releasing leaked pod IP allocation for sandbox %s (allocated %s)", sandboxID, allocated.Format(time.RFC3339))
+		if err := m.ipamDel(sandboxID); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Could not release leaked pod IP allocation for sandbox %s: %v", sandboxID, err))
+			continue
+		}
+		reclaimed++
+		metrics.PodIPLeaksReclaimed.Inc()
+	}
+	return leaked, reclaimed, nil
+}
@@ -0,0 +1,82 @@
+package node
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// fakeIPAM records allocations in memory
+type fakeIPAM struct {
+	allocations map[string]time.Time
+	released    []string
+}
+
+func (f *fakeIPAM) Allocate(netnsPath, sandboxID, namespace, name string) (*current.Result, error) {
+	f.allocations[sandboxID] = time.Now()
+	return &current.Result{}, nil
+}
+
+func (f *fakeIPAM) Release(sandboxID string) error {
+	delete(f.allocations, sandboxID)
+	f.released = append(f.released, sandboxID)
+	return nil
+}
+
+func (f *fakeIPAM) Allocations() (map[string]time.Time, error) {
+	allocations := make(map[string]time.Time)
+	for id, allocated := range f.allocations {
+		allocations[id] = allocated
+	}
+	return allocations, nil
+}
+
+func TestReclaimLeakedIPs(t *testing.T) {
+	_, oc, _ := setupOVSController(t)
+	now := time.Now()
+	ipam := &fakeIPAM{
+		allocations: map[string]time.Time{
+			"running":  now.Add(-time.Hour),
+			"attached": now.Add(-time.Hour),
+			"leaked":   now.Add(-time.Hour),
+			"new":      now.Add(-time.Minute),
+		},
+	}
+	m := newDefaultPodManager()
+	m.ovs = oc
+	m.ipam = ipam
+
+	// "attached" isn't known to the runtime (eg, because the runtime restarted)
+	// but still has an OVS port, so its IP must not be released
+	if _, err := oc.SetUpPod(context.TODO(), "attached", "veth1", net.ParseIP("10.128.0.3"), nil, 42); err != nil {
+		t.Fatalf("Unexpected error setting up pod: %v", err)
+	}
+
+	leaked, reclaimed, err := m.reclaimLeakedIPs(sets.NewString("running"), 10*time.Minute, now)
+	if err != nil {
+		t.Fatalf("Unexpected error reclaiming leaked IPs: %v", err)
+	}
+	if leaked != 2 || reclaimed != 1 {
+		t.Fatalf("Expected 2 leaked and 1 reclaimed, got %d and %d", leaked, reclaimed)
+	}
+	if len(ipam.released) != 1 || ipam.released[0] != "leaked" {
+		t.Fatalf("Unexpected released allocations %v", ipam.released)
+	}
+
+	// Once it is old enough, the other leaked allocation is released too
+	leaked, reclaimed, err = m.reclaimLeakedIPs(sets.NewString("running"), 10*time.Minute, now.Add(10*time.Minute))
+	if err != nil {
+		t.Fatalf("Unexpected error reclaiming leaked IPs: %v", err)
+	}
+	if leaked != 1 || reclaimed != 1 || ipam.released[1] != "new" {
+		t.Fatalf("Expected \"new\" to be reclaimed, got %d, %d, %v", leaked, reclaimed, ipam.released)
+	}
+	if ids := sets.StringKeySet(ipam.allocations); !ids.Equal(sets.NewString("running", "attached")) {
+		t.Fatalf("Unexpected remaining allocations %v", ids.List())
+	}
+}
@@ -0,0 +1,250 @@
+package node
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	kapierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// fakeLeaseClient is a minimal in-memory dynamic client for PodIPLeases
+type fakeLeaseClient struct {
+	dynamic.NamespaceableResourceInterface
+	leases map[string]*unstructured.Unstructured
+}
+
+func newFakeLeaseClient() *fakeLeaseClient {
+	return &fakeLeaseClient{leases: make(map[string]*unstructured.Unstructured)}
+}
+
+func (f *fakeLeaseClient) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return f
+}
+
+func (f *fakeLeaseClient) Create(ctx context.Context, obj *unstructured.Unstructured, options metav1.CreateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	if _, exists := f.leases[obj.GetName()]; exists {
+		return nil, kapierrors.NewAlreadyExists(PodIPLeaseResource.GroupResource(), obj.GetName())
+	}
+	f.leases[obj.GetName()] = obj.DeepCopy()
+	return obj, nil
+}
+
+func (f *fakeLeaseClient) Update(ctx context.Context, obj *unstructured.Unstructured, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	if _, exists := f.leases[obj.GetName()]; !exists {
+		return nil, kapierrors.NewNotFound(PodIPLeaseResource.GroupResource(), obj.GetName())
+	}
+	f.leases[obj.GetName()] = obj.DeepCopy()
+	return obj, nil
+}
+
+func (f *fakeLeaseClient) Get(ctx context.Context, name string, options metav1.GetOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	obj, exists := f.leases[name]
+	if !exists {
+		return nil, kapierrors.NewNotFound(PodIPLeaseResource.GroupResource(), name)
+	}
+	return obj.DeepCopy(), nil
+}
+
+func (f *fakeLeaseClient) Delete(ctx context.Context, name string, options metav1.DeleteOptions, subresources ...string) error {
+	if _, exists := f.leases[name]; !exists {
+		return kapierrors.NewNotFound(PodIPLeaseResource.GroupResource(), name)
+	}
+	delete(f.leases, name)
+	return nil
+}
+
+func (f *fakeLeaseClient) List(ctx context.Context, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &unstructured.UnstructuredList{}
+	for _, obj := range f.leases {
+		if selector.Matches(labels.Set(obj.GetLabels())) {
+			list.Items = append(list.Items, *obj.DeepCopy())
+		}
+	}
+	return list, nil
+}
+
+func newTestClusterIPAM(client *fakeLeaseClient) *clusterIPAM {
+	_, clusterCIDR, _ := net.ParseCIDR("10.128.0.0/14")
+	_, nodeNet, _ := net.ParseCIDR("10.128.0.0/29")
+	clusterNetworks := []common.ParsedClusterNetworkEntry{{ClusterCIDR: clusterCIDR, HostSubnetLength: 9}}
+	return newClusterIPAM(client, "node1", clusterNetworks, nodeNet,
+		cache.NewStore(cache.MetaNamespaceKeyFunc),
+		cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{podIPLeasePodIndex: podIPLeasePodIndexFunc}))
+}
+
+// syncLeases updates ipam's stores from client, as its informers would
+func syncLeases(t *testing.T, ipam *clusterIPAM, client *fakeLeaseClient) {
+	var leases, reservations []interface{}
+	for _, obj := range client.leases {
+		if node, bound := obj.GetLabels()[PodIPLeaseNodeLabel]; !bound {
+			reservations = append(reservations, obj.DeepCopy())
+		} else if node == ipam.nodeName {
+			leases = append(leases, obj.DeepCopy())
+		}
+	}
+	if err := ipam.leases.Replace(leases, ""); err != nil {
+		t.Fatalf("unexpected error syncing leases: %v", err)
+	}
+	if err := ipam.reservations.Replace(reservations, ""); err != nil {
+		t.Fatalf("unexpected error syncing reservations: %v", err)
+	}
+}
+
+func TestClusterIPAM(t *testing.T) {
+	client := newFakeLeaseClient()
+	ipam := newTestClusterIPAM(client)
+
+	// A lease on another node's IP must not confuse the allocator
+	other := &unstructured.Unstructured{}
+	other.SetName("10.129.0.2")
+	bindPodIPLease(other, "node2", "sandbox-other")
+	client.leases[other.GetName()] = other
+	syncLeases(t, ipam, client)
+
+	result, err := ipam.Allocate("/proc/1/ns/net", "sandbox1", "ns", "pod1")
+	if err != nil {
+		t.Fatalf("unexpected error allocating IP: %v", err)
+	}
+	if len(result.IPs) != 1 || result.IPs[0].Address.String() != "10.128.0.2/29" || result.IPs[0].Gateway.String() != "10.128.0.1" {
+		t.Fatalf("unexpected IPs in result: %v", result.IPs)
+	}
+	if len(result.Routes) != 3 || result.Routes[0].GW.String() != "10.128.0.1" || result.Routes[2].Dst.String() != "10.128.0.0/14" {
+		t.Fatalf("unexpected routes in result: %v", result.Routes)
+	}
+	lease := parsePodIPLease(client.leases["10.128.0.2"])
+	if lease.node != "node1" || lease.sandboxID != "sandbox1" || lease.podNamespace != "ns" || lease.podName != "pod1" {
+		t.Fatalf("unexpected lease %#v", lease)
+	}
+
+	// Reserved IPs are skipped for other pods
+	reservation := &unstructured.Unstructured{}
+	reservation.SetName("10.128.0.3")
+	_ = unstructured.SetNestedField(reservation.Object, true, "spec", "reserved")
+	_ = unstructured.SetNestedField(reservation.Object, "ns", "spec", "podNamespace")
+	_ = unstructured.SetNestedField(reservation.Object, "reserved-pod", "spec", "podName")
+	client.leases[reservation.GetName()] = reservation
+	syncLeases(t, ipam, client)
+
+	result, err = ipam.Allocate("/proc/1/ns/net", "sandbox2", "ns", "pod2")
+	if err != nil {
+		t.Fatalf("unexpected error allocating IP: %v", err)
+	}
+	if ip := result.IPs[0].Address.IP.String(); ip != "10.128.0.4" {
+		t.Fatalf("expected 10.128.0.4, got %s", ip)
+	}
+
+	// ...but are used for the pod they are reserved for
+	syncLeases(t, ipam, client)
+	result, err = ipam.Allocate("/proc/1/ns/net", "sandbox3", "ns", "reserved-pod")
+	if err != nil {
+		t.Fatalf("unexpected error allocating IP: %v", err)
+	}
+	if ip := result.IPs[0].Address.IP.String(); ip != "10.128.0.3" {
+		t.Fatalf("expected reserved IP 10.128.0.3, got %s", ip)
+	}
+
+	syncLeases(t, ipam, client)
+	allocations, err := ipam.Allocations()
+	if err != nil {
+		t.Fatalf("unexpected error listing allocations: %v", err)
+	}
+	ids := sets.StringKeySet(allocations)
+	if ids.Len() != 3 || !ids.HasAll("sandbox1", "sandbox2", "sandbox3") {
+		t.Fatalf("unexpected sandbox IDs %v", ids.List())
+	}
+	if allocated := allocations["sandbox3"]; time.Since(allocated) > time.Minute {
+		t.Fatalf("unexpected allocation time %v", allocated)
+	}
+
+	// Releasing a reserved IP unbinds the reservation rather than deleting it
+	if err := ipam.Release("sandbox3"); err != nil {
+		t.Fatalf("unexpected error releasing IP: %v", err)
+	}
+	lease = parsePodIPLease(client.leases["10.128.0.3"])
+	if !lease.reserved || lease.node != "" || lease.sandboxID != "" || client.leases["10.128.0.3"].GetLabels()[PodIPLeaseNodeLabel] != "" {
+		t.Fatalf("unexpected released reservation %#v", lease)
+	}
+	if err := ipam.Release("sandbox1"); err != nil {
+		t.Fatalf("unexpected error releasing IP: %v", err)
+	}
+	if _, exists := client.leases["10.128.0.2"]; exists {
+		t.Fatalf("lease for released IP was not deleted")
+	}
+	syncLeases(t, ipam, client)
+
+	// Allocation continues after the last allocated IP, wrapping around, and
+	// fails once the subnet is full
+	result, err = ipam.Allocate("/proc/1/ns/net", "sandbox4", "ns", "pod4")
+	if err != nil {
+		t.Fatalf("unexpected error allocating IP: %v", err)
+	}
+	if ip := result.IPs[0].Address.IP.String(); ip != "10.128.0.5" {
+		t.Fatalf("expected 10.128.0.5, got %s", ip)
+	}
+	for _, expected := range []string{"10.128.0.6", "10.128.0.2"} {
+		result, err = ipam.Allocate("/proc/1/ns/net", "sandbox-"+expected, "ns", "pod-"+expected)
+		if err != nil {
+			t.Fatalf("unexpected error allocating IP: %v", err)
+		}
+		if ip := result.IPs[0].Address.IP.String(); ip != expected {
+			t.Fatalf("expected %s, got %s", expected, ip)
+		}
+	}
+	if _, err := ipam.Allocate("/proc/1/ns/net", "sandbox-full", "ns", "pod-full"); err == nil {
+		t.Fatalf("unexpected success allocating IP from full subnet")
+	}
+
+	// A reservation outside the node's subnet is ignored
+	if err := ipam.Release("sandbox4"); err != nil {
+		t.Fatalf("unexpected error releasing IP: %v", err)
+	}
+	reservation = &unstructured.Unstructured{}
+	reservation.SetName("10.129.0.9")
+	_ = unstructured.SetNestedField(reservation.Object, true, "spec", "reserved")
+	_ = unstructured.SetNestedField(reservation.Object, "ns", "spec", "podNamespace")
+	_ = unstructured.SetNestedField(reservation.Object, "elsewhere", "spec", "podName")
+	client.leases[reservation.GetName()] = reservation
+	syncLeases(t, ipam, client)
+	result, err = ipam.Allocate("/proc/1/ns/net", "sandbox5", "ns", "elsewhere")
+	if err != nil {
+		t.Fatalf("unexpected error allocating IP: %v", err)
+	}
+	if ip := result.IPs[0].Address.IP.String(); ip != "10.128.0.5" {
+		t.Fatalf("expected 10.128.0.5, got %s", ip)
+	}
+	if lease := parsePodIPLease(client.leases["10.129.0.9"]); lease.sandboxID != "" {
+		t.Fatalf("unexpected claimed reservation %#v", lease)
+	}
+}
+
+func TestNewIPAMBackend(t *testing.T) {
+	if _, err := newIPAMBackend(ClusterIPAM, newFakeLeaseClient(), "node1", nil, "10.128.0.0/23", nil, "fd01::/64"); err == nil {
+		t.Fatalf("unexpected success creating cluster IPAM in dual-stack cluster")
+	}
+	if _, err := newIPAMBackend(ClusterIPAM, nil, "node1", nil, "10.128.0.0/23", nil, ""); err == nil {
+		t.Fatalf("unexpected success creating cluster IPAM without a client")
+	}
+	if _, err := newIPAMBackend("bogus", nil, "node1", nil, "10.128.0.0/23", nil, ""); err == nil {
+		t.Fatalf("unexpected success creating unknown IPAM")
+	}
+	if ipam, err := newIPAMBackend(HostLocalIPAM, nil, "node1", nil, "10.128.0.0/23", nil, ""); err != nil {
+		t.Fatalf("unexpected error creating host-local IPAM: %v", err)
+	} else if _, ok := ipam.(*hostLocalIPAM); !ok {
+		t.Fatalf("unexpected IPAM %#v", ipam)
+	}
+}
@@ -10,9 +10,12 @@ import (
 
 	"k8s.io/klog/v2"
 
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/kubernetes/pkg/util/iptables"
 	utilexec "k8s.io/utils/exec"
+
+	"github.com/openshift/sdn/pkg/network/common"
 )
 
 type NodeIPTables struct {
@@ -22,9 +25,20 @@ type NodeIPTables struct {
 	vxlanPort          uint32
 	masqueradeBitHex   string // the masquerade bit as hex value
 
+	// routed is set if pod traffic to other nodes may be routed by the node's
+	// network rather than encapsulated, in which case it must not be masqueraded;
+	// geneve is set if pod traffic may be received over Geneve
+	routed bool
+	geneve bool
+
 	mu sync.Mutex // Protects concurrent access to syncIPTableRules()
 
 	egressIPs map[string]string
+	// egressIPBandwidth holds the bandwidth limit of each egress IP that has one
+	egressIPBandwidth map[string]int64
+	// hairpinServiceIPs are the cluster IPs of services whose hairpin traffic is
+	// NATted to the service IP (see HairpinModeServiceIP)
+	hairpinServiceIPs sets.String
 }
 
 // this will retry 10 times over a period of 13 seconds
@@ -60,14 +74,18 @@ func isResourceError(err error) bool {
 	return false
 }
 
-func newNodeIPTables(ipt iptables.Interface, clusterNetworkCIDR []string, masqueradeServices bool, vxlanPort uint32, masqueradeBit uint32) *NodeIPTables {
+func newNodeIPTables(ipt iptables.Interface, clusterNetworkCIDR []string, masqueradeServices bool, vxlanPort uint32, masqueradeBit uint32, encapsulations sets.String) *NodeIPTables {
 	return &NodeIPTables{
 		ipt:                ipt,
 		clusterNetworkCIDR: clusterNetworkCIDR,
 		masqueradeServices: masqueradeServices,
 		vxlanPort:          vxlanPort,
+		routed:             encapsulations.Has(common.EncapsulationNone),
+		geneve:             encapsulations.Has(common.EncapsulationGeneve),
 		masqueradeBitHex:   fmt.Sprintf("%#x", 1<<masqueradeBit),
 		egressIPs:          make(map[string]string),
+		egressIPBandwidth:  make(map[string]int64),
+		hairpinServiceIPs:  sets.NewString(),
 	}
 }
 
@@ -78,6 +96,81 @@ func (n *NodeIPTables) Setup() error {
 	return nil
 }
 
+// SetClusterNetworkCIDRs updates the cluster network CIDRs after a clusterNetworks
+// entry is added or removed, and resyncs the rules. Chains that referred to removed
+// CIDRs are flushed so that the stale rules don't linger.
+func (n *NodeIPTables) SetClusterNetworkCIDRs(clusterNetworkCIDR []string) error {
+	n.mu.Lock()
+	removed := sets.NewString(n.clusterNetworkCIDR...).Difference(sets.NewString(clusterNetworkCIDR...))
+	n.clusterNetworkCIDR = clusterNetworkCIDR
+	if removed.Len() > 0 {
+		for _, chain := range n.getNodeIPTablesChains() {
+			if chain.name != "OPENSHIFT-MASQUERADE" && chain.name != "OPENSHIFT-MASQUERADE-2" && chain.name != "OPENSHIFT-FIREWALL-FORWARD" {
+				continue
+			}
+			err := execIPTablesWithRetry(func() error {
+				return n.ipt.FlushChain(iptables.Table(chain.table), iptables.Chain(chain.name))
+			})
+			if err != nil {
+				n.mu.Unlock()
+				return fmt.Errorf("failed to flush chain %s: %v", chain.name, err)
+			}
+		}
+	}
+	n.mu.Unlock()
+
+	return n.syncIPTableRules()
+}
+
+// Teardown removes all of the node's iptables chains, and the rules jumping to them.
+// It is used when migrating the node to another network plugin.
+func (n *NodeIPTables) Teardown() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	deleted := sets.NewString()
+	for _, chain := range n.getNodeIPTablesChains() {
+		table, name := iptables.Table(chain.table), iptables.Chain(chain.name)
+		if exists, _ := n.ipt.ChainExists(table, name); !exists {
+			continue
+		}
+		if chain.srcChain != "" {
+			err := execIPTablesWithRetry(func() error {
+				return n.ipt.DeleteRule(table, iptables.Chain(chain.srcChain), append(chain.srcRule, "-j", chain.name)...)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to delete rule from %s to %s: %v", chain.srcChain, chain.name, err)
+			}
+		}
+		deleted.Insert(chain.table + "/" + chain.name)
+	}
+
+	// Flush all of the chains before deleting any, since some of them jump to others
+	for _, tableChain := range deleted.List() {
+		parts := strings.SplitN(tableChain, "/", 2)
+		err := execIPTablesWithRetry(func() error {
+			return n.ipt.FlushChain(iptables.Table(parts[0]), iptables.Chain(parts[1]))
+		})
+		if err != nil {
+			return fmt.Errorf("failed to flush chain %s: %v", parts[1], err)
+		}
+	}
+	for _, tableChain := range deleted.List() {
+		parts := strings.SplitN(tableChain, "/", 2)
+		err := execIPTablesWithRetry(func() error {
+			return n.ipt.DeleteChain(iptables.Table(parts[0]), iptables.Chain(parts[1]))
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete chain %s: %v", parts[1], err)
+		}
+	}
+
+	n.egressIPs = make(map[string]string)
+	n.egressIPBandwidth = make(map[string]int64)
+	n.hairpinServiceIPs = sets.NewString()
+	return nil
+}
+
 type Chain struct {
 	table    string
 	name     string
@@ -172,6 +265,11 @@ func (n *NodeIPTables) syncIPTableRules() error {
 			return err
 		}
 	}
+	for _, serviceIP := range n.hairpinServiceIPs.UnsortedList() {
+		if err := n.ensureHairpinRule(serviceIP); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -180,17 +278,32 @@ func (n *NodeIPTables) getNodeIPTablesChains() []Chain {
 
 	var chainArray []Chain
 
+	allowRules := [][]string{
+		{"-p", "udp", "--dport", fmt.Sprintf("%d", n.vxlanPort), "-m", "comment", "--comment", "VXLAN incoming", "-j", "ACCEPT"},
+	}
+	if n.geneve {
+		allowRules = append(allowRules, []string{"-p", "udp", "--dport", fmt.Sprintf("%d", genevePort), "-m", "comment", "--comment", "Geneve incoming", "-j", "ACCEPT"})
+	}
+	allowRules = append(allowRules,
+		[]string{"-i", Tun0, "-m", "comment", "--comment", "from SDN to localhost", "-j", "ACCEPT"},
+		[]string{"-i", "docker0", "-m", "comment", "--comment", "from docker to localhost", "-j", "ACCEPT"},
+	)
+
 	chainArray = append(chainArray,
+		Chain{
+			// Filled in by ensureEgressIPRules()
+			table:    "filter",
+			name:     "OPENSHIFT-EGRESS-IP-LIMIT",
+			srcChain: "FORWARD",
+			srcRule:  []string{"-i", Tun0, "-m", "comment", "--comment", "egress IP bandwidth limits"},
+			rules:    nil,
+		},
 		Chain{
 			table:    "filter",
 			name:     "OPENSHIFT-FIREWALL-ALLOW",
 			srcChain: "INPUT",
 			srcRule:  []string{"-m", "comment", "--comment", "firewall overrides"},
-			rules: [][]string{
-				{"-p", "udp", "--dport", fmt.Sprintf("%d", n.vxlanPort), "-m", "comment", "--comment", "VXLAN incoming", "-j", "ACCEPT"},
-				{"-i", Tun0, "-m", "comment", "--comment", "from SDN to localhost", "-j", "ACCEPT"},
-				{"-i", "docker0", "-m", "comment", "--comment", "from docker to localhost", "-j", "ACCEPT"},
-			},
+			rules:    allowRules,
 		},
 		Chain{
 			table:    "filter",
@@ -201,14 +314,25 @@ func (n *NodeIPTables) getNodeIPTablesChains() []Chain {
 		},
 	)
 
-	masqRules := [][]string{
-		// Skip traffic already marked by kube-proxy for masquerading.
-		// This fixes a bug where traffic destined to a service's ExternalIP
-		// but also intended to go be SNAT'd to an EgressIP was dropped.
-		{"-m", "mark", "--mark", n.masqueradeBitHex + "/" + n.masqueradeBitHex, "-j", "RETURN"},
+	var masqRules [][]string
+	for _, cidr := range n.clusterNetworkCIDR {
+		// kube-proxy marks pod-to-service traffic for masquerading when it is sent
+		// back to the pod that sent it
+		masqRules = append(masqRules, []string{"-s", cidr, "-o", Tun0, "-m", "mark", "--mark", n.masqueradeBitHex + "/" + n.masqueradeBitHex, "-m", "comment", "--comment", "hairpin traffic", "-j", "OPENSHIFT-HAIRPIN"})
 	}
+	// Skip traffic already marked by kube-proxy for masquerading.
+	// This fixes a bug where traffic destined to a service's ExternalIP
+	// but also intended to go be SNAT'd to an EgressIP was dropped.
+	masqRules = append(masqRules, []string{"-m", "mark", "--mark", n.masqueradeBitHex + "/" + n.masqueradeBitHex, "-j", "RETURN"})
+	// The off-cluster traffic of direct-attach namespaces keeps the pods' IPs
+	masqRules = append(masqRules, []string{"-m", "mark", "--mark", directAttachMark, "!", "-o", Tun0, "-m", "comment", "--comment", "don't masquerade direct-attach pods", "-j", "RETURN"})
 	var masq2Rules [][]string
 	var filterRules [][]string
+	if n.routed {
+		for _, cidr := range n.clusterNetworkCIDR {
+			masqRules = append(masqRules, []string{"-d", cidr, "!", "-o", Tun0, "-m", "comment", "--comment", "don't masquerade routed pod-to-pod traffic", "-j", "RETURN"})
+		}
+	}
 	for _, cidr := range n.clusterNetworkCIDR {
 		if n.masqueradeServices {
 			masqRules = append(masqRules, []string{"-s", cidr, "-m", "comment", "--comment", "masquerade pod-to-service and pod-to-external traffic", "-j", "MASQUERADE"})
@@ -238,6 +362,14 @@ func (n *NodeIPTables) getNodeIPTablesChains() []Chain {
 			rules:    filterRules,
 		},
 	)
+	chainArray = append(chainArray,
+		Chain{
+			// Filled in by AddHairpinServiceIP()
+			table: "nat",
+			name:  "OPENSHIFT-HAIRPIN",
+			rules: nil,
+		},
+	)
 	if !n.masqueradeServices {
 		masq2Rules = append(masq2Rules, []string{"-j", "MASQUERADE"})
 		chainArray = append(chainArray,
@@ -288,9 +420,68 @@ func (n *NodeIPTables) ensureEgressIPRules(egressIP, mark string) error {
 		_, err := n.ipt.EnsureRule(iptables.Append, iptables.TableFilter, iptables.Chain("OPENSHIFT-FIREWALL-ALLOW"), "-d", egressIP, "-m", "conntrack", "--ctstate", "NEW", "-j", "REJECT")
 		return err
 	})
+	if err != nil {
+		return err
+	}
+	if bandwidth := n.egressIPBandwidth[egressIP]; bandwidth != 0 {
+		err = execIPTablesWithRetry(func() error {
+			_, err := n.ipt.EnsureRule(iptables.Append, iptables.TableFilter, iptables.Chain("OPENSHIFT-EGRESS-IP-LIMIT"), egressIPBandwidthRule(mark, bandwidth)...)
+			return err
+		})
+	}
 	return err
 }
 
+// egressIPBandwidthRule returns the OPENSHIFT-EGRESS-IP-LIMIT rule dropping traffic
+// with mark in excess of bandwidth bits per second
+func egressIPBandwidthRule(mark string, bandwidth int64) []string {
+	// hashlimit names are limited to 15 characters, so use the mark (which is
+	// unique per local egress IP) rather than the IP
+	name := "eip-" + strings.TrimPrefix(mark, "0x")
+	var rate string
+	if byteRate := bandwidth / 8; byteRate%(1024*1024) == 0 {
+		rate = fmt.Sprintf("%dmb/s", byteRate/(1024*1024))
+	} else if byteRate%1024 == 0 {
+		rate = fmt.Sprintf("%dkb/s", byteRate/1024)
+	} else {
+		rate = fmt.Sprintf("%db/s", byteRate)
+	}
+	return []string{"-m", "mark", "--mark", mark, "-m", "hashlimit", "--hashlimit-name", name, "--hashlimit-above", rate, "-j", "DROP"}
+}
+
+// SetEgressIPBandwidth sets the bandwidth limit, in bits per second, for egressIP's
+// traffic (which is marked with mark). A bandwidth of 0 removes the limit.
+func (n *NodeIPTables) SetEgressIPBandwidth(egressIP, mark string, bandwidth int64) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if mark == "" {
+		return fmt.Errorf("no packet mark for egress IP %q", egressIP)
+	}
+
+	if old := n.egressIPBandwidth[egressIP]; old != 0 {
+		err := execIPTablesWithRetry(func() error {
+			return n.ipt.DeleteRule(iptables.TableFilter, iptables.Chain("OPENSHIFT-EGRESS-IP-LIMIT"), egressIPBandwidthRule(mark, old)...)
+		})
+		if err != nil {
+			return err
+		}
+		delete(n.egressIPBandwidth, egressIP)
+	}
+	if bandwidth == 0 {
+		return nil
+	}
+	n.egressIPBandwidth[egressIP] = bandwidth
+	if _, ok := n.egressIPs[egressIP]; !ok {
+		// will be added along with the other egress IP rules
+		return nil
+	}
+	return execIPTablesWithRetry(func() error {
+		_, err := n.ipt.EnsureRule(iptables.Append, iptables.TableFilter, iptables.Chain("OPENSHIFT-EGRESS-IP-LIMIT"), egressIPBandwidthRule(mark, bandwidth)...)
+		return err
+	})
+}
+
 func (n *NodeIPTables) AddEgressIPRules(egressIP, mark string) error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
@@ -307,6 +498,15 @@ func (n *NodeIPTables) DeleteEgressIPRules(egressIP, mark string) error {
 	defer n.mu.Unlock()
 
 	delete(n.egressIPs, egressIP)
+	if bandwidth := n.egressIPBandwidth[egressIP]; bandwidth != 0 {
+		delete(n.egressIPBandwidth, egressIP)
+		err := execIPTablesWithRetry(func() error {
+			return n.ipt.DeleteRule(iptables.TableFilter, iptables.Chain("OPENSHIFT-EGRESS-IP-LIMIT"), egressIPBandwidthRule(mark, bandwidth)...)
+		})
+		if err != nil {
+			return err
+		}
+	}
 
 	for _, cidr := range n.clusterNetworkCIDR {
 		err := execIPTablesWithRetry(func() error {
@@ -322,6 +522,44 @@ func (n *NodeIPTables) DeleteEgressIPRules(egressIP, mark string) error {
 	return err
 }
 
+// hairpinRule returns the OPENSHIFT-HAIRPIN rule NATting hairpin traffic to
+// serviceIP to serviceIP
+func hairpinRule(serviceIP string) []string {
+	return []string{"-m", "conntrack", "--ctorigdst", serviceIP, "-j", "SNAT", "--to-source", serviceIP}
+}
+
+func (n *NodeIPTables) ensureHairpinRule(serviceIP string) error {
+	return execIPTablesWithRetry(func() error {
+		_, err := n.ipt.EnsureRule(iptables.Append, iptables.TableNAT, iptables.Chain("OPENSHIFT-HAIRPIN"), hairpinRule(serviceIP)...)
+		return err
+	})
+}
+
+// AddHairpinServiceIP makes hairpin traffic to serviceIP (pod-to-service traffic
+// that kube-proxy sends back to the same pod) appear to come from serviceIP, rather
+// than being masqueraded to the tun0 IP
+func (n *NodeIPTables) AddHairpinServiceIP(serviceIP string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.ensureHairpinRule(serviceIP); err != nil {
+		return err
+	}
+	n.hairpinServiceIPs.Insert(serviceIP)
+	return nil
+}
+
+// DeleteHairpinServiceIP undoes AddHairpinServiceIP
+func (n *NodeIPTables) DeleteHairpinServiceIP(serviceIP string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.hairpinServiceIPs.Delete(serviceIP)
+	return execIPTablesWithRetry(func() error {
+		return n.ipt.DeleteRule(iptables.TableNAT, iptables.Chain("OPENSHIFT-HAIRPIN"), hairpinRule(serviceIP)...)
+	})
+}
+
 var masqRuleRE = regexp.MustCompile(`-A OPENSHIFT-MASQUERADE .* --to-source ([^ ]*)`)
 var filterRuleRE = regexp.MustCompile(`-A OPENSHIFT-FIREWALL-ALLOW -d ([^ ]*)/32 .* -j REJECT`)
 
@@ -357,6 +595,29 @@ func (n *NodeIPTables) SyncEgressIPRules() {
 		klog.Warningf("Error looking for stale egress IP iptables rules: %v", err)
 	}
 
+	// The bandwidth limit rules don't mention the egress IP, so just rebuild them
+	n.mu.Lock()
+	err = execIPTablesWithRetry(func() error {
+		return n.ipt.FlushChain(iptables.TableFilter, iptables.Chain("OPENSHIFT-EGRESS-IP-LIMIT"))
+	})
+	if err == nil {
+		for egressIP, bandwidth := range n.egressIPBandwidth {
+			if mark, ok := n.egressIPs[egressIP]; ok {
+				err = execIPTablesWithRetry(func() error {
+					_, err := n.ipt.EnsureRule(iptables.Append, iptables.TableFilter, iptables.Chain("OPENSHIFT-EGRESS-IP-LIMIT"), egressIPBandwidthRule(mark, bandwidth)...)
+					return err
+				})
+				if err != nil {
+					break
+				}
+			}
+		}
+	}
+	n.mu.Unlock()
+	if err != nil {
+		klog.Warningf("Error syncing egress IP bandwidth limit iptables rules: %v", err)
+	}
+
 	for ip, rule := range masqRules {
 		klog.V(2).Infof("Deleting iptables masquerade rule for stale egress IP %s", ip)
 		args := strings.Split(rule, " ")
@@ -0,0 +1,119 @@
+package node
+
+import (
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+// localVNIDs tracks which VNIDs are in use on this node, so that per-VNID flows are
+// only programmed where they are needed. A pod can only reach the services of its own
+// VNID, of global namespaces, and of the namespaces it shares services with, so
+// rather than having flows for the services of every namespace in the cluster, the
+// node only programs the service flows of VNID 0, of the VNIDs of its pods, and of
+// their shared-services peers. When the last local pod with a VNID goes away, the
+// flows for that VNID are removed immediately rather than at the next Reconcile().
+type localVNIDs struct {
+	lock sync.Mutex
+	// services is the services with IPs (whose flows are only maintained when not
+	// using conntrack), and their VNIDs
+	services map[ktypes.NamespacedName]*localService
+	// podVNIDs is the set of VNIDs of local pods as of the last update
+	podVNIDs sets.Int
+	// serviceVNIDs is the set of VNIDs whose services have flows, or nil if that
+	// isn't known yet (in which case every service gets flows)
+	serviceVNIDs sets.Int
+}
+
+type localService struct {
+	service *corev1.Service
+	vnid    uint32
+}
+
+func newLocalVNIDs() *localVNIDs {
+	return &localVNIDs{
+		services: make(map[ktypes.NamespacedName]*localService),
+		podVNIDs: sets.NewInt(),
+	}
+}
+
+func serviceKey(service *corev1.Service) ktypes.NamespacedName {
+	return ktypes.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+}
+
+// wantsServiceFlows returns true if the services with VNID vnid should have flows.
+// Must be called with the lock held.
+func (lv *localVNIDs) wantsServiceFlows(vnid uint32) bool {
+	return lv.serviceVNIDs == nil || lv.serviceVNIDs.Has(int(vnid))
+}
+
+// resyncServiceFlows rewrites the flows of the services that should have them, in
+// case they have drifted
+func (node *OsdnNode) resyncServiceFlows() error {
+	lv := node.localVNIDs
+	if lv == nil {
+		return nil
+	}
+	lv.lock.Lock()
+	defer lv.lock.Unlock()
+
+	otx := node.oc.NewTransaction()
+	for _, ls := range lv.services {
+		deleteServiceRules(otx, ls.service)
+		if lv.wantsServiceFlows(ls.vnid) {
+			addServiceRules(otx, ls.service, ls.vnid)
+		}
+	}
+	if err := otx.Commit(); err != nil {
+		return fmt.Errorf("error resyncing OVS flows for services: %v", err)
+	}
+	return nil
+}
+
+// updateLocalVNIDs updates the per-VNID flows after the VNIDs of the local pods (or
+// the shared-services peers of those VNIDs) may have changed
+func (node *OsdnNode) updateLocalVNIDs() {
+	lv := node.localVNIDs
+	if lv == nil {
+		return
+	}
+
+	podVNIDs := node.podManager.localVNIDs()
+	wanted := sets.NewInt(0)
+	for _, vnid := range podVNIDs.UnsortedList() {
+		wanted.Insert(vnid)
+		for _, peer := range node.policy.GetSharedServiceVNIDs(uint32(vnid)) {
+			wanted.Insert(int(peer))
+		}
+	}
+
+	lv.lock.Lock()
+	released := lv.podVNIDs.Difference(podVNIDs)
+	lv.podVNIDs = podVNIDs
+
+	otx := node.oc.NewTransaction()
+	for _, ls := range lv.services {
+		vnid := int(ls.vnid)
+		if wanted.Has(vnid) && !lv.wantsServiceFlows(ls.vnid) {
+			addServiceRules(otx, ls.service, ls.vnid)
+		} else if !wanted.Has(vnid) && lv.wantsServiceFlows(ls.vnid) {
+			deleteServiceRules(otx, ls.service)
+		}
+	}
+	if err := otx.Commit(); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Error updating OVS flows for services of local VNIDs: %v", err))
+	} else {
+		lv.serviceVNIDs = wanted
+	}
+	lv.lock.Unlock()
+
+	if released.Len() > 0 {
+		klog.V(5).Infof("No more local pods with VNIDs %v; removing their flows", released.List())
+		node.policy.SyncVNIDRules()
+	}
+}
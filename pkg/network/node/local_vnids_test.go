@@ -0,0 +1,113 @@
+package node
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/sdn/pkg/util/ovs"
+)
+
+func TestLocalVNIDs(t *testing.T) {
+	ovsif, oc, _ := setupOVSController(t)
+	mp := NewMultiTenantPlugin().(*multiTenantPlugin)
+	node := &OsdnNode{
+		oc:         oc,
+		policy:     mp,
+		podManager: newDefaultPodManager(),
+		localVNIDs: newLocalVNIDs(),
+		hairpin:    newHairpinServices(),
+	}
+	mp.node = node
+	mp.vnids = newNodeVNIDMap(mp, nil)
+	mp.vnidInUse = oc.FindPolicyVNIDs()
+	mp.vnids.setVNID("default", 0, false)
+	mp.vnids.setVNID("services", 10, false)
+	mp.vnids.setVNID("alpha", 11, false)
+	mp.vnids.setVNID("bravo", 12, false)
+
+	node.podManager.runningPods["alpha/pod"] = &runningPod{vnid: 11, ofport: 3}
+	mp.EnsureVNIDRules(11)
+	node.updateLocalVNIDs()
+
+	services := map[string]uint32{"default": 0, "services": 10, "alpha": 11, "bravo": 12}
+	serviceIP := func(namespace string) string {
+		return fmt.Sprintf("172.30.0.%d", services[namespace]+1)
+	}
+	for namespace, vnid := range services {
+		node.AddServiceRules(&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "svc"},
+			Spec: corev1.ServiceSpec{
+				ClusterIP: serviceIP(namespace),
+				Ports:     []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80}},
+			},
+		}, vnid)
+	}
+
+	assertFlows := func(expected ...string) {
+		t.Helper()
+		flows, err := ovsif.DumpFlows("")
+		if err != nil {
+			t.Fatalf("Unexpected error dumping flows: %v", err)
+		}
+		found := make(map[string]bool)
+		for _, flow := range flows {
+			if strings.Contains(flow, "table=60") && strings.Contains(flow, "tcp_dst=80") {
+				for namespace := range services {
+					if strings.Contains(flow, "nw_dst="+serviceIP(namespace)+",") {
+						found[namespace] = true
+					}
+				}
+			}
+		}
+		if len(found) != len(expected) {
+			t.Fatalf("expected service flows for %v, got %v", expected, found)
+		}
+		for _, namespace := range expected {
+			if !found[namespace] {
+				t.Fatalf("expected service flows for %v, got %v", expected, found)
+			}
+		}
+	}
+
+	// Only the services of global namespaces and of local pods get flows
+	assertFlows("default", "alpha")
+
+	// Sharing services with alpha makes the services namespace's services reachable
+	mp.updateSharedServices(sharedServicesNetNamespace("services", 10, "alpha"), false)
+	assertFlows("default", "alpha", "services")
+
+	// A pod in bravo adds bravo's services
+	node.podManager.runningPods["bravo/pod"] = &runningPod{vnid: 12, ofport: 4}
+	node.updateLocalVNIDs()
+	assertFlows("default", "alpha", "bravo", "services")
+
+	// When the last alpha pod goes away, its services, its shared-services peer's
+	// services, and its policy flows are all removed
+	if !hasPolicyFlow(t, ovsif, 11) {
+		t.Fatalf("Missing policy flow for VNID 11")
+	}
+	delete(node.podManager.runningPods, "alpha/pod")
+	node.updateLocalVNIDs()
+	assertFlows("default", "bravo")
+	if hasPolicyFlow(t, ovsif, 11) {
+		t.Fatalf("Unexpected policy flow for unused VNID 11")
+	}
+}
+
+func hasPolicyFlow(t *testing.T, ovsif ovs.Interface, vnid uint32) bool {
+	t.Helper()
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	for _, flow := range flows {
+		if strings.Contains(flow, "table=80") && strings.Contains(flow, fmt.Sprintf("reg0=%d,", vnid)) && strings.Contains(flow, fmt.Sprintf("reg1=%d,", vnid)) {
+			return true
+		}
+	}
+	return false
+}
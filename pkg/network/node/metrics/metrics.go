@@ -5,8 +5,6 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -22,19 +20,56 @@ const (
 	SDNSubsystem     = "sdn"
 
 	OVSFlowsKey                 = "ovs_flows"
+	OVSFlowsByOwnerKey          = "ovs_flows_by_owner"
+	OVSTableFlowsKey            = "ovs_table_flows"
 	OVSOperationsKey            = "ovs_operations"
+	OVSRestartsKey              = "ovs_restarts"
+	ExecFailuresKey             = "exec_failures_total"
 	ARPCacheAvailableEntriesKey = "arp_cache_entries"
+	NDPCacheAvailableEntriesKey = "ndp_cache_entries"
+	NeighborTableGCThresholdKey = "neighbor_table_gc_threshold"
+	NeighborTableGCRaisesKey    = "neighbor_table_gc_threshold_raises"
 	PodIPsKey                   = "pod_ips"
+	PodIPLeaksKey               = "pod_ip_leaks"
+	PodIPLeaksReclaimedKey      = "pod_ip_leaks_reclaimed_total"
 	PodOperationsErrorsKey      = "pod_operations_errors"
 	PodOperationsLatencyKey     = "pod_operations_latency"
+	PodSetupLatencyKey          = "pod_setup_latency_seconds"
 	VnidNotFoundErrorsKey       = "vnid_not_found_errors"
 
+	NetworkPolicyFlowsKey           = "networkpolicy_flows"
+	NetworkPolicySyncDurationKey    = "networkpolicy_sync_duration_seconds"
+	NetworkPolicyCompileFailuresKey = "networkpolicy_compile_failures"
+
+	NamespaceTrafficBytesKey = "namespace_traffic_bytes_total"
+
+	EgressFirewallDroppedPacketsKey = "egress_firewall_dropped_packets_total"
+	EgressFirewallAuditedPacketsKey = "egress_firewall_audited_packets"
+
+	HybridProxyIdledServicesKey = "hybrid_proxy_idled_services"
+
+	EgressDNSResolutionLatencyKey = "egress_dns_resolution_latency_seconds"
+	EgressDNSResolutionErrorsKey  = "egress_dns_resolution_errors_total"
+
+	MTUMismatchKey = "mtu_mismatch"
+
 	// OVS Operation result type
 	OVSOperationSuccess = "success"
 	OVSOperationFailure = "failure"
+	// OVS restart recovery result type
+	OVSRestartRecovered = "recovered"
+	OVSRestartFailed    = "failed"
 	// Pod Operation types
 	PodOperationSetup    = "setup"
 	PodOperationTeardown = "teardown"
+	// Pod setup phase covering the whole setup
+	PodSetupPhaseTotal = "total"
+	// Namespace traffic directions and peer types
+	TrafficDirectionTx  = "tx"
+	TrafficDirectionRx  = "rx"
+	TrafficPeerPod      = "pod"
+	TrafficPeerService  = "service"
+	TrafficPeerExternal = "external"
 )
 
 var (
@@ -46,6 +81,24 @@ var (
 			Help:      "Number of Open vSwitch flows",
 		},
 	)
+	OVSFlowsByOwner = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      OVSFlowsByOwnerKey,
+			Help:      "Number of Open vSwitch flows by the class of object (pod, service, policy, egress) they belong to",
+		},
+		[]string{"owner"},
+	)
+	OVSTableFlows = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      OVSTableFlowsKey,
+			Help:      "Number of Open vSwitch flows in each table",
+		},
+		[]string{"table"},
+	)
 	OVSOperationsResult = metrics.NewCounterVec(
 		&metrics.CounterOpts{
 			Namespace: SDNNamespace,
@@ -55,6 +108,24 @@ var (
 		},
 		[]string{"result_type"},
 	)
+	OVSRestarts = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      OVSRestartsKey,
+			Help:      "Cumulative number of detected OVS restarts by whether the flows could be restored",
+		},
+		[]string{"result_type"},
+	)
+	ExecFailures = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      ExecFailuresKey,
+			Help:      "Cumulative number of failed helper commands (ovs-ofctl, iptables, conntrack, etc) by command and reason. (Reason \"exit\" includes non-0 exits the caller expects, such as from \"iptables -C\".)",
+		},
+		[]string{"command", "reason"},
+	)
 
 	ARPCacheAvailableEntries = metrics.NewGauge(
 		&metrics.GaugeOpts{
@@ -65,6 +136,35 @@ var (
 		},
 	)
 
+	NDPCacheAvailableEntries = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      NDPCacheAvailableEntriesKey,
+			Help:      "Number of available entries in the NDP (IPv6 neighbor) cache",
+		},
+	)
+
+	NeighborTableGCThreshold = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      NeighborTableGCThresholdKey,
+			Help:      "Current neighbor table garbage collection thresholds (gc_thresh1, gc_thresh2, gc_thresh3) by address family",
+		},
+		[]string{"family", "threshold"},
+	)
+
+	NeighborTableGCRaises = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      NeighborTableGCRaisesKey,
+			Help:      "Cumulative number of times the node raised the neighbor table garbage collection thresholds because the table was nearly full, by address family",
+		},
+		[]string{"family"},
+	)
+
 	PodIPs = metrics.NewGauge(
 		&metrics.GaugeOpts{
 			Namespace: SDNNamespace,
@@ -74,6 +174,24 @@ var (
 		},
 	)
 
+	PodIPLeaks = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      PodIPLeaksKey,
+			Help:      "Number of pod IP allocations not belonging to any running sandbox or OVS port, as of the last leak scan",
+		},
+	)
+
+	PodIPLeaksReclaimed = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      PodIPLeaksReclaimedKey,
+			Help:      "Cumulative number of leaked pod IP allocations released by the leak scan",
+		},
+	)
+
 	PodOperationsErrors = metrics.NewCounterVec(
 		&metrics.CounterOpts{
 			Namespace: SDNNamespace,
@@ -94,6 +212,17 @@ var (
 		[]string{"operation_type"},
 	)
 
+	PodSetupLatency = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      PodSetupLatencyKey,
+			Help:      "Time in seconds taken by successful pod network setups (phase \"total\", from when the CNI plugin started) and by each phase of them",
+			Buckets:   metrics.ExponentialBuckets(0.001, 2, 15),
+		},
+		[]string{"phase"},
+	)
+
 	VnidNotFoundErrors = metrics.NewCounter(
 		&metrics.CounterOpts{
 			Namespace: SDNNamespace,
@@ -103,8 +232,105 @@ var (
 		},
 	)
 
+	NetworkPolicyFlows = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      NetworkPolicyFlowsKey,
+			Help:      "Number of OVS flows generated for each NetworkPolicy",
+		},
+		[]string{"namespace", "policy"},
+	)
+
+	NetworkPolicySyncDuration = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      NetworkPolicySyncDurationKey,
+			Help:      "Time in seconds taken to sync NetworkPolicy flows to OVS",
+			Buckets:   metrics.ExponentialBuckets(0.001, 2, 15),
+		},
+	)
+
+	NetworkPolicyCompileFailures = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      NetworkPolicyCompileFailuresKey,
+			Help:      "Number of NetworkPolicies in each namespace containing rules that could not be converted to OVS flows",
+		},
+		[]string{"namespace"},
+	)
+
+	NamespaceTrafficBytes = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      NamespaceTrafficBytesKey,
+			Help:      "Cumulative number of IPv4 bytes sent (tx) and received (rx) by the pods on this node, by namespace and by whether the other end was a pod, a service, or external",
+		},
+		[]string{"namespace", "direction", "peer"},
+	)
+
+	EgressFirewallDroppedPackets = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      EgressFirewallDroppedPacketsKey,
+			Help:      "Cumulative number of packets dropped by EgressNetworkPolicy rules by namespace",
+		},
+		[]string{"namespace"},
+	)
+
+	EgressFirewallAuditedPackets = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      EgressFirewallAuditedPacketsKey,
+			Help:      "Cumulative number of packets that audit-only EgressNetworkPolicy rules would have dropped by namespace",
+		},
+		[]string{"namespace"},
+	)
+
+	HybridProxyIdledServices = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      HybridProxyIdledServicesKey,
+			Help:      "Number of services currently handled by the unidling proxy rather than the main proxy",
+		},
+	)
+
+	EgressDNSResolutionLatency = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      EgressDNSResolutionLatencyKey,
+			Help:      "Time in seconds taken to resolve each EgressNetworkPolicy dnsName",
+			Buckets:   metrics.ExponentialBuckets(0.001, 2, 15),
+		},
+	)
+
+	EgressDNSResolutionErrors = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      EgressDNSResolutionErrorsKey,
+			Help:      "Cumulative number of failed EgressNetworkPolicy dnsName resolutions",
+		},
+	)
+
+	MTUMismatch = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      MTUMismatchKey,
+			Help:      "Set to 1 for each remote node whose advertised underlay interface MTU differs from this node's",
+		},
+		[]string{"peer_node"},
+	)
+
 	// num stale OVS flows (flows that reference non-existent ports)
-	// num vnids (in the master)
 	// num netnamespaces (in the master)
 	// iptables call time (in upstream kube)
 	// iptables call failures (in upstream kube)
@@ -117,15 +343,44 @@ var registerMetrics sync.Once
 func RegisterMetrics() {
 	registerMetrics.Do(func() {
 		legacyregistry.MustRegister(OVSFlows)
+		legacyregistry.MustRegister(OVSFlowsByOwner)
+		legacyregistry.MustRegister(OVSTableFlows)
 		legacyregistry.MustRegister(OVSOperationsResult)
+		legacyregistry.MustRegister(OVSRestarts)
+		legacyregistry.MustRegister(ExecFailures)
 		legacyregistry.MustRegister(ARPCacheAvailableEntries)
+		legacyregistry.MustRegister(NDPCacheAvailableEntries)
+		legacyregistry.MustRegister(NeighborTableGCThreshold)
+		legacyregistry.MustRegister(NeighborTableGCRaises)
 		legacyregistry.MustRegister(PodIPs)
+		legacyregistry.MustRegister(PodIPLeaks)
+		legacyregistry.MustRegister(PodIPLeaksReclaimed)
 		legacyregistry.MustRegister(PodOperationsErrors)
 		legacyregistry.MustRegister(PodOperationsLatency)
+		legacyregistry.MustRegister(PodSetupLatency)
 		legacyregistry.MustRegister(VnidNotFoundErrors)
+		legacyregistry.MustRegister(NetworkPolicyFlows)
+		legacyregistry.MustRegister(NetworkPolicySyncDuration)
+		legacyregistry.MustRegister(NetworkPolicyCompileFailures)
+		legacyregistry.MustRegister(NamespaceTrafficBytes)
+		legacyregistry.MustRegister(EgressFirewallDroppedPackets)
+		legacyregistry.MustRegister(EgressFirewallAuditedPackets)
+		legacyregistry.MustRegister(HybridProxyIdledServices)
+		legacyregistry.MustRegister(EgressDNSResolutionLatency)
+		legacyregistry.MustRegister(EgressDNSResolutionErrors)
+		legacyregistry.MustRegister(MTUMismatch)
 	})
 }
 
+// ObserveEgressDNSResolution records an EgressNetworkPolicy dnsName resolution; it
+// is a common.EgressDNSObserver
+func ObserveEgressDNSResolution(latency time.Duration, err error) {
+	EgressDNSResolutionLatency.Observe(latency.Seconds())
+	if err != nil {
+		EgressDNSResolutionErrors.Inc()
+	}
+}
+
 // SinceInMicroseconds gets the time since the specified start in microseconds.
 func SinceInMicroseconds(start time.Time) float64 {
 	return float64(time.Since(start) / time.Microsecond)
@@ -133,44 +388,9 @@ func SinceInMicroseconds(start time.Time) float64 {
 
 // GatherPeriodicMetrics is used to periodically gather metrics.
 func GatherPeriodicMetrics() {
-	updateARPMetrics()
 	updatePodIPMetrics()
 }
 
-func updateARPMetrics() {
-	var used int
-	data, err := ioutil.ReadFile("/proc/net/arp")
-	if err != nil {
-		utilruntime.HandleError(fmt.Errorf("failed to read ARP entries for metrics: %v", err))
-		return
-	}
-	lines := strings.Split(string(data), "\n")
-	// Skip the header line
-	used = len(lines) - 1
-
-	// gc_thresh2 isn't the absolute max, but it's the level at which
-	// garbage collection (and thus problems) could start.
-	data, err = ioutil.ReadFile("/proc/sys/net/ipv4/neigh/default/gc_thresh2")
-	if err != nil && os.IsNotExist(err) {
-		// gc_thresh* may not exist in some cases; don't log an error
-		return
-	} else if err != nil {
-		utilruntime.HandleError(fmt.Errorf("failed to read max ARP entries for metrics: %T %v", err, err))
-		return
-	}
-
-	max, err := strconv.Atoi(strings.TrimSpace(string(data)))
-	if err == nil {
-		available := max - used
-		if available < 0 {
-			available = 0
-		}
-		ARPCacheAvailableEntries.Set(float64(available))
-	} else {
-		utilruntime.HandleError(fmt.Errorf("failed to parse max ARP entries %q for metrics: %T %v", data, err, err))
-	}
-}
-
 func updatePodIPMetrics() {
 	numAddrs := 0
 	items, err := ioutil.ReadDir(hostLocalDataDir + "/openshift-sdn/")
@@ -0,0 +1,152 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// MigrationTeardownAnnotation is set to "true" on a Node by the migration
+// controller once OVN-Kubernetes is ready to take over the node. A node in
+// migration mode then removes its OVS bridge and iptables rules as soon as no pods
+// remain attached to the SDN.
+const MigrationTeardownAnnotation = "network.openshift.io/sdn-migration-teardown"
+
+// migrationTeardownRetryInterval is how often a requested teardown is retried while
+// pods are still attached to the SDN
+var migrationTeardownRetryInterval = 10 * time.Second
+
+// MigrationStatus describes the node's progress in a live migration to
+// OVN-Kubernetes, as returned by ServeMigrationStatus
+type MigrationStatus struct {
+	// Migrating is true if the node is running in migration mode
+	Migrating bool `json:"migrating"`
+	// RunningPods is the number of pods still attached to the SDN on this node
+	RunningPods int `json:"runningPods"`
+	// Ready is true if no pods remain attached to the SDN, so the node can be
+	// torn down
+	Ready bool `json:"ready"`
+	// TeardownRequested is true if the Node has MigrationTeardownAnnotation
+	TeardownRequested bool `json:"teardownRequested"`
+	// TornDown is true if the node's OVS bridge and iptables rules have been
+	// removed
+	TornDown bool `json:"tornDown"`
+}
+
+func (node *OsdnNode) isTornDown() bool {
+	node.migrationLock.Lock()
+	defer node.migrationLock.Unlock()
+	return node.tornDown
+}
+
+// GetMigrationStatus returns the node's migration status
+func (node *OsdnNode) GetMigrationStatus() *MigrationStatus {
+	node.migrationLock.Lock()
+	status := &MigrationStatus{
+		Migrating:         node.migrationMode,
+		TeardownRequested: node.teardownRequested,
+		TornDown:          node.tornDown,
+	}
+	node.migrationLock.Unlock()
+	if !status.TornDown {
+		status.RunningPods = node.podManager.runningPodCount()
+	}
+	status.Ready = status.Migrating && status.RunningPods == 0
+	return status
+}
+
+// Teardown removes the node's OVS bridge and iptables rules at the end of a
+// migration. It can only be called in migration mode, once all pods have been
+// moved off of the SDN. After a successful Teardown, the node no longer tries to
+// repair or resync its networking.
+func (node *OsdnNode) Teardown() error {
+	if !node.migrationMode {
+		return fmt.Errorf("node is not in migration mode")
+	}
+	if node.isTornDown() {
+		return nil
+	}
+	if pods := node.podManager.runningPodCount(); pods > 0 {
+		return fmt.Errorf("%d pods are still attached to the SDN", pods)
+	}
+
+	// Mark the node torn down first so that the OVS health check doesn't try to
+	// restore the bridge while it is being deleted
+	node.migrationLock.Lock()
+	node.tornDown = true
+	node.migrationLock.Unlock()
+
+	if err := node.nodeIPTables.Teardown(); err != nil {
+		return fmt.Errorf("could not remove iptables rules: %v", err)
+	}
+	if err := node.oc.ovs.DeleteBridge(); err != nil {
+		return fmt.Errorf("could not delete OVS bridge: %v", err)
+	}
+	klog.Infof("Removed SDN bridge and iptables rules for migration")
+	return nil
+}
+
+// watchMigrationTeardown starts watching for MigrationTeardownAnnotation on our Node
+func (node *OsdnNode) watchMigrationTeardown() {
+	funcs := common.InformerFuncs(&corev1.Node{}, node.handleAddOrUpdateMigrationNode, nil)
+	node.kubeInformers.Core().V1().Nodes().Informer().AddEventHandler(funcs)
+}
+
+func (node *OsdnNode) handleAddOrUpdateMigrationNode(obj, _ interface{}, eventType watch.EventType) {
+	kNode := obj.(*corev1.Node)
+	if kNode.Name != node.hostName || kNode.Annotations[MigrationTeardownAnnotation] != "true" {
+		return
+	}
+
+	node.migrationLock.Lock()
+	defer node.migrationLock.Unlock()
+	if node.teardownRequested || node.tornDown {
+		return
+	}
+	klog.Infof("Teardown of SDN networking requested for migration")
+	node.teardownRequested = true
+	go utilwait.PollImmediateInfinite(migrationTeardownRetryInterval, node.tryMigrationTeardown)
+}
+
+// tryMigrationTeardown tears the node down (and calls the MigrationTornDown hook)
+// if no pods are left, returning true once it has succeeded
+func (node *OsdnNode) tryMigrationTeardown() (bool, error) {
+	if err := node.Teardown(); err != nil {
+		klog.V(2).Infof("Not tearing down SDN networking yet: %v", err)
+		return false, nil
+	}
+	if node.migrationTornDown != nil {
+		if err := node.migrationTornDown(); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Could not finish migration teardown: %v", err))
+			return false, nil
+		}
+	}
+	node.recorder.Eventf(&corev1.ObjectReference{Kind: "Node", Name: node.hostName}, corev1.EventTypeNormal, "TornDown", "openshift-sdn removed node networking for migration.")
+	return true, nil
+}
+
+// ServeMigrationStatus is an HTTP handler returning the node's MigrationStatus as
+// JSON. The status is 200 if the node is ready to be torn down (or already has
+// been) and 503 otherwise.
+func (node *OsdnNode) ServeMigrationStatus(w http.ResponseWriter, r *http.Request) {
+	status := node.GetMigrationStatus()
+	w.Header().Set("Content-Type", "application/json")
+	if status.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not write migration status: %v", err))
+	}
+}
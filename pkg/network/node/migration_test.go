@@ -0,0 +1,79 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/kubernetes/pkg/util/iptables"
+)
+
+// noChainsIPTables is an iptables.Interface with no chains
+type noChainsIPTables struct {
+	iptables.Interface
+}
+
+func (ipt *noChainsIPTables) ChainExists(table iptables.Table, chain iptables.Chain) (bool, error) {
+	return false, nil
+}
+
+func TestMigrationTeardown(t *testing.T) {
+	migrationTeardownRetryInterval = 10 * time.Millisecond
+
+	ovsif, oc, _ := setupOVSController(t)
+	tornDown := make(chan struct{})
+	node := &OsdnNode{
+		hostName:      "node1",
+		oc:            oc,
+		migrationMode: true,
+		podManager:    newDefaultPodManager(),
+		nodeIPTables:  newNodeIPTables(&noChainsIPTables{}, []string{"10.128.0.0/14"}, false, 4789, 0, nil),
+		recorder:      record.NewFakeRecorder(10),
+		migrationTornDown: func() error {
+			close(tornDown)
+			return nil
+		},
+	}
+	node.podManager.runningPods["alpha/pod1"] = &runningPod{vnid: 11, ofport: 3}
+
+	kNode := func(name string, teardown bool) *corev1.Node {
+		n := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{}}}
+		if teardown {
+			n.Annotations[MigrationTeardownAnnotation] = "true"
+		}
+		return n
+	}
+	node.handleAddOrUpdateMigrationNode(kNode("node2", true), nil, watch.Added)
+	node.handleAddOrUpdateMigrationNode(kNode("node1", false), nil, watch.Added)
+	if status := node.GetMigrationStatus(); status.TeardownRequested || status.Ready {
+		t.Fatalf("unexpected migration status %#v", status)
+	}
+
+	node.handleAddOrUpdateMigrationNode(kNode("node1", true), nil, watch.Modified)
+	time.Sleep(5 * migrationTeardownRetryInterval)
+	if status := node.GetMigrationStatus(); !status.TeardownRequested || status.TornDown || status.RunningPods != 1 {
+		t.Fatalf("unexpected migration status with pods remaining %#v", status)
+	}
+	if _, err := ovsif.DumpFlows(""); err != nil {
+		t.Fatalf("bridge removed while pods remain: %v", err)
+	}
+
+	node.podManager.runningPodsLock.Lock()
+	delete(node.podManager.runningPods, "alpha/pod1")
+	node.podManager.runningPodsLock.Unlock()
+	select {
+	case <-tornDown:
+	case <-time.After(utilwait.ForeverTestTimeout):
+		t.Fatalf("node was not torn down")
+	}
+	if status := node.GetMigrationStatus(); !status.TornDown || !status.Ready {
+		t.Fatalf("unexpected migration status after teardown %#v", status)
+	}
+	if _, err := ovsif.DumpFlows(""); err == nil {
+		t.Fatalf("bridge not removed by teardown")
+	}
+}
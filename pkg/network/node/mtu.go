@@ -0,0 +1,131 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	kwait "k8s.io/apimachinery/pkg/util/wait"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+
+	"github.com/openshift/sdn/pkg/network/common"
+	"github.com/openshift/sdn/pkg/network/node/metrics"
+)
+
+// underlayMTUCheckInterval is how often the node checks whether the MTU of its
+// underlay interface has changed
+const underlayMTUCheckInterval = time.Minute
+
+// mtuMismatch is an MTU mismatch with another node that has been reported
+type mtuMismatch struct {
+	local, peer uint32
+}
+
+// watchUnderlayMTU periodically checks the MTU of the node's underlay interface,
+// and when it changes, compares it with the other nodes' again and advertises it on
+// the node's HostSubnet (see common.HostSubnetUnderlayMTUAnnotation)
+func (node *OsdnNode) watchUnderlayMTU() {
+	published := 0
+	kwait.Forever(func() {
+		mtu, err := node.getUnderlayMTU()
+		if err != nil {
+			utilruntime.HandleError(err)
+			return
+		}
+		node.hsw.setUnderlayMTU(uint32(mtu))
+		if mtu == published {
+			return
+		}
+		if err := node.publishUnderlayMTU(mtu); err != nil {
+			utilruntime.HandleError(fmt.Errorf("could not update underlay MTU on HostSubnet %q: %v", node.hostName, err))
+			return
+		}
+		published = mtu
+	}, underlayMTUCheckInterval)
+}
+
+func (node *OsdnNode) publishUnderlayMTU(mtu int) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				common.HostSubnetUnderlayMTUAnnotation: strconv.Itoa(mtu),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = node.osdnClient.NetworkV1().HostSubnets().Patch(context.TODO(), node.hostName, ktypes.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// setUnderlayMTU records the MTU of this node's underlay interface, and if it has
+// changed, compares it with every other node's again
+func (hsw *hostSubnetWatcher) setUnderlayMTU(mtu uint32) {
+	hsw.lock.Lock()
+	defer hsw.lock.Unlock()
+
+	if mtu == hsw.underlayMTU {
+		return
+	}
+	klog.Infof("Underlay interface MTU is %d", mtu)
+	hsw.underlayMTU = mtu
+	for nodeName := range hsw.peerMTUs {
+		hsw.compareMTU(nodeName)
+	}
+}
+
+// checkMTU records the underlay MTU advertised on the remote HostSubnet hs and
+// compares it with ours. Nodes that don't advertise their MTU are ignored. The caller
+// must hold hsw.lock.
+func (hsw *hostSubnetWatcher) checkMTU(hs *osdnv1.HostSubnet) {
+	if peerMTU := common.GetHostSubnetUnderlayMTU(hs); peerMTU != 0 {
+		hsw.peerMTUs[hs.Name] = peerMTU
+	} else {
+		delete(hsw.peerMTUs, hs.Name)
+	}
+	hsw.compareMTU(hs.Name)
+}
+
+// compareMTU compares the underlay MTU of the node nodeName with ours, and records
+// an event and sets the MTUMismatch metric when they start (or stop) differing. The
+// caller must hold hsw.lock.
+func (hsw *hostSubnetWatcher) compareMTU(nodeName string) {
+	mismatch := mtuMismatch{local: hsw.underlayMTU, peer: hsw.peerMTUs[nodeName]}
+	if mismatch.local == 0 || mismatch.peer == 0 || mismatch.local == mismatch.peer {
+		hsw.clearMTUMismatch(nodeName)
+		return
+	}
+	if hsw.mtuMismatches[nodeName] == mismatch {
+		return
+	}
+	hsw.mtuMismatches[nodeName] = mismatch
+
+	klog.Warningf("Node %q has underlay MTU %d but this node has %d", nodeName, mismatch.peer, mismatch.local)
+	metrics.MTUMismatch.WithLabelValues(nodeName).Set(1)
+	if hsw.recorder != nil {
+		hsw.recorder.Eventf(&corev1.ObjectReference{Kind: "Node", Name: hsw.hostName}, corev1.EventTypeWarning, "MTUMismatch",
+			"Node %s has underlay MTU %d but node %s has %d; large packets between their pods may be dropped",
+			hsw.hostName, mismatch.local, nodeName, mismatch.peer)
+	}
+}
+
+// clearMTUMismatch forgets any MTU mismatch with the node nodeName. The caller must
+// hold hsw.lock.
+func (hsw *hostSubnetWatcher) clearMTUMismatch(nodeName string) {
+	if _, ok := hsw.mtuMismatches[nodeName]; !ok {
+		return
+	}
+	klog.Infof("Node %q no longer has a different underlay MTU", nodeName)
+	delete(hsw.mtuMismatches, nodeName)
+	metrics.MTUMismatch.DeleteLabelValues(nodeName)
+}
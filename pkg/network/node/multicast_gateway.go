@@ -0,0 +1,546 @@
+package node
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/klog/v2"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+const (
+	// multicastGatewayCookie identifies the flows that send traffic for the
+	// multicast gateway groups between pods and the node
+	multicastGatewayCookie = "0x3e"
+
+	// multicastGatewayTTL is the TTL of the multicast packets that the gateway
+	// sends onto the node's network, so that they can be routed within the
+	// datacenter
+	multicastGatewayTTL = 8
+
+	// The gateway acts as the IGMP querier for the local pods, sending a general
+	// query every multicastGatewayQueryInterval; a pod's interest in a group
+	// expires if it doesn't report it for multicastGatewayMembershipTimeout
+	multicastGatewayQueryInterval     = time.Minute
+	multicastGatewayMaxResponseTime   = 10 * time.Second
+	multicastGatewayMembershipTimeout = 2*multicastGatewayQueryInterval + multicastGatewayMaxResponseTime
+
+	// IGMP message types (RFC 3376)
+	igmpMembershipQuery    = 0x11
+	igmpV1MembershipReport = 0x12
+	igmpV2MembershipReport = 0x16
+	igmpV2LeaveGroup       = 0x17
+	igmpV3MembershipReport = 0x22
+
+	// IGMPv3 group record types
+	igmpModeIsInclude       = 1
+	igmpModeIsExclude       = 2
+	igmpChangeToIncludeMode = 3
+	igmpChangeToExcludeMode = 4
+	igmpAllowNewSources     = 5
+)
+
+// igmpAllHosts is the destination of IGMP general queries
+var igmpAllHosts = net.IPv4(224, 0, 0, 1).To4()
+
+// multicastGateway bridges traffic for a set of multicast groups (each an IP and UDP
+// port) between the pod overlay and the node's network. OVS sends traffic to the
+// groups from pods in multicast-enabled namespaces to tun0, where the gateway
+// receives it and resends it on the node's interface; and traffic to the groups
+// that arrives on the node's interface is resent to tun0, where OVS delivers it to
+// the pods of multicast-enabled namespaces.
+//
+// Every node's gateway sees every other gateway's traffic on the node network, but
+// pods on other nodes have already received that traffic over VXLAN, so traffic
+// from other nodes (or from pod IPs) is not resent to tun0.
+//
+// The gateway acts as an IGMP proxy: OVS sends the pods' IGMP reports to tun0, and
+// the gateway queries the pods periodically, and only joins each group on the
+// node's interface (so that the upstream network forwards it to the node) while
+// some local pod has joined it.
+type multicastGateway struct {
+	groups []*net.UDPAddr
+
+	hostIface       *net.Interface
+	tunIface        *net.Interface
+	localSubnet     *net.IPNet
+	clusterNetworks []*net.IPNet
+	// conns are the sockets receiving each group; hostConn and tunConn send to
+	// the node's network and to tun0; igmpFD is a raw socket receiving the pods'
+	// IGMP reports and sending queries to them
+	conns    []*net.UDPConn
+	hostConn *net.UDPConn
+	tunConn  *net.UDPConn
+	igmpFD   int
+
+	lock sync.Mutex
+	// nodeIPs are the IPs of the nodes in the cluster
+	nodeIPs map[string]string
+	// members maps the IP of each group to the IPs of the local pods that have
+	// reported joining it, and when they last did
+	members map[string]map[string]time.Time
+	// joined is the set of group IPs that are joined on hostIface
+	joined sets.String
+}
+
+func newMulticastGateway(groups []*net.UDPAddr) *multicastGateway {
+	return &multicastGateway{
+		groups:  groups,
+		igmpFD:  -1,
+		nodeIPs: make(map[string]string),
+		members: make(map[string]map[string]time.Time),
+		joined:  sets.NewString(),
+	}
+}
+
+// parseMulticastGatewayGroups parses "group:port" strings
+func parseMulticastGatewayGroups(groups []string) ([]*net.UDPAddr, error) {
+	var addrs []*net.UDPAddr
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		host, portStr, err := net.SplitHostPort(group)
+		if err != nil {
+			return nil, fmt.Errorf("invalid multicast gateway group %q: %v", group, err)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || ip.To4() == nil || !multicastCIDR.Contains(ip) {
+			return nil, fmt.Errorf("invalid multicast gateway group %q: %q is not an IPv4 multicast address", group, host)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid multicast gateway group %q: bad port %q", group, portStr)
+		}
+		addr := &net.UDPAddr{IP: ip.To4(), Port: port}
+		if !seen[addr.String()] {
+			seen[addr.String()] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// setupMulticastGateway sets up the OVS flows for the multicast gateway groups and
+// starts relaying them, or removes any flows left over from a previous run if there
+// are no groups
+func (node *OsdnNode) setupMulticastGateway() error {
+	if node.multicastGateway == nil {
+		return node.oc.SetMulticastGatewayGroups(nil)
+	}
+
+	mg := node.multicastGateway
+	link, _, err := GetLinkDetails(node.localIP)
+	if err != nil {
+		return fmt.Errorf("could not find the interface for the multicast gateway: %v", err)
+	}
+	if mg.hostIface, err = net.InterfaceByName(link.Attrs().Name); err != nil {
+		return fmt.Errorf("could not find the interface for the multicast gateway: %v", err)
+	}
+	if mg.tunIface, err = net.InterfaceByName(Tun0); err != nil {
+		return fmt.Errorf("could not find %s for the multicast gateway: %v", Tun0, err)
+	}
+	if _, mg.localSubnet, err = net.ParseCIDR(node.localSubnetCIDR); err != nil {
+		return fmt.Errorf("invalid local subnet %q: %v", node.localSubnetCIDR, err)
+	}
+	for _, cn := range node.networkInfo.ClusterNetworks {
+		mg.clusterNetworks = append(mg.clusterNetworks, cn.ClusterCIDR)
+	}
+	funcs := common.InformerFuncs(&osdnv1.HostSubnet{}, mg.handleAddOrUpdateHostSubnet, mg.handleDeleteHostSubnet)
+	node.osdnInformers.Network().V1().HostSubnets().Informer().AddEventHandler(funcs)
+
+	if err := node.oc.SetMulticastGatewayGroups(mg.groups); err != nil {
+		return fmt.Errorf("could not set up multicast gateway flows: %v", err)
+	}
+	if err := mg.start(); err != nil {
+		return err
+	}
+	klog.Infof("Relaying multicast groups %v between pods and %s", mg.groups, mg.hostIface.Name)
+	return nil
+}
+
+func (mg *multicastGateway) start() error {
+	var err error
+	if mg.hostConn, err = multicastSendConn(mg.hostIface); err != nil {
+		return err
+	}
+	if mg.tunConn, err = multicastSendConn(mg.tunIface); err != nil {
+		return err
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setsockopt(c, func(fd int) error {
+				return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			})
+		},
+	}
+	for _, group := range mg.groups {
+		// Binding to the group address means we only receive traffic for the group
+		pc, err := lc.ListenPacket(context.Background(), "udp4", group.String())
+		if err != nil {
+			return fmt.Errorf("could not listen for multicast gateway group %s: %v", group, err)
+		}
+		conn := pc.(*net.UDPConn)
+		// Joining on tun0 just lets us receive the pods' traffic; it doesn't leave the node
+		if err := setMulticastMembership(conn, group.IP, mg.tunIface, true); err != nil {
+			conn.Close()
+			return fmt.Errorf("could not join multicast gateway group %s on %s: %v", group, Tun0, err)
+		}
+		mg.conns = append(mg.conns, conn)
+		go mg.relay(conn, group)
+	}
+
+	if mg.igmpFD, err = igmpSocket(mg.tunIface); err != nil {
+		return err
+	}
+	go mg.receiveIGMP()
+	go utilwait.Forever(mg.query, multicastGatewayQueryInterval)
+	return nil
+}
+
+// igmpSocket returns a raw IGMP socket that receives IGMP messages arriving on
+// iface and sends them out of it
+func igmpSocket(iface *net.Interface) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_IGMP)
+	if err != nil {
+		return -1, fmt.Errorf("could not create multicast gateway IGMP socket: %v", err)
+	}
+	if err = syscall.BindToDevice(fd, iface.Name); err == nil {
+		err = syscall.SetsockoptIPMreqn(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, &syscall.IPMreqn{Ifindex: int32(iface.Index)})
+	}
+	if err == nil {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, 1)
+	}
+	if err == nil {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 0)
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("could not set up multicast gateway IGMP socket on %s: %v", iface.Name, err)
+	}
+	return fd, nil
+}
+
+// multicastSendConn returns a socket that sends multicast traffic out iface
+func multicastSendConn(iface *net.Interface) (*net.UDPConn, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("could not create multicast gateway socket: %v", err)
+	}
+	raw, err := conn.SyscallConn()
+	if err == nil {
+		err = setsockopt(raw, func(fd int) error {
+			if err := syscall.SetsockoptIPMreqn(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, &syscall.IPMreqn{Ifindex: int32(iface.Index)}); err != nil {
+				return err
+			}
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, multicastGatewayTTL); err != nil {
+				return err
+			}
+			return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 0)
+		})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not set up multicast gateway socket for %s: %v", iface.Name, err)
+	}
+	return conn, nil
+}
+
+// setMulticastMembership joins or leaves group on iface
+func setMulticastMembership(conn *net.UDPConn, group net.IP, iface *net.Interface, join bool) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	opt := syscall.IP_DROP_MEMBERSHIP
+	if join {
+		opt = syscall.IP_ADD_MEMBERSHIP
+	}
+	mreq := &syscall.IPMreqn{Ifindex: int32(iface.Index)}
+	copy(mreq.Multiaddr[:], group.To4())
+	return setsockopt(raw, func(fd int) error {
+		return syscall.SetsockoptIPMreqn(fd, syscall.IPPROTO_IP, opt, mreq)
+	})
+}
+
+// setsockopt calls f on the file descriptor of raw
+func setsockopt(raw syscall.RawConn, f func(fd int) error) error {
+	var err error
+	if controlErr := raw.Control(func(fd uintptr) { err = f(int(fd)) }); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+// relay resends the traffic received on conn from each side of the gateway to the
+// other side. Traffic from pods (which is only sent to tun0) has a source IP in the
+// local subnet; our own resent traffic is not looped back to us.
+func (mg *multicastGateway) relay(conn *net.UDPConn, group *net.UDPAddr) {
+	buf := make([]byte, 65536)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("multicast gateway for %s stopped: %v", group, err))
+			return
+		}
+
+		out, outName := mg.tunConn, Tun0
+		if mg.localSubnet.Contains(src.IP) {
+			out, outName = mg.hostConn, mg.hostIface.Name
+		} else if mg.isClusterSource(src.IP) {
+			continue
+		}
+		if _, err := out.WriteToUDP(buf[:n], group); err != nil {
+			klog.V(5).Infof("Could not relay multicast packet for %s to %s: %v", group, outName, err)
+		}
+	}
+}
+
+// isClusterSource returns whether ip (the source of traffic arriving on the node's
+// interface) is a node or pod in the cluster, whose traffic to the gateway groups
+// has already reached the local pods via VXLAN
+func (mg *multicastGateway) isClusterSource(ip net.IP) bool {
+	for _, cidr := range mg.clusterNetworks {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	for _, nodeIP := range mg.nodeIPs {
+		if nodeIP == ip.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func (mg *multicastGateway) handleAddOrUpdateHostSubnet(obj, _ interface{}, eventType watch.EventType) {
+	hs := obj.(*osdnv1.HostSubnet)
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	mg.nodeIPs[hs.Name] = hs.HostIP
+}
+
+func (mg *multicastGateway) handleDeleteHostSubnet(obj interface{}) {
+	hs := obj.(*osdnv1.HostSubnet)
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	delete(mg.nodeIPs, hs.Name)
+}
+
+// receiveIGMP processes the IGMP messages that pods send to tun0
+func (mg *multicastGateway) receiveIGMP() {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := syscall.Recvfrom(mg.igmpFD, buf, 0)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			utilruntime.HandleError(fmt.Errorf("multicast gateway IGMP receiver stopped: %v", err))
+			return
+		}
+		src, joins, leaves := parseIGMPReport(buf[:n])
+		if src == nil || !mg.localSubnet.Contains(src) {
+			continue
+		}
+		mg.updateMembers(src.String(), joins, leaves, time.Now())
+	}
+}
+
+// parseIGMPReport parses an IPv4 packet containing an IGMP membership report or
+// leave, returning its source, and the groups it reports joining and leaving
+func parseIGMPReport(packet []byte) (net.IP, []string, []string) {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return nil, nil, nil
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	if ihl < 20 || len(packet) < ihl+8 {
+		return nil, nil, nil
+	}
+	src := net.IP(append([]byte{}, packet[12:16]...))
+	igmp := packet[ihl:]
+
+	var joins, leaves []string
+	switch igmp[0] {
+	case igmpV1MembershipReport, igmpV2MembershipReport:
+		joins = append(joins, net.IP(igmp[4:8]).String())
+	case igmpV2LeaveGroup:
+		leaves = append(leaves, net.IP(igmp[4:8]).String())
+	case igmpV3MembershipReport:
+		records := int(binary.BigEndian.Uint16(igmp[6:8]))
+		offset := 8
+		for i := 0; i < records && len(igmp) >= offset+8; i++ {
+			recordType := igmp[offset]
+			auxLen := int(igmp[offset+1]) * 4
+			sources := int(binary.BigEndian.Uint16(igmp[offset+2 : offset+4]))
+			group := net.IP(igmp[offset+4 : offset+8]).String()
+			switch recordType {
+			case igmpModeIsExclude, igmpChangeToExcludeMode, igmpAllowNewSources:
+				joins = append(joins, group)
+			case igmpModeIsInclude, igmpChangeToIncludeMode:
+				if sources > 0 {
+					joins = append(joins, group)
+				} else {
+					leaves = append(leaves, group)
+				}
+			}
+			offset += 8 + sources*4 + auxLen
+		}
+	default:
+		return nil, nil, nil
+	}
+	return src, joins, leaves
+}
+
+// updateMembers records that pod has joined and left the given groups (ignoring
+// groups that aren't gateway groups) at now, and updates the groups joined on
+// hostIface
+func (mg *multicastGateway) updateMembers(pod string, joins, leaves []string, now time.Time) {
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+
+	for _, group := range joins {
+		if mg.isGroup(group) {
+			if mg.members[group] == nil {
+				mg.members[group] = make(map[string]time.Time)
+			}
+			mg.members[group][pod] = now
+		}
+	}
+	for _, group := range leaves {
+		if members := mg.members[group]; members != nil {
+			delete(members, pod)
+		}
+	}
+	mg.updateJoinedWithLock(now)
+}
+
+func (mg *multicastGateway) isGroup(ip string) bool {
+	for _, group := range mg.groups {
+		if group.IP.String() == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// query expires the memberships of pods that haven't reported them recently, and
+// sends a general query to the pods so they report their memberships again
+func (mg *multicastGateway) query() {
+	mg.lock.Lock()
+	mg.updateJoinedWithLock(time.Now())
+	mg.lock.Unlock()
+
+	query := make([]byte, 12)
+	query[0] = igmpMembershipQuery
+	query[1] = byte(multicastGatewayMaxResponseTime / (100 * time.Millisecond))
+	// QRV = 2, QQIC = query interval in seconds
+	query[8] = 2
+	query[9] = byte(multicastGatewayQueryInterval / time.Second)
+	binary.BigEndian.PutUint16(query[2:4], inetChecksum(query))
+	addr := &syscall.SockaddrInet4{}
+	copy(addr.Addr[:], igmpAllHosts)
+	if err := syscall.Sendto(mg.igmpFD, query, 0, addr); err != nil {
+		klog.V(5).Infof("Could not send multicast gateway IGMP query: %v", err)
+	}
+}
+
+// inetChecksum returns the Internet checksum of data
+func inetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// updateJoinedWithLock expires old memberships and joins or leaves each group on
+// hostIface according to whether any local pod is a member. Must be called with
+// lock held.
+func (mg *multicastGateway) updateJoinedWithLock(now time.Time) {
+	wanted := sets.NewString()
+	for group, members := range mg.members {
+		for pod, lastReport := range members {
+			if now.Sub(lastReport) > multicastGatewayMembershipTimeout {
+				delete(members, pod)
+			}
+		}
+		if len(members) > 0 {
+			wanted.Insert(group)
+		} else {
+			delete(mg.members, group)
+		}
+	}
+	if wanted.Equal(mg.joined) {
+		return
+	}
+
+	for i, conn := range mg.conns {
+		group := mg.groups[i].IP.String()
+		join := wanted.Has(group)
+		if join == mg.joined.Has(group) || mg.hostIface == nil {
+			continue
+		}
+		if err := setMulticastMembership(conn, mg.groups[i].IP, mg.hostIface, join); err != nil {
+			utilruntime.HandleError(fmt.Errorf("could not update membership of multicast gateway group %s on %s: %v", mg.groups[i], mg.hostIface.Name, err))
+		}
+	}
+	klog.V(2).Infof("Multicast gateway groups joined on %s: %v", mg.hostIfaceName(), wanted.List())
+	mg.joined = wanted
+}
+
+func (mg *multicastGateway) hostIfaceName() string {
+	if mg.hostIface == nil {
+		return ""
+	}
+	return mg.hostIface.Name
+}
+
+// updateMulticastGatewayFlowsWithLock updates the flows that deliver multicast
+// gateway traffic (and IGMP queries) to pods, after the pods or multicast-enabled
+// namespaces on the node have changed. Must be called with runningPodsLock held.
+func (m *podManager) updateMulticastGatewayFlowsWithLock() {
+	if m.multicastGateway == nil {
+		return
+	}
+
+	enabled := make(map[uint32]bool)
+	var ofports []int
+	for _, pod := range m.runningPods {
+		if _, checked := enabled[pod.vnid]; !checked {
+			enabled[pod.vnid] = m.policy.GetMulticastEnabled(pod.vnid)
+		}
+		if enabled[pod.vnid] {
+			ofports = append(ofports, pod.ofport)
+		}
+	}
+	ofportSet := sets.NewInt(ofports...)
+	if m.multicastGatewayOfports != nil && m.multicastGatewayOfports.Equal(ofportSet) {
+		return
+	}
+
+	if err := m.ovs.UpdateMulticastGatewayDeliveryFlows(ofports); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Error updating OVS multicast gateway flows: %v", err))
+		return
+	}
+	m.multicastGatewayOfports = ofportSet
+}
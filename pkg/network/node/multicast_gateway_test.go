@@ -0,0 +1,153 @@
+package node
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestParseMulticastGatewayGroups(t *testing.T) {
+	groups, err := parseMulticastGatewayGroups([]string{"239.1.2.3:5000", "239.1.2.3:5001", "239.1.2.3:5000"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(groups) != 2 || groups[0].String() != "239.1.2.3:5000" || groups[1].String() != "239.1.2.3:5001" {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+
+	for _, bad := range []string{"239.1.2.3", "10.0.0.1:5000", "239.1.2.3:0", "239.1.2.3:http", "[ff02::1]:5000"} {
+		if _, err := parseMulticastGatewayGroups([]string{bad}); err == nil {
+			t.Fatalf("unexpectedly parsed %q", bad)
+		}
+	}
+}
+
+func TestOVSMulticastGateway(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+
+	groups := []*net.UDPAddr{{IP: net.ParseIP("239.1.2.3").To4(), Port: 5000}}
+	if err := oc.SetMulticastGatewayGroups(groups); err != nil {
+		t.Fatalf("Unexpected error setting multicast gateway groups: %v", err)
+	}
+	if err := oc.UpdateVXLANMulticastFlows([]string{"192.168.1.2"}); err != nil {
+		t.Fatalf("Unexpected error updating VXLAN multicast flows: %v", err)
+	}
+	if err := oc.UpdateMulticastGatewayDeliveryFlows([]int{5, 4}); err != nil {
+		t.Fatalf("Unexpected error updating multicast gateway flows: %v", err)
+	}
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{kind: flowAdded, match: []string{"table=0", "priority=450", "in_port=2", "nw_dst=239.1.2.3", "udp_dst=5000", "goto_table:120"}},
+		flowChange{kind: flowAdded, match: []string{"table=0", "priority=450", "in_port=2", "nw_proto=2", "nw_dst=224.0.0.1", "goto_table:120"}},
+		flowChange{kind: flowRemoved, match: []string{"table=111", "priority=100", "actions=goto_table:120"}},
+		flowChange{kind: flowAdded, match: []string{"table=111", "priority=100", "192.168.1.2->tun_dst"}},
+		flowChange{kind: flowAdded, match: []string{"table=111", "priority=110", "nw_dst=239.1.2.3", "udp_dst=5000", "actions=output:2,move:", "192.168.1.2->tun_dst"}},
+		flowChange{kind: flowAdded, match: []string{"table=111", "priority=110", "nw_proto=2", "actions=output:2,move:", "192.168.1.2->tun_dst"}},
+		flowChange{kind: flowAdded, match: []string{"table=120", "priority=150", "in_port=2", "nw_dst=239.1.2.3", "udp_dst=5000", "actions=output:4,output:5"}},
+		flowChange{kind: flowAdded, match: []string{"table=120", "priority=150", "in_port=2", "nw_proto=2", "nw_dst=224.0.0.1", "actions=output:4,output:5"}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	// Removing the groups removes all of the gateway flows
+	if err := oc.SetMulticastGatewayGroups(nil); err != nil {
+		t.Fatalf("Unexpected error clearing multicast gateway groups: %v", err)
+	}
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{kind: flowRemoved, match: []string{"table=111", "priority=100", "actions=goto_table:120"}},
+		flowChange{kind: flowAdded, match: []string{"table=111", "priority=100", "192.168.1.2->tun_dst"}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+}
+
+func TestParseIGMPReport(t *testing.T) {
+	ipHeader := []byte{0x45, 0, 0, 0, 0, 0, 0, 0, 1, 2, 0, 0, 10, 128, 0, 5, 224, 0, 0, 22}
+	for _, tc := range []struct {
+		name   string
+		igmp   []byte
+		joins  []string
+		leaves []string
+	}{
+		{
+			name:  "v2 report",
+			igmp:  []byte{igmpV2MembershipReport, 0, 0, 0, 239, 1, 2, 3},
+			joins: []string{"239.1.2.3"},
+		},
+		{
+			name:   "v2 leave",
+			igmp:   []byte{igmpV2LeaveGroup, 0, 0, 0, 239, 1, 2, 3},
+			leaves: []string{"239.1.2.3"},
+		},
+		{
+			name: "v3 report",
+			igmp: []byte{
+				igmpV3MembershipReport, 0, 0, 0, 0, 0, 0, 3,
+				igmpChangeToExcludeMode, 0, 0, 0, 239, 1, 2, 3,
+				igmpModeIsInclude, 0, 0, 1, 239, 1, 2, 4, 10, 0, 0, 1,
+				igmpChangeToIncludeMode, 0, 0, 0, 239, 1, 2, 5,
+			},
+			joins:  []string{"239.1.2.3", "239.1.2.4"},
+			leaves: []string{"239.1.2.5"},
+		},
+	} {
+		src, joins, leaves := parseIGMPReport(append(append([]byte{}, ipHeader...), tc.igmp...))
+		if src.String() != "10.128.0.5" || !reflect.DeepEqual(joins, tc.joins) || !reflect.DeepEqual(leaves, tc.leaves) {
+			t.Errorf("%s: unexpected result %v %v %v", tc.name, src, joins, leaves)
+		}
+	}
+
+	query := append(append([]byte{}, ipHeader...), igmpMembershipQuery, 100, 0, 0, 0, 0, 0, 0)
+	if src, _, _ := parseIGMPReport(query); src != nil {
+		t.Errorf("unexpectedly parsed query")
+	}
+}
+
+func TestMulticastGatewayMembership(t *testing.T) {
+	mg := newMulticastGateway([]*net.UDPAddr{{IP: net.ParseIP("239.1.2.3").To4(), Port: 5000}})
+	now := time.Now()
+
+	mg.updateMembers("10.128.0.5", []string{"239.1.2.3", "239.9.9.9"}, nil, now)
+	mg.updateMembers("10.128.0.6", []string{"239.1.2.3"}, nil, now)
+	if mg.joined.List()[0] != "239.1.2.3" || mg.joined.Len() != 1 {
+		t.Fatalf("unexpected joined groups %v", mg.joined.List())
+	}
+	mg.updateMembers("10.128.0.5", nil, []string{"239.1.2.3"}, now)
+	if !mg.joined.Has("239.1.2.3") {
+		t.Fatalf("group left while it still has members")
+	}
+	mg.updateMembers("10.128.0.7", nil, nil, now.Add(multicastGatewayMembershipTimeout+time.Second))
+	if mg.joined.Len() != 0 {
+		t.Fatalf("expired membership not removed: %v", mg.joined.List())
+	}
+}
+
+func TestMulticastGatewayClusterSource(t *testing.T) {
+	mg := newMulticastGateway(nil)
+	_, cn, _ := net.ParseCIDR("10.128.0.0/14")
+	mg.clusterNetworks = []*net.IPNet{cn}
+	mg.handleAddOrUpdateHostSubnet(&osdnv1.HostSubnet{HostIP: "192.168.1.2"}, nil, watch.Added)
+
+	for ip, expected := range map[string]bool{
+		"10.129.0.5":  true,
+		"192.168.1.2": true,
+		"192.168.1.9": false,
+	} {
+		if mg.isClusterSource(net.ParseIP(ip)) != expected {
+			t.Errorf("expected isClusterSource(%s) to be %v", ip, expected)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package node
+
+import (
+	"net"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+const (
+	// MulticastGrantsAnnotation can be set on the NetNamespace of a namespace to a
+	// comma-separated list of "<namespace>/<group>" entries, where <group> is a
+	// multicast IP address or CIDR. Pods in the annotated namespace will then also
+	// receive multicast traffic sent to <group> by pods in <namespace>. Both
+	// namespaces must have multicast enabled.
+	MulticastGrantsAnnotation = "network.openshift.io/multicast-grants"
+
+	// multicastGrantCookie identifies the table 120 flows that deliver granted
+	// multicast groups to other namespaces
+	multicastGrantCookie = "0x3c"
+)
+
+var multicastCIDR = &net.IPNet{IP: net.IPv4(224, 0, 0, 0).To4(), Mask: net.CIDRMask(4, 32)}
+
+// multicastGrant is a parsed MulticastGrantsAnnotation entry: the receiving
+// namespace (the one with the annotation) accepts traffic to group from namespace
+type multicastGrant struct {
+	namespace string
+	group     *net.IPNet
+}
+
+// multicastGrantTarget is a multicastGrant resolved for a sending VNID: traffic to
+// group should also be delivered to the pods with VNID vnid
+type multicastGrantTarget struct {
+	group *net.IPNet
+	vnid  uint32
+}
+
+func parseMulticastGrants(netns *osdnv1.NetNamespace) []multicastGrant {
+	var grants []multicastGrant
+	for _, entry := range strings.Split(netns.Annotations[MulticastGrantsAnnotation], ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "/", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			klog.Warningf("Ignoring invalid multicast grant %q on NetNamespace %q", entry, netns.NetName)
+			continue
+		}
+		group := parseMulticastGroup(parts[1])
+		if group == nil {
+			klog.Warningf("Ignoring multicast grant %q on NetNamespace %q: %q is not a multicast address or CIDR", entry, netns.NetName, parts[1])
+			continue
+		}
+		if parts[0] != netns.NetName {
+			grants = append(grants, multicastGrant{namespace: parts[0], group: group})
+		}
+	}
+	return grants
+}
+
+// parseMulticastGroup parses an IPv4 multicast address or CIDR, returning nil if it
+// is invalid
+func parseMulticastGroup(group string) *net.IPNet {
+	var cidr *net.IPNet
+	if strings.Contains(group, "/") {
+		_, parsed, err := net.ParseCIDR(group)
+		if err != nil {
+			return nil
+		}
+		cidr = parsed
+	} else if ip := net.ParseIP(group); ip != nil {
+		cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	} else {
+		return nil
+	}
+	if cidr.IP.To4() == nil || !multicastCIDR.Contains(cidr.IP) {
+		return nil
+	}
+	if ones, _ := cidr.Mask.Size(); ones < 4 {
+		return nil
+	}
+	cidr.IP = cidr.IP.To4()
+	return cidr
+}
+
+// GetMulticastGrants returns the namespaces that multicast traffic from vnid should
+// also be delivered to, and the groups they have been granted
+func (vmap *nodeVNIDMap) GetMulticastGrants(vnid uint32) []multicastGrantTarget {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+
+	if !vmap.getMulticastEnabledLocked(vnid) {
+		return nil
+	}
+	var targets []multicastGrantTarget
+	for receiver, grants := range vmap.mcGrants {
+		receiverVNID, exists := vmap.ids[receiver]
+		if !exists || receiverVNID == vnid || !vmap.getMulticastEnabledLocked(receiverVNID) {
+			continue
+		}
+		for _, grant := range grants {
+			if senderVNID, exists := vmap.ids[grant.namespace]; exists && senderVNID == vnid {
+				targets = append(targets, multicastGrantTarget{group: grant.group, vnid: receiverVNID})
+			}
+		}
+	}
+	return targets
+}
+
+// GetMulticastGrantSenders returns the VNIDs whose multicast traffic is granted to
+// some namespace with VNID vnid
+func (vmap *nodeVNIDMap) GetMulticastGrantSenders(vnid uint32) []uint32 {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+
+	senders := sets.NewInt()
+	for receiver, grants := range vmap.mcGrants {
+		if receiverVNID, exists := vmap.ids[receiver]; !exists || receiverVNID != vnid {
+			continue
+		}
+		for _, grant := range grants {
+			if senderVNID, exists := vmap.ids[grant.namespace]; exists && senderVNID != vnid {
+				senders.Insert(int(senderVNID))
+			}
+		}
+	}
+
+	var vnids []uint32
+	for _, sender := range senders.List() {
+		vnids = append(vnids, uint32(sender))
+	}
+	return vnids
+}
+
+// compileMulticastGrantFlows returns, for each group in targets, the ofports (from
+// ofportsForVNID) that traffic to that group should be delivered to in addition to
+// the sending namespace's own pods. Since a more-specific group's flow overrides a
+// less-specific one, each group also includes the receivers of every group that
+// contains it.
+func compileMulticastGrantFlows(targets []multicastGrantTarget, ofportsForVNID func(uint32) []int) map[string][]int {
+	flows := make(map[string][]int)
+	for _, target := range targets {
+		group := target.group.String()
+		if _, done := flows[group]; done {
+			continue
+		}
+		groupOnes, _ := target.group.Mask.Size()
+
+		ofports := sets.NewInt()
+		for _, other := range targets {
+			otherOnes, _ := other.group.Mask.Size()
+			if otherOnes <= groupOnes && other.group.Contains(target.group.IP) {
+				ofports.Insert(ofportsForVNID(other.vnid)...)
+			}
+		}
+		flows[group] = ofports.List()
+	}
+	for group, ofports := range flows {
+		if len(ofports) == 0 {
+			delete(flows, group)
+		}
+	}
+	return flows
+}
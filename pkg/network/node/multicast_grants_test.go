@@ -0,0 +1,126 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+func TestParseMulticastGrants(t *testing.T) {
+	netns := &osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "cache-b",
+			Annotations: map[string]string{
+				MulticastGrantsAnnotation: "cache-a/239.1.2.3, cache-c/239.2.0.0/16,cache-b/239.1.2.3,bad,cache-d/10.0.0.1,cache-e/239.0.0.0/2,/239.1.1.1",
+			},
+		},
+		NetName: "cache-b",
+	}
+
+	var parsed []string
+	for _, grant := range parseMulticastGrants(netns) {
+		parsed = append(parsed, grant.namespace+"/"+grant.group.String())
+	}
+	expected := []string{"cache-a/239.1.2.3/32", "cache-c/239.2.0.0/16"}
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Fatalf("expected %v, got %v", expected, parsed)
+	}
+}
+
+func TestMulticastGrants(t *testing.T) {
+	vmap := newNodeVNIDMap(NewNetworkPolicyPlugin(), nil)
+	vmap.setVNID("sender", 1, true)
+	vmap.setVNID("receiver", 2, true)
+	vmap.setVNID("disabled", 3, false)
+	vmap.setVNID("other", 4, true)
+
+	vmap.setMulticastGrants("receiver", []multicastGrant{
+		{namespace: "sender", group: parseMulticastGroup("239.1.0.0/16")},
+		{namespace: "other", group: parseMulticastGroup("239.4.4.4")},
+	})
+	vmap.setMulticastGrants("disabled", []multicastGrant{
+		{namespace: "sender", group: parseMulticastGroup("239.1.1.1")},
+	})
+	vmap.setMulticastGrants("other", []multicastGrant{
+		{namespace: "sender", group: parseMulticastGroup("239.1.1.1")},
+	})
+
+	targets := vmap.GetMulticastGrants(1)
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 targets for VNID 1, got %#v", targets)
+	}
+	if senders := vmap.GetMulticastGrantSenders(2); !reflect.DeepEqual(senders, []uint32{1, 4}) {
+		t.Fatalf("unexpected senders for VNID 2: %v", senders)
+	}
+	if targets := vmap.GetMulticastGrants(3); len(targets) != 0 {
+		t.Fatalf("unexpected targets for disabled VNID 3: %#v", targets)
+	}
+
+	ofports := map[uint32][]int{1: {3}, 2: {5, 6}, 4: {7}}
+	flows := compileMulticastGrantFlows(targets, func(vnid uint32) []int { return ofports[vnid] })
+	expected := map[string][]int{
+		"239.1.0.0/16": {5, 6},
+		// "239.1.1.1" is inside "239.1.0.0/16", so it gets both namespaces' pods
+		"239.1.1.1/32": {5, 6, 7},
+	}
+	if !reflect.DeepEqual(flows, expected) {
+		t.Fatalf("expected %v, got %v", expected, flows)
+	}
+
+	// Groups whose receivers have no pods on this node need no flows
+	delete(ofports, 2)
+	flows = compileMulticastGrantFlows(targets, func(vnid uint32) []int { return ofports[vnid] })
+	expected = map[string][]int{
+		"239.1.1.1/32": {7},
+	}
+	if !reflect.DeepEqual(flows, expected) {
+		t.Fatalf("expected %v, got %v", expected, flows)
+	}
+}
+
+func TestOVSMulticastGrants(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+
+	if err := oc.UpdateLocalMulticastFlows(99, true, []int{4}); err != nil {
+		t.Fatalf("Unexpected error adding multicast flows: %v", err)
+	}
+	err := oc.UpdateMulticastGrantFlows(99, []int{4}, map[string][]int{
+		"239.1.0.0/16": {5, 6},
+		"239.1.1.1/32": {5, 6, 7},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error adding multicast grant flows: %v", err)
+	}
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{kind: flowAdded, match: []string{"table=110", "reg0=99", "goto_table:111"}},
+		flowChange{kind: flowAdded, match: []string{"table=120", "priority=100", "reg0=99", "actions=output:4"}},
+		flowChange{kind: flowAdded, match: []string{"table=120", "priority=117", "reg0=99", "nw_dst=239.1.0.0/16", "actions=output:4,output:5,output:6"}},
+		flowChange{kind: flowAdded, match: []string{"table=120", "priority=133", "reg0=99", "nw_dst=239.1.1.1/32", "actions=output:4,output:5,output:6,output:7"}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	// Removing the grants leaves only the namespace's own flows
+	if err := oc.UpdateMulticastGrantFlows(99, []int{4}, nil); err != nil {
+		t.Fatalf("Unexpected error removing multicast grant flows: %v", err)
+	}
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{kind: flowAdded, match: []string{"table=110", "reg0=99", "goto_table:111"}},
+		flowChange{kind: flowAdded, match: []string{"table=120", "priority=100", "reg0=99", "actions=output:4"}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+}
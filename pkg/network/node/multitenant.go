@@ -25,10 +25,14 @@ type multiTenantPlugin struct {
 
 	vnidInUseLock sync.Mutex
 	vnidInUse     sets.Int
+
+	sharedServices *sharedServices
 }
 
 func NewMultiTenantPlugin() osdnPolicy {
-	return &multiTenantPlugin{}
+	return &multiTenantPlugin{
+		sharedServices: newSharedServices(),
+	}
 }
 
 func (mp *multiTenantPlugin) Name() string {
@@ -53,6 +57,8 @@ func (mp *multiTenantPlugin) Start(node *OsdnNode) error {
 	}
 
 	otx := node.oc.NewTransaction()
+	// Shared-services flows will be recreated as the NetNamespaces are processed
+	otx.DeleteFlows("table=80, cookie=%s/%s", sharedServicesCookie, flowKindMask)
 	otx.AddFlow("table=80, priority=200, reg0=0, actions=output:NXM_NX_REG2[]")
 	otx.AddFlow("table=80, priority=200, reg1=0, actions=output:NXM_NX_REG2[]")
 	if err := otx.Commit(); err != nil {
@@ -96,7 +102,9 @@ func (mp *multiTenantPlugin) updatePodNetwork(namespace string, oldNetID, netID
 			mp.node.AddServiceRules(&svc, netID)
 		}
 
-		mp.EnsureVNIDRules(netID)
+		if len(pods) > 0 {
+			mp.EnsureVNIDRules(netID)
+		}
 
 		// Update namespace references in egress firewall rules
 		mp.node.UpdateEgressNetworkPolicyVNID(namespace, oldNetID, netID)
@@ -109,14 +117,17 @@ func (mp *multiTenantPlugin) updatePodNetwork(namespace string, oldNetID, netID
 
 func (mp *multiTenantPlugin) AddNetNamespace(netns *osdnv1.NetNamespace) {
 	mp.updatePodNetwork(netns.Name, 0, netns.NetID)
+	mp.updateSharedServices(netns, false)
 }
 
 func (mp *multiTenantPlugin) UpdateNetNamespace(netns *osdnv1.NetNamespace, oldNetID uint32) {
 	mp.updatePodNetwork(netns.Name, oldNetID, netns.NetID)
+	mp.updateSharedServices(netns, false)
 }
 
 func (mp *multiTenantPlugin) DeleteNetNamespace(netns *osdnv1.NetNamespace) {
 	mp.updatePodNetwork(netns.Name, netns.NetID, 0)
+	mp.updateSharedServices(netns, true)
 }
 
 func (mp *multiTenantPlugin) GetVNID(namespace string) (uint32, error) {
@@ -131,6 +142,18 @@ func (mp *multiTenantPlugin) GetMulticastEnabled(vnid uint32) bool {
 	return mp.vnids.GetMulticastEnabled(vnid)
 }
 
+func (mp *multiTenantPlugin) GetMulticastGrants(vnid uint32) []multicastGrantTarget {
+	return mp.vnids.GetMulticastGrants(vnid)
+}
+
+func (mp *multiTenantPlugin) GetMulticastGrantSenders(vnid uint32) []uint32 {
+	return mp.vnids.GetMulticastGrantSenders(vnid)
+}
+
+func (mp *multiTenantPlugin) GetSharedServiceVNIDs(vnid uint32) []uint32 {
+	return mp.sharedServices.peers(vnid)
+}
+
 func (mp *multiTenantPlugin) EnsureVNIDRules(vnid uint32) {
 	if vnid == 0 {
 		return
@@ -146,12 +169,25 @@ func (mp *multiTenantPlugin) EnsureVNIDRules(vnid uint32) {
 	klog.V(5).Infof("EnsureVNIDRules %d - adding rules", vnid)
 
 	otx := mp.node.oc.NewTransaction()
-	otx.AddFlow("table=80, priority=100, reg0=%d, reg1=%d, actions=output:NXM_NX_REG2[]", vnid, vnid)
+	otx.AddFlow("table=80, priority=100, cookie=%s, reg0=%d, reg1=%d, actions=output:NXM_NX_REG2[]", policyFlowOwner(vnid).cookie("0"), vnid, vnid)
 	if err := otx.Commit(); err != nil {
 		utilruntime.HandleError(fmt.Errorf("Error adding OVS flow for VNID: %v", err))
 	}
 }
 
+func (mp *multiTenantPlugin) ResyncVNIDRules() {
+	mp.vnidInUseLock.Lock()
+	defer mp.vnidInUseLock.Unlock()
+
+	otx := mp.node.oc.NewTransaction()
+	for _, vnid := range mp.vnidInUse.List() {
+		otx.AddFlow("table=80, priority=100, cookie=%s, reg0=%d, reg1=%d, actions=output:NXM_NX_REG2[]", policyFlowOwner(uint32(vnid)).cookie("0"), vnid, vnid)
+	}
+	if err := otx.Commit(); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Error resyncing OVS VNID rules: %v", err))
+	}
+}
+
 func (mp *multiTenantPlugin) SyncVNIDRules() {
 	mp.vnidInUseLock.Lock()
 	defer mp.vnidInUseLock.Unlock()
@@ -162,7 +198,9 @@ func (mp *multiTenantPlugin) SyncVNIDRules() {
 	otx := mp.node.oc.NewTransaction()
 	for _, vnid := range unused {
 		mp.vnidInUse.Delete(int(vnid))
-		otx.DeleteFlows("table=80, reg1=%d", vnid)
+		// (This doesn't delete any shared-services flows that match reg1=vnid,
+		// since those have their own owners and are managed separately.)
+		otx.DeleteFlows("table=80, %s", policyFlowOwner(uint32(vnid)).match())
 	}
 	if err := otx.Commit(); err != nil {
 		utilruntime.HandleError(fmt.Errorf("Error deleting syncing OVS VNID rules: %v", err))
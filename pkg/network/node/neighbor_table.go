@@ -0,0 +1,130 @@
+package node
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/kubernetes/pkg/util/sysctl"
+
+	"github.com/openshift/sdn/pkg/network/node/metrics"
+)
+
+const (
+	// neighborTablePressure is the fraction of gc_thresh2 at which the neighbor table
+	// is considered nearly full. (gc_thresh2 is the level at which the kernel starts
+	// aggressively garbage collecting entries that are still in use.)
+	neighborTablePressure = 0.8
+)
+
+var neighborFamilies = map[string]int{
+	"ipv4": netlink.FAMILY_V4,
+	"ipv6": netlink.FAMILY_V6,
+}
+
+// neighborGCThresholds are a family's gc_thresh1, gc_thresh2, and gc_thresh3 values
+type neighborGCThresholds [3]int
+
+func neighborGCThresholdSysctl(family string, i int) string {
+	return fmt.Sprintf("net/%s/neigh/default/gc_thresh%d", family, i+1)
+}
+
+func readNeighborGCThresholds(sc sysctl.Interface, family string) (neighborGCThresholds, error) {
+	var thresholds neighborGCThresholds
+	for i := range thresholds {
+		val, err := sc.GetSysctl(neighborGCThresholdSysctl(family, i))
+		if err != nil {
+			return thresholds, err
+		}
+		thresholds[i] = val
+	}
+	return thresholds, nil
+}
+
+// raisedNeighborGCThresholds returns the thresholds to use if a table with the given
+// thresholds has used entries, or false if they should not be changed. When the
+// table is nearly full the thresholds are doubled, keeping their ratios, with
+// gc_thresh3 capped at max.
+func raisedNeighborGCThresholds(thresholds neighborGCThresholds, used, max int) (neighborGCThresholds, bool) {
+	if thresholds[2] <= 0 || float64(used) < neighborTablePressure*float64(thresholds[1]) {
+		return thresholds, false
+	}
+	newMax := 2 * thresholds[2]
+	if newMax > max {
+		newMax = max
+	}
+	if newMax <= thresholds[2] {
+		return thresholds, false
+	}
+
+	var raised neighborGCThresholds
+	for i := range thresholds {
+		raised[i] = thresholds[i] * newMax / thresholds[2]
+	}
+	return raised, true
+}
+
+// updateNeighborTableStats updates the ARP and NDP cache metrics, and if
+// node.neighborGCThreshMax is set, raises the garbage collection thresholds of
+// tables that are nearly full.
+func (node *OsdnNode) updateNeighborTableStats() {
+	sc := sysctl.New()
+	for family, nlFamily := range neighborFamilies {
+		thresholds, err := readNeighborGCThresholds(sc, family)
+		if err != nil {
+			// gc_thresh* may not exist in some cases (eg, IPv6 disabled)
+			klog.V(5).Infof("Could not read %s neighbor table thresholds: %v", family, err)
+			continue
+		}
+		neighbors, err := netlink.NeighList(0, nlFamily)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("failed to list %s neighbors for metrics: %v", family, err))
+			continue
+		}
+		used := len(neighbors)
+
+		if node.neighborGCThreshMax > 0 {
+			if raised, ok := raisedNeighborGCThresholds(thresholds, used, node.neighborGCThreshMax); ok {
+				if err := writeNeighborGCThresholds(sc, family, thresholds, raised); err != nil {
+					utilruntime.HandleError(fmt.Errorf("failed to raise %s neighbor table thresholds: %v", family, err))
+				} else {
+					klog.Infof("%s neighbor table has %d entries; raised gc_thresh1-3 from %v to %v", family, used, thresholds, raised)
+					metrics.NeighborTableGCRaises.WithLabelValues(family).Inc()
+					thresholds = raised
+				}
+			}
+		}
+
+		// gc_thresh2 isn't the absolute max, but it's the level at which
+		// garbage collection (and thus problems) could start.
+		available := thresholds[1] - used
+		if available < 0 {
+			available = 0
+		}
+		if family == "ipv4" {
+			metrics.ARPCacheAvailableEntries.Set(float64(available))
+		} else {
+			metrics.NDPCacheAvailableEntries.Set(float64(available))
+		}
+		for i, val := range thresholds {
+			metrics.NeighborTableGCThreshold.WithLabelValues(family, fmt.Sprintf("gc_thresh%d", i+1)).Set(float64(val))
+		}
+	}
+}
+
+// writeNeighborGCThresholds changes a family's thresholds from old to new. Since
+// they are being raised, they are written from gc_thresh3 down, so that they are
+// never out of order.
+func writeNeighborGCThresholds(sc sysctl.Interface, family string, old, new neighborGCThresholds) error {
+	for i := len(new) - 1; i >= 0; i-- {
+		if new[i] == old[i] {
+			continue
+		}
+		if err := sc.SetSysctl(neighborGCThresholdSysctl(family, i), new[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package node
+
+import (
+	"testing"
+)
+
+func TestRaisedNeighborGCThresholds(t *testing.T) {
+	defaults := neighborGCThresholds{128, 512, 1024}
+	tests := []struct {
+		name   string
+		used   int
+		max    int
+		raised *neighborGCThresholds
+	}{
+		{
+			name: "not full",
+			used: 100,
+			max:  8192,
+		},
+		{
+			name:   "nearly full",
+			used:   450,
+			max:    8192,
+			raised: &neighborGCThresholds{256, 1024, 2048},
+		},
+		{
+			name:   "capped",
+			used:   450,
+			max:    1536,
+			raised: &neighborGCThresholds{192, 768, 1536},
+		},
+		{
+			name: "at max",
+			used: 1000,
+			max:  1024,
+		},
+	}
+
+	for _, test := range tests {
+		raised, ok := raisedNeighborGCThresholds(defaults, test.used, test.max)
+		if test.raised == nil {
+			if ok {
+				t.Errorf("%s: unexpectedly raised thresholds to %v", test.name, raised)
+			}
+		} else if !ok || raised != *test.raised {
+			t.Errorf("%s: expected %v, got %v (%v)", test.name, *test.raised, raised, ok)
+		}
+	}
+}
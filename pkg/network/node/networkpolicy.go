@@ -3,6 +3,7 @@ package node
 import (
 	"context"
 	"fmt"
+	"net"
 	"reflect"
 	"sort"
 	"strings"
@@ -19,22 +20,44 @@ import (
 	"k8s.io/apimachinery/pkg/util/sets"
 	utilwait "k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/util/async"
+	utilnet "k8s.io/utils/net"
 
 	osdnv1 "github.com/openshift/api/network/v1"
 	"github.com/openshift/library-go/pkg/network/networkutils"
 	"github.com/openshift/sdn/pkg/network/common"
+	metrics "github.com/openshift/sdn/pkg/network/node/metrics"
 	"github.com/openshift/sdn/pkg/util/ovs"
 )
 
 const HostNetworkNamespace = "openshift-host-network"
 
+const (
+	// policyAllowedCTLabel is the ct_label (value/mask) committed in table 81 on
+	// connections that NetworkPolicy has allowed. Established and related packets
+	// on those connections are accepted in table 80 without being evaluated
+	// against policy again. (As with the "+rpl" rule, this means that a
+	// NetworkPolicy change does not affect connections that are already
+	// established.) We use a label rather than ct_mark because ct_mark is shared
+	// with the host's iptables CONNMARK rules.
+	policyAllowedCTLabel = "0x1/0x1"
+
+	// policyAllowAction is the table 80 action for traffic allowed by NetworkPolicy;
+	// table 81 commits the connection with policyAllowedCTLabel and delivers it.
+	policyAllowAction = "goto_table:81"
+)
+
 type networkPolicyPlugin struct {
 	node   *OsdnNode
 	vnids  *nodeVNIDMap
 	runner *async.BoundedFrequencyRunner
 
+	// dualStack is set if pods have IPv6 addresses as well (see
+	// ovsController.dualStack)
+	dualStack bool
+
 	lock sync.Mutex
 	// namespacesByName includes every Namespace, including ones that we haven't seen
 	// a NetNamespace for, and is only used in the informer-related methods.
@@ -44,6 +67,17 @@ type networkPolicyPlugin struct {
 	namespaces map[uint32]*npNamespace
 	// nsMatchCache caches matches for namespaceSelectors; see selectNamespacesInternal
 	nsMatchCache map[string]*npCacheEntry
+	// podSelectors is the shared index of pod selectors; see npPodSelectorEntry
+	podSelectors map[string]*npPodSelectorEntry
+	// namespaceSelectors indexes the policies using each namespace selector; see
+	// npNamespaceSelectorEntry
+	namespaceSelectors map[string]*npNamespaceSelectorEntry
+
+	// denyLogger is started the first time a namespace enables deny logging
+	denyLogger *policyDenyLogger
+
+	// adminPolicies is only set if AdminNetworkPolicy support is enabled
+	adminPolicies *npAdminPolicies
 }
 
 // npNamespace tracks NetworkPolicy-related data for a Namespace
@@ -60,6 +94,9 @@ type npNamespace struct {
 	labels   map[string]string
 	policies map[ktypes.UID]*npPolicy
 
+	// denyLogging is true if traffic dropped by policy should be logged
+	denyLogging bool
+
 	gotNamespace    bool
 	gotNetNamespace bool
 }
@@ -68,12 +105,20 @@ type npNamespace struct {
 type npPolicy struct {
 	policy            networkingv1.NetworkPolicy
 	watchesNamespaces bool
-	watchesAllPods    bool
-	watchesOwnPods    bool
+	// watchesAllPods and watchesOwnPods describe which pods the policy depends on;
+	// pod changes are actually tracked via the podSelectors entries in podSelectorKeys
+	watchesAllPods  bool
+	watchesOwnPods  bool
+	podSelectorKeys sets.String
+	// namespaceSelectorKeys is the namespaceSelectors entries the policy uses
+	namespaceSelectorKeys sets.String
 
 	flows         []string
 	selectedIPs   []string
 	selectsAllIPs bool
+
+	// compileErrors describes any parts of the policy that could not be converted to flows
+	compileErrors []string
 }
 
 // npCacheEntry caches information about matches for a LabelSelector
@@ -87,7 +132,9 @@ func NewNetworkPolicyPlugin() osdnPolicy {
 		namespaces:       make(map[uint32]*npNamespace),
 		namespacesByName: make(map[string]*npNamespace),
 
-		nsMatchCache: make(map[string]*npCacheEntry),
+		nsMatchCache:       make(map[string]*npCacheEntry),
+		podSelectors:       make(map[string]*npPodSelectorEntry),
+		namespaceSelectors: make(map[string]*npNamespaceSelectorEntry),
 	}
 }
 
@@ -108,6 +155,7 @@ func (np *networkPolicyPlugin) Start(node *OsdnNode) error {
 	defer np.lock.Unlock()
 
 	np.node = node
+	np.dualStack = node.oc.dualStack
 	np.vnids = newNodeVNIDMap(np, node.osdnClient)
 	if err := np.vnids.Start(node.osdnInformers); err != nil {
 		return err
@@ -118,9 +166,24 @@ func (np *networkPolicyPlugin) Start(node *OsdnNode) error {
 		// Must pass packets through CT NAT to ensure NAT state is handled
 		// correctly by OVS when NAT-ed packets have tuple collisions.
 		// https://bugzilla.redhat.com/show_bug.cgi?id=1910378
-		otx.AddFlow("table=21, priority=200, ip, nw_dst=%s, ct_state=-rpl, actions=ct(commit,nat(src=0.0.0.0),table=30)", cn.ClusterCIDR.String())
+		otx.AddFlow("table=21, priority=200, %s, ct_state=-rpl, actions=ct(commit,nat(src=0.0.0.0),table=22)", ipMatch("dst", cn.ClusterCIDR.String()))
+	}
+	families := []string{"ip"}
+	if np.dualStack {
+		for _, cn := range np.node.networkInfo.IPv6ClusterNetworks {
+			otx.AddFlow("table=21, priority=200, %s, ct_state=-rpl, actions=ct(commit,nat(src=0.0.0.0),table=22)", ipMatch("dst", cn.ClusterCIDR.String()))
+		}
+		families = append(families, "ipv6")
+	}
+	for _, family := range families {
+		// Replies on connections from local pods (which table 21 committed) and
+		// packets on connections that were already allowed skip the per-namespace
+		// rules
+		otx.AddFlow("table=80, priority=200, %s, ct_state=+rpl, actions=output:NXM_NX_REG2[]", family)
+		otx.AddFlow("table=80, priority=200, %s, ct_state=+est+trk, ct_label=%s, actions=output:NXM_NX_REG2[]", family, policyAllowedCTLabel)
+		otx.AddFlow("table=80, priority=200, %s, ct_state=+rel+trk, ct_label=%s, actions=output:NXM_NX_REG2[]", family, policyAllowedCTLabel)
+		otx.AddFlow("table=81, priority=100, %s, actions=ct(commit,exec(set_field:%s->ct_label)),output:NXM_NX_REG2[]", family, policyAllowedCTLabel)
 	}
-	otx.AddFlow("table=80, priority=200, ip, ct_state=+rpl, actions=output:NXM_NX_REG2[]")
 	if err := otx.Commit(); err != nil {
 		return err
 	}
@@ -131,6 +194,15 @@ func (np *networkPolicyPlugin) Start(node *OsdnNode) error {
 	np.runner = async.NewBoundedFrequencyRunner("NetworkPolicy", np.syncFlows, time.Second, time.Hour, 2)
 	go np.runner.Loop(utilwait.NeverStop)
 
+	if node.adminPolicyClient != nil {
+		if err := np.startAdminPolicies(node.adminPolicyClient); err != nil {
+			return err
+		}
+	}
+
+	if node.connectionLogger != nil {
+		np.startDenyLoggerLocked()
+	}
 	if err := np.initNamespaces(); err != nil {
 		return err
 	}
@@ -141,6 +213,59 @@ func (np *networkPolicyPlugin) Start(node *OsdnNode) error {
 	return nil
 }
 
+// updateClusterNetworkFlows updates the per-clusterNetwork flows created by Start()
+// after clusterNetworks entries are added or removed
+func (np *networkPolicyPlugin) updateClusterNetworkFlows(added, removed []string) error {
+	otx := np.node.oc.NewTransaction()
+	for _, cidr := range added {
+		otx.AddFlow("table=21, priority=200, %s, ct_state=-rpl, actions=ct(commit,nat(src=0.0.0.0),table=22)", ipMatch("dst", cidr))
+	}
+	for _, cidr := range removed {
+		otx.DeleteFlows("table=21, %s", ipMatch("dst", cidr))
+	}
+	return otx.Commit()
+}
+
+// ipMatch returns the OVS match for the source or destination (according to dir,
+// "src" or "dst") address or CIDR ip, in ip's family
+func ipMatch(dir, ip string) string {
+	if utilnet.IsIPv6String(ip) || utilnet.IsIPv6CIDRString(ip) {
+		return fmt.Sprintf("ipv6, ipv6_%s=%s", dir, ip)
+	}
+	return fmt.Sprintf("ip, nw_%s=%s", dir, ip)
+}
+
+// combinePolicyMatches combines destination, peer, and port matches (as generated by
+// parseNetworkPolicy, with port matches using the IPv4 protocol names) into the
+// matches for a policy flow. It returns nothing if dest and peer match addresses of
+// different families, and uses the IPv6 protocol names if they match IPv6 addresses.
+// In a dual-stack cluster, a port match with no address match is returned for both
+// families.
+func combinePolicyMatches(dualStack bool, dest, peer, port string) []string {
+	ipv4 := strings.Contains(dest, "nw_") || strings.Contains(peer, "nw_")
+	ipv6 := strings.Contains(dest, "ipv6_") || strings.Contains(peer, "ipv6_")
+	switch {
+	case ipv4 && ipv6:
+		return nil
+	case ipv6:
+		return []string{dest + peer + ipv6PortMatch(port)}
+	case !ipv4 && port != "" && dualStack:
+		return []string{dest + peer + port, dest + peer + ipv6PortMatch(port)}
+	default:
+		return []string{dest + peer + port}
+	}
+}
+
+// ipv6PortMatch converts a port match (eg "tcp, tp_dst=80, ") to IPv6
+func ipv6PortMatch(port string) string {
+	for _, protocol := range []string{"tcp", "udp", "sctp"} {
+		if strings.HasPrefix(port, protocol+",") {
+			return protocol + "6" + port[len(protocol):]
+		}
+	}
+	return port
+}
+
 func (np *networkPolicyPlugin) initNamespaces() error {
 	inUseVNIDs := np.node.oc.FindPolicyVNIDs()
 
@@ -204,7 +329,8 @@ func (np *networkPolicyPlugin) AddNetNamespace(netns *osdnv1.NetNamespace) {
 	npns.gotNetNamespace = true
 	if npns.gotNamespace {
 		np.updateMatchCache(npns)
-		np.refreshNamespaceNetworkPolicies()
+		// (Even if it was already selectable, its VNID may have changed.)
+		np.refreshNamespaceNetworkPolicies(nil, npns.selectableLabels())
 	}
 }
 
@@ -230,13 +356,12 @@ func (np *networkPolicyPlugin) DeleteNetNamespace(netns *osdnv1.NetNamespace) {
 		// This needs to happen before we forget about the namespace.
 		np.syncNamespaceImmediately(npns)
 	}
+	oldLabels := npns.selectableLabels()
 	delete(np.namespaces, netns.NetID)
 	npns.gotNetNamespace = false
 
-	// We don't need to call refreshNetworkPolicies here; if the VNID doesn't get
-	// reused then the stale flows won't hurt anything, and if it does get reused then
-	// things will be cleaned up then. However, we do have to clean up the cache.
 	np.updateMatchCache(npns)
+	np.refreshNamespaceNetworkPolicies(oldLabels, nil)
 }
 
 func (np *networkPolicyPlugin) GetVNID(namespace string) (uint32, error) {
@@ -251,6 +376,18 @@ func (np *networkPolicyPlugin) GetMulticastEnabled(vnid uint32) bool {
 	return np.vnids.GetMulticastEnabled(vnid)
 }
 
+func (np *networkPolicyPlugin) GetMulticastGrants(vnid uint32) []multicastGrantTarget {
+	return np.vnids.GetMulticastGrants(vnid)
+}
+
+func (np *networkPolicyPlugin) GetMulticastGrantSenders(vnid uint32) []uint32 {
+	return np.vnids.GetMulticastGrantSenders(vnid)
+}
+
+func (np *networkPolicyPlugin) GetSharedServiceVNIDs(vnid uint32) []uint32 {
+	return nil
+}
+
 func (np *networkPolicyPlugin) syncNamespace(npns *npNamespace) {
 	if !npns.mustSync {
 		npns.mustSync = true
@@ -271,18 +408,48 @@ func (np *networkPolicyPlugin) syncFlows() {
 	np.lock.Lock()
 	defer np.lock.Unlock()
 
+	start := time.Now()
+	defer func() {
+		metrics.NetworkPolicySyncDuration.Observe(time.Since(start).Seconds())
+	}()
+
 	np.recalculate()
 
 	// Push internal data to OVS (for namespaces that have changed)
 	otx := np.node.oc.NewTransaction()
+	var synced []*npNamespace
 	for _, npns := range np.namespaces {
 		if npns.mustSync {
 			np.generateNamespaceFlows(otx, npns)
 			npns.mustSync = false
+			if npns.inUse {
+				synced = append(synced, npns)
+			}
 		}
 	}
+	if np.adminPolicies != nil && np.adminPolicies.mustSync {
+		np.generateAdminPolicyFlows(otx)
+		np.adminPolicies.mustSync = false
+	}
 	if err := otx.Commit(); err != nil {
 		utilruntime.HandleError(fmt.Errorf("Error syncing OVS flows: %v", err))
+		for _, npns := range synced {
+			for _, npp := range npns.policies {
+				np.node.recorder.Eventf(policyRef(&npp.policy), corev1.EventTypeWarning, "NetworkPolicyProgrammingFailed",
+					"Failed to program NetworkPolicy on node %s: %v", np.node.hostName, err)
+			}
+		}
+		return
+	}
+}
+
+func policyRef(policy *networkingv1.NetworkPolicy) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		Kind:       "NetworkPolicy",
+		APIVersion: "networking.k8s.io/v1",
+		Namespace:  policy.Namespace,
+		Name:       policy.Name,
+		UID:        policy.UID,
 	}
 }
 
@@ -302,14 +469,23 @@ func (np *networkPolicyPlugin) recalculate() {
 
 func (np *networkPolicyPlugin) generateNamespaceFlows(otx ovs.Transaction, npns *npNamespace) {
 	klog.V(5).Infof("syncNamespace %d", npns.vnid)
-	otx.DeleteFlows("table=80, reg1=%d", npns.vnid)
+	owner := policyFlowOwner(npns.vnid)
+	cookie := owner.cookie("0")
+	otx.DeleteFlows("table=80, %s", owner.match())
 	if npns.inUse {
 		allPodsSelected := false
+		// Deny logging only works if the deny logger (and its meter) was set up. The
+		// connection log records the denied traffic of all namespaces.
+		denyLogging := (npns.denyLogging || np.node.connectionLogger != nil) && np.denyLogger != nil
+		dropAction := "drop"
+		if denyLogging {
+			dropAction = denyLogAction
+		}
 
 		// Add "allow" rules for all traffic allowed by a NetworkPolicy
 		for _, npp := range npns.policies {
 			for _, flow := range npp.flows {
-				otx.AddFlow("table=80, priority=150, reg1=%d, %s actions=output:NXM_NX_REG2[]", npns.vnid, flow)
+				otx.AddFlow("table=80, priority=150, cookie=%s, reg1=%d, %s actions=%s", cookie, npns.vnid, flow, policyAllowAction)
 			}
 			if npp.selectsAllIPs {
 				allPodsSelected = true
@@ -320,7 +496,10 @@ func (np *networkPolicyPlugin) generateNamespaceFlows(otx ovs.Transaction, npns
 			// Some policy selects all pods, so all pods are "isolated" and no
 			// traffic is allowed beyond what we explicitly allowed above. (And
 			// the "priority=0, actions=drop" rule will filter out all remaining
-			// traffic in this Namespace).
+			// traffic in this Namespace, unless we need to log it).
+			if denyLogging {
+				otx.AddFlow("table=80, priority=50, cookie=%s, reg1=%d, actions=%s", cookie, npns.vnid, dropAction)
+			}
 		} else {
 			// No policy selects all pods, so we need an "else accept" rule to
 			// allow traffic to pod IPs that aren't selected by a policy. But
@@ -331,12 +510,12 @@ func (np *networkPolicyPlugin) generateNamespaceFlows(otx ovs.Transaction, npns
 				for _, ip := range npp.selectedIPs {
 					if !selectedIPs.Has(ip) {
 						selectedIPs.Insert(ip)
-						otx.AddFlow("table=80, priority=100, reg1=%d, ip, nw_dst=%s, actions=drop", npns.vnid, ip)
+						otx.AddFlow("table=80, priority=100, cookie=%s, reg1=%d, %s, actions=%s", cookie, npns.vnid, ipMatch("dst", ip), dropAction)
 					}
 				}
 			}
 
-			otx.AddFlow("table=80, priority=50, reg1=%d, actions=output:NXM_NX_REG2[]", npns.vnid)
+			otx.AddFlow("table=80, priority=50, cookie=%s, reg1=%d, actions=%s", cookie, npns.vnid, np.baselineAction())
 		}
 	}
 }
@@ -370,6 +549,19 @@ func (np *networkPolicyPlugin) SyncVNIDRules() {
 	}
 }
 
+func (np *networkPolicyPlugin) ResyncVNIDRules() {
+	np.lock.Lock()
+	for _, npns := range np.namespaces {
+		npns.mustSync = true
+	}
+	if np.adminPolicies != nil {
+		np.adminPolicies.mustSync = true
+	}
+	np.lock.Unlock()
+
+	np.syncFlows()
+}
+
 // Match namespaces against a selector, using a cache so that, eg, when a new Namespace is
 // added, we only figure out if it matches "name: default" once, rather than recomputing
 // the set of namespaces that match that selector for every single "allow-from-default"
@@ -408,6 +600,8 @@ func (np *networkPolicyPlugin) updateMatchCache(npns *npNamespace) {
 			delete(match.matches, npns.name)
 		}
 	}
+	np.invalidateNamespaceSelectors()
+	np.invalidateAdminPolicies()
 }
 
 func (np *networkPolicyPlugin) flushMatchCache(lsel *metav1.LabelSelector) {
@@ -420,7 +614,7 @@ func (np *networkPolicyPlugin) flushMatchCache(lsel *metav1.LabelSelector) {
 	delete(np.nsMatchCache, selector.String())
 }
 
-func (np *networkPolicyPlugin) selectPodsFromNamespaces(nsLabelSel, podLabelSel *metav1.LabelSelector) []string {
+func (np *networkPolicyPlugin) selectPodsFromNamespaces(npp *npPolicy, npns *npNamespace, nsLabelSel, podLabelSel *metav1.LabelSelector) []string {
 	var peerFlows []string
 
 	nsSel, err := metav1.LabelSelectorAsSelector(nsLabelSel)
@@ -437,25 +631,16 @@ func (np *networkPolicyPlugin) selectPodsFromNamespaces(nsLabelSel, podLabelSel
 		return nil
 	}
 
-	nsLister := np.node.kubeInformers.Core().V1().Pods().Lister()
-	for namespace, vnid := range np.selectNamespacesInternal(nsSel) {
-		pods, err := nsLister.Pods(namespace).List(podSel)
-		if err != nil {
-			// Shouldn't happen
-			utilruntime.HandleError(fmt.Errorf("Could not find matching pods in namespace %q: %v", namespace, err))
-			continue
-		}
-		for _, pod := range pods {
-			if isOnPodNetwork(pod) {
-				peerFlows = append(peerFlows, fmt.Sprintf("reg0=%d, ip, nw_src=%s, ", vnid, pod.Status.PodIP))
-			}
+	np.watchNamespaceSelector(npp, npns, nsSel)
+	for _, pod := range np.lookupPodSelector(npp, npns, "", nsSel, podSel) {
+		for _, ip := range pod.ips() {
+			peerFlows = append(peerFlows, fmt.Sprintf("reg0=%d, %s, ", pod.vnid, ipMatch("src", ip)))
 		}
 	}
-
 	return peerFlows
 }
 
-func (np *networkPolicyPlugin) selectNamespaces(lsel *metav1.LabelSelector) []string {
+func (np *networkPolicyPlugin) selectNamespaces(npp *npPolicy, npns *npNamespace, lsel *metav1.LabelSelector) []string {
 	var peerFlows []string
 	sel, err := metav1.LabelSelectorAsSelector(lsel)
 	if err != nil {
@@ -463,6 +648,7 @@ func (np *networkPolicyPlugin) selectNamespaces(lsel *metav1.LabelSelector) []st
 		utilruntime.HandleError(fmt.Errorf("ValidateNetworkPolicy() failure! Invalid NamespaceSelector: %v", err))
 		return peerFlows
 	}
+	np.watchNamespaceSelector(npp, npns, sel)
 
 	namespaces := np.selectNamespacesInternal(sel)
 	for _, vnid := range namespaces {
@@ -471,7 +657,7 @@ func (np *networkPolicyPlugin) selectNamespaces(lsel *metav1.LabelSelector) []st
 	return peerFlows
 }
 
-func (np *networkPolicyPlugin) selectPods(npns *npNamespace, lsel *metav1.LabelSelector) []string {
+func (np *networkPolicyPlugin) selectPods(npp *npPolicy, npns *npNamespace, lsel *metav1.LabelSelector) []string {
 	ips := []string{}
 	sel, err := metav1.LabelSelectorAsSelector(lsel)
 	if err != nil {
@@ -480,32 +666,24 @@ func (np *networkPolicyPlugin) selectPods(npns *npNamespace, lsel *metav1.LabelS
 		return ips
 	}
 
-	pods, err := np.node.kubeInformers.Core().V1().Pods().Lister().Pods(npns.name).List(sel)
-	if err != nil {
-		// Shouldn't happen
-		utilruntime.HandleError(fmt.Errorf("Could not find matching pods in namespace %q: %v", npns.name, err))
-		return ips
-	}
-	for _, pod := range pods {
-		if isOnPodNetwork(pod) {
-			ips = append(ips, pod.Status.PodIP)
-		}
+	for _, pod := range np.lookupPodSelector(npp, npns, npns.name, nil, sel) {
+		ips = append(ips, pod.ips()...)
 	}
 	return ips
 }
 
 func (np *networkPolicyPlugin) parseNetworkPolicy(npns *npNamespace, policy *networkingv1.NetworkPolicy) *npPolicy {
 	npp := &npPolicy{policy: *policy}
+	// (The SDN controller reports these in NetworkPolicyStatusAnnotation.)
+	npp.compileErrors = common.NetworkPolicyUnsupportedFeatures(policy)
+	if len(npp.compileErrors) > 0 {
+		klog.Warningf("Ignoring unsupported parts of NetworkPolicy %s/%s: %s", policy.Namespace, policy.Name, strings.Join(npp.compileErrors, "; "))
+	}
 
-	var affectsIngress, affectsEgress bool
+	var affectsIngress bool
 	for _, ptype := range policy.Spec.PolicyTypes {
 		if ptype == networkingv1.PolicyTypeIngress {
 			affectsIngress = true
-		} else if ptype == networkingv1.PolicyTypeEgress {
-			if !affectsEgress {
-				klog.Warningf("Ignoring egress rules in NetworkPolicy %s/%s", policy.Namespace, policy.Name)
-			}
-			affectsEgress = true
 		}
 	}
 	if !affectsIngress {
@@ -520,9 +698,9 @@ func (np *networkPolicyPlugin) parseNetworkPolicy(npns *npNamespace, policy *net
 	var destFlows []string
 	if len(policy.Spec.PodSelector.MatchLabels) > 0 || len(policy.Spec.PodSelector.MatchExpressions) > 0 {
 		npp.watchesOwnPods = true
-		npp.selectedIPs = np.selectPods(npns, &policy.Spec.PodSelector)
+		npp.selectedIPs = np.selectPods(npp, npns, &policy.Spec.PodSelector)
 		for _, ip := range npp.selectedIPs {
-			destFlows = append(destFlows, fmt.Sprintf("ip, nw_dst=%s, ", ip))
+			destFlows = append(destFlows, fmt.Sprintf("%s, ", ipMatch("dst", ip)))
 		}
 	} else {
 		npp.selectedIPs = nil
@@ -543,7 +721,6 @@ func (np *networkPolicyPlugin) parseNetworkPolicy(npns *npNamespace, policy *net
 				protocol = strings.ToLower(string(*port.Protocol))
 			} else {
 				// upstream is unlikely to add any more protocol values, but just in case...
-				klog.Warningf("Ignoring rule in NetworkPolicy %s/%s with unrecognized Protocol %q", policy.Namespace, policy.Name, *port.Protocol)
 				continue
 			}
 			var portNum int
@@ -551,7 +728,6 @@ func (np *networkPolicyPlugin) parseNetworkPolicy(npns *npNamespace, policy *net
 				portFlows = append(portFlows, fmt.Sprintf("%s, ", protocol))
 				continue
 			} else if port.Port.Type != intstr.Int {
-				klog.Warningf("Ignoring rule in NetworkPolicy %s/%s with unsupported named port %q", policy.Namespace, policy.Name, port.Port.StrVal)
 				continue
 			} else {
 				portNum = int(port.Port.IntVal)
@@ -569,8 +745,8 @@ func (np *networkPolicyPlugin) parseNetworkPolicy(npns *npNamespace, policy *net
 					peerFlows = append(peerFlows, fmt.Sprintf("reg0=%d, ", npns.vnid))
 				} else {
 					npp.watchesOwnPods = true
-					for _, ip := range np.selectPods(npns, peer.PodSelector) {
-						peerFlows = append(peerFlows, fmt.Sprintf("reg0=%d, ip, nw_src=%s, ", npns.vnid, ip))
+					for _, ip := range np.selectPods(npp, npns, peer.PodSelector) {
+						peerFlows = append(peerFlows, fmt.Sprintf("reg0=%d, %s, ", npns.vnid, ipMatch("src", ip)))
 					}
 				}
 			} else if peer.NamespaceSelector != nil && peer.PodSelector == nil {
@@ -579,28 +755,32 @@ func (np *networkPolicyPlugin) parseNetworkPolicy(npns *npNamespace, policy *net
 					peerFlows = append(peerFlows, "")
 				} else {
 					npp.watchesNamespaces = true
-					peerFlows = append(peerFlows, np.selectNamespaces(peer.NamespaceSelector)...)
+					peerFlows = append(peerFlows, np.selectNamespaces(npp, npns, peer.NamespaceSelector)...)
 				}
 			} else {
 				npp.watchesNamespaces = true
 				npp.watchesAllPods = true
-				peerFlows = append(peerFlows, np.selectPodsFromNamespaces(peer.NamespaceSelector, peer.PodSelector)...)
+				peerFlows = append(peerFlows, np.selectPodsFromNamespaces(npp, npns, peer.NamespaceSelector, peer.PodSelector)...)
 			}
 
 			if peer.IPBlock != nil {
-				if peer.IPBlock.Except != nil {
-					// Currently IPBlocks with except rules are skipped.
-					klog.Warningf("IPBlocks with except rules are not supported (NetworkPolicy [%s], Namespace [%s])", policy.Name, policy.Namespace)
-				} else {
-					// Network Policy has ipBlocks, allow traffic from those ips.
-					peerFlows = append(peerFlows, fmt.Sprintf("ip, nw_src=%s, ", peer.IPBlock.CIDR))
+				// Network Policy has ipBlocks, allow traffic from those ips. (Since
+				// other rules may allow traffic from the excepted ranges, we can't
+				// just add drop rules for them; instead we break up the CIDR into
+				// the smallest set of subnets that doesn't include them.)
+				cidrs, err := cidrsExcept(peer.IPBlock.CIDR, peer.IPBlock.Except)
+				if err != nil {
+					continue
+				}
+				for _, cidr := range cidrs {
+					peerFlows = append(peerFlows, fmt.Sprintf("%s, ", ipMatch("src", cidr)))
 				}
 			}
 		}
 		for _, destFlow := range destFlows {
 			for _, peerFlow := range peerFlows {
 				for _, portFlow := range portFlows {
-					npp.flows = append(npp.flows, fmt.Sprintf("%s%s%s", destFlow, peerFlow, portFlow))
+					npp.flows = append(npp.flows, combinePolicyMatches(np.dualStack, destFlow, peerFlow, portFlow)...)
 				}
 			}
 		}
@@ -611,6 +791,57 @@ func (np *networkPolicyPlugin) parseNetworkPolicy(npns *npNamespace, policy *net
 	return npp
 }
 
+// cidrsExcept returns a minimal list of CIDRs that together cover exactly the
+// addresses in cidr that are not in any of except
+func cidrsExcept(cidr string, except []string) ([]string, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	remaining := []*net.IPNet{ipNet}
+	for _, exceptCIDR := range except {
+		_, exceptNet, err := net.ParseCIDR(exceptCIDR)
+		if err != nil {
+			return nil, err
+		}
+		var next []*net.IPNet
+		for _, n := range remaining {
+			next = append(next, subtractCIDR(n, exceptNet)...)
+		}
+		remaining = next
+	}
+
+	cidrs := make([]string, 0, len(remaining))
+	for _, n := range remaining {
+		cidrs = append(cidrs, n.String())
+	}
+	return cidrs, nil
+}
+
+// subtractCIDR returns the subnets of n that do not overlap except
+func subtractCIDR(n, except *net.IPNet) []*net.IPNet {
+	nOnes, bits := n.Mask.Size()
+	exceptOnes, exceptBits := except.Mask.Size()
+	if bits != exceptBits || !(n.Contains(except.IP) || except.Contains(n.IP)) {
+		// no overlap
+		return []*net.IPNet{n}
+	}
+	if exceptOnes <= nOnes {
+		// except contains all of n
+		return nil
+	}
+
+	// Split n in half and recurse; one half will overlap except and the other won't
+	mask := net.CIDRMask(nOnes+1, bits)
+	low := &net.IPNet{IP: n.IP.Mask(mask), Mask: mask}
+	highIP := make(net.IP, len(low.IP))
+	copy(highIP, low.IP)
+	highIP[nOnes/8] |= 0x80 >> uint(nOnes%8)
+	high := &net.IPNet{IP: highIP, Mask: mask}
+
+	return append(subtractCIDR(low, except), subtractCIDR(high, except)...)
+}
+
 // Cleans up after a NetworkPolicy that is being deleted
 func (np *networkPolicyPlugin) cleanupNetworkPolicy(policy *networkingv1.NetworkPolicy) {
 	for _, rule := range policy.Spec.Ingress {
@@ -630,6 +861,12 @@ func (np *networkPolicyPlugin) updateNetworkPolicy(npns *npNamespace, policy *ne
 	npp := np.parseNetworkPolicy(npns, policy)
 	oldNPP, existed := npns.policies[policy.UID]
 	npns.policies[policy.UID] = npp
+	if existed {
+		np.releasePodSelectors(oldNPP, npp.podSelectorKeys)
+		np.releaseNamespaceSelectors(oldNPP, npp.namespaceSelectorKeys)
+	}
+	metrics.NetworkPolicyFlows.WithLabelValues(policy.Namespace, policy.Name).Set(float64(len(npp.flows)))
+	updateCompileFailuresMetric(npns)
 
 	changed := !existed || !reflect.DeepEqual(oldNPP.flows, npp.flows) || !reflect.DeepEqual(oldNPP.selectedIPs, npp.selectedIPs) || oldNPP.selectsAllIPs != npp.selectsAllIPs
 	if !changed {
@@ -638,6 +875,20 @@ func (np *networkPolicyPlugin) updateNetworkPolicy(npns *npNamespace, policy *ne
 	return changed
 }
 
+func updateCompileFailuresMetric(npns *npNamespace) {
+	if len(npns.policies) == 0 {
+		metrics.NetworkPolicyCompileFailures.Delete(map[string]string{"namespace": npns.name})
+		return
+	}
+	failed := 0
+	for _, npp := range npns.policies {
+		if len(npp.compileErrors) > 0 {
+			failed++
+		}
+	}
+	metrics.NetworkPolicyCompileFailures.WithLabelValues(npns.name).Set(float64(failed))
+}
+
 func (np *networkPolicyPlugin) watchNetworkPolicies() {
 	funcs := common.InformerFuncs(&networkingv1.NetworkPolicy{}, np.handleAddOrUpdateNetworkPolicy, np.handleDeleteNetworkPolicy)
 	np.node.kubeInformers.Networking().V1().NetworkPolicies().Informer().AddEventHandler(funcs)
@@ -668,6 +919,7 @@ func (np *networkPolicyPlugin) handleAddOrUpdateNetworkPolicy(obj, _ interface{}
 func (np *networkPolicyPlugin) handleDeleteNetworkPolicy(obj interface{}) {
 	policy := obj.(*networkingv1.NetworkPolicy)
 	klog.V(5).Infof("Watch %s event for NetworkPolicy %s/%s", watch.Deleted, policy.Namespace, policy.Name)
+	metrics.NetworkPolicyFlows.Delete(map[string]string{"namespace": policy.Namespace, "policy": policy.Name})
 
 	vnid, err := np.vnids.WaitAndGetVNID(policy.Namespace)
 	if err != nil {
@@ -680,16 +932,47 @@ func (np *networkPolicyPlugin) handleDeleteNetworkPolicy(obj interface{}) {
 
 	if npns, exists := np.namespaces[vnid]; exists {
 		np.cleanupNetworkPolicy(policy)
+		if npp, exists := npns.policies[policy.UID]; exists {
+			np.releasePodSelectors(npp, nil)
+			np.releaseNamespaceSelectors(npp, nil)
+		}
 		delete(npns.policies, policy.UID)
+		updateCompileFailuresMetric(npns)
 		if npns.inUse {
 			np.syncNamespace(npns)
 		}
 	}
 }
 
+// podIPIndex is the name of the Pod informer index of pod-network pods by IP
+const podIPIndex = "podIP"
+
+func podIPIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || !isOnPodNetwork(pod) {
+		return nil, nil
+	}
+	if ipv6 := podIPv6(pod); ipv6 != "" {
+		return []string{pod.Status.PodIP, ipv6}, nil
+	}
+	return []string{pod.Status.PodIP}, nil
+}
+
+// addPodIPIndex adds podIPIndex to the Pod informer, unless it already has it
+func addPodIPIndex(informer cache.SharedIndexInformer) error {
+	if _, ok := informer.GetIndexer().GetIndexers()[podIPIndex]; ok {
+		return nil
+	}
+	return informer.AddIndexers(cache.Indexers{podIPIndex: podIPIndexFunc})
+}
+
 func (np *networkPolicyPlugin) watchPods() {
+	informer := np.node.kubeInformers.Core().V1().Pods().Informer()
+	if err := addPodIPIndex(informer); err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not index pods by IP: %v", err))
+	}
 	funcs := common.InformerFuncs(&corev1.Pod{}, np.handleAddOrUpdatePod, np.handleDeletePod)
-	np.node.kubeInformers.Core().V1().Pods().Informer().AddEventHandler(funcs)
+	informer.AddEventHandler(funcs)
 }
 
 func isOnPodNetwork(pod *corev1.Pod) bool {
@@ -699,6 +982,16 @@ func isOnPodNetwork(pod *corev1.Pod) bool {
 	return pod.Status.PodIP != ""
 }
 
+// podIPv6 returns pod's IPv6 address in a dual-stack cluster, or ""
+func podIPv6(pod *corev1.Pod) string {
+	for _, podIP := range pod.Status.PodIPs {
+		if podIP.IP != pod.Status.PodIP && utilnet.IsIPv6String(podIP.IP) {
+			return podIP.IP
+		}
+	}
+	return ""
+}
+
 func (np *networkPolicyPlugin) handleAddOrUpdatePod(obj, old interface{}, eventType watch.EventType) {
 	pod := obj.(*corev1.Pod)
 	klog.V(5).Infof("Watch %s event for Pod %q", eventType, getPodFullName(pod))
@@ -707,9 +1000,10 @@ func (np *networkPolicyPlugin) handleAddOrUpdatePod(obj, old interface{}, eventT
 		return
 	}
 
+	var oldPod *corev1.Pod
 	if old != nil {
-		oldPod := old.(*corev1.Pod)
-		if oldPod.Status.PodIP == pod.Status.PodIP && reflect.DeepEqual(oldPod.Labels, pod.Labels) {
+		oldPod = old.(*corev1.Pod)
+		if oldPod.Status.PodIP == pod.Status.PodIP && podIPv6(oldPod) == podIPv6(pod) && reflect.DeepEqual(oldPod.Labels, pod.Labels) {
 			return
 		}
 	}
@@ -717,7 +1011,8 @@ func (np *networkPolicyPlugin) handleAddOrUpdatePod(obj, old interface{}, eventT
 	np.lock.Lock()
 	defer np.lock.Unlock()
 
-	np.refreshPodNetworkPolicies(pod)
+	np.invalidatePodSelectors(pod, oldPod)
+	np.invalidateAdminPolicies()
 }
 
 func (np *networkPolicyPlugin) handleDeletePod(obj interface{}) {
@@ -727,7 +1022,8 @@ func (np *networkPolicyPlugin) handleDeletePod(obj interface{}) {
 	np.lock.Lock()
 	defer np.lock.Unlock()
 
-	np.refreshPodNetworkPolicies(pod)
+	np.invalidatePodSelectors(pod)
+	np.invalidateAdminPolicies()
 }
 
 func (np *networkPolicyPlugin) watchNamespaces() {
@@ -748,15 +1044,27 @@ func (np *networkPolicyPlugin) handleAddOrUpdateNamespace(obj, _ interface{}, ev
 		np.namespacesByName[ns.Name] = npns
 	}
 
+	denyLogging := denyLoggingEnabled(ns)
+	if denyLogging != npns.denyLogging {
+		npns.denyLogging = denyLogging
+		if denyLogging {
+			np.startDenyLoggerLocked()
+		}
+		if npns.gotNetNamespace && npns.inUse {
+			np.syncNamespace(npns)
+		}
+	}
+
 	if npns.gotNamespace && reflect.DeepEqual(npns.labels, ns.Labels) {
 		return
 	}
+	oldLabels := npns.selectableLabels()
 	npns.labels = ns.Labels
 
 	npns.gotNamespace = true
 	if npns.gotNetNamespace {
 		np.updateMatchCache(npns)
-		np.refreshNamespaceNetworkPolicies()
+		np.refreshNamespaceNetworkPolicies(oldLabels, npns.selectableLabels())
 	}
 }
 
@@ -772,36 +1080,47 @@ func (np *networkPolicyPlugin) handleDeleteNamespace(obj interface{}) {
 		return
 	}
 
+	oldLabels := npns.selectableLabels()
 	delete(np.namespacesByName, ns.Name)
 	npns.gotNamespace = false
 
-	// We don't need to call refreshNetworkPolicies here; if the VNID doesn't get
-	// reused then the stale flows won't hurt anything, and if it does get reused then
-	// things will be cleaned up then. However, we do have to clean up the cache.
+	for _, npp := range npns.policies {
+		metrics.NetworkPolicyFlows.Delete(map[string]string{"namespace": ns.Name, "policy": npp.policy.Name})
+	}
+	metrics.NetworkPolicyCompileFailures.Delete(map[string]string{"namespace": ns.Name})
+
 	np.updateMatchCache(npns)
+	np.refreshNamespaceNetworkPolicies(oldLabels, nil)
 }
 
-func (np *networkPolicyPlugin) refreshNamespaceNetworkPolicies() {
-	for _, npns := range np.namespaces {
-		for _, npp := range npns.policies {
-			if npp.watchesNamespaces {
-				npns.mustRecalculate = true
-			}
-		}
-		if npns.mustRecalculate && npns.inUse {
-			np.syncNamespace(npns)
-		}
+// selectableLabels returns npns's labels for matching against namespaceSelectors, or
+// nil if it can't currently be selected
+func (npns *npNamespace) selectableLabels() labels.Set {
+	if !npns.gotNamespace || !npns.gotNetNamespace {
+		return nil
 	}
+	if npns.labels == nil {
+		return labels.Set{}
+	}
+	return labels.Set(npns.labels)
 }
 
-func (np *networkPolicyPlugin) refreshPodNetworkPolicies(pod *corev1.Pod) {
-	podNs := np.namespacesByName[pod.Namespace]
-	for _, npns := range np.namespaces {
-		for _, npp := range npns.policies {
-			if (npp.watchesOwnPods && npns == podNs) || npp.watchesAllPods {
-				npns.mustRecalculate = true
-			}
+// refreshNamespaceNetworkPolicies recalculates the policies whose namespaceSelectors
+// select a different set of namespaces after a namespace that had (selectable)
+// labels oldLabels now has newLabels. Either may be nil if the namespace was not or
+// is no longer selectable.
+func (np *networkPolicyPlugin) refreshNamespaceNetworkPolicies(oldLabels, newLabels labels.Set) {
+	for _, entry := range np.namespaceSelectors {
+		matchedOld := oldLabels != nil && entry.selector.Matches(oldLabels)
+		matchesNew := newLabels != nil && entry.selector.Matches(newLabels)
+		if matchedOld == matchesNew {
+			continue
+		}
+		for _, npns := range entry.users {
+			npns.mustRecalculate = true
 		}
+	}
+	for _, npns := range np.namespaces {
 		if npns.mustRecalculate && npns.inUse {
 			np.syncNamespace(npns)
 		}
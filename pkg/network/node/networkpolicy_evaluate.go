@@ -0,0 +1,208 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/openshift/library-go/pkg/network/networkutils"
+)
+
+// ConnectionQuery describes a hypothetical connection to be evaluated against the
+// node's current NetworkPolicy state.
+type ConnectionQuery struct {
+	SrcIP    string `json:"srcIP"`
+	DstIP    string `json:"dstIP"`
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+}
+
+// ConnectionVerdict is the result of evaluating a ConnectionQuery.
+type ConnectionVerdict struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+	// Policies lists the policies that allowed the connection, or, if it was
+	// denied, the policies that isolate the destination pod.
+	Policies []string `json:"policies,omitempty"`
+}
+
+// EvaluateConnection reports whether the NetworkPolicies currently known to this node
+// would allow the given connection (to a pod on any node), and which policies were
+// responsible. Sources that are not pods are treated the same way as host-network
+// traffic.
+func (node *OsdnNode) EvaluateConnection(q *ConnectionQuery) (*ConnectionVerdict, error) {
+	np, ok := node.policy.(*networkPolicyPlugin)
+	if !ok {
+		return nil, fmt.Errorf("connection evaluation is only supported by the %s plugin", networkutils.NetworkPolicyPluginName)
+	}
+	return np.evaluateConnection(q)
+}
+
+func (np *networkPolicyPlugin) findPodByIP(ip string) *corev1.Pod {
+	objs, err := np.node.kubeInformers.Core().V1().Pods().Informer().GetIndexer().ByIndex(podIPIndex, ip)
+	if err != nil || len(objs) == 0 {
+		return nil
+	}
+	return objs[0].(*corev1.Pod)
+}
+
+func (np *networkPolicyPlugin) evaluateConnection(q *ConnectionQuery) (*ConnectionVerdict, error) {
+	srcIP := net.ParseIP(q.SrcIP)
+	if srcIP == nil {
+		return nil, fmt.Errorf("invalid source IP %q", q.SrcIP)
+	}
+	dstIP := net.ParseIP(q.DstIP)
+	if dstIP == nil {
+		return nil, fmt.Errorf("invalid destination IP %q", q.DstIP)
+	}
+	protocol := strings.ToLower(q.Protocol)
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	if protocol != "tcp" && protocol != "udp" && protocol != "sctp" {
+		return nil, fmt.Errorf("unsupported protocol %q", q.Protocol)
+	}
+
+	dstPod := np.findPodByIP(q.DstIP)
+	if dstPod == nil {
+		return nil, fmt.Errorf("destination IP %s does not belong to a pod", q.DstIP)
+	}
+	dstVNID, err := np.vnids.getVNID(dstPod.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	srcVNID := uint32(0)
+	if srcPod := np.findPodByIP(q.SrcIP); srcPod != nil {
+		srcVNID, err = np.vnids.getVNID(srcPod.Namespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	np.lock.Lock()
+	defer np.lock.Unlock()
+	return np.evaluateConnectionInternal(srcVNID, srcIP, dstVNID, dstIP, protocol, q.Port)
+}
+
+// evaluateConnectionInternal mirrors the logic of generateNamespaceFlows
+func (np *networkPolicyPlugin) evaluateConnectionInternal(srcVNID uint32, srcIP net.IP, dstVNID uint32, dstIP net.IP, protocol string, port int) (*ConnectionVerdict, error) {
+	npns := np.namespaces[dstVNID]
+	if npns == nil {
+		return nil, fmt.Errorf("no namespace with VNID %d", dstVNID)
+	}
+
+	var allowing, isolating []string
+	for _, npp := range npns.policies {
+		for _, flow := range npp.flows {
+			if policyFlowMatches(flow, srcVNID, srcIP, dstIP, protocol, port) {
+				allowing = append(allowing, npp.policy.Name)
+				break
+			}
+		}
+		if npp.selectsAllIPs {
+			isolating = append(isolating, npp.policy.Name)
+		} else {
+			for _, ip := range npp.selectedIPs {
+				if ip == dstIP.String() {
+					isolating = append(isolating, npp.policy.Name)
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(allowing)
+	sort.Strings(isolating)
+
+	if len(allowing) > 0 {
+		return &ConnectionVerdict{Allowed: true, Reason: "allowed by NetworkPolicy", Policies: allowing}, nil
+	} else if len(isolating) == 0 {
+		return &ConnectionVerdict{Allowed: true, Reason: "destination pod is not selected by any NetworkPolicy"}, nil
+	}
+	return &ConnectionVerdict{Allowed: false, Reason: "destination pod is isolated and no NetworkPolicy allows the connection", Policies: isolating}, nil
+}
+
+// policyFlowMatches tests whether a connection matches one of the partial flows
+// generated by parseNetworkPolicy (eg "ip, nw_dst=10.128.0.3, reg0=5, tcp, tp_dst=80, ")
+func policyFlowMatches(flow string, srcVNID uint32, srcIP, dstIP net.IP, protocol string, port int) bool {
+	for _, field := range strings.Split(flow, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" || field == "ip" || field == "ipv6" {
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) == 1 {
+			if kv[0] != protocol && kv[0] != protocol+"6" {
+				return false
+			}
+			continue
+		}
+		switch kv[0] {
+		case "reg0":
+			vnid, err := strconv.ParseUint(kv[1], 0, 32)
+			if err != nil || uint32(vnid) != srcVNID {
+				return false
+			}
+		case "nw_src", "ipv6_src":
+			if !ipMatches(srcIP, kv[1]) {
+				return false
+			}
+		case "nw_dst", "ipv6_dst":
+			if !ipMatches(dstIP, kv[1]) {
+				return false
+			}
+		case "tp_dst":
+			if kv[1] != strconv.Itoa(port) {
+				return false
+			}
+		default:
+			// Unknown match; be conservative
+			return false
+		}
+	}
+	return true
+}
+
+func ipMatches(ip net.IP, match string) bool {
+	if strings.Contains(match, "/") {
+		_, ipNet, err := net.ParseCIDR(match)
+		return err == nil && ipNet.Contains(ip)
+	}
+	return ip.Equal(net.ParseIP(match))
+}
+
+// ServeConnectionEvaluation is an HTTP handler for EvaluateConnection, taking the
+// fields of a ConnectionQuery as query parameters, eg
+// "?srcIP=10.128.0.5&dstIP=10.129.0.8&protocol=tcp&port=8080"
+func (node *OsdnNode) ServeConnectionEvaluation(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := &ConnectionQuery{
+		SrcIP:    params.Get("srcIP"),
+		DstIP:    params.Get("dstIP"),
+		Protocol: params.Get("protocol"),
+	}
+	if portStr := params.Get("port"); portStr != "" {
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid port %q", portStr), http.StatusBadRequest)
+			return
+		}
+		q.Port = port
+	}
+
+	verdict, err := node.EvaluateConnection(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(verdict); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
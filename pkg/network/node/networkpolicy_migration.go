@@ -0,0 +1,63 @@
+package node
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/openshift/library-go/pkg/network/networkutils"
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// nodePluginName returns the plugin that node should run given the ClusterNetwork's
+// plugin: the NetworkPolicy plugin if the master has switched the node to it as part
+// of a migration from the multitenant plugin (see common.NodePluginAnnotation), and
+// clusterPluginName otherwise.
+func nodePluginName(node *corev1.Node, clusterPluginName string) string {
+	if strings.ToLower(clusterPluginName) == networkutils.MultiTenantPluginName &&
+		node != nil && node.Annotations[common.NodePluginAnnotation] == networkutils.NetworkPolicyPluginName {
+		return networkutils.NetworkPolicyPluginName
+	}
+	return clusterPluginName
+}
+
+// getNodePluginName returns nodePluginName for the Node named nodeName
+func getNodePluginName(kClient kubernetes.Interface, nodeName, clusterPluginName string) (string, error) {
+	node, err := kClient.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		node = nil
+	} else if err != nil {
+		return "", err
+	}
+	return nodePluginName(node, clusterPluginName), nil
+}
+
+// watchPluginMigration watches our Node for common.NodePluginAnnotation, and
+// restarts if it changes which plugin we should be running
+func (node *OsdnNode) watchPluginMigration() {
+	funcs := common.InformerFuncs(&corev1.Node{}, node.handleAddOrUpdatePluginMigrationNode, nil)
+	node.kubeInformers.Core().V1().Nodes().Informer().AddEventHandler(funcs)
+}
+
+func (node *OsdnNode) handleAddOrUpdatePluginMigrationNode(obj, _ interface{}, eventType watch.EventType) {
+	kNode := obj.(*corev1.Node)
+	if kNode.Name != node.hostName {
+		return
+	}
+	pluginName := nodePluginName(kNode, node.networkInfo.PluginName)
+	if strings.ToLower(pluginName) == node.policy.Name() {
+		return
+	}
+	// The plugin can only be chosen at startup, so exit and let the daemonset
+	// restart us with the new one
+	klog.Warningf("Node was switched from the %q plugin to the %q plugin, restarting", node.policy.Name(), pluginName)
+	os.Exit(1)
+}
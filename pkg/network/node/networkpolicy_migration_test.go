@@ -0,0 +1,57 @@
+package node
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/library-go/pkg/network/networkutils"
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+func TestNodePluginName(t *testing.T) {
+	switched := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "node1",
+			Annotations: map[string]string{common.NodePluginAnnotation: networkutils.NetworkPolicyPluginName},
+		},
+	}
+	unswitched := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}}
+
+	tests := []struct {
+		name          string
+		node          *corev1.Node
+		clusterPlugin string
+		expected      string
+	}{
+		{
+			name:          "switched multitenant node",
+			node:          switched,
+			clusterPlugin: networkutils.MultiTenantPluginName,
+			expected:      networkutils.NetworkPolicyPluginName,
+		},
+		{
+			name:          "unswitched multitenant node",
+			node:          unswitched,
+			clusterPlugin: networkutils.MultiTenantPluginName,
+			expected:      networkutils.MultiTenantPluginName,
+		},
+		{
+			name:          "missing node",
+			clusterPlugin: networkutils.MultiTenantPluginName,
+			expected:      networkutils.MultiTenantPluginName,
+		},
+		{
+			name:          "annotation ignored for other plugins",
+			node:          switched,
+			clusterPlugin: networkutils.SingleTenantPluginName,
+			expected:      networkutils.SingleTenantPluginName,
+		},
+	}
+	for _, test := range tests {
+		if pluginName := nodePluginName(test.node, test.clusterPlugin); pluginName != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, pluginName)
+		}
+	}
+}
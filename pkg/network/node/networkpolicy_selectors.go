@@ -0,0 +1,243 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// npPodSelectorEntry is an entry in networkPolicyPlugin.podSelectors. Many
+// NetworkPolicies use identical pod selectors (eg, "app: frontend" in a namespace, or
+// the same namespaceSelector/podSelector pair copied into every namespace), so rather
+// than having each policy list and match pods itself, the pods matching each distinct
+// selector are computed once and shared by every policy that uses it. When a pod
+// changes, only the entries whose selectors match it are recomputed, and only the
+// namespaces with policies using those entries are recalculated.
+type npPodSelectorEntry struct {
+	// namespace is the namespace that podSelector selects pods in, or "" if
+	// namespaceSelector selects the namespaces
+	namespace         string
+	namespaceSelector labels.Selector
+	podSelector       labels.Selector
+
+	// pods is the matching pods, sorted by IP; it is only current if valid is set
+	valid bool
+	pods  []npSelectedPod
+
+	// users is the policies using this entry, and their namespaces
+	users map[ktypes.UID]*npNamespace
+}
+
+// npSelectedPod is a pod matched by an npPodSelectorEntry
+type npSelectedPod struct {
+	// vnid is the VNID of the pod's namespace (only set for entries with a
+	// namespaceSelector)
+	vnid uint32
+	ip   string
+	// ipv6 is the pod's IPv6 address, in a dual-stack cluster
+	ipv6 string
+}
+
+// ips returns the pod's addresses
+func (pod npSelectedPod) ips() []string {
+	if pod.ipv6 != "" {
+		return []string{pod.ip, pod.ipv6}
+	}
+	return []string{pod.ip}
+}
+
+// podSelectorKey returns the key of the npPodSelectorEntry for podSelector in either
+// namespace or the namespaces matching namespaceSelector
+func podSelectorKey(namespace string, namespaceSelector, podSelector labels.Selector) string {
+	if namespaceSelector != nil {
+		return fmt.Sprintf("namespaces[%s]/pods[%s]", namespaceSelector.String(), podSelector.String())
+	}
+	return fmt.Sprintf("namespace[%s]/pods[%s]", namespace, podSelector.String())
+}
+
+// lookupPodSelector returns the pods matching podSelector in namespace (or, if
+// namespaceSelector is non-nil, in the namespaces it matches), recording that npp
+// (in npns) depends on the result
+func (np *networkPolicyPlugin) lookupPodSelector(npp *npPolicy, npns *npNamespace, namespace string, namespaceSelector, podSelector labels.Selector) []npSelectedPod {
+	if np.podSelectors == nil {
+		np.podSelectors = make(map[string]*npPodSelectorEntry)
+	}
+	key := podSelectorKey(namespace, namespaceSelector, podSelector)
+	entry := np.podSelectors[key]
+	if entry == nil {
+		entry = &npPodSelectorEntry{
+			namespace:         namespace,
+			namespaceSelector: namespaceSelector,
+			podSelector:       podSelector,
+			users:             make(map[ktypes.UID]*npNamespace),
+		}
+		np.podSelectors[key] = entry
+	}
+	if !entry.valid {
+		entry.pods = np.evaluatePodSelector(entry)
+		entry.valid = true
+	}
+
+	entry.users[npp.policy.UID] = npns
+	if npp.podSelectorKeys == nil {
+		npp.podSelectorKeys = sets.NewString()
+	}
+	npp.podSelectorKeys.Insert(key)
+	return entry.pods
+}
+
+func (np *networkPolicyPlugin) evaluatePodSelector(entry *npPodSelectorEntry) []npSelectedPod {
+	namespaces := map[string]uint32{entry.namespace: 0}
+	if entry.namespaceSelector != nil {
+		namespaces = np.selectNamespacesInternal(entry.namespaceSelector)
+	}
+
+	var selected []npSelectedPod
+	podLister := np.node.kubeInformers.Core().V1().Pods().Lister()
+	for namespace, vnid := range namespaces {
+		pods, err := podLister.Pods(namespace).List(entry.podSelector)
+		if err != nil {
+			// Shouldn't happen
+			utilruntime.HandleError(fmt.Errorf("Could not find matching pods in namespace %q: %v", namespace, err))
+			continue
+		}
+		for _, pod := range pods {
+			if isOnPodNetwork(pod) {
+				selected = append(selected, npSelectedPod{vnid: vnid, ip: pod.Status.PodIP, ipv6: podIPv6(pod)})
+			}
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].ip < selected[j].ip
+	})
+	return selected
+}
+
+// releasePodSelectors drops npp's use of any entries other than those in keep (which
+// may be nil), deleting entries that are no longer used by any policy
+func (np *networkPolicyPlugin) releasePodSelectors(npp *npPolicy, keep sets.String) {
+	for key := range npp.podSelectorKeys {
+		if keep.Has(key) {
+			continue
+		}
+		entry := np.podSelectors[key]
+		if entry == nil {
+			continue
+		}
+		delete(entry.users, npp.policy.UID)
+		if len(entry.users) == 0 {
+			delete(np.podSelectors, key)
+		}
+	}
+}
+
+// invalidatePodSelectors marks the entries that pod (before or after a change) is or
+// was selected by as needing to be recomputed, and the namespaces of the policies
+// that use them as needing to be recalculated
+func (np *networkPolicyPlugin) invalidatePodSelectors(pods ...*corev1.Pod) {
+	for _, entry := range np.podSelectors {
+		for _, pod := range pods {
+			if pod == nil || !entry.selects(np, pod) {
+				continue
+			}
+			entry.valid = false
+			for _, npns := range entry.users {
+				npns.mustRecalculate = true
+				if npns.inUse {
+					np.syncNamespace(npns)
+				}
+			}
+			break
+		}
+	}
+}
+
+// invalidateNamespaceSelectors marks the entries with namespaceSelectors as needing to
+// be recomputed, after the set of namespaces they might match has changed. (The
+// policies that use them are recalculated by refreshNamespaceNetworkPolicies, if
+// needed.)
+func (np *networkPolicyPlugin) invalidateNamespaceSelectors() {
+	for _, entry := range np.podSelectors {
+		if entry.namespaceSelector != nil {
+			entry.valid = false
+		}
+	}
+}
+
+// selects returns true if pod matches entry's selectors, or was selected by it when
+// it was last computed
+func (entry *npPodSelectorEntry) selects(np *networkPolicyPlugin, pod *corev1.Pod) bool {
+	if entry.valid && pod.Status.PodIP != "" {
+		i := sort.Search(len(entry.pods), func(i int) bool { return entry.pods[i].ip >= pod.Status.PodIP })
+		if i < len(entry.pods) && entry.pods[i].ip == pod.Status.PodIP {
+			return true
+		}
+	}
+
+	if entry.namespaceSelector == nil {
+		if pod.Namespace != entry.namespace {
+			return false
+		}
+	} else if _, matches := np.selectNamespacesInternal(entry.namespaceSelector)[pod.Namespace]; !matches {
+		return false
+	}
+	return entry.podSelector.Matches(labels.Set(pod.Labels))
+}
+
+// npNamespaceSelectorEntry is an entry in networkPolicyPlugin.namespaceSelectors,
+// which indexes the policies that use each distinct namespaceSelector. When a
+// namespace's labels change, only the policies using selectors that matched it before
+// or after the change need to be recalculated, rather than every policy with any
+// namespaceSelector.
+type npNamespaceSelectorEntry struct {
+	selector labels.Selector
+	// users is the policies using this selector, and their namespaces
+	users map[ktypes.UID]*npNamespace
+}
+
+// watchNamespaceSelector records that npp (in npns) depends on the namespaces matching
+// selector
+func (np *networkPolicyPlugin) watchNamespaceSelector(npp *npPolicy, npns *npNamespace, selector labels.Selector) {
+	if np.namespaceSelectors == nil {
+		np.namespaceSelectors = make(map[string]*npNamespaceSelectorEntry)
+	}
+	key := selector.String()
+	entry := np.namespaceSelectors[key]
+	if entry == nil {
+		entry = &npNamespaceSelectorEntry{
+			selector: selector,
+			users:    make(map[ktypes.UID]*npNamespace),
+		}
+		np.namespaceSelectors[key] = entry
+	}
+
+	entry.users[npp.policy.UID] = npns
+	if npp.namespaceSelectorKeys == nil {
+		npp.namespaceSelectorKeys = sets.NewString()
+	}
+	npp.namespaceSelectorKeys.Insert(key)
+}
+
+// releaseNamespaceSelectors drops npp's use of any namespaceSelectors other than
+// those in keep (which may be nil), deleting entries that are no longer used by any
+// policy
+func (np *networkPolicyPlugin) releaseNamespaceSelectors(npp *npPolicy, keep sets.String) {
+	for key := range npp.namespaceSelectorKeys {
+		if keep.Has(key) {
+			continue
+		}
+		entry := np.namespaceSelectors[key]
+		if entry == nil {
+			continue
+		}
+		delete(entry.users, npp.policy.UID)
+		if len(entry.users) == 0 {
+			delete(np.namespaceSelectors, key)
+		}
+	}
+}
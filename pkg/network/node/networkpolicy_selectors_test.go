@@ -0,0 +1,209 @@
+package node
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func allowClientsPolicy(npns *npNamespace, name string, namespaceSelector *metav1.LabelSelector) *networkingv1.NetworkPolicy {
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			UID:       uid(npns, name),
+			Namespace: npns.name,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{"kind": "server"},
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				From: []networkingv1.NetworkPolicyPeer{{
+					NamespaceSelector: namespaceSelector,
+					PodSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"kind": "client"},
+					},
+				}},
+			}},
+		},
+	}
+}
+
+func TestNetworkPolicySelectorIndex(t *testing.T) {
+	np, synced, stopCh := newTestNPP()
+	defer close(stopCh)
+
+	addNamespace(np, "one", 1, map[string]string{"parity": "odd"})
+	addNamespace(np, "two", 2, map[string]string{"parity": "even"})
+	addNamespace(np, "three", 3, map[string]string{"parity": "odd"})
+	one := np.namespaces[1]
+	two := np.namespaces[2]
+	three := np.namespaces[3]
+	addPods(np, one)
+	addPods(np, two)
+	addPods(np, three)
+
+	oddSelector := &metav1.LabelSelector{
+		MatchLabels: map[string]string{"parity": "odd"},
+	}
+	policies := []*networkingv1.NetworkPolicy{
+		allowClientsPolicy(one, "allow-clients", nil),
+		allowClientsPolicy(one, "allow-clients-again", nil),
+		allowClientsPolicy(two, "allow-odd-clients", oddSelector),
+		allowClientsPolicy(three, "allow-odd-clients", oddSelector),
+	}
+	for _, policy := range policies {
+		synced.Store(false)
+		addNetworkPolicy(np, policy)
+	}
+	waitForSync(np, synced, "policies")
+
+	assertEntry := func(key string, users int, pods ...npSelectedPod) {
+		t.Helper()
+		np.lock.Lock()
+		defer np.lock.Unlock()
+		entry := np.podSelectors[key]
+		if entry == nil {
+			if users != 0 {
+				t.Fatalf("no entry for %q", key)
+			}
+			return
+		} else if users == 0 {
+			t.Fatalf("unexpected entry for %q", key)
+		}
+		if len(entry.users) != users {
+			t.Fatalf("expected %d users of %q, got %d", users, key, len(entry.users))
+		}
+		if !entry.valid {
+			t.Fatalf("entry %q unexpectedly invalid", key)
+		}
+		if !reflect.DeepEqual(entry.pods, pods) {
+			t.Fatalf("unexpected pods for %q: expected %#v, got %#v", key, pods, entry.pods)
+		}
+	}
+
+	// The two policies in "one" share entries for both of their selectors, and the
+	// policies in "two" and "three" share the entry for their peer selector
+	assertEntry("namespace[one]/pods[kind=server]", 2, npSelectedPod{ip: serverIP(one)})
+	assertEntry("namespace[one]/pods[kind=client]", 2, npSelectedPod{ip: clientIP(one)})
+	assertEntry("namespace[two]/pods[kind=server]", 1, npSelectedPod{ip: serverIP(two)})
+	assertEntry("namespace[three]/pods[kind=server]", 1, npSelectedPod{ip: serverIP(three)})
+	assertEntry("namespaces[parity=odd]/pods[kind=client]", 2,
+		npSelectedPod{vnid: 1, ip: clientIP(one)},
+		npSelectedPod{vnid: 3, ip: clientIP(three)},
+	)
+	if len(np.podSelectors) != 5 {
+		t.Fatalf("expected 5 entries, got %#v", np.podSelectors)
+	}
+
+	// A new client pod in "three" should update the shared entry, and the flows of
+	// both policies using it
+	newClient := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: three.name,
+			Name:      "client2",
+			UID:       uid(three, "client2"),
+			Labels: map[string]string{
+				"kind": "client",
+			},
+		},
+		Status: corev1.PodStatus{
+			PodIP: "10.3.0.4",
+		},
+	}
+	synced.Store(false)
+	_, err := np.node.kClient.CoreV1().Pods(three.name).Create(context.TODO(), newClient, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating pod: %v", err)
+	}
+	err = waitForEvent(np, func() bool {
+		for _, npns := range []*npNamespace{two, three} {
+			npp := npns.policies[uid(npns, "allow-odd-clients")]
+			expected := "ip, nw_dst=" + serverIP(npns) + ", reg0=3, ip, nw_src=10.3.0.4, "
+			if len(npp.flows) != 3 || npp.flows[2] != expected {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Policies were not updated for new pod")
+	}
+	assertEntry("namespaces[parity=odd]/pods[kind=client]", 2,
+		npSelectedPod{vnid: 1, ip: clientIP(one)},
+		npSelectedPod{vnid: 3, ip: clientIP(three)},
+		npSelectedPod{vnid: 3, ip: "10.3.0.4"},
+	)
+
+	// Deleting one of the policies using an entry leaves it in place; deleting the
+	// other removes it
+	synced.Store(false)
+	delNetworkPolicy(np, policies[0])
+	assertEntry("namespace[one]/pods[kind=server]", 1, npSelectedPod{ip: serverIP(one)})
+	assertEntry("namespace[one]/pods[kind=client]", 1, npSelectedPod{ip: clientIP(one)})
+	delNetworkPolicy(np, policies[1])
+	assertEntry("namespace[one]/pods[kind=server]", 0)
+	assertEntry("namespace[one]/pods[kind=client]", 0)
+
+	// Changing a policy's selectors releases the entries it no longer uses
+	updated := allowClientsPolicy(two, "allow-odd-clients", nil)
+	_, err = np.node.kClient.NetworkingV1().NetworkPolicies(two.name).Update(context.TODO(), updated, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error updating policy: %v", err)
+	}
+	err = waitForEvent(np, func() bool {
+		return np.podSelectors["namespace[two]/pods[kind=client]"] != nil
+	})
+	if err != nil {
+		t.Fatalf("Policy was not updated")
+	}
+	assertEntry("namespace[two]/pods[kind=client]", 1, npSelectedPod{ip: clientIP(two)})
+	assertEntry("namespaces[parity=odd]/pods[kind=client]", 1,
+		npSelectedPod{vnid: 1, ip: clientIP(one)},
+		npSelectedPod{vnid: 3, ip: clientIP(three)},
+		npSelectedPod{vnid: 3, ip: "10.3.0.4"},
+	)
+	np.lock.Lock()
+	if entry := np.namespaceSelectors["parity=odd"]; entry == nil || len(entry.users) != 1 || entry.users[uid(three, "allow-odd-clients")] != three {
+		t.Fatalf("unexpected namespace selector index %#v", np.namespaceSelectors)
+	}
+	np.lock.Unlock()
+
+	// Relabeling a namespace only recalculates the policies whose namespace
+	// selectors it matched before or after the change
+	synced.Store(false)
+	_, err = np.node.kClient.CoreV1().Namespaces().Update(context.TODO(), &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: two.name, Labels: map[string]string{"parity": "even", "prime": "true"}},
+	}, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error updating namespace: %v", err)
+	}
+	err = waitForEvent(np, func() bool { return two.labels["prime"] == "true" })
+	if err != nil {
+		t.Fatalf("Namespace was not updated")
+	}
+	np.lock.Lock()
+	if three.mustRecalculate {
+		t.Fatalf("unrelated policy was marked for recalculation")
+	}
+	np.lock.Unlock()
+
+	_, err = np.node.kClient.CoreV1().Namespaces().Update(context.TODO(), &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: two.name, Labels: map[string]string{"parity": "odd"}},
+	}, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error updating namespace: %v", err)
+	}
+	waitForSync(np, synced, "namespace relabel")
+	assertEntry("namespaces[parity=odd]/pods[kind=client]", 1,
+		npSelectedPod{vnid: 1, ip: clientIP(one)},
+		npSelectedPod{vnid: 2, ip: clientIP(two)},
+		npSelectedPod{vnid: 3, ip: clientIP(three)},
+		npSelectedPod{vnid: 3, ip: "10.3.0.4"},
+	)
+}
@@ -3,6 +3,8 @@ package node
 import (
 	"context"
 	"fmt"
+	"net"
+	"reflect"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -12,14 +14,20 @@ import (
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ktypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/util/sets"
 	utilwait "k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/component-base/metrics/testutil"
 	"k8s.io/kubernetes/pkg/util/async"
 
 	osdnv1 "github.com/openshift/api/network/v1"
+
+	"github.com/openshift/sdn/pkg/network/common"
+	"github.com/openshift/sdn/pkg/network/node/metrics"
 )
 
 func newTestNPP() (*networkPolicyPlugin, *atomic.Value, chan struct{}) {
@@ -251,6 +259,17 @@ func addPods(np *networkPolicyPlugin, npns *npNamespace) {
 	if err != nil {
 		panic(fmt.Sprintf("Unexpected error creating server pod: %v", err))
 	}
+
+	// Wait for the informer cache to catch up, since policies are computed from it
+	podLister := np.node.kubeInformers.Core().V1().Pods().Lister().Pods(npns.name)
+	err = waitForEvent(np, func() bool {
+		_, clientErr := podLister.Get(client.Name)
+		_, serverErr := podLister.Get(server.Name)
+		return clientErr == nil && serverErr == nil
+	})
+	if err != nil {
+		panic(fmt.Sprintf("Unexpected error waiting for pods in %q: %v", npns.name, err))
+	}
 }
 
 func addBadPods(np *networkPolicyPlugin, npns *npNamespace) {
@@ -760,16 +779,17 @@ func TestNetworkPolicy(t *testing.T) {
 		}
 	}
 
-	// If we delete a namespace, then stale policies may be left behind...
+	// If we delete a namespace, the policies that selected it are updated
 	forceSync(np, synced)
+	synced.Store(false)
 	delNamespace(np, "two", 2)
+	waitForSync(np, synced, "namespace deletion")
 	err = assertPolicies(np, npns1, 5, map[string]*npPolicy{
 		"allow-from-even": {
 			watchesNamespaces: true,
 			watchesAllPods:    false,
 			watchesOwnPods:    false,
 			flows: []string{
-				"reg0=2",
 				"reg0=4",
 				"reg0=6",
 				"reg0=8",
@@ -780,10 +800,13 @@ func TestNetworkPolicy(t *testing.T) {
 		t.Error(err.Error())
 	}
 
-	// ...but they'll be cleaned up as soon as we add any new namespace
-	synced.Store(false)
+	// Adding a namespace that no selector matches doesn't recalculate anything
 	addNamespace(np, "unrelated", 100, nil)
-	waitForSync(np, synced, "namespace addition")
+	np.lock.Lock()
+	if npns1.mustRecalculate {
+		t.Errorf("unrelated namespace caused unnecessary recalculation")
+	}
+	np.lock.Unlock()
 	err = assertPolicies(np, npns1, 5, map[string]*npPolicy{
 		"allow-from-even": {
 			watchesNamespaces: true,
@@ -1145,3 +1168,315 @@ func _TestNetworkPolicy_MultiplePoliciesOneNamespace(t *testing.T) {
 		}
 	}
 }
+
+func TestNetworkPolicyCompileFailed(t *testing.T) {
+	np := &networkPolicyPlugin{}
+	npns := newNPNamespace("one")
+	npns.vnid = 1
+
+	tcp := corev1.ProtocolTCP
+	namedPort := intstr.FromString("http")
+	numericPort := intstr.FromInt(80)
+	policy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "named-port",
+			Namespace: npns.name,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				Ports: []networkingv1.NetworkPolicyPort{{
+					Protocol: &tcp,
+					Port:     &namedPort,
+				}},
+			}},
+		},
+	}
+
+	npp := np.parseNetworkPolicy(npns, policy)
+	if len(npp.compileErrors) != 1 {
+		t.Errorf("expected policy with named port to fail to compile")
+	}
+	if status := common.NetworkPolicyStatus(policy); status != `PartiallyProgrammed: named port "http" is not supported` {
+		t.Errorf("unexpected status %q", status)
+	}
+
+	policy.Spec.Ingress[0].Ports[0].Port = &numericPort
+	npp = np.parseNetworkPolicy(npns, policy)
+	if len(npp.compileErrors) != 0 {
+		t.Errorf("expected policy with numeric port to compile")
+	}
+	if status := common.NetworkPolicyStatus(policy); status != common.NetworkPolicyStatusProgrammed {
+		t.Errorf("unexpected status %q", status)
+	}
+	if len(npp.flows) != 1 || npp.flows[0] != "tcp, tp_dst=80, " {
+		t.Errorf("unexpected flows %#v", npp.flows)
+	}
+}
+
+func hasNetworkPolicyMetric(t *testing.T, key string, labels map[string]string) bool {
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error gathering metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != metrics.SDNNamespace+"_"+metrics.SDNSubsystem+"_"+key {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if testutil.LabelsMatch(metric, labels) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestNetworkPolicyMetricsDeleted(t *testing.T) {
+	metrics.RegisterMetrics()
+	np, _, stopCh := newTestNPP()
+	defer close(stopCh)
+
+	addNamespace(np, "metrics", 1, nil)
+	npns := np.namespacesByName["metrics"]
+	newPolicy := func(name string) *networkingv1.NetworkPolicy {
+		return &networkingv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				UID:       uid(npns, name),
+				Namespace: npns.name,
+			},
+			Spec: networkingv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{},
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			},
+		}
+	}
+	policyLabels := map[string]string{"namespace": npns.name, "policy": "deny-all"}
+	namespaceLabels := map[string]string{"namespace": npns.name}
+
+	policy := newPolicy("deny-all")
+	addNetworkPolicy(np, policy)
+	if !hasNetworkPolicyMetric(t, metrics.NetworkPolicyFlowsKey, policyLabels) {
+		t.Fatalf("expected flows metric for policy")
+	}
+	if !hasNetworkPolicyMetric(t, metrics.NetworkPolicyCompileFailuresKey, namespaceLabels) {
+		t.Fatalf("expected compile failures metric for namespace")
+	}
+
+	delNetworkPolicy(np, policy)
+	if hasNetworkPolicyMetric(t, metrics.NetworkPolicyFlowsKey, policyLabels) {
+		t.Errorf("flows metric for deleted policy was not deleted")
+	}
+	if hasNetworkPolicyMetric(t, metrics.NetworkPolicyCompileFailuresKey, namespaceLabels) {
+		t.Errorf("compile failures metric for namespace with no policies was not deleted")
+	}
+
+	// Deleting the namespace deletes the metrics of the policies still in it
+	addNetworkPolicy(np, newPolicy("deny-all"))
+	delNamespace(np, "metrics", 1)
+	if hasNetworkPolicyMetric(t, metrics.NetworkPolicyFlowsKey, policyLabels) {
+		t.Errorf("flows metric for policy in deleted namespace was not deleted")
+	}
+	if hasNetworkPolicyMetric(t, metrics.NetworkPolicyCompileFailuresKey, namespaceLabels) {
+		t.Errorf("compile failures metric for deleted namespace was not deleted")
+	}
+}
+
+func TestCIDRsExcept(t *testing.T) {
+	tests := []struct {
+		cidr   string
+		except []string
+		result []string
+	}{
+		{
+			cidr:   "10.0.0.0/8",
+			except: nil,
+			result: []string{"10.0.0.0/8"},
+		},
+		{
+			cidr:   "10.0.0.0/8",
+			except: []string{"192.168.0.0/16"},
+			result: []string{"10.0.0.0/8"},
+		},
+		{
+			cidr:   "10.0.0.0/8",
+			except: []string{"10.0.0.0/8"},
+			result: []string{},
+		},
+		{
+			cidr:   "10.0.0.0/24",
+			except: []string{"10.0.0.0/26"},
+			result: []string{"10.0.0.64/26", "10.0.0.128/25"},
+		},
+		{
+			cidr:   "10.0.0.0/24",
+			except: []string{"10.0.0.128/26", "10.0.0.5/32"},
+			result: []string{"10.0.0.0/30", "10.0.0.4/32", "10.0.0.6/31", "10.0.0.8/29", "10.0.0.16/28", "10.0.0.32/27", "10.0.0.64/26", "10.0.0.192/26"},
+		},
+	}
+
+	for _, test := range tests {
+		result, err := cidrsExcept(test.cidr, test.except)
+		if err != nil {
+			t.Errorf("%s except %v: unexpected error: %v", test.cidr, test.except, err)
+		} else if !sets.NewString(result...).Equal(sets.NewString(test.result...)) || len(result) != len(test.result) {
+			t.Errorf("%s except %v: expected %v, got %v", test.cidr, test.except, test.result, result)
+		}
+	}
+
+	if _, err := cidrsExcept("10.0.0.0/8", []string{"bad"}); err == nil {
+		t.Errorf("expected error for bad except CIDR")
+	}
+}
+
+func TestCombinePolicyMatches(t *testing.T) {
+	tests := []struct {
+		dualStack        bool
+		dest, peer, port string
+		result           []string
+	}{
+		{
+			dest:   "ip, nw_dst=10.128.0.2, ",
+			peer:   "reg0=5, ",
+			port:   "tcp, tp_dst=80, ",
+			result: []string{"ip, nw_dst=10.128.0.2, reg0=5, tcp, tp_dst=80, "},
+		},
+		{
+			dest:   "",
+			peer:   "",
+			port:   "udp, tp_dst=53, ",
+			result: []string{"udp, tp_dst=53, "},
+		},
+		{
+			dualStack: true,
+			dest:      "",
+			peer:      "",
+			port:      "udp, tp_dst=53, ",
+			result:    []string{"udp, tp_dst=53, ", "udp6, tp_dst=53, "},
+		},
+		{
+			dualStack: true,
+			dest:      "ipv6, ipv6_dst=fd01::2, ",
+			peer:      "reg0=5, ",
+			port:      "sctp, ",
+			result:    []string{"ipv6, ipv6_dst=fd01::2, reg0=5, sctp6, "},
+		},
+		{
+			dualStack: true,
+			dest:      "ipv6, ipv6_dst=fd01::2, ",
+			peer:      "ip, nw_src=10.0.0.0/8, ",
+			port:      "",
+			result:    nil,
+		},
+		{
+			dualStack: true,
+			dest:      "",
+			peer:      "reg0=5, ",
+			port:      "",
+			result:    []string{"reg0=5, "},
+		},
+	}
+
+	for i, test := range tests {
+		result := combinePolicyMatches(test.dualStack, test.dest, test.peer, test.port)
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("%d: expected %q, got %q", i, test.result, result)
+		}
+	}
+}
+
+func TestEvaluateConnection(t *testing.T) {
+	np := &networkPolicyPlugin{namespaces: make(map[uint32]*npNamespace)}
+	npns := newNPNamespace("one")
+	npns.vnid = 1
+	np.namespaces[1] = npns
+
+	dstIP := net.ParseIP("10.128.0.3")
+	otherIP := net.ParseIP("10.128.0.4")
+	clientIP := net.ParseIP("10.128.0.2")
+	externalIP := net.ParseIP("192.168.1.5")
+
+	// No policies; everything is allowed
+	verdict, err := np.evaluateConnectionInternal(1, clientIP, 1, dstIP, "tcp", 80)
+	if err != nil || !verdict.Allowed || len(verdict.Policies) != 0 {
+		t.Fatalf("unexpected result %#v, %v", verdict, err)
+	}
+
+	npns.policies["allow-client-http"] = &npPolicy{
+		policy: networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: "allow-client-http"}},
+		flows: []string{
+			"ip, nw_dst=10.128.0.3, reg0=1, ip, nw_src=10.128.0.2, tcp, tp_dst=80, ",
+			"ip, nw_dst=10.128.0.3, ip, nw_src=192.168.0.0/16, tcp, tp_dst=80, ",
+		},
+		selectedIPs: []string{"10.128.0.3"},
+	}
+
+	tests := []struct {
+		name     string
+		srcVNID  uint32
+		srcIP    net.IP
+		dstIP    net.IP
+		protocol string
+		port     int
+		allowed  bool
+		policies []string
+	}{
+		{"allowed pod", 1, clientIP, dstIP, "tcp", 80, true, []string{"allow-client-http"}},
+		{"allowed ipBlock", 0, externalIP, dstIP, "tcp", 80, true, []string{"allow-client-http"}},
+		{"wrong port", 1, clientIP, dstIP, "tcp", 443, false, []string{"allow-client-http"}},
+		{"wrong protocol", 1, clientIP, dstIP, "udp", 80, false, []string{"allow-client-http"}},
+		{"wrong VNID", 2, clientIP, dstIP, "tcp", 80, false, []string{"allow-client-http"}},
+		{"unselected destination", 1, clientIP, otherIP, "tcp", 443, true, nil},
+	}
+	for _, test := range tests {
+		verdict, err := np.evaluateConnectionInternal(test.srcVNID, test.srcIP, 1, test.dstIP, test.protocol, test.port)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if verdict.Allowed != test.allowed || !reflect.DeepEqual(verdict.Policies, test.policies) {
+			t.Errorf("%s: unexpected result %#v", test.name, verdict)
+		}
+	}
+
+	if _, err := np.evaluateConnectionInternal(1, clientIP, 7, dstIP, "tcp", 80); err == nil {
+		t.Errorf("expected error for unknown VNID")
+	}
+}
+
+func TestNetworkPolicyFlows(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+	np := &networkPolicyPlugin{node: &OsdnNode{oc: oc}}
+
+	npns := newNPNamespace("ns")
+	npns.vnid = 42
+	npns.inUse = true
+	npns.policies = map[ktypes.UID]*npPolicy{
+		"allow-http": {
+			flows:       []string{"tcp, tp_dst=80, "},
+			selectedIPs: []string{"10.128.0.2"},
+		},
+	}
+
+	otx := oc.NewTransaction()
+	np.generateNamespaceFlows(otx, npns)
+	if err := otx.Commit(); err != nil {
+		t.Fatalf("Unexpected error generating flows: %v", err)
+	}
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+
+	// Allowed traffic must go through table 81 so the connection gets marked
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{kind: flowAdded, match: []string{"table=80", "priority=150", "reg1=42", "tp_dst=80", "actions=goto_table:81"}},
+		flowChange{kind: flowAdded, match: []string{"table=80", "priority=100", "reg1=42", "nw_dst=10.128.0.2", "actions=drop"}},
+		flowChange{kind: flowAdded, match: []string{"table=80", "priority=50", "reg1=42", "actions=goto_table:81"}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+}
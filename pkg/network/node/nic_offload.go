@@ -0,0 +1,231 @@
+package node
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// nicOffloadBug is a known NIC driver or firmware bug that corrupts VXLAN traffic
+// while some offload is enabled
+type nicOffloadBug struct {
+	driver string
+	// firmware, if set, is the prefix of the affected firmware versions
+	firmware string
+	// vxlanPort, if set, is the only VXLAN port the bug affects
+	vxlanPort uint32
+
+	description string
+	// features are the ethtool features that must be disabled to work around the bug
+	features []string
+}
+
+var knownNICOffloadBugs = []nicOffloadBug{
+	{
+		driver:      "vmxnet3",
+		vxlanPort:   4789,
+		description: "vmxnet3 on VMware virtual hardware version 14 and later corrupts VXLAN packets on port 4789 when transmit checksum offload is enabled",
+		features:    []string{"tx-checksum-ip-generic"},
+	},
+}
+
+// vxlanOffloadFeatures are the features reported when the self-test finds that large
+// VXLAN frames are being corrupted by a NIC that isn't in knownNICOffloadBugs
+var vxlanOffloadFeatures = []string{"tx-checksum-ip-generic", "tx-udp_tnl-segmentation", "tx-udp_tnl-csum-segmentation"}
+
+// nicDriverInfo is the output of "ethtool -i"
+type nicDriverInfo struct {
+	driver   string
+	version  string
+	firmware string
+}
+
+func parseEthtoolDriverInfo(out string) nicDriverInfo {
+	info := nicDriverInfo{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch parts[0] {
+		case "driver":
+			info.driver = value
+		case "version":
+			info.version = value
+		case "firmware-version":
+			info.firmware = value
+		}
+	}
+	return info
+}
+
+// parseEthtoolFeatures parses the output of "ethtool -k", returning whether each
+// feature that can be changed is enabled
+func parseEthtoolFeatures(out string) map[string]bool {
+	features := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 || strings.HasPrefix(parts[0], "Features for") {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		if strings.HasSuffix(value, "[fixed]") {
+			continue
+		}
+		features[strings.TrimSpace(parts[0])] = strings.HasPrefix(value, "on")
+	}
+	return features
+}
+
+// findNICOffloadBug returns the known bug affecting a NIC with the given driver
+// info, if any
+func findNICOffloadBug(info nicDriverInfo, vxlanPort uint32) *nicOffloadBug {
+	for i := range knownNICOffloadBugs {
+		bug := &knownNICOffloadBugs[i]
+		if bug.driver != info.driver {
+			continue
+		}
+		if bug.firmware != "" && !strings.HasPrefix(info.firmware, bug.firmware) {
+			continue
+		}
+		if bug.vxlanPort != 0 && bug.vxlanPort != vxlanPort {
+			continue
+		}
+		return bug
+	}
+	return nil
+}
+
+func (node *OsdnNode) ethtool(args ...string) (string, error) {
+	out, err := node.execer.Command("ethtool", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ethtool %s failed: %v (%s)", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// enabledOffloadFeatures returns those of features that are enabled on iface
+func (node *OsdnNode) enabledOffloadFeatures(iface string, features []string) ([]string, error) {
+	out, err := node.ethtool("-k", iface)
+	if err != nil {
+		return nil, err
+	}
+	enabled := parseEthtoolFeatures(out)
+
+	var found []string
+	for _, feature := range features {
+		if enabled[feature] {
+			found = append(found, feature)
+		}
+	}
+	return found, nil
+}
+
+// vxlanSelfTest pings another node's pod network gateway with small and large
+// packets, which are sent to it over VXLAN. It returns a description of the
+// problem if the large packets are lost but the small ones are not, or "" if there
+// is no problem (or if there are no other nodes to test against).
+func (node *OsdnNode) vxlanSelfTest() (string, error) {
+	subnets, err := node.osdnInformers.Network().V1().HostSubnets().Lister().List(labels.Everything())
+	if err != nil {
+		return "", err
+	}
+	var peer, peerNode string
+	for _, hs := range subnets {
+		if hs.Host == node.hostName || hs.Subnet == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(hs.Subnet)
+		if err != nil {
+			continue
+		}
+		peer = common.GenerateDefaultGateway(subnet).String()
+		peerNode = hs.Host
+		break
+	}
+	if peer == "" {
+		klog.V(2).Infof("No other nodes to run VXLAN offload self-test against")
+		return "", nil
+	}
+
+	ping := func(size int) bool {
+		err := node.execer.Command("ping", "-q", "-c", "3", "-W", "2", "-M", "do", "-s", strconv.Itoa(size), peer).Run()
+		return err == nil
+	}
+	if !ping(56) {
+		// Can't reach the peer at all; that's not an offload problem
+		return "", fmt.Errorf("could not reach node %s (%s) for VXLAN offload self-test", peerNode, peer)
+	}
+	// The largest ICMP payload that fits in the pod network MTU
+	large := int(node.networkInfo.MTU) - 28
+	if ping(large) {
+		return "", nil
+	}
+	return fmt.Sprintf("self-test pings of %d bytes to node %s over VXLAN were lost while small pings were delivered", large, peerNode), nil
+}
+
+// checkNICOffload checks the NIC carrying VXLAN traffic for offload bugs that corrupt
+// it, first against knownNICOffloadBugs and then with vxlanSelfTest(), and if it
+// finds one with the offending offloads enabled, emits an event on the Node. It only
+// reports the problem; disabling the offloads is left to the administrator, since
+// they are shared with everything else using the NIC.
+func (node *OsdnNode) checkNICOffload() {
+	link, _, err := GetLinkDetails(node.localIP)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not find interface for NIC offload check: %v", err))
+		return
+	}
+	iface := link.Attrs().Name
+	out, err := node.ethtool("-i", iface)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not check NIC offload: %v", err))
+		return
+	}
+	info := parseEthtoolDriverInfo(out)
+	klog.V(2).Infof("Checking NIC offload on %s (driver %s %s, firmware %s)", iface, info.driver, info.version, info.firmware)
+
+	var problem string
+	var features []string
+	if bug := findNICOffloadBug(info, node.networkInfo.VXLANPort); bug != nil {
+		problem = bug.description
+		features = bug.features
+	} else {
+		problem, err = node.vxlanSelfTest()
+		if err != nil {
+			utilruntime.HandleError(err)
+			return
+		}
+		features = vxlanOffloadFeatures
+	}
+	if problem == "" {
+		return
+	}
+
+	enabled, err := node.enabledOffloadFeatures(iface, features)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("NIC offload problem on %s: %s; could not check offloads: %v", iface, problem, err))
+		return
+	} else if len(enabled) == 0 {
+		klog.Infof("NIC offload problem on %s: %s; offloads %s are already disabled", iface, problem, strings.Join(features, ", "))
+		return
+	}
+
+	klog.Warningf("NIC offload problem on %s: %s; offloads %s should be disabled", iface, problem, strings.Join(enabled, ", "))
+	nodeRef := &corev1.ObjectReference{Kind: "Node", Name: node.hostName}
+	node.recorder.Eventf(nodeRef, corev1.EventTypeWarning, "NICOffloadProblem",
+		"Interface %s (driver %s, firmware %s) may corrupt VXLAN traffic: %s. Disable %s (eg, \"ethtool -K %s %s off\") to work around it.",
+		iface, info.driver, info.firmware, problem, strings.Join(enabled, ", "), iface, strings.Join(enabled, " off "))
+}
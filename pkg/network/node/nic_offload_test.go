@@ -0,0 +1,50 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEthtool(t *testing.T) {
+	info := parseEthtoolDriverInfo(`driver: vmxnet3
+version: 1.5.0.0-k-NAPI
+firmware-version:
+expansion-rom-version:
+bus-info: 0000:0b:00.0
+supports-statistics: yes
+`)
+	if !reflect.DeepEqual(info, nicDriverInfo{driver: "vmxnet3", version: "1.5.0.0-k-NAPI"}) {
+		t.Fatalf("unexpected driver info %#v", info)
+	}
+
+	features := parseEthtoolFeatures(`Features for ens192:
+rx-checksumming: on
+tx-checksumming: on
+	tx-checksum-ipv4: off [fixed]
+	tx-checksum-ip-generic: on
+tx-udp_tnl-segmentation: off
+tx-udp_tnl-csum-segmentation: on [requested off]
+`)
+	expected := map[string]bool{
+		"rx-checksumming":              true,
+		"tx-checksumming":              true,
+		"tx-checksum-ip-generic":       true,
+		"tx-udp_tnl-segmentation":      false,
+		"tx-udp_tnl-csum-segmentation": true,
+	}
+	if !reflect.DeepEqual(features, expected) {
+		t.Fatalf("unexpected features: expected %v, got %v", expected, features)
+	}
+}
+
+func TestFindNICOffloadBug(t *testing.T) {
+	if bug := findNICOffloadBug(nicDriverInfo{driver: "vmxnet3"}, 4789); bug == nil {
+		t.Fatalf("expected vmxnet3 to be affected on port 4789")
+	}
+	if bug := findNICOffloadBug(nicDriverInfo{driver: "vmxnet3"}, 9000); bug != nil {
+		t.Fatalf("expected vmxnet3 not to be affected on port 9000, got %#v", bug)
+	}
+	if bug := findNICOffloadBug(nicDriverInfo{driver: "ixgbe", firmware: "0x800007f4"}, 4789); bug != nil {
+		t.Fatalf("expected ixgbe not to be affected, got %#v", bug)
+	}
+}
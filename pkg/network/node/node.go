@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
@@ -19,9 +20,11 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	kwait "k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/record"
@@ -42,6 +45,7 @@ import (
 	"github.com/openshift/library-go/pkg/network/networkutils"
 	"github.com/openshift/sdn/pkg/network/common"
 	"github.com/openshift/sdn/pkg/network/common/cniserver"
+	"github.com/openshift/sdn/pkg/util/bgp"
 	"github.com/openshift/sdn/pkg/util/ovs"
 )
 
@@ -58,11 +62,27 @@ type osdnPolicy interface {
 	GetVNID(namespace string) (uint32, error)
 	GetNamespaces(vnid uint32) []string
 	GetMulticastEnabled(vnid uint32) bool
+	GetMulticastGrants(vnid uint32) []multicastGrantTarget
+	GetMulticastGrantSenders(vnid uint32) []uint32
+	GetSharedServiceVNIDs(vnid uint32) []uint32
 
 	EnsureVNIDRules(vnid uint32)
 	SyncVNIDRules()
+	// ResyncVNIDRules rewrites the policy flows of every VNID in use, whether or not
+	// they appear to have changed
+	ResyncVNIDRules()
 }
 
+// DefaultReconcilePeriod is the default value of OsdnNodeConfig.ReconcilePeriod
+const DefaultReconcilePeriod = time.Hour
+
+// unusedVNIDCleanupPeriod is how often the flows of unused VNIDs are removed when
+// periodic reconciliation is disabled
+var unusedVNIDCleanupPeriod = time.Hour
+
+// DefaultPodReattachWorkers is the default value of OsdnNodeConfig.PodReattachWorkers
+const DefaultPodReattachWorkers = 8
+
 type OsdnNodeConfig struct {
 	NodeName string
 	NodeIP   string
@@ -75,8 +95,128 @@ type OsdnNodeConfig struct {
 	OSDNInformers osdninformers.SharedInformerFactory
 
 	IPTables      iptables.Interface
+	Exec          kexec.Interface
 	ProxyMode     kubeproxyconfig.ProxyMode
 	MasqueradeBit *int32
+
+	// EgressDNSServers, if set, overrides the nameservers used to resolve
+	// EgressNetworkPolicy dnsNames
+	EgressDNSServers []string
+	// EgressDNSResolvConf, if set, is the resolv.conf file to read nameservers
+	// from, if EgressDNSServers is not set
+	EgressDNSResolvConf string
+
+	// ClusterDNS and ClusterDomain are the kubelet's clusterDNS and clusterDomain.
+	// If ClusterDNS is set, it is returned in the CNI result for each pod, along
+	// with search domains under ClusterDomain.
+	ClusterDNS    []string
+	ClusterDomain string
+
+	// ReconcilePeriod is how often to reconcile the node's VNID flows and
+	// iptables rules. If 0, the node only updates them in response to events
+	// or calls to Reconcile(), though it still removes the flows of unused VNIDs
+	// hourly.
+	ReconcilePeriod time.Duration
+
+	// ConnectionLogPath, if set, is a file to write a JSON record of each new
+	// connection to or from a pod (and, with the NetworkPolicy plugin, of traffic
+	// dropped by NetworkPolicy) to, for security auditing. ConnectionLogQPS
+	// limits the number of records written per second, and the file is rotated
+	// once it reaches ConnectionLogMaxSize bytes.
+	ConnectionLogPath    string
+	ConnectionLogQPS     float64
+	ConnectionLogMaxSize int64
+
+	// MigrationMode, if set, runs the node alongside OVN-Kubernetes during a live
+	// migration: existing pods keep working, but no new pods are set up and no
+	// egress IPs are hosted, and the node is torn down once its Node has
+	// MigrationTeardownAnnotation and all of its pods are gone. MigrationTornDown,
+	// if set, is called after the node has been torn down.
+	MigrationMode     bool
+	MigrationTornDown func() error
+
+	// NICOffloadCheck, if set, checks at startup whether the NIC carrying VXLAN
+	// traffic has an offload bug that corrupts it, and if so reports it.
+	NICOffloadCheck bool
+
+	// NeighborGCThreshMax, if non-0, lets the node raise the kernel's neighbor table
+	// garbage collection thresholds when the table is nearly full, up to this many
+	// entries for gc_thresh3.
+	NeighborGCThreshMax int
+
+	// OVSFlowLimit and OVSTableFlowLimit, if non-0, are the number of OVS flows in
+	// total, and in any one table, above which the datapath is expected to degrade.
+	// The node emits a warning event when the flows approach either limit.
+	OVSFlowLimit      int
+	OVSTableFlowLimit int
+
+	// CNIAllowedExecutables, if set, restricts connections to the CNI server to
+	// processes running one of these executables
+	CNIAllowedExecutables []string
+
+	// PodReattachWorkers is the number of existing pods to set up again in
+	// parallel when the node restarts with a changed network. If 0, it defaults
+	// to DefaultPodReattachWorkers.
+	PodReattachWorkers int
+
+	// EgressFirewallExemptNodeSelector, if set, is a label selector for nodes whose
+	// IPs are exempt from EgressNetworkPolicy rules (eg, infra nodes running a
+	// registry that pods must always be able to reach)
+	EgressFirewallExemptNodeSelector string
+
+	// MulticastGatewayGroups, if set, is a list of IPv4 multicast groups, as
+	// "address:port", to bridge between multicast-enabled namespaces and the
+	// node's network
+	MulticastGatewayGroups []string
+
+	// IPAM is the pod IPAM backend: HostLocalIPAM (the default) or ClusterIPAM.
+	// IPAMClient is the client to manage PodIPLeases with, for ClusterIPAM.
+	IPAM       string
+	IPAMClient dynamic.Interface
+
+	// IPAMLeakCheckPeriod is how often to look for pod IP allocations that don't
+	// belong to any running sandbox, and release those allocated more than
+	// IPAMLeakMinAge ago. If 0, leaked allocations are never released.
+	IPAMLeakCheckPeriod time.Duration
+	IPAMLeakMinAge      time.Duration
+
+	// PodNetworkStatus, if set, writes the NetworkAttachmentDefinition
+	// specification's network-status annotation (NetworkStatusAnnotation) on each
+	// new pod. It should not be set when running under Multus, which writes the
+	// annotation itself.
+	PodNetworkStatus bool
+
+	// AdminNetworkPolicyClient, if set, is used to watch AdminNetworkPolicies and
+	// BaselineAdminNetworkPolicies, which are then enforced by the NetworkPolicy
+	// plugin
+	AdminNetworkPolicyClient dynamic.Interface
+
+	// BGPPeers, if set, is a list of IPv4 routers ("address" or "address:port")
+	// to advertise the node's HostSubnet to over BGP, as BGPLocalAS, to peers in
+	// BGPPeerAS. Pod traffic to other nodes is then routed by the node's network
+	// rather than sent over VXLAN. This requires the subnet plugin, since routed
+	// traffic doesn't carry the sending pod's VNID. The peers can be a routing
+	// daemon such as FRR or GoBGP on the node itself, which then handles
+	// redistribution into the network, BFD, etc. BGPGracefulRestartTime, if set,
+	// is how long peers that support graceful restart keep routing to the
+	// HostSubnet while the node's session is down.
+	BGPPeers               []string
+	BGPLocalAS             uint32
+	BGPPeerAS              uint32
+	BGPGracefulRestartTime time.Duration
+
+	// NativeRouting, if set, routes pod traffic to nodes on the same network as
+	// this one directly to them rather than sending it over VXLAN, which is only
+	// used for nodes on other networks (or that don't use routing themselves).
+	// Like BGPPeers, it requires the subnet plugin.
+	NativeRouting bool
+
+	// Encapsulations are the encapsulations other than VXLAN (currently only
+	// "geneve") that the node can receive pod traffic with. Each pair of nodes uses
+	// the most preferred encapsulation that they both support, as advertised on
+	// their HostSubnets, so nodes with different encapsulations can be mixed in a
+	// cluster. BGPPeers and NativeRouting add the "none" encapsulation.
+	Encapsulations []string
 }
 
 type OsdnNode struct {
@@ -85,22 +225,83 @@ type OsdnNode struct {
 	osdnClient       osdnclient.Interface
 	recorder         record.EventRecorder
 	oc               *ovsController
+	ovsCheckpoint    *ovsCheckpoint
 	networkInfo      *common.ParsedClusterNetwork
 	podManager       *podManager
 	ipt              iptables.Interface
+	execer           kexec.Interface
 	nodeIPTables     *NodeIPTables
-	clusterCIDRs     []string
 	localSubnetCIDR  string
 	localGatewayCIDR string
 	localIP          string
 	hostName         string
 	useConnTrack     bool
 	masqueradeBit    uint32
+	reconcilePeriod  time.Duration
+	nicOffloadCheck  bool
+
+	podReattachWorkers int
+
+	ipamLeakCheckPeriod time.Duration
+	ipamLeakScanner     *ipamLeakScanner
+
+	neighborGCThreshMax int
+	flowTableStats      *flowTableStats
+
+	// bgpPeers is empty unless the node advertises its HostSubnet over BGP;
+	// bgpSpeaker is set once it has started doing so
+	bgpPeers   []bgp.Peer
+	bgpLocalAS uint32
+	bgpGRTime  time.Duration
+	bgpSpeaker *bgp.Speaker
+
+	nativeRouting bool
+	// encapsulations are the encapsulations that the node supports, including
+	// VXLAN, and "none" if it uses BGP or native routing
+	encapsulations sets.String
+	// hsw is set once the node has started watching HostSubnets
+	hsw *hostSubnetWatcher
+
+	// Only set in dual-stack clusters
+	localSubnetIPv6CIDR  string
+	localGatewayIPv6CIDR string
+
+	// clusterCIDRs can change at runtime; see clusterNetworkWatcher
+	clusterCIDRsLock sync.Mutex
+	clusterCIDRs     []string
 
 	// Synchronizes operations on egressPolicies
 	egressPoliciesLock sync.Mutex
 	egressPolicies     map[uint32][]osdnv1.EgressNetworkPolicy
 	egressDNS          *common.EgressDNS
+	// egressServiceVNIDs maps the "namespace/name" of each Service referred to by
+	// an EgressNetworkPolicy to the VNIDs of the policies that refer to it
+	egressServiceVNIDs map[string]sets.Int
+	// egressExemptions is nil unless EgressFirewallExemptNodeSelector is set
+	egressExemptions *egressFirewallExemptions
+	// multicastGateway is nil unless MulticastGatewayGroups is set
+	multicastGateway *multicastGateway
+	// hairpin tracks the services whose hairpin traffic is NATted to their IPs
+	hairpin *hairpinServices
+	// directAttach tracks the namespaces using direct-attach
+	directAttach *directAttachNamespaces
+
+	egressFirewallStats *egressFirewallStats
+	trafficStats        *trafficStats
+
+	// connectionLogger is only set if connection logging is enabled
+	connectionLogger *connectionLogger
+
+	// adminPolicyClient is only set if AdminNetworkPolicy support is enabled
+	adminPolicyClient dynamic.Interface
+
+	migrationMode     bool
+	migrationTornDown func() error
+	migrationLock     sync.Mutex
+	// teardownRequested is set once our Node has MigrationTeardownAnnotation, and
+	// tornDown once the node's networking has been removed in migration mode
+	teardownRequested bool
+	tornDown          bool
 
 	kubeInformers informers.SharedInformerFactory
 	osdnInformers osdninformers.SharedInformerFactory
@@ -109,6 +310,20 @@ type OsdnNode struct {
 	runtimeService kubeletapi.RuntimeService
 
 	egressIP *egressIPWatcher
+
+	localVNIDs *localVNIDs
+
+	// The checks reported by ServeHealthz
+	health healthChecks
+	// hostIPLock protects localIP, once the node has started, and changedHostIP,
+	// the HostIP that the master has given our HostSubnet if we could not switch
+	// localIP to it (see handleLocalHostIPUpdated)
+	hostIPLock    sync.Mutex
+	changedHostIP string
+	// The last status published to our HostSubnet, and when our SDN Lease was
+	// last renewed; only accessed from the publishSDNStatus goroutine
+	lastSDNStatus       *common.NodeSDNStatus
+	lastSDNLeaseRenewal time.Time
 }
 
 // Called by higher layers to create the plugin SDN node instance
@@ -122,10 +337,15 @@ func New(c *OsdnNodeConfig) (*OsdnNode, error) {
 		return nil, err
 	}
 
+	pluginName, err := getNodePluginName(c.KClient, c.NodeName, networkInfo.PluginName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get node: %v", err)
+	}
+
 	var policy osdnPolicy
 	var pluginId int
 	var useConnTrack bool
-	switch strings.ToLower(networkInfo.PluginName) {
+	switch strings.ToLower(pluginName) {
 	case networkutils.SingleTenantPluginName:
 		policy = NewSingleTenantPlugin()
 		pluginId = 0
@@ -141,27 +361,32 @@ func New(c *OsdnNodeConfig) (*OsdnNode, error) {
 		pluginId = 2
 		useConnTrack = true
 	default:
-		return nil, fmt.Errorf("Unknown plugin name %q", networkInfo.PluginName)
+		return nil, fmt.Errorf("Unknown plugin name %q", pluginName)
 	}
 
 	if useConnTrack && c.ProxyMode == kubeproxyconfig.ProxyModeUserspace {
-		return nil, fmt.Errorf("%q plugin is not compatible with proxy-mode %q", networkInfo.PluginName, c.ProxyMode)
+		return nil, fmt.Errorf("%q plugin is not compatible with proxy-mode %q", pluginName, c.ProxyMode)
+	}
+	if c.AdminNetworkPolicyClient != nil && strings.ToLower(pluginName) != networkutils.NetworkPolicyPluginName {
+		return nil, fmt.Errorf("AdminNetworkPolicy is only supported by the %q plugin", networkutils.NetworkPolicyPluginName)
 	}
 
-	klog.Infof("Initializing SDN node %q (%s) of type %q", c.NodeName, c.NodeIP, networkInfo.PluginName)
+	klog.Infof("Initializing SDN node %q (%s) of type %q", c.NodeName, c.NodeIP, pluginName)
 
-	ovsif, err := ovs.New(kexec.New(), Br0)
+	ovsif, err := ovs.New(c.Exec, Br0)
 	if err != nil {
 		return nil, err
 	}
-	oc := NewOVSController(ovsif, pluginId, useConnTrack, c.NodeIP)
+	ovsCheckpoint := newOVSCheckpoint(ovsif)
+	oc := NewOVSController(ovsCheckpoint, pluginId, useConnTrack, c.NodeIP)
+	oc.dualStack = len(networkInfo.IPv6ClusterNetworks) > 0
 
 	masqBit := uint32(0)
 	if c.MasqueradeBit != nil {
 		masqBit = uint32(*c.MasqueradeBit)
 	}
 
-	egressDNS, err := common.NewEgressDNS(true, false)
+	egressDNS, err := common.NewEgressDNS(true, oc.dualStack, c.EgressDNSResolvConf, c.EgressDNSServers, metrics.ObserveEgressDNSResolution)
 	if err != nil {
 		return nil, err
 	}
@@ -172,18 +397,92 @@ func New(c *OsdnNodeConfig) (*OsdnNode, error) {
 		osdnClient:     c.OSDNClient,
 		recorder:       c.Recorder,
 		oc:             oc,
+		ovsCheckpoint:  ovsCheckpoint,
 		networkInfo:    networkInfo,
 		podManager:     newPodManager(c.KClient, policy, networkInfo.MTU, oc),
 		localIP:        c.NodeIP,
 		hostName:       c.NodeName,
 		useConnTrack:   useConnTrack,
 		ipt:            c.IPTables,
+		execer:         c.Exec,
 		masqueradeBit:  masqBit,
 		egressPolicies: make(map[uint32][]osdnv1.EgressNetworkPolicy),
 		egressDNS:      egressDNS,
 		kubeInformers:  c.KubeInformers,
 		osdnInformers:  c.OSDNInformers,
 		egressIP:       newEgressIPWatcher(oc, c.NodeIP, c.MasqueradeBit),
+		localVNIDs:     newLocalVNIDs(),
+
+		egressFirewallStats: newEgressFirewallStats(),
+		trafficStats:        newTrafficStats(),
+		reconcilePeriod:     c.ReconcilePeriod,
+		podReattachWorkers:  c.PodReattachWorkers,
+		ipamLeakCheckPeriod: c.IPAMLeakCheckPeriod,
+		migrationMode:       c.MigrationMode,
+		nicOffloadCheck:     c.NICOffloadCheck,
+		neighborGCThreshMax: c.NeighborGCThreshMax,
+		flowTableStats:      newFlowTableStats(c.OVSFlowLimit, c.OVSTableFlowLimit),
+		hairpin:             newHairpinServices(),
+		directAttach:        newDirectAttachNamespaces(),
+		egressServiceVNIDs:  make(map[string]sets.Int),
+		bgpLocalAS:          c.BGPLocalAS,
+		bgpGRTime:           c.BGPGracefulRestartTime,
+		nativeRouting:       c.NativeRouting,
+	}
+	plugin.encapsulations = sets.NewString(common.EncapsulationVXLAN)
+	for _, encap := range c.Encapsulations {
+		if encap != common.EncapsulationVXLAN && encap != common.EncapsulationGeneve {
+			return nil, fmt.Errorf("unsupported encapsulation %q", encap)
+		}
+		plugin.encapsulations.Insert(encap)
+	}
+	if len(c.BGPPeers) > 0 || c.NativeRouting {
+		if policy.SupportsVNIDs() {
+			return nil, fmt.Errorf("BGP peers and native routing can only be used with the %q plugin", networkutils.SingleTenantPluginName)
+		}
+		plugin.encapsulations.Insert(common.EncapsulationNone)
+	}
+	oc.geneve = plugin.encapsulations.Has(common.EncapsulationGeneve)
+	if len(c.BGPPeers) > 0 {
+		plugin.bgpPeers, err = parseBGPPeers(c.BGPPeers, c.BGPPeerAS)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.EgressFirewallExemptNodeSelector != "" {
+		selector, err := labels.Parse(c.EgressFirewallExemptNodeSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid egress firewall exempt node selector %q: %v", c.EgressFirewallExemptNodeSelector, err)
+		}
+		plugin.egressExemptions = &egressFirewallExemptions{selector: selector}
+	}
+	if len(c.MulticastGatewayGroups) > 0 {
+		groups, err := parseMulticastGatewayGroups(c.MulticastGatewayGroups)
+		if err != nil {
+			return nil, err
+		}
+		plugin.multicastGateway = newMulticastGateway(groups)
+		plugin.podManager.multicastGateway = plugin.multicastGateway
+	}
+	if plugin.podReattachWorkers <= 0 {
+		plugin.podReattachWorkers = DefaultPodReattachWorkers
+	}
+	plugin.podManager.migrating = c.MigrationMode
+	plugin.egressIP.migrating = c.MigrationMode
+	plugin.migrationTornDown = c.MigrationTornDown
+	plugin.adminPolicyClient = c.AdminNetworkPolicyClient
+	plugin.podManager.clusterDNS = c.ClusterDNS
+	plugin.podManager.clusterDomain = c.ClusterDomain
+	plugin.podManager.cniAllowedExecutables = c.CNIAllowedExecutables
+	plugin.ipamLeakScanner = &ipamLeakScanner{node: plugin, minAge: c.IPAMLeakMinAge}
+	plugin.podManager.recorder = c.Recorder
+	plugin.podManager.networkStatus = c.PodNetworkStatus
+	plugin.podManager.ipamType = c.IPAM
+	plugin.podManager.ipamClient = c.IPAMClient
+	plugin.podManager.nodeName = c.NodeName
+	plugin.egressIP.tracker.SetFailbackDelay(networkInfo.EgressIPFailbackDelay)
+	if c.ConnectionLogPath != "" {
+		plugin.connectionLogger = newConnectionLogger(plugin, c.ConnectionLogPath, c.ConnectionLogQPS, c.ConnectionLogMaxSize)
 	}
 
 	metrics.RegisterMetrics()
@@ -242,17 +541,17 @@ func GetLinkDetails(ip string) (netlink.Link, *net.IPNet, error) {
 	return nil, nil, ErrorNetworkInterfaceNotFound
 }
 
-func (node *OsdnNode) validateMTU() error {
-	klog.V(2).Infof("Checking default interface MTU")
-
+// getUnderlayMTU returns the MTU of the interface with the node's primary IP, which
+// carries its VXLAN traffic
+func (node *OsdnNode) getUnderlayMTU() (int, error) {
 	// Get the interface with the default route
 	// TODO(cdc) handle v6-only nodes
 	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
 	if err != nil {
-		return fmt.Errorf("could not list routes while validating MTU: %v", err)
+		return 0, fmt.Errorf("could not list routes while checking MTU: %v", err)
 	}
 	if len(routes) == 0 {
-		return fmt.Errorf("got no routes while validating MTU")
+		return 0, fmt.Errorf("got no routes while checking MTU")
 	}
 
 	const maxMTU = 65536
@@ -264,7 +563,7 @@ func (node *OsdnNode) validateMTU() error {
 		}
 		link, err := netlink.LinkByIndex(route.LinkIndex)
 		if err != nil {
-			return fmt.Errorf("could not retrieve link id %d while validating MTU", route.LinkIndex)
+			return 0, fmt.Errorf("could not retrieve link id %d while checking MTU", route.LinkIndex)
 		}
 
 		// we want to check the mtu only for the interface assigned to the node's primary ip
@@ -286,7 +585,16 @@ func (node *OsdnNode) validateMTU() error {
 		}
 	}
 	if mtu > maxMTU {
-		return fmt.Errorf("unable to determine MTU while performing validation")
+		return 0, fmt.Errorf("unable to determine MTU of default interface")
+	}
+	return mtu, nil
+}
+
+func (node *OsdnNode) validateMTU() error {
+	klog.V(2).Infof("Checking default interface MTU")
+	mtu, err := node.getUnderlayMTU()
+	if err != nil {
+		return err
 	}
 
 	needsTaint := mtu < int(node.networkInfo.MTU)+50
@@ -352,16 +660,33 @@ func (node *OsdnNode) Start() error {
 	klog.V(2).Infof("Starting openshift-sdn network plugin")
 
 	var err error
-	node.localSubnetCIDR, err = node.getLocalSubnet()
+	node.localSubnetCIDR, node.localSubnetIPv6CIDR, err = node.getLocalSubnet()
 	if err != nil {
 		return err
 	}
 
+	if node.migrationMode && !node.ovsSetUp() {
+		// The node was already torn down (or never set up); don't claim it again
+		klog.Infof("SDN is not set up on this node; not starting it in migration mode")
+		node.migrationLock.Lock()
+		node.tornDown = true
+		node.migrationLock.Unlock()
+		return nil
+	}
+	if node.migrationMode {
+		node.watchMigrationTeardown()
+	}
+	node.watchPluginMigration()
+
+	var clusterCIDRs []string
 	for _, cn := range node.networkInfo.ClusterNetworks {
-		node.clusterCIDRs = append(node.clusterCIDRs, cn.ClusterCIDR.String())
+		clusterCIDRs = append(clusterCIDRs, cn.ClusterCIDR.String())
 	}
+	node.setClusterCIDRs(clusterCIDRs)
 
-	node.nodeIPTables = newNodeIPTables(node.ipt, node.clusterCIDRs, !node.useConnTrack, node.networkInfo.VXLANPort, node.masqueradeBit)
+	node.addDefaultHealthChecks()
+
+	node.nodeIPTables = newNodeIPTables(node.ipt, clusterCIDRs, !node.useConnTrack, node.networkInfo.VXLANPort, node.masqueradeBit, node.encapsulations)
 	if err = node.nodeIPTables.Setup(); err != nil {
 		return fmt.Errorf("failed to set up iptables: %v", err)
 	}
@@ -371,8 +696,30 @@ func (node *OsdnNode) Start() error {
 		return fmt.Errorf("node SDN setup failed: %v", err)
 	}
 
-	hsw := newHostSubnetWatcher(node.oc, node.localIP, node.networkInfo)
-	hsw.Start(node.osdnInformers)
+	hsw := newHostSubnetWatcher(node.oc, node.hostName, node.localIP, node.networkInfo)
+	hsw.localHostIPUpdated = node.handleLocalHostIPUpdated
+	hsw.encapsulations = node.encapsulations
+	hsw.recorder = node.recorder
+	hsw.removeStaleRoutes = func(keep sets.String) error {
+		return removeStaleHostSubnetRoutes(node.networkInfo, keep)
+	}
+	node.hsw = hsw
+	node.publishHostSubnetAnnotations()
+	if node.routed() {
+		if len(node.bgpPeers) > 0 {
+			if err := node.startBGP(!networkChanged); err != nil {
+				return err
+			}
+		}
+		if hsw.routeSubnet, err = node.getHostSubnetRouter(); err != nil {
+			return err
+		}
+		hsw.updateRoute = updateHostSubnetRoute
+	}
+	hsw.Start(node.osdnInformers, !networkChanged)
+
+	cnw := newClusterNetworkWatcher(node)
+	cnw.Start(node.osdnInformers)
 
 	if err = node.policy.Start(node); err != nil {
 		return err
@@ -381,13 +728,27 @@ func (node *OsdnNode) Start() error {
 		if err := node.SetupEgressNetworkPolicy(); err != nil {
 			return err
 		}
-		if err := node.egressIP.Start(node.osdnInformers, node.nodeIPTables); err != nil {
+		if err := node.setupEgressFirewallExemptions(); err != nil {
+			return err
+		}
+		if err := node.setupMulticastGateway(); err != nil {
+			return err
+		}
+		if err := node.egressIP.Start(node.osdnClient, node.hostName, node.osdnInformers, node.nodeIPTables, node.execer); err != nil {
 			return err
 		}
 	}
 	if !node.useConnTrack {
 		node.watchServices()
 	}
+	node.watchLoadBalancerServices()
+	node.watchHairpinServices()
+	node.watchDirectAttachNamespaces()
+	if node.connectionLogger != nil {
+		if err := node.connectionLogger.Start(); err != nil {
+			return err
+		}
+	}
 
 	existingPodSandboxes, err := node.getSDNPodSandboxes()
 	if err != nil {
@@ -397,8 +758,12 @@ func (node *OsdnNode) Start() error {
 	if err = node.podManager.InitRunningPods(existingPodSandboxes, existingOFPodNetworks); err != nil {
 		return err
 	}
+	node.podManager.localVNIDsChanged = node.updateLocalVNIDs
+	node.updateLocalVNIDs()
 
 	klog.V(2).Infof("Starting openshift-sdn pod manager")
+	node.podManager.localSubnetIPv6CIDR = node.localSubnetIPv6CIDR
+	node.podManager.ipv6ClusterNetworks = node.networkInfo.IPv6ClusterNetworks
 	if err := node.podManager.Start(cniserver.CNIServerRunDir, node.localSubnetCIDR,
 		node.networkInfo.ClusterNetworks, node.networkInfo.ServiceNetwork.String()); err != nil {
 		return err
@@ -414,24 +779,63 @@ func (node *OsdnNode) Start() error {
 	if err := node.FinishSetupSDN(); err != nil {
 		return fmt.Errorf("could not complete SDN setup: %v", err)
 	}
+	go func() {
+		node.waitForStartupReady()
+		if !networkChanged {
+			node.finishWarmRestart()
+		}
+	}()
 
 	if err := node.validateMTU(); err != nil {
 		utilruntime.HandleError(err)
 	}
+	go node.watchUnderlayMTU()
+	if node.nicOffloadCheck {
+		go node.checkNICOffload()
+	}
+	go kwait.Forever(node.publishSDNStatus, sdnStatusInterval)
 
-	go kwait.Forever(node.policy.SyncVNIDRules, time.Hour)
+	go node.runPeriodicReconcile(kwait.NeverStop)
+	if node.ipamLeakCheckPeriod > 0 {
+		go kwait.Forever(node.ipamLeakScanner.scan, node.ipamLeakCheckPeriod)
+	}
 	go kwait.Forever(func() {
 		metrics.GatherPeriodicMetrics()
 		node.oc.ovs.UpdateOVSMetrics()
+		node.updateFlowStats()
+		node.updateNeighborTableStats()
 	}, time.Minute*2)
 
 	return nil
 }
 
+// Stop stops any child processes that the node has started, so they don't outlive
+// it when the process exits
+func (node *OsdnNode) Stop() {
+	if np, ok := node.policy.(*networkPolicyPlugin); ok {
+		np.stopDenyLogger()
+	}
+}
+
+func (node *OsdnNode) getClusterCIDRs() []string {
+	node.clusterCIDRsLock.Lock()
+	defer node.clusterCIDRsLock.Unlock()
+	return node.clusterCIDRs
+}
+
+func (node *OsdnNode) setClusterCIDRs(clusterCIDRs []string) {
+	node.clusterCIDRsLock.Lock()
+	defer node.clusterCIDRsLock.Unlock()
+	node.clusterCIDRs = clusterCIDRs
+}
+
 // reattachPods takes an array containing the information about pods that had been
 // attached to the OVS bridge before restart, and either reattaches or kills each of the
-// corresponding pods.
+// corresponding pods. The pods are set up in parallel, after the VNID flows for all of
+// their namespaces.
 func (node *OsdnNode) reattachPods(existingPodSandboxes map[string]*kruntimeapi.PodSandbox, existingOFPodNetworks map[string]podNetworkInfo) error {
+	var reqs []*cniserver.PodRequest
+	namespaces := sets.NewString()
 	for sandboxID, podInfo := range existingOFPodNetworks {
 		sandbox, ok := existingPodSandboxes[sandboxID]
 		if !ok {
@@ -443,24 +847,36 @@ func (node *OsdnNode) reattachPods(existingPodSandboxes map[string]*kruntimeapi.
 			continue
 		}
 
-		req := &cniserver.PodRequest{
+		reqs = append(reqs, &cniserver.PodRequest{
 			Command:      cniserver.CNI_ADD,
 			PodNamespace: sandbox.Metadata.Namespace,
 			PodName:      sandbox.Metadata.Name,
 			SandboxID:    sandboxID,
 			HostVeth:     podInfo.vethName,
 			AssignedIP:   podInfo.ip,
+			AssignedIPv6: podInfo.ipv6,
 			Result:       make(chan *cniserver.PodResult),
+		})
+		namespaces.Insert(sandbox.Metadata.Namespace)
+	}
+
+	// Set up the namespace-wide flows first so that the pods' flows don't depend
+	// on which of their namespace's pods happens to be set up first
+	for _, namespace := range namespaces.List() {
+		if vnid, err := node.policy.GetVNID(namespace); err == nil {
+			node.policy.EnsureVNIDRules(vnid)
 		}
-		klog.Infof("Reattaching pod '%s/%s' to SDN", req.PodNamespace, req.PodName)
-		// NB: we don't need to worry about locking here because the cniserver
-		// isn't running for real yet.
-		if _, err := node.podManager.handleCNIRequest(req); err == nil {
-			delete(existingPodSandboxes, sandboxID)
-		} else {
-			klog.Warningf("Could not reattach pod '%s/%s' to SDN: %v", req.PodNamespace, req.PodName, err)
+	}
+
+	klog.Infof("Reattaching %d pods to SDN with %d workers", len(reqs), node.podReattachWorkers)
+	start := time.Now()
+	failed := node.podManager.reattachPods(reqs, node.podReattachWorkers)
+	for _, req := range reqs {
+		if _, isFailed := failed[req.SandboxID]; !isFailed {
+			delete(existingPodSandboxes, req.SandboxID)
 		}
 	}
+	klog.Infof("Reattached %d of %d pods in %v", len(reqs)-len(failed), len(reqs), time.Since(start))
 
 	// Kill any remaining pods in another thread, after letting SDN startup proceed
 	go node.killFailedPods(existingPodSandboxes)
@@ -568,7 +984,6 @@ func (node *OsdnNode) handleAddOrUpdateService(obj, oldObj interface{}, eventTyp
 	}
 
 	node.AddServiceRules(serv, netid)
-	node.policy.EnsureVNIDRules(netid)
 }
 
 func (node *OsdnNode) handleDeleteService(obj interface{}) {
@@ -582,6 +997,74 @@ func (node *OsdnNode) handleDeleteService(obj interface{}) {
 	node.DeleteServiceRules(serv)
 }
 
+func (node *OsdnNode) watchLoadBalancerServices() {
+	funcs := common.InformerFuncs(&kapi.Service{}, node.handleAddOrUpdateLoadBalancerService, node.handleDeleteLoadBalancerService)
+	node.kubeInformers.Core().V1().Services().Informer().AddEventHandler(funcs)
+}
+
+func isLoadBalancerSourceRangeChanged(oldsvc, newsvc *corev1.Service) bool {
+	return oldsvc.Spec.Type != newsvc.Spec.Type ||
+		!reflect.DeepEqual(oldsvc.Spec.LoadBalancerSourceRanges, newsvc.Spec.LoadBalancerSourceRanges) ||
+		!reflect.DeepEqual(oldsvc.Spec.Ports, newsvc.Spec.Ports) ||
+		!reflect.DeepEqual(oldsvc.Status.LoadBalancer, newsvc.Status.LoadBalancer)
+}
+
+func (node *OsdnNode) handleAddOrUpdateLoadBalancerService(obj, oldObj interface{}, eventType watch.EventType) {
+	serv := obj.(*corev1.Service)
+	if oldServ, exists := oldObj.(*corev1.Service); exists {
+		if !isLoadBalancerSourceRangeChanged(oldServ, serv) {
+			return
+		}
+		if err := node.oc.DeleteLoadBalancerSourceRangeRules(oldServ); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Error deleting loadBalancerSourceRanges rules for service %s/%s: %v", oldServ.Namespace, oldServ.Name, err))
+		}
+	}
+	if err := node.oc.AddLoadBalancerSourceRangeRules(serv); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Error adding loadBalancerSourceRanges rules for service %s/%s: %v", serv.Namespace, serv.Name, err))
+	}
+}
+
+func (node *OsdnNode) handleDeleteLoadBalancerService(obj interface{}) {
+	serv := obj.(*corev1.Service)
+	if err := node.oc.DeleteLoadBalancerSourceRangeRules(serv); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Error deleting loadBalancerSourceRanges rules for service %s/%s: %v", serv.Namespace, serv.Name, err))
+	}
+}
+
 func (node *OsdnNode) ReloadIPTables() error {
+	if node.isTornDown() {
+		return nil
+	}
 	return node.nodeIPTables.syncIPTableRules()
 }
+
+// runPeriodicReconcile calls Reconcile every reconcilePeriod until stopCh is closed.
+// If periodic reconciliation is disabled, it still removes the flows of unused VNIDs
+// every unusedVNIDCleanupPeriod, since nothing else cleans those up.
+func (node *OsdnNode) runPeriodicReconcile(stopCh <-chan struct{}) {
+	if node.reconcilePeriod <= 0 {
+		kwait.Until(node.policy.SyncVNIDRules, unusedVNIDCleanupPeriod, stopCh)
+		return
+	}
+	kwait.Until(func() {
+		if err := node.Reconcile(); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Periodic reconciliation failed: %v", err))
+		}
+	}, node.reconcilePeriod, stopCh)
+}
+
+// Reconcile resyncs the node's VNID flows (see SyncVNIDRules) and iptables rules,
+// in case they have drifted from the desired state. It does not touch pod, service,
+// HostSubnet or egress flows; use Resync for that. It is called every
+// ReconcilePeriod, and can also be called on demand.
+func (node *OsdnNode) Reconcile() error {
+	if node.isTornDown() {
+		return fmt.Errorf("node has been torn down for migration")
+	}
+	klog.V(2).Infof("Reconciling VNID flows and iptables rules")
+	node.policy.SyncVNIDRules()
+	if err := node.nodeIPTables.syncIPTableRules(); err != nil {
+		return fmt.Errorf("could not sync iptables rules: %v", err)
+	}
+	return nil
+}
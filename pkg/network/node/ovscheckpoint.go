@@ -0,0 +1,318 @@
+package node
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/sdn/pkg/util/ovs"
+)
+
+// ovsCheckpoint wraps an ovs.Interface and keeps track of the bridge's OpenFlow
+// state, so that it can be restored if ovs-vswitchd restarts and loses it. The state
+// consists of a snapshot of the flows and groups, plus a journal of the transactions
+// that have been committed since the snapshot was taken, plus the fragment handling
+// mode and meters (which are not part of either, but which the flows depend on).
+// Commits and snapshots are serialized so that the two always agree.
+type ovsCheckpoint struct {
+	ovs.Interface
+
+	lock    sync.Mutex
+	valid   bool
+	flows   []string
+	groups  []string
+	journal []func(ovs.Transaction)
+	// ofports tracks the OpenFlow port numbers of the bridge's interfaces; the
+	// checkpointed flows are only valid if these are unchanged
+	ofports map[string]int
+	// frags and meters are the most recent arguments to SetFrags and SetMeter
+	frags  string
+	meters map[uint32]int
+
+	// warmRestartOwners is non-nil during a warm restart, and contains the flow
+	// owners that had flows when the node started and that have not had any
+	// flows added or deleted since (see warm_restart.go)
+	warmRestartOwners map[flowOwner]bool
+}
+
+func newOVSCheckpoint(ovsif ovs.Interface) *ovsCheckpoint {
+	return &ovsCheckpoint{
+		Interface: ovsif,
+		ofports:   make(map[string]int),
+		meters:    make(map[uint32]int),
+	}
+}
+
+// ovsStatsRegexp matches the fields of "ovs-ofctl dump-flows" output that are
+// statistics rather than part of the flow
+var ovsStatsRegexp = regexp.MustCompile(`\b(duration|n_packets|n_bytes|idle_age|hard_age)=[^,]*, ?`)
+
+// bucketIDRegexp matches the bucket IDs in "ovs-ofctl dump-groups" output
+var bucketIDRegexp = regexp.MustCompile(`bucket=bucket_id:[0-9]+,`)
+
+// snapshot replaces the checkpoint with the current flows and groups, and clears
+// the journal. setUp is called after dumping the flows, and must return true if the
+// bridge was fully set up; otherwise the existing checkpoint is kept.
+func (cp *ovsCheckpoint) snapshot(setUp func() bool) error {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	flows, err := cp.Interface.DumpFlows("")
+	if err != nil {
+		return fmt.Errorf("could not dump flows: %v", err)
+	}
+	groups, err := cp.Interface.DumpGroups()
+	if err != nil {
+		return fmt.Errorf("could not dump groups: %v", err)
+	}
+	if !setUp() {
+		return fmt.Errorf("bridge is not set up")
+	}
+	ports, err := cp.Interface.Find("interface", []string{"name", "ofport"}, `name!=""`)
+	if err != nil {
+		return fmt.Errorf("could not find interfaces: %v", err)
+	}
+	for _, port := range ports {
+		if ofport, err := strconv.Atoi(port["ofport"]); err == nil && ofport > 0 {
+			cp.ofports[port["name"]] = ofport
+		}
+	}
+
+	cp.flows = make([]string, 0, len(flows))
+	for _, flow := range flows {
+		cp.flows = append(cp.flows, strings.TrimSpace(ovsStatsRegexp.ReplaceAllString(flow, "")))
+	}
+	cp.groups = groups
+	cp.journal = nil
+	cp.valid = true
+
+	klog.V(5).Infof("Checkpointed %d OVS flows and %d groups", len(cp.flows), len(cp.groups))
+	return nil
+}
+
+// journalLength returns the number of operations committed since the last snapshot
+func (cp *ovsCheckpoint) journalLength() int {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	return len(cp.journal)
+}
+
+// restore reapplies the fragment handling mode and meters, replaces the bridge's
+// flows and groups with the checkpointed ones, and then replays the journal. (The
+// meters must be recreated first, since flows that use a nonexistent meter are
+// rejected.) It fails if there is no checkpoint, or if the bridge's
+// interfaces have been renumbered such that the checkpointed flows are no longer
+// correct.
+func (cp *ovsCheckpoint) restore() error {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	if !cp.valid {
+		return fmt.Errorf("no OVS checkpoint available")
+	}
+	for name, ofport := range cp.ofports {
+		current, err := cp.Interface.GetOFPort(name)
+		if err != nil {
+			return err
+		}
+		if current != ofport {
+			return fmt.Errorf("ofport of %s changed from %d to %d", name, ofport, current)
+		}
+	}
+
+	if cp.frags != "" {
+		if err := cp.Interface.SetFrags(cp.frags); err != nil {
+			return fmt.Errorf("could not restore OVS fragment handling: %v", err)
+		}
+	}
+	for meterID, pktps := range cp.meters {
+		if err := cp.Interface.SetMeter(meterID, pktps); err != nil {
+			return fmt.Errorf("could not restore OVS meter %d: %v", meterID, err)
+		}
+	}
+
+	otx := cp.Interface.NewTransaction()
+	otx.DeleteFlows("")
+	for _, group := range cp.groups {
+		groupID, groupType, buckets, err := parseGroupDump(group)
+		if err != nil {
+			return err
+		}
+		otx.DeleteGroup(groupID)
+		otx.AddGroup(groupID, groupType, []string{buckets})
+	}
+	for _, flow := range cp.flows {
+		otx.AddFlow(flow)
+	}
+	for _, op := range cp.journal {
+		op(otx)
+	}
+	if err := otx.Commit(); err != nil {
+		return fmt.Errorf("could not restore OVS flows: %v", err)
+	}
+
+	klog.Infof("Restored %d OVS flows, %d groups, and %d journaled operations",
+		len(cp.flows), len(cp.groups), len(cp.journal))
+	return nil
+}
+
+// parseGroupDump parses a line of "ovs-ofctl dump-groups" output, returning the
+// group ID, type, and buckets in the form expected by Transaction.AddGroup.
+func parseGroupDump(group string) (uint32, string, string, error) {
+	group = bucketIDRegexp.ReplaceAllString(group, "bucket=")
+	parts := strings.SplitN(group, ",bucket=", 2)
+	if len(parts) != 2 {
+		return 0, "", "", fmt.Errorf("bad group %q (no buckets)", group)
+	}
+
+	var groupID uint32
+	var groupType string
+	for _, field := range strings.Split(parts[0], ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "group_id":
+			id, err := strconv.ParseUint(kv[1], 10, 32)
+			if err != nil {
+				return 0, "", "", fmt.Errorf("bad group %q (bad group_id)", group)
+			}
+			groupID = uint32(id)
+		case "type":
+			groupType = kv[1]
+		}
+	}
+	if groupType == "" {
+		return 0, "", "", fmt.Errorf("bad group %q (no type)", group)
+	}
+	return groupID, groupType, parts[1], nil
+}
+
+// DeleteBridge is part of ovs.Interface. It invalidates the checkpoint, since
+// the bridge will have to be set up again from scratch.
+func (cp *ovsCheckpoint) DeleteBridge() error {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	cp.valid = false
+	cp.flows = nil
+	cp.groups = nil
+	cp.journal = nil
+	cp.ofports = make(map[string]int)
+	cp.frags = ""
+	cp.meters = make(map[uint32]int)
+	return cp.Interface.DeleteBridge()
+}
+
+// SetFrags is part of ovs.Interface
+func (cp *ovsCheckpoint) SetFrags(mode string) error {
+	err := cp.Interface.SetFrags(mode)
+	if err == nil {
+		cp.lock.Lock()
+		cp.frags = mode
+		cp.lock.Unlock()
+	}
+	return err
+}
+
+// SetMeter is part of ovs.Interface
+func (cp *ovsCheckpoint) SetMeter(meterID uint32, pktps int) error {
+	err := cp.Interface.SetMeter(meterID, pktps)
+	if err == nil {
+		cp.lock.Lock()
+		cp.meters[meterID] = pktps
+		cp.lock.Unlock()
+	}
+	return err
+}
+
+// AddPort is part of ovs.Interface
+func (cp *ovsCheckpoint) AddPort(port string, ofportRequest int, properties ...string) (int, error) {
+	ofport, err := cp.Interface.AddPort(port, ofportRequest, properties...)
+	if err == nil {
+		cp.lock.Lock()
+		cp.ofports[port] = ofport
+		cp.lock.Unlock()
+	}
+	return ofport, err
+}
+
+// DeletePort is part of ovs.Interface
+func (cp *ovsCheckpoint) DeletePort(port string) error {
+	err := cp.Interface.DeletePort(port)
+	if err == nil {
+		cp.lock.Lock()
+		delete(cp.ofports, port)
+		cp.lock.Unlock()
+	}
+	return err
+}
+
+// NewTransaction is part of ovs.Interface
+func (cp *ovsCheckpoint) NewTransaction() ovs.Transaction {
+	return &checkpointTx{Transaction: cp.Interface.NewTransaction(), cp: cp}
+}
+
+// checkpointTx is an ovs.Transaction that records its operations so that they can
+// be added to the checkpoint journal when it is committed.
+type checkpointTx struct {
+	ovs.Transaction
+	cp  *ovsCheckpoint
+	ops []func(ovs.Transaction)
+	// flows are the flows added or deleted by the transaction
+	flows []string
+}
+
+func (tx *checkpointTx) AddFlow(flow string, args ...interface{}) {
+	if len(args) > 0 {
+		flow = fmt.Sprintf(flow, args...)
+	}
+	tx.Transaction.AddFlow(flow)
+	tx.ops = append(tx.ops, func(otx ovs.Transaction) { otx.AddFlow(flow) })
+	tx.flows = append(tx.flows, flow)
+}
+
+func (tx *checkpointTx) DeleteFlows(flow string, args ...interface{}) {
+	if len(args) > 0 {
+		flow = fmt.Sprintf(flow, args...)
+	}
+	tx.Transaction.DeleteFlows(flow)
+	tx.ops = append(tx.ops, func(otx ovs.Transaction) { otx.DeleteFlows(flow) })
+	tx.flows = append(tx.flows, flow)
+}
+
+func (tx *checkpointTx) AddGroup(groupID uint32, groupType string, buckets []string) {
+	tx.Transaction.AddGroup(groupID, groupType, buckets)
+	tx.ops = append(tx.ops, func(otx ovs.Transaction) { otx.AddGroup(groupID, groupType, buckets) })
+}
+
+func (tx *checkpointTx) ModifyGroup(groupID uint32, groupType string, buckets []string) {
+	tx.Transaction.ModifyGroup(groupID, groupType, buckets)
+	tx.ops = append(tx.ops, func(otx ovs.Transaction) { otx.ModifyGroup(groupID, groupType, buckets) })
+}
+
+func (tx *checkpointTx) DeleteGroup(groupID uint32) {
+	tx.Transaction.DeleteGroup(groupID)
+	tx.ops = append(tx.ops, func(otx ovs.Transaction) { otx.DeleteGroup(groupID) })
+}
+
+func (tx *checkpointTx) Commit() error {
+	tx.cp.lock.Lock()
+	defer tx.cp.lock.Unlock()
+
+	err := tx.Transaction.Commit()
+	if err == nil && tx.cp.valid {
+		tx.cp.journal = append(tx.cp.journal, tx.ops...)
+	}
+	if err == nil && tx.cp.warmRestartOwners != nil {
+		tx.cp.revalidateOwnersWithLock(tx.flows)
+	}
+	tx.ops = nil
+	tx.flows = nil
+	return err
+}
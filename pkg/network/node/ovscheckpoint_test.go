@@ -0,0 +1,277 @@
+package node
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/openshift/sdn/pkg/util/ovs"
+)
+
+func dumpSortedState(t *testing.T, ovsif ovs.Interface) ([]string, []string) {
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	groups, err := ovsif.DumpGroups()
+	if err != nil {
+		t.Fatalf("Unexpected error dumping groups: %v", err)
+	}
+	sort.Strings(flows)
+	sort.Strings(groups)
+	return flows, groups
+}
+
+func TestOVSCheckpoint(t *testing.T) {
+	fakeOVS := ovs.NewFake(Br0)
+	cp := newOVSCheckpoint(fakeOVS)
+	oc := NewOVSController(cp, 0, true, "172.17.0.4")
+	oc.tunMAC = "c6:ac:2c:13:48:4b"
+	if err := oc.SetupOVS([]string{"10.128.0.0/14"}, "172.30.0.0/16", "10.128.0.0/23", "10.128.0.1", 1450, 4789); err != nil {
+		t.Fatalf("Unexpected error setting up OVS: %v", err)
+	}
+	if err := oc.FinishSetupOVS(); err != nil {
+		t.Fatalf("Unexpected error setting up OVS: %v", err)
+	}
+	setUp := func() bool { return oc.AlreadySetUp(4789) }
+
+	if err := cp.restore(); err == nil {
+		t.Fatalf("Unexpected success restoring without a checkpoint")
+	}
+	if err := cp.snapshot(setUp); err != nil {
+		t.Fatalf("Unexpected error taking snapshot: %v", err)
+	}
+
+	// Make some changes after the snapshot, which should be journaled
+	otx := oc.ovs.NewTransaction()
+	otx.AddGroup(42, "select", []string{"actions=set_field:172.17.0.3->tun_dst,output:vxlan0,", "actions=set_field:172.17.0.5->tun_dst,output:vxlan0"})
+	otx.AddFlow("table=101, priority=100, ip, reg0=%d, actions=group:%d", 42, 42)
+	otx.DeleteFlows("table=253")
+	otx.AddFlow("table=253, actions=note:%s", oc.getVersionNote())
+	if err := otx.Commit(); err != nil {
+		t.Fatalf("Unexpected error committing transaction: %v", err)
+	}
+	if _, err := oc.ovs.AddPort("veth1", -1); err != nil {
+		t.Fatalf("Unexpected error adding port: %v", err)
+	}
+	if cp.journalLength() != 4 {
+		t.Fatalf("Expected 4 journaled operations, got %d", cp.journalLength())
+	}
+	expectedFlows, expectedGroups := dumpSortedState(t, fakeOVS)
+
+	// Simulate an OVS restart by removing everything behind the checkpoint's back
+	otx = fakeOVS.NewTransaction()
+	otx.DeleteFlows("")
+	otx.DeleteGroup(42)
+	if err := otx.Commit(); err != nil {
+		t.Fatalf("Unexpected error committing transaction: %v", err)
+	}
+	if setUp() {
+		t.Fatalf("Bridge unexpectedly still set up after removing flows")
+	}
+
+	if err := cp.restore(); err != nil {
+		t.Fatalf("Unexpected error restoring checkpoint: %v", err)
+	}
+	flows, groups := dumpSortedState(t, fakeOVS)
+	if !reflect.DeepEqual(flows, expectedFlows) {
+		t.Fatalf("Unexpected flows after restore:\nexpected %v\ngot %v", expectedFlows, flows)
+	}
+	if !reflect.DeepEqual(groups, expectedGroups) {
+		t.Fatalf("Unexpected groups after restore:\nexpected %v\ngot %v", expectedGroups, groups)
+	}
+
+	// A new snapshot includes the journaled changes and clears the journal
+	if err := cp.snapshot(setUp); err != nil {
+		t.Fatalf("Unexpected error taking snapshot: %v", err)
+	}
+	if cp.journalLength() != 0 {
+		t.Fatalf("Expected empty journal after snapshot, got %d operations", cp.journalLength())
+	}
+
+	// The checkpoint can't be restored if a port has been renumbered
+	if err := fakeOVS.DeletePort("veth1"); err != nil {
+		t.Fatalf("Unexpected error deleting port: %v", err)
+	}
+	if _, err := fakeOVS.AddPort("veth1", 10); err != nil {
+		t.Fatalf("Unexpected error adding port: %v", err)
+	}
+	if err := cp.restore(); err == nil {
+		t.Fatalf("Unexpected success restoring after port was renumbered")
+	}
+
+	// Deleting the bridge invalidates the checkpoint
+	if err := oc.ovs.DeleteBridge(); err != nil {
+		t.Fatalf("Unexpected error deleting bridge: %v", err)
+	}
+	if err := cp.restore(); err == nil {
+		t.Fatalf("Unexpected success restoring after bridge was deleted")
+	}
+}
+
+func TestParseGroupDump(t *testing.T) {
+	tests := []struct {
+		name    string
+		group   string
+		id      uint32
+		typ     string
+		buckets string
+		err     bool
+	}{
+		{
+			name:    "single bucket",
+			group:   "group_id=42,type=select,bucket=actions=ct(commit),set_field:172.17.0.3->tun_dst,output:vxlan0",
+			id:      42,
+			typ:     "select",
+			buckets: "actions=ct(commit),set_field:172.17.0.3->tun_dst,output:vxlan0",
+		},
+		{
+			name:    "bucket IDs",
+			group:   "group_id=7,type=select,bucket=bucket_id:0,actions=output:1,bucket=bucket_id:1,actions=output:2",
+			id:      7,
+			typ:     "select",
+			buckets: "actions=output:1,bucket=actions=output:2",
+		},
+		{
+			name:  "no buckets",
+			group: "group_id=7,type=select",
+			err:   true,
+		},
+		{
+			name:  "bad group_id",
+			group: "group_id=foo,type=select,bucket=actions=output:1",
+			err:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		id, typ, buckets, err := parseGroupDump(tc.group)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: unexpected success", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		} else if id != tc.id || typ != tc.typ || buckets != tc.buckets {
+			t.Errorf("%s: expected %d/%s/%q, got %d/%s/%q", tc.name, tc.id, tc.typ, tc.buckets, id, typ, buckets)
+		}
+	}
+}
+
+func TestOVSCheckpointWarmRestart(t *testing.T) {
+	fakeOVS := ovs.NewFake(Br0)
+	cp := newOVSCheckpoint(fakeOVS)
+	oc := NewOVSController(cp, 0, true, "172.17.0.4")
+	oc.tunMAC = "c6:ac:2c:13:48:4b"
+	if err := oc.SetupOVS([]string{"10.128.0.0/14"}, "172.30.0.0/16", "10.128.0.0/23", "10.128.0.1", 1450, 4789); err != nil {
+		t.Fatalf("Unexpected error setting up OVS: %v", err)
+	}
+
+	otx := oc.ovs.NewTransaction()
+	otx.AddFlow("table=80, priority=100, cookie=%s, reg0=1, reg1=1, actions=output:NXM_NX_REG2[]", policyFlowOwner(1).cookie("0"))
+	otx.AddFlow("table=80, priority=100, cookie=%s, reg0=2, reg1=2, actions=output:NXM_NX_REG2[]", policyFlowOwner(2).cookie("0"))
+	otx.AddFlow("table=101, priority=100, cookie=%s, reg0=2, actions=drop", egressFlowOwner(2).cookie("0"))
+	otx.AddFlow("table=70, priority=100, cookie=%s, ip, nw_dst=10.128.0.5, actions=load:1->NXM_NX_REG1[], load:5->NXM_NX_REG2[], goto_table:80", podFlowOwner(net.ParseIP("10.128.0.5")).cookie("0"))
+	if err := otx.Commit(); err != nil {
+		t.Fatalf("Unexpected error committing transaction: %v", err)
+	}
+
+	// The node restarts, keeping its flows. (Pod flows aren't tracked.)
+	owners, err := cp.startWarmRestart()
+	if err != nil {
+		t.Fatalf("Unexpected error starting warm restart: %v", err)
+	}
+	if owners != 3 {
+		t.Fatalf("Expected 3 flow owners, got %d", owners)
+	}
+
+	// VNID 1 is re-added by its informer; VNID 2 was deleted while the node was down
+	otx = oc.ovs.NewTransaction()
+	otx.DeleteFlows("table=80, %s", policyFlowOwner(1).match())
+	otx.AddFlow("table=80, priority=100, cookie=%s, reg0=1, reg1=1, actions=output:NXM_NX_REG2[]", policyFlowOwner(1).cookie("0"))
+	if err := otx.Commit(); err != nil {
+		t.Fatalf("Unexpected error committing transaction: %v", err)
+	}
+
+	stale, err := cp.finishWarmRestart()
+	if err != nil {
+		t.Fatalf("Unexpected error finishing warm restart: %v", err)
+	}
+	if !reflect.DeepEqual(stale, []flowOwner{policyFlowOwner(2), egressFlowOwner(2)}) {
+		t.Fatalf("Unexpected stale owners %v", stale)
+	}
+	for _, tc := range []struct {
+		match  string
+		exists bool
+	}{
+		{"table=80, reg0=1", true},
+		{"table=80, reg0=2", false},
+		{"table=101, reg0=2", false},
+		{"table=70, ip, nw_dst=10.128.0.5", true},
+	} {
+		flows, err := fakeOVS.DumpFlows(tc.match)
+		if err != nil {
+			t.Fatalf("Unexpected error dumping flows: %v", err)
+		}
+		if (len(flows) > 0) != tc.exists {
+			t.Fatalf("Expected flows for %q to exist=%v, got %v", tc.match, tc.exists, flows)
+		}
+	}
+
+	// Tracking stops once the warm restart is finished
+	if stale, err := cp.finishWarmRestart(); err != nil || len(stale) != 0 {
+		t.Fatalf("Unexpected result finishing warm restart again: %v, %v", stale, err)
+	}
+}
+
+func TestOVSCheckpointMeters(t *testing.T) {
+	fakeOVS := ovs.NewFake(Br0)
+	cp := newOVSCheckpoint(fakeOVS)
+	oc := NewOVSController(cp, 0, true, "172.17.0.4")
+	oc.tunMAC = "c6:ac:2c:13:48:4b"
+	if err := oc.SetupOVS([]string{"10.128.0.0/14"}, "172.30.0.0/16", "10.128.0.0/23", "10.128.0.1", 1450, 4789); err != nil {
+		t.Fatalf("Unexpected error setting up OVS: %v", err)
+	}
+	if err := oc.FinishSetupOVS(); err != nil {
+		t.Fatalf("Unexpected error setting up OVS: %v", err)
+	}
+	if err := cp.snapshot(func() bool { return oc.AlreadySetUp(4789) }); err != nil {
+		t.Fatalf("Unexpected error taking snapshot: %v", err)
+	}
+
+	// Add a deny-logging flow (journaled), which requires the deny logging meter
+	if err := oc.ovs.SetMeter(denyLogMeter, denyLogMeterRate); err != nil {
+		t.Fatalf("Unexpected error setting meter: %v", err)
+	}
+	otx := oc.ovs.NewTransaction()
+	otx.AddFlow("table=80, priority=0, reg1=42, actions=%s", denyLogAction)
+	if err := otx.Commit(); err != nil {
+		t.Fatalf("Unexpected error committing transaction: %v", err)
+	}
+	expectedFlows, _ := dumpSortedState(t, fakeOVS)
+
+	// Simulate an ovs-vswitchd restart, which loses the meter along with the
+	// flows, but keeps the ports and their ofports
+	if err := fakeOVS.DeleteBridge(); err != nil {
+		t.Fatalf("Unexpected error deleting bridge: %v", err)
+	}
+	if err := fakeOVS.AddBridge("fail_mode=secure", "protocols=OpenFlow13"); err != nil {
+		t.Fatalf("Unexpected error adding bridge: %v", err)
+	}
+	for name, ofport := range map[string]int{Vxlan0: 1, Tun0: 2} {
+		if _, err := fakeOVS.AddPort(name, ofport); err != nil {
+			t.Fatalf("Unexpected error adding port: %v", err)
+		}
+	}
+
+	if err := cp.restore(); err != nil {
+		t.Fatalf("Unexpected error restoring checkpoint: %v", err)
+	}
+	flows, _ := dumpSortedState(t, fakeOVS)
+	if !reflect.DeepEqual(flows, expectedFlows) {
+		t.Fatalf("Unexpected flows after restore:\nexpected %v\ngot %v", expectedFlows, flows)
+	}
+}
@@ -1,12 +1,14 @@
 package node
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"net"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"k8s.io/klog/v2"
 
@@ -18,14 +20,41 @@ import (
 	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/sets"
+	utilnet "k8s.io/utils/net"
 )
 
 type ovsController struct {
 	ovs          ovs.Interface
 	pluginId     int
 	useConnTrack bool
-	localIP      string
 	tunMAC       string
+
+	// geneve is set if the node can receive pod traffic over Geneve, in which case
+	// br0 has a Geneve port alongside the VXLAN port
+	geneve bool
+
+	// dualStack is set if pods have IPv6 addresses as well, in which case policy
+	// flows that don't match a specific address must be added for both families
+	dualStack bool
+
+	// The cluster and service networks, for the per-pod traffic accounting flows,
+	// and the node IP, which can change (see SetLocalIP)
+	networksLock        sync.Mutex
+	clusterNetworkCIDRs []string
+	serviceNetworkCIDR  string
+	localSubnetGateway  string
+	localIP             string
+
+	// The destinations of the table 101 flows that send each VNID's traffic to its
+	// egress IP group, so that egress IP changes only need to update the group
+	egressGroupsLock        sync.Mutex
+	egressGroupDestinations map[uint32]string
+
+	// The remote nodes and multicast gateway groups that the table 111 flows send
+	// multicast traffic from local pods to
+	multicastLock          sync.Mutex
+	vxlanMulticastIPs      []string
+	multicastGatewayGroups []*net.UDPAddr
 }
 
 const (
@@ -33,42 +62,120 @@ const (
 	Tun0   = "tun0"
 	Vxlan0 = "vxlan0"
 
+	Geneve0 = "genev0"
+
+	// genev0's OpenFlow port, after vxlan0 (1) and tun0 (2)
+	geneve0OFPort = 3
+
+	// the standard Geneve UDP port
+	genevePort = 6081
+
 	// rule versioning; increment each time flow rules change
-	ruleVersion = 11
+	ruleVersion = 12
 
 	ruleVersionTable = 253
+
+	// cookie marking table 99 flows for audit-only EgressNetworkPolicy deny rules
+	egressAuditCookie = "0xea"
+	// cookie marking table 99 flows that exempt traffic to particular nodes from
+	// EgressNetworkPolicy rules
+	egressExemptCookie = "0xec"
+	// the maximum number of audit-only rules per VNID; the audit rules must have
+	// priorities between those of the table 99 DNS and exemption rules and the
+	// default rule
+	maxEgressAuditRules = 198
+
+	// cookies marking the per-pod table 20 and 70 flows that count IPv4 traffic
+	// between the pod and other pods or services, for per-namespace traffic
+	// accounting. (The pod's main flows count everything else.)
+	trafficPodCookie     = "0xa1"
+	trafficServiceCookie = "0xa2"
+
+	// cookie marking the table 30 flows that enforce the loadBalancerSourceRanges
+	// of LoadBalancer services for traffic from pods
+	lbSourceRangeCookie = "0xb1"
+
+	// cookie marking the table 60 and 80 flows that let hairpin traffic of services
+	// in namespaces with HairpinModeServiceIP through, since it comes from (and is
+	// replied to) the service IP rather than the tun0 IP
+	hairpinCookie = "0xc1"
+
+	// cookie marking the table 101 flows that mark the off-cluster traffic of
+	// direct-attach namespaces with directAttachMark
+	directAttachCookie = "0xd1"
+	// directAttachMark is the packet mark that exempts traffic from masquerading (see
+	// DirectAttachAnnotation). It can't collide with an egress IP's mark, since those
+	// are either below it or 0xff000000 (see getMarkForVNID).
+	directAttachMark = "0x02000000"
 )
 
 func NewOVSController(ovsif ovs.Interface, pluginId int, useConnTrack bool, localIP string) *ovsController {
-	return &ovsController{ovs: ovsif, pluginId: pluginId, useConnTrack: useConnTrack, localIP: localIP}
+	return &ovsController{
+		ovs:                     ovsif,
+		pluginId:                pluginId,
+		useConnTrack:            useConnTrack,
+		localIP:                 localIP,
+		egressGroupDestinations: make(map[uint32]string),
+	}
 }
 
 func (oc *ovsController) getVersionNote() string {
 	if ruleVersion > 254 {
 		panic("Version too large!")
 	}
-	return fmt.Sprintf("%02X.%02X", oc.pluginId, ruleVersion)
+	schema := &flowSchema{pluginId: oc.pluginId, ruleVersion: ruleVersion, tables: flowTableVersions}
+	return schema.String()
 }
 
 func (oc *ovsController) AlreadySetUp(vxlanPort uint32) bool {
+	outdated, err := oc.OutdatedFlowTables(vxlanPort)
+	return err == nil && outdated.Len() == 0
+}
+
+// OutdatedFlowTables returns the tables whose versions in flowTableVersions have
+// changed since the bridge was set up, which can be rebuilt by RebuildFlowTables.
+// It returns an error if the bridge needs to be set up from scratch instead.
+func (oc *ovsController) OutdatedFlowTables(vxlanPort uint32) (sets.Int, error) {
 	flows, err := oc.ovs.DumpFlows("table=%d", ruleVersionTable)
-	if err != nil || len(flows) != 1 {
-		return false
+	if err != nil {
+		return nil, err
+	} else if len(flows) != 1 {
+		return nil, fmt.Errorf("no version note")
 	}
 
 	port, err := oc.ovs.Get("Interface", Vxlan0, "options:dst_port")
 	// the call to ovs.Get() returns the port number surrounded by double quotes
 	// so add them to the structs value for purposes of comparison
 	if err != nil || fmt.Sprintf("\"%d\"", vxlanPort) != port {
-		return false
+		return nil, fmt.Errorf("VXLAN port is not %d", vxlanPort)
 	}
-	if parsed, err := ovs.ParseFlow(ovs.ParseForDump, flows[0]); err == nil {
-		return parsed.NoteHasPrefix(oc.getVersionNote())
+	if _, err := oc.ovs.GetOFPort(Geneve0); (err == nil) != oc.geneve {
+		return nil, fmt.Errorf("Geneve port should exist: %v", oc.geneve)
 	}
-	return false
+
+	parsed, err := ovs.ParseFlow(ovs.ParseForDump, flows[0])
+	if err != nil {
+		return nil, err
+	}
+	note, ok := parsed.FindAction("note")
+	if !ok {
+		return nil, fmt.Errorf("no version note")
+	}
+	schema, err := parseFlowSchema(note.Value)
+	if err != nil {
+		return nil, err
+	}
+	if schema.pluginId != oc.pluginId || schema.ruleVersion != ruleVersion {
+		return nil, fmt.Errorf("flows are from plugin %d version %d", schema.pluginId, schema.ruleVersion)
+	} else if schema.tables == nil {
+		return nil, fmt.Errorf("flows predate table versioning")
+	}
+	return schema.outdatedTables(flowTableVersions), nil
 }
 
 func (oc *ovsController) SetupOVS(clusterNetworkCIDR []string, serviceNetworkCIDR, localSubnetCIDR, localSubnetGateway string, mtu uint32, vxlanPort uint32) error {
+	oc.SetNetworks(clusterNetworkCIDR, serviceNetworkCIDR, localSubnetGateway)
+
 	err := oc.ovs.DeleteBridge()
 	if err != nil {
 		return err
@@ -91,9 +198,54 @@ func (oc *ovsController) SetupOVS(clusterNetworkCIDR []string, serviceNetworkCID
 	if err != nil {
 		return err
 	}
+	if oc.geneve {
+		_, err = oc.ovs.AddPort(Geneve0, geneve0OFPort, "type=geneve", `options:remote_ip="flow"`, `options:key="flow"`, fmt.Sprintf("options:dst_port=%d", genevePort))
+		if err != nil {
+			return err
+		}
+	}
 
 	otx := oc.ovs.NewTransaction()
+	oc.addStaticFlows(otx, clusterNetworkCIDR, serviceNetworkCIDR, localSubnetCIDR, localSubnetGateway, vxlanPort)
+	return otx.Commit()
+}
+
+// RebuildFlowTables deletes all of the flows in tables and recreates the ones that
+// SetupOVS (and, in a dual-stack cluster, SetupOVSIPv6) creates in them. Flows added
+// later, by setupPodFlows, AddHostSubnetRules, etc, must be re-added by the caller.
+// The version note is removed, so that if the node is restarted before
+// FinishSetupOVS is called, the bridge will be set up from scratch.
+func (oc *ovsController) RebuildFlowTables(tables sets.Int, clusterNetworkCIDR []string, serviceNetworkCIDR, localSubnetCIDR, localSubnetGateway string, vxlanPort uint32, clusterNetworkCIDRv6 []string, localSubnetCIDRv6, localSubnetGatewayv6 string) error {
+	oc.SetNetworks(clusterNetworkCIDR, serviceNetworkCIDR, localSubnetGateway)
 
+	otx := oc.ovs.NewTransaction()
+	otx.DeleteFlows("table=%d", ruleVersionTable)
+	for _, table := range tables.List() {
+		otx.DeleteFlows("table=%d", table)
+	}
+
+	ftx := &tableFilterTransaction{Transaction: otx, tables: tables}
+	oc.addStaticFlows(ftx, clusterNetworkCIDR, serviceNetworkCIDR, localSubnetCIDR, localSubnetGateway, vxlanPort)
+	if localSubnetCIDRv6 != "" {
+		oc.addStaticIPv6Flows(ftx, clusterNetworkCIDRv6, localSubnetCIDRv6, localSubnetGatewayv6)
+	}
+	return otx.Commit()
+}
+
+// ResyncStaticFlows re-adds the flows that SetupOVS (and, in a dual-stack cluster,
+// SetupOVSIPv6) create, in case they have been modified or deleted. Unlike
+// RebuildFlowTables, it leaves all other flows alone.
+func (oc *ovsController) ResyncStaticFlows(clusterNetworkCIDR []string, serviceNetworkCIDR, localSubnetCIDR, localSubnetGateway string, vxlanPort uint32, clusterNetworkCIDRv6 []string, localSubnetCIDRv6, localSubnetGatewayv6 string) error {
+	otx := oc.ovs.NewTransaction()
+	oc.addStaticFlows(otx, clusterNetworkCIDR, serviceNetworkCIDR, localSubnetCIDR, localSubnetGateway, vxlanPort)
+	if localSubnetCIDRv6 != "" {
+		oc.addStaticIPv6Flows(otx, clusterNetworkCIDRv6, localSubnetCIDRv6, localSubnetGatewayv6)
+	}
+	return otx.Commit()
+}
+
+// addStaticFlows adds the flows that SetupOVS creates
+func (oc *ovsController) addStaticFlows(otx ovs.Transaction, clusterNetworkCIDR []string, serviceNetworkCIDR, localSubnetCIDR, localSubnetGateway string, vxlanPort uint32) {
 	// Table 0: initial dispatch based on in_port
 	if oc.useConnTrack {
 		otx.AddFlow("table=0, priority=1000, ip, ct_state=-trk, actions=ct(table=0)")
@@ -105,6 +257,15 @@ func (oc *ovsController) SetupOVS(clusterNetworkCIDR []string, serviceNetworkCID
 		otx.AddFlow("table=0, priority=200, in_port=1, ip, nw_dst=%s, actions=move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:10", clusterCIDR)
 	}
 	otx.AddFlow("table=0, priority=150, in_port=1, actions=drop")
+	// genev0
+	if oc.geneve {
+		for _, clusterCIDR := range clusterNetworkCIDR {
+			otx.AddFlow("table=0, priority=200, in_port=%d, arp, nw_src=%s, nw_dst=%s, actions=move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:10", geneve0OFPort, clusterCIDR, localSubnetCIDR)
+			otx.AddFlow("table=0, priority=200, in_port=%d, ip, nw_src=%s, actions=move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:10", geneve0OFPort, clusterCIDR)
+			otx.AddFlow("table=0, priority=200, in_port=%d, ip, nw_dst=%s, actions=move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:10", geneve0OFPort, clusterCIDR)
+		}
+		otx.AddFlow("table=0, priority=150, in_port=%d, actions=drop", geneve0OFPort)
+	}
 	// tun0
 	if oc.useConnTrack {
 		otx.AddFlow("table=0, priority=400, in_port=2, ip, nw_src=%s, actions=goto_table:30", localSubnetGateway)
@@ -112,6 +273,10 @@ func (oc *ovsController) SetupOVS(clusterNetworkCIDR []string, serviceNetworkCID
 			otx.AddFlow("table=0, priority=300, in_port=2, ip, nw_src=%s, nw_dst=%s, actions=goto_table:25", localSubnetCIDR, clusterCIDR)
 		}
 	}
+	// (except for proxy ARP replies for routed HostSubnets; see addHostSubnetRules())
+	// (and multicast gateway groups; see SetMulticastGatewayGroups())
+	// eg, "table=0, cookie=${multicastGatewayCookie}, priority=450, in_port=2, udp, nw_dst=${group}, udp_dst=${port}, actions=goto_table:120"
+	// eg, "table=0, cookie=${multicastGatewayCookie}, priority=450, in_port=2, ip, nw_proto=2, nw_dst=224.0.0.1, actions=goto_table:120"
 	otx.AddFlow("table=0, priority=250, in_port=2, ip, nw_dst=224.0.0.0/4, actions=drop")
 	for _, clusterCIDR := range clusterNetworkCIDR {
 		otx.AddFlow("table=0, priority=200, in_port=2, arp, nw_src=%s, nw_dst=%s, actions=goto_table:30", localSubnetGateway, clusterCIDR)
@@ -130,12 +295,29 @@ func (oc *ovsController) SetupOVS(clusterNetworkCIDR []string, serviceNetworkCID
 	// Table 20: from OpenShift container; validate IP/MAC, assign tenant-id; filled in by setupPodFlows
 	// eg, "table=20, priority=100, in_port=${ovs_port}, arp, nw_src=${ipaddr}, arp_sha=${macaddr}, actions=load:${tenant_id}->NXM_NX_REG0[], goto_table:21"
 	//     "table=20, priority=100, in_port=${ovs_port}, ip, nw_src=${ipaddr}, actions=load:${tenant_id}->NXM_NX_REG0[], goto_table:21"
+	//     "table=20, priority=110, cookie=${traffic_cookie}, in_port=${ovs_port}, ip, nw_src=${ipaddr}, nw_dst=${peer_cidr}, actions=load:${tenant_id}->NXM_NX_REG0[], goto_table:21"
+	// (the priority 110 and 120 flows just split up the traffic for per-namespace accounting)
 	// (${tenant_id} is always 0 for single-tenant)
 	otx.AddFlow("table=20, priority=300, udp, udp_dst=%d, actions=drop", vxlanPort)
+	if oc.geneve {
+		otx.AddFlow("table=20, priority=300, udp, udp_dst=%d, actions=drop", genevePort)
+	}
 	otx.AddFlow("table=20, priority=0, actions=drop")
 
 	// Table 21: from OpenShift container; NetworkPolicy plugin uses this for connection tracking
-	otx.AddFlow("table=21, priority=0, actions=goto_table:30")
+	otx.AddFlow("table=21, priority=0, actions=goto_table:22")
+
+	// Table 22: from OpenShift container; audit-only EgressNetworkPolicy rules for
+	// in-cluster Services, whose cluster IPs and pod IPs never reach table 99;
+	// filled in by UpdateEgressNetworkPolicyRules
+	// eg, "table=22, cookie=${egressAuditCookie}, reg0=${tenant_id}, priority=2, ip, nw_dst=${service_ip}, actions=goto_table:23"
+	otx.AddFlow("table=22, priority=0, actions=goto_table:23")
+
+	// Table 23: from OpenShift container; EgressNetworkPolicy rules for in-cluster
+	// Services, whose cluster IPs and pod IPs never reach table 100; filled in by
+	// UpdateEgressNetworkPolicyRules
+	// eg, "table=23, reg0=${tenant_id}, priority=2, ip, nw_dst=${service_ip}, actions=drop"
+	otx.AddFlow("table=23, priority=0, actions=goto_table:30")
 
 	if oc.useConnTrack {
 		// Table 25: IP from OpenShift container via Service IP; reload tenant-id; filled in by setupPodFlows
@@ -159,6 +341,11 @@ func (oc *ovsController) SetupOVS(clusterNetworkCIDR []string, serviceNetworkCID
 		otx.AddFlow("table=30, priority=100, ip, nw_dst=%s, actions=goto_table:90", clusterCIDR)
 	}
 
+	// LoadBalancer source ranges; filled in by AddLoadBalancerSourceRangeRules()
+	// eg, "table=30, priority=160, cookie=${lbSourceRangeCookie}, ip, nw_dst=${ingress_ip}, ${service_proto}, tp_dst=${service_port}, nw_src=${source_range}, actions=goto_table:99"
+	//     "table=30, priority=150, cookie=${lbSourceRangeCookie}, ip, nw_dst=${ingress_ip}, ${service_proto}, tp_dst=${service_port}, actions=drop"
+	// (and likewise with ipv6, ipv6_dst, and ipv6_src for IPv6 ingress IPs)
+
 	// Multicast coming from the VXLAN
 	otx.AddFlow("table=30, priority=50, in_port=1, ip, nw_dst=224.0.0.0/4, actions=goto_table:120")
 	// Multicast coming from local pods
@@ -187,13 +374,22 @@ func (oc *ovsController) SetupOVS(clusterNetworkCIDR []string, serviceNetworkCID
 
 	// Table 70: IP to local container: vnid/port mappings; filled in by setupPodFlows
 	// eg, "table=70, priority=100, ip, nw_dst=${ipaddr}, actions=load:${tenant_id}->NXM_NX_REG1[], load:${ovs_port}->NXM_NX_REG2[], goto_table:80"
+	//     "table=70, priority=110, cookie=${traffic_cookie}, ip, nw_src=${peer_cidr}, nw_dst=${ipaddr}, actions=load:${tenant_id}->NXM_NX_REG1[], load:${ovs_port}->NXM_NX_REG2[], goto_table:80"
 	otx.AddFlow("table=70, priority=0, actions=drop")
 
 	// Table 80: IP policy enforcement; mostly managed by the osdnPolicy
 	otx.AddFlow("table=80, priority=300, ip, nw_src=%s/32, actions=output:NXM_NX_REG2[]", localSubnetGateway)
+	// (and hairpin traffic that is NATted to the service IP; see AddHairpinRules())
+	// eg, "table=80, priority=300, cookie=${hairpinCookie}, in_port=2, ip, nw_src=${service_ip}, actions=output:NXM_NX_REG2[]"
 	// eg, "table=80, priority=100, reg0=${tenant_id}, reg1=${tenant_id}, actions=output:NXM_NX_REG2[]"
 	otx.AddFlow("table=80, priority=0, actions=drop")
 
+	// Table 81: IP allowed by policy; NetworkPolicy plugin uses this to mark allowed connections
+	otx.AddFlow("table=81, priority=0, actions=output:NXM_NX_REG2[]")
+
+	// Tables 82 and 83: AdminNetworkPolicy and BaselineAdminNetworkPolicy rules;
+	// only used by the NetworkPolicy plugin, when AdminNetworkPolicy is enabled
+
 	// Table 90: IP to remote container; filled in by AddHostSubnetRules()
 	// eg, "table=90, priority=100, ip, nw_dst=${remote_subnet_cidr}, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31], set_field:${remote_node_ip}->tun_dst,output:1"
 	otx.AddFlow("table=90, priority=0, actions=drop")
@@ -203,8 +399,11 @@ func (oc *ovsController) SetupOVS(clusterNetworkCIDR []string, serviceNetworkCID
 	// pod DNS to talk to the node IP, and also has an EgressNetworkPolicy
 	// saying "Deny 0.0.0.0/0", then DNS to the node IP is still expected to
 	// work
-	otx.AddFlow("table=99, priority=200, tcp, tcp_dst=53, nw_dst=%s, actions=output:2", oc.localIP)
-	otx.AddFlow("table=99, priority=200, udp, udp_dst=53, nw_dst=%s, actions=output:2", oc.localIP)
+	addNodeDNSFlows(otx, oc.getLocalIP())
+	// Nodes exempt from EgressNetworkPolicy; edited by UpdateEgressFirewallExemptions()
+	// eg, "table=99, cookie=${egressExemptCookie}, priority=199, ip, nw_dst=${node_ip}, actions=goto_table:101"
+	// Audit-only EgressNetworkPolicy rules; edited by UpdateEgressNetworkPolicyRules()
+	// eg, "table=99, cookie=${egressAuditCookie}, reg0=${tenant_id}, priority=2, ip, nw_dst=${external_cidr}, actions=goto_table:100"
 	otx.AddFlow("table=99, priority=0, actions=goto_table:100")
 
 	// Table 100: egress network policy dispatch; edited by UpdateEgressNetworkPolicy()
@@ -225,14 +424,144 @@ func (oc *ovsController) SetupOVS(clusterNetworkCIDR []string, serviceNetworkCID
 
 	// Table 120: multicast delivery to local pods (either from VXLAN or local pods); updated by UpdateLocalMulticastFlows()
 	// eg, "table=120, priority=100, reg0=${tenant_id}, actions=output:${ovs_port_1},output:${ovs_port_2}"
+	// Groups granted to other namespaces; updated by UpdateMulticastGrantFlows(), with priority 101 + the group's prefix length
+	// eg, "table=120, cookie=${multicastGrantCookie}, priority=133, reg0=${tenant_id}, ip, nw_dst=${group}, actions=output:${ovs_port_1},output:${other_ovs_port_1}"
 	otx.AddFlow("table=120, priority=0, actions=drop")
-
-	return otx.Commit()
 }
 
 // Perform the final step of SDN setup; this is done after everything else, so if the SDN
 // pod is killed partway through setup, then when it is restarted, oc.AlreadySetUp() will
 // fail and we'll destroy and recreate the bridge again.
+
+// SetNetworks records the cluster and service networks and the local subnet
+// gateway, as SetupOVS does, for when the node starts up with OVS already set up.
+func (oc *ovsController) SetNetworks(clusterNetworkCIDRs []string, serviceNetworkCIDR, localSubnetGateway string) {
+	oc.networksLock.Lock()
+	defer oc.networksLock.Unlock()
+	oc.clusterNetworkCIDRs = append([]string{}, clusterNetworkCIDRs...)
+	oc.serviceNetworkCIDR = serviceNetworkCIDR
+	oc.localSubnetGateway = localSubnetGateway
+}
+
+// getNetworks returns the values recorded by SetNetworks
+func (oc *ovsController) getNetworks() ([]string, string, string) {
+	oc.networksLock.Lock()
+	defer oc.networksLock.Unlock()
+	return append([]string{}, oc.clusterNetworkCIDRs...), oc.serviceNetworkCIDR, oc.localSubnetGateway
+}
+
+// getLocalIP returns the node IP
+func (oc *ovsController) getLocalIP() string {
+	oc.networksLock.Lock()
+	defer oc.networksLock.Unlock()
+	return oc.localIP
+}
+
+// SetLocalIP changes the node IP to localIP, updating the table 99 DNS flows. The
+// egress IP flows that depend on the node IP are not updated; the caller must
+// resync them.
+func (oc *ovsController) SetLocalIP(localIP string) error {
+	oc.networksLock.Lock()
+	oldIP := oc.localIP
+	oc.localIP = localIP
+	oc.networksLock.Unlock()
+
+	otx := oc.ovs.NewTransaction()
+	otx.DeleteFlows("table=99, tcp, tcp_dst=53, nw_dst=%s", oldIP)
+	otx.DeleteFlows("table=99, udp, udp_dst=53, nw_dst=%s", oldIP)
+	addNodeDNSFlows(otx, localIP)
+	return otx.Commit()
+}
+
+// addNodeDNSFlows adds the table 99 flows that allow DNS traffic to the node IP
+func addNodeDNSFlows(otx ovs.Transaction, localIP string) {
+	otx.AddFlow("table=99, priority=200, tcp, tcp_dst=53, nw_dst=%s, actions=output:2", localIP)
+	otx.AddFlow("table=99, priority=200, udp, udp_dst=53, nw_dst=%s, actions=output:2", localIP)
+}
+
+// AddClusterNetworkRules adds the flows for a clusterNetworks entry that was added
+// after SetupOVS; these are the same per-clusterNetwork flows that SetupOVS creates.
+// (Existing pods' traffic accounting flows are not updated, so their traffic to and
+// from the new clusterNetwork is counted as external until they are recreated.)
+func (oc *ovsController) AddClusterNetworkRules(clusterCIDR, localSubnetCIDR, localSubnetGateway string) error {
+	oc.networksLock.Lock()
+	oc.clusterNetworkCIDRs = append(oc.clusterNetworkCIDRs, clusterCIDR)
+	oc.networksLock.Unlock()
+
+	otx := oc.ovs.NewTransaction()
+	otx.AddFlow("table=0, priority=200, in_port=1, arp, nw_src=%s, nw_dst=%s, actions=move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:10", clusterCIDR, localSubnetCIDR)
+	otx.AddFlow("table=0, priority=200, in_port=1, ip, nw_src=%s, actions=move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:10", clusterCIDR)
+	otx.AddFlow("table=0, priority=200, in_port=1, ip, nw_dst=%s, actions=move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:10", clusterCIDR)
+	if oc.useConnTrack {
+		otx.AddFlow("table=0, priority=300, in_port=2, ip, nw_src=%s, nw_dst=%s, actions=goto_table:25", localSubnetCIDR, clusterCIDR)
+	}
+	otx.AddFlow("table=0, priority=200, in_port=2, arp, nw_src=%s, nw_dst=%s, actions=goto_table:30", localSubnetGateway, clusterCIDR)
+	otx.AddFlow("table=30, priority=100, arp, nw_dst=%s, actions=goto_table:50", clusterCIDR)
+	otx.AddFlow("table=30, priority=100, ip, nw_dst=%s, actions=goto_table:90", clusterCIDR)
+	return otx.Commit()
+}
+
+// DeleteClusterNetworkRules deletes the flows for a removed clusterNetworks entry
+func (oc *ovsController) DeleteClusterNetworkRules(clusterCIDR string) error {
+	oc.networksLock.Lock()
+	for i := range oc.clusterNetworkCIDRs {
+		if oc.clusterNetworkCIDRs[i] == clusterCIDR {
+			oc.clusterNetworkCIDRs = append(oc.clusterNetworkCIDRs[:i], oc.clusterNetworkCIDRs[i+1:]...)
+			break
+		}
+	}
+	oc.networksLock.Unlock()
+
+	otx := oc.ovs.NewTransaction()
+	otx.DeleteFlows("table=0, in_port=1, arp, nw_src=%s", clusterCIDR)
+	otx.DeleteFlows("table=0, in_port=1, ip, nw_src=%s", clusterCIDR)
+	otx.DeleteFlows("table=0, in_port=1, ip, nw_dst=%s", clusterCIDR)
+	otx.DeleteFlows("table=0, in_port=2, ip, nw_dst=%s", clusterCIDR)
+	otx.DeleteFlows("table=0, in_port=2, arp, nw_dst=%s", clusterCIDR)
+	otx.DeleteFlows("table=30, arp, nw_dst=%s", clusterCIDR)
+	otx.DeleteFlows("table=30, ip, nw_dst=%s", clusterCIDR)
+	otx.DeleteFlows("table=20, ip, nw_dst=%s", clusterCIDR)
+	otx.DeleteFlows("table=70, ip, nw_src=%s", clusterCIDR)
+	return otx.Commit()
+}
+
+// SetupOVSIPv6 adds the flows for IPv6 pod traffic in a dual-stack cluster. It is
+// called after SetupOVS. IPv6 traffic uses the same pipeline as IPv4, with Neighbor
+// Solicitations taking the place of ARP requests.
+func (oc *ovsController) SetupOVSIPv6(clusterNetworkCIDR []string, localSubnetCIDR, localSubnetGateway string) error {
+	otx := oc.ovs.NewTransaction()
+	oc.addStaticIPv6Flows(otx, clusterNetworkCIDR, localSubnetCIDR, localSubnetGateway)
+	return otx.Commit()
+}
+
+// addStaticIPv6Flows adds the flows that SetupOVSIPv6 creates
+func (oc *ovsController) addStaticIPv6Flows(otx ovs.Transaction, clusterNetworkCIDR []string, localSubnetCIDR, localSubnetGateway string) {
+	// Table 0: initial dispatch based on in_port
+	if oc.useConnTrack {
+		otx.AddFlow("table=0, priority=1000, ipv6, ct_state=-trk, actions=ct(table=0)")
+	}
+	for _, clusterCIDR := range clusterNetworkCIDR {
+		otx.AddFlow("table=0, priority=200, in_port=1, ipv6, ipv6_src=%s, actions=move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:10", clusterCIDR)
+		otx.AddFlow("table=0, priority=200, in_port=1, ipv6, ipv6_dst=%s, actions=move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:10", clusterCIDR)
+	}
+	otx.AddFlow("table=0, priority=200, in_port=2, ipv6, actions=goto_table:30")
+	otx.AddFlow("table=0, priority=100, ipv6, actions=goto_table:20")
+
+	// Table 30: general routing
+	otx.AddFlow("table=30, priority=300, icmp6, icmp_type=135, nd_target=%s, actions=output:2", localSubnetGateway)
+	otx.AddFlow("table=30, priority=200, icmp6, icmp_type=135, nd_target=%s, actions=goto_table:40", localSubnetCIDR)
+	otx.AddFlow("table=30, priority=300, ipv6, ipv6_dst=%s, actions=output:2", localSubnetGateway)
+	otx.AddFlow("table=30, priority=200, ipv6, ipv6_dst=%s, actions=goto_table:70", localSubnetCIDR)
+	for _, clusterCIDR := range clusterNetworkCIDR {
+		otx.AddFlow("table=30, priority=100, icmp6, icmp_type=135, nd_target=%s, actions=goto_table:50", clusterCIDR)
+		otx.AddFlow("table=30, priority=100, ipv6, ipv6_dst=%s, actions=goto_table:90", clusterCIDR)
+	}
+	otx.AddFlow("table=30, priority=0, ipv6, actions=goto_table:99")
+
+	// Table 80: IP policy enforcement
+	otx.AddFlow("table=80, priority=300, ipv6, ipv6_src=%s/128, actions=output:NXM_NX_REG2[]", localSubnetGateway)
+}
+
 func (oc *ovsController) FinishSetupOVS() error {
 	otx := oc.ovs.NewTransaction()
 
@@ -245,6 +574,7 @@ func (oc *ovsController) FinishSetupOVS() error {
 type podNetworkInfo struct {
 	vethName string
 	ip       string
+	ipv6     string
 	ofport   int
 }
 
@@ -285,6 +615,7 @@ func (oc *ovsController) GetPodNetworkInfo() (map[string]podNetworkInfo, error)
 		results[ids["sandbox"]] = podNetworkInfo{
 			vethName: row["name"],
 			ip:       ids["ip"],
+			ipv6:     ids["ipv6"],
 			ofport:   ofport,
 		}
 	}
@@ -296,10 +627,12 @@ func (oc *ovsController) NewTransaction() ovs.Transaction {
 	return oc.ovs.NewTransaction()
 }
 
-func (oc *ovsController) ensureOvsPort(hostVeth, sandboxID, podIP string) (int, error) {
-	ofport, err := oc.ovs.AddPort(hostVeth, -1,
-		fmt.Sprintf(`external_ids=sandbox="%s",ip="%s"`, sandboxID, podIP),
-	)
+func (oc *ovsController) ensureOvsPort(hostVeth, sandboxID string, podIP, podIPv6 net.IP) (int, error) {
+	externalIDs := fmt.Sprintf(`external_ids=sandbox="%s",ip="%s"`, sandboxID, podIP.String())
+	if podIPv6 != nil {
+		externalIDs += fmt.Sprintf(`,ipv6="%s"`, podIPv6.String())
+	}
+	ofport, err := oc.ovs.AddPort(hostVeth, -1, externalIDs)
 	if err != nil {
 		// If hostVeth doesn't exist, ovs-vsctl will return an error, but will
 		// still add an entry to the database anyway.
@@ -308,46 +641,99 @@ func (oc *ovsController) ensureOvsPort(hostVeth, sandboxID, podIP string) (int,
 	return ofport, err
 }
 
-func (oc *ovsController) setupPodFlows(ofport int, podIP net.IP, vnid uint32) error {
+func (oc *ovsController) setupPodFlows(ofport int, podIP, podIPv6 net.IP, vnid uint32) error {
+	otx := oc.ovs.NewTransaction()
+	oc.addPodFlows(otx, ofport, podIP, podIPv6, vnid)
+	return otx.Commit()
+}
+
+// resetPodFlows replaces a pod's flows in a single transaction
+func (oc *ovsController) resetPodFlows(ofport int, podIP, podIPv6 net.IP, vnid uint32) error {
 	otx := oc.ovs.NewTransaction()
+	otx.DeleteFlows(podFlowOwner(podIP).match())
+	oc.addPodFlows(otx, ofport, podIP, podIPv6, vnid)
+	return otx.Commit()
+}
+
+func (oc *ovsController) addPodFlows(otx ovs.Transaction, ofport int, podIP, podIPv6 net.IP, vnid uint32) {
+	owner := podFlowOwner(podIP)
+	cookie := owner.cookie("0")
+	trafficPodFlowCookie := owner.cookie(trafficPodCookie)
+	trafficServiceFlowCookie := owner.cookie(trafficServiceCookie)
+
+	if podIPv6 != nil {
+		ipv6str := podIPv6.String()
+		// Neighbor Discovery/IPv6 traffic from container
+		otx.AddFlow("table=20, priority=100, cookie=%s, in_port=%d, ipv6, ipv6_src=%s, actions=load:%d->NXM_NX_REG0[], goto_table:21", cookie, ofport, ipv6str, vnid)
+		// Neighbor Solicitation to container (not isolated)
+		otx.AddFlow("table=40, priority=100, cookie=%s, icmp6, icmp_type=135, nd_target=%s, actions=output:%d", cookie, ipv6str, ofport)
+		// IPv6 traffic to container
+		otx.AddFlow("table=70, priority=100, cookie=%s, ipv6, ipv6_dst=%s, actions=load:%d->NXM_NX_REG1[], load:%d->NXM_NX_REG2[], goto_table:80", cookie, ipv6str, vnid, ofport)
+	}
 
 	ipstr := podIP.String()
 	podIP = podIP.To4()
 	ipmac := fmt.Sprintf("00:00:%02x:%02x:%02x:%02x/00:00:ff:ff:ff:ff", podIP[0], podIP[1], podIP[2], podIP[3])
 
 	// ARP/IP traffic from container
-	otx.AddFlow("table=20, priority=100, in_port=%d, arp, nw_src=%s, arp_sha=%s, actions=load:%d->NXM_NX_REG0[], goto_table:21", ofport, ipstr, ipmac, vnid)
-	otx.AddFlow("table=20, priority=100, in_port=%d, ip, nw_src=%s, actions=load:%d->NXM_NX_REG0[], goto_table:21", ofport, ipstr, vnid)
+	otx.AddFlow("table=20, priority=100, cookie=%s, in_port=%d, arp, nw_src=%s, arp_sha=%s, actions=load:%d->NXM_NX_REG0[], goto_table:21", cookie, ofport, ipstr, ipmac, vnid)
+	otx.AddFlow("table=20, priority=100, cookie=%s, in_port=%d, ip, nw_src=%s, actions=load:%d->NXM_NX_REG0[], goto_table:21", cookie, ofport, ipstr, vnid)
+	// Same, split out by destination for traffic accounting. (Traffic to the node
+	// itself is external, even though tun0's address is in the cluster network.)
+	clusterNetworkCIDRs, serviceNetworkCIDR, localSubnetGateway := oc.getNetworks()
+	if localSubnetGateway != "" {
+		otx.AddFlow("table=20, priority=120, cookie=%s, in_port=%d, ip, nw_src=%s, nw_dst=%s, actions=load:%d->NXM_NX_REG0[], goto_table:21", cookie, ofport, ipstr, localSubnetGateway, vnid)
+	}
+	for _, clusterCIDR := range clusterNetworkCIDRs {
+		otx.AddFlow("table=20, priority=110, cookie=%s, in_port=%d, ip, nw_src=%s, nw_dst=%s, actions=load:%d->NXM_NX_REG0[], goto_table:21", trafficPodFlowCookie, ofport, ipstr, clusterCIDR, vnid)
+	}
+	if serviceNetworkCIDR != "" {
+		otx.AddFlow("table=20, priority=110, cookie=%s, in_port=%d, ip, nw_src=%s, nw_dst=%s, actions=load:%d->NXM_NX_REG0[], goto_table:21", trafficServiceFlowCookie, ofport, ipstr, serviceNetworkCIDR, vnid)
+	}
 	if oc.useConnTrack {
-		otx.AddFlow("table=25, priority=100, ip, nw_src=%s, actions=load:%d->NXM_NX_REG0[], goto_table:30", ipstr, vnid)
+		otx.AddFlow("table=25, priority=100, cookie=%s, ip, nw_src=%s, actions=load:%d->NXM_NX_REG0[], goto_table:30", cookie, ipstr, vnid)
 	}
 
 	// ARP request/response to container (not isolated)
-	otx.AddFlow("table=40, priority=100, arp, nw_dst=%s, actions=output:%d", ipstr, ofport)
+	otx.AddFlow("table=40, priority=100, cookie=%s, arp, nw_dst=%s, actions=output:%d", cookie, ipstr, ofport)
 
 	// IP traffic to container
-	otx.AddFlow("table=70, priority=100, ip, nw_dst=%s, actions=load:%d->NXM_NX_REG1[], load:%d->NXM_NX_REG2[], goto_table:80", ipstr, vnid, ofport)
-
-	return otx.Commit()
+	otx.AddFlow("table=70, priority=100, cookie=%s, ip, nw_dst=%s, actions=load:%d->NXM_NX_REG1[], load:%d->NXM_NX_REG2[], goto_table:80", cookie, ipstr, vnid, ofport)
+	// Same, split out by source for traffic accounting. (Replies from services
+	// have already been un-NATted by table 30.)
+	if localSubnetGateway != "" {
+		otx.AddFlow("table=70, priority=120, cookie=%s, ip, nw_src=%s, nw_dst=%s, actions=load:%d->NXM_NX_REG1[], load:%d->NXM_NX_REG2[], goto_table:80", cookie, localSubnetGateway, ipstr, vnid, ofport)
+	}
+	for _, clusterCIDR := range clusterNetworkCIDRs {
+		otx.AddFlow("table=70, priority=110, cookie=%s, ip, nw_src=%s, nw_dst=%s, actions=load:%d->NXM_NX_REG1[], load:%d->NXM_NX_REG2[], goto_table:80", trafficPodFlowCookie, clusterCIDR, ipstr, vnid, ofport)
+	}
+	if serviceNetworkCIDR != "" {
+		otx.AddFlow("table=70, priority=110, cookie=%s, ip, nw_src=%s, nw_dst=%s, actions=load:%d->NXM_NX_REG1[], load:%d->NXM_NX_REG2[], goto_table:80", trafficServiceFlowCookie, serviceNetworkCIDR, ipstr, vnid, ofport)
+	}
 }
 
-func (oc *ovsController) cleanupPodFlows(podIP net.IP) error {
-	ipstr := podIP.String()
-
+func (oc *ovsController) cleanupPodFlows(podIP, podIPv6 net.IP) error {
+	// (The IPv6 flows belong to the same owner as the IPv4 flows.)
 	otx := oc.ovs.NewTransaction()
-	otx.DeleteFlows("ip, nw_dst=%s", ipstr)
-	otx.DeleteFlows("ip, nw_src=%s", ipstr)
-	otx.DeleteFlows("arp, nw_dst=%s", ipstr)
-	otx.DeleteFlows("arp, nw_src=%s", ipstr)
+	otx.DeleteFlows(podFlowOwner(podIP).match())
 	return otx.Commit()
 }
 
-func (oc *ovsController) SetUpPod(sandboxID, hostVeth string, podIP net.IP, vnid uint32) (int, error) {
-	ofport, err := oc.ensureOvsPort(hostVeth, sandboxID, podIP.String())
+// SetUpPod sets up a pod's OVS port and flows. podIPv6 is nil unless the cluster
+// is dual-stack.
+func (oc *ovsController) SetUpPod(ctx context.Context, sandboxID, hostVeth string, podIP, podIPv6 net.IP, vnid uint32) (int, error) {
+	var ofport int
+	err := traceStage(ctx, "ovs-port", func(context.Context) error {
+		var err error
+		ofport, err = oc.ensureOvsPort(hostVeth, sandboxID, podIP, podIPv6)
+		return err
+	})
 	if err != nil {
 		return -1, err
 	}
-	return ofport, oc.setupPodFlows(ofport, podIP, vnid)
+	return ofport, traceStage(ctx, "ovs-flows", func(context.Context) error {
+		return oc.setupPodFlows(ofport, podIP, podIPv6, vnid)
+	})
 }
 
 // Returned list can also be used for port names
@@ -410,60 +796,65 @@ func (oc *ovsController) SetPodBandwidth(hostVeth, sandboxID string, ingressBPS,
 	return nil
 }
 
-func (oc *ovsController) getPodDetailsBySandboxID(sandboxID string) (int, net.IP, error) {
+// getPodDetailsBySandboxID returns the pod's ofport, IP, and IPv6 address (if it
+// has one)
+func (oc *ovsController) getPodDetailsBySandboxID(sandboxID string) (int, net.IP, net.IP, error) {
 	rows, err := oc.ovs.Find("interface", []string{"ofport", "external_ids"}, "external_ids:sandbox="+sandboxID)
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, nil, err
 	}
 
 	if len(rows) == 0 {
-		return 0, nil, fmt.Errorf("failed to find pod details in OVS database")
+		return 0, nil, nil, fmt.Errorf("failed to find pod details in OVS database")
 	} else if len(rows) > 1 {
-		return 0, nil, fmt.Errorf("found multiple pods for sandbox ID %q: %#v", sandboxID, rows)
+		return 0, nil, nil, fmt.Errorf("found multiple pods for sandbox ID %q: %#v", sandboxID, rows)
 	}
 
 	ofport, err := strconv.Atoi(rows[0]["ofport"])
 	if err != nil {
-		return 0, nil, fmt.Errorf("could not parse ofport %q: %v", rows[0]["ofport"], err)
+		return 0, nil, nil, fmt.Errorf("could not parse ofport %q: %v", rows[0]["ofport"], err)
 	}
 
 	ids, err := ovs.ParseExternalIDs(rows[0]["external_ids"])
 	if err != nil {
-		return 0, nil, fmt.Errorf("could not parse external_ids %q: %v", rows[0]["external_ids"], err)
+		return 0, nil, nil, fmt.Errorf("could not parse external_ids %q: %v", rows[0]["external_ids"], err)
 	} else if ids["ip"] == "" {
-		return 0, nil, fmt.Errorf("external_ids %#v does not contain IP", ids)
+		return 0, nil, nil, fmt.Errorf("external_ids %#v does not contain IP", ids)
 	}
 	podIP := net.ParseIP(ids["ip"])
 	if podIP == nil {
-		return 0, nil, fmt.Errorf("failed to parse IP %q", ids["ip"])
+		return 0, nil, nil, fmt.Errorf("failed to parse IP %q", ids["ip"])
+	}
+	var podIPv6 net.IP
+	if ids["ipv6"] != "" {
+		podIPv6 = net.ParseIP(ids["ipv6"])
+		if podIPv6 == nil {
+			return 0, nil, nil, fmt.Errorf("failed to parse IPv6 address %q", ids["ipv6"])
+		}
 	}
 
-	return ofport, podIP, nil
+	return ofport, podIP, podIPv6, nil
 }
 
 func (oc *ovsController) UpdatePod(sandboxID string, vnid uint32) error {
-	ofport, podIP, err := oc.getPodDetailsBySandboxID(sandboxID)
+	ofport, podIP, podIPv6, err := oc.getPodDetailsBySandboxID(sandboxID)
 	if err != nil {
 		return err
 	} else if ofport == -1 {
 		return fmt.Errorf("can't update pod %q with missing veth interface", sandboxID)
 	}
-	err = oc.cleanupPodFlows(podIP)
-	if err != nil {
-		return err
-	}
-	return oc.setupPodFlows(ofport, podIP, vnid)
+	return oc.resetPodFlows(ofport, podIP, podIPv6, vnid)
 }
 
 func (oc *ovsController) TearDownPod(sandboxID string) error {
-	_, podIP, err := oc.getPodDetailsBySandboxID(sandboxID)
+	_, podIP, podIPv6, err := oc.getPodDetailsBySandboxID(sandboxID)
 	if err != nil {
 		// OVS flows related to sandboxID not found
 		// Nothing needs to be done in that case
 		return nil
 	}
 
-	if err := oc.cleanupPodFlows(podIP); err != nil {
+	if err := oc.cleanupPodFlows(podIP, podIPv6); err != nil {
 		return err
 	}
 
@@ -493,12 +884,26 @@ func policyNames(policies []osdnv1.EgressNetworkPolicy) string {
 	return strings.Join(names, ", ")
 }
 
-func (oc *ovsController) UpdateEgressNetworkPolicyRules(policies []osdnv1.EgressNetworkPolicy, vnid uint32, namespaces []string, egressDNS *common.EgressDNS) error {
+func (oc *ovsController) UpdateEgressNetworkPolicyRules(policies []osdnv1.EgressNetworkPolicy, vnid uint32, namespaces []string, egressDNS *common.EgressDNS, serviceIPs egressServiceIPsFunc) error {
 	otx := oc.ovs.NewTransaction()
+	errs := oc.updateEgressNetworkPolicyRules(otx, policies, vnid, namespaces, egressDNS, serviceIPs)
+	if txErr := otx.Commit(); txErr != nil {
+		errs = append(errs, txErr)
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// updateEgressNetworkPolicyRules adds the changes for UpdateEgressNetworkPolicyRules
+// to otx, returning any problems with the policies
+func (oc *ovsController) updateEgressNetworkPolicyRules(otx ovs.Transaction, policies []osdnv1.EgressNetworkPolicy, vnid uint32, namespaces []string, egressDNS *common.EgressDNS, serviceIPs egressServiceIPsFunc) []error {
 	errs := []error{}
 
+	owner := egressFlowOwner(vnid)
+	otx.DeleteFlows("table=22, %s", owner.match())
+	otx.DeleteFlows("table=23, %s", owner.match())
+	otx.DeleteFlows("table=99, %s", owner.match())
 	if len(policies) == 0 {
-		otx.DeleteFlows("table=100, reg0=%d", vnid)
+		otx.DeleteFlows("table=100, %s", owner.match())
 	} else if vnid == 0 {
 		errs = append(errs, fmt.Errorf("EgressNetworkPolicy in global network namespace is not allowed (%s); ignoring", policyNames(policies)))
 	} else if len(namespaces) > 1 {
@@ -506,58 +911,155 @@ func (oc *ovsController) UpdateEgressNetworkPolicyRules(policies []osdnv1.Egress
 		// Even though Egress network policy is defined per namespace, its implementation is based on VNIDs.
 		// So in case of shared network namespaces, egress policy of one namespace will affect all other namespaces that are sharing the network which might not be desirable.
 		errs = append(errs, fmt.Errorf("EgressNetworkPolicy not allowed in shared NetNamespace (%s); dropping all traffic", strings.Join(namespaces, ", ")))
-		otx.DeleteFlows("table=100, reg0=%d", vnid)
-		otx.AddFlow("table=100, reg0=%d, priority=1, actions=drop", vnid)
-	} else if len(policies) > 1 {
-		// Rationale: If we have allowed more than one policy, we could end up with different network restrictions depending
-		// on the order of policies that were processed and also it doesn't give more expressive power than a single policy.
-		errs = append(errs, fmt.Errorf("multiple EgressNetworkPolicies in same network namespace (%s) is not allowed; dropping all traffic", policyNames(policies)))
-		otx.DeleteFlows("table=100, reg0=%d", vnid)
-		otx.AddFlow("table=100, reg0=%d, priority=1, actions=drop", vnid)
-	} else /* vnid != 0 && len(policies) == 1 */ {
-		otx.DeleteFlows("table=100, reg0=%d", vnid)
-
-		for i, rule := range policies[0].Spec.Egress {
-			priority := len(policies[0].Spec.Egress) - i
-
-			var action string
-			if rule.Type == osdnv1.EgressNetworkPolicyRuleAllow {
-				action = "goto_table:101"
+		otx.DeleteFlows("table=100, %s", owner.match())
+		otx.AddFlow("table=100, cookie=%s, reg0=%d, priority=1, actions=drop", owner.cookie("0"), vnid)
+	} else /* vnid != 0 && len(policies) > 0 */ {
+		otx.DeleteFlows("table=100, %s", owner.match())
+
+		// If there are multiple policies, their rules are concatenated in priority
+		// order, so the first matching rule across all of the policies wins.
+		// Rules referring to in-cluster Services are also added to tables 22 and
+		// 23 (with the same priorities), since traffic to cluster IPs and pod IPs
+		// never reaches tables 99 and 100. (Other rules have never applied to
+		// in-cluster destinations.)
+		var enforcing, audit []osdnv1.EgressNetworkPolicy
+		for _, policy := range policies {
+			if common.IsEgressNetworkPolicyAuditOnly(&policy) {
+				audit = append(audit, policy)
 			} else {
-				action = "drop"
+				enforcing = append(enforcing, policy)
 			}
+		}
+		common.SortEgressNetworkPolicies(enforcing)
+		common.SortEgressNetworkPolicies(audit)
 
-			var selectors []string
-			if len(rule.To.CIDRSelector) > 0 {
-				selectors = append(selectors, rule.To.CIDRSelector)
-			} else if len(rule.To.DNSName) > 0 {
-				ips := egressDNS.GetIPs(rule.To.DNSName)
-				for _, ip := range ips {
-					selectors = append(selectors, ip.String())
+		numRules := 0
+		for _, policy := range enforcing {
+			numRules += len(policy.Spec.Egress)
+		}
+		i := 0
+		for p := range enforcing {
+			policy := &enforcing[p]
+			for _, rule := range policy.Spec.Egress {
+				priority := numRules - i
+				i++
+
+				var action, serviceAction string
+				if rule.Type == osdnv1.EgressNetworkPolicyRuleAllow {
+					action = "goto_table:101"
+					serviceAction = "goto_table:30"
+				} else {
+					action = "drop"
+					serviceAction = "drop"
+				}
+				_, _, isService := common.ParseEgressServiceDNSName(rule.To.DNSName)
+				for _, dst := range oc.egressRuleDestinations(policy, rule, egressDNS, serviceIPs) {
+					otx.AddFlow("table=100, cookie=%s, reg0=%d, priority=%d, %s, actions=%s", owner.cookie("0"), vnid, priority, dst, action)
+					if isService {
+						otx.AddFlow("table=23, cookie=%s, reg0=%d, priority=%d, %s, actions=%s", owner.cookie("0"), vnid, priority, dst, serviceAction)
+					}
 				}
 			}
+		}
 
-			for _, selector := range selectors {
-				var dst string
-				if selector == "0.0.0.0/0" {
-					dst = ""
-				} else if selector == "0.0.0.0/32" {
-					klog.Warningf("Correcting CIDRSelector '0.0.0.0/32' to '0.0.0.0/0' in EgressNetworkPolicy %s:%s", policies[0].Namespace, policies[0].Name)
-					dst = ""
-				} else {
-					dst = fmt.Sprintf(", nw_dst=%s", selector)
+		// Audit-only policies are evaluated in table 99, before the real firewall,
+		// so they can't affect what it does. Traffic that would have been denied
+		// is tagged with egressAuditCookie so it can be counted. The rules must
+		// fit in between the priority=199 exemption rules and the priority=0
+		// default.
+		numRules = 0
+		for _, policy := range audit {
+			numRules += len(policy.Spec.Egress)
+		}
+		if numRules > maxEgressAuditRules {
+			errs = append(errs, fmt.Errorf("too many rules in audit-only EgressNetworkPolicies (%s); only the first %d will be audited", policyNames(audit), maxEgressAuditRules))
+		}
+		i = 0
+		for p := range audit {
+			policy := &audit[p]
+			for _, rule := range policy.Spec.Egress {
+				if i >= maxEgressAuditRules {
+					break
 				}
+				priority := maxEgressAuditRules - i
+				i++
 
-				otx.AddFlow("table=100, reg0=%d, priority=%d, ip%s, actions=%s", vnid, priority, dst, action)
+				cookie := owner.cookie("0")
+				if rule.Type == osdnv1.EgressNetworkPolicyRuleDeny {
+					cookie = owner.cookie(egressAuditCookie)
+				}
+				_, _, isService := common.ParseEgressServiceDNSName(rule.To.DNSName)
+				for _, dst := range oc.egressRuleDestinations(policy, rule, egressDNS, serviceIPs) {
+					otx.AddFlow("table=99, cookie=%s, reg0=%d, priority=%d, %s, actions=goto_table:100", cookie, vnid, priority, dst)
+					if isService {
+						otx.AddFlow("table=22, cookie=%s, reg0=%d, priority=%d, %s, actions=goto_table:23", cookie, vnid, priority, dst)
+					}
+				}
 			}
 		}
 	}
+	return errs
+}
 
-	if txErr := otx.Commit(); txErr != nil {
-		errs = append(errs, txErr)
+// UpdateEgressFirewallExemptions replaces the flows that let traffic to nodeIPs
+// bypass EgressNetworkPolicy rules (both enforcing and audit-only)
+func (oc *ovsController) UpdateEgressFirewallExemptions(nodeIPs []string) error {
+	otx := oc.ovs.NewTransaction()
+	otx.DeleteFlows("table=99, cookie=%s/%s", egressExemptCookie, flowKindMask)
+	for _, ip := range nodeIPs {
+		otx.AddFlow("table=99, cookie=%s, priority=199, ip, nw_dst=%s, actions=goto_table:101", egressExemptCookie, ip)
 	}
+	return otx.Commit()
+}
 
-	return kerrors.NewAggregate(errs)
+// egressRuleDestinations returns the OVS match strings (eg "ip, nw_dst=1.2.3.0/24")
+// for the destinations of rule. A dnsName referring to an in-cluster Service is
+// resolved with serviceIPs (which may be nil, in which case it matches nothing). In a
+// dual-stack cluster, a rule matching all destinations matches IPv6 traffic too.
+func (oc *ovsController) egressRuleDestinations(policy *osdnv1.EgressNetworkPolicy, rule osdnv1.EgressNetworkPolicyRule, egressDNS *common.EgressDNS, serviceIPs egressServiceIPsFunc) []string {
+	var selectors []string
+	if len(rule.To.CIDRSelector) > 0 {
+		selectors = append(selectors, rule.To.CIDRSelector)
+	} else if namespace, name, ok := common.ParseEgressServiceDNSName(rule.To.DNSName); ok {
+		if serviceIPs != nil {
+			for _, ip := range serviceIPs(namespace, name) {
+				if ip.To4() != nil || oc.dualStack {
+					selectors = append(selectors, ip.String())
+				}
+			}
+		}
+	} else if len(rule.To.DNSName) > 0 {
+		ips := egressDNS.GetPolicyIPs(policy, rule.To.DNSName)
+		for _, ip := range ips {
+			selectors = append(selectors, ip.String())
+		}
+	}
+
+	dsts := make([]string, 0, len(selectors))
+	for _, selector := range selectors {
+		if selector == "0.0.0.0/32" {
+			klog.Warningf("Correcting CIDRSelector '0.0.0.0/32' to '0.0.0.0/0' in EgressNetworkPolicy %s:%s", policy.Namespace, policy.Name)
+			selector = "0.0.0.0/0"
+		}
+		switch {
+		case selector == "0.0.0.0/0":
+			dsts = append(dsts, "ip")
+			if oc.dualStack {
+				dsts = append(dsts, "ipv6")
+			}
+		case selector == "::/0":
+			if oc.dualStack {
+				dsts = append(dsts, "ipv6")
+			}
+		case utilnet.IsIPv6String(selector) || utilnet.IsIPv6CIDRString(selector):
+			if oc.dualStack {
+				dsts = append(dsts, ipMatch("dst", selector))
+			}
+		default:
+			dsts = append(dsts, ipMatch("dst", selector))
+		}
+	}
+	return dsts
 }
 
 func hostSubnetCookie(subnet *osdnv1.HostSubnet) uint32 {
@@ -566,35 +1068,107 @@ func hostSubnetCookie(subnet *osdnv1.HostSubnet) uint32 {
 }
 
 func (oc *ovsController) AddHostSubnetRules(subnet *osdnv1.HostSubnet) error {
-	cookie := hostSubnetCookie(subnet)
 	otx := oc.ovs.NewTransaction()
+	addHostSubnetRules(otx, subnet, common.EncapsulationVXLAN)
+	return otx.Commit()
+}
 
+// addHostSubnetRules adds the flows to reach subnet's pods with the given
+// encapsulation. With common.EncapsulationNone, IPv4 traffic to the subnet is sent
+// to tun0 unencapsulated, for the node's network to route (with the node answering
+// ARP requests for the subnet via proxy ARP); IPv6 traffic still uses VXLAN.
+func addHostSubnetRules(otx ovs.Transaction, subnet *osdnv1.HostSubnet, encap string) {
+	cookie := hostSubnetCookie(subnet)
 	otx.AddFlow("table=10, priority=100, cookie=0x%08x, tun_src=%s, actions=goto_table:30", cookie, subnet.HostIP)
+	loadVNID := "move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31]"
 	if vnid, ok := subnet.Annotations[osdnv1.FixedVNIDHostAnnotation]; ok {
-		otx.AddFlow("table=50, priority=100, cookie=0x%08x, arp, nw_dst=%s, actions=load:%s->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1", cookie, subnet.Subnet, vnid, subnet.HostIP)
-		otx.AddFlow("table=90, priority=100, cookie=0x%08x, ip, nw_dst=%s, actions=load:%s->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1", cookie, subnet.Subnet, vnid, subnet.HostIP)
-	} else {
-		otx.AddFlow("table=50, priority=100, cookie=0x%08x, arp, nw_dst=%s, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1", cookie, subnet.Subnet, subnet.HostIP)
-		otx.AddFlow("table=90, priority=100, cookie=0x%08x, ip, nw_dst=%s, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1", cookie, subnet.Subnet, subnet.HostIP)
+		loadVNID = fmt.Sprintf("load:%s->NXM_NX_TUN_ID[0..31]", vnid)
+	}
+	switch encap {
+	case common.EncapsulationNone:
+		otx.AddFlow("table=0, priority=200, cookie=0x%08x, in_port=2, arp, nw_src=%s, actions=goto_table:30", cookie, subnet.Subnet)
+		otx.AddFlow("table=50, priority=100, cookie=0x%08x, arp, nw_dst=%s, actions=output:2", cookie, subnet.Subnet)
+		otx.AddFlow("table=90, priority=100, cookie=0x%08x, ip, nw_dst=%s, actions=output:2", cookie, subnet.Subnet)
+	default:
+		tunnelPort := 1
+		if encap == common.EncapsulationGeneve {
+			tunnelPort = geneve0OFPort
+		}
+		otx.AddFlow("table=50, priority=100, cookie=0x%08x, arp, nw_dst=%s, actions=%s,set_field:%s->tun_dst,output:%d", cookie, subnet.Subnet, loadVNID, subnet.HostIP, tunnelPort)
+		otx.AddFlow("table=90, priority=100, cookie=0x%08x, ip, nw_dst=%s, actions=%s,set_field:%s->tun_dst,output:%d", cookie, subnet.Subnet, loadVNID, subnet.HostIP, tunnelPort)
 	}
+	if subnetV6, ok := subnet.Annotations[common.HostSubnetIPv6Annotation]; ok {
+		otx.AddFlow("table=50, priority=100, cookie=0x%08x, icmp6, icmp_type=135, nd_target=%s, actions=%s,set_field:%s->tun_dst,output:1", cookie, subnetV6, loadVNID, subnet.HostIP)
+		otx.AddFlow("table=90, priority=100, cookie=0x%08x, ipv6, ipv6_dst=%s, actions=%s,set_field:%s->tun_dst,output:1", cookie, subnetV6, loadVNID, subnet.HostIP)
+	}
+}
 
+func (oc *ovsController) DeleteHostSubnetRules(subnet *osdnv1.HostSubnet) error {
+	otx := oc.ovs.NewTransaction()
+	deleteHostSubnetRules(otx, subnet)
 	return otx.Commit()
 }
 
-func (oc *ovsController) DeleteHostSubnetRules(subnet *osdnv1.HostSubnet) error {
+func deleteHostSubnetRules(otx ovs.Transaction, subnet *osdnv1.HostSubnet) {
 	cookie := hostSubnetCookie(subnet)
-
-	otx := oc.ovs.NewTransaction()
+	otx.DeleteFlows("table=0, cookie=0x%08x/0xffffffff, in_port=2, arp, nw_src=%s", cookie, subnet.Subnet)
 	otx.DeleteFlows("table=10, cookie=0x%08x/0xffffffff, tun_src=%s", cookie, subnet.HostIP)
 	otx.DeleteFlows("table=50, cookie=0x%08x/0xffffffff, arp, nw_dst=%s", cookie, subnet.Subnet)
 	otx.DeleteFlows("table=90, cookie=0x%08x/0xffffffff, ip, nw_dst=%s", cookie, subnet.Subnet)
+	if subnetV6, ok := subnet.Annotations[common.HostSubnetIPv6Annotation]; ok {
+		otx.DeleteFlows("table=50, cookie=0x%08x/0xffffffff, icmp6, icmp_type=135, nd_target=%s", cookie, subnetV6)
+		otx.DeleteFlows("table=90, cookie=0x%08x/0xffffffff, ipv6, ipv6_dst=%s", cookie, subnetV6)
+	}
+}
+
+// FindHostSubnetCookies returns the cookies of all of the HostSubnet flows currently
+// in OVS. (This is used to find flows for HostSubnets that were deleted while the
+// node was not running.)
+func (oc *ovsController) FindHostSubnetCookies() (sets.String, error) {
+	flows, err := oc.ovs.DumpFlows("table=10")
+	if err != nil {
+		return nil, err
+	}
+
+	cookies := sets.NewString()
+	for _, flow := range flows {
+		parsed, err := ovs.ParseFlow(ovs.ParseForDump, flow)
+		if err != nil {
+			klog.Warningf("FindHostSubnetCookies: could not parse flow %q: %v", flow, err)
+			continue
+		}
+		cookie, err := strconv.ParseUint(parsed.Cookie, 0, 32)
+		if err != nil || cookie == 0 {
+			continue
+		}
+		cookies.Insert(fmt.Sprintf("0x%08x", cookie))
+	}
+	return cookies, nil
+}
+
+// DeleteHostSubnetRulesByCookie deletes the HostSubnet flows with the given cookie (as
+// returned by FindHostSubnetCookies).
+func (oc *ovsController) DeleteHostSubnetRulesByCookie(cookie string) error {
+	otx := oc.ovs.NewTransaction()
+	deleteHostSubnetRulesByCookie(otx, cookie)
 	return otx.Commit()
 }
 
+func deleteHostSubnetRulesByCookie(otx ovs.Transaction, cookie string) {
+	otx.DeleteFlows("table=0, cookie=%s/0xffffffff", cookie)
+	otx.DeleteFlows("table=10, cookie=%s/0xffffffff", cookie)
+	otx.DeleteFlows("table=50, cookie=%s/0xffffffff", cookie)
+	otx.DeleteFlows("table=90, cookie=%s/0xffffffff", cookie)
+}
+
 func (oc *ovsController) AddServiceRules(service *corev1.Service, netID uint32) error {
 	otx := oc.ovs.NewTransaction()
+	addServiceRules(otx, service, netID)
+	return otx.Commit()
+}
 
-	action := fmt.Sprintf(", priority=100, actions=load:%d->NXM_NX_REG1[], load:2->NXM_NX_REG2[], goto_table:80", netID)
+func addServiceRules(otx ovs.Transaction, service *corev1.Service, netID uint32) {
+	action := fmt.Sprintf(", priority=100, cookie=%s, actions=load:%d->NXM_NX_REG1[], load:2->NXM_NX_REG2[], goto_table:80", serviceFlowOwner(service).cookie("0"), netID)
 
 	// Add blanket rule allowing subsequent IP fragments
 	otx.AddFlow(generateBaseServiceRule(service.Spec.ClusterIP) + ", ip_frag=later" + action)
@@ -606,16 +1180,150 @@ func (oc *ovsController) AddServiceRules(service *corev1.Service, netID uint32)
 		}
 		otx.AddFlow(baseRule + action)
 	}
+}
 
+func (oc *ovsController) DeleteServiceRules(service *corev1.Service) error {
+	otx := oc.ovs.NewTransaction()
+	deleteServiceRules(otx, service)
 	return otx.Commit()
 }
 
-func (oc *ovsController) DeleteServiceRules(service *corev1.Service) error {
+func deleteServiceRules(otx ovs.Transaction, service *corev1.Service) {
+	// (This leaves the service's hairpin flows, which are managed separately)
+	otx.DeleteFlows("table=60, cookie=%s/0xffffffffffffffff", serviceFlowOwner(service).cookie("0"))
+}
+
+// AddHairpinRules adds the flows for hairpin traffic of service that is NATted to
+// its cluster IP rather than to the tun0 IP (see HairpinModeServiceIP). The NATted
+// traffic comes in from tun0 like host traffic, and bypasses policy just as it
+// would have if it came from the tun0 IP. Without conntrack, the pod's replies to
+// the service IP also need to be let through to tun0 on any port, to be un-NATted.
+func (oc *ovsController) AddHairpinRules(service *corev1.Service, netID uint32) error {
+	cookie := serviceFlowOwner(service).cookie(hairpinCookie)
+	otx := oc.ovs.NewTransaction()
+	otx.AddFlow("table=80, priority=300, cookie=%s, in_port=2, ip, nw_src=%s, actions=output:NXM_NX_REG2[]", cookie, service.Spec.ClusterIP)
+	if !oc.useConnTrack {
+		otx.AddFlow("table=60, priority=90, cookie=%s, reg0=%d, ip, nw_dst=%s, actions=load:%d->NXM_NX_REG1[], load:2->NXM_NX_REG2[], goto_table:80", cookie, netID, service.Spec.ClusterIP, netID)
+	}
+	return otx.Commit()
+}
+
+// DeleteHairpinRules deletes the flows added by AddHairpinRules for service
+func (oc *ovsController) DeleteHairpinRules(service *corev1.Service) error {
+	cookie := serviceFlowOwner(service).cookie(hairpinCookie)
 	otx := oc.ovs.NewTransaction()
-	otx.DeleteFlows(generateBaseServiceRule(service.Spec.ClusterIP))
+	otx.DeleteFlows("table=60, cookie=%s/0xffffffffffffffff", cookie)
+	otx.DeleteFlows("table=80, cookie=%s/0xffffffffffffffff", cookie)
 	return otx.Commit()
 }
 
+// getLoadBalancerSourceRangeIPs returns the ingress IPs of service if it is a
+// LoadBalancer with loadBalancerSourceRanges, or nil otherwise
+func getLoadBalancerSourceRangeIPs(service *corev1.Service) []net.IP {
+	if service.Spec.Type != corev1.ServiceTypeLoadBalancer || len(service.Spec.LoadBalancerSourceRanges) == 0 {
+		return nil
+	}
+	var ips []net.IP
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ip := net.ParseIP(ingress.IP); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// AddLoadBalancerSourceRangeRules adds flows dropping traffic from pods to the
+// ingress IPs of service unless it comes from one of its loadBalancerSourceRanges.
+// kube-proxy enforces the source ranges too, but traffic from pods to a load
+// balancer may reach it without passing through the kube-proxy chains (eg, if the
+// load balancer is outside the cluster and doesn't preserve the pod's IP). Each
+// ingress IP is only reachable from the source ranges of the same IP family.
+func (oc *ovsController) AddLoadBalancerSourceRangeRules(service *corev1.Service) error {
+	if len(getLoadBalancerSourceRangeIPs(service)) == 0 {
+		return nil
+	}
+	otx := oc.ovs.NewTransaction()
+	addLoadBalancerSourceRangeRules(otx, service)
+	return otx.Commit()
+}
+
+func addLoadBalancerSourceRangeRules(otx ovs.Transaction, service *corev1.Service) {
+	ips := getLoadBalancerSourceRangeIPs(service)
+
+	var ranges, rangesV6 []string
+	for _, sourceRange := range service.Spec.LoadBalancerSourceRanges {
+		_, cidr, err := net.ParseCIDR(strings.TrimSpace(sourceRange))
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("Ignoring invalid loadBalancerSourceRange %q for service %s/%s", sourceRange, service.Namespace, service.Name))
+			continue
+		}
+		if cidr.IP.To4() != nil {
+			ranges = append(ranges, cidr.String())
+		} else {
+			rangesV6 = append(rangesV6, cidr.String())
+		}
+	}
+
+	owner := serviceFlowOwner(service)
+	for _, ip := range ips {
+		srcField, srcRanges := "nw_src", ranges
+		if ip.To4() == nil {
+			srcField, srcRanges = "ipv6_src", rangesV6
+		}
+		for _, port := range service.Spec.Ports {
+			match, err := generateLoadBalancerSourceRangeMatch(ip, port.Protocol, int(port.Port))
+			if err != nil {
+				utilruntime.HandleError(fmt.Errorf("Error creating OVS flow for service %s/%s: %v", service.Namespace, service.Name, err))
+				continue
+			}
+			for _, sourceRange := range srcRanges {
+				otx.AddFlow("table=30, priority=160, cookie=%s, %s, %s=%s, actions=goto_table:99", owner.cookie(lbSourceRangeCookie), match, srcField, sourceRange)
+			}
+			otx.AddFlow("table=30, priority=150, cookie=%s, %s, actions=drop", owner.cookie(lbSourceRangeCookie), match)
+		}
+	}
+}
+
+// DeleteLoadBalancerSourceRangeRules deletes the flows added by
+// AddLoadBalancerSourceRangeRules for service
+func (oc *ovsController) DeleteLoadBalancerSourceRangeRules(service *corev1.Service) error {
+	ips := getLoadBalancerSourceRangeIPs(service)
+	if len(ips) == 0 {
+		return nil
+	}
+
+	otx := oc.ovs.NewTransaction()
+	otx.DeleteFlows("table=30, %s", serviceFlowOwner(service).match())
+	return otx.Commit()
+}
+
+// ResyncLoadBalancerSourceRangeRules rewrites the flows added by
+// AddLoadBalancerSourceRangeRules for services, in case they have drifted
+func (oc *ovsController) ResyncLoadBalancerSourceRangeRules(services []*corev1.Service) error {
+	otx := oc.ovs.NewTransaction()
+	for _, service := range services {
+		if len(getLoadBalancerSourceRangeIPs(service)) == 0 {
+			continue
+		}
+		otx.DeleteFlows("table=30, %s", serviceFlowOwner(service).match())
+		addLoadBalancerSourceRangeRules(otx, service)
+	}
+	return otx.Commit()
+}
+
+func generateLoadBalancerSourceRangeMatch(IP net.IP, protocol corev1.Protocol, port int) (string, error) {
+	switch protocol {
+	case corev1.ProtocolTCP, corev1.ProtocolUDP, corev1.ProtocolSCTP:
+	default:
+		return "", fmt.Errorf("unhandled protocol %v", protocol)
+	}
+	proto := strings.ToLower(string(protocol))
+	if IP.To4() == nil {
+		return fmt.Sprintf("ipv6, ipv6_dst=%s, %s6, tp_dst=%d", IP, proto, port), nil
+	}
+	return fmt.Sprintf("ip, nw_dst=%s, %s, %s_dst=%d", IP, proto, proto, port), nil
+}
+
 func generateBaseServiceRule(IP string) string {
 	return fmt.Sprintf("table=60, ip, nw_dst=%s", IP)
 }
@@ -658,20 +1366,121 @@ func (oc *ovsController) UpdateLocalMulticastFlows(vnid uint32, enabled bool, of
 	return otx.Commit()
 }
 
-func (oc *ovsController) UpdateVXLANMulticastFlows(remoteIPs []string) error {
+// UpdateMulticastGrantFlows replaces vnid's table 120 flows for multicast groups
+// granted to other namespaces. grants maps each group (a CIDR) to the ofports of the
+// other namespaces' pods that it is delivered to, in addition to ofports.
+func (oc *ovsController) UpdateMulticastGrantFlows(vnid uint32, ofports []int, grants map[string][]int) error {
 	otx := oc.ovs.NewTransaction()
+	otx.DeleteFlows("table=120, cookie=%s/%s, reg0=%d", multicastGrantCookie, flowKindMask, vnid)
+
+	for group, receivers := range grants {
+		_, cidr, err := net.ParseCIDR(group)
+		if err != nil {
+			return fmt.Errorf("invalid multicast group %q: %v", group, err)
+		}
+		ones, _ := cidr.Mask.Size()
+		allOfports := sets.NewInt(ofports...).Insert(receivers...).List()
+		actions := make([]string, len(allOfports))
+		for i, ofport := range allOfports {
+			actions[i] = fmt.Sprintf("output:%d", ofport)
+		}
+		otx.AddFlow("table=120, cookie=%s, priority=%d, reg0=%d, ip, nw_dst=%s, actions=%s", multicastGrantCookie, 101+ones, vnid, cidr.String(), strings.Join(actions, ","))
+	}
+
+	return otx.Commit()
+}
 
+func (oc *ovsController) UpdateVXLANMulticastFlows(remoteIPs []string) error {
+	return oc.commitVXLANMulticastFlows(oc.ovs.NewTransaction(), remoteIPs)
+}
+
+// commitVXLANMulticastFlows adds the table 111 flows for remoteIPs to otx and
+// commits it, only recording remoteIPs (for later rewrites of the flows) if the
+// commit succeeds
+func (oc *ovsController) commitVXLANMulticastFlows(otx ovs.Transaction, remoteIPs []string) error {
+	oc.multicastLock.Lock()
+	defer oc.multicastLock.Unlock()
+
+	oc.addVXLANMulticastFlows(otx, remoteIPs)
+	if err := otx.Commit(); err != nil {
+		return err
+	}
+	oc.vxlanMulticastIPs = remoteIPs
+	return nil
+}
+
+// addVXLANMulticastFlows adds the table 111 flows for remoteIPs; must be called with
+// multicastLock held
+func (oc *ovsController) addVXLANMulticastFlows(otx ovs.Transaction, remoteIPs []string) {
+	var actions string
 	if len(remoteIPs) > 0 {
-		actions := make([]string, len(remoteIPs))
+		remotes := make([]string, len(remoteIPs))
 		for i, ip := range remoteIPs {
-			actions[i] = fmt.Sprintf("set_field:%s->tun_dst,output:1", ip)
+			remotes[i] = fmt.Sprintf("set_field:%s->tun_dst,output:1", ip)
 		}
-		sort.Strings(actions)
-		otx.AddFlow("table=111, priority=100, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],%s,goto_table:120", strings.Join(actions, ","))
+		sort.Strings(remotes)
+		actions = fmt.Sprintf("move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],%s,goto_table:120", strings.Join(remotes, ","))
 	} else {
-		otx.AddFlow("table=111, priority=100, actions=goto_table:120")
+		actions = "goto_table:120"
 	}
+	otx.AddFlow("table=111, priority=100, actions=%s", actions)
 
+	// Multicast gateway groups, and the IGMP reports that tell the gateway which
+	// groups pods are interested in, are also sent to the node
+	otx.DeleteFlows("table=111, cookie=%s/%s", multicastGatewayCookie, flowKindMask)
+	for _, group := range oc.multicastGatewayGroups {
+		otx.AddFlow("table=111, cookie=%s, priority=110, udp, nw_dst=%s, udp_dst=%d, actions=output:2,%s", multicastGatewayCookie, group.IP.String(), group.Port, actions)
+	}
+	if len(oc.multicastGatewayGroups) > 0 {
+		otx.AddFlow("table=111, cookie=%s, priority=110, ip, nw_proto=2, actions=output:2,%s", multicastGatewayCookie, actions)
+	}
+}
+
+// SetMulticastGatewayGroups replaces the flows that send traffic for multicast
+// gateway groups between the node and pods. Traffic to the groups from pods in
+// multicast-enabled namespaces is sent to tun0 as well as to the usual destinations,
+// and traffic to the groups from tun0 is delivered by the flows added by
+// UpdateMulticastGatewayDeliveryFlows.
+func (oc *ovsController) SetMulticastGatewayGroups(groups []*net.UDPAddr) error {
+	oc.multicastLock.Lock()
+	defer oc.multicastLock.Unlock()
+
+	otx := oc.ovs.NewTransaction()
+	oc.multicastGatewayGroups = groups
+	otx.DeleteFlows("table=0, cookie=%s/%s", multicastGatewayCookie, flowKindMask)
+	otx.DeleteFlows("table=120, cookie=%s/%s", multicastGatewayCookie, flowKindMask)
+	for _, group := range groups {
+		otx.AddFlow("table=0, cookie=%s, priority=450, in_port=2, udp, nw_dst=%s, udp_dst=%d, actions=goto_table:120", multicastGatewayCookie, group.IP.String(), group.Port)
+	}
+	if len(groups) > 0 {
+		// The gateway's IGMP queries to the pods
+		otx.AddFlow("table=0, cookie=%s, priority=450, in_port=2, ip, nw_proto=2, nw_dst=224.0.0.1, actions=goto_table:120", multicastGatewayCookie)
+	}
+	oc.addVXLANMulticastFlows(otx, oc.vxlanMulticastIPs)
+	return otx.Commit()
+}
+
+// UpdateMulticastGatewayDeliveryFlows replaces the table 120 flows that deliver
+// traffic for the multicast gateway groups, and the gateway's IGMP queries, from
+// tun0 to the given ofports
+func (oc *ovsController) UpdateMulticastGatewayDeliveryFlows(ofports []int) error {
+	oc.multicastLock.Lock()
+	defer oc.multicastLock.Unlock()
+
+	otx := oc.ovs.NewTransaction()
+	otx.DeleteFlows("table=120, cookie=%s/%s", multicastGatewayCookie, flowKindMask)
+	if len(ofports) > 0 {
+		var actions []string
+		for _, ofport := range sets.NewInt(ofports...).List() {
+			actions = append(actions, fmt.Sprintf("output:%d", ofport))
+		}
+		for _, group := range oc.multicastGatewayGroups {
+			otx.AddFlow("table=120, cookie=%s, priority=150, in_port=2, udp, nw_dst=%s, udp_dst=%d, actions=%s", multicastGatewayCookie, group.IP.String(), group.Port, strings.Join(actions, ","))
+		}
+		if len(oc.multicastGatewayGroups) > 0 {
+			otx.AddFlow("table=120, cookie=%s, priority=150, in_port=2, ip, nw_proto=2, nw_dst=224.0.0.1, actions=%s", multicastGatewayCookie, strings.Join(actions, ","))
+		}
+	}
 	return otx.Commit()
 }
 
@@ -685,21 +1494,21 @@ func (oc *ovsController) FindPolicyVNIDs() sets.Int {
 }
 
 // FindUnusedVNIDs returns a list of VNIDs for which there are table 80 "policy" rules,
-// but no table 60/70 "load" rules (meaning that there are no longer any pods or services
-// on this node with that VNID). There is no locking with respect to other ovsController
-// actions, but as long the "add a pod" and "add a service" codepaths add the
-// pod/service-specific rules before they call policy.EnsureVNIDRules(), then there is no
-// race condition.
+// but no table 70 "load" rules (meaning that there are no longer any pods on this node
+// with that VNID). (Service flows don't count, since traffic to a service from a local
+// pod with a different VNID is allowed by shared-services flows, not by the policy
+// rules of the service's VNID.) There is no locking with respect to other
+// ovsController actions, but as long the "add a pod" codepath adds the pod-specific
+// rules before it calls policy.EnsureVNIDRules(), then there is no race condition.
 func (oc *ovsController) FindUnusedVNIDs() []int {
 	inUseVNIDs, policyVNIDs := oc.findInUseAndPolicyVNIDs()
-	// VNID 0 is always in use, even if there aren't any flows for it in table 60/70
+	// VNID 0 is always in use, even if there aren't any flows for it in table 70
 	inUseVNIDs.Insert(0)
 	return policyVNIDs.Difference(inUseVNIDs).UnsortedList()
 }
 
 // findInUseAndPolicyVNIDs returns two sets: the VNIDs that are currently in use by pods
-// or services on this node, and the VNIDs that are currently in use by NetworkPolicies
-// on this node.
+// on this node, and the VNIDs that are currently in use by NetworkPolicies on this node.
 func (oc *ovsController) findInUseAndPolicyVNIDs() (sets.Int, sets.Int) {
 	inUseVNIDs := sets.NewInt()
 	policyVNIDs := sets.NewInt()
@@ -717,9 +1526,9 @@ func (oc *ovsController) findInUseAndPolicyVNIDs() (sets.Int, sets.Int) {
 			continue
 		}
 
-		// A VNID is in use if there is a table 60 (services) or 70 (pods) flow that
-		// loads that VNID into reg1 for later comparison.
-		if parsed.Table == 60 || parsed.Table == 70 {
+		// A VNID is in use if there is a table 70 (pods) flow that loads that VNID
+		// into reg1 for later comparison.
+		if parsed.Table == 70 {
 			// Can't use FindAction here since there may be multiple "load"s
 			for _, action := range parsed.Actions {
 				if action.Name != "load" || strings.Index(action.Value, "REG1") == -1 {
@@ -740,7 +1549,9 @@ func (oc *ovsController) findInUseAndPolicyVNIDs() (sets.Int, sets.Int) {
 		}
 
 		// A VNID is checked by policy if there is a table 80 rule comparing reg1 to it.
-		if parsed.Table == 80 {
+		// (Shared-services flows don't count, since they don't depend on whether
+		// the VNID is in use on this node.)
+		if parsed.Table == 80 && flowCookieKind(parsed.Cookie) != sharedServicesCookie {
 			if field, exists := parsed.FindField("reg1"); exists {
 				vnid, err := strconv.ParseInt(field.Value, 0, 32)
 				if err != nil {
@@ -772,27 +1583,92 @@ func (oc *ovsController) ensureTunMAC() error {
 
 func (oc *ovsController) SetNamespaceEgressNormal(vnid uint32) error {
 	otx := oc.ovs.NewTransaction()
-	otx.DeleteFlows("table=101, reg0=%d", vnid)
-	otx.DeleteGroup(vnid)
+	oc.setNamespaceEgressNormal(otx, vnid)
 	return otx.Commit()
 }
 
-func (oc *ovsController) SetNamespaceEgressDropped(vnid uint32) error {
-	otx := oc.ovs.NewTransaction()
+func (oc *ovsController) setNamespaceEgressNormal(otx ovs.Transaction, vnid uint32) {
+	oc.egressGroupsLock.Lock()
+	defer oc.egressGroupsLock.Unlock()
+
+	otx.DeleteFlows("table=101, %s", egressFlowOwner(vnid).kindMatch("0"))
 	otx.DeleteGroup(vnid)
-	otx.DeleteFlows("table=101, reg0=%d", vnid)
-	otx.AddFlow("table=101, priority=100, reg0=%d, actions=drop", vnid)
+	delete(oc.egressGroupDestinations, vnid)
+}
+
+// SetNamespaceDirectAttach sets whether vnid's off-cluster traffic is marked with
+// directAttachMark, so that it leaves the node without being masqueraded. The
+// traffic has already been through tables 80 and 100 by then, and egress IPs (whose
+// table 101 flows have a higher priority) still take precedence.
+func (oc *ovsController) SetNamespaceDirectAttach(vnid uint32, enabled bool) error {
+	owner := egressFlowOwner(vnid)
+	otx := oc.ovs.NewTransaction()
+	otx.DeleteFlows("table=101, %s", owner.kindMatch(directAttachCookie))
+	if enabled {
+		otx.AddFlow("table=101, priority=50, cookie=%s, ip, reg0=%d, actions=set_field:%s->pkt_mark,output:2", owner.cookie(directAttachCookie), vnid, directAttachMark)
+	}
 	return otx.Commit()
 }
 
-func (oc *ovsController) SetNamespaceEgressViaEgressIPs(vnid uint32, egressIPsMetaData []egressIPMetaData) error {
+// addNamespaceEgressFlows adds table 101 flows for vnid's traffic to destinations
+// with the given actions
+func addNamespaceEgressFlows(otx ovs.Transaction, vnid uint32, destinations []string, actions string) {
+	cookie := egressFlowOwner(vnid).cookie("0")
+	for _, dest := range destinations {
+		otx.AddFlow("table=101, priority=100, cookie=%s, ip, reg0=%d, nw_dst=%s, actions=%s", cookie, vnid, dest, actions)
+	}
+}
+
+// SetNamespaceEgressDropped drops vnid's egress traffic (or just its traffic to
+// destinations, if that is non-empty)
+func (oc *ovsController) SetNamespaceEgressDropped(vnid uint32, destinations []string) error {
 	otx := oc.ovs.NewTransaction()
-	otx.DeleteFlows("table=101, reg0=%d", vnid)
+	oc.setNamespaceEgressDropped(otx, vnid, destinations)
+	return otx.Commit()
+}
+
+func (oc *ovsController) setNamespaceEgressDropped(otx ovs.Transaction, vnid uint32, destinations []string) {
+	oc.egressGroupsLock.Lock()
+	defer oc.egressGroupsLock.Unlock()
+
 	otx.DeleteGroup(vnid)
+	otx.DeleteFlows("table=101, %s", egressFlowOwner(vnid).kindMatch("0"))
+	delete(oc.egressGroupDestinations, vnid)
+	if len(destinations) == 0 {
+		otx.AddFlow("table=101, priority=100, cookie=%s, reg0=%d, actions=drop", egressFlowOwner(vnid).cookie("0"), vnid)
+	} else {
+		addNamespaceEgressFlows(otx, vnid, destinations, "drop")
+	}
+}
 
+// SetNamespaceEgressViaEgressIPs sends vnid's egress traffic (or just its traffic to
+// destinations, if that is non-empty) via the given egress IPs. The traffic is
+// balanced between the egress IPs by an OVS select group (which hashes each
+// connection's 5-tuple to pick a bucket), so if vnid's traffic is already being
+// sent to its group, only the group's buckets need to be updated.
+func (oc *ovsController) SetNamespaceEgressViaEgressIPs(vnid uint32, destinations []string, egressIPsMetaData []egressIPMetaData) error {
+	otx := oc.ovs.NewTransaction()
+	if err := oc.setNamespaceEgressViaEgressIPs(otx, vnid, destinations, egressIPsMetaData); err != nil {
+		return err
+	}
+	if err := otx.Commit(); err != nil {
+		oc.forgetEgressGroupDestinations(vnid)
+		return err
+	}
+	return nil
+}
+
+// setNamespaceEgressViaEgressIPs adds the changes for SetNamespaceEgressViaEgressIPs
+// to otx. If otx then fails to commit, the caller must call
+// forgetEgressGroupDestinations.
+func (oc *ovsController) setNamespaceEgressViaEgressIPs(otx ovs.Transaction, vnid uint32, destinations []string, egressIPsMetaData []egressIPMetaData) error {
+	oc.egressGroupsLock.Lock()
+	defer oc.egressGroupsLock.Unlock()
+
+	localIP := oc.getLocalIP()
 	var buildBuckets []string
 	for _, egressIPMetaData := range egressIPsMetaData {
-		if egressIPMetaData.nodeIP == oc.localIP {
+		if egressIPMetaData.nodeIP == localIP {
 			if err := oc.ensureTunMAC(); err != nil {
 				return err
 			}
@@ -809,14 +1685,51 @@ func (oc *ovsController) SetNamespaceEgressViaEgressIPs(vnid uint32, egressIPsMe
 
 	}
 
+	owner := egressFlowOwner(vnid)
+	groupDestinations := strings.Join(destinations, ",")
+	if installed, ok := oc.egressGroupDestinations[vnid]; ok && installed == groupDestinations && len(egressIPsMetaData) > 0 {
+		otx.ModifyGroup(vnid, "select", buildBuckets)
+		return nil
+	}
+
+	otx.DeleteFlows("table=101, %s", owner.kindMatch("0"))
+	otx.DeleteGroup(vnid)
+	delete(oc.egressGroupDestinations, vnid)
+
 	if len(egressIPsMetaData) == 0 {
 		// Namespace wants egressIP, but no node hosts it, so drop
-		otx.AddFlow("table=101, priority=100, reg0=%d, actions=drop", vnid)
+		if len(destinations) == 0 {
+			otx.AddFlow("table=101, priority=100, cookie=%s, reg0=%d, actions=drop", owner.cookie("0"), vnid)
+		} else {
+			addNamespaceEgressFlows(otx, vnid, destinations, "drop")
+		}
+		return nil
+	}
+
+	// there is at least one egressIP hosted by one other node. Use a group
+	// to load balance between the egressIPs
+	otx.AddGroup(vnid, "select", buildBuckets)
+	if len(destinations) == 0 {
+		otx.AddFlow("table=101, priority=100, cookie=%s, ip, reg0=%d, actions=group:%d", owner.cookie("0"), vnid, vnid)
 	} else {
-		// there is at least one egressIP hosted by one other node. Use a group
-		// to load balance between the egressIPs
-		otx.AddGroup(vnid, "select", buildBuckets)
-		otx.AddFlow("table=101, priority=100,ip,reg0=%d, actions=group:%d", vnid, vnid)
+		addNamespaceEgressFlows(otx, vnid, destinations, fmt.Sprintf("group:%d", vnid))
+	}
+	oc.egressGroupDestinations[vnid] = groupDestinations
+	return nil
+}
+
+// forgetEgressGroupDestinations is called when a transaction that changed the egress
+// IP flows of vnids (or of all VNIDs, if none are given) failed to commit, so that
+// their next update rewrites their flows rather than assuming the group is in place
+func (oc *ovsController) forgetEgressGroupDestinations(vnids ...uint32) {
+	oc.egressGroupsLock.Lock()
+	defer oc.egressGroupsLock.Unlock()
+
+	if len(vnids) == 0 {
+		oc.egressGroupDestinations = make(map[uint32]string)
+		return
+	}
+	for _, vnid := range vnids {
+		delete(oc.egressGroupDestinations, vnid)
 	}
-	return otx.Commit()
 }
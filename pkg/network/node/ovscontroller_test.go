@@ -1,6 +1,7 @@
 package node
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"reflect"
@@ -9,6 +10,7 @@ import (
 	"testing"
 
 	osdnv1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/sdn/pkg/network/common"
 	"github.com/openshift/sdn/pkg/util/ovs"
 
 	corev1 "k8s.io/api/core/v1"
@@ -167,6 +169,98 @@ func TestOVSService(t *testing.T) {
 	}
 }
 
+func TestOVSLoadBalancerSourceRanges(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+
+	svc := corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "service",
+		},
+		Spec: corev1.ServiceSpec{
+			Type:      corev1.ServiceTypeLoadBalancer,
+			ClusterIP: "172.30.99.99",
+			Ports: []corev1.ServicePort{
+				{Protocol: corev1.ProtocolTCP, Port: 80},
+			},
+			LoadBalancerSourceRanges: []string{"192.168.1.0/24", "10.128.0.0/16", "fd00:10::/64"},
+		},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{
+					{IP: "203.0.113.5"},
+					{IP: "2001:db8::5"},
+					{Hostname: "lb.example.com"},
+				},
+			},
+		},
+	}
+	err := oc.AddLoadBalancerSourceRangeRules(&svc)
+	if err != nil {
+		t.Fatalf("Unexpected error adding source range rules: %v", err)
+	}
+
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=30", "priority=160", "cookie=" + serviceFlowOwner(&svc).cookie(lbSourceRangeCookie), "nw_dst=203.0.113.5", "tcp_dst=80", "nw_src=192.168.1.0/24", "goto_table:99"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=30", "priority=160", "cookie=" + serviceFlowOwner(&svc).cookie(lbSourceRangeCookie), "nw_dst=203.0.113.5", "tcp_dst=80", "nw_src=10.128.0.0/16", "goto_table:99"},
+		},
+		flowChange{
+			kind:    flowAdded,
+			match:   []string{"table=30", "priority=150", "cookie=" + serviceFlowOwner(&svc).cookie(lbSourceRangeCookie), "nw_dst=203.0.113.5", "tcp_dst=80", "drop"},
+			noMatch: []string{"nw_src"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=30", "priority=160", "cookie=" + serviceFlowOwner(&svc).cookie(lbSourceRangeCookie), "ipv6_dst=2001:db8::5", "tcp6", "tp_dst=80", "ipv6_src=fd00:10::/64", "goto_table:99"},
+		},
+		flowChange{
+			kind:    flowAdded,
+			match:   []string{"table=30", "priority=150", "cookie=" + serviceFlowOwner(&svc).cookie(lbSourceRangeCookie), "ipv6_dst=2001:db8::5", "tp_dst=80", "drop"},
+			noMatch: []string{"ipv6_src"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	err = oc.DeleteLoadBalancerSourceRangeRules(&svc)
+	if err != nil {
+		t.Fatalf("Unexpected error deleting source range rules: %v", err)
+	}
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows) // no changes
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	// Services without source ranges get no flows
+	svc.Spec.LoadBalancerSourceRanges = nil
+	err = oc.AddLoadBalancerSourceRangeRules(&svc)
+	if err != nil {
+		t.Fatalf("Unexpected error adding source range rules: %v", err)
+	}
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows) // no changes
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+}
+
 const (
 	sandboxID string = "bcb5d8d287fcf97458c48ad643b101079e3bc265a94e097e7407440716112f69"
 )
@@ -175,7 +269,7 @@ func TestOVSPod(t *testing.T) {
 	ovsif, oc, origFlows := setupOVSController(t)
 
 	// Add
-	ofport, err := oc.SetUpPod(sandboxID, "veth1", net.ParseIP("10.128.0.2"), 42)
+	ofport, err := oc.SetUpPod(context.TODO(), sandboxID, "veth1", net.ParseIP("10.128.0.2"), nil, 42)
 	if err != nil {
 		t.Fatalf("Unexpected error adding pod rules: %v", err)
 	}
@@ -189,6 +283,18 @@ func TestOVSPod(t *testing.T) {
 			kind:  flowAdded,
 			match: []string{"table=20", fmt.Sprintf("in_port=%d", ofport), "arp", "10.128.0.2", "00:00:0a:80:00:02/00:00:ff:ff:ff:ff"},
 		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=20", fmt.Sprintf("in_port=%d", ofport), "nw_src=10.128.0.2", "nw_dst=10.128.0.1,", "42->NXM_NX_REG0"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=20", "cookie=" + podFlowOwner(net.ParseIP("10.128.0.2")).cookie(trafficPodCookie), fmt.Sprintf("in_port=%d", ofport), "nw_src=10.128.0.2", "nw_dst=10.128.0.0/14", "42->NXM_NX_REG0"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=20", "cookie=" + podFlowOwner(net.ParseIP("10.128.0.2")).cookie(trafficServiceCookie), fmt.Sprintf("in_port=%d", ofport), "nw_src=10.128.0.2", "nw_dst=172.30.0.0/16", "42->NXM_NX_REG0"},
+		},
 		flowChange{
 			kind:  flowAdded,
 			match: []string{"table=20", fmt.Sprintf("in_port=%d", ofport), "ip", "10.128.0.2", "42->NXM_NX_REG0"},
@@ -202,6 +308,18 @@ func TestOVSPod(t *testing.T) {
 			match:   []string{"table=40", "arp", "10.128.0.2", fmt.Sprintf("output:%d", ofport)},
 			noMatch: []string{"reg0=42"},
 		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=70", "nw_src=10.128.0.1,", "nw_dst=10.128.0.2", "42->NXM_NX_REG1", fmt.Sprintf("%d->NXM_NX_REG2", ofport)},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=70", "cookie=" + podFlowOwner(net.ParseIP("10.128.0.2")).cookie(trafficPodCookie), "nw_src=10.128.0.0/14", "nw_dst=10.128.0.2", "42->NXM_NX_REG1", fmt.Sprintf("%d->NXM_NX_REG2", ofport)},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=70", "cookie=" + podFlowOwner(net.ParseIP("10.128.0.2")).cookie(trafficServiceCookie), "nw_src=172.30.0.0/16", "nw_dst=10.128.0.2", "42->NXM_NX_REG1", fmt.Sprintf("%d->NXM_NX_REG2", ofport)},
+		},
 		flowChange{
 			kind:    flowAdded,
 			match:   []string{"table=70", "ip", "10.128.0.2", "42->NXM_NX_REG1", fmt.Sprintf("%d->NXM_NX_REG2", ofport)},
@@ -227,6 +345,18 @@ func TestOVSPod(t *testing.T) {
 			kind:  flowAdded,
 			match: []string{"table=20", fmt.Sprintf("in_port=%d", ofport), "arp", "10.128.0.2", "00:00:0a:80:00:02/00:00:ff:ff:ff:ff"},
 		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=20", fmt.Sprintf("in_port=%d", ofport), "nw_src=10.128.0.2", "nw_dst=10.128.0.1,", "43->NXM_NX_REG0"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=20", "cookie=" + podFlowOwner(net.ParseIP("10.128.0.2")).cookie(trafficPodCookie), fmt.Sprintf("in_port=%d", ofport), "nw_src=10.128.0.2", "nw_dst=10.128.0.0/14", "43->NXM_NX_REG0"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=20", "cookie=" + podFlowOwner(net.ParseIP("10.128.0.2")).cookie(trafficServiceCookie), fmt.Sprintf("in_port=%d", ofport), "nw_src=10.128.0.2", "nw_dst=172.30.0.0/16", "43->NXM_NX_REG0"},
+		},
 		flowChange{
 			kind:  flowAdded,
 			match: []string{"table=20", fmt.Sprintf("in_port=%d", ofport), "ip", "10.128.0.2", "43->NXM_NX_REG0"},
@@ -240,6 +370,18 @@ func TestOVSPod(t *testing.T) {
 			match:   []string{"table=40", "arp", "10.128.0.2", fmt.Sprintf("output:%d", ofport)},
 			noMatch: []string{"reg0=43"},
 		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=70", "nw_src=10.128.0.1,", "nw_dst=10.128.0.2", "43->NXM_NX_REG1", fmt.Sprintf("%d->NXM_NX_REG2", ofport)},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=70", "cookie=" + podFlowOwner(net.ParseIP("10.128.0.2")).cookie(trafficPodCookie), "nw_src=10.128.0.0/14", "nw_dst=10.128.0.2", "43->NXM_NX_REG1", fmt.Sprintf("%d->NXM_NX_REG2", ofport)},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=70", "cookie=" + podFlowOwner(net.ParseIP("10.128.0.2")).cookie(trafficServiceCookie), "nw_src=172.30.0.0/16", "nw_dst=10.128.0.2", "43->NXM_NX_REG1", fmt.Sprintf("%d->NXM_NX_REG2", ofport)},
+		},
 		flowChange{
 			kind:    flowAdded,
 			match:   []string{"table=70", "ip", "10.128.0.2", "43->NXM_NX_REG1", fmt.Sprintf("%d->NXM_NX_REG2", ofport)},
@@ -282,12 +424,12 @@ func TestGetPodDetails(t *testing.T) {
 
 	for _, tc := range testcases {
 		_, oc, _ := setupOVSController(t)
-		tcOFPort, err := oc.SetUpPod(tc.sandboxID, "veth1", net.ParseIP(tc.ip), 42)
+		tcOFPort, err := oc.SetUpPod(context.TODO(), tc.sandboxID, "veth1", net.ParseIP(tc.ip), nil, 42)
 		if err != nil {
 			t.Fatalf("Unexpected error adding pod rules: %v", err)
 		}
 
-		ofport, ip, err := oc.getPodDetailsBySandboxID(tc.sandboxID)
+		ofport, ip, _, err := oc.getPodDetailsBySandboxID(tc.sandboxID)
 		if err != nil {
 			if tc.errStr != "" {
 				if !strings.Contains(err.Error(), tc.errStr) {
@@ -446,6 +588,9 @@ var enpDenyAll = osdnv1.EgressNetworkPolicy{
 type enpFlowAddition struct {
 	policy *osdnv1.EgressNetworkPolicy
 	vnid   int
+	// offset is added to the priority of each rule, for policies that are
+	// combined with other higher-priority policies
+	offset int
 }
 
 func assertENPFlowAdditions(origFlows, newFlows []string, additions ...enpFlowAddition) error {
@@ -457,7 +602,7 @@ func assertENPFlowAdditions(origFlows, newFlows []string, additions ...enpFlowAd
 			change.match = []string{
 				"table=100",
 				fmt.Sprintf("reg0=%d", addition.vnid),
-				fmt.Sprintf("priority=%d", len(addition.policy.Spec.Egress)-i),
+				fmt.Sprintf("priority=%d,", addition.offset+len(addition.policy.Spec.Egress)-i),
 			}
 			if rule.To.CIDRSelector == "0.0.0.0/0" || rule.To.CIDRSelector == "0.0.0.0/32" {
 				change.noMatch = []string{"nw_dst"}
@@ -487,6 +632,7 @@ func TestOVSEgressNetworkPolicy(t *testing.T) {
 		42,
 		[]string{"ns1"},
 		nil,
+		nil,
 	)
 	if err != nil {
 		t.Fatalf("Unexpected error updating egress network policy: %v", err)
@@ -511,6 +657,7 @@ func TestOVSEgressNetworkPolicy(t *testing.T) {
 		43,
 		[]string{"ns2"},
 		nil,
+		nil,
 	)
 	if err != nil {
 		t.Fatalf("Unexpected error updating egress network policy: %v", err)
@@ -539,6 +686,7 @@ func TestOVSEgressNetworkPolicy(t *testing.T) {
 		42,
 		[]string{"ns1"},
 		nil,
+		nil,
 	)
 	if err != nil {
 		t.Fatalf("Unexpected error updating egress network policy: %v", err)
@@ -567,6 +715,7 @@ func TestOVSEgressNetworkPolicy(t *testing.T) {
 		43,
 		[]string{"ns2"},
 		nil,
+		nil,
 	)
 	if err != nil {
 		t.Fatalf("Unexpected error updating egress network policy: %v", err)
@@ -591,6 +740,7 @@ func TestOVSEgressNetworkPolicy(t *testing.T) {
 		0,
 		[]string{"default", "my-global-project"},
 		nil,
+		nil,
 	)
 	if err != nil {
 		t.Fatalf("Unexpected error updating egress network policy: %v", err)
@@ -615,6 +765,7 @@ func TestOVSEgressNetworkPolicy(t *testing.T) {
 		44,
 		[]string{"ns3", "ns4"},
 		nil,
+		nil,
 	)
 	if err != nil {
 		t.Fatalf("Unexpected error updating egress network policy: %v", err)
@@ -641,6 +792,7 @@ func TestOVSEgressNetworkPolicy(t *testing.T) {
 		0,
 		[]string{"default"},
 		nil,
+		nil,
 	)
 	if err == nil {
 		t.Fatalf("Unexpected lack of error updating egress network policy")
@@ -665,6 +817,7 @@ func TestOVSEgressNetworkPolicy(t *testing.T) {
 		45,
 		[]string{"ns3", "ns4"},
 		nil,
+		nil,
 	)
 	if err == nil {
 		t.Fatalf("Unexpected lack of error updating egress network policy")
@@ -687,15 +840,17 @@ func TestOVSEgressNetworkPolicy(t *testing.T) {
 		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
 	}
 
-	// Can't set multiple policies
+	// CLEARING ERRORS
+
 	err = oc.UpdateEgressNetworkPolicyRules(
-		[]osdnv1.EgressNetworkPolicy{enp1, enp2},
-		46,
-		[]string{"ns5"},
+		[]osdnv1.EgressNetworkPolicy{},
+		45,
+		[]string{"ns3", "ns4"},
+		nil,
 		nil,
 	)
-	if err == nil {
-		t.Fatalf("Unexpected lack of error updating egress network policy")
+	if err != nil {
+		t.Fatalf("Unexpected error updating egress network policy: %v", err)
 	}
 	flows, err = ovsif.DumpFlows("")
 	if err != nil {
@@ -706,53 +861,59 @@ func TestOVSEgressNetworkPolicy(t *testing.T) {
 			vnid:   42,
 			policy: &enp2,
 		},
-		enpFlowAddition{
-			vnid:   45,
-			policy: &enpDenyAll,
-		},
-		enpFlowAddition{
-			vnid:   46,
-			policy: &enpDenyAll,
-		},
 	)
 	if err != nil {
 		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
 	}
 
-	// CLEARING ERRORS
+}
 
-	err = oc.UpdateEgressNetworkPolicyRules(
-		[]osdnv1.EgressNetworkPolicy{},
-		45,
-		[]string{"ns3", "ns4"},
+func TestOVSEgressNetworkPolicyPriority(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+
+	baseline := *enp1.DeepCopy()
+	baseline.Name = "zzz-baseline"
+	baseline.Annotations = map[string]string{common.EgressNetworkPolicyPriorityAnnotation: "-10"}
+
+	// Without the annotation, the rules of "enp2" would come after those of
+	// "zzz-baseline"; with it, the baseline goes last
+	err := oc.UpdateEgressNetworkPolicyRules(
+		[]osdnv1.EgressNetworkPolicy{baseline, enp2},
+		46,
+		[]string{"ns5"},
+		nil,
 		nil,
 	)
 	if err != nil {
 		t.Fatalf("Unexpected error updating egress network policy: %v", err)
 	}
-	flows, err = ovsif.DumpFlows("")
+	flows, err := ovsif.DumpFlows("")
 	if err != nil {
 		t.Fatalf("Unexpected error dumping flows: %v", err)
 	}
 	err = assertENPFlowAdditions(origFlows, flows,
 		enpFlowAddition{
-			vnid:   42,
+			vnid:   46,
 			policy: &enp2,
+			offset: len(baseline.Spec.Egress),
 		},
 		enpFlowAddition{
 			vnid:   46,
-			policy: &enpDenyAll,
+			policy: &baseline,
 		},
 	)
 	if err != nil {
 		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
 	}
 
+	// Raising the baseline's priority above the default puts it first
+	baseline.Annotations[common.EgressNetworkPolicyPriorityAnnotation] = "10"
 	err = oc.UpdateEgressNetworkPolicyRules(
-		[]osdnv1.EgressNetworkPolicy{},
+		[]osdnv1.EgressNetworkPolicy{enp2, baseline},
 		46,
 		[]string{"ns5"},
 		nil,
+		nil,
 	)
 	if err != nil {
 		t.Fatalf("Unexpected error updating egress network policy: %v", err)
@@ -763,7 +924,12 @@ func TestOVSEgressNetworkPolicy(t *testing.T) {
 	}
 	err = assertENPFlowAdditions(origFlows, flows,
 		enpFlowAddition{
-			vnid:   42,
+			vnid:   46,
+			policy: &baseline,
+			offset: len(enp2.Spec.Egress),
+		},
+		enpFlowAddition{
+			vnid:   46,
 			policy: &enp2,
 		},
 	)
@@ -772,82 +938,415 @@ func TestOVSEgressNetworkPolicy(t *testing.T) {
 	}
 }
 
-func TestAlreadySetUp(t *testing.T) {
-	testcases := []struct {
-		flow    string
-		success bool
-	}{
-		{
-			// Good note
-			flow:    fmt.Sprintf("cookie=0x0, duration=4.796s, table=253, n_packets=0, n_bytes=0, actions=note:00.%02x.00.00.00.00", ruleVersion),
-			success: true,
-		},
-		{
-			// Wrong version
-			flow:    fmt.Sprintf("cookie=0x0, duration=4.796s, table=253, n_packets=0, n_bytes=0, actions=note:00.%02x.00.00.00.00", ruleVersion-1),
-			success: false,
-		},
-		{
-			// Wrong table
-			flow:    fmt.Sprintf("cookie=0x0, duration=4.796s, table=10, n_packets=0, n_bytes=0, actions=note:00.%02x.00.00.00.00", ruleVersion),
-			success: false,
-		},
-		{
-			// No note
-			flow:    "cookie=0x0, duration=4.796s, table=253, n_packets=0, n_bytes=0, actions=goto_table:50",
-			success: false,
+func TestOVSEgressNetworkPolicyDualStack(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+	oc.dualStack = true
+
+	policy := osdnv1.EgressNetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dual", Namespace: "ns6"},
+		Spec: osdnv1.EgressNetworkPolicySpec{
+			Egress: []osdnv1.EgressNetworkPolicyRule{
+				{
+					Type: osdnv1.EgressNetworkPolicyRuleAllow,
+					To:   osdnv1.EgressNetworkPolicyPeer{CIDRSelector: "192.168.1.0/24"},
+				},
+				{
+					Type: osdnv1.EgressNetworkPolicyRuleAllow,
+					To:   osdnv1.EgressNetworkPolicyPeer{CIDRSelector: "fd00:1::/64"},
+				},
+				{
+					Type: osdnv1.EgressNetworkPolicyRuleDeny,
+					To:   osdnv1.EgressNetworkPolicyPeer{CIDRSelector: "0.0.0.0/0"},
+				},
+			},
 		},
 	}
+	err := oc.UpdateEgressNetworkPolicyRules([]osdnv1.EgressNetworkPolicy{policy}, 47, []string{"ns6"}, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error updating egress network policy: %v", err)
+	}
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	// Denying all destinations denies IPv6 destinations as well
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{kind: flowAdded, match: []string{"table=100", "reg0=47", "priority=3", "nw_dst=192.168.1.0/24", "actions=goto_table:101"}},
+		flowChange{kind: flowAdded, match: []string{"table=100", "reg0=47", "priority=2", "ipv6_dst=fd00:1::/64", "actions=goto_table:101"}},
+		flowChange{kind: flowAdded, match: []string{"table=100", "reg0=47", "priority=1", "ip,", "actions=drop"}, noMatch: []string{"nw_dst"}},
+		flowChange{kind: flowAdded, match: []string{"table=100", "reg0=47", "priority=1", "ipv6,", "actions=drop"}, noMatch: []string{"ipv6_dst"}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+}
 
-	for i, tc := range testcases {
-		ovsif := ovs.NewFake(Br0)
-		if err := ovsif.AddBridge("fail_mode=secure", "protocols=OpenFlow13"); err != nil {
-			t.Fatalf("(%d) unexpected error from AddBridge: %v", i, err)
-		}
-		oc := NewOVSController(ovsif, 0, true, "172.17.0.4")
-		/* In order to test AlreadySetUp the vxlan port has to be added, we are not testing AddPort here */
-		_, err := ovsif.AddPort("vxlan0", 1, "type=vxlan", `options:remote_ip="flow"`, `options:key="flow"`, fmt.Sprintf("options:dst_port=%d", 4789))
-		if err != nil {
-			t.Fatalf("(%d) unexpected error from AddPort: %v", i, err)
-		}
+func TestOVSEgressNetworkPolicyAudit(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
 
-		otx := ovsif.NewTransaction()
-		otx.AddFlow(tc.flow)
-		if err := otx.Commit(); err != nil {
-			t.Fatalf("(%d) unexpected error from AddFlow: %v", i, err)
-		}
-		if success := oc.AlreadySetUp(4789); success != tc.success {
-			t.Fatalf("(%d) unexpected setup value %v (expected %v)", i, success, tc.success)
+	audit := *enp1.DeepCopy()
+	audit.Name = "audit"
+	audit.Annotations = map[string]string{common.EgressNetworkPolicyAuditAnnotation: "true"}
+
+	err := oc.UpdateEgressNetworkPolicyRules(
+		[]osdnv1.EgressNetworkPolicy{audit},
+		46,
+		[]string{"ns5"},
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error updating egress network policy: %v", err)
+	}
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	// The audit-only policy should generate only table 99 flows, and only its
+	// deny rules should be tagged with the audit cookie
+	changes := []flowChange{}
+	for i, rule := range audit.Spec.Egress {
+		cookie := egressFlowOwner(46).cookie("0")
+		if rule.Type == osdnv1.EgressNetworkPolicyRuleDeny {
+			cookie = egressFlowOwner(46).cookie(egressAuditCookie)
 		}
+		changes = append(changes, flowChange{
+			kind: flowAdded,
+			match: []string{
+				fmt.Sprintf("cookie=%s,", cookie),
+				"table=99,",
+				"reg0=46",
+				fmt.Sprintf("priority=%d,", maxEgressAuditRules-i),
+				rule.To.CIDRSelector,
+				"actions=goto_table:100",
+			},
+		})
+	}
+	if err := assertFlowChanges(origFlows, flows, changes...); err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
 	}
 }
 
-func TestFindUnusedVNIDs(t *testing.T) {
-	testcases := []struct {
-		flows  []string
-		policy []int
-		unused []int
-	}{
-		{
-			/* VNID 0 is never unused, even if there are no table 60/70 rules for it */
-			flows: []string{
-				"table=60,priority=100,ip,nw_dst=172.30.0.1,nw_frag=later actions=load:0->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
-				"table=60,priority=100,ip,nw_dst=172.30.156.103,nw_frag=later actions=load:0xcb81e9->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
-				"table=60,priority=100,ip,nw_dst=172.30.76.192,nw_frag=later actions=load:0x55fac->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
-				"table=60,priority=100,tcp,nw_dst=172.30.0.1,tp_dst=443 actions=load:0->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
-				"table=60,priority=100,udp,nw_dst=172.30.0.1,tp_dst=53 actions=load:0->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
-				"table=60,priority=100,tcp,nw_dst=172.30.0.1,tp_dst=53 actions=load:0->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
-				"table=60,priority=100,tcp,nw_dst=172.30.156.103,tp_dst=5454 actions=load:0xcb81e9->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
-				"table=60,priority=100,tcp,nw_dst=172.30.76.192,tp_dst=5454 actions=load:0x55fac->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
-				"table=60,priority=100,tcp,nw_dst=172.30.76.192,tp_dst=5455 actions=load:0x55fac->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
-				"table=60,priority=0 actions=drop",
-				"table=70,priority=100,ip,nw_dst=10.129.0.2 actions=load:0x55fac->NXM_NX_REG1[],load:0x3->NXM_NX_REG2[],goto_table:80",
-				"table=70,priority=100,ip,nw_dst=10.129.0.3 actions=load:0xcb81e9->NXM_NX_REG1[],load:0x4->NXM_NX_REG2[],goto_table:80",
-				"table=70,priority=0 actions=drop",
-				"table=80,priority=300,ip,nw_src=10.129.0.1 actions=output:NXM_NX_REG2[]",
-				"table=80,priority=200,reg0=0 actions=output:NXM_NX_REG2[]",
-				"table=80,priority=200,reg1=0 actions=output:NXM_NX_REG2[]",
-				"table=80,priority=100,reg0=0x55fac,reg1=0x55fac actions=output:NXM_NX_REG2[]",
+func TestOVSEgressIPDestinations(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+
+	egressIPsMetaData := []egressIPMetaData{
+		{nodeIP: "172.17.0.5", packetMark: getMarkForVNID(42, 0x1)},
+	}
+	err := oc.SetNamespaceEgressViaEgressIPs(42, []string{"10.0.0.0/8", "192.168.1.0/24"}, egressIPsMetaData)
+	if err != nil {
+		t.Fatalf("Unexpected error setting egress IPs: %v", err)
+	}
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=101", "reg0=42", "nw_dst=10.0.0.0/8", "group:42"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=101", "reg0=42", "nw_dst=192.168.1.0/24", "group:42"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	err = oc.SetNamespaceEgressDropped(42, []string{"192.168.1.0/24"})
+	if err != nil {
+		t.Fatalf("Unexpected error setting egress dropped: %v", err)
+	}
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=101", "reg0=42", "nw_dst=192.168.1.0/24", "drop"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	err = oc.SetNamespaceEgressNormal(42)
+	if err != nil {
+		t.Fatalf("Unexpected error setting egress normal: %v", err)
+	}
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows) // no changes
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+}
+
+func TestOVSEgressIPGroupUpdate(t *testing.T) {
+	ovsif, oc, _ := setupOVSController(t)
+
+	egressIPsMetaData := []egressIPMetaData{
+		{nodeIP: "172.17.0.5", packetMark: getMarkForVNID(42, 0x1)},
+		{nodeIP: "172.17.0.6", packetMark: getMarkForVNID(42, 0x1)},
+	}
+	err := oc.SetNamespaceEgressViaEgressIPs(42, nil, egressIPsMetaData)
+	if err != nil {
+		t.Fatalf("Unexpected error setting egress IPs: %v", err)
+	}
+	origFlows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+
+	// Removing an egress IP should only change the group
+	err = oc.SetNamespaceEgressViaEgressIPs(42, nil, egressIPsMetaData[1:])
+	if err != nil {
+		t.Fatalf("Unexpected error setting egress IPs: %v", err)
+	}
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows) // no changes
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+	groups, err := ovsif.DumpGroups()
+	if err != nil {
+		t.Fatalf("Unexpected error dumping groups: %v", err)
+	}
+	expected := "group_id=42,type=select,bucket=actions=ct(commit),move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:172.17.0.6->tun_dst,output:vxlan0"
+	if len(groups) != 1 || groups[0] != expected {
+		t.Fatalf("Unexpected groups: expected %q, got %#v", expected, groups)
+	}
+
+	// Changing the destinations requires rewriting the flows
+	err = oc.SetNamespaceEgressViaEgressIPs(42, []string{"10.0.0.0/8"}, egressIPsMetaData)
+	if err != nil {
+		t.Fatalf("Unexpected error setting egress IPs: %v", err)
+	}
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{
+			kind:  flowRemoved,
+			match: []string{"table=101", "reg0=42", "group:42"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=101", "reg0=42", "nw_dst=10.0.0.0/8", "group:42"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	// Once the namespace's egress is reset, the group can't be modified
+	if err := oc.SetNamespaceEgressNormal(42); err != nil {
+		t.Fatalf("Unexpected error setting egress normal: %v", err)
+	}
+	err = oc.SetNamespaceEgressViaEgressIPs(42, []string{"10.0.0.0/8"}, egressIPsMetaData)
+	if err != nil {
+		t.Fatalf("Unexpected error setting egress IPs: %v", err)
+	}
+	groups, err = ovsif.DumpGroups()
+	if err != nil {
+		t.Fatalf("Unexpected error dumping groups: %v", err)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("Unexpected groups: %#v", groups)
+	}
+}
+
+func TestOVSDirectAttach(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+
+	if err := oc.SetNamespaceDirectAttach(42, true); err != nil {
+		t.Fatalf("Unexpected error setting direct-attach: %v", err)
+	}
+	// Setting egress IPs for the namespace must not remove the direct-attach flow
+	egressIPsMetaData := []egressIPMetaData{
+		{nodeIP: "172.17.0.5", packetMark: getMarkForVNID(42, 0x1)},
+	}
+	if err := oc.SetNamespaceEgressViaEgressIPs(42, nil, egressIPsMetaData); err != nil {
+		t.Fatalf("Unexpected error setting egress IPs: %v", err)
+	}
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=101", "priority=50", "reg0=42", "set_field:0x02000000->pkt_mark", "output:2"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=101", "priority=100", "reg0=42", "group:42"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	// ...and vice versa
+	if err := oc.SetNamespaceEgressNormal(42); err != nil {
+		t.Fatalf("Unexpected error setting egress normal: %v", err)
+	}
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=101", "priority=50", "reg0=42", "set_field:0x02000000->pkt_mark", "output:2"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	if err := oc.SetNamespaceDirectAttach(42, false); err != nil {
+		t.Fatalf("Unexpected error unsetting direct-attach: %v", err)
+	}
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows) // no changes
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+}
+
+func TestAlreadySetUp(t *testing.T) {
+	versionNote := NewOVSController(nil, 0, true, "172.17.0.4").getVersionNote()
+	testcases := []struct {
+		flow    string
+		success bool
+	}{
+		{
+			// Good note
+			flow:    fmt.Sprintf("cookie=0x0, duration=4.796s, table=253, n_packets=0, n_bytes=0, actions=note:%s.00.00.00.00", versionNote),
+			success: true,
+		},
+		{
+			// Wrong version
+			flow:    fmt.Sprintf("cookie=0x0, duration=4.796s, table=253, n_packets=0, n_bytes=0, actions=note:00.%02x%s", ruleVersion-1, versionNote[5:]),
+			success: false,
+		},
+		{
+			// Outdated table (the last pair in the note is table 120)
+			flow:    fmt.Sprintf("cookie=0x0, duration=4.796s, table=253, n_packets=0, n_bytes=0, actions=note:%s.FF", versionNote[:len(versionNote)-3]),
+			success: false,
+		},
+		{
+			// Note from before tables were versioned
+			flow:    fmt.Sprintf("cookie=0x0, duration=4.796s, table=253, n_packets=0, n_bytes=0, actions=note:00.%02x.00.00.00.00", ruleVersion),
+			success: false,
+		},
+		{
+			// Wrong table
+			flow:    fmt.Sprintf("cookie=0x0, duration=4.796s, table=10, n_packets=0, n_bytes=0, actions=note:%s", versionNote),
+			success: false,
+		},
+		{
+			// No note
+			flow:    "cookie=0x0, duration=4.796s, table=253, n_packets=0, n_bytes=0, actions=goto_table:50",
+			success: false,
+		},
+	}
+
+	for i, tc := range testcases {
+		ovsif := ovs.NewFake(Br0)
+		if err := ovsif.AddBridge("fail_mode=secure", "protocols=OpenFlow13"); err != nil {
+			t.Fatalf("(%d) unexpected error from AddBridge: %v", i, err)
+		}
+		oc := NewOVSController(ovsif, 0, true, "172.17.0.4")
+		/* In order to test AlreadySetUp the vxlan port has to be added, we are not testing AddPort here */
+		_, err := ovsif.AddPort("vxlan0", 1, "type=vxlan", `options:remote_ip="flow"`, `options:key="flow"`, fmt.Sprintf("options:dst_port=%d", 4789))
+		if err != nil {
+			t.Fatalf("(%d) unexpected error from AddPort: %v", i, err)
+		}
+
+		otx := ovsif.NewTransaction()
+		otx.AddFlow(tc.flow)
+		if err := otx.Commit(); err != nil {
+			t.Fatalf("(%d) unexpected error from AddFlow: %v", i, err)
+		}
+		if success := oc.AlreadySetUp(4789); success != tc.success {
+			t.Fatalf("(%d) unexpected setup value %v (expected %v)", i, success, tc.success)
+		}
+	}
+}
+
+func TestOVSGeneve(t *testing.T) {
+	ovsif := ovs.NewFake(Br0)
+	oc := NewOVSController(ovsif, 0, true, "172.17.0.4")
+	oc.geneve = true
+	err := oc.SetupOVS([]string{"10.128.0.0/14"}, "172.30.0.0/16", "10.128.0.0/23", "10.128.0.1", 1450, 4789)
+	if err != nil {
+		t.Fatalf("Unexpected error setting up OVS: %v", err)
+	}
+	if err := oc.FinishSetupOVS(); err != nil {
+		t.Fatalf("Unexpected error setting up OVS: %v", err)
+	}
+
+	if ofport, err := ovsif.GetOFPort(Geneve0); err != nil || ofport != geneve0OFPort {
+		t.Fatalf("Unexpected Geneve port %d (%v)", ofport, err)
+	}
+	flows, err := ovsif.DumpFlows("table=0, in_port=%d", geneve0OFPort)
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	if len(flows) != 4 {
+		t.Fatalf("Unexpected Geneve flows %v", flows)
+	}
+	if !oc.AlreadySetUp(4789) {
+		t.Fatalf("Unexpected setup value false")
+	}
+
+	// A node that no longer supports Geneve has to recreate the bridge
+	oc = NewOVSController(ovsif, 0, true, "172.17.0.4")
+	if oc.AlreadySetUp(4789) {
+		t.Fatalf("Unexpected setup value true")
+	}
+}
+
+func TestFindUnusedVNIDs(t *testing.T) {
+	testcases := []struct {
+		flows  []string
+		policy []int
+		unused []int
+	}{
+		{
+			/* VNID 0 is never unused, even if there are no table 70 rules for it */
+			flows: []string{
+				"table=60,priority=100,ip,nw_dst=172.30.0.1,nw_frag=later actions=load:0->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
+				"table=60,priority=100,ip,nw_dst=172.30.156.103,nw_frag=later actions=load:0xcb81e9->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
+				"table=60,priority=100,ip,nw_dst=172.30.76.192,nw_frag=later actions=load:0x55fac->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
+				"table=60,priority=100,tcp,nw_dst=172.30.0.1,tp_dst=443 actions=load:0->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
+				"table=60,priority=100,udp,nw_dst=172.30.0.1,tp_dst=53 actions=load:0->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
+				"table=60,priority=100,tcp,nw_dst=172.30.0.1,tp_dst=53 actions=load:0->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
+				"table=60,priority=100,tcp,nw_dst=172.30.156.103,tp_dst=5454 actions=load:0xcb81e9->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
+				"table=60,priority=100,tcp,nw_dst=172.30.76.192,tp_dst=5454 actions=load:0x55fac->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
+				"table=60,priority=100,tcp,nw_dst=172.30.76.192,tp_dst=5455 actions=load:0x55fac->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
+				"table=60,priority=0 actions=drop",
+				"table=70,priority=100,ip,nw_dst=10.129.0.2 actions=load:0x55fac->NXM_NX_REG1[],load:0x3->NXM_NX_REG2[],goto_table:80",
+				"table=70,priority=100,ip,nw_dst=10.129.0.3 actions=load:0xcb81e9->NXM_NX_REG1[],load:0x4->NXM_NX_REG2[],goto_table:80",
+				"table=70,priority=0 actions=drop",
+				"table=80,priority=300,ip,nw_src=10.129.0.1 actions=output:NXM_NX_REG2[]",
+				"table=80,priority=200,reg0=0 actions=output:NXM_NX_REG2[]",
+				"table=80,priority=200,reg1=0 actions=output:NXM_NX_REG2[]",
+				"table=80,priority=100,reg0=0x55fac,reg1=0x55fac actions=output:NXM_NX_REG2[]",
 				"table=80,priority=100,reg0=0xcb81e9,reg1=0xcb81e9 actions=output:NXM_NX_REG2[]",
 				"table=80,priority=0 actions=drop",
 			},
@@ -882,7 +1381,8 @@ func TestFindUnusedVNIDs(t *testing.T) {
 			unused: []int{},
 		},
 		{
-			/* 0xcb81e9 has just a pod, 0x55fac has just a service, both stay */
+			/* 0xcb81e9 has just a pod and stays; 0x55fac has just a service, which
+			 * doesn't count, so it gets GCed */
 			flows: []string{
 				"table=60,priority=200,reg0=0 actions=output:2",
 				"table=60,priority=100,ip,nw_dst=172.30.0.1,nw_frag=later actions=load:0->NXM_NX_REG1[],load:0x2->NXM_NX_REG2[],goto_table:80",
@@ -903,7 +1403,7 @@ func TestFindUnusedVNIDs(t *testing.T) {
 				"table=80,priority=0 actions=drop",
 			},
 			policy: []int{0x0, 0x55fac, 0xcb81e9},
-			unused: []int{},
+			unused: []int{0x55fac},
 		},
 		{
 			/* 0xcb81e9 gets GCed, 0x55fac stays */
@@ -1081,7 +1581,8 @@ func TestSetHWAddrByIP(t *testing.T) {
 	}
 }
 
-// *** IF YOU UPDATE THIS ARRAY YOU *MUST* CHANGE ruleVersion IN ovscontroller.go ***
+// *** IF YOU UPDATE THIS ARRAY YOU *MUST* CHANGE ruleVersion IN ovscontroller.go, OR
+// THE VERSIONS OF THE AFFECTED TABLES IN flow_schema.go ***
 var expectedFlows = []string{
 	" cookie=0, table=0, priority=1000, ip, ct_state=-trk, actions=ct(table=0)",
 	" cookie=0, table=0, priority=400, in_port=2, ip, nw_src=10.128.0.1, actions=goto_table:30",
@@ -1100,11 +1601,16 @@ var expectedFlows = []string{
 	" cookie=0x0f46ee1a, table=10, priority=100, tun_src=10.0.123.45, actions=goto_table:30",
 	" cookie=0, table=10, priority=0, actions=drop",
 	" cookie=0, table=20, priority=300, udp, udp_dst=4789, actions=drop",
-	" cookie=0, table=20, priority=100, in_port=3, arp, arp_spa=10.128.0.2, arp_sha=00:00:0a:80:00:02/00:00:ff:ff:ff:ff, actions=load:42->NXM_NX_REG0[],goto_table:21",
-	" cookie=0, table=20, priority=100, in_port=3, ip, nw_src=10.128.0.2, actions=load:42->NXM_NX_REG0[],goto_table:21",
+	" cookie=0x100000a80000200, table=20, priority=120, in_port=3, ip, nw_src=10.128.0.2, nw_dst=10.128.0.1, actions=load:42->NXM_NX_REG0[],goto_table:21",
+	" cookie=0x100000a800002a1, table=20, priority=110, in_port=3, ip, nw_src=10.128.0.2, nw_dst=10.128.0.0/14, actions=load:42->NXM_NX_REG0[],goto_table:21",
+	" cookie=0x100000a800002a2, table=20, priority=110, in_port=3, ip, nw_src=10.128.0.2, nw_dst=172.30.0.0/16, actions=load:42->NXM_NX_REG0[],goto_table:21",
+	" cookie=0x100000a80000200, table=20, priority=100, in_port=3, arp, arp_spa=10.128.0.2, arp_sha=00:00:0a:80:00:02/00:00:ff:ff:ff:ff, actions=load:42->NXM_NX_REG0[],goto_table:21",
+	" cookie=0x100000a80000200, table=20, priority=100, in_port=3, ip, nw_src=10.128.0.2, actions=load:42->NXM_NX_REG0[],goto_table:21",
 	" cookie=0, table=20, priority=0, actions=drop",
-	" cookie=0, table=21, priority=0, actions=goto_table:30",
-	" cookie=0, table=25, priority=100, ip, nw_src=10.128.0.2, actions=load:42->NXM_NX_REG0[],goto_table:30",
+	" cookie=0, table=21, priority=0, actions=goto_table:22",
+	" cookie=0, table=22, priority=0, actions=goto_table:23",
+	" cookie=0, table=23, priority=0, actions=goto_table:30",
+	" cookie=0x100000a80000200, table=25, priority=100, ip, nw_src=10.128.0.2, actions=load:42->NXM_NX_REG0[],goto_table:30",
 	" cookie=0, table=25, priority=0, actions=drop",
 	" cookie=0, table=30, priority=300, arp, arp_tpa=10.128.0.1, actions=output:2",
 	" cookie=0, table=30, priority=300, ip, nw_dst=10.128.0.1, actions=output:2",
@@ -1118,47 +1624,51 @@ var expectedFlows = []string{
 	" cookie=0, table=30, priority=25, ip, nw_dst=224.0.0.0/4, actions=goto_table:110",
 	" cookie=0, table=30, priority=0, ip, actions=goto_table:99",
 	" cookie=0, table=30, priority=0, arp, actions=drop",
-	" cookie=0, table=40, priority=100, arp, arp_tpa=10.128.0.2, actions=output:3",
+	" cookie=0x100000a80000200, table=40, priority=100, arp, arp_tpa=10.128.0.2, actions=output:3",
 	" cookie=0, table=40, priority=0, actions=drop",
 	" cookie=0x0f46ee1a, table=50, priority=100, arp, arp_tpa=10.128.2.0/23, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:10.0.123.45->tun_dst,output:1",
 	" cookie=0, table=50, priority=0, actions=drop",
 	" cookie=0, table=60, priority=200, actions=output:2",
-	" cookie=0, table=60, priority=100, ip, nw_dst=172.30.99.99, ip_frag=later, actions=load:42->NXM_NX_REG1[],load:2->NXM_NX_REG2[],goto_table:80",
-	" cookie=0, table=60, priority=100, ip, nw_dst=172.30.99.99, tcp, tcp_dst=80, actions=load:42->NXM_NX_REG1[],load:2->NXM_NX_REG2[],goto_table:80",
-	" cookie=0, table=60, priority=100, ip, nw_dst=172.30.99.99, tcp, tcp_dst=443, actions=load:42->NXM_NX_REG1[],load:2->NXM_NX_REG2[],goto_table:80",
+	" cookie=0x26b3a02b352c400, table=60, priority=100, ip, nw_dst=172.30.99.99, ip_frag=later, actions=load:42->NXM_NX_REG1[],load:2->NXM_NX_REG2[],goto_table:80",
+	" cookie=0x26b3a02b352c400, table=60, priority=100, ip, nw_dst=172.30.99.99, tcp, tcp_dst=80, actions=load:42->NXM_NX_REG1[],load:2->NXM_NX_REG2[],goto_table:80",
+	" cookie=0x26b3a02b352c400, table=60, priority=100, ip, nw_dst=172.30.99.99, tcp, tcp_dst=443, actions=load:42->NXM_NX_REG1[],load:2->NXM_NX_REG2[],goto_table:80",
 	" cookie=0, table=60, priority=0, actions=drop",
-	" cookie=0, table=70, priority=100, ip, nw_dst=10.128.0.2, actions=load:42->NXM_NX_REG1[],load:3->NXM_NX_REG2[],goto_table:80",
+	" cookie=0x100000a80000200, table=70, priority=120, ip, nw_src=10.128.0.1, nw_dst=10.128.0.2, actions=load:42->NXM_NX_REG1[],load:3->NXM_NX_REG2[],goto_table:80",
+	" cookie=0x100000a800002a1, table=70, priority=110, ip, nw_src=10.128.0.0/14, nw_dst=10.128.0.2, actions=load:42->NXM_NX_REG1[],load:3->NXM_NX_REG2[],goto_table:80",
+	" cookie=0x100000a800002a2, table=70, priority=110, ip, nw_src=172.30.0.0/16, nw_dst=10.128.0.2, actions=load:42->NXM_NX_REG1[],load:3->NXM_NX_REG2[],goto_table:80",
+	" cookie=0x100000a80000200, table=70, priority=100, ip, nw_dst=10.128.0.2, actions=load:42->NXM_NX_REG1[],load:3->NXM_NX_REG2[],goto_table:80",
 	" cookie=0, table=70, priority=0, actions=drop",
 	" cookie=0, table=80, priority=300, ip, nw_src=10.128.0.1/32, actions=output:NXM_NX_REG2[]",
 	" cookie=0, table=80, priority=0, actions=drop",
+	" cookie=0, table=81, priority=0, actions=output:NXM_NX_REG2[]",
 	" cookie=0x0f46ee1a, table=90, priority=100, ip, nw_dst=10.128.2.0/23, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:10.0.123.45->tun_dst,output:1",
 	" cookie=0, table=90, priority=0, actions=drop",
 	" cookie=0, table=99, priority=200, tcp, tcp_dst=53, nw_dst=172.17.0.4, actions=output:2",
 	" cookie=0, table=99, priority=200, udp, udp_dst=53, nw_dst=172.17.0.4, actions=output:2",
 	" cookie=0, table=99, priority=0, actions=goto_table:100",
-	" cookie=0, table=100, priority=3, reg0=42, ip, nw_dst=192.168.0.0/16, actions=goto_table:101",
-	" cookie=0, table=100, priority=2, reg0=42, ip, nw_dst=192.168.1.0/24, actions=drop",
-	" cookie=0, table=100, priority=1, reg0=42, ip, nw_dst=192.168.1.1/32, actions=goto_table:101",
+	" cookie=0x400000000002a00, table=100, priority=3, reg0=42, ip, nw_dst=192.168.0.0/16, actions=goto_table:101",
+	" cookie=0x400000000002a00, table=100, priority=2, reg0=42, ip, nw_dst=192.168.1.0/24, actions=drop",
+	" cookie=0x400000000002a00, table=100, priority=1, reg0=42, ip, nw_dst=192.168.1.1/32, actions=goto_table:101",
 	" cookie=0, table=100, priority=0, actions=goto_table:101",
 	" cookie=0, table=101, priority=150, ct_state=+rpl, actions=output:2",
-	" cookie=0, table=101, priority=100, ip, reg0=37, actions=group:37",
+	" cookie=0x400000000002500, table=101, priority=100, ip, reg0=37, actions=group:37",
 	" cookie=0, table=101, priority=0, actions=output:2",
 	" cookie=0, table=110, reg0=99, actions=goto_table:111",
 	" cookie=0, table=110, priority=0, actions=drop",
 	" cookie=0, table=111, priority=100, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:10.0.123.45->tun_dst,output:1,set_field:10.0.45.123->tun_dst,output:1,goto_table:120",
 	" cookie=0, table=120, priority=100, reg0=99, actions=output:4,output:5,output:6",
 	" cookie=0, table=120, priority=0, actions=drop",
-	" cookie=0, table=253, actions=note:00.0B",
+	" cookie=0, table=253, actions=note:00.0C.00.02.0A.01.14.02.15.02.16.01.17.01.19.02.1E.02.28.02.32.01.3C.02.46.02.50.04.51.01.5A.01.63.02.64.02.65.02.6E.01.6F.01.78.01",
 }
 
-// Ensure that we do not change the OVS flows without bumping ruleVersion
+// Ensure that we do not change the OVS flows without bumping ruleVersion or the table versions
 func TestRuleVersion(t *testing.T) {
 	ovsif, oc, _ := setupOVSController(t)
 
 	// Now call each oc method that adds flows
 
 	// Pod-related flows
-	_, err := oc.SetUpPod(sandboxID, "veth1", net.ParseIP("10.128.0.2"), 42)
+	_, err := oc.SetUpPod(context.TODO(), sandboxID, "veth1", net.ParseIP("10.128.0.2"), nil, 42)
 	if err != nil {
 		t.Fatalf("Unexpected error adding pod rules: %v", err)
 	}
@@ -1214,6 +1724,7 @@ func TestRuleVersion(t *testing.T) {
 		42,
 		[]string{"ns1"},
 		nil,
+		nil,
 	)
 	if err != nil {
 		t.Fatalf("Unexpected error updating egress network policy: %v", err)
@@ -1222,7 +1733,7 @@ func TestRuleVersion(t *testing.T) {
 	// Egress IP flows
 	egressIPsMetaData := []egressIPMetaData{
 		{nodeIP: "10.0.12.34", packetMark: getMarkForVNID(37, 0x1)}}
-	err = oc.SetNamespaceEgressViaEgressIPs(uint32(37), egressIPsMetaData)
+	err = oc.SetNamespaceEgressViaEgressIPs(uint32(37), nil, egressIPsMetaData)
 	if err != nil {
 		t.Fatalf("Unexpected error updating egress IPs: %v", err)
 	}
@@ -1251,7 +1762,287 @@ func TestRuleVersion(t *testing.T) {
 	for _, flow := range expectedFlows {
 		fmt.Fprintf(expectedOut, "%q,\n", flow)
 	}
-	t.Logf("*** FLOWS HAVE CHANGED FROM PREVIOUS COMMIT ***\nExpected:\n%s\nActual:\n%s\nIf this change is expected then make sure you have bumped ruleVersion in pkg/network/node/ovscontroller.go, and then copy the \"Actual\" output above into expectedFlows in pkg/network/node/ovscontroller_test.go", expectedOut.String(), out.String())
+	t.Logf("*** FLOWS HAVE CHANGED FROM PREVIOUS COMMIT ***\nExpected:\n%s\nActual:\n%s\nIf this change is expected then make sure you have bumped ruleVersion in pkg/network/node/ovscontroller.go or the versions of the changed tables in pkg/network/node/flow_schema.go, and then copy the \"Actual\" output above into expectedFlows in pkg/network/node/ovscontroller_test.go", expectedOut.String(), out.String())
 
 	t.Fatalf("flows changed: %s", firstDiff)
 }
+
+func TestOVSClusterNetworkRules(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+
+	err := oc.AddClusterNetworkRules("10.132.0.0/14", "10.128.0.0/23", "10.128.0.1")
+	if err != nil {
+		t.Fatalf("Unexpected error adding clusterNetwork flows: %v", err)
+	}
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+
+	// The result should be the same as if the new clusterNetwork had been there
+	// from the start
+	expectedOVS := ovs.NewFake(Br0)
+	expectedOC := NewOVSController(expectedOVS, 0, true, "172.17.0.4")
+	expectedOC.tunMAC = oc.tunMAC
+	err = expectedOC.SetupOVS([]string{"10.128.0.0/14", "10.132.0.0/14"}, "172.30.0.0/16", "10.128.0.0/23", "10.128.0.1", 1450, 4789)
+	if err != nil {
+		t.Fatalf("Unexpected error setting up OVS: %v", err)
+	}
+	if err = expectedOC.FinishSetupOVS(); err != nil {
+		t.Fatalf("Unexpected error setting up OVS: %v", err)
+	}
+	expectedFlows, err := expectedOVS.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	sort.Strings(flows)
+	sort.Strings(expectedFlows)
+	if !reflect.DeepEqual(flows, expectedFlows) {
+		t.Fatalf("Unexpected flows after adding clusterNetwork:\nexpected %#v\ngot %#v", expectedFlows, flows)
+	}
+
+	err = oc.DeleteClusterNetworkRules("10.132.0.0/14")
+	if err != nil {
+		t.Fatalf("Unexpected error deleting clusterNetwork flows: %v", err)
+	}
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes after deleting clusterNetwork: %v", err)
+	}
+}
+
+func TestOVSSetLocalIP(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+
+	err := oc.SetLocalIP("172.17.0.5")
+	if err != nil {
+		t.Fatalf("Unexpected error setting local IP: %v", err)
+	}
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{kind: flowRemoved, match: []string{"table=99", "tcp", "nw_dst=172.17.0.4"}},
+		flowChange{kind: flowRemoved, match: []string{"table=99", "udp", "nw_dst=172.17.0.4"}},
+		flowChange{kind: flowAdded, match: []string{"table=99", "tcp", "tcp_dst=53", "nw_dst=172.17.0.5"}},
+		flowChange{kind: flowAdded, match: []string{"table=99", "udp", "udp_dst=53", "nw_dst=172.17.0.5"}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes after setting local IP: %v", err)
+	}
+}
+
+func TestRebuildFlowTables(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+
+	// Simulate an upgrade that changes table 30's flows
+	oldVersions := make(map[int]int)
+	for table, version := range flowTableVersions {
+		oldVersions[table] = version
+	}
+	oldVersions[30]--
+	oldNote := (&flowSchema{pluginId: 0, ruleVersion: ruleVersion, tables: oldVersions}).String()
+	otx := ovsif.NewTransaction()
+	otx.DeleteFlows("table=30, arp")
+	otx.AddFlow("table=30, priority=5, actions=drop")
+	otx.AddFlow("table=30, priority=0, ip, actions=goto_table:100")
+	otx.DeleteFlows("table=%d", ruleVersionTable)
+	otx.AddFlow("table=%d, actions=note:%s", ruleVersionTable, oldNote)
+	if err := otx.Commit(); err != nil {
+		t.Fatalf("Unexpected error modifying flows: %v", err)
+	}
+	if oc.AlreadySetUp(4789) {
+		t.Fatalf("Unexpectedly already set up")
+	}
+
+	outdated, err := oc.OutdatedFlowTables(4789)
+	if err != nil {
+		t.Fatalf("Unexpected error getting outdated tables: %v", err)
+	}
+	if !outdated.Equal(sets.NewInt(30)) {
+		t.Fatalf("Unexpected outdated tables %v", outdated.List())
+	}
+
+	err = oc.RebuildFlowTables(outdated, []string{"10.128.0.0/14"}, "172.30.0.0/16", "10.128.0.0/23", "10.128.0.1", 4789, nil, "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error rebuilding tables: %v", err)
+	}
+	if _, err := oc.OutdatedFlowTables(4789); err == nil {
+		t.Fatalf("Unexpectedly found version note before FinishSetupOVS")
+	}
+	if err := oc.FinishSetupOVS(); err != nil {
+		t.Fatalf("Unexpected error finishing setup: %v", err)
+	}
+	if !oc.AlreadySetUp(4789) {
+		t.Fatalf("Not set up after rebuilding tables")
+	}
+
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows) // no changes
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+}
+
+func TestOVSPodIPv6(t *testing.T) {
+	ovsif, oc, origFlows := setupOVSController(t)
+
+	ofport, err := oc.SetUpPod(context.TODO(), sandboxID, "veth1", net.ParseIP("10.128.0.2"), net.ParseIP("fd01:0:0:5::2"), 42)
+	if err != nil {
+		t.Fatalf("Unexpected error adding pod rules: %v", err)
+	}
+
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=20", fmt.Sprintf("in_port=%d", ofport), "arp", "10.128.0.2", "00:00:0a:80:00:02/00:00:ff:ff:ff:ff"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=20", fmt.Sprintf("in_port=%d", ofport), "nw_src=10.128.0.2", "nw_dst=10.128.0.1,", "42->NXM_NX_REG0"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=20", "cookie=" + podFlowOwner(net.ParseIP("10.128.0.2")).cookie(trafficPodCookie), fmt.Sprintf("in_port=%d", ofport), "nw_src=10.128.0.2", "nw_dst=10.128.0.0/14", "42->NXM_NX_REG0"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=20", "cookie=" + podFlowOwner(net.ParseIP("10.128.0.2")).cookie(trafficServiceCookie), fmt.Sprintf("in_port=%d", ofport), "nw_src=10.128.0.2", "nw_dst=172.30.0.0/16", "42->NXM_NX_REG0"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=20", fmt.Sprintf("in_port=%d", ofport), "ip", "10.128.0.2", "42->NXM_NX_REG0"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=20", fmt.Sprintf("in_port=%d", ofport), "ipv6", "fd01:0:0:5::2", "42->NXM_NX_REG0"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=25", "ip", "10.128.0.2", "42->NXM_NX_REG0"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=40", "arp", "10.128.0.2", fmt.Sprintf("output:%d", ofport)},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=40", "icmp6", "nd_target=fd01:0:0:5::2", fmt.Sprintf("output:%d", ofport)},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=70", "nw_src=10.128.0.1,", "nw_dst=10.128.0.2", "42->NXM_NX_REG1", fmt.Sprintf("%d->NXM_NX_REG2", ofport)},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=70", "cookie=" + podFlowOwner(net.ParseIP("10.128.0.2")).cookie(trafficPodCookie), "nw_src=10.128.0.0/14", "nw_dst=10.128.0.2", "42->NXM_NX_REG1", fmt.Sprintf("%d->NXM_NX_REG2", ofport)},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=70", "cookie=" + podFlowOwner(net.ParseIP("10.128.0.2")).cookie(trafficServiceCookie), "nw_src=172.30.0.0/16", "nw_dst=10.128.0.2", "42->NXM_NX_REG1", fmt.Sprintf("%d->NXM_NX_REG2", ofport)},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=70", "ip", "10.128.0.2", "42->NXM_NX_REG1", fmt.Sprintf("%d->NXM_NX_REG2", ofport)},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=70", "ipv6", "fd01:0:0:5::2", "42->NXM_NX_REG1", fmt.Sprintf("%d->NXM_NX_REG2", ofport)},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	_, _, ipv6, err := oc.getPodDetailsBySandboxID(sandboxID)
+	if err != nil {
+		t.Fatalf("Unexpected error getting pod details: %v", err)
+	}
+	if ipv6.String() != "fd01:0:0:5::2" {
+		t.Fatalf("unexpected IPv6 address %q", ipv6.String())
+	}
+
+	err = oc.TearDownPod(sandboxID)
+	if err != nil {
+		t.Fatalf("Unexpected error deleting pod rules: %v", err)
+	}
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows) // no changes
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	// Remote HostSubnet with an IPv6 subnet
+	hs := osdnv1.HostSubnet{
+		TypeMeta: metav1.TypeMeta{
+			Kind: "HostSubnet",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "node2",
+			UID:         "node2UID",
+			Annotations: map[string]string{common.HostSubnetIPv6Annotation: "fd01:0:0:6::/64"},
+		},
+		Host:   "node2",
+		HostIP: "192.168.1.2",
+		Subnet: "10.129.0.0/23",
+	}
+	if err := oc.AddHostSubnetRules(&hs); err != nil {
+		t.Fatalf("Unexpected error adding HostSubnet rules: %v", err)
+	}
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=10", "tun_src=192.168.1.2"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=50", "arp", "arp_tpa=10.129.0.0/23", "192.168.1.2->tun_dst"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=50", "icmp6", "nd_target=fd01:0:0:6::/64", "192.168.1.2->tun_dst"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=90", "ip", "nw_dst=10.129.0.0/23", "192.168.1.2->tun_dst"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=90", "ipv6", "ipv6_dst=fd01:0:0:6::/64", "192.168.1.2->tun_dst"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	if err := oc.DeleteHostSubnetRules(&hs); err != nil {
+		t.Fatalf("Unexpected error deleting HostSubnet rules: %v", err)
+	}
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows) // no changes
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,17 +23,21 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	kruntimeapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
 	"k8s.io/klog/v2"
 	kcontainer "k8s.io/kubernetes/pkg/kubelet/container"
 	kbandwidth "k8s.io/kubernetes/pkg/util/bandwidth"
 
-	"github.com/containernetworking/cni/pkg/invoke"
 	cnitypes "github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/plugins/pkg/ns"
 
 	"github.com/vishvananda/netlink"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
 )
 
 const (
@@ -38,6 +46,67 @@ const (
 	containerLocalCniPluginsBinDir = "/usr/bin/cni"
 )
 
+// tracer traces the stages of pod setup and teardown, as children of the CNI
+// server's span for the request
+var tracer = otel.Tracer("github.com/openshift/sdn/pkg/network/node")
+
+// traceStage runs f in a child span of ctx, recording f's error (if any) in the span,
+// and f's duration in ctx's stageTimings, if it has them
+func traceStage(ctx context.Context, name string, f func(ctx context.Context) error) error {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, name)
+	defer span.End()
+	err := f(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	if timings, ok := ctx.Value(stageTimingsKey{}).(stageTimings); ok {
+		timings[name] += time.Since(start)
+	}
+	return err
+}
+
+// stageTimings records the durations of the stages of a pod setup, by name, for
+// the pod setup latency metrics
+type stageTimings map[string]time.Duration
+
+type stageTimingsKey struct{}
+
+// withStageTimings returns a context that records the durations of the stages run
+// in it by traceStage
+func withStageTimings(ctx context.Context) (context.Context, stageTimings) {
+	timings := make(stageTimings)
+	return context.WithValue(ctx, stageTimingsKey{}, timings), timings
+}
+
+// observePodSetupLatency records a successful pod setup that started at start, and
+// its stages, in the pod setup latency metrics. The setup is considered to have
+// started when the plugin started its stages, if it reported them.
+func observePodSetupLatency(req *cniserver.PodRequest, start time.Time, timings stageTimings) {
+	for name, stage := range map[string]*cniserver.StageTiming{"veth": req.VethSetup, "iptables": req.IPTablesSetup} {
+		if stage != nil {
+			timings[name] = stage.End.Sub(stage.Start)
+			if stage.Start.Before(start) {
+				start = stage.Start
+			}
+		}
+	}
+	for name, duration := range timings {
+		metrics.PodSetupLatency.WithLabelValues(name).Observe(duration.Seconds())
+	}
+	metrics.PodSetupLatency.WithLabelValues(metrics.PodSetupPhaseTotal).Observe(time.Since(start).Seconds())
+}
+
+// traceLogSuffix returns a suffix for log messages about request identifying its
+// trace, if it is being traced
+func traceLogSuffix(request *cniserver.PodRequest) string {
+	if traceID := request.TraceID(); traceID != "" {
+		return " (trace " + traceID + ")"
+	}
+	return ""
+}
+
 type podHandler interface {
 	setup(req *cniserver.PodRequest) (cnitypes.Result, *runningPod, error)
 	update(req *cniserver.PodRequest) (uint32, error)
@@ -51,23 +120,79 @@ type runningPod struct {
 
 type podManager struct {
 	// Common stuff used for both live and testing code
-	podHandler podHandler
-	cniServer  *cniserver.CNIServer
+	podHandler    podHandler
+	cniServerLock sync.Mutex
+	cniServer     *cniserver.CNIServer
 	// Request queue for pod operations incoming from the CNIServer
 	requests chan (*cniserver.PodRequest)
 	// Tracks pod info for updates
 	runningPods     map[string]*runningPod
 	runningPodsLock sync.Mutex
+	// multicastGrantVNIDs is the set of VNIDs that have multicast grant flows;
+	// protected by runningPodsLock
+	multicastGrantVNIDs sets.Int
+	// multicastGateway is nil unless multicast gateway groups are configured;
+	// multicastGatewayOfports is the set of ofports it currently delivers to
+	// (protected by runningPodsLock)
+	multicastGateway        *multicastGateway
+	multicastGatewayOfports sets.Int
+	// localVNIDsChanged, if set, is called (without runningPodsLock held) after the
+	// first pod with some VNID starts running or the last one stops; must be set
+	// before Start()
+	localVNIDsChanged func()
+	// Held while processing a request from the queue, or while reattaching pods
+	// in parallel at startup
+	requestLock sync.Mutex
+	// ready is closed once the node has passed its startup checks; until then
+	// CNI_ADD requests wait for it, and the "startup" health check fails
+	// with notReadyErr
+	ready       chan struct{}
+	readyLock   sync.Mutex
+	notReadyErr error
 
 	// Live pod setup/teardown stuff not used in testing code
-	kClient kubernetes.Interface
-	policy  osdnPolicy
-	mtu     uint32
-	ovs     *ovsController
+	kClient  kubernetes.Interface
+	policy   osdnPolicy
+	mtu      uint32
+	ovs      *ovsController
+	recorder record.EventRecorder
+
+	// probeHostPort checks whether a hostPort can be bound on the node
+	probeHostPort func(hostPort) error
+
+	// Only set in dual-stack clusters; must be set before Start()
+	localSubnetIPv6CIDR string
+	ipv6ClusterNetworks []common.ParsedClusterNetworkEntry
+
+	// migrating is set in migration mode, in which no new pods are set up; must be
+	// set before Start()
+	migrating bool
+
+	// Cluster DNS configuration to return in CNI results; must be set before Start()
+	clusterDNS    []string
+	clusterDomain string
+
+	// Executables allowed to connect to the CNI server; must be set before Start()
+	cniAllowedExecutables []string
+
+	// networkStatus is set to write NetworkStatusAnnotation on new pods; must be
+	// set before Start()
+	networkStatus bool
+
+	// IPAM backend type (HostLocalIPAM or ClusterIPAM), and the client and node
+	// name for ClusterIPAM; must be set before Start()
+	ipamType   string
+	ipamClient dynamic.Interface
+	nodeName   string
+
+	// Egress router DNS proxies, by sandbox ID; see EgressRouterDNSProxyAnnotation
+	egressRouterProxies     map[string]*egressRouterDNSProxy
+	egressRouterProxiesLock sync.Mutex
+	egressRouterStateDir    string
 
 	// Things only accessed through the processCNIRequests() goroutine
 	// and thus can be set from Start()
-	ipamConfig []byte
+	ipam ipamBackend
 }
 
 // Creates a new live podManager; used by node code0
@@ -78,31 +203,72 @@ func newPodManager(kClient kubernetes.Interface, policy osdnPolicy, mtu uint32,
 	pm.mtu = mtu
 	pm.podHandler = pm
 	pm.ovs = ovs
+	pm.egressRouterStateDir = egressRouterDNSProxyStateDir
+	// Not ready until the node's startup checks pass; see waitForStartupReady()
+	pm.ready = make(chan struct{})
+	pm.notReadyErr = fmt.Errorf("node has not finished starting up")
 	return pm
 }
 
 // Creates a new basic podManager; used by testcases
 func newDefaultPodManager() *podManager {
+	ready := make(chan struct{})
+	close(ready)
 	return &podManager{
-		runningPods: make(map[string]*runningPod),
-		requests:    make(chan *cniserver.PodRequest, 20),
+		runningPods:         make(map[string]*runningPod),
+		multicastGrantVNIDs: sets.NewInt(),
+		requests:            make(chan *cniserver.PodRequest, 20),
+		egressRouterProxies: make(map[string]*egressRouterDNSProxy),
+		ready:               ready,
+		probeHostPort:       probeHostPort,
 	}
 }
 
+// getPodRoutes returns the IPv4 routes for pods on a node with subnet nodeNet
+func getPodRoutes(clusterNetworks []common.ParsedClusterNetworkEntry, nodeNet *net.IPNet) []cnitypes.Route {
+	_, mcnet, _ := net.ParseCIDR("224.0.0.0/4")
+
+	routes := []cnitypes.Route{
+		{
+			//Default route
+			Dst: net.IPNet{
+				IP:   net.IPv4zero,
+				Mask: net.IPMask(net.IPv4zero),
+			},
+			GW: common.GenerateDefaultGateway(nodeNet),
+		},
+		{
+			//Multicast
+			Dst: *mcnet,
+		},
+	}
+
+	for _, cn := range clusterNetworks {
+		routes = append(routes, cnitypes.Route{Dst: *cn.ClusterCIDR})
+	}
+	return routes
+}
+
 // Generates a CNI IPAM config from a given node cluster and local subnet that
 // CNI 'host-local' IPAM plugin will use to create an IP address lease for the
-// container
-func getIPAMConfig(clusterNetworks []common.ParsedClusterNetworkEntry, localSubnet string) ([]byte, error) {
+// container. In a dual-stack cluster, localSubnetIPv6 and ipv6ClusterNetworks are
+// used to allocate an IPv6 address as well.
+func getIPAMConfig(clusterNetworks []common.ParsedClusterNetworkEntry, localSubnet string, ipv6ClusterNetworks []common.ParsedClusterNetworkEntry, localSubnetIPv6 string) ([]byte, error) {
 	nodeNet, err := cnitypes.ParseCIDR(localSubnet)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing node network '%s': %v", localSubnet, err)
 	}
 
+	type hostLocalRange struct {
+		Subnet cnitypes.IPNet `json:"subnet"`
+	}
+
 	type hostLocalIPAM struct {
-		Type    string           `json:"type"`
-		Subnet  cnitypes.IPNet   `json:"subnet"`
-		Routes  []cnitypes.Route `json:"routes"`
-		DataDir string           `json:"dataDir"`
+		Type    string             `json:"type"`
+		Subnet  cnitypes.IPNet     `json:"subnet"`
+		Ranges  [][]hostLocalRange `json:"ranges,omitempty"`
+		Routes  []cnitypes.Route   `json:"routes"`
+		DataDir string             `json:"dataDir"`
 	}
 
 	type cniNetworkConfig struct {
@@ -112,25 +278,29 @@ func getIPAMConfig(clusterNetworks []common.ParsedClusterNetworkEntry, localSubn
 		IPAM       *hostLocalIPAM `json:"ipam"`
 	}
 
-	_, mcnet, _ := net.ParseCIDR("224.0.0.0/4")
+	routes := getPodRoutes(clusterNetworks, nodeNet)
 
-	routes := []cnitypes.Route{
-		{
-			//Default route
+	// The legacy "subnet" field is treated by host-local as the first range, so
+	// the IPv4 address is always first in the result
+	var ranges [][]hostLocalRange
+	if localSubnetIPv6 != "" {
+		nodeNetV6, err := cnitypes.ParseCIDR(localSubnetIPv6)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing node IPv6 network '%s': %v", localSubnetIPv6, err)
+		}
+		ranges = append(ranges, []hostLocalRange{{Subnet: cnitypes.IPNet(*nodeNetV6)}})
+
+		routes = append(routes, cnitypes.Route{
+			//Default IPv6 route
 			Dst: net.IPNet{
-				IP:   net.IPv4zero,
-				Mask: net.IPMask(net.IPv4zero),
+				IP:   net.IPv6zero,
+				Mask: net.CIDRMask(0, 8*net.IPv6len),
 			},
-			GW: common.GenerateDefaultGateway(nodeNet),
-		},
-		{
-			//Multicast
-			Dst: *mcnet,
-		},
-	}
-
-	for _, cn := range clusterNetworks {
-		routes = append(routes, cnitypes.Route{Dst: *cn.ClusterCIDR})
+			GW: common.GenerateDefaultGateway(nodeNetV6),
+		})
+		for _, cn := range ipv6ClusterNetworks {
+			routes = append(routes, cnitypes.Route{Dst: *cn.ClusterCIDR})
+		}
 	}
 
 	return json.Marshal(&cniNetworkConfig{
@@ -144,6 +314,7 @@ func getIPAMConfig(clusterNetworks []common.ParsedClusterNetworkEntry, localSubn
 				IP:   nodeNet.IP,
 				Mask: nodeNet.Mask,
 			},
+			Ranges: ranges,
 			Routes: routes,
 		},
 	})
@@ -152,14 +323,22 @@ func getIPAMConfig(clusterNetworks []common.ParsedClusterNetworkEntry, localSubn
 // Start the CNI server and start processing requests from it
 func (m *podManager) Start(rundir string, localSubnetCIDR string, clusterNetworks []common.ParsedClusterNetworkEntry, serviceNetworkCIDR string) error {
 	var err error
-	if m.ipamConfig, err = getIPAMConfig(clusterNetworks, localSubnetCIDR); err != nil {
+	if m.ipam, err = newIPAMBackend(m.ipamType, m.ipamClient, m.nodeName, clusterNetworks, localSubnetCIDR, m.ipv6ClusterNetworks, m.localSubnetIPv6CIDR); err != nil {
 		return err
 	}
 
+	m.restartEgressRouterDNSProxies()
 	go m.processCNIRequests()
 
-	m.cniServer = cniserver.NewCNIServer(rundir, &cniserver.Config{MTU: m.mtu, ServiceNetworkCIDR: serviceNetworkCIDR})
-	return m.cniServer.Start(m.handleCNIRequest)
+	cniServer := cniserver.NewCNIServer(rundir, &cniserver.Config{MTU: m.mtu, ServiceNetworkCIDR: serviceNetworkCIDR})
+	cniServer.SetAllowedExecutables(m.cniAllowedExecutables)
+	if err := cniServer.Start(m.handleCNIRequest); err != nil {
+		return err
+	}
+	m.cniServerLock.Lock()
+	defer m.cniServerLock.Unlock()
+	m.cniServer = cniServer
+	return nil
 }
 
 func (m *podManager) InitRunningPods(existingPodSandboxes map[string]*kruntimeapi.PodSandbox, existingOFPodNetworks map[string]podNetworkInfo) error {
@@ -193,6 +372,32 @@ func getPodKey(namespace, name string) string {
 	return fmt.Sprintf("%s/%s", namespace, name)
 }
 
+// getOFPortNamespaces returns the namespace of each running pod, by ofport
+func (m *podManager) getOFPortNamespaces() map[int]string {
+	m.runningPodsLock.Lock()
+	defer m.runningPodsLock.Unlock()
+
+	namespaces := make(map[int]string, len(m.runningPods))
+	for key, runningPod := range m.runningPods {
+		namespaces[runningPod.ofport] = strings.SplitN(key, "/", 2)[0]
+	}
+	return namespaces
+}
+
+func (m *podManager) isRunning(pk string) bool {
+	m.runningPodsLock.Lock()
+	defer m.runningPodsLock.Unlock()
+	_, exists := m.runningPods[pk]
+	return exists
+}
+
+// runningPodCount returns the number of pods attached to the SDN
+func (m *podManager) runningPodCount() int {
+	m.runningPodsLock.Lock()
+	defer m.runningPodsLock.Unlock()
+	return len(m.runningPods)
+}
+
 func (m *podManager) getPod(request *cniserver.PodRequest) *runningPod {
 	return m.runningPods[getPodKey(request.PodNamespace, request.PodName)]
 }
@@ -210,6 +415,14 @@ func (m *podManager) waitRequest(request *cniserver.PodRequest) *cniserver.PodRe
 // Enqueue incoming pod requests from the CNI server, wait on the result,
 // and return that result to the CNI client
 func (m *podManager) handleCNIRequest(request *cniserver.PodRequest) ([]byte, error) {
+	switch request.Command {
+	case cniserver.CNI_ADD:
+		if err := m.waitReady(cniReadyTimeout); err != nil {
+			pk := getPodKey(request.PodNamespace, request.PodName)
+			klog.Warningf("CNI_ADD %s failed: %v%s", pk, err, traceLogSuffix(request))
+			return nil, err
+		}
+	}
 	klog.V(5).Infof("Dispatching pod network request %v", request)
 	m.addRequest(request)
 	result := m.waitRequest(request)
@@ -217,60 +430,215 @@ func (m *podManager) handleCNIRequest(request *cniserver.PodRequest) ([]byte, er
 	return result.Response, result.Err
 }
 
-func (m *podManager) updateLocalMulticastRulesWithLock(vnid uint32) {
+// localVNIDs returns the VNIDs of the running pods
+func (m *podManager) localVNIDs() sets.Int {
+	m.runningPodsLock.Lock()
+	defer m.runningPodsLock.Unlock()
+
+	vnids := sets.NewInt()
+	for _, pod := range m.runningPods {
+		vnids.Insert(int(pod.vnid))
+	}
+	return vnids
+}
+
+// resyncPodFlows rewrites the flows of every running pod, and the multicast flows
+// (including grants and multicast gateway delivery) of their VNIDs, in case they
+// have drifted. Pods that are being set up or torn down concurrently are left
+// alone, since they aren't (or are no longer) in runningPods.
+func (m *podManager) resyncPodFlows() error {
+	m.runningPodsLock.Lock()
+	defer m.runningPodsLock.Unlock()
+
+	podNetworks, err := m.ovs.GetPodNetworkInfo()
+	if err != nil {
+		return fmt.Errorf("could not get pod network info: %v", err)
+	}
+	ofportVNIDs := make(map[int]uint32)
+	for _, pod := range m.runningPods {
+		ofportVNIDs[pod.ofport] = pod.vnid
+	}
+
+	vnids := sets.NewInt()
+	for sandboxID, info := range podNetworks {
+		vnid, ok := ofportVNIDs[info.ofport]
+		if !ok {
+			continue
+		}
+		vnids.Insert(int(vnid))
+		podIP := net.ParseIP(info.ip)
+		podIPv6 := net.ParseIP(info.ipv6)
+		if err := m.ovs.resetPodFlows(info.ofport, podIP, podIPv6, vnid); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Error resyncing OVS flows for pod %q: %v", sandboxID, err))
+		}
+	}
+	// Force the multicast gateway delivery flows to be rewritten too
+	m.multicastGatewayOfports = nil
+	for _, vnid := range vnids.Union(m.multicastGrantVNIDs).List() {
+		m.updateLocalMulticastRulesWithLock(uint32(vnid))
+	}
+	m.updateMulticastGatewayFlowsWithLock()
+	return nil
+}
+
+// hasPodsWithVNIDWithLock returns true if any running pod has VNID vnid. Must be
+// called with runningPodsLock held.
+func (m *podManager) hasPodsWithVNIDWithLock(vnid uint32) bool {
+	for _, pod := range m.runningPods {
+		if pod.vnid == vnid {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *podManager) notifyLocalVNIDsChanged() {
+	if m.localVNIDsChanged != nil {
+		m.localVNIDsChanged()
+	}
+}
+
+func (m *podManager) localOfportsForVNID(vnid uint32) []int {
+	var ofports []int
+	for _, pod := range m.runningPods {
+		if pod.vnid == vnid {
+			ofports = append(ofports, pod.ofport)
+		}
+	}
+	return ofports
+}
+
+func (m *podManager) updateMulticastFlowsWithLock(vnid uint32) {
 	var ofports []int
 	enabled := m.policy.GetMulticastEnabled(vnid)
 	if enabled {
-		for _, pod := range m.runningPods {
-			if pod.vnid == vnid {
-				ofports = append(ofports, pod.ofport)
-			}
-		}
+		ofports = m.localOfportsForVNID(vnid)
 	}
 
 	if err := m.ovs.UpdateLocalMulticastFlows(vnid, enabled, ofports); err != nil {
 		utilruntime.HandleError(fmt.Errorf("Error updating OVS multicast flows for VNID %d: %v", vnid, err))
 
 	}
+
+	// Granted groups; GetMulticastGrants returns nothing if vnid is not enabled
+	grants := compileMulticastGrantFlows(m.policy.GetMulticastGrants(vnid), m.localOfportsForVNID)
+	if len(grants) == 0 && !m.multicastGrantVNIDs.Has(int(vnid)) {
+		return
+	}
+	if err := m.ovs.UpdateMulticastGrantFlows(vnid, ofports, grants); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Error updating OVS multicast grant flows for VNID %d: %v", vnid, err))
+		return
+	}
+	if len(grants) == 0 {
+		m.multicastGrantVNIDs.Delete(int(vnid))
+	} else {
+		m.multicastGrantVNIDs.Insert(int(vnid))
+	}
 }
 
-// Update multicast OVS rules for the given vnid
+// updateLocalMulticastRulesWithLock updates the multicast flows of vnid, and of any
+// VNIDs whose multicast traffic is granted to it (since they deliver to its pods)
+func (m *podManager) updateLocalMulticastRulesWithLock(vnid uint32) {
+	m.updateMulticastFlowsWithLock(vnid)
+	for _, sender := range m.policy.GetMulticastGrantSenders(vnid) {
+		m.updateMulticastFlowsWithLock(sender)
+	}
+	m.updateMulticastGatewayFlowsWithLock()
+}
+
+// Update multicast OVS rules for the given vnid (after a change to its NetNamespace)
 func (m *podManager) UpdateLocalMulticastRules(vnid uint32) {
 	m.runningPodsLock.Lock()
 	defer m.runningPodsLock.Unlock()
 	m.updateLocalMulticastRulesWithLock(vnid)
+
+	// The change may have removed grants to vnid from VNIDs that we don't know about
+	// any more, so recheck all of the VNIDs that currently have grant flows
+	for _, grantVNID := range m.multicastGrantVNIDs.List() {
+		if uint32(grantVNID) != vnid {
+			m.updateMulticastFlowsWithLock(uint32(grantVNID))
+		}
+	}
 }
 
 // Process all CNI requests from the request queue serially.  Our OVS interaction
 // and scripts currently cannot run in parallel, and doing so greatly complicates
-// setup/teardown logic
+// setup/teardown logic. (The exception is reattaching existing pods at startup; see
+// reattachPods.)
 func (m *podManager) processCNIRequests() {
 	for request := range m.requests {
+		m.requestLock.Lock()
 		result := m.processRequest(request)
+		m.requestLock.Unlock()
 		request.Result <- result
 	}
 	panic("stopped processing CNI pod requests!")
 }
 
+// reattachPods processes reqs (CNI_ADD requests for pods that were running before
+// the node restarted) using up to workers goroutines, holding off requests from the
+// CNI server until they are done. Unlike new pods, these pods already have their IP
+// addresses and veths, so they only need their OVS ports and flows, which can be set
+// up in parallel. It returns the errors for the requests that failed, by sandbox ID.
+func (m *podManager) reattachPods(reqs []*cniserver.PodRequest, workers int) map[string]error {
+	m.requestLock.Lock()
+	defer m.requestLock.Unlock()
+
+	queue := make(chan *cniserver.PodRequest, len(reqs))
+	for _, req := range reqs {
+		queue <- req
+	}
+	close(queue)
+
+	var failedLock sync.Mutex
+	failed := make(map[string]error)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(reqs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range queue {
+				klog.Infof("Reattaching pod '%s/%s' to SDN", req.PodNamespace, req.PodName)
+				result := m.processRequest(req)
+				if result.Err != nil {
+					klog.Warningf("Could not reattach pod '%s/%s' to SDN: %v", req.PodNamespace, req.PodName, result.Err)
+					failedLock.Lock()
+					failed[req.SandboxID] = result.Err
+					failedLock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return failed
+}
+
 func (m *podManager) processRequest(request *cniserver.PodRequest) *cniserver.PodResult {
 	pk := getPodKey(request.PodNamespace, request.PodName)
 	result := &cniserver.PodResult{}
+	vnidsChanged := false
 	switch request.Command {
 	case cniserver.CNI_ADD:
+		if m.migrating && !m.isRunning(pk) {
+			result.Err = fmt.Errorf("node is migrating to another network plugin; not setting up new pod %s", pk)
+			klog.Warningf("CNI_ADD %s failed: %v%s", pk, result.Err, traceLogSuffix(request))
+			break
+		}
 		ipamResult, runningPod, err := m.podHandler.setup(request)
 		if ipamResult != nil {
 			result.Response, err = json.Marshal(ipamResult)
 			if err == nil {
 				m.runningPodsLock.Lock()
-				defer m.runningPodsLock.Unlock()
+				vnidsChanged = !m.hasPodsWithVNIDWithLock(runningPod.vnid)
 				m.runningPods[pk] = runningPod
 				if m.ovs != nil {
 					m.updateLocalMulticastRulesWithLock(runningPod.vnid)
 				}
+				m.runningPodsLock.Unlock()
 			}
 		}
 		if err != nil {
-			klog.Warningf("CNI_ADD %s failed: %v", pk, err)
+			klog.Warningf("CNI_ADD %s failed: %v%s", pk, err, traceLogSuffix(request))
 			metrics.PodOperationsErrors.WithLabelValues(metrics.PodOperationSetup).Inc()
 			result.Err = err
 		}
@@ -278,18 +646,20 @@ func (m *podManager) processRequest(request *cniserver.PodRequest) *cniserver.Po
 		vnid, err := m.podHandler.update(request)
 		if err == nil {
 			m.runningPodsLock.Lock()
-			defer m.runningPodsLock.Unlock()
-			if runningPod, exists := m.runningPods[pk]; exists {
+			if runningPod, exists := m.runningPods[pk]; exists && runningPod.vnid != vnid {
 				runningPod.vnid = vnid
+				vnidsChanged = true
 			}
+			m.runningPodsLock.Unlock()
 		} else {
-			klog.Warningf("CNI_UPDATE %s failed: %v", pk, err)
+			klog.Warningf("CNI_UPDATE %s failed: %v%s", pk, err, traceLogSuffix(request))
 		}
 		result.Err = err
 	case cniserver.CNI_DEL:
 		m.runningPodsLock.Lock()
 		if runningPod, exists := m.runningPods[pk]; exists {
 			delete(m.runningPods, pk)
+			vnidsChanged = !m.hasPodsWithVNIDWithLock(runningPod.vnid)
 			if m.ovs != nil {
 				m.updateLocalMulticastRulesWithLock(runningPod.vnid)
 			}
@@ -297,15 +667,41 @@ func (m *podManager) processRequest(request *cniserver.PodRequest) *cniserver.Po
 		m.runningPodsLock.Unlock()
 		result.Err = m.podHandler.teardown(request)
 		if result.Err != nil {
-			klog.Warningf("CNI_DEL %s failed: %v", pk, result.Err)
+			klog.Warningf("CNI_DEL %s failed: %v%s", pk, result.Err, traceLogSuffix(request))
 			metrics.PodOperationsErrors.WithLabelValues(metrics.PodOperationTeardown).Inc()
 		}
 	default:
 		result.Err = fmt.Errorf("unhandled CNI request %v", request.Command)
 	}
+	// (For CNI_DEL this is after teardown, so the pod's flows are already gone.)
+	if vnidsChanged {
+		m.notifyLocalVNIDsChanged()
+	}
 	return result
 }
 
+// getDefaultRouteInterface returns the interface with the node's default route
+func getDefaultRouteInterface() (netlink.Link, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routes: %v", err)
+	}
+
+	var iface netlink.Link
+	for _, r := range routes {
+		if r.Dst == nil {
+			iface, err = netlink.LinkByIndex(r.LinkIndex)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get default route interface: %v", err)
+			}
+		}
+	}
+	if iface == nil {
+		return nil, fmt.Errorf("failed to find default route interface")
+	}
+	return iface, nil
+}
+
 // Adds a macvlan interface to a container, if requested, for use with the egress router feature
 func maybeAddMacvlan(pod *corev1.Pod, netns string) error {
 	annotation, ok := pod.Annotations[osdnv1.AssignMacvlanAnnotation]
@@ -327,22 +723,9 @@ func maybeAddMacvlan(pod *corev1.Pod, netns string) error {
 	var iface netlink.Link
 	var err error
 	if annotation == "true" {
-		// Find interface with the default route
-		routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+		iface, err = getDefaultRouteInterface()
 		if err != nil {
-			return fmt.Errorf("failed to read routes: %v", err)
-		}
-
-		for _, r := range routes {
-			if r.Dst == nil {
-				iface, err = netlink.LinkByIndex(r.LinkIndex)
-				if err != nil {
-					return fmt.Errorf("failed to get default route interface: %v", err)
-				}
-			}
-		}
-		if iface == nil {
-			return fmt.Errorf("failed to find default route interface")
+			return err
 		}
 	} else {
 		iface, err = netlink.LinkByName(annotation)
@@ -374,48 +757,57 @@ func maybeAddMacvlan(pod *corev1.Pod, netns string) error {
 	return nil
 }
 
-func createIPAMArgs(netnsPath string, action cniserver.CNICommand, id string) *invoke.Args {
-	return &invoke.Args{
-		Command:     string(action),
-		ContainerID: id,
-		NetNS:       netnsPath,
-		IfName:      podInterfaceName,
-		Path:        containerLocalCniPluginsBinDir,
-	}
-}
-
-// Run CNI IPAM allocation for the container and return the allocated IP address
-func (m *podManager) ipamAdd(netnsPath string, id string) (*current.Result, net.IP, error) {
+// Run IPAM allocation for the container and return the allocated IP address,
+// and IPv6 address (if the cluster is dual-stack)
+func (m *podManager) ipamAdd(netnsPath, id, namespace, name string) (*current.Result, net.IP, net.IP, error) {
 	if netnsPath == "" {
-		return nil, nil, fmt.Errorf("netns required for CNI_ADD")
-	}
-
-	args := createIPAMArgs(netnsPath, cniserver.CNI_ADD, id)
-	r, err := invoke.ExecPluginWithResult(containerLocalCniPluginsBinDir+"/osdn-host-local", m.ipamConfig, args)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to run CNI IPAM ADD: %v", err)
+		return nil, nil, nil, fmt.Errorf("netns required for CNI_ADD")
 	}
 
-	// We gave the IPAM plugin 0.3.1 config, so the plugin must return a 0.3.1 result
-	result, err := current.GetResult(r)
+	result, err := m.ipam.Allocate(netnsPath, id, namespace, name)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse CNI IPAM ADD result: %v", err)
+		return nil, nil, nil, err
 	}
 	if len(result.IPs) == 0 {
-		return nil, nil, fmt.Errorf("failed to obtain IP address from CNI IPAM")
+		return nil, nil, nil, fmt.Errorf("failed to obtain IP address from CNI IPAM")
+	}
+
+	var podIPv6 net.IP
+	if m.localSubnetIPv6CIDR != "" {
+		if len(result.IPs) != 2 || result.IPs[1].Version != "6" {
+			return nil, nil, nil, fmt.Errorf("failed to obtain IPv6 address from CNI IPAM")
+		}
+		podIPv6 = result.IPs[1].Address.IP
 	}
 
-	return result, result.IPs[0].Address.IP, nil
+	return result, result.IPs[0].Address.IP, podIPv6, nil
 }
 
-// Run CNI IPAM release for the container
-func (m *podManager) ipamDel(id string) error {
-	args := createIPAMArgs("", cniserver.CNI_DEL, id)
-	err := invoke.ExecPluginWithoutResult(containerLocalCniPluginsBinDir+"/osdn-host-local", m.ipamConfig, args)
-	if err != nil {
-		return fmt.Errorf("failed to run CNI IPAM DEL: %v", err)
+// getPodDNS returns the DNS configuration for a pod in namespace, matching what
+// kubelet writes to the pod's resolv.conf for the "ClusterFirst" DNS policy
+func (m *podManager) getPodDNS(namespace string) cnitypes.DNS {
+	if len(m.clusterDNS) == 0 {
+		return cnitypes.DNS{}
+	}
+	dns := cnitypes.DNS{
+		Nameservers: m.clusterDNS,
+		Options:     []string{"ndots:5"},
+	}
+	// Like kubelet, only add search domains if there is a cluster domain
+	if domain := strings.TrimSuffix(m.clusterDomain, "."); domain != "" {
+		dns.Domain = domain
+		dns.Search = []string{
+			fmt.Sprintf("%s.svc.%s", namespace, domain),
+			"svc." + domain,
+			domain,
+		}
 	}
-	return nil
+	return dns
+}
+
+// Run IPAM release for the container
+func (m *podManager) ipamDel(id string) error {
+	return m.ipam.Release(id)
 }
 
 func setupPodBandwidth(ovs *ovsController, pod *corev1.Pod, hostVeth, sandboxID string) error {
@@ -462,6 +854,8 @@ func podIsExited(p *kcontainer.Pod) bool {
 // Set up all networking (host/container veth, OVS flows, IPAM, loopback, etc)
 func (m *podManager) setup(req *cniserver.PodRequest) (cnitypes.Result, *runningPod, error) {
 	defer metrics.PodOperationsLatency.WithLabelValues(metrics.PodOperationSetup).Observe(metrics.SinceInMicroseconds(time.Now()))
+	start := time.Now()
+	ctx, timings := withStageTimings(req.Context())
 
 	// Release any IPAM allocations if the setup failed
 	var success bool
@@ -471,21 +865,49 @@ func (m *podManager) setup(req *cniserver.PodRequest) (cnitypes.Result, *running
 		}
 	}()
 
-	v1Pod, err := m.kClient.CoreV1().Pods(req.PodNamespace).Get(context.TODO(), req.PodName, metav1.GetOptions{})
+	var v1Pod *corev1.Pod
+	err := traceStage(ctx, "get-pod", func(ctx context.Context) error {
+		var err error
+		v1Pod, err = m.kClient.CoreV1().Pods(req.PodNamespace).Get(ctx, req.PodName, metav1.GetOptions{})
+		return err
+	})
 	if err != nil {
 		return nil, nil, err
 	}
 
 	var ipamResult cnitypes.Result
 	podIP := net.ParseIP(req.AssignedIP)
+	podIPv6 := net.ParseIP(req.AssignedIPv6)
 	if podIP == nil {
-		ipamResult, podIP, err = m.ipamAdd(req.Netns, req.SandboxID)
+		err = traceStage(ctx, "hostports", func(ctx context.Context) error {
+			return m.checkHostPorts(ctx, v1Pod)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var result *current.Result
+		err = traceStage(ctx, "ipam", func(context.Context) error {
+			var err error
+			result, podIP, podIPv6, err = m.ipamAdd(req.Netns, req.SandboxID, req.PodNamespace, req.PodName)
+			return err
+		})
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to run IPAM for %v: %v", req.SandboxID, err)
 		}
+		result.DNS = m.getPodDNS(req.PodNamespace)
+		ipamResult = result
 		if err := maybeAddMacvlan(v1Pod, req.Netns); err != nil {
 			return nil, nil, err
 		}
+		if err := m.maybeStartEgressRouterDNSProxy(v1Pod, req.SandboxID, req.Netns); err != nil {
+			return nil, nil, err
+		}
+		defer func() {
+			if !success {
+				m.stopEgressRouterDNSProxy(req.SandboxID)
+			}
+		}()
 	}
 
 	vnid, err := m.policy.GetVNID(req.PodNamespace)
@@ -493,17 +915,31 @@ func (m *podManager) setup(req *cniserver.PodRequest) (cnitypes.Result, *running
 		return nil, nil, err
 	}
 
-	ofport, err := m.ovs.SetUpPod(req.SandboxID, req.HostVeth, podIP, vnid)
+	ofport, err := m.ovs.SetUpPod(ctx, req.SandboxID, req.HostVeth, podIP, podIPv6, vnid)
 	if err != nil {
 		return nil, nil, err
 	}
-	if err := setupPodBandwidth(m.ovs, v1Pod, req.HostVeth, req.SandboxID); err != nil {
+	err = traceStage(ctx, "ovs-bandwidth", func(context.Context) error {
+		return setupPodBandwidth(m.ovs, v1Pod, req.HostVeth, req.SandboxID)
+	})
+	if err != nil {
 		return nil, nil, err
 	}
 
-	m.policy.EnsureVNIDRules(vnid)
+	_ = traceStage(ctx, "ovs-vnid-flows", func(context.Context) error {
+		m.policy.EnsureVNIDRules(vnid)
+		return nil
+	})
 	success = true
-	klog.Infof("CNI_ADD %s/%s got IP %s, ofport %d", req.PodNamespace, req.PodName, podIP, ofport)
+	observePodSetupLatency(req, start, timings)
+	if result, ok := ipamResult.(*current.Result); ok && m.networkStatus {
+		go m.updatePodNetworkStatus(req, v1Pod.UID, result)
+	}
+	if podIPv6 != nil {
+		klog.Infof("CNI_ADD %s/%s got IP %s, IPv6 %s, ofport %d%s", req.PodNamespace, req.PodName, podIP, podIPv6, ofport, traceLogSuffix(req))
+	} else {
+		klog.Infof("CNI_ADD %s/%s got IP %s, ofport %d%s", req.PodNamespace, req.PodName, podIP, ofport, traceLogSuffix(req))
+	}
 	return ipamResult, &runningPod{vnid: vnid, ofport: ofport}, nil
 }
 
@@ -525,13 +961,16 @@ func (m *podManager) update(req *cniserver.PodRequest) (uint32, error) {
 func (m *podManager) teardown(req *cniserver.PodRequest) error {
 	defer metrics.PodOperationsLatency.WithLabelValues(metrics.PodOperationTeardown).Observe(metrics.SinceInMicroseconds(time.Now()))
 
+	ctx := req.Context()
 	errList := []error{}
 
-	if err := m.ovs.TearDownPod(req.SandboxID); err != nil {
+	m.stopEgressRouterDNSProxy(req.SandboxID)
+
+	if err := traceStage(ctx, "ovs-teardown", func(context.Context) error { return m.ovs.TearDownPod(req.SandboxID) }); err != nil {
 		errList = append(errList, err)
 	}
 
-	if err := m.ipamDel(req.SandboxID); err != nil {
+	if err := traceStage(ctx, "ipam-release", func(context.Context) error { return m.ipamDel(req.SandboxID) }); err != nil {
 		errList = append(errList, err)
 	}
 
@@ -539,6 +978,38 @@ func (m *podManager) teardown(req *cniserver.PodRequest) error {
 		return kerrors.NewAggregate(errList)
 	}
 
-	klog.Infof("CNI_DEL %s/%s", req.PodNamespace, req.PodName)
+	klog.Infof("CNI_DEL %s/%s%s", req.PodNamespace, req.PodName, traceLogSuffix(req))
 	return nil
 }
+
+// getIPAMAllocations returns the IDs of the sandboxes that have addresses allocated
+// in the host-local IPAM data directory dataDir, and when each was (first) allocated
+func getIPAMAllocations(dataDir string) (map[string]time.Time, error) {
+	allocations := make(map[string]time.Time)
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return allocations, nil
+		}
+		return nil, err
+	}
+	for _, file := range files {
+		// Each allocation is a file named after the IP address, containing the ID
+		if file.IsDir() || net.ParseIP(file.Name()) == nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dataDir, file.Name()))
+		if err != nil {
+			continue
+		}
+		// Newer host-local versions also record the interface name
+		id := strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+		if id == "" {
+			continue
+		}
+		if allocated, exists := allocations[id]; !exists || file.ModTime().Before(allocated) {
+			allocations[id] = file.ModTime()
+		}
+	}
+	return allocations, nil
+}
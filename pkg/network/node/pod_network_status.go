@@ -0,0 +1,94 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/klog/v2"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	"github.com/openshift/sdn/pkg/network/common/cniserver"
+)
+
+const (
+	// NetworkStatusAnnotation is the pod annotation, defined by the Network Plumbing
+	// Working Group's NetworkAttachmentDefinition specification (and written by
+	// Multus), that describes the pod's network attachments
+	NetworkStatusAnnotation = "k8s.v1.cni.cncf.io/network-status"
+
+	// defaultNetworkName is the name to report for the pod network if the CNI
+	// configuration doesn't have one
+	defaultNetworkName = "openshift-sdn"
+)
+
+// networkStatus is an entry in NetworkStatusAnnotation
+type networkStatus struct {
+	Name      string        `json:"name"`
+	Interface string        `json:"interface,omitempty"`
+	IPs       []string      `json:"ips,omitempty"`
+	Mac       string        `json:"mac,omitempty"`
+	Default   bool          `json:"default"`
+	DNS       *cnitypes.DNS `json:"dns,omitempty"`
+}
+
+// getNetworkStatus returns the value of NetworkStatusAnnotation for a pod set up
+// by req with result
+func getNetworkStatus(req *cniserver.PodRequest, result *current.Result) (string, error) {
+	status := networkStatus{
+		Name:      req.NetworkName,
+		Interface: podInterfaceName,
+		Mac:       req.PodMAC,
+		Default:   true,
+	}
+	if status.Name == "" {
+		status.Name = defaultNetworkName
+	}
+	for _, ip := range result.IPs {
+		status.IPs = append(status.IPs, ip.Address.IP.String())
+	}
+	if len(result.DNS.Nameservers) > 0 {
+		status.DNS = &result.DNS
+	}
+	data, err := json.Marshal([]networkStatus{status})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// updatePodNetworkStatus sets NetworkStatusAnnotation on the pod set up by req,
+// which has UID uid. The patch is conditional on the UID, so that it doesn't apply to
+// a new pod with the same name if the pod was deleted and recreated in the meantime.
+func (m *podManager) updatePodNetworkStatus(req *cniserver.PodRequest, uid ktypes.UID, result *current.Result) {
+	status, err := getNetworkStatus(req, result)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Could not build network status for pod %s/%s: %v", req.PodNamespace, req.PodName, err))
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"uid": uid,
+			"annotations": map[string]string{
+				NetworkStatusAnnotation: status,
+			},
+		},
+	})
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Could not build network status patch for pod %s/%s: %v", req.PodNamespace, req.PodName, err))
+		return
+	}
+	_, err = m.kClient.CoreV1().Pods(req.PodNamespace).Patch(context.TODO(), req.PodName, ktypes.MergePatchType, patch, metav1.PatchOptions{})
+	if kerrors.IsNotFound(err) || kerrors.IsConflict(err) {
+		klog.V(5).Infof("Not updating network status of pod %s/%s: pod was deleted", req.PodNamespace, req.PodName)
+	} else if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Could not update network status of pod %s/%s: %v", req.PodNamespace, req.PodName, err))
+	}
+}
@@ -0,0 +1,85 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	"github.com/openshift/sdn/pkg/network/common/cniserver"
+)
+
+func TestPodNetworkStatus(t *testing.T) {
+	req := &cniserver.PodRequest{
+		PodNamespace: "ns",
+		PodName:      "pod",
+		PodMAC:       "0a:58:0a:80:00:05",
+	}
+	result := &current.Result{
+		IPs: []*current.IPConfig{
+			{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.128.0.5"), Mask: net.CIDRMask(23, 32)}},
+			{Version: "6", Address: net.IPNet{IP: net.ParseIP("fd01:0:0:1::5"), Mask: net.CIDRMask(64, 128)}},
+		},
+	}
+
+	status, err := getNetworkStatus(req, result)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := `[{"name":"openshift-sdn","interface":"eth0","ips":["10.128.0.5","fd01:0:0:1::5"],"mac":"0a:58:0a:80:00:05","default":true}]`
+	if status != expected {
+		t.Fatalf("Expected %s, got %s", expected, status)
+	}
+
+	req.NetworkName = "pod-network"
+	result.IPs = result.IPs[:1]
+	result.DNS = cnitypes.DNS{Nameservers: []string{"172.30.0.10"}, Domain: "cluster.local"}
+	status, err = getNetworkStatus(req, result)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected = `[{"name":"pod-network","interface":"eth0","ips":["10.128.0.5"],"mac":"0a:58:0a:80:00:05","default":true,"dns":{"nameservers":["172.30.0.10"],"domain":"cluster.local"}}]`
+	if status != expected {
+		t.Fatalf("Expected %s, got %s", expected, status)
+	}
+
+	m := newDefaultPodManager()
+	kClient := fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod", UID: "pod-uid", Annotations: map[string]string{"other": "value"}},
+	})
+	var patch []byte
+	kClient.PrependReactor("patch", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		patch = action.(clienttesting.PatchAction).GetPatch()
+		return false, nil, nil
+	})
+	m.kClient = kClient
+	m.updatePodNetworkStatus(req, "pod-uid", result)
+	// The fake client doesn't enforce the UID precondition, so check the patch
+	var patchObj struct {
+		Metadata struct {
+			UID string `json:"uid"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(patch, &patchObj); err != nil {
+		t.Fatalf("Unexpected error parsing patch %q: %v", string(patch), err)
+	}
+	if patchObj.Metadata.UID != "pod-uid" {
+		t.Fatalf("Expected patch to have UID precondition, got %s", string(patch))
+	}
+	pod, err := m.kClient.CoreV1().Pods("ns").Get(context.TODO(), "pod", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error getting pod: %v", err)
+	}
+	if pod.Annotations[NetworkStatusAnnotation] != expected || pod.Annotations["other"] != "value" {
+		t.Fatalf("Unexpected annotations %v", pod.Annotations)
+	}
+}
@@ -1,18 +1,24 @@
 package node
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/openshift/sdn/pkg/network/common"
 	"github.com/openshift/sdn/pkg/network/common/cniserver"
 
+	"k8s.io/apimachinery/pkg/util/sets"
 	utiltesting "k8s.io/client-go/util/testing"
 
 	cnitypes "github.com/containernetworking/cni/pkg/types"
@@ -429,3 +435,356 @@ func TestDirectPodUpdate(t *testing.T) {
 		t.Fatalf("failed to update pod: %v", err)
 	}
 }
+
+func TestGetIPAMConfigDualStack(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("10.128.0.0/14")
+	_, cidrV6, _ := net.ParseCIDR("fd01::/48")
+	clusterNetworks := []common.ParsedClusterNetworkEntry{{ClusterCIDR: cidr, HostSubnetLength: 9}}
+	ipv6ClusterNetworks := []common.ParsedClusterNetworkEntry{{ClusterCIDR: cidrV6, HostSubnetLength: 64}}
+
+	type ipamConfig struct {
+		IPAM struct {
+			Subnet string `json:"subnet"`
+			Ranges [][]struct {
+				Subnet string `json:"subnet"`
+			} `json:"ranges"`
+			Routes []struct {
+				Dst string `json:"dst"`
+				GW  string `json:"gw"`
+			} `json:"routes"`
+		} `json:"ipam"`
+	}
+
+	data, err := getIPAMConfig(clusterNetworks, "10.128.0.0/23", nil, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var config ipamConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("unexpected error parsing IPAM config: %v", err)
+	}
+	if config.IPAM.Subnet != "10.128.0.0/23" || len(config.IPAM.Ranges) != 0 {
+		t.Fatalf("unexpected single-stack IPAM config: %s", string(data))
+	}
+
+	data, err = getIPAMConfig(clusterNetworks, "10.128.0.0/23", ipv6ClusterNetworks, "fd01:0:0:5::/64")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	config = ipamConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("unexpected error parsing IPAM config: %v", err)
+	}
+	if config.IPAM.Subnet != "10.128.0.0/23" {
+		t.Fatalf("unexpected IPv4 subnet in IPAM config: %s", string(data))
+	}
+	if len(config.IPAM.Ranges) != 1 || len(config.IPAM.Ranges[0]) != 1 || config.IPAM.Ranges[0][0].Subnet != "fd01:0:0:5::/64" {
+		t.Fatalf("unexpected IPv6 ranges in IPAM config: %s", string(data))
+	}
+	var foundDefault, foundCluster bool
+	for _, route := range config.IPAM.Routes {
+		switch route.Dst {
+		case "::/0":
+			foundDefault = route.GW == "fd01:0:0:5::1"
+		case "fd01::/48":
+			foundCluster = route.GW == ""
+		}
+	}
+	if !foundDefault || !foundCluster {
+		t.Fatalf("missing IPv6 routes in IPAM config: %s", string(data))
+	}
+}
+
+func TestPodManagerMigrationMode(t *testing.T) {
+	tmpDir, err := utiltesting.MkTmpdir("cniserver")
+	if err != nil {
+		t.Fatalf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := filepath.Join(tmpDir, cniserver.CNIServerSocketName)
+
+	podTester := newPodTester(t, "migration", socketPath)
+	podManager := newDefaultPodManager()
+	podManager.podHandler = podTester
+	podManager.migrating = true
+	podManager.runningPods[ptPodKey("ns", "existing")] = &runningPod{vnid: 1, ofport: 3}
+	_, cidr, _ := net.ParseCIDR("1.2.0.0/16")
+	err = podManager.Start(tmpDir, "1.2.3.0/24", []common.ParsedClusterNetworkEntry{{ClusterCIDR: cidr, HostSubnetLength: 8}}, "172.30.0.0/16")
+	if err != nil {
+		t.Fatalf("could not start PodManager: %v", err)
+	}
+
+	for _, name := range []string{"existing", "new"} {
+		podTester.addExpectedPod(t, &operation{command: cniserver.CNI_ADD, namespace: "ns", name: name, cidr: "1.2.3.4/24"})
+		podTester.addExpectedPod(t, &operation{command: cniserver.CNI_DEL, namespace: "ns", name: name})
+	}
+	request := func(command cniserver.CNICommand, name string) error {
+		_, err := podManager.handleCNIRequest(&cniserver.PodRequest{
+			Command:      command,
+			PodNamespace: "ns",
+			PodName:      name,
+			SandboxID:    "sandbox-" + name,
+			Result:       make(chan *cniserver.PodResult),
+		})
+		return err
+	}
+
+	// A pod that is already running can be set up again, but a new one can't
+	if err := request(cniserver.CNI_ADD, "existing"); err != nil {
+		t.Fatalf("unexpected error re-adding existing pod: %v", err)
+	}
+	if err := request(cniserver.CNI_ADD, "new"); err == nil {
+		t.Fatalf("unexpected success adding new pod in migration mode")
+	}
+	if podTester.pods[ptPodKey("ns", "new")].added {
+		t.Fatalf("new pod was unexpectedly set up")
+	}
+
+	if count := podManager.runningPodCount(); count != 1 {
+		t.Fatalf("expected 1 running pod, got %d", count)
+	}
+	if err := request(cniserver.CNI_DEL, "existing"); err != nil {
+		t.Fatalf("unexpected error deleting pod: %v", err)
+	}
+	if count := podManager.runningPodCount(); count != 0 {
+		t.Fatalf("expected no running pods, got %d", count)
+	}
+}
+
+func TestPodManagerLocalVNIDsChanged(t *testing.T) {
+	tmpDir, err := utiltesting.MkTmpdir("cniserver")
+	if err != nil {
+		t.Fatalf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := filepath.Join(tmpDir, cniserver.CNIServerSocketName)
+
+	podTester := newPodTester(t, "localvnids", socketPath)
+	podManager := newDefaultPodManager()
+	podManager.podHandler = podTester
+	changes := 0
+	podManager.localVNIDsChanged = func() { changes++ }
+	_, cidr, _ := net.ParseCIDR("1.2.0.0/16")
+	err = podManager.Start(tmpDir, "1.2.3.0/24", []common.ParsedClusterNetworkEntry{{ClusterCIDR: cidr, HostSubnetLength: 8}}, "172.30.0.0/16")
+	if err != nil {
+		t.Fatalf("could not start PodManager: %v", err)
+	}
+
+	for _, name := range []string{"pod1", "pod2"} {
+		podTester.addExpectedPod(t, &operation{command: cniserver.CNI_ADD, namespace: "ns", name: name, cidr: "1.2.3.4/24"})
+		podTester.addExpectedPod(t, &operation{command: cniserver.CNI_DEL, namespace: "ns", name: name})
+	}
+	request := func(command cniserver.CNICommand, name string, expectedChanges int) {
+		t.Helper()
+		_, err := podManager.handleCNIRequest(&cniserver.PodRequest{
+			Command:      command,
+			PodNamespace: "ns",
+			PodName:      name,
+			SandboxID:    "sandbox-" + name,
+			Result:       make(chan *cniserver.PodResult),
+		})
+		if err != nil {
+			t.Fatalf("unexpected error for %s %s: %v", command, name, err)
+		}
+		if changes != expectedChanges {
+			t.Fatalf("expected %d local VNID changes after %s %s, got %d", expectedChanges, command, name, changes)
+		}
+	}
+
+	// Only the first pod of the VNID to start, and the last to stop, matter
+	request(cniserver.CNI_ADD, "pod1", 1)
+	request(cniserver.CNI_ADD, "pod2", 1)
+	request(cniserver.CNI_DEL, "pod1", 1)
+	request(cniserver.CNI_DEL, "pod2", 2)
+}
+
+// slowPodTester is a podTester whose setups take a while, and which tracks how many
+// of them run at once
+type slowPodTester struct {
+	*podTester
+
+	lock        sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (spt *slowPodTester) setup(req *cniserver.PodRequest) (cnitypes.Result, *runningPod, error) {
+	spt.lock.Lock()
+	spt.inFlight++
+	if spt.inFlight > spt.maxInFlight {
+		spt.maxInFlight = spt.inFlight
+	}
+	spt.lock.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	spt.lock.Lock()
+	defer spt.lock.Unlock()
+	spt.inFlight--
+	return spt.podTester.setup(req)
+}
+
+func TestReattachPods(t *testing.T) {
+	tmpDir, err := utiltesting.MkTmpdir("cniserver")
+	if err != nil {
+		t.Fatalf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := filepath.Join(tmpDir, cniserver.CNIServerSocketName)
+
+	podTester := &slowPodTester{podTester: newPodTester(t, "reattach", socketPath)}
+	podManager := newDefaultPodManager()
+	podManager.podHandler = podTester
+	_, cidr, _ := net.ParseCIDR("1.2.0.0/16")
+	err = podManager.Start(tmpDir, "1.2.3.0/24", []common.ParsedClusterNetworkEntry{{ClusterCIDR: cidr, HostSubnetLength: 8}}, "172.30.0.0/16")
+	if err != nil {
+		t.Fatalf("could not start PodManager: %v", err)
+	}
+
+	var reqs []*cniserver.PodRequest
+	for i := 0; i < 6; i++ {
+		op := &operation{command: cniserver.CNI_ADD, namespace: "ns", name: fmt.Sprintf("pod%d", i), cidr: fmt.Sprintf("1.2.3.%d/24", i+2)}
+		if i == 4 {
+			op.failStr = "veth is gone"
+		}
+		podTester.addExpectedPod(t, op)
+		reqs = append(reqs, &cniserver.PodRequest{
+			Command:      cniserver.CNI_ADD,
+			PodNamespace: op.namespace,
+			PodName:      op.name,
+			SandboxID:    "sandbox-" + op.name,
+			AssignedIP:   strings.Split(op.cidr, "/")[0],
+			Result:       make(chan *cniserver.PodResult),
+		})
+	}
+	podTester.addExpectedPod(t, &operation{command: cniserver.CNI_DEL, namespace: "ns", name: "other"})
+
+	// A request from the CNI server while the pods are being reattached has to
+	// wait until they are done
+	delDone := make(chan time.Time)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, err := podManager.handleCNIRequest(&cniserver.PodRequest{
+			Command:      cniserver.CNI_DEL,
+			PodNamespace: "ns",
+			PodName:      "other",
+			SandboxID:    "sandbox-other",
+			Result:       make(chan *cniserver.PodResult),
+		})
+		if err != nil {
+			t.Errorf("unexpected error deleting pod: %v", err)
+		}
+		delDone <- time.Now()
+	}()
+
+	failed := podManager.reattachPods(reqs, 3)
+	reattachDone := time.Now()
+	if len(failed) != 1 || failed["sandbox-pod4"] == nil {
+		t.Fatalf("expected only pod4 to fail, got %v", failed)
+	}
+	if podTester.maxInFlight != 3 {
+		t.Fatalf("expected 3 pods to be set up at once, got %d", podTester.maxInFlight)
+	}
+	if count := podManager.runningPodCount(); count != 5 {
+		t.Fatalf("expected 5 running pods, got %d", count)
+	}
+	if delTime := <-delDone; delTime.Before(reattachDone) {
+		t.Fatalf("CNI request was processed while pods were being reattached")
+	}
+}
+
+func TestGetIPAMAllocations(t *testing.T) {
+	tmpDir, err := utiltesting.MkTmpdir("ipam")
+	if err != nil {
+		t.Fatalf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	allocations, err := getIPAMAllocations(filepath.Join(tmpDir, "missing"))
+	if err != nil || len(allocations) != 0 {
+		t.Fatalf("unexpected result for missing directory: %v, %v", allocations, err)
+	}
+
+	files := map[string]string{
+		"10.128.0.5":         "sandbox1",
+		"10.128.0.6":         "sandbox2\r\neth0",
+		"fd01:0:0:5::6":      "sandbox2\r\neth0",
+		"last_reserved_ip.0": "10.128.0.6",
+		"lock":               "",
+		"10.128.0.7":         "",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(tmpDir, "fd01:0:0:5::6"), old, old); err != nil {
+		t.Fatalf("failed to set time: %v", err)
+	}
+	allocations, err = getIPAMAllocations(tmpDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ids := sets.StringKeySet(allocations); !ids.Equal(sets.NewString("sandbox1", "sandbox2")) {
+		t.Fatalf("unexpected sandbox IDs %v", ids.List())
+	}
+	// A dual-stack sandbox was allocated when its first address was
+	if !allocations["sandbox2"].Equal(old) {
+		t.Fatalf("unexpected allocation time %v for sandbox2", allocations["sandbox2"])
+	}
+}
+
+func TestGetPodDNS(t *testing.T) {
+	podManager := newDefaultPodManager()
+	if dns := podManager.getPodDNS("ns1"); !reflect.DeepEqual(dns, cnitypes.DNS{}) {
+		t.Fatalf("unexpected DNS configuration without cluster DNS: %#v", dns)
+	}
+
+	podManager.clusterDNS = []string{"172.30.0.10"}
+	podManager.clusterDomain = "cluster.local."
+	expected := cnitypes.DNS{
+		Nameservers: []string{"172.30.0.10"},
+		Domain:      "cluster.local",
+		Search:      []string{"ns1.svc.cluster.local", "svc.cluster.local", "cluster.local"},
+		Options:     []string{"ndots:5"},
+	}
+	if dns := podManager.getPodDNS("ns1"); !reflect.DeepEqual(dns, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, dns)
+	}
+
+	podManager.clusterDomain = ""
+	expected = cnitypes.DNS{
+		Nameservers: []string{"172.30.0.10"},
+		Options:     []string{"ndots:5"},
+	}
+	if dns := podManager.getPodDNS("ns1"); !reflect.DeepEqual(dns, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, dns)
+	}
+}
+
+func TestStageTimings(t *testing.T) {
+	// Stages run without stageTimings are just traced
+	if err := traceStage(context.Background(), "ipam", func(context.Context) error { return nil }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, timings := withStageTimings(context.Background())
+	for i := 0; i < 2; i++ {
+		_ = traceStage(ctx, "ovs-flows", func(context.Context) error {
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		})
+	}
+	err := traceStage(ctx, "ipam", func(context.Context) error { return fmt.Errorf("failed") })
+	if err == nil {
+		t.Fatalf("expected stage error to be returned")
+	}
+
+	if len(timings) != 2 {
+		t.Fatalf("expected 2 stages, got %v", timings)
+	}
+	if timings["ovs-flows"] < 20*time.Millisecond {
+		t.Fatalf("expected repeated stage durations to add up, got %v", timings["ovs-flows"])
+	}
+}
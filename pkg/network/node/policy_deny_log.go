@@ -0,0 +1,290 @@
+package node
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	// DenyLoggingAnnotation, when set to "true" on a Namespace, causes traffic to
+	// pods in that namespace that is dropped by NetworkPolicy to be punted to the
+	// node and logged.
+	DenyLoggingAnnotation = "network.openshift.io/policy-deny-logging"
+
+	// denyLogAction is the OVS action used in place of "drop" for namespaces with
+	// deny logging enabled. Only the packet headers are sent up from the datapath,
+	// and denyLogMeter drops any packets beyond denyLogMeterRate rather than
+	// sending them to ovs-vswitchd.
+	denyLogAction = "meter:1,controller(max_len=128)"
+
+	denyLogMeter     = 1
+	denyLogMeterRate = 100
+
+	// Per-namespace rate limit for deny log messages. Packets beyond this rate are
+	// still dropped, just not logged.
+	denyLogQPS   = 1.0
+	denyLogBurst = 10
+)
+
+// deniedPacket is the parsed form of a packet-in generated by a deny-logging flow
+type deniedPacket struct {
+	table    int
+	srcVNID  uint32
+	dstVNID  uint32
+	protocol string
+	srcIP    string
+	dstIP    string
+	srcPort  string
+	dstPort  string
+}
+
+// policyDenyLogger monitors br0 for packets punted to the controller by the
+// NetworkPolicy deny-logging flows and logs them with pod/namespace context
+type policyDenyLogger struct {
+	np *networkPolicyPlugin
+
+	limitersLock sync.Mutex
+	limiters     map[uint32]flowcontrol.RateLimiter
+
+	stopCh chan struct{}
+}
+
+func newPolicyDenyLogger(np *networkPolicyPlugin) *policyDenyLogger {
+	return &policyDenyLogger{
+		np:       np,
+		limiters: make(map[uint32]flowcontrol.RateLimiter),
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// Start creates denyLogMeter (which must exist before any flow uses
+// denyLogAction) and starts monitoring denied packets
+func (dl *policyDenyLogger) Start() error {
+	if err := dl.np.node.oc.ovs.SetMeter(denyLogMeter, denyLogMeterRate); err != nil {
+		return fmt.Errorf("could not create deny logging meter: %v", err)
+	}
+	go utilwait.Until(dl.monitor, 10*time.Second, dl.stopCh)
+	return nil
+}
+
+// Stop stops monitoring denied packets
+func (dl *policyDenyLogger) Stop() {
+	close(dl.stopCh)
+}
+
+// startDenyLoggerLocked starts np's deny logger, if it isn't running yet. Must be
+// called with the lock held.
+func (np *networkPolicyPlugin) startDenyLoggerLocked() {
+	if np.denyLogger != nil {
+		return
+	}
+	denyLogger := newPolicyDenyLogger(np)
+	if err := denyLogger.Start(); err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	np.denyLogger = denyLogger
+}
+
+// stopDenyLogger stops np's deny logger, if it was started
+func (np *networkPolicyPlugin) stopDenyLogger() {
+	np.lock.Lock()
+	defer np.lock.Unlock()
+	if np.denyLogger != nil {
+		np.denyLogger.Stop()
+		np.denyLogger = nil
+	}
+}
+
+// monitor runs "ovs-ofctl monitor" until it exits, logging each denied packet
+func (dl *policyDenyLogger) monitor() {
+	cmd := dl.np.node.execer.Command("ovs-ofctl", "-O", "OpenFlow13", "monitor", Br0, "65534", "-P", "nxt_packet_in")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not monitor denied packets: %v", err))
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not monitor denied packets: %v", err))
+		return
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-dl.stopCh:
+			cmd.Stop()
+		case <-done:
+		}
+	}()
+
+	var header string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.Contains(line, "PACKET_IN") {
+			header = line
+			continue
+		}
+		if header == "" || line == "" {
+			continue
+		}
+		pkt, err := parseDeniedPacket(header, line)
+		header = ""
+		if err != nil {
+			klog.V(5).Infof("Ignoring packet-in: %v", err)
+			continue
+		}
+		dl.log(pkt)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		select {
+		case <-dl.stopCh:
+		default:
+			utilruntime.HandleError(fmt.Errorf("denied packet monitor exited: %v", err))
+		}
+	}
+}
+
+// parseDeniedPacket parses the two lines that ovs-ofctl prints for a packet-in; eg:
+//
+//	NXT_PACKET_IN2 (OF1.3) (xid=0x0): table_id=80 cookie=0x0 total_len=74 reg0=0x5,reg1=0x6,reg2=0x3,in_port=2 (via action) data_len=74 (unbuffered)
+//	tcp,vlan_tci=0x0000,dl_src=0a:58:0a:80:00:05,dl_dst=0a:58:0a:80:00:06,nw_src=10.128.0.5,nw_dst=10.128.0.6,nw_tos=0,nw_ecn=0,nw_ttl=64,tp_src=43210,tp_dst=8080,tcp_flags=syn tcp_csum:1c3f
+func parseDeniedPacket(header, packet string) (*deniedPacket, error) {
+	pkt := &deniedPacket{table: -1}
+
+	for _, word := range strings.FieldsFunc(header, func(r rune) bool { return r == ' ' || r == ',' }) {
+		kv := strings.SplitN(word, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "table_id":
+			table, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("bad table_id %q", kv[1])
+			}
+			pkt.table = table
+		case "reg0", "reg1":
+			vnid, err := strconv.ParseUint(kv[1], 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad %s %q", kv[0], kv[1])
+			}
+			if kv[0] == "reg0" {
+				pkt.srcVNID = uint32(vnid)
+			} else {
+				pkt.dstVNID = uint32(vnid)
+			}
+		}
+	}
+	if pkt.table != 80 {
+		return nil, fmt.Errorf("packet-in from unexpected table %d", pkt.table)
+	}
+
+	fields := strings.Fields(packet)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty packet description")
+	}
+	for i, field := range strings.Split(fields[0], ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			if i == 0 {
+				pkt.protocol = field
+			}
+			continue
+		}
+		switch kv[0] {
+		case "nw_src", "ipv6_src":
+			pkt.srcIP = kv[1]
+		case "nw_dst", "ipv6_dst":
+			pkt.dstIP = kv[1]
+		case "tp_src":
+			pkt.srcPort = kv[1]
+		case "tp_dst":
+			pkt.dstPort = kv[1]
+		}
+	}
+	if pkt.srcIP == "" || pkt.dstIP == "" {
+		return nil, fmt.Errorf("packet-in %q is not IP", packet)
+	}
+
+	return pkt, nil
+}
+
+func (dl *policyDenyLogger) allow(vnid uint32) bool {
+	dl.limitersLock.Lock()
+	defer dl.limitersLock.Unlock()
+
+	limiter := dl.limiters[vnid]
+	if limiter == nil {
+		limiter = flowcontrol.NewTokenBucketRateLimiter(denyLogQPS, denyLogBurst)
+		dl.limiters[vnid] = limiter
+	}
+	return limiter.TryAccept()
+}
+
+func (dl *policyDenyLogger) log(pkt *deniedPacket) {
+	if cl := dl.np.node.connectionLogger; cl != nil {
+		cl.logDenied(pkt)
+	}
+	// With the connection log enabled, all namespaces' denied traffic is punted,
+	// but only that of the namespaces with DenyLoggingAnnotation is logged here
+	if !dl.np.denyLoggingEnabled(pkt.dstVNID) || !dl.allow(pkt.dstVNID) {
+		return
+	}
+
+	src := dl.describeEndpoint(pkt.srcVNID, pkt.srcIP, pkt.srcPort)
+	dst := dl.describeEndpoint(pkt.dstVNID, pkt.dstIP, pkt.dstPort)
+	klog.Infof("NetworkPolicy denied %s traffic from %s to %s", pkt.protocol, src, dst)
+}
+
+// describeEndpoint returns a string identifying the pod with the given IP, if it can
+// be found, along with its namespace and VNID.
+func (dl *policyDenyLogger) describeEndpoint(vnid uint32, ip, port string) string {
+	addr := ip
+	if port != "" {
+		addr = fmt.Sprintf("%s:%s", ip, port)
+	}
+
+	namespaces := dl.np.GetNamespaces(vnid)
+	for _, namespace := range namespaces {
+		pods, err := dl.np.node.kubeInformers.Core().V1().Pods().Lister().Pods(namespace).List(labels.Everything())
+		if err != nil {
+			continue
+		}
+		for _, pod := range pods {
+			if pod.Status.PodIP == ip && isOnPodNetwork(pod) {
+				return fmt.Sprintf("pod %s (%s, VNID %d)", getPodFullName(pod), addr, vnid)
+			}
+		}
+	}
+	if len(namespaces) == 1 {
+		return fmt.Sprintf("%s (namespace %s, VNID %d)", addr, namespaces[0], vnid)
+	}
+	return fmt.Sprintf("%s (VNID %d)", addr, vnid)
+}
+
+// denyLoggingEnabled returns whether the namespace with vnid has DenyLoggingAnnotation
+func (np *networkPolicyPlugin) denyLoggingEnabled(vnid uint32) bool {
+	np.lock.Lock()
+	defer np.lock.Unlock()
+	npns := np.namespaces[vnid]
+	return npns != nil && npns.denyLogging
+}
+
+func denyLoggingEnabled(ns *corev1.Namespace) bool {
+	return ns.Annotations[DenyLoggingAnnotation] == "true"
+}
@@ -0,0 +1,137 @@
+package node
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/utils/exec"
+	fakeexec "k8s.io/utils/exec/testing"
+)
+
+// stoppableFakeCmd is a FakeCmd whose output ends when it is stopped
+type stoppableFakeCmd struct {
+	*fakeexec.FakeCmd
+	stdout  *io.PipeWriter
+	stopped chan struct{}
+}
+
+func (cmd *stoppableFakeCmd) Stop() {
+	cmd.stdout.Close()
+	close(cmd.stopped)
+}
+
+func TestPolicyDenyLoggerStartStop(t *testing.T) {
+	_, oc, _ := setupOVSController(t)
+	stdoutReader, stdoutWriter := io.Pipe()
+	cmd := &stoppableFakeCmd{
+		FakeCmd: &fakeexec.FakeCmd{StdoutPipeResponse: fakeexec.FakeStdIOPipeResponse{ReadCloser: stdoutReader}},
+		stdout:  stdoutWriter,
+		stopped: make(chan struct{}),
+	}
+	started := make(chan struct{})
+	execer := &fakeexec.FakeExec{
+		CommandScript: []fakeexec.FakeCommandAction{
+			func(cmdName string, args ...string) exec.Cmd {
+				close(started)
+				return cmd
+			},
+		},
+	}
+	np := &networkPolicyPlugin{node: &OsdnNode{oc: oc, execer: execer}}
+
+	otx := oc.NewTransaction()
+	otx.AddFlow("table=80, priority=50, reg1=42, actions=%s", denyLogAction)
+	if err := otx.Commit(); err == nil {
+		t.Fatalf("unexpectedly added deny logging flow without meter")
+	}
+
+	dl := newPolicyDenyLogger(np)
+	if err := dl.Start(); err != nil {
+		t.Fatalf("unexpected error starting deny logger: %v", err)
+	}
+	otx = oc.NewTransaction()
+	otx.AddFlow("table=80, priority=50, reg1=42, actions=%s", denyLogAction)
+	if err := otx.Commit(); err != nil {
+		t.Fatalf("unexpected error adding deny logging flow: %v", err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(utilwait.ForeverTestTimeout):
+		t.Fatalf("monitor was not started")
+	}
+	dl.Stop()
+	select {
+	case <-cmd.stopped:
+	case <-time.After(utilwait.ForeverTestTimeout):
+		t.Fatalf("monitor command was not stopped")
+	}
+}
+
+func TestParseDeniedPacket(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		packet string
+		result *deniedPacket
+	}{
+		{
+			name:   "TCP",
+			header: "NXT_PACKET_IN2 (OF1.3) (xid=0x0): table_id=80 cookie=0x0 total_len=74 reg0=0x5,reg1=0x6,reg2=0x3,in_port=2 (via action) data_len=74 (unbuffered)",
+			packet: "tcp,vlan_tci=0x0000,dl_src=0a:58:0a:80:00:05,dl_dst=0a:58:0a:80:00:06,nw_src=10.128.0.5,nw_dst=10.128.0.6,nw_tos=0,nw_ecn=0,nw_ttl=64,tp_src=43210,tp_dst=8080,tcp_flags=syn tcp_csum:1c3f",
+			result: &deniedPacket{
+				table:    80,
+				srcVNID:  5,
+				dstVNID:  6,
+				protocol: "tcp",
+				srcIP:    "10.128.0.5",
+				dstIP:    "10.128.0.6",
+				srcPort:  "43210",
+				dstPort:  "8080",
+			},
+		},
+		{
+			name:   "ICMP",
+			header: "NXT_PACKET_IN2 (OF1.3) (xid=0x0): table_id=80 cookie=0x0 total_len=98 reg1=0x2a,reg2=0x3,in_port=2 (via action) data_len=98 (unbuffered)",
+			packet: "icmp,vlan_tci=0x0000,dl_src=0a:58:0a:80:00:05,dl_dst=0a:58:0a:80:00:06,nw_src=10.128.0.5,nw_dst=10.128.0.6,nw_tos=0,nw_ecn=0,nw_ttl=64,icmp_type=8,icmp_code=0 icmp_csum:4227",
+			result: &deniedPacket{
+				table:    80,
+				srcVNID:  0,
+				dstVNID:  42,
+				protocol: "icmp",
+				srcIP:    "10.128.0.5",
+				dstIP:    "10.128.0.6",
+			},
+		},
+		{
+			name:   "wrong table",
+			header: "NXT_PACKET_IN2 (OF1.3) (xid=0x0): table_id=40 cookie=0x0 total_len=42 in_port=2 (via action) data_len=42 (unbuffered)",
+			packet: "arp,vlan_tci=0x0000,dl_src=0a:58:0a:80:00:05,dl_dst=ff:ff:ff:ff:ff:ff,arp_spa=10.128.0.5,arp_tpa=10.128.0.1,arp_op=1",
+			result: nil,
+		},
+		{
+			name:   "not IP",
+			header: "NXT_PACKET_IN2 (OF1.3) (xid=0x0): table_id=80 cookie=0x0 total_len=42 in_port=2 (via action) data_len=42 (unbuffered)",
+			packet: "arp,vlan_tci=0x0000,dl_src=0a:58:0a:80:00:05,dl_dst=ff:ff:ff:ff:ff:ff,arp_spa=10.128.0.5,arp_tpa=10.128.0.1,arp_op=1",
+			result: nil,
+		},
+	}
+
+	for _, test := range tests {
+		pkt, err := parseDeniedPacket(test.header, test.packet)
+		if test.result == nil {
+			if err == nil {
+				t.Errorf("%s: expected error, got %#v", test.name, pkt)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !reflect.DeepEqual(pkt, test.result) {
+			t.Errorf("%s: expected %#v, got %#v", test.name, test.result, pkt)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package node
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/labels"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+)
+
+// Resync rewrites all of the node's OVS flows and iptables rules from its caches:
+// the static flows, and the flows of HostSubnets, pods, multicast (including grants
+// and the multicast gateway), services (including loadBalancerSourceRanges),
+// NetworkPolicies, EgressNetworkPolicies (including their Service destinations and
+// exempt nodes) and egress IPs. Unlike Reconcile, it rewrites everything whether or
+// not it appears to be up to date, to recover from suspected drift (eg, after flows
+// were modified by hand) without restarting. (Flows that shouldn't exist at all are
+// only removed if Reconcile would remove them.)
+func (node *OsdnNode) Resync() error {
+	if node.isTornDown() {
+		return fmt.Errorf("node has been torn down for migration")
+	}
+	klog.Infof("Starting full resync of OVS flows and iptables rules")
+
+	var errs []error
+	if err := node.resyncStaticFlows(); err != nil {
+		errs = append(errs, fmt.Errorf("could not resync static OVS flows: %v", err))
+	}
+	if node.hsw != nil {
+		if err := node.hsw.resync(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if node.multicastGateway != nil {
+		if err := node.oc.SetMulticastGatewayGroups(node.multicastGateway.groups); err != nil {
+			errs = append(errs, fmt.Errorf("could not resync multicast gateway OVS flows: %v", err))
+		}
+	}
+	if err := node.podManager.resyncPodFlows(); err != nil {
+		errs = append(errs, fmt.Errorf("could not resync pod OVS flows: %v", err))
+	}
+	if err := node.resyncServiceFlows(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := node.resyncLoadBalancerSourceRangeRules(); err != nil {
+		errs = append(errs, err)
+	}
+	node.resyncHairpinRules()
+
+	node.policy.SyncVNIDRules()
+	node.policy.ResyncVNIDRules()
+	if node.policy.SupportsVNIDs() {
+		node.egressPoliciesLock.Lock()
+		var vnids []uint32
+		for vnid := range node.egressPolicies {
+			vnids = append(vnids, vnid)
+		}
+		node.updateEgressNetworkPolicyRules(vnids...)
+		node.egressPoliciesLock.Unlock()
+		if node.egressExemptions != nil {
+			node.syncEgressFirewallExemptions(true)
+		}
+		node.egressIP.Resync()
+	}
+
+	if err := node.nodeIPTables.syncIPTableRules(); err != nil {
+		errs = append(errs, fmt.Errorf("could not sync iptables rules: %v", err))
+	}
+
+	if len(errs) > 0 {
+		return kerrors.NewAggregate(errs)
+	}
+	klog.Infof("Finished full resync of OVS flows and iptables rules")
+	return nil
+}
+
+// resyncLoadBalancerSourceRangeRules rewrites the loadBalancerSourceRanges flows of
+// every service
+func (node *OsdnNode) resyncLoadBalancerSourceRangeRules() error {
+	services, err := node.kubeInformers.Core().V1().Services().Lister().List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("could not list services: %v", err)
+	}
+	if err := node.oc.ResyncLoadBalancerSourceRangeRules(services); err != nil {
+		return fmt.Errorf("could not resync loadBalancerSourceRanges OVS flows: %v", err)
+	}
+	return nil
+}
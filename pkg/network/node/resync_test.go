@@ -0,0 +1,266 @@
+package node
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/kubernetes/pkg/util/iptables"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+func TestResyncFlows(t *testing.T) {
+	ovsif, oc, _ := setupOVSController(t)
+	mp := NewMultiTenantPlugin().(*multiTenantPlugin)
+	_, serviceNetwork, _ := net.ParseCIDR("172.30.0.0/16")
+	node := &OsdnNode{
+		oc:               oc,
+		policy:           mp,
+		podManager:       newDefaultPodManager(),
+		localVNIDs:       newLocalVNIDs(),
+		hairpin:          newHairpinServices(),
+		networkInfo:      &common.ParsedClusterNetwork{ServiceNetwork: serviceNetwork, VXLANPort: 4789},
+		clusterCIDRs:     []string{"10.128.0.0/14"},
+		localSubnetCIDR:  "10.128.0.0/23",
+		localGatewayCIDR: "10.128.0.1/23",
+	}
+	mp.node = node
+	mp.vnids = newNodeVNIDMap(mp, nil)
+	mp.vnidInUse = oc.FindPolicyVNIDs()
+	mp.vnids.setVNID("alpha", 11, false)
+	node.podManager.ovs = oc
+	node.podManager.policy = mp
+
+	if _, err := oc.SetUpPod(context.TODO(), "pod1", "veth1", net.ParseIP("10.128.0.2"), nil, 11); err != nil {
+		t.Fatalf("unexpected error setting up pod: %v", err)
+	}
+	node.podManager.runningPods["alpha/pod1"] = &runningPod{vnid: 11, ofport: 3}
+	mp.EnsureVNIDRules(11)
+	node.updateLocalVNIDs()
+	node.AddServiceRules(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "alpha", Name: "svc"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "172.30.0.5",
+			Ports:     []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80}},
+		},
+	}, 11)
+	node.kubeInformers = informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	lbService := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "alpha", Name: "lb"},
+		Spec: corev1.ServiceSpec{
+			Type:                     corev1.ServiceTypeLoadBalancer,
+			ClusterIP:                "172.30.0.6",
+			Ports:                    []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 443}},
+			LoadBalancerSourceRanges: []string{"192.168.0.0/16"},
+		},
+		Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{IP: "1.2.3.4"}}}},
+	}
+	if err := node.kubeInformers.Core().V1().Services().Informer().GetStore().Add(lbService); err != nil {
+		t.Fatalf("unexpected error adding service: %v", err)
+	}
+	if err := oc.AddLoadBalancerSourceRangeRules(lbService); err != nil {
+		t.Fatalf("unexpected error adding loadBalancerSourceRanges flows: %v", err)
+	}
+
+	hsw := newHostSubnetWatcher(oc, "node0", oc.localIP, node.networkInfo)
+	node.hsw = hsw
+	if err := hsw.updateHostSubnet(makeHostSubnet("node1", "192.168.1.2", "10.129.0.0/23")); err != nil {
+		t.Fatalf("unexpected error adding HostSubnet: %v", err)
+	}
+
+	dumpFlows := func() []string {
+		flows, err := ovsif.DumpFlows("")
+		if err != nil {
+			t.Fatalf("unexpected error dumping flows: %v", err)
+		}
+		sort.Strings(flows)
+		return flows
+	}
+	expected := dumpFlows()
+
+	// Delete every flow from the tables with static, HostSubnet, pod, service, and
+	// policy flows
+	otx := ovsif.NewTransaction()
+	for _, table := range []int{0, 10, 20, 30, 40, 50, 60, 70, 80, 90} {
+		otx.DeleteFlows("table=%d", table)
+	}
+	if err := otx.Commit(); err != nil {
+		t.Fatalf("unexpected error deleting flows: %v", err)
+	}
+	if reflect.DeepEqual(dumpFlows(), expected) {
+		t.Fatalf("flows were not deleted")
+	}
+
+	if err := node.resyncStaticFlows(); err != nil {
+		t.Fatalf("unexpected error resyncing static flows: %v", err)
+	}
+	if err := hsw.resync(); err != nil {
+		t.Fatalf("unexpected error resyncing HostSubnet flows: %v", err)
+	}
+	if err := node.podManager.resyncPodFlows(); err != nil {
+		t.Fatalf("unexpected error resyncing pod flows: %v", err)
+	}
+	if err := node.resyncServiceFlows(); err != nil {
+		t.Fatalf("unexpected error resyncing service flows: %v", err)
+	}
+	if err := node.resyncLoadBalancerSourceRangeRules(); err != nil {
+		t.Fatalf("unexpected error resyncing loadBalancerSourceRanges flows: %v", err)
+	}
+	mp.ResyncVNIDRules()
+
+	if flows := dumpFlows(); !reflect.DeepEqual(flows, expected) {
+		t.Fatalf("flows not restored by resync:\nexpected:\n%v\ngot:\n%v", expected, flows)
+	}
+}
+
+// countingIPTables is an iptables.Interface that counts the chains ensured by
+// syncIPTableRules
+type countingIPTables struct {
+	iptables.Interface
+	lock   sync.Mutex
+	chains int
+}
+
+func (ipt *countingIPTables) EnsureChain(table iptables.Table, chain iptables.Chain) (bool, error) {
+	ipt.lock.Lock()
+	defer ipt.lock.Unlock()
+	ipt.chains++
+	return false, nil
+}
+
+func (ipt *countingIPTables) EnsureRule(position iptables.RulePosition, table iptables.Table, chain iptables.Chain, args ...string) (bool, error) {
+	return false, nil
+}
+
+func (ipt *countingIPTables) chainsEnsured() int {
+	ipt.lock.Lock()
+	defer ipt.lock.Unlock()
+	return ipt.chains
+}
+
+// countingPolicy is a multiTenantPlugin that counts calls to SyncVNIDRules
+type countingPolicy struct {
+	*multiTenantPlugin
+	syncs int32
+}
+
+func (cp *countingPolicy) SyncVNIDRules() {
+	atomic.AddInt32(&cp.syncs, 1)
+	cp.multiTenantPlugin.SyncVNIDRules()
+}
+
+// setupReconcileNode returns an OsdnNode with policy rules for VNID 11 but no pods
+// using it
+func setupReconcileNode(t *testing.T, reconcilePeriod time.Duration) (*OsdnNode, *countingPolicy, *countingIPTables, func() bool) {
+	ovsif, oc, _ := setupOVSController(t)
+	ipt := &countingIPTables{}
+	mp := NewMultiTenantPlugin().(*multiTenantPlugin)
+	cp := &countingPolicy{multiTenantPlugin: mp}
+	node := &OsdnNode{
+		oc:              oc,
+		policy:          cp,
+		nodeIPTables:    newNodeIPTables(ipt, []string{"10.128.0.0/14"}, false, 4789, 0, nil),
+		reconcilePeriod: reconcilePeriod,
+	}
+	mp.node = node
+	mp.vnids = newNodeVNIDMap(mp, nil)
+	mp.vnidInUse = oc.FindPolicyVNIDs()
+	mp.EnsureVNIDRules(11)
+
+	hasVNIDFlow := func() bool {
+		flows, err := ovsif.DumpFlows("table=80")
+		if err != nil {
+			t.Fatalf("unexpected error dumping flows: %v", err)
+		}
+		for _, flow := range flows {
+			if strings.Contains(flow, "reg0=11") {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasVNIDFlow() {
+		t.Fatalf("VNID 11 policy flow was not added")
+	}
+	return node, cp, ipt, hasVNIDFlow
+}
+
+// runReconcileLoop runs node.runPeriodicReconcile until cp.SyncVNIDRules has been
+// called at least twice, and then stops it
+func runReconcileLoop(t *testing.T, node *OsdnNode, cp *countingPolicy) {
+	stopCh := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		node.runPeriodicReconcile(stopCh)
+		close(stopped)
+	}()
+	err := utilwait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return atomic.LoadInt32(&cp.syncs) >= 2, nil
+	})
+	close(stopCh)
+	<-stopped
+	if err != nil {
+		t.Fatalf("unused VNIDs were not synced periodically")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	node, _, ipt, hasVNIDFlow := setupReconcileNode(t, 0)
+
+	node.tornDown = true
+	if err := node.Reconcile(); err == nil {
+		t.Fatalf("unexpected success reconciling torn-down node")
+	}
+	if !hasVNIDFlow() || ipt.chainsEnsured() != 0 {
+		t.Fatalf("torn-down node was reconciled")
+	}
+
+	node.tornDown = false
+	if err := node.Reconcile(); err != nil {
+		t.Fatalf("unexpected error reconciling: %v", err)
+	}
+	if hasVNIDFlow() {
+		t.Fatalf("unused VNID flow was not removed")
+	}
+	if ipt.chainsEnsured() == 0 {
+		t.Fatalf("iptables rules were not synced")
+	}
+}
+
+func TestPeriodicReconcile(t *testing.T) {
+	node, cp, ipt, hasVNIDFlow := setupReconcileNode(t, 10*time.Millisecond)
+	runReconcileLoop(t, node, cp)
+	if hasVNIDFlow() {
+		t.Fatalf("unused VNID flow was not removed")
+	}
+	if ipt.chainsEnsured() < 2*len(node.nodeIPTables.getNodeIPTablesChains()) {
+		t.Fatalf("iptables rules were not synced periodically")
+	}
+}
+
+func TestPeriodicReconcileDisabled(t *testing.T) {
+	defer func(period time.Duration) { unusedVNIDCleanupPeriod = period }(unusedVNIDCleanupPeriod)
+	unusedVNIDCleanupPeriod = 10 * time.Millisecond
+
+	// The unused VNID flows are still cleaned up, but nothing else is reconciled
+	node, cp, ipt, hasVNIDFlow := setupReconcileNode(t, 0)
+	runReconcileLoop(t, node, cp)
+	if hasVNIDFlow() {
+		t.Fatalf("unused VNID flow was not removed with periodic reconciliation disabled")
+	}
+	if ipt.chainsEnsured() != 0 {
+		t.Fatalf("iptables rules were synced with periodic reconciliation disabled")
+	}
+}
@@ -0,0 +1,161 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/util/sysctl"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// routed returns true if pod traffic to some or all other nodes may be routed by
+// the node's network rather than encapsulated
+func (node *OsdnNode) routed() bool {
+	return node.encapsulations.Has(common.EncapsulationNone)
+}
+
+// publishHostSubnetAnnotations records the encapsulations other than VXLAN that the
+// node supports on its HostSubnet, in order of preference, for other nodes to
+// choose from (see common.HostSubnetEncapsulationsAnnotation)
+func (node *OsdnNode) publishHostSubnetAnnotations() {
+	var value interface{}
+	var encapsulations []string
+	for _, encap := range common.Encapsulations {
+		if encap != common.EncapsulationVXLAN && node.encapsulations.Has(encap) {
+			encapsulations = append(encapsulations, encap)
+		}
+	}
+	if len(encapsulations) > 0 {
+		value = strings.Join(encapsulations, ",")
+	}
+	// A null value removes the annotation
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				common.HostSubnetEncapsulationsAnnotation: value,
+			},
+		},
+	})
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Could not encode HostSubnet annotations: %v", err))
+		return
+	}
+	_, err = node.osdnClient.NetworkV1().HostSubnets().Patch(context.TODO(), node.hostName, ktypes.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Could not update encapsulations on HostSubnet %q: %v", node.hostName, err))
+		return
+	}
+	klog.Infof("Supported encapsulations: %s", strings.Join(node.encapsulations.List(), ", "))
+}
+
+// getHostSubnetRouter returns a function that says whether pod traffic to a remote
+// HostSubnet is routed rather than sent over VXLAN. With BGP, the node's network
+// knows the routes to every node's subnet. With native routing, only nodes on the
+// same network as this one can be reached without encapsulation, as the next hop
+// for their subnets.
+func (node *OsdnNode) getHostSubnetRouter() (func(hs *osdnv1.HostSubnet) bool, error) {
+	if len(node.bgpPeers) > 0 {
+		return func(*osdnv1.HostSubnet) bool { return true }, nil
+	}
+	_, localNet, err := GetLinkDetails(node.localIP)
+	if err != nil {
+		return nil, fmt.Errorf("could not find the network of node IP %s for native routing: %v", node.localIP, err)
+	}
+	return func(hs *osdnv1.HostSubnet) bool {
+		return localNet.Contains(net.ParseIP(hs.HostIP))
+	}, nil
+}
+
+// setupRoutedTun0 configures tun0 so that the node answers pods' ARP requests for
+// the IPs of pods on other nodes (which OVS sends to tun0 in routed mode) itself,
+// and then routes their traffic.
+func setupRoutedTun0() error {
+	sc := sysctl.New()
+	if err := sc.SetSysctl(fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", Tun0), 1); err != nil {
+		return fmt.Errorf("could not enable proxy ARP on %s: %v", Tun0, err)
+	}
+	// By default the kernel delays proxy ARP replies by up to 800ms
+	if err := sc.SetSysctl(fmt.Sprintf("net/ipv4/neigh/%s/proxy_delay", Tun0), 0); err != nil {
+		return fmt.Errorf("could not set proxy ARP delay on %s: %v", Tun0, err)
+	}
+	return nil
+}
+
+// removeStaleHostSubnetRoutes deletes the IPv4 routes to subnets of the cluster
+// network that don't go via tun0 (ie, the routes added by updateHostSubnetRoute)
+// other than those to the subnets in keep.
+func removeStaleHostSubnetRoutes(networkInfo *common.ParsedClusterNetwork, keep sets.String) error {
+	tun0, err := netlink.LinkByName(Tun0)
+	if err != nil {
+		return fmt.Errorf("could not find %s: %v", Tun0, err)
+	}
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("could not list routes: %v", err)
+	}
+	for _, route := range routes {
+		if route.Dst == nil || route.LinkIndex == tun0.Attrs().Index || keep.Has(route.Dst.String()) {
+			continue
+		}
+		for _, cn := range networkInfo.ClusterNetworks {
+			if !cn.ClusterCIDR.Contains(route.Dst.IP) {
+				continue
+			}
+			klog.Infof("Removing stale route to HostSubnet %s", route.Dst)
+			if err := netlink.RouteDel(&route); err != nil && err != syscall.ESRCH {
+				utilruntime.HandleError(fmt.Errorf("could not delete stale route to %s: %v", route.Dst, err))
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// updateHostSubnetRoute adds or deletes the route to a remote node's subnet in
+// routed mode. This goes via the same next hop as the route to the node itself:
+// the node, if it is on the same network, or else a router (which, with BGP, has
+// learned the subnet from the node). It is more specific than the route to the
+// cluster network via tun0.
+func updateHostSubnetRoute(subnet, hostIP string, add bool) error {
+	_, dst, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return err
+	}
+	if !add {
+		if err := netlink.RouteDel(&netlink.Route{Dst: dst}); err != nil && err != syscall.ESRCH {
+			return err
+		}
+		return nil
+	}
+
+	ip := net.ParseIP(hostIP)
+	routes, err := netlink.RouteGet(ip)
+	if err != nil {
+		return fmt.Errorf("could not get route to node %s: %v", hostIP, err)
+	} else if len(routes) == 0 {
+		return fmt.Errorf("no route to node %s", hostIP)
+	}
+	route := &netlink.Route{
+		LinkIndex: routes[0].LinkIndex,
+		Dst:       dst,
+		Gw:        routes[0].Gw,
+	}
+	if route.Gw == nil {
+		route.Gw = ip
+	}
+	return netlink.RouteReplace(route)
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"syscall"
 	"time"
 
 	"k8s.io/klog/v2"
@@ -11,7 +12,9 @@ import (
 	"github.com/openshift/sdn/pkg/network/common"
 
 	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
 	utilwait "k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/kubernetes/pkg/util/sysctl"
 
@@ -21,6 +24,10 @@ import (
 func (plugin *OsdnNode) alreadySetUp() error {
 	var found bool
 
+	if plugin.isTornDown() {
+		return nil
+	}
+
 	l, err := netlink.LinkByName(Tun0)
 	if err != nil {
 		return err
@@ -41,11 +48,28 @@ func (plugin *OsdnNode) alreadySetUp() error {
 		return errors.New("local subnet gateway CIDR not found")
 	}
 
+	if plugin.localGatewayIPv6CIDR != "" {
+		addrs, err := netlink.AddrList(l, netlink.FAMILY_V6)
+		if err != nil {
+			return err
+		}
+		found = false
+		for _, addr := range addrs {
+			if addr.IPNet.String() == plugin.localGatewayIPv6CIDR {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("local subnet IPv6 gateway CIDR not found")
+		}
+	}
+
 	routes, err := netlink.RouteList(l, netlink.FAMILY_V4)
 	if err != nil {
 		return err
 	}
-	for _, clusterCIDR := range plugin.clusterCIDRs {
+	for _, clusterCIDR := range plugin.getClusterCIDRs() {
 		found = false
 		for _, route := range routes {
 			if route.Dst != nil && route.Dst.String() == clusterCIDR {
@@ -58,8 +82,11 @@ func (plugin *OsdnNode) alreadySetUp() error {
 		}
 	}
 
-	if !plugin.oc.AlreadySetUp(plugin.networkInfo.VXLANPort) {
-		return errors.New("plugin is not setup")
+	outdated, err := plugin.oc.OutdatedFlowTables(plugin.networkInfo.VXLANPort)
+	if err != nil {
+		return fmt.Errorf("plugin is not setup: %v", err)
+	} else if outdated.Len() > 0 {
+		return &flowTablesOutdatedError{tables: outdated}
 	}
 
 	return nil
@@ -121,6 +148,25 @@ func (plugin *OsdnNode) SetupSDN() (bool, map[string]podNetworkInfo, error) {
 
 	plugin.localGatewayCIDR = fmt.Sprintf("%s/%d", localSubnetGateway, localSubnetMaskLength)
 
+	if plugin.localSubnetIPv6CIDR != "" {
+		val, err := sysctl.GetSysctl("net/ipv6/conf/all/forwarding")
+		if err != nil {
+			return false, nil, fmt.Errorf("could not get IPv6 forwarding state: %s", err)
+		}
+		if val != 1 {
+			return false, nil, fmt.Errorf("net/ipv6/conf/all/forwarding=0, it must be set to 1 in a dual-stack cluster")
+		}
+
+		_, ipnetV6, err := net.ParseCIDR(plugin.localSubnetIPv6CIDR)
+		if err != nil {
+			return false, nil, fmt.Errorf("invalid local subnet IPv6 CIDR: %v", err)
+		}
+		maskLengthV6, _ := ipnetV6.Mask.Size()
+		gatewayV6 := common.GenerateDefaultGateway(ipnetV6)
+		klog.V(5).Infof("[SDN setup] node pod IPv6 subnet %s gateway %s", ipnetV6.String(), gatewayV6.String())
+		plugin.localGatewayIPv6CIDR = fmt.Sprintf("%s/%d", gatewayV6.String(), maskLengthV6)
+	}
+
 	if err := waitForOVS(ovsDialDefaultNetwork, ovsDialDefaultAddress); err != nil {
 		return false, nil, err
 	}
@@ -131,15 +177,35 @@ func (plugin *OsdnNode) SetupSDN() (bool, map[string]podNetworkInfo, error) {
 		klog.Warningf("[SDN setup] Could not get details of existing pods: %v", err)
 	}
 
-	if err := plugin.alreadySetUp(); err == nil {
+	err = plugin.alreadySetUp()
+	if outdated, ok := err.(*flowTablesOutdatedError); ok {
+		klog.Infof("[SDN setup] %v; rebuilding them", err)
+		if err = plugin.rebuildFlowTables(outdated.tables, localSubnetCIDR, localSubnetGateway); err != nil {
+			klog.Warningf("[SDN setup] could not rebuild OVS tables: %v", err)
+		} else {
+			// The pods' flows in the rebuilt tables are restored by reattaching
+			// them; everything else is re-added by the informers at startup.
+			changed = outdated.tables.HasAny(podFlowTables.List()...)
+		}
+	} else if err == nil {
 		klog.Infof("[SDN setup] SDN is already set up")
-	} else {
+		plugin.oc.SetNetworks(plugin.getClusterCIDRs(), plugin.networkInfo.ServiceNetwork.String(), localSubnetGateway)
+	}
+	if err != nil {
 		klog.Infof("[SDN setup] full SDN setup required (%v)", err)
 		if err := plugin.setup(localSubnetCIDR, localSubnetGateway); err != nil {
 			return false, nil, err
 		}
 		changed = true
 	}
+	if !changed {
+		// Warm restart; see warm_restart.go
+		if owners, err := plugin.ovsCheckpoint.startWarmRestart(); err != nil {
+			klog.Warningf("[SDN setup] Could not check existing OVS flows; stale flows will not be removed: %v", err)
+		} else {
+			klog.Infof("[SDN setup] Keeping existing OVS flows; checking the flows of %d objects for staleness", owners)
+		}
+	}
 
 	return changed, existingPods, nil
 }
@@ -150,17 +216,96 @@ func (plugin *OsdnNode) FinishSetupSDN() error {
 		return err
 	}
 
-	// TODO: make it possible to safely reestablish node configuration after restart
-	// If OVS goes down and fails the health check, restart the entire process
-	runOVSHealthCheck(ovsDialDefaultNetwork, ovsDialDefaultAddress, plugin.alreadySetUp)
+	if err := plugin.ovsCheckpoint.snapshot(plugin.ovsSetUp); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Could not checkpoint OVS flows; OVS restarts will require restarting the node: %v", err))
+	}
+	go utilwait.Until(plugin.compactOVSCheckpoint, ovsCheckpointInterval, utilwait.NeverStop)
+
+	// If OVS restarts and loses its flows, restore them from the checkpoint. If that
+	// fails, restart the entire process.
+	runOVSHealthCheck(ovsDialDefaultNetwork, ovsDialDefaultAddress, plugin.alreadySetUp, plugin.restoreOVS)
 
 	return nil
 }
 
+func (plugin *OsdnNode) ovsSetUp() bool {
+	return plugin.oc.AlreadySetUp(plugin.networkInfo.VXLANPort)
+}
+
+// compactOVSCheckpoint replaces the OVS checkpoint with a fresh snapshot if there
+// have been any changes since it was taken, to keep the journal from growing
+// without bound.
+func (plugin *OsdnNode) compactOVSCheckpoint() {
+	if plugin.ovsCheckpoint.journalLength() == 0 {
+		return
+	}
+	if err := plugin.ovsCheckpoint.snapshot(plugin.ovsSetUp); err != nil {
+		klog.V(2).Infof("Could not update OVS checkpoint: %v", err)
+	}
+}
+
+// restoreOVS restores the node's OVS flows and tun0 configuration after OVS has
+// been restarted.
+func (plugin *OsdnNode) restoreOVS() error {
+	if err := plugin.ovsCheckpoint.restore(); err != nil {
+		return err
+	}
+	return plugin.restoreTun0()
+}
+
+// restoreTun0 re-adds tun0's addresses and routes, which are lost if OVS recreates
+// the interface when it restarts.
+func (plugin *OsdnNode) restoreTun0() error {
+	l, err := netlink.LinkByName(Tun0)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(l); err != nil {
+		return err
+	}
+
+	gwIP, err := netlink.ParseIPNet(plugin.localGatewayCIDR)
+	if err != nil {
+		return err
+	}
+	if err := netlink.AddrAdd(l, &netlink.Addr{IPNet: gwIP}); err == nil {
+		deleteLocalSubnetRoute(Tun0, plugin.localSubnetCIDR)
+	} else if err != syscall.EEXIST {
+		return fmt.Errorf("could not add gateway address to %s: %v", Tun0, err)
+	}
+	routes := []*netlink.Route{{LinkIndex: l.Attrs().Index, Dst: plugin.networkInfo.ServiceNetwork}}
+	for _, clusterNetwork := range plugin.networkInfo.ClusterNetworks {
+		routes = append(routes, &netlink.Route{LinkIndex: l.Attrs().Index, Scope: netlink.SCOPE_LINK, Dst: clusterNetwork.ClusterCIDR})
+	}
+
+	if plugin.localGatewayIPv6CIDR != "" {
+		gwIPv6, err := netlink.ParseIPNet(plugin.localGatewayIPv6CIDR)
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrAdd(l, &netlink.Addr{IPNet: gwIPv6, Flags: syscall.IFA_F_NODAD}); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("could not add IPv6 gateway address to %s: %v", Tun0, err)
+		}
+		for _, cn := range plugin.networkInfo.IPv6ClusterNetworks {
+			routes = append(routes, &netlink.Route{LinkIndex: l.Attrs().Index, Scope: netlink.SCOPE_LINK, Dst: cn.ClusterCIDR})
+		}
+	}
+
+	for _, route := range routes {
+		if err := netlink.RouteAdd(route); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("could not add route to %s: %v", route.Dst, err)
+		}
+	}
+	if plugin.routed() {
+		return setupRoutedTun0()
+	}
+	return nil
+}
+
 func (plugin *OsdnNode) setup(localSubnetCIDR, localSubnetGateway string) error {
 	serviceNetworkCIDR := plugin.networkInfo.ServiceNetwork.String()
 
-	if err := plugin.oc.SetupOVS(plugin.clusterCIDRs, serviceNetworkCIDR, localSubnetCIDR, localSubnetGateway, plugin.networkInfo.MTU, plugin.networkInfo.VXLANPort); err != nil {
+	if err := plugin.oc.SetupOVS(plugin.getClusterCIDRs(), serviceNetworkCIDR, localSubnetCIDR, localSubnetGateway, plugin.networkInfo.MTU, plugin.networkInfo.VXLANPort); err != nil {
 		return err
 	}
 
@@ -198,25 +343,138 @@ func (plugin *OsdnNode) setup(localSubnetCIDR, localSubnetGateway string) error
 		return err
 	}
 
+	if plugin.routed() {
+		if err := setupRoutedTun0(); err != nil {
+			return err
+		}
+	}
+	if plugin.localGatewayIPv6CIDR != "" {
+		return plugin.setupIPv6(l)
+	}
+	return nil
+}
+
+// rebuildFlowTables rebuilds the given OVS tables without recreating the bridge
+func (plugin *OsdnNode) rebuildFlowTables(tables sets.Int, localSubnetCIDR, localSubnetGateway string) error {
+	clusterCIDRsv6, gatewayv6, err := plugin.getIPv6FlowParams()
+	if err != nil {
+		return err
+	}
+	return plugin.oc.RebuildFlowTables(tables, plugin.getClusterCIDRs(), plugin.networkInfo.ServiceNetwork.String(), localSubnetCIDR, localSubnetGateway, plugin.networkInfo.VXLANPort,
+		clusterCIDRsv6, plugin.localSubnetIPv6CIDR, gatewayv6)
+}
+
+// resyncStaticFlows re-adds the flows that setup creates
+func (plugin *OsdnNode) resyncStaticFlows() error {
+	gwIP, err := netlink.ParseIPNet(plugin.localGatewayCIDR)
+	if err != nil {
+		return err
+	}
+	clusterCIDRsv6, gatewayv6, err := plugin.getIPv6FlowParams()
+	if err != nil {
+		return err
+	}
+	return plugin.oc.ResyncStaticFlows(plugin.getClusterCIDRs(), plugin.networkInfo.ServiceNetwork.String(), plugin.localSubnetCIDR, gwIP.IP.String(), plugin.networkInfo.VXLANPort,
+		clusterCIDRsv6, plugin.localSubnetIPv6CIDR, gatewayv6)
+}
+
+// getIPv6FlowParams returns the IPv6 cluster CIDRs and local gateway for the static
+// IPv6 flows, which are empty unless the cluster is dual-stack
+func (plugin *OsdnNode) getIPv6FlowParams() ([]string, string, error) {
+	if plugin.localGatewayIPv6CIDR == "" {
+		return nil, "", nil
+	}
+	gwIP, err := netlink.ParseIPNet(plugin.localGatewayIPv6CIDR)
+	if err != nil {
+		return nil, "", err
+	}
+	var clusterCIDRsv6 []string
+	for _, cn := range plugin.networkInfo.IPv6ClusterNetworks {
+		clusterCIDRsv6 = append(clusterCIDRsv6, cn.ClusterCIDR.String())
+	}
+	return clusterCIDRsv6, gwIP.IP.String(), nil
+}
+
+// setupIPv6 sets up OVS and tun0 for IPv6 pod traffic in a dual-stack cluster
+func (plugin *OsdnNode) setupIPv6(l netlink.Link) error {
+	gwIP, err := netlink.ParseIPNet(plugin.localGatewayIPv6CIDR)
+	if err != nil {
+		return err
+	}
+	var clusterCIDRs []string
+	for _, cn := range plugin.networkInfo.IPv6ClusterNetworks {
+		clusterCIDRs = append(clusterCIDRs, cn.ClusterCIDR.String())
+	}
+	if err := plugin.oc.SetupOVSIPv6(clusterCIDRs, plugin.localSubnetIPv6CIDR, gwIP.IP.String()); err != nil {
+		return err
+	}
+
+	// Unlike with IPv4, the kernel marks a new IPv6 address as tentative until
+	// duplicate address detection completes, which would delay pod traffic for
+	// no reason since OVS owns the subnet.
+	if err := netlink.AddrAdd(l, &netlink.Addr{IPNet: gwIP, Flags: syscall.IFA_F_NODAD}); err != nil {
+		return fmt.Errorf("could not add IPv6 gateway address to %s: %v", Tun0, err)
+	}
+	for _, cn := range plugin.networkInfo.IPv6ClusterNetworks {
+		route := &netlink.Route{
+			LinkIndex: l.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       cn.ClusterCIDR,
+		}
+		if err := netlink.RouteAdd(route); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("could not add route to %s: %v", cn.ClusterCIDR, err)
+		}
+	}
 	return nil
 }
 
-func (plugin *OsdnNode) updateEgressNetworkPolicyRules(vnid uint32) {
-	policies := plugin.egressPolicies[vnid]
-	namespaces := plugin.policy.GetNamespaces(vnid)
-	if err := plugin.oc.UpdateEgressNetworkPolicyRules(policies, vnid, namespaces, plugin.egressDNS); err != nil {
-		utilruntime.HandleError(fmt.Errorf("Error updating OVS flows for EgressNetworkPolicy: %v", err))
+// updateEgressNetworkPolicyRules updates the EgressNetworkPolicy flows of vnids,
+// applying each VNID's changes with its own OVS transaction so that a failure for
+// one VNID doesn't prevent the others from being updated
+func (plugin *OsdnNode) updateEgressNetworkPolicyRules(vnids ...uint32) {
+	errs := []error{}
+	for _, vnid := range vnids {
+		plugin.indexEgressServices(vnid)
+		policies := plugin.egressPolicies[vnid]
+		namespaces := plugin.policy.GetNamespaces(vnid)
+		if err := plugin.oc.UpdateEgressNetworkPolicyRules(policies, vnid, namespaces, plugin.egressDNS, plugin.getEgressServiceIPs); err != nil {
+			errs = append(errs, fmt.Errorf("VNID %d: %v", vnid, err))
+		}
+	}
+	if len(errs) > 0 {
+		utilruntime.HandleError(fmt.Errorf("Error updating OVS flows for EgressNetworkPolicy: %v", kerrors.NewAggregate(errs)))
 	}
 }
 
 func (plugin *OsdnNode) AddServiceRules(service *corev1.Service, netID uint32) {
+	lv := plugin.localVNIDs
+	lv.lock.Lock()
+	defer lv.lock.Unlock()
+
+	lv.services[serviceKey(service)] = &localService{service: service, vnid: netID}
+	if !lv.wantsServiceFlows(netID) {
+		klog.V(5).Infof("AddServiceRules for %v: VNID %d is not used on this node", service, netID)
+		// Make sure there aren't any flows left over from before a restart
+		if err := plugin.oc.DeleteServiceRules(service); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Error deleting OVS flows for service %v: %v", service, err))
+		}
+		return
+	}
+
 	klog.V(5).Infof("AddServiceRules for %v", service)
 	if err := plugin.oc.AddServiceRules(service, netID); err != nil {
 		utilruntime.HandleError(fmt.Errorf("Error adding OVS flows for service %v, netid %d: %v", service, netID, err))
 	}
+	// The hairpin flows also depend on the VNID
+	plugin.resyncHairpinService(service)
 }
 
 func (plugin *OsdnNode) DeleteServiceRules(service *corev1.Service) {
+	lv := plugin.localVNIDs
+	lv.lock.Lock()
+	defer lv.lock.Unlock()
+
+	delete(lv.services, serviceKey(service))
 	klog.V(5).Infof("DeleteServiceRules for %v", service)
 	if err := plugin.oc.DeleteServiceRules(service); err != nil {
 		utilruntime.HandleError(fmt.Errorf("Error deleting OVS flows for service %v: %v", service, err))
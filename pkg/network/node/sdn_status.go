@@ -0,0 +1,130 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+const (
+	// sdnStatusInterval is how often the node's health checks are run to update
+	// NodeSDNStatusAnnotation
+	sdnStatusInterval = 30 * time.Second
+
+	// sdnLeaseRenewInterval is how often the node's SDN Lease is renewed, so that
+	// the master can tell that its NodeSDNStatusAnnotation is still current
+	sdnLeaseRenewInterval = 2 * time.Minute
+	// sdnLeaseDurationSeconds is the duration of the node's SDN Lease
+	sdnLeaseDurationSeconds = 300
+)
+
+// getSDNStatus runs the node's health checks and returns the result as a
+// NodeSDNStatus
+func (node *OsdnNode) getSDNStatus() *common.NodeSDNStatus {
+	health := node.CheckHealth()
+	status := &common.NodeSDNStatus{
+		LastUpdate: metav1.Now(),
+		Ready:      health.Healthy,
+	}
+	if node.policy != nil {
+		status.PluginName = node.policy.Name()
+	}
+	for name, subsystem := range health.Subsystems {
+		if !subsystem.Healthy {
+			if status.Failures == nil {
+				status.Failures = make(map[string]string)
+			}
+			status.Failures[name] = subsystem.Message
+		}
+	}
+	return status
+}
+
+// sdnStatusChanged returns true if the readiness, failures, or plugin differ between
+// old and new (ignoring timestamps)
+func sdnStatusChanged(old, new *common.NodeSDNStatus) bool {
+	return old == nil || old.Ready != new.Ready || !reflect.DeepEqual(old.Failures, new.Failures) || old.PluginName != new.PluginName
+}
+
+// publishSDNStatus writes NodeSDNStatusAnnotation to our HostSubnet if it has
+// changed, and renews our SDN Lease if it hasn't been renewed in
+// sdnLeaseRenewInterval. (Since every node watches HostSubnets, rewriting them
+// periodically would be expensive in large clusters.)
+func (node *OsdnNode) publishSDNStatus() {
+	if time.Since(node.lastSDNLeaseRenewal) >= sdnLeaseRenewInterval {
+		if err := node.renewSDNLease(); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Could not renew SDN lease: %v", err))
+		} else {
+			node.lastSDNLeaseRenewal = time.Now()
+		}
+	}
+
+	status := node.getSDNStatus()
+	if !sdnStatusChanged(node.lastSDNStatus, status) {
+		return
+	}
+
+	value, err := json.Marshal(status)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Could not encode SDN status: %v", err))
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				common.NodeSDNStatusAnnotation: string(value),
+			},
+		},
+	})
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Could not encode SDN status: %v", err))
+		return
+	}
+	_, err = node.osdnClient.NetworkV1().HostSubnets().Patch(context.TODO(), node.hostName, ktypes.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Could not update SDN status on HostSubnet %q: %v", node.hostName, err))
+		return
+	}
+	klog.Infof("Updated SDN status: %s", string(value))
+	node.lastSDNStatus = status
+}
+
+// renewSDNLease creates or renews the node's SDN Lease
+func (node *OsdnNode) renewSDNLease() error {
+	leases := node.kClient.CoordinationV1().Leases(common.NodeSDNLeaseNamespace)
+	name := common.NodeSDNLeaseName(node.hostName)
+	now := metav1.NewMicroTime(time.Now())
+
+	lease, err := leases.Get(context.TODO(), name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		holder := node.hostName
+		duration := int32(sdnLeaseDurationSeconds)
+		_, err = leases.Create(context.TODO(), &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: common.NodeSDNLeaseNamespace},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &holder,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(context.TODO(), lease, metav1.UpdateOptions{})
+	return err
+}
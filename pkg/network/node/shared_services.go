@@ -0,0 +1,138 @@
+package node
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/klog/v2"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+const (
+	// SharedServicesClientsAnnotation can be set on the NetNamespace of a "services"
+	// namespace to a comma-separated list of namespaces that should be able to talk
+	// to it (and vice versa) in the multitenant plugin, without fully joining their
+	// pod networks (which would also let the client namespaces talk to each other).
+	SharedServicesClientsAnnotation = "network.openshift.io/shared-services-clients"
+
+	// sharedServicesCookie identifies the table 80 flows added for shared services,
+	// which are not tied to whether the VNIDs involved are in use on this node
+	sharedServicesCookie = "0x5e"
+)
+
+type vnidPair struct {
+	src, dst uint32
+}
+
+// sharedServices tracks the shared-services groups and the VNID-pair flows that
+// implement them
+type sharedServices struct {
+	lock sync.Mutex
+	// clients maps the name of each services namespace to its client namespaces
+	clients map[string][]string
+	// flows is the set of VNID pairs that we currently have flows for
+	flows map[vnidPair]bool
+}
+
+func newSharedServices() *sharedServices {
+	return &sharedServices{
+		clients: make(map[string][]string),
+		flows:   make(map[vnidPair]bool),
+	}
+}
+
+func parseSharedServicesClients(netns *osdnv1.NetNamespace) []string {
+	var clients []string
+	for _, name := range strings.Split(netns.Annotations[SharedServicesClientsAnnotation], ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && name != netns.NetName {
+			clients = append(clients, name)
+		}
+	}
+	return clients
+}
+
+// desiredFlows returns the VNID pairs that should be allowed given the current
+// groups, using getVNID to look up namespace VNIDs. Must be called with the lock held.
+func (ss *sharedServices) desiredFlows(getVNID func(string) (uint32, error)) map[vnidPair]bool {
+	desired := make(map[vnidPair]bool)
+	for services, clients := range ss.clients {
+		servicesVNID, err := getVNID(services)
+		if err != nil || servicesVNID == 0 {
+			// Global namespaces can already talk to everyone
+			continue
+		}
+		for _, client := range clients {
+			clientVNID, err := getVNID(client)
+			if err != nil || clientVNID == 0 || clientVNID == servicesVNID {
+				continue
+			}
+			desired[vnidPair{servicesVNID, clientVNID}] = true
+			desired[vnidPair{clientVNID, servicesVNID}] = true
+		}
+	}
+	return desired
+}
+
+// updateSharedServices updates the shared-services group for netns (which has been
+// deleted if deleted is true) and then resyncs the VNID-pair flows, since any
+// NetNamespace change may change the VNIDs of some group's members.
+func (mp *multiTenantPlugin) updateSharedServices(netns *osdnv1.NetNamespace, deleted bool) {
+	if mp.updateSharedServicesFlows(netns, deleted) {
+		// The services that local pods can reach may have changed
+		mp.node.updateLocalVNIDs()
+	}
+}
+
+// updateSharedServicesFlows does the work of updateSharedServices, returning true if
+// the VNID-pair flows changed
+func (mp *multiTenantPlugin) updateSharedServicesFlows(netns *osdnv1.NetNamespace, deleted bool) bool {
+	ss := mp.sharedServices
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if clients := parseSharedServicesClients(netns); !deleted && len(clients) > 0 {
+		ss.clients[netns.NetName] = clients
+	} else {
+		delete(ss.clients, netns.NetName)
+	}
+
+	desired := ss.desiredFlows(mp.vnids.getVNID)
+	otx := mp.node.oc.NewTransaction()
+	for pair := range ss.flows {
+		if !desired[pair] {
+			otx.DeleteFlows("table=80, %s", sharedServicesFlowOwner(pair.src, pair.dst).match())
+		}
+	}
+	for pair := range desired {
+		if !ss.flows[pair] {
+			klog.V(5).Infof("Allowing shared-services traffic from VNID %d to VNID %d", pair.src, pair.dst)
+			otx.AddFlow("table=80, cookie=%s, priority=150, reg0=%d, reg1=%d, actions=output:NXM_NX_REG2[]", sharedServicesFlowOwner(pair.src, pair.dst).cookie(sharedServicesCookie), pair.src, pair.dst)
+		}
+	}
+	if err := otx.Commit(); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Error updating shared-services flows: %v", err))
+		return false
+	}
+	changed := !reflect.DeepEqual(ss.flows, desired)
+	ss.flows = desired
+	return changed
+}
+
+// peers returns the VNIDs that vnid is allowed to talk to via shared services
+func (ss *sharedServices) peers(vnid uint32) []uint32 {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	var peers []uint32
+	for pair := range ss.flows {
+		if pair.src == vnid {
+			peers = append(peers, pair.dst)
+		}
+	}
+	return peers
+}
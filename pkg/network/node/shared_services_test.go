@@ -0,0 +1,86 @@
+package node
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+func sharedServicesNetNamespace(name string, netid uint32, clients string) *osdnv1.NetNamespace {
+	netns := &osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		NetName:    name,
+		NetID:      netid,
+	}
+	if clients != "" {
+		netns.Annotations = map[string]string{SharedServicesClientsAnnotation: clients}
+	}
+	return netns
+}
+
+func TestSharedServices(t *testing.T) {
+	ovsif, oc, _ := setupOVSController(t)
+	mp := NewMultiTenantPlugin().(*multiTenantPlugin)
+	mp.node = &OsdnNode{oc: oc}
+	mp.vnids = newNodeVNIDMap(mp, nil)
+
+	mp.vnids.setVNID("services", 10, false)
+	mp.vnids.setVNID("alpha", 11, false)
+	mp.vnids.setVNID("bravo", 12, false)
+	mp.vnids.setVNID("global", 0, false)
+
+	origFlows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+
+	// "global" is ignored since it can already talk to everyone, and "charlie"
+	// is ignored since it doesn't exist (yet)
+	mp.updateSharedServices(sharedServicesNetNamespace("services", 10, "alpha, bravo,global,charlie"), false)
+	flows, err := ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{kind: flowAdded, match: []string{"table=80", "cookie=" + sharedServicesFlowOwner(10, 11).cookie(sharedServicesCookie), "priority=150", "reg0=10,", "reg1=11,"}},
+		flowChange{kind: flowAdded, match: []string{"table=80", "cookie=" + sharedServicesFlowOwner(11, 10).cookie(sharedServicesCookie), "priority=150", "reg0=11,", "reg1=10,"}},
+		flowChange{kind: flowAdded, match: []string{"table=80", "cookie=" + sharedServicesFlowOwner(10, 12).cookie(sharedServicesCookie), "priority=150", "reg0=10,", "reg1=12,"}},
+		flowChange{kind: flowAdded, match: []string{"table=80", "cookie=" + sharedServicesFlowOwner(12, 10).cookie(sharedServicesCookie), "priority=150", "reg0=12,", "reg1=10,"}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	// The shared-services flows don't make the VNIDs count as "in use by policy"
+	if policyVNIDs := oc.FindPolicyVNIDs(); policyVNIDs.Has(10) || policyVNIDs.Has(11) || policyVNIDs.Has(12) {
+		t.Fatalf("Unexpected policy VNIDs %v", policyVNIDs.List())
+	}
+
+	// If bravo joins the services network, it no longer needs its own flows
+	mp.vnids.setVNID("bravo", 10, false)
+	mp.updateSharedServices(sharedServicesNetNamespace("bravo", 10, ""), false)
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	err = assertFlowChanges(origFlows, flows,
+		flowChange{kind: flowAdded, match: []string{"table=80", "cookie=" + sharedServicesFlowOwner(10, 11).cookie(sharedServicesCookie), "reg0=10,", "reg1=11,"}},
+		flowChange{kind: flowAdded, match: []string{"table=80", "cookie=" + sharedServicesFlowOwner(11, 10).cookie(sharedServicesCookie), "reg0=11,", "reg1=10,"}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+
+	// Deleting the services namespace removes everything
+	mp.vnids.unsetVNID("services")
+	mp.updateSharedServices(sharedServicesNetNamespace("services", 10, "alpha,bravo"), true)
+	flows, err = ovsif.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping flows: %v", err)
+	}
+	if err = assertFlowChanges(origFlows, flows); err != nil {
+		t.Fatalf("Unexpected flow changes: %v\nOrig: %#v\nNew: %#v", err, origFlows, flows)
+	}
+}
@@ -50,8 +50,23 @@ func (sp *singleTenantPlugin) GetMulticastEnabled(vnid uint32) bool {
 	return false
 }
 
+func (sp *singleTenantPlugin) GetMulticastGrants(vnid uint32) []multicastGrantTarget {
+	return nil
+}
+
+func (sp *singleTenantPlugin) GetMulticastGrantSenders(vnid uint32) []uint32 {
+	return nil
+}
+
+func (sp *singleTenantPlugin) GetSharedServiceVNIDs(vnid uint32) []uint32 {
+	return nil
+}
+
 func (sp *singleTenantPlugin) EnsureVNIDRules(vnid uint32) {
 }
 
 func (sp *singleTenantPlugin) SyncVNIDRules() {
 }
+
+func (sp *singleTenantPlugin) ResyncVNIDRules() {
+}
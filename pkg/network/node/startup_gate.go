@@ -0,0 +1,144 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	kapierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+const (
+	// startupCheckInterval is how often the startup checks are retried until they pass
+	startupCheckInterval = time.Second
+
+	// cniReadyTimeout is how long a CNI_ADD request waits for the startup checks to
+	// pass before failing (after which kubelet will retry it)
+	cniReadyTimeout = 30 * time.Second
+)
+
+// waitForStartupReady waits until the informer caches that pod setup depends on
+// have synced and our HostSubnet in the cache matches the subnet and IP we were set
+// up with, and then marks the pod manager as ready to set up new pods. (The CNI
+// config file persists across restarts, so kubelet may send us ADDs before the
+// caches are populated; serving them from empty caches would give pods the wrong
+// VNIDs and policies.)
+func (node *OsdnNode) waitForStartupReady() {
+	informers := map[string]cache.InformerSynced{
+		"HostSubnets": node.osdnInformers.Network().V1().HostSubnets().Informer().HasSynced,
+		"Services":    node.kubeInformers.Core().V1().Services().Informer().HasSynced,
+	}
+	if node.policy.SupportsVNIDs() {
+		informers["NetNamespaces"] = node.osdnInformers.Network().V1().NetNamespaces().Informer().HasSynced
+	}
+	if _, ok := node.policy.(*networkPolicyPlugin); ok {
+		informers["NetworkPolicies"] = node.kubeInformers.Networking().V1().NetworkPolicies().Informer().HasSynced
+	}
+
+	var lastErr string
+	_ = utilwait.PollImmediateInfinite(startupCheckInterval, func() (bool, error) {
+		err := node.checkStartupReady(informers)
+		node.podManager.setNotReady(err)
+		if err == nil {
+			return true, nil
+		}
+		if err.Error() != lastErr {
+			klog.Infof("Not yet ready to set up pods: %v", err)
+			lastErr = err.Error()
+		}
+		return false, nil
+	})
+	klog.Infof("Startup checks passed; ready to set up pods")
+}
+
+// checkStartupReady returns nil if informers have all synced and our HostSubnet
+// matches our local state, or an error describing what we are waiting for
+func (node *OsdnNode) checkStartupReady(informers map[string]cache.InformerSynced) error {
+	var notSynced []string
+	for name, hasSynced := range informers {
+		if !hasSynced() {
+			notSynced = append(notSynced, name)
+		}
+	}
+	if len(notSynced) > 0 {
+		sort.Strings(notSynced)
+		return fmt.Errorf("waiting for informers to sync: %s", strings.Join(notSynced, ", "))
+	}
+
+	hs, err := node.osdnInformers.Network().V1().HostSubnets().Lister().Get(node.hostName)
+	if kapierrors.IsNotFound(err) {
+		return fmt.Errorf("HostSubnet %q not found", node.hostName)
+	} else if err != nil {
+		return fmt.Errorf("could not get HostSubnet %q: %v", node.hostName, err)
+	}
+	return verifyLocalHostSubnet(hs, node.localIP, node.localSubnetCIDR, node.localSubnetIPv6CIDR)
+}
+
+// verifyLocalHostSubnet returns an error if hs does not match the node IP and
+// subnets that the node was set up with
+func verifyLocalHostSubnet(hs *osdnv1.HostSubnet, localIP, localSubnetCIDR, localSubnetIPv6CIDR string) error {
+	if hs.HostIP != localIP {
+		return fmt.Errorf("HostSubnet %q has HostIP %q but node IP is %q", hs.Name, hs.HostIP, localIP)
+	}
+	if hs.Subnet != localSubnetCIDR {
+		return fmt.Errorf("HostSubnet %q has subnet %q but node was set up with %q", hs.Name, hs.Subnet, localSubnetCIDR)
+	}
+	if localSubnetIPv6CIDR != "" {
+		ipnet, err := common.GetHostSubnetIPv6(hs)
+		if err != nil {
+			return fmt.Errorf("HostSubnet %q has invalid IPv6 subnet: %v", hs.Name, err)
+		} else if ipnet == nil || ipnet.String() != localSubnetIPv6CIDR {
+			return fmt.Errorf("HostSubnet %q does not have IPv6 subnet %q that node was set up with", hs.Name, localSubnetIPv6CIDR)
+		}
+	}
+	return nil
+}
+
+// setNotReady records err as the reason the pod manager is not ready, or marks it
+// ready if err is nil. Once ready, it stays ready.
+func (m *podManager) setNotReady(err error) {
+	m.readyLock.Lock()
+	defer m.readyLock.Unlock()
+	select {
+	case <-m.ready:
+		return
+	default:
+	}
+	if err == nil {
+		m.notReadyErr = nil
+		close(m.ready)
+	} else {
+		m.notReadyErr = err
+	}
+}
+
+// checkReady returns nil if the pod manager is ready to set up pods, or an error
+// saying why it is not
+func (m *podManager) checkReady() error {
+	m.readyLock.Lock()
+	defer m.readyLock.Unlock()
+	select {
+	case <-m.ready:
+		return nil
+	default:
+		return fmt.Errorf("SDN is not ready: %v", m.notReadyErr)
+	}
+}
+
+// waitReady waits up to timeout for the pod manager to be ready to set up pods
+func (m *podManager) waitReady(timeout time.Duration) error {
+	select {
+	case <-m.ready:
+		return nil
+	case <-time.After(timeout):
+		return m.checkReady()
+	}
+}
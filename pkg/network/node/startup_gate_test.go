@@ -0,0 +1,108 @@
+package node
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+func TestVerifyLocalHostSubnet(t *testing.T) {
+	hs := &osdnv1.HostSubnet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "node1",
+			Annotations: map[string]string{common.HostSubnetIPv6Annotation: "fd01:0:0:1::/64"},
+		},
+		HostIP: "192.168.1.1",
+		Subnet: "10.128.0.0/23",
+	}
+
+	testcases := []struct {
+		name        string
+		localIP     string
+		subnet      string
+		subnetIPv6  string
+		expectError bool
+	}{
+		{
+			name:    "matches",
+			localIP: "192.168.1.1",
+			subnet:  "10.128.0.0/23",
+		},
+		{
+			name:       "matches dual-stack",
+			localIP:    "192.168.1.1",
+			subnet:     "10.128.0.0/23",
+			subnetIPv6: "fd01:0:0:1::/64",
+		},
+		{
+			name:        "wrong IP",
+			localIP:     "192.168.1.2",
+			subnet:      "10.128.0.0/23",
+			expectError: true,
+		},
+		{
+			name:        "wrong subnet",
+			localIP:     "192.168.1.1",
+			subnet:      "10.128.2.0/23",
+			expectError: true,
+		},
+		{
+			name:        "wrong IPv6 subnet",
+			localIP:     "192.168.1.1",
+			subnet:      "10.128.0.0/23",
+			subnetIPv6:  "fd01:0:0:2::/64",
+			expectError: true,
+		},
+	}
+	for _, tc := range testcases {
+		err := verifyLocalHostSubnet(hs, tc.localIP, tc.subnet, tc.subnetIPv6)
+		if tc.expectError && err == nil {
+			t.Fatalf("%s: unexpectedly got no error", tc.name)
+		} else if !tc.expectError && err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestPodManagerReadiness(t *testing.T) {
+	m := newDefaultPodManager()
+	m.ready = make(chan struct{})
+	m.notReadyErr = fmt.Errorf("node has not finished starting up")
+
+	if err := m.checkReady(); err == nil {
+		t.Fatalf("unexpectedly got no error before ready")
+	}
+	if err := m.waitReady(10 * time.Millisecond); err == nil {
+		t.Fatalf("unexpectedly became ready")
+	}
+
+	m.setNotReady(fmt.Errorf("waiting for informers to sync: HostSubnets"))
+	if err := m.checkReady(); err == nil || err.Error() != "SDN is not ready: waiting for informers to sync: HostSubnets" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- m.waitReady(time.Minute)
+	}()
+	m.setNotReady(nil)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error waiting for ready: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for ready")
+	}
+
+	// Once ready, it stays ready
+	m.setNotReady(fmt.Errorf("HostSubnet \"node1\" not found"))
+	if err := m.checkReady(); err != nil {
+		t.Fatalf("unexpected error after ready: %v", err)
+	}
+}
@@ -3,44 +3,177 @@ package node
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"k8s.io/klog/v2"
 
+	corev1 "k8s.io/api/core/v1"
 	kapierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	ktypes "k8s.io/apimachinery/pkg/types"
-	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
 	utilwait "k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
 	osdnv1 "github.com/openshift/api/network/v1"
 	osdninformers "github.com/openshift/client-go/network/informers/externalversions"
+	osdnlisters "github.com/openshift/client-go/network/listers/network/v1"
 	"github.com/openshift/sdn/pkg/network/common"
+	"github.com/openshift/sdn/pkg/util/ovs"
 )
 
 type hostSubnetWatcher struct {
 	oc          *ovsController
+	hostName    string
 	localIP     string
 	networkInfo *common.ParsedClusterNetwork
 
+	// localHostIPUpdated, if set, is called with the HostIP of the local node's
+	// HostSubnet whenever it is added or updated, so that the node can notice if the
+	// master changes it. It returns true if the node now uses hostIP as its IP, in
+	// which case the watcher does too.
+	localHostIPUpdated func(hostIP string) bool
+
+	// encapsulations are the encapsulations that this node supports; pod traffic
+	// to each remote HostSubnet uses the most preferred one that its node also
+	// supports (see common.HostSubnetEncapsulationsAnnotation)
+	encapsulations sets.String
+	// routeSubnet, if set, returns true if the node's network can route pod traffic
+	// to a remote HostSubnet (because of BGP or native routing), in which case it is
+	// sent without encapsulation if both nodes support common.EncapsulationNone
+	routeSubnet func(hs *osdnv1.HostSubnet) bool
+	// updateRoute is called to add or delete the host route to each remote
+	// HostSubnet that pod traffic is routed to without encapsulation
+	updateRoute func(subnet, hostIP string, add bool) error
+	// removeStaleRoutes, if set, is called once the informer has synced to delete
+	// any host routes to remote HostSubnets other than the given subnets, which a
+	// previous run may have left behind (eg, if routing has since been disabled)
+	removeStaleRoutes func(keep sets.String) error
+	// recorder, if set, records events about the local node, eg for MTU mismatches
+	recorder record.EventRecorder
+
+	// lock protects hostSubnetMap, which is accessed both from the informer and
+	// from removeStaleHostSubnets, and the MTU fields
+	lock          sync.Mutex
 	hostSubnetMap map[ktypes.UID]*osdnv1.HostSubnet
+	// underlayMTU is the MTU of this node's underlay interface (or 0 if not yet
+	// known), peerMTUs is the underlay MTU advertised by each other node, and
+	// mtuMismatches is the mismatches that have been reported, by node name
+	underlayMTU   uint32
+	peerMTUs      map[string]uint32
+	mtuMismatches map[string]mtuMismatch
 }
 
-func newHostSubnetWatcher(oc *ovsController, localIP string, networkInfo *common.ParsedClusterNetwork) *hostSubnetWatcher {
+func newHostSubnetWatcher(oc *ovsController, hostName, localIP string, networkInfo *common.ParsedClusterNetwork) *hostSubnetWatcher {
 	return &hostSubnetWatcher{
 		oc:          oc,
+		hostName:    hostName,
 		localIP:     localIP,
 		networkInfo: networkInfo,
 
-		hostSubnetMap: make(map[ktypes.UID]*osdnv1.HostSubnet),
+		encapsulations: sets.NewString(common.EncapsulationVXLAN),
+		hostSubnetMap:  make(map[ktypes.UID]*osdnv1.HostSubnet),
+		peerMTUs:       make(map[string]uint32),
+		mtuMismatches:  make(map[string]mtuMismatch),
 	}
 }
 
-func (hsw *hostSubnetWatcher) Start(osdnInformers osdninformers.SharedInformerFactory) {
+// Start starts watching HostSubnets. If keptFlows is true, then the OVS flows from
+// before the node was restarted were kept rather than being recreated, so once the
+// informer has synced, we remove the flows for any HostSubnets that were deleted
+// while we were not running.
+func (hsw *hostSubnetWatcher) Start(osdnInformers osdninformers.SharedInformerFactory, keptFlows bool) {
 	funcs := common.InformerFuncs(&osdnv1.HostSubnet{}, hsw.handleAddOrUpdateHostSubnet, hsw.handleDeleteHostSubnet)
-	osdnInformers.Network().V1().HostSubnets().Informer().AddEventHandler(funcs)
+	informer := osdnInformers.Network().V1().HostSubnets()
+	informer.Informer().AddEventHandler(funcs)
+
+	go func() {
+		if !cache.WaitForCacheSync(utilwait.NeverStop, informer.Informer().HasSynced) {
+			return
+		}
+		if keptFlows {
+			if err := hsw.removeStaleHostSubnets(informer.Lister()); err != nil {
+				utilruntime.HandleError(fmt.Errorf("error removing stale HostSubnet flows: %v", err))
+			}
+		}
+		if err := hsw.removeStaleHostSubnetRoutes(); err != nil {
+			utilruntime.HandleError(fmt.Errorf("error removing stale HostSubnet routes: %v", err))
+		}
+	}()
+}
+
+// removeStaleHostSubnetRoutes deletes any host routes to remote HostSubnets that
+// are not currently routed without encapsulation. (Unlike the OVS flows, these
+// routes are left behind even if the node restarts with routing disabled.)
+func (hsw *hostSubnetWatcher) removeStaleHostSubnetRoutes() error {
+	if hsw.removeStaleRoutes == nil {
+		return nil
+	}
+	hsw.lock.Lock()
+	defer hsw.lock.Unlock()
+
+	keep := sets.NewString()
+	for _, hs := range hsw.hostSubnetMap {
+		if hsw.getEncapsulation(hs) == common.EncapsulationNone {
+			keep.Insert(hs.Subnet)
+		}
+	}
+	return hsw.removeStaleRoutes(keep)
+}
+
+// removeStaleHostSubnets deletes the flows for any HostSubnet that is in OVS but
+// that is not known to either the lister or the watcher.
+func (hsw *hostSubnetWatcher) removeStaleHostSubnets(lister osdnlisters.HostSubnetLister) error {
+	hsw.lock.Lock()
+	defer hsw.lock.Unlock()
+
+	cookies, err := hsw.oc.FindHostSubnetCookies()
+	if err != nil {
+		return err
+	}
+	subnets, err := lister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	haveRemoteSubnets := false
+	for _, hs := range subnets {
+		if _, isDuplicate := hs.Annotations[common.DuplicateHostIPAnnotation]; isDuplicate {
+			continue
+		}
+		cookies.Delete(fmt.Sprintf("0x%08x", hostSubnetCookie(hs)))
+		if hs.HostIP != hsw.localIP {
+			haveRemoteSubnets = true
+		}
+	}
+	for _, hs := range hsw.hostSubnetMap {
+		cookies.Delete(fmt.Sprintf("0x%08x", hostSubnetCookie(hs)))
+	}
+	if cookies.Len() == 0 {
+		return nil
+	}
+
+	otx := hsw.oc.NewTransaction()
+	for _, cookie := range cookies.List() {
+		klog.Infof("Removing stale OVS flows for deleted HostSubnet (cookie %s)", cookie)
+		deleteHostSubnetRulesByCookie(otx, cookie)
+	}
+	// The multicast flows get rewritten (without the stale subnets) whenever a
+	// HostSubnet is added, so we only need to fix them here if there are none.
+	if !haveRemoteSubnets {
+		err = hsw.commitWithVXLANMulticastRules(otx)
+	} else {
+		err = otx.Commit()
+	}
+	if err != nil {
+		return fmt.Errorf("error deleting OVS flows for stale HostSubnets %s: %v", strings.Join(cookies.List(), ", "), err)
+	}
+	return nil
 }
 
 func (hsw *hostSubnetWatcher) handleAddOrUpdateHostSubnet(obj, _ interface{}, eventType watch.EventType) {
@@ -67,68 +200,224 @@ func (hsw *hostSubnetWatcher) handleDeleteHostSubnet(obj interface{}) {
 }
 
 func (hsw *hostSubnetWatcher) updateHostSubnet(hs *osdnv1.HostSubnet) error {
-	if hs.HostIP == hsw.localIP {
+	hsw.lock.Lock()
+	defer hsw.lock.Unlock()
+
+	if hs.Name == hsw.hostName {
+		if hsw.localHostIPUpdated != nil && hsw.localHostIPUpdated(hs.HostIP) {
+			hsw.localIP = hs.HostIP
+		}
+		return nil
+	} else if hs.HostIP == hsw.localIP {
 		return nil
 	}
+	hsw.checkMTU(hs)
 	oldSubnet, exists := hsw.hostSubnetMap[hs.UID]
+	if owner, isDuplicate := hs.Annotations[common.DuplicateHostIPAnnotation]; isDuplicate {
+		if !exists {
+			klog.V(5).Infof("Ignoring HostSubnet %s with duplicate HostIP", common.HostSubnetToString(hs))
+			return nil
+		}
+		klog.Warningf("Removing flows for HostSubnet %s: its HostIP is already used by HostSubnet %q", common.HostSubnetToString(hs), owner)
+		return hsw.removeHostSubnet(hs)
+	}
+	otx := hsw.oc.NewTransaction()
 	if exists {
-		if oldSubnet.HostIP == hs.HostIP {
+		if oldSubnet.HostIP == hs.HostIP && oldSubnet.Annotations[common.HostSubnetIPv6Annotation] == hs.Annotations[common.HostSubnetIPv6Annotation] &&
+			hsw.getEncapsulation(oldSubnet) == hsw.getEncapsulation(hs) {
 			return nil
 		} else {
-			// Delete old subnet rules (ignore errors)
-			hsw.oc.DeleteHostSubnetRules(oldSubnet)
+			// Delete old subnet rules
+			deleteHostSubnetRules(otx, oldSubnet)
+			hsw.deleteRoute(oldSubnet)
 		}
 	}
 	if err := hsw.networkInfo.ValidateNodeIP(hs.HostIP); err != nil {
+		// Still delete the old subnet rules, if any (ignoring errors)
+		otx.Commit()
 		return fmt.Errorf("ignoring invalid subnet for node %s: %v", hs.HostIP, err)
 	}
 
+	encap := hsw.getEncapsulation(hs)
+	if encap == common.EncapsulationNone {
+		if err := hsw.updateRoute(hs.Subnet, hs.HostIP, true); err != nil {
+			otx.Commit()
+			return fmt.Errorf("error adding route to subnet %q: %v", hs.Subnet, err)
+		}
+	}
+
 	hsw.hostSubnetMap[hs.UID] = hs
 
-	errList := []error{}
-	if err := hsw.oc.AddHostSubnetRules(hs); err != nil {
-		errList = append(errList, fmt.Errorf("error adding OVS flows for subnet %q: %v", hs.Subnet, err))
-	}
+	addHostSubnetRules(otx, hs, encap)
 	// Update multicast rules after all other changes have been processed
-	if err := hsw.updateVXLANMulticastRules(); err != nil {
-		errList = append(errList, fmt.Errorf("error updating OVS VXLAN multicast flows: %v", err))
+	if err := hsw.commitWithVXLANMulticastRules(otx); err != nil {
+		return fmt.Errorf("error adding OVS flows for subnet %q: %v", hs.Subnet, err)
 	}
-
-	return kerrors.NewAggregate(errList)
+	return nil
 }
 
 func (hsw *hostSubnetWatcher) deleteHostSubnet(hs *osdnv1.HostSubnet) error {
+	hsw.lock.Lock()
+	defer hsw.lock.Unlock()
+
 	if hs.HostIP == hsw.localIP {
 		return nil
 	}
-	if _, exists := hsw.hostSubnetMap[hs.UID]; !exists {
+	delete(hsw.peerMTUs, hs.Name)
+	hsw.clearMTUMismatch(hs.Name)
+	return hsw.removeHostSubnet(hs)
+}
+
+// removeHostSubnet removes the flows for hs, if we have created them. The caller
+// must hold hsw.lock.
+func (hsw *hostSubnetWatcher) removeHostSubnet(hs *osdnv1.HostSubnet) error {
+	oldSubnet, exists := hsw.hostSubnetMap[hs.UID]
+	if !exists {
 		return nil
 	}
 
 	delete(hsw.hostSubnetMap, hs.UID)
 
-	errList := []error{}
-	if err := hsw.oc.DeleteHostSubnetRules(hs); err != nil {
-		errList = append(errList, fmt.Errorf("error deleting OVS flows for subnet %q: %v", hs.Subnet, err))
+	otx := hsw.oc.NewTransaction()
+	deleteHostSubnetRules(otx, oldSubnet)
+	hsw.deleteRoute(oldSubnet)
+	if err := hsw.commitWithVXLANMulticastRules(otx); err != nil {
+		return fmt.Errorf("error deleting OVS flows for subnet %q: %v", oldSubnet.Subnet, err)
 	}
-	if err := hsw.updateVXLANMulticastRules(); err != nil {
-		errList = append(errList, fmt.Errorf("error updating OVS VXLAN multicast flows: %v", err))
+	return nil
+}
+
+// resync rewrites the flows (and, for routed subnets, the routes) for every remote
+// HostSubnet, in case they have drifted
+func (hsw *hostSubnetWatcher) resync() error {
+	hsw.lock.Lock()
+	defer hsw.lock.Unlock()
+
+	otx := hsw.oc.NewTransaction()
+	for _, hs := range hsw.hostSubnetMap {
+		encap := hsw.getEncapsulation(hs)
+		if encap == common.EncapsulationNone {
+			if err := hsw.updateRoute(hs.Subnet, hs.HostIP, true); err != nil {
+				utilruntime.HandleError(fmt.Errorf("Error adding route to subnet %q: %v", hs.Subnet, err))
+			}
+		}
+		deleteHostSubnetRules(otx, hs)
+		addHostSubnetRules(otx, hs, encap)
 	}
+	if err := hsw.commitWithVXLANMulticastRules(otx); err != nil {
+		return fmt.Errorf("error resyncing OVS flows for HostSubnets: %v", err)
+	}
+	return nil
+}
+
+// getEncapsulation returns the encapsulation to send pod traffic to hs with: the
+// first of common.Encapsulations that both this node and hs's node support (and,
+// for common.EncapsulationNone, that routeSubnet allows). Since the order is the
+// same on every node, traffic between two nodes normally uses the same
+// encapsulation in both directions.
+func (hsw *hostSubnetWatcher) getEncapsulation(hs *osdnv1.HostSubnet) string {
+	remote := common.GetHostSubnetEncapsulations(hs)
+	for _, encap := range common.Encapsulations {
+		if !hsw.encapsulations.Has(encap) || !remote.Has(encap) {
+			continue
+		}
+		if encap == common.EncapsulationNone && (hsw.routeSubnet == nil || !hsw.routeSubnet(hs)) {
+			continue
+		}
+		return encap
+	}
+	return common.EncapsulationVXLAN
+}
 
-	return kerrors.NewAggregate(errList)
+// deleteRoute deletes the host route to hs, if there is one
+func (hsw *hostSubnetWatcher) deleteRoute(hs *osdnv1.HostSubnet) {
+	if hsw.getEncapsulation(hs) != common.EncapsulationNone {
+		return
+	}
+	if err := hsw.updateRoute(hs.Subnet, hs.HostIP, false); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Error deleting route to subnet %q: %v", hs.Subnet, err))
+	}
 }
 
-func (hsw *hostSubnetWatcher) updateVXLANMulticastRules() error {
+// commitWithVXLANMulticastRules adds the updated VXLAN multicast flows to otx and
+// commits it
+func (hsw *hostSubnetWatcher) commitWithVXLANMulticastRules(otx ovs.Transaction) error {
 	remoteIPs := make([]string, 0, len(hsw.hostSubnetMap))
 	for _, subnet := range hsw.hostSubnetMap {
 		if subnet.HostIP != hsw.localIP {
 			remoteIPs = append(remoteIPs, subnet.HostIP)
 		}
 	}
-	return hsw.oc.UpdateVXLANMulticastFlows(remoteIPs)
+	return hsw.oc.commitVXLANMulticastFlows(otx, remoteIPs)
 }
 
-func (node *OsdnNode) getLocalSubnet() (string, error) {
+// handleLocalHostIPUpdated is called when our HostSubnet is added or updated. If
+// the master has changed its HostIP because the node's primary IP changed, and the
+// new IP is one of ours, then we switch to it: the DNS flows and egress IPs are
+// moved to the new IP. (Other nodes update their flows for us when they see the
+// HostSubnet change.) BGP and native routing are set up for the node IP at startup
+// and can't be moved, so if either is in use, we instead report the mismatch, via
+// an event and the "node-ip" health check, until we are restarted with the new IP.
+func (node *OsdnNode) handleLocalHostIPUpdated(hostIP string) bool {
+	node.hostIPLock.Lock()
+	defer node.hostIPLock.Unlock()
+
+	if hostIP == node.localIP {
+		if node.changedHostIP != "" {
+			klog.Infof("HostSubnet %q HostIP is back to node IP %s", node.hostName, node.localIP)
+			node.changedHostIP = ""
+		}
+		return false
+	} else if hostIP == node.changedHostIP {
+		return false
+	}
+	if _, _, err := GetLinkDetails(hostIP); err != nil {
+		utilruntime.HandleError(fmt.Errorf("HostSubnet %q has HostIP %q, which is not a local address (node IP is %q); ignoring", node.hostName, hostIP, node.localIP))
+		return false
+	}
+
+	if len(node.bgpPeers) > 0 || node.nativeRouting {
+		node.changedHostIP = hostIP
+		klog.Warningf("Node IP changed from %s to %s; openshift-sdn must be restarted with --node-ip=%s", node.localIP, hostIP, hostIP)
+		node.recorder.Eventf(&corev1.ObjectReference{Kind: "Node", Name: node.hostName}, corev1.EventTypeWarning, "NodeIPChanged",
+			"Node IP changed from %s to %s; openshift-sdn must be restarted with the new node IP, since BGP or native routing is in use", node.localIP, hostIP)
+		return false
+	}
+
+	klog.Infof("Node IP changed from %s to %s; updating", node.localIP, hostIP)
+	if err := node.oc.SetLocalIP(hostIP); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Error updating OVS flows for new node IP %s: %v", hostIP, err))
+	}
+	if node.policy.SupportsVNIDs() {
+		node.egressIP.updateLocalIP(hostIP)
+	}
+	node.recorder.Eventf(&corev1.ObjectReference{Kind: "Node", Name: node.hostName}, corev1.EventTypeNormal, "NodeIPChanged",
+		"Node IP changed from %s to %s", node.localIP, hostIP)
+	node.localIP = hostIP
+	node.changedHostIP = ""
+	return true
+}
+
+// getLocalIP returns the node IP, which can change (see handleLocalHostIPUpdated)
+func (node *OsdnNode) getLocalIP() string {
+	node.hostIPLock.Lock()
+	defer node.hostIPLock.Unlock()
+	return node.localIP
+}
+
+// checkNodeIPHealth reports whether the node IP still matches our HostSubnet
+func (node *OsdnNode) checkNodeIPHealth() error {
+	node.hostIPLock.Lock()
+	defer node.hostIPLock.Unlock()
+	if node.changedHostIP != "" {
+		return fmt.Errorf("node IP changed from %s to %s; restart with the new node IP", node.localIP, node.changedHostIP)
+	}
+	return nil
+}
+
+// getLocalSubnet returns the node's IPv4 subnet, and its IPv6 subnet (or "" if the
+// cluster is not dual-stack)
+func (node *OsdnNode) getLocalSubnet() (string, string, error) {
 	var subnet *osdnv1.HostSubnet
 	// If the HostSubnet doesn't already exist, it will be created by the SDN master in
 	// response to the kubelet registering itself with the master (which should be
@@ -162,12 +451,24 @@ func (node *OsdnNode) getLocalSubnet() (string, error) {
 		}
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to get subnet for this host: %s, error: %v", node.hostName, err)
+		return "", "", fmt.Errorf("failed to get subnet for this host: %s, error: %v", node.hostName, err)
 	}
 
 	if err = node.networkInfo.ValidateNodeIP(subnet.HostIP); err != nil {
-		return "", fmt.Errorf("failed to validate own HostSubnet: %v", err)
+		return "", "", fmt.Errorf("failed to validate own HostSubnet: %v", err)
+	}
+
+	var subnetV6 string
+	if len(node.networkInfo.IPv6ClusterNetworks) > 0 {
+		ipnet, err := common.GetHostSubnetIPv6(subnet)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to parse IPv6 subnet of own HostSubnet: %v", err)
+		} else if ipnet == nil {
+			klog.Warningf("Cluster is dual-stack but HostSubnet %q has no IPv6 subnet; pods will be IPv4-only", node.hostName)
+		} else {
+			subnetV6 = ipnet.String()
+		}
 	}
 
-	return subnet.Subnet, nil
+	return subnet.Subnet, subnetV6, nil
 }
@@ -2,14 +2,21 @@ package node
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ktypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
 	osdnv1 "github.com/openshift/api/network/v1"
+	osdnlisters "github.com/openshift/client-go/network/listers/network/v1"
 	"github.com/openshift/sdn/pkg/network/common"
+	"github.com/openshift/sdn/pkg/network/node/metrics"
+	"github.com/openshift/sdn/pkg/util/ovs"
 )
 
 func assertHostSubnetFlowChanges(hsw *hostSubnetWatcher, flows *[]string, changes ...flowChange) error {
@@ -47,7 +54,7 @@ func setupHostSubnetWatcher(t *testing.T) (*hostSubnetWatcher, []string) {
 		t.Fatalf("unexpected error parsing network info: %v", err)
 	}
 
-	hsw := newHostSubnetWatcher(oc, oc.localIP, networkInfo)
+	hsw := newHostSubnetWatcher(oc, "local-node", oc.localIP, networkInfo)
 
 	flows, err := hsw.oc.ovs.DumpFlows("")
 	if err != nil {
@@ -72,6 +79,12 @@ func makeHostSubnet(name, hostIP, subnet string) *osdnv1.HostSubnet {
 	}
 }
 
+func makeHostSubnetWithEncapsulations(name, hostIP, subnet, encapsulations string) *osdnv1.HostSubnet {
+	hs := makeHostSubnet(name, hostIP, subnet)
+	hs.Annotations = map[string]string{common.HostSubnetEncapsulationsAnnotation: encapsulations}
+	return hs
+}
+
 func TestHostSubnetWatcher(t *testing.T) {
 	hsw, flows := setupHostSubnetWatcher(t)
 
@@ -338,3 +351,515 @@ func TestHostSubnetReassignment(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 }
+
+func TestHostSubnetLocalIPChange(t *testing.T) {
+	hsw, flows := setupHostSubnetWatcher(t)
+
+	var newLocalIP string
+	hsw.localHostIPUpdated = func(hostIP string) bool {
+		if hostIP != hsw.localIP {
+			newLocalIP = hostIP
+			return true
+		}
+		return false
+	}
+
+	local := makeHostSubnet("local-node", hsw.localIP, "10.128.0.0/23")
+	err := hsw.updateHostSubnet(local)
+	if err != nil {
+		t.Fatalf("Unexpected error adding HostSubnet: %v", err)
+	}
+	err = assertHostSubnetFlowChanges(hsw, &flows)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if newLocalIP != "" {
+		t.Fatalf("Unexpected local IP change to %q", newLocalIP)
+	}
+
+	// If the master changes our HostIP, we must not treat our own HostSubnet as
+	// belonging to a remote node
+	local = local.DeepCopy()
+	local.HostIP = "192.168.5.5"
+	err = hsw.updateHostSubnet(local)
+	if err != nil {
+		t.Fatalf("Unexpected error updating HostSubnet: %v", err)
+	}
+	err = assertHostSubnetFlowChanges(hsw, &flows)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if newLocalIP != "192.168.5.5" {
+		t.Fatalf("Expected local IP change to 192.168.5.5, got %q", newLocalIP)
+	}
+	if hsw.localIP != "192.168.5.5" {
+		t.Fatalf("Expected watcher to switch to local IP 192.168.5.5, got %q", hsw.localIP)
+	}
+}
+
+func TestRemoveStaleHostSubnets(t *testing.T) {
+	hsw, flows := setupHostSubnetWatcher(t)
+
+	hs1 := makeHostSubnet("node1", "192.168.0.2", "10.128.0.0/23")
+	hs2 := makeHostSubnet("node2", "192.168.1.2", "10.129.0.0/23")
+	hs3 := makeHostSubnet("node3", "192.168.2.2", "10.130.0.0/23")
+	for _, hs := range []*osdnv1.HostSubnet{hs1, hs2, hs3} {
+		if err := hsw.updateHostSubnet(hs); err != nil {
+			t.Fatalf("Unexpected error adding HostSubnet: %v", err)
+		}
+	}
+	if err := assertHostSubnetFlowChanges(hsw, &flows,
+		flowChange{kind: flowAdded, match: []string{"table=10", "tun_src=192.168.0.2"}},
+		flowChange{kind: flowAdded, match: []string{"table=10", "tun_src=192.168.1.2"}},
+		flowChange{kind: flowAdded, match: []string{"table=10", "tun_src=192.168.2.2"}},
+		flowChange{kind: flowAdded, match: []string{"table=50", "arp_tpa=10.128.0.0/23"}},
+		flowChange{kind: flowAdded, match: []string{"table=50", "arp_tpa=10.129.0.0/23"}},
+		flowChange{kind: flowAdded, match: []string{"table=50", "arp_tpa=10.130.0.0/23"}},
+		flowChange{kind: flowAdded, match: []string{"table=90", "nw_dst=10.128.0.0/23"}},
+		flowChange{kind: flowAdded, match: []string{"table=90", "nw_dst=10.129.0.0/23"}},
+		flowChange{kind: flowAdded, match: []string{"table=90", "nw_dst=10.130.0.0/23"}},
+		flowChange{kind: flowRemoved, match: []string{"table=111", "goto_table:120"}, noMatch: []string{"->tun_dst"}},
+		flowChange{kind: flowAdded, match: []string{"table=111", "192.168.0.2->tun_dst", "192.168.1.2->tun_dst", "192.168.2.2->tun_dst"}},
+	); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Now the node restarts, keeping its flows. node1 is deleted while it is down.
+	// The new watcher has seen node2 but node3 is only in the lister so far.
+	hsw = newHostSubnetWatcher(hsw.oc, hsw.hostName, hsw.localIP, hsw.networkInfo)
+	if err := hsw.updateHostSubnet(hs2); err != nil {
+		t.Fatalf("Unexpected error adding HostSubnet: %v", err)
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(hs2)
+	indexer.Add(hs3)
+	if err := hsw.removeStaleHostSubnets(osdnlisters.NewHostSubnetLister(indexer)); err != nil {
+		t.Fatalf("Unexpected error removing stale HostSubnets: %v", err)
+	}
+
+	if err := assertHostSubnetFlowChanges(hsw, &flows,
+		flowChange{kind: flowRemoved, match: []string{"table=10", "tun_src=192.168.0.2"}},
+		flowChange{kind: flowRemoved, match: []string{"table=50", "arp_tpa=10.128.0.0/23"}},
+		flowChange{kind: flowRemoved, match: []string{"table=90", "nw_dst=10.128.0.0/23"}},
+		flowChange{kind: flowRemoved, match: []string{"table=111", "192.168.0.2->tun_dst", "192.168.1.2->tun_dst", "192.168.2.2->tun_dst"}},
+		flowChange{kind: flowAdded, match: []string{"table=111", "192.168.1.2->tun_dst"}, noMatch: []string{"192.168.0.2", "192.168.2.2"}},
+	); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Once node3 is processed, the multicast flows include it again
+	if err := hsw.updateHostSubnet(hs3); err != nil {
+		t.Fatalf("Unexpected error adding HostSubnet: %v", err)
+	}
+	if err := assertHostSubnetFlowChanges(hsw, &flows,
+		flowChange{kind: flowRemoved, match: []string{"table=111", "192.168.1.2->tun_dst"}, noMatch: []string{"192.168.2.2"}},
+		flowChange{kind: flowAdded, match: []string{"table=111", "192.168.1.2->tun_dst", "192.168.2.2->tun_dst"}, noMatch: []string{"192.168.0.2"}},
+	); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestHostSubnetDuplicateHostIP(t *testing.T) {
+	hsw, flows := setupHostSubnetWatcher(t)
+
+	hs1 := makeHostSubnet("node1", "192.168.0.2", "10.128.0.0/23")
+	if err := hsw.updateHostSubnet(hs1); err != nil {
+		t.Fatalf("Unexpected error adding HostSubnet: %v", err)
+	}
+	flows, err := hsw.oc.ovs.DumpFlows("")
+	if err != nil {
+		t.Fatalf("Unexpected error dumping OVS flows: %v", err)
+	}
+
+	// A duplicate HostSubnet is ignored
+	hs2 := makeHostSubnet("node2", "192.168.0.2", "10.129.0.0/23")
+	hs2.Annotations = map[string]string{common.DuplicateHostIPAnnotation: "node1"}
+	if err := hsw.updateHostSubnet(hs2); err != nil {
+		t.Fatalf("Unexpected error adding HostSubnet: %v", err)
+	}
+	if err := assertHostSubnetFlowChanges(hsw, &flows); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// A HostSubnet that is marked as a duplicate after being added is removed
+	hs1 = hs1.DeepCopy()
+	hs1.Annotations = map[string]string{common.DuplicateHostIPAnnotation: "node0"}
+	if err := hsw.updateHostSubnet(hs1); err != nil {
+		t.Fatalf("Unexpected error updating HostSubnet: %v", err)
+	}
+	err = assertHostSubnetFlowChanges(hsw, &flows,
+		flowChange{
+			kind:  flowRemoved,
+			match: []string{"table=10", "tun_src=192.168.0.2"},
+		},
+		flowChange{
+			kind:  flowRemoved,
+			match: []string{"table=50", "arp", "arp_tpa=10.128.0.0/23", "192.168.0.2->tun_dst"},
+		},
+		flowChange{
+			kind:  flowRemoved,
+			match: []string{"table=90", "ip", "nw_dst=10.128.0.0/23", "192.168.0.2->tun_dst"},
+		},
+		flowChange{
+			kind:  flowRemoved,
+			match: []string{"table=111", "192.168.0.2->tun_dst"},
+		},
+		flowChange{
+			kind:    flowAdded,
+			match:   []string{"table=111", "goto_table:120"},
+			noMatch: []string{"tun_dst"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(hsw.hostSubnetMap) != 0 {
+		t.Fatalf("Unexpected HostSubnets in map: %v", hsw.hostSubnetMap)
+	}
+}
+
+// commitCountingOVS is an ovs.Interface that counts transaction commits
+type commitCountingOVS struct {
+	ovs.Interface
+	commits int
+}
+
+func (c *commitCountingOVS) NewTransaction() ovs.Transaction {
+	return &commitCountingTx{Transaction: c.Interface.NewTransaction(), c: c}
+}
+
+type commitCountingTx struct {
+	ovs.Transaction
+	c *commitCountingOVS
+}
+
+func (tx *commitCountingTx) Commit() error {
+	tx.c.commits++
+	return tx.Transaction.Commit()
+}
+
+func TestHostSubnetSingleCommit(t *testing.T) {
+	hsw, flows := setupHostSubnetWatcher(t)
+	counter := &commitCountingOVS{Interface: hsw.oc.ovs}
+	hsw.oc.ovs = counter
+
+	hs1 := makeHostSubnet("node1", "192.168.0.2", "10.128.0.0/23")
+	hs2 := makeHostSubnet("node2", "192.168.1.2", "10.129.0.0/23")
+	hs3 := makeHostSubnet("node3", "192.168.2.2", "10.130.0.0/23")
+	for _, hs := range []*osdnv1.HostSubnet{hs1, hs2, hs3} {
+		if err := hsw.updateHostSubnet(hs); err != nil {
+			t.Fatalf("Unexpected error adding HostSubnet: %v", err)
+		}
+	}
+	// Each HostSubnet's flows and the multicast flows are added together
+	if counter.commits != 3 {
+		t.Fatalf("expected 3 commits, got %d", counter.commits)
+	}
+
+	// The stale flows for node1 and node2 are all removed together
+	hsw = newHostSubnetWatcher(hsw.oc, hsw.hostName, hsw.localIP, hsw.networkInfo)
+	if err := hsw.updateHostSubnet(hs3); err != nil {
+		t.Fatalf("Unexpected error adding HostSubnet: %v", err)
+	}
+	counter.commits = 0
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(hs3)
+	if err := hsw.removeStaleHostSubnets(osdnlisters.NewHostSubnetLister(indexer)); err != nil {
+		t.Fatalf("Unexpected error removing stale HostSubnets: %v", err)
+	}
+	if counter.commits != 1 {
+		t.Fatalf("expected 1 commit, got %d", counter.commits)
+	}
+	if err := assertHostSubnetFlowChanges(hsw, &flows,
+		flowChange{kind: flowAdded, match: []string{"table=10", "tun_src=192.168.2.2"}},
+		flowChange{kind: flowAdded, match: []string{"table=50", "arp_tpa=10.130.0.0/23"}},
+		flowChange{kind: flowAdded, match: []string{"table=90", "nw_dst=10.130.0.0/23"}},
+		flowChange{kind: flowRemoved, match: []string{"table=111", "goto_table:120"}, noMatch: []string{"->tun_dst"}},
+		flowChange{kind: flowAdded, match: []string{"table=111", "192.168.2.2->tun_dst"}, noMatch: []string{"192.168.0.2", "192.168.1.2"}},
+	); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestHostSubnetWatcherRouted(t *testing.T) {
+	hsw, flows := setupHostSubnetWatcher(t)
+	hsw.encapsulations.Insert(common.EncapsulationNone)
+	routes := map[string]string{}
+	// Only nodes on 192.168.0.0/24 are routed to directly
+	hsw.routeSubnet = func(hs *osdnv1.HostSubnet) bool {
+		return strings.HasPrefix(hs.HostIP, "192.168.0.")
+	}
+	hsw.updateRoute = func(subnet, hostIP string, add bool) error {
+		if add {
+			routes[subnet] = hostIP
+		} else {
+			delete(routes, subnet)
+		}
+		return nil
+	}
+
+	hs1 := makeHostSubnetWithEncapsulations("node1", "192.168.0.2", "10.128.0.0/23", common.EncapsulationNone)
+	if err := hsw.updateHostSubnet(hs1); err != nil {
+		t.Fatalf("Unexpected error adding HostSubnet: %v", err)
+	}
+	err := assertHostSubnetFlowChanges(hsw, &flows,
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=0", "in_port=2", "arp", "arp_spa=10.128.0.0/23", "goto_table:30"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=10", "tun_src=192.168.0.2"},
+		},
+		flowChange{
+			kind:    flowAdded,
+			match:   []string{"table=50", "arp", "arp_tpa=10.128.0.0/23", "actions=output:2"},
+			noMatch: []string{"tun_dst"},
+		},
+		flowChange{
+			kind:    flowAdded,
+			match:   []string{"table=90", "ip", "nw_dst=10.128.0.0/23", "actions=output:2"},
+			noMatch: []string{"tun_dst"},
+		},
+		flowChange{
+			kind:    flowRemoved,
+			match:   []string{"table=111", "goto_table:120"},
+			noMatch: []string{"->tun_dst"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=111", "192.168.0.2->tun_dst"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(routes) != 1 || routes["10.128.0.0/23"] != "192.168.0.2" {
+		t.Fatalf("Unexpected routes %v", routes)
+	}
+
+	// Nodes on other networks are still reached over VXLAN
+	hs2 := makeHostSubnetWithEncapsulations("node2", "192.168.1.2", "10.129.0.0/23", common.EncapsulationNone)
+	if err := hsw.updateHostSubnet(hs2); err != nil {
+		t.Fatalf("Unexpected error adding HostSubnet: %v", err)
+	}
+	err = assertHostSubnetFlowChanges(hsw, &flows,
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=10", "tun_src=192.168.1.2"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=50", "arp", "arp_tpa=10.129.0.0/23", "192.168.1.2->tun_dst"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=90", "ip", "nw_dst=10.129.0.0/23", "192.168.1.2->tun_dst"},
+		},
+		flowChange{
+			kind:  flowRemoved,
+			match: []string{"table=111", "192.168.0.2->tun_dst"},
+		},
+		flowChange{
+			kind:  flowAdded,
+			match: []string{"table=111", "192.168.0.2->tun_dst", "192.168.1.2->tun_dst"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(routes) != 1 {
+		t.Fatalf("Unexpected routes %v", routes)
+	}
+
+	// Moving the node updates the route
+	hs1 = makeHostSubnetWithEncapsulations("node1", "192.168.0.3", "10.128.0.0/23", common.EncapsulationNone)
+	if err := hsw.updateHostSubnet(hs1); err != nil {
+		t.Fatalf("Unexpected error updating HostSubnet: %v", err)
+	}
+	if len(routes) != 1 || routes["10.128.0.0/23"] != "192.168.0.3" {
+		t.Fatalf("Unexpected routes %v", routes)
+	}
+
+	// Moving the other node onto the same network switches it to routing
+	hs2 = makeHostSubnetWithEncapsulations("node2", "192.168.0.4", "10.129.0.0/23", common.EncapsulationNone)
+	if err := hsw.updateHostSubnet(hs2); err != nil {
+		t.Fatalf("Unexpected error updating HostSubnet: %v", err)
+	}
+	if len(routes) != 2 || routes["10.129.0.0/23"] != "192.168.0.4" {
+		t.Fatalf("Unexpected routes %v", routes)
+	}
+	flows, _ = hsw.oc.ovs.DumpFlows("table=90, ip, nw_dst=10.129.0.0/23")
+	if len(flows) != 1 || !strings.Contains(flows[0], "actions=output:2") {
+		t.Fatalf("Unexpected flows %v", flows)
+	}
+
+	// A node on the same network that doesn't support routing is still reached
+	// over VXLAN
+	hs2 = makeHostSubnet("node2", "192.168.0.4", "10.129.0.0/23")
+	if err := hsw.updateHostSubnet(hs2); err != nil {
+		t.Fatalf("Unexpected error updating HostSubnet: %v", err)
+	}
+	if len(routes) != 1 {
+		t.Fatalf("Unexpected routes %v", routes)
+	}
+	flows, _ = hsw.oc.ovs.DumpFlows("table=90, ip, nw_dst=10.129.0.0/23")
+	if len(flows) != 1 || !strings.Contains(flows[0], "192.168.0.4->tun_dst,output:1") {
+		t.Fatalf("Unexpected flows %v", flows)
+	}
+	flows, _ = hsw.oc.ovs.DumpFlows("table=0, arp, arp_spa=10.129.0.0/23")
+	if len(flows) != 0 {
+		t.Fatalf("Unexpected flows %v", flows)
+	}
+
+	// Stale routes are removed, other than those to routed subnets
+	var kept []string
+	hsw.removeStaleRoutes = func(keep sets.String) error {
+		kept = keep.List()
+		return nil
+	}
+	if err := hsw.removeStaleHostSubnetRoutes(); err != nil {
+		t.Fatalf("Unexpected error removing stale routes: %v", err)
+	}
+	if !reflect.DeepEqual(kept, []string{"10.128.0.0/23"}) {
+		t.Fatalf("Unexpected routes kept %v", kept)
+	}
+	if err := hsw.deleteHostSubnet(hs2); err != nil {
+		t.Fatalf("Unexpected error deleting HostSubnet: %v", err)
+	}
+
+	if err := hsw.deleteHostSubnet(hs1); err != nil {
+		t.Fatalf("Unexpected error deleting HostSubnet: %v", err)
+	}
+	if len(routes) != 0 {
+		t.Fatalf("Unexpected routes %v", routes)
+	}
+}
+
+func TestHostSubnetWatcherEncapsulations(t *testing.T) {
+	hsw, _ := setupHostSubnetWatcher(t)
+	hsw.encapsulations.Insert(common.EncapsulationGeneve)
+
+	for _, tc := range []struct {
+		name   string
+		hs     *osdnv1.HostSubnet
+		output string
+	}{
+		{
+			name:   "node with only VXLAN",
+			hs:     makeHostSubnet("node1", "192.168.0.2", "10.128.0.0/23"),
+			output: "192.168.0.2->tun_dst,output:1",
+		},
+		{
+			name:   "node with Geneve",
+			hs:     makeHostSubnetWithEncapsulations("node2", "192.168.0.3", "10.129.0.0/23", "geneve"),
+			output: "192.168.0.3->tun_dst,output:3",
+		},
+		{
+			name:   "routed node with Geneve",
+			hs:     makeHostSubnetWithEncapsulations("node3", "192.168.0.4", "10.130.0.0/23", "none, geneve"),
+			output: "192.168.0.4->tun_dst,output:3",
+		},
+		{
+			name:   "node with unknown encapsulation",
+			hs:     makeHostSubnetWithEncapsulations("node4", "192.168.0.5", "10.131.0.0/23", "gre"),
+			output: "192.168.0.5->tun_dst,output:1",
+		},
+		{
+			name:   "node switching to Geneve",
+			hs:     makeHostSubnetWithEncapsulations("node1", "192.168.0.2", "10.128.0.0/23", "geneve"),
+			output: "192.168.0.2->tun_dst,output:3",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := hsw.updateHostSubnet(tc.hs); err != nil {
+				t.Fatalf("Unexpected error updating HostSubnet: %v", err)
+			}
+			for _, table := range []string{"table=50, arp", "table=90, ip"} {
+				flows, err := hsw.oc.ovs.DumpFlows("%s, nw_dst=%s", table, tc.hs.Subnet)
+				if err != nil {
+					t.Fatalf("Unexpected error dumping flows: %v", err)
+				}
+				if len(flows) != 1 || !strings.Contains(flows[0], tc.output) {
+					t.Fatalf("Unexpected flows %v", flows)
+				}
+			}
+		})
+	}
+}
+
+func TestHostSubnetWatcherMTU(t *testing.T) {
+	metrics.RegisterMetrics()
+	hsw, _ := setupHostSubnetWatcher(t)
+	recorder := record.NewFakeRecorder(10)
+	hsw.recorder = recorder
+
+	withMTU := func(hs *osdnv1.HostSubnet, mtu string) *osdnv1.HostSubnet {
+		hs.Annotations = map[string]string{common.HostSubnetUnderlayMTUAnnotation: mtu}
+		return hs
+	}
+	assertEvents := func(expected ...string) {
+		t.Helper()
+		for _, prefix := range expected {
+			select {
+			case event := <-recorder.Events:
+				if !strings.HasPrefix(event, prefix) {
+					t.Fatalf("expected event %q, got %q", prefix, event)
+				}
+			default:
+				t.Fatalf("expected event %q, got none", prefix)
+			}
+		}
+		select {
+		case event := <-recorder.Events:
+			t.Fatalf("unexpected event %q", event)
+		default:
+		}
+	}
+
+	// Nothing is compared until we know our own MTU
+	node2 := withMTU(makeHostSubnet("node2", "192.168.0.3", "10.129.0.0/23"), "1400")
+	for _, hs := range []*osdnv1.HostSubnet{
+		makeHostSubnet("node1", "192.168.0.2", "10.128.0.0/23"),
+		node2,
+		withMTU(makeHostSubnet("node3", "192.168.0.4", "10.130.0.0/23"), "bad"),
+	} {
+		if err := hsw.updateHostSubnet(hs); err != nil {
+			t.Fatalf("unexpected error updating HostSubnet: %v", err)
+		}
+	}
+	assertEvents()
+	if len(hsw.mtuMismatches) != 0 {
+		t.Fatalf("unexpected MTU mismatches %v", hsw.mtuMismatches)
+	}
+
+	hsw.setUnderlayMTU(1500)
+	assertEvents("Warning MTUMismatch Node local-node has underlay MTU 1500 but node node2 has 1400")
+	// Updating it again doesn't cause another event
+	if err := hsw.updateHostSubnet(node2); err != nil {
+		t.Fatalf("unexpected error updating HostSubnet: %v", err)
+	}
+	assertEvents()
+	if hsw.mtuMismatches["node2"] != (mtuMismatch{local: 1500, peer: 1400}) {
+		t.Fatalf("unexpected MTU mismatches %v", hsw.mtuMismatches)
+	}
+
+	// Changing our MTU to match clears the mismatch
+	hsw.setUnderlayMTU(1400)
+	assertEvents()
+	if len(hsw.mtuMismatches) != 0 {
+		t.Fatalf("unexpected MTU mismatches %v", hsw.mtuMismatches)
+	}
+
+	node3 := withMTU(makeHostSubnet("node3", "192.168.0.4", "10.130.0.0/23"), "9000")
+	if err := hsw.updateHostSubnet(node3); err != nil {
+		t.Fatalf("unexpected error updating HostSubnet: %v", err)
+	}
+	assertEvents("Warning MTUMismatch Node local-node has underlay MTU 1400 but node node3 has 9000")
+	if err := hsw.deleteHostSubnet(node3); err != nil {
+		t.Fatalf("unexpected error deleting HostSubnet: %v", err)
+	}
+	if len(hsw.mtuMismatches) != 0 || len(hsw.peerMTUs) != 1 {
+		t.Fatalf("unexpected MTU state %v %v", hsw.mtuMismatches, hsw.peerMTUs)
+	}
+}
@@ -0,0 +1,497 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/hwaddr"
+	"github.com/vishvananda/netlink"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// PacketTraceQuery describes a packet to trace through the node's OVS bridge. The
+// packet enters the bridge from the pod with SrcIP if it is a local pod, the way
+// that traffic from the pod's node arrives (over VXLAN or Geneve, or routed via
+// tun0) if it is a pod on another node, or from tun0 otherwise.
+type PacketTraceQuery struct {
+	SrcIP string `json:"srcIP"`
+	// SrcNamespace is the namespace of the pod with SrcIP. It is used to find
+	// the VNID of traffic from a pod on another node; if it is not set, the
+	// traffic is traced as coming from VNID 0.
+	SrcNamespace string `json:"srcNamespace,omitempty"`
+	DstIP        string `json:"dstIP"`
+	Protocol     string `json:"protocol"`
+	Port         int    `json:"port"`
+}
+
+// PacketTraceStep is one flow that the traced packet matched (or, if Match is
+// empty and Priority is -1, a table where it matched no flow)
+type PacketTraceStep struct {
+	Table     int    `json:"table"`
+	TableName string `json:"tableName,omitempty"`
+	Match     string `json:"match"`
+	Priority  int    `json:"priority"`
+	Cookie    string `json:"cookie,omitempty"`
+	// Owner is the object that the flow belongs to, if its cookie identifies one
+	Owner   string   `json:"owner,omitempty"`
+	Actions []string `json:"actions,omitempty"`
+	// Notes are ofproto/trace's explanations of the actions
+	Notes []string `json:"notes,omitempty"`
+}
+
+// PacketTrace is the result of tracing a PacketTraceQuery
+type PacketTrace struct {
+	// Flow is the ofproto/trace flow that described the packet
+	Flow  string            `json:"flow"`
+	Steps []PacketTraceStep `json:"steps"`
+	// DatapathActions are the final datapath actions, eg "drop"
+	DatapathActions string `json:"datapathActions"`
+	Dropped         bool   `json:"dropped"`
+	// DropTable is the table of the last step, if the packet was dropped
+	DropTable *int `json:"dropTable,omitempty"`
+	// OutputPorts are the names of the ports that the packet was sent to
+	OutputPorts []string `json:"outputPorts,omitempty"`
+	// Verdict summarizes the trace, eg "dropped in table 80 (IP policy enforcement)"
+	Verdict string `json:"verdict"`
+}
+
+// traceTableNames are the descriptions of the tables (see addStaticFlows)
+var traceTableNames = map[int]string{
+	0:   "dispatch by input port",
+	10:  "VXLAN ingress filtering",
+	20:  "from pod",
+	21:  "from pod: connection tracking",
+	25:  "from pod via service IP",
+	30:  "general routing",
+	40:  "ARP to local pod",
+	50:  "ARP to remote pod",
+	60:  "IP to service",
+	70:  "IP to local pod",
+	80:  "IP policy enforcement",
+	81:  "IP allowed by policy",
+	90:  "IP to remote pod",
+	99:  "egress DNS exceptions",
+	100: "egress network policy",
+	101: "egress routing",
+	110: "outbound multicast filtering",
+	111: "multicast to VXLAN",
+	120: "multicast to local pods",
+}
+
+// buildTraceFlow returns the ofproto/trace flow describing q's packet
+func (node *OsdnNode) buildTraceFlow(q *PacketTraceQuery) (string, error) {
+	srcIP := net.ParseIP(q.SrcIP)
+	if srcIP == nil || srcIP.To4() == nil {
+		return "", fmt.Errorf("invalid source IP %q", q.SrcIP)
+	}
+	dstIP := net.ParseIP(q.DstIP)
+	if dstIP == nil || dstIP.To4() == nil {
+		return "", fmt.Errorf("invalid destination IP %q", q.DstIP)
+	}
+	protocol := strings.ToLower(q.Protocol)
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	switch protocol {
+	case "tcp", "udp", "sctp":
+		if q.Port <= 0 || q.Port > 65535 {
+			return "", fmt.Errorf("invalid port %d", q.Port)
+		}
+	case "icmp":
+	default:
+		return "", fmt.Errorf("unsupported protocol %q", q.Protocol)
+	}
+
+	source, err := node.traceSource(srcIP, q.SrcNamespace)
+	if err != nil {
+		return "", err
+	}
+	fields := []string{protocol, source, "nw_src=" + srcIP.String(), "nw_dst=" + dstIP.String(), "nw_ttl=64"}
+	if protocol != "icmp" {
+		fields = append(fields, fmt.Sprintf("%s_dst=%d", protocol, q.Port))
+	}
+	return strings.Join(fields, ","), nil
+}
+
+// traceSource returns the flow fields describing where a traced packet from srcIP
+// (in srcNamespace, if known) enters the bridge
+func (node *OsdnNode) traceSource(srcIP net.IP, srcNamespace string) (string, error) {
+	ofports, err := node.oc.ovs.FindOne("interface", "ofport", "external_ids:ip="+srcIP.String())
+	if err != nil {
+		return "", fmt.Errorf("could not look up pod with IP %s: %v", srcIP, err)
+	}
+	if len(ofports) > 0 {
+		mac, err := hwaddr.GenerateHardwareAddr4(srcIP, hwaddr.PrivateMACPrefix)
+		if err != nil {
+			return "", err
+		}
+		source := fmt.Sprintf("in_port=%s,dl_src=%s", ofports[0], mac)
+		if node.oc.tunMAC != "" {
+			source += ",dl_dst=" + node.oc.tunMAC
+		}
+		return source, nil
+	}
+
+	if node.networkInfo != nil && node.networkInfo.PodNetworkContains(srcIP) {
+		subnets, err := node.osdnInformers.Network().V1().HostSubnets().Lister().List(labels.Everything())
+		if err != nil {
+			return "", err
+		}
+		for _, hs := range subnets {
+			_, subnet, err := net.ParseCIDR(hs.Subnet)
+			if err != nil || !subnet.Contains(srcIP) {
+				continue
+			}
+			if hs.HostIP == node.getLocalIP() {
+				return "", fmt.Errorf("no local pod has IP %s", srcIP)
+			}
+			encap := common.EncapsulationVXLAN
+			if node.hsw != nil {
+				encap = node.hsw.getEncapsulation(hs)
+			}
+			switch encap {
+			case common.EncapsulationNone:
+				// Routed traffic arrives from the node's network via tun0
+				return "in_port=2", nil
+			case common.EncapsulationGeneve:
+				return fmt.Sprintf("in_port=%d,tun_src=%s,tun_id=%d", geneve0OFPort, hs.HostIP, node.traceSourceVNID(srcNamespace)), nil
+			default:
+				return fmt.Sprintf("in_port=1,tun_src=%s,tun_id=%d", hs.HostIP, node.traceSourceVNID(srcNamespace)), nil
+			}
+		}
+		return "", fmt.Errorf("no node has a subnet containing %s", srcIP)
+	}
+
+	return "in_port=2", nil
+}
+
+// traceSourceVNID returns the VNID of namespace, or 0 if it is not known
+func (node *OsdnNode) traceSourceVNID(namespace string) uint32 {
+	if namespace == "" {
+		return 0
+	}
+	vnid, err := node.policy.GetVNID(namespace)
+	if err != nil {
+		return 0
+	}
+	return vnid
+}
+
+var (
+	traceStepRE   = regexp.MustCompile(`^\s*(\d+)\. (.*)$`)
+	traceMatchRE  = regexp.MustCompile(`^(?:(.*), )?priority (\d+)(?:, cookie (0x[0-9a-f]+))?$`)
+	traceOutputRE = regexp.MustCompile(`^(?:output:|-> output port is |output port is )(\d+)`)
+)
+
+// parseTrace parses the output of ofproto/trace
+func parseTrace(output string) (*PacketTrace, error) {
+	trace := &PacketTrace{}
+	var step *PacketTraceStep
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "Flow: ") && trace.Flow == "":
+			trace.Flow = strings.TrimPrefix(line, "Flow: ")
+		case strings.HasPrefix(line, "Datapath actions: "):
+			trace.DatapathActions = strings.TrimPrefix(line, "Datapath actions: ")
+			step = nil
+		case strings.HasPrefix(line, "bridge(") || strings.HasPrefix(line, "Final flow: "):
+			step = nil
+		case traceStepRE.MatchString(line):
+			m := traceStepRE.FindStringSubmatch(line)
+			table, _ := strconv.Atoi(m[1])
+			trace.Steps = append(trace.Steps, PacketTraceStep{Table: table, TableName: traceTableNames[table], Priority: -1})
+			step = &trace.Steps[len(trace.Steps)-1]
+			if m[2] == "No match." {
+				continue
+			}
+			fm := traceMatchRE.FindStringSubmatch(m[2])
+			if fm == nil {
+				return nil, fmt.Errorf("could not parse trace line %q", line)
+			}
+			step.Match = fm[1]
+			step.Priority, _ = strconv.Atoi(fm[2])
+			step.Cookie = fm[3]
+			step.Owner = traceFlowOwner(fm[3])
+		case step != nil && trimmed != "":
+			if strings.HasPrefix(trimmed, "->") {
+				step.Notes = append(step.Notes, strings.TrimSpace(strings.TrimPrefix(trimmed, "->")))
+			} else {
+				step.Actions = append(step.Actions, trimmed)
+			}
+		}
+	}
+	if trace.DatapathActions == "" {
+		return nil, fmt.Errorf("trace has no datapath actions")
+	}
+	trace.Dropped = trace.DatapathActions == "drop"
+	return trace, nil
+}
+
+// traceFlowOwner describes the owner of a flow with the given cookie
+func traceFlowOwner(cookie string) string {
+	class, _ := parseFlowCookie(cookie)
+	if _, ok := flowOwnerClassNames[class]; !ok || class == flowOwnerNone {
+		return ""
+	}
+	value, _ := strconv.ParseUint(cookie, 0, 64)
+	hash := (value >> flowOwnerHashShift) & (1<<flowOwnerHashBits - 1)
+	switch class {
+	case flowOwnerPod:
+		return fmt.Sprintf("pod %s", net.IPv4(byte(hash>>24), byte(hash>>16), byte(hash>>8), byte(hash)))
+	case flowOwnerPolicy, flowOwnerEgress:
+		if hash < 1<<24 {
+			return fmt.Sprintf("%s for VNID %d", class, hash)
+		}
+	}
+	return class.String()
+}
+
+// annotateTrace fills in trace's OutputPorts and Verdict, using portNames to name
+// the OpenFlow ports
+func annotateTrace(trace *PacketTrace, portNames map[string]string) {
+	if trace.Dropped {
+		if len(trace.Steps) == 0 {
+			trace.Verdict = "dropped"
+			return
+		}
+		last := trace.Steps[len(trace.Steps)-1]
+		trace.DropTable = &last.Table
+		trace.Verdict = fmt.Sprintf("dropped in table %d", last.Table)
+		if last.TableName != "" {
+			trace.Verdict += fmt.Sprintf(" (%s)", last.TableName)
+		}
+		if last.Priority == -1 {
+			trace.Verdict += " because no flow matched"
+		}
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, step := range trace.Steps {
+		for _, line := range append(append([]string{}, step.Actions...), step.Notes...) {
+			m := traceOutputRE.FindStringSubmatch(line)
+			if m == nil || seen[m[1]] {
+				continue
+			}
+			seen[m[1]] = true
+			name := portNames[m[1]]
+			if name == "" {
+				name = "port " + m[1]
+			}
+			trace.OutputPorts = append(trace.OutputPorts, name)
+		}
+	}
+	if len(trace.OutputPorts) == 0 {
+		trace.Verdict = "forwarded (" + trace.DatapathActions + ")"
+	} else {
+		trace.Verdict = "output to " + strings.Join(trace.OutputPorts, ", ")
+	}
+}
+
+// TracePacket traces the packet described by q through the node's OVS bridge with
+// ofproto/trace, and returns the flows that it matched and what happened to it
+func (node *OsdnNode) TracePacket(q *PacketTraceQuery) (*PacketTrace, error) {
+	flow, err := node.buildTraceFlow(q)
+	if err != nil {
+		return nil, err
+	}
+	output, err := node.oc.ovs.Trace(flow)
+	if err != nil {
+		return nil, fmt.Errorf("could not trace %q: %v", flow, err)
+	}
+	trace, err := parseTrace(output)
+	if err != nil {
+		return nil, err
+	}
+
+	portNames := make(map[string]string)
+	if ports, err := node.oc.ovs.Find("interface", []string{"name", "ofport"}, "name!=\"\""); err == nil {
+		for _, port := range ports {
+			portNames[port["ofport"]] = port["name"]
+		}
+	}
+	annotateTrace(trace, portNames)
+	return trace, nil
+}
+
+// ServePacketTrace is an HTTP handler for TracePacket, taking the fields of a
+// PacketTraceQuery as query parameters, eg
+// "?srcIP=10.128.0.5&dstIP=10.129.0.8&protocol=tcp&port=8080"
+func (node *OsdnNode) ServePacketTrace(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := &PacketTraceQuery{
+		SrcIP:        params.Get("srcIP"),
+		SrcNamespace: params.Get("srcNamespace"),
+		DstIP:        params.Get("dstIP"),
+		Protocol:     params.Get("protocol"),
+	}
+	if portStr := params.Get("port"); portStr != "" {
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid port %q", portStr), http.StatusBadRequest)
+			return
+		}
+		q.Port = port
+	}
+
+	trace, err := node.TracePacket(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(trace); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Results of a probe
+const (
+	// ProbeConnected means that the destination accepted the connection
+	ProbeConnected = "Connected"
+	// ProbeRefused means that the destination was reached but nothing was
+	// listening on the port
+	ProbeRefused = "Refused"
+	// ProbeFailed means that the destination could not be reached
+	ProbeFailed = "Failed"
+)
+
+// probeTimeout is how long a probe waits for a connection
+var probeTimeout = 3 * time.Second
+
+// podNetNSDirs are the directories where the container runtime pins pods' network
+// namespaces
+var podNetNSDirs = []string{"/var/run/netns", "/run/netns"}
+
+// ProbeResult is the result of Probe
+type ProbeResult struct {
+	Result  string `json:"result"`
+	Error   string `json:"error,omitempty"`
+	Latency string `json:"latency,omitempty"`
+}
+
+// Probe tries to open a TCP connection from the local pod with IP srcIP to port on
+// the pod with IP dstIP, to check that traffic actually gets there (in addition to
+// what the OVS flows say). The connection is made from the source pod's network
+// namespace, so it takes the same path through OVS (including NetworkPolicy) as
+// the pod's own traffic. Only pod IPs can be probed.
+func (node *OsdnNode) Probe(srcIP, dstIP string, port int) (*ProbeResult, error) {
+	if ip := net.ParseIP(srcIP); ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid source IP %q", srcIP)
+	}
+	if ip := net.ParseIP(dstIP); ip == nil || ip.To4() == nil || node.networkInfo == nil || !node.networkInfo.PodNetworkContains(ip) {
+		return nil, fmt.Errorf("invalid destination IP %q: must be a pod IP", dstIP)
+	}
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", port)
+	}
+	names, err := node.oc.ovs.FindOne("interface", "name", "external_ids:ip="+srcIP)
+	if err != nil {
+		return nil, fmt.Errorf("could not look up pod with IP %s: %v", srcIP, err)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no local pod has IP %s", srcIP)
+	}
+	podNS, err := podNetNS(names[0])
+	if err != nil {
+		return nil, err
+	}
+	defer podNS.Close()
+
+	var result *ProbeResult
+	err = podNS.Do(func(ns.NetNS) error {
+		result = probeConnect(func() (net.Conn, error) {
+			return net.DialTimeout("tcp", net.JoinHostPort(dstIP, strconv.Itoa(port)), probeTimeout)
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not enter network namespace of pod %s: %v", srcIP, err)
+	}
+	return result, nil
+}
+
+// probeConnect connects with dial and returns the result
+func probeConnect(dial func() (net.Conn, error)) *ProbeResult {
+	start := time.Now()
+	conn, err := dial()
+	result := &ProbeResult{Latency: time.Since(start).String()}
+	switch {
+	case err == nil:
+		conn.Close()
+		result.Result = ProbeConnected
+	case errors.Is(err, syscall.ECONNREFUSED):
+		result.Result = ProbeRefused
+	default:
+		result.Result = ProbeFailed
+		result.Error = err.Error()
+		result.Latency = ""
+	}
+	return result
+}
+
+// podNetNS returns the network namespace of the pod whose host-side veth is
+// vethName, by finding the pinned network namespace with the netns ID of the veth's
+// peer
+func podNetNS(vethName string) (ns.NetNS, error) {
+	link, err := netlink.LinkByName(vethName)
+	if err != nil {
+		return nil, fmt.Errorf("could not find pod interface %s: %v", vethName, err)
+	}
+	nsid := link.Attrs().NetNsID
+	if nsid < 0 {
+		return nil, fmt.Errorf("pod interface %s has no peer network namespace", vethName)
+	}
+	for _, dir := range podNetNSDirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			podNS, err := ns.GetNS(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				continue
+			}
+			if id, err := netlink.GetNetNsIdByFd(int(podNS.Fd())); err == nil && id == nsid {
+				return podNS, nil
+			}
+			podNS.Close()
+		}
+	}
+	return nil, fmt.Errorf("could not find network namespace of pod interface %s", vethName)
+}
+
+// ServeProbe is an HTTP handler for Probe, taking "srcIP", "dstIP", and "port"
+// query parameters
+func (node *OsdnNode) ServeProbe(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	port, err := strconv.Atoi(params.Get("port"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid port %q", params.Get("port")), http.StatusBadRequest)
+		return
+	}
+	result, err := node.Probe(params.Get("srcIP"), params.Get("dstIP"), port)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
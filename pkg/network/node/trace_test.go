@@ -0,0 +1,280 @@
+package node
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	osdninformers "github.com/openshift/client-go/network/informers/externalversions"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+const testTraceOutput = `Flow: tcp,in_port=3,vlan_tci=0x0000,dl_src=0a:58:0a:80:00:02,dl_dst=c6:ac:2c:13:48:4b,nw_src=10.128.0.2,nw_dst=10.128.0.3,nw_tos=0,nw_ecn=0,nw_ttl=64,tp_src=0,tp_dst=8080,tcp_flags=0
+
+bridge("br0")
+-------------
+ 0. ip, priority 100
+    goto_table:20
+20. ip,in_port=3,nw_src=10.128.0.2, priority 100, cookie 0x100000a80000200
+    load:0x2a->NXM_NX_REG0[]
+    goto_table:21
+21. priority 0
+    goto_table:30
+30. ip,nw_dst=10.128.0.0/23, priority 200
+    goto_table:70
+70. ip,nw_dst=10.128.0.3, priority 100, cookie 0x100000a80000300
+    load:0x2a->NXM_NX_REG1[]
+    load:0x4->NXM_NX_REG2[]
+    goto_table:80
+80. ip,reg0=0x2a,reg1=0x2a, priority 50, cookie 0x300000000002a00
+    output:NXM_NX_REG2[]
+     -> output port is 4
+
+Final flow: unchanged
+Megaflow: recirc_id=0,eth,tcp,in_port=3,nw_src=10.128.0.2,nw_dst=10.128.0.3,nw_frag=no
+Datapath actions: 4
+`
+
+const testTraceDropOutput = `Flow: tcp,in_port=3,vlan_tci=0x0000,dl_src=0a:58:0a:80:00:02,dl_dst=c6:ac:2c:13:48:4b,nw_src=10.128.0.2,nw_dst=10.128.0.3,nw_tos=0,nw_ecn=0,nw_ttl=64,tp_src=0,tp_dst=8080,tcp_flags=0
+
+bridge("br0")
+-------------
+ 0. ct_state=-trk,ip, priority 300
+    ct(table=0)
+    drop
+     -> A clone of the packet is forked to recirculate. The forked pipeline will be resumed at table 0.
+
+Final flow: unchanged
+Megaflow: recirc_id=0,ct_state=-trk,eth,ip,in_port=3,nw_frag=no
+Datapath actions: ct,recirc(0x1)
+
+===============================================================================
+recirc(0x1) - resume conntrack with default ct_state=trk|new (use --ct-next to customize)
+===============================================================================
+
+Flow: recirc_id=0x1,ct_state=new|trk,eth,tcp,in_port=3,nw_src=10.128.0.2,nw_dst=10.128.0.3
+
+bridge("br0")
+-------------
+    thaw
+        Resuming from table 0
+ 0. ip, priority 100
+    goto_table:20
+80. No match.
+    drop
+
+Final flow: unchanged
+Megaflow: recirc_id=0x1,ct_state=new|trk,eth,tcp,in_port=3,nw_frag=no
+Datapath actions: drop
+`
+
+func TestParseTrace(t *testing.T) {
+	trace, err := parseTrace(testTraceOutput)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	annotateTrace(trace, map[string]string{"4": "veth2"})
+
+	if len(trace.Steps) != 6 {
+		t.Fatalf("expected 6 steps, got %#v", trace.Steps)
+	}
+	expected := PacketTraceStep{
+		Table:     80,
+		TableName: "IP policy enforcement",
+		Match:     "ip,reg0=0x2a,reg1=0x2a",
+		Priority:  50,
+		Cookie:    "0x300000000002a00",
+		Owner:     "policy for VNID 42",
+		Actions:   []string{"output:NXM_NX_REG2[]"},
+		Notes:     []string{"output port is 4"},
+	}
+	if !reflect.DeepEqual(trace.Steps[5], expected) {
+		t.Fatalf("expected last step %#v, got %#v", expected, trace.Steps[5])
+	}
+	if trace.Steps[1].Owner != "pod 10.128.0.2" {
+		t.Fatalf("unexpected owner of table 20 flow %q", trace.Steps[1].Owner)
+	}
+	if trace.Steps[2].Match != "" || trace.Steps[2].Priority != 0 {
+		t.Fatalf("unexpected table 21 step %#v", trace.Steps[2])
+	}
+	if trace.Dropped || trace.DatapathActions != "4" {
+		t.Fatalf("unexpected result %q", trace.DatapathActions)
+	}
+	if !reflect.DeepEqual(trace.OutputPorts, []string{"veth2"}) || trace.Verdict != "output to veth2" {
+		t.Fatalf("unexpected output %v / %q", trace.OutputPorts, trace.Verdict)
+	}
+
+	trace, err = parseTrace(testTraceDropOutput)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	annotateTrace(trace, nil)
+	if len(trace.Steps) != 3 {
+		t.Fatalf("expected 3 steps, got %#v", trace.Steps)
+	}
+	if !trace.Dropped || trace.DropTable == nil || *trace.DropTable != 80 {
+		t.Fatalf("expected drop in table 80, got %#v", trace)
+	}
+	if trace.Verdict != "dropped in table 80 (IP policy enforcement) because no flow matched" {
+		t.Fatalf("unexpected verdict %q", trace.Verdict)
+	}
+	if trace.Flow[:4] != "tcp," {
+		t.Fatalf("unexpected flow %q", trace.Flow)
+	}
+
+	if _, err := parseTrace("ovs-appctl: cannot connect"); err == nil {
+		t.Fatalf("unexpected success parsing bad output")
+	}
+}
+
+func TestBuildTraceFlow(t *testing.T) {
+	_, oc, _ := setupOVSController(t)
+	if _, err := oc.SetUpPod(context.TODO(), "pod1", "veth1", net.ParseIP("10.128.0.2"), nil, 42); err != nil {
+		t.Fatalf("unexpected error setting up pod: %v", err)
+	}
+
+	mp := NewMultiTenantPlugin().(*multiTenantPlugin)
+	mp.vnids = newNodeVNIDMap(mp, nil)
+	mp.vnids.setVNID("alpha", 11, false)
+
+	osdnInformers := osdninformers.NewSharedInformerFactory(nil, 0)
+	osdnInformers.Network().V1().HostSubnets().Informer().GetIndexer().Add(makeHostSubnet("node0", "172.17.0.4", "10.128.0.0/23"))
+	osdnInformers.Network().V1().HostSubnets().Informer().GetIndexer().Add(makeHostSubnet("node1", "172.17.0.5", "10.128.2.0/23"))
+	osdnInformers.Network().V1().HostSubnets().Informer().GetIndexer().Add(makeHostSubnetWithEncapsulations("node2", "172.17.0.6", "10.128.4.0/23", common.EncapsulationGeneve))
+
+	_, clusterCIDR, _ := net.ParseCIDR("10.128.0.0/14")
+	networkInfo := &common.ParsedClusterNetwork{
+		ClusterNetworks: []common.ParsedClusterNetworkEntry{{ClusterCIDR: clusterCIDR, HostSubnetLength: 9}},
+	}
+
+	node := &OsdnNode{
+		oc:            oc,
+		policy:        mp,
+		localIP:       "172.17.0.4",
+		networkInfo:   networkInfo,
+		osdnInformers: osdnInformers,
+		hsw: &hostSubnetWatcher{
+			encapsulations: sets.NewString(common.EncapsulationVXLAN, common.EncapsulationGeneve),
+		},
+	}
+
+	for _, tc := range []struct {
+		name  string
+		query PacketTraceQuery
+		flow  string
+		err   bool
+	}{
+		{
+			name:  "local pod",
+			query: PacketTraceQuery{SrcIP: "10.128.0.2", DstIP: "10.128.0.3", Protocol: "TCP", Port: 8080},
+			flow:  "tcp,in_port=3,dl_src=0a:58:0a:80:00:02,dl_dst=c6:ac:2c:13:48:4b,nw_src=10.128.0.2,nw_dst=10.128.0.3,nw_ttl=64,tcp_dst=8080",
+		},
+		{
+			name:  "remote pod",
+			query: PacketTraceQuery{SrcIP: "10.128.2.5", SrcNamespace: "alpha", DstIP: "10.128.0.2", Protocol: "udp", Port: 53},
+			flow:  "udp,in_port=1,tun_src=172.17.0.5,tun_id=11,nw_src=10.128.2.5,nw_dst=10.128.0.2,nw_ttl=64,udp_dst=53",
+		},
+		{
+			name:  "remote pod in unknown namespace",
+			query: PacketTraceQuery{SrcIP: "10.128.2.5", DstIP: "10.128.0.2", Protocol: "udp", Port: 53},
+			flow:  "udp,in_port=1,tun_src=172.17.0.5,tun_id=0,nw_src=10.128.2.5,nw_dst=10.128.0.2,nw_ttl=64,udp_dst=53",
+		},
+		{
+			name:  "remote pod via Geneve",
+			query: PacketTraceQuery{SrcIP: "10.128.4.5", SrcNamespace: "alpha", DstIP: "10.128.0.2", Protocol: "udp", Port: 53},
+			flow:  "udp,in_port=3,tun_src=172.17.0.6,tun_id=11,nw_src=10.128.4.5,nw_dst=10.128.0.2,nw_ttl=64,udp_dst=53",
+		},
+		{
+			name:  "external",
+			query: PacketTraceQuery{SrcIP: "192.168.1.1", DstIP: "10.128.0.2", Protocol: "icmp"},
+			flow:  "icmp,in_port=2,nw_src=192.168.1.1,nw_dst=10.128.0.2,nw_ttl=64",
+		},
+		{
+			name:  "missing local pod",
+			query: PacketTraceQuery{SrcIP: "10.128.0.9", DstIP: "10.128.0.2", Protocol: "icmp"},
+			err:   true,
+		},
+		{
+			name:  "missing port",
+			query: PacketTraceQuery{SrcIP: "10.128.0.2", DstIP: "10.128.0.3", Protocol: "tcp"},
+			err:   true,
+		},
+		{
+			name:  "bad protocol",
+			query: PacketTraceQuery{SrcIP: "10.128.0.2", DstIP: "10.128.0.3", Protocol: "gre"},
+			err:   true,
+		},
+	} {
+		flow, err := node.buildTraceFlow(&tc.query)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: unexpected success (%q)", tc.name, flow)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		} else if flow != tc.flow {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.flow, flow)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	dial := func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, probeTimeout)
+	}
+
+	if result := probeConnect(dial); result.Result != ProbeConnected {
+		t.Fatalf("expected connection to %s, got %#v", addr, result)
+	}
+	listener.Close()
+	if result := probeConnect(dial); result.Result != ProbeRefused {
+		t.Fatalf("expected connection to %s to be refused, got %#v", addr, result)
+	}
+
+	_, oc, _ := setupOVSController(t)
+	if _, err := oc.SetUpPod(context.TODO(), "pod1", "veth1", net.ParseIP("10.128.0.2"), nil, 42); err != nil {
+		t.Fatalf("unexpected error setting up pod: %v", err)
+	}
+	_, clusterCIDR, _ := net.ParseCIDR("10.128.0.0/14")
+	node := &OsdnNode{
+		oc: oc,
+		networkInfo: &common.ParsedClusterNetwork{
+			ClusterNetworks: []common.ParsedClusterNetworkEntry{{ClusterCIDR: clusterCIDR, HostSubnetLength: 9}},
+		},
+	}
+	for _, tc := range []struct {
+		name         string
+		srcIP, dstIP string
+		port         int
+	}{
+		{name: "host destination", srcIP: "10.128.0.2", dstIP: "127.0.0.1", port: 80},
+		{name: "metadata service", srcIP: "10.128.0.2", dstIP: "169.254.169.254", port: 80},
+		{name: "hostname", srcIP: "10.128.0.2", dstIP: "localhost", port: 80},
+		{name: "non-local source", srcIP: "10.128.0.9", dstIP: "10.129.0.5", port: 80},
+		{name: "port 0", srcIP: "10.128.0.2", dstIP: "10.129.0.5", port: 0},
+	} {
+		if _, err := node.Probe(tc.srcIP, tc.dstIP, tc.port); err == nil {
+			t.Errorf("%s: unexpected success", tc.name)
+		}
+	}
+}
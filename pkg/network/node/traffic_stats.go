@@ -0,0 +1,146 @@
+package node
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/openshift/sdn/pkg/network/node/metrics"
+	"github.com/openshift/sdn/pkg/util/ovs"
+)
+
+// trafficKey identifies a single per-pod traffic accounting flow
+type trafficKey struct {
+	ofport    int
+	direction string
+	peer      string
+	// peerMatch is the flow's nw_dst (for tx) or nw_src (for rx), or "" if it
+	// matches all peers
+	peerMatch string
+}
+
+// trafficStats tracks the byte counts of the per-pod table 20 and 70 flows, so that
+// we can tell how much traffic each pod has sent and received since the last check
+type trafficStats struct {
+	lock       sync.Mutex
+	lastCounts map[trafficKey]uint64
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{
+		lastCounts: make(map[trafficKey]uint64),
+	}
+}
+
+// findLoadedValue returns the value that flow loads into reg, if any
+func findLoadedValue(flow *ovs.OvsFlow, reg string) (string, bool) {
+	for _, action := range flow.Actions {
+		if action.Name != "load" {
+			continue
+		}
+		parts := strings.SplitN(action.Value, "->", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[1], reg) {
+			return parts[0], true
+		}
+	}
+	return "", false
+}
+
+// parseTrafficCounts parses the output of "ovs-ofctl dump-flows br0" for tables 20
+// and 70 and returns the byte counts of the per-pod IPv4 flows. Table 20 flows
+// count traffic sent by the pod and table 70 flows count traffic received by it;
+// the traffic accounting cookies indicate pod and service peers, and everything
+// else is external.
+func parseTrafficCounts(flows []string) map[trafficKey]uint64 {
+	counts := make(map[trafficKey]uint64)
+	for _, flow := range flows {
+		parsed, err := ovs.ParseFlow(ovs.ParseForDump, flow)
+		if err != nil {
+			continue
+		}
+		if _, isIP := parsed.FindField("ip"); !isIP {
+			continue
+		}
+
+		var key trafficKey
+		var ofport string
+		var peerMatch *ovs.OvsField
+		switch parsed.Table {
+		case 20:
+			key.direction = metrics.TrafficDirectionTx
+			if inPort, ok := parsed.FindField("in_port"); ok {
+				ofport = inPort.Value
+			}
+			peerMatch, _ = parsed.FindField("nw_dst")
+		case 70:
+			key.direction = metrics.TrafficDirectionRx
+			ofport, _ = findLoadedValue(parsed, "NXM_NX_REG2")
+			peerMatch, _ = parsed.FindField("nw_src")
+		default:
+			continue
+		}
+		port, err := strconv.ParseUint(ofport, 0, 16)
+		if err != nil {
+			continue
+		}
+		key.ofport = int(port)
+		if peerMatch != nil {
+			key.peerMatch = peerMatch.Value
+		}
+		switch flowCookieKind(parsed.Cookie) {
+		case trafficPodCookie:
+			key.peer = metrics.TrafficPeerPod
+		case trafficServiceCookie:
+			key.peer = metrics.TrafficPeerService
+		default:
+			key.peer = metrics.TrafficPeerExternal
+		}
+
+		nBytes, ok := parsed.FindField("n_bytes")
+		if !ok {
+			continue
+		}
+		count, err := strconv.ParseUint(nBytes.Value, 10, 64)
+		if err != nil {
+			continue
+		}
+		counts[key] = count
+	}
+	return counts
+}
+
+// update records the latest byte counts and returns the number of new bytes for
+// each flow since the last call. If a flow's count went down (because the flow was
+// replaced), its full count is treated as new.
+func (ts *trafficStats) update(counts map[trafficKey]uint64) map[trafficKey]uint64 {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	deltas := make(map[trafficKey]uint64)
+	for key, count := range counts {
+		last, existed := ts.lastCounts[key]
+		if !existed || count < last {
+			last = 0
+		}
+		if count > last {
+			deltas[key] = count - last
+		}
+	}
+	ts.lastCounts = counts
+	return deltas
+}
+
+// updateTrafficStats reads the per-pod flow counters from flows and adds the
+// traffic since the last update to the per-namespace traffic metrics. (Traffic from
+// a pod that is deleted between updates is lost.)
+func (node *OsdnNode) updateTrafficStats(flows []string) {
+	deltas := node.trafficStats.update(parseTrafficCounts(flows))
+	namespaces := node.podManager.getOFPortNamespaces()
+	for key, delta := range deltas {
+		namespace, ok := namespaces[key.ofport]
+		if !ok {
+			continue
+		}
+		metrics.NamespaceTrafficBytes.WithLabelValues(namespace, key.direction, key.peer).Add(float64(delta))
+	}
+}
@@ -0,0 +1,57 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/openshift/sdn/pkg/network/node/metrics"
+)
+
+func TestTrafficStats(t *testing.T) {
+	flows := []string{
+		" cookie=0x0, duration=120.5s, table=20, n_packets=3, n_bytes=180, idle_age=3, priority=300,udp,tp_dst=4789 actions=drop",
+		" cookie=0x0, duration=120.5s, table=20, n_packets=5, n_bytes=300, idle_age=3, priority=120,ip,in_port=3,nw_src=10.128.0.2,nw_dst=10.128.0.1 actions=load:0x2a->NXM_NX_REG0[],goto_table:21",
+		" cookie=0xa1, duration=120.5s, table=20, n_packets=20, n_bytes=2000, idle_age=3, priority=110,ip,in_port=3,nw_src=10.128.0.2,nw_dst=10.128.0.0/14 actions=load:0x2a->NXM_NX_REG0[],goto_table:21",
+		" cookie=0xa2, duration=120.5s, table=20, n_packets=10, n_bytes=1000, idle_age=3, priority=110,ip,in_port=3,nw_src=10.128.0.2,nw_dst=172.30.0.0/16 actions=load:0x2a->NXM_NX_REG0[],goto_table:21",
+		" cookie=0x0, duration=120.5s, table=20, n_packets=2, n_bytes=84, idle_age=3, priority=100,arp,in_port=3,arp_spa=10.128.0.2,arp_sha=00:00:0a:80:00:02/00:00:ff:ff:ff:ff actions=load:0x2a->NXM_NX_REG0[],goto_table:21",
+		" cookie=0x0, duration=120.5s, table=20, n_packets=7, n_bytes=700, idle_age=3, priority=100,ip,in_port=3,nw_src=10.128.0.2 actions=load:0x2a->NXM_NX_REG0[],goto_table:21",
+		" cookie=0x0, duration=120.5s, table=20, n_packets=99, n_bytes=9900, idle_age=3, priority=0 actions=drop",
+		" cookie=0xa1, duration=120.5s, table=70, n_packets=30, n_bytes=3000, idle_age=3, priority=110,ip,nw_src=10.128.0.0/14,nw_dst=10.128.0.2 actions=load:0x2a->NXM_NX_REG1[],load:0x3->NXM_NX_REG2[],goto_table:80",
+		" cookie=0x0, duration=120.5s, table=70, n_packets=4, n_bytes=400, idle_age=3, priority=100,ip,nw_dst=10.128.0.2 actions=load:0x2a->NXM_NX_REG1[],load:0x3->NXM_NX_REG2[],goto_table:80",
+		" cookie=0x0, duration=120.5s, table=70, n_packets=0, n_bytes=0, idle_age=3, priority=0 actions=drop",
+	}
+
+	counts := parseTrafficCounts(flows)
+	expected := map[trafficKey]uint64{
+		{ofport: 3, direction: metrics.TrafficDirectionTx, peer: metrics.TrafficPeerExternal, peerMatch: "10.128.0.1"}:   300,
+		{ofport: 3, direction: metrics.TrafficDirectionTx, peer: metrics.TrafficPeerPod, peerMatch: "10.128.0.0/14"}:     2000,
+		{ofport: 3, direction: metrics.TrafficDirectionTx, peer: metrics.TrafficPeerService, peerMatch: "172.30.0.0/16"}: 1000,
+		{ofport: 3, direction: metrics.TrafficDirectionTx, peer: metrics.TrafficPeerExternal}:                            700,
+		{ofport: 3, direction: metrics.TrafficDirectionRx, peer: metrics.TrafficPeerPod, peerMatch: "10.128.0.0/14"}:     3000,
+		{ofport: 3, direction: metrics.TrafficDirectionRx, peer: metrics.TrafficPeerExternal}:                            400,
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("unexpected counts: expected %v, got %v", expected, counts)
+	}
+
+	ts := newTrafficStats()
+	deltas := ts.update(counts)
+	if !reflect.DeepEqual(deltas, expected) {
+		t.Fatalf("unexpected initial deltas: expected %v, got %v", expected, deltas)
+	}
+
+	// Counter increases give deltas; a counter that went down (because the flow
+	// was replaced) counts from 0
+	deltas = ts.update(map[trafficKey]uint64{
+		{ofport: 3, direction: metrics.TrafficDirectionTx, peer: metrics.TrafficPeerPod, peerMatch: "10.128.0.0/14"}: 2500,
+		{ofport: 3, direction: metrics.TrafficDirectionTx, peer: metrics.TrafficPeerExternal}:                        100,
+		{ofport: 3, direction: metrics.TrafficDirectionRx, peer: metrics.TrafficPeerExternal}:                        400,
+	})
+	expected = map[trafficKey]uint64{
+		{ofport: 3, direction: metrics.TrafficDirectionTx, peer: metrics.TrafficPeerPod, peerMatch: "10.128.0.0/14"}: 500,
+		{ofport: 3, direction: metrics.TrafficDirectionTx, peer: metrics.TrafficPeerExternal}:                        100,
+	}
+	if !reflect.DeepEqual(deltas, expected) {
+		t.Fatalf("unexpected deltas: expected %v, got %v", expected, deltas)
+	}
+}
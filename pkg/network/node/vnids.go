@@ -3,6 +3,7 @@ package node
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"sync"
 	"time"
 
@@ -30,6 +31,10 @@ type nodeVNIDMap struct {
 	ids        map[string]uint32
 	mcEnabled  map[string]bool
 	namespaces map[uint32]sets.String
+	// sharedServices holds the SharedServicesClientsAnnotation of each NetNamespace
+	sharedServices map[string]string
+	// mcGrants holds the parsed MulticastGrantsAnnotation of each NetNamespace
+	mcGrants map[string][]multicastGrant
 }
 
 func newNodeVNIDMap(policy osdnPolicy, osdnClient osdnclient.Interface) *nodeVNIDMap {
@@ -39,6 +44,9 @@ func newNodeVNIDMap(policy osdnPolicy, osdnClient osdnclient.Interface) *nodeVNI
 		ids:        make(map[string]uint32),
 		mcEnabled:  make(map[string]bool),
 		namespaces: make(map[uint32]sets.String),
+
+		sharedServices: make(map[string]string),
+		mcGrants:       make(map[string][]multicastGrant),
 	}
 }
 
@@ -75,6 +83,10 @@ func (vmap *nodeVNIDMap) GetMulticastEnabled(id uint32) bool {
 	vmap.lock.Lock()
 	defer vmap.lock.Unlock()
 
+	return vmap.getMulticastEnabledLocked(id)
+}
+
+func (vmap *nodeVNIDMap) getMulticastEnabledLocked(id uint32) bool {
 	set, exists := vmap.namespaces[id]
 	if !exists || set.Len() == 0 {
 		return false
@@ -163,6 +175,28 @@ func (vmap *nodeVNIDMap) setVNID(name string, id uint32, mcEnabled bool) {
 	klog.V(4).Infof("Associate netid %d to namespace %q with mcEnabled %v", id, name, mcEnabled)
 }
 
+func (vmap *nodeVNIDMap) setSharedServices(name, sharedServices string) {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+
+	if sharedServices == "" {
+		delete(vmap.sharedServices, name)
+	} else {
+		vmap.sharedServices[name] = sharedServices
+	}
+}
+
+func (vmap *nodeVNIDMap) setMulticastGrants(name string, grants []multicastGrant) {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+
+	if len(grants) == 0 {
+		delete(vmap.mcGrants, name)
+	} else {
+		vmap.mcGrants[name] = grants
+	}
+}
+
 func (vmap *nodeVNIDMap) unsetVNID(name string) (id uint32, err error) {
 	vmap.lock.Lock()
 	defer vmap.lock.Unlock()
@@ -174,6 +208,8 @@ func (vmap *nodeVNIDMap) unsetVNID(name string) (id uint32, err error) {
 	vmap.removeNamespaceFromSet(name, id)
 	delete(vmap.ids, name)
 	delete(vmap.mcEnabled, name)
+	delete(vmap.sharedServices, name)
+	delete(vmap.mcGrants, name)
 	klog.V(4).Infof("Dissociate netid %d from namespace %q", id, name)
 	return id, nil
 }
@@ -228,10 +264,16 @@ func (vmap *nodeVNIDMap) handleAddOrUpdateNetNamespace(obj, _ interface{}, event
 	oldNetID, err := vmap.getVNID(netns.NetName)
 	oldMCEnabled := vmap.mcEnabled[netns.NetName]
 	mcEnabled := netnsIsMulticastEnabled(netns)
-	if err == nil && oldNetID == netns.NetID && oldMCEnabled == mcEnabled {
+	oldSharedServices := vmap.sharedServices[netns.NetName]
+	sharedServices := netns.Annotations[SharedServicesClientsAnnotation]
+	oldMCGrants := vmap.mcGrants[netns.NetName]
+	mcGrants := parseMulticastGrants(netns)
+	if err == nil && oldNetID == netns.NetID && oldMCEnabled == mcEnabled && oldSharedServices == sharedServices && reflect.DeepEqual(oldMCGrants, mcGrants) {
 		return
 	}
 	vmap.setVNID(netns.NetName, netns.NetID, mcEnabled)
+	vmap.setSharedServices(netns.NetName, sharedServices)
+	vmap.setMulticastGrants(netns.NetName, mcGrants)
 
 	if eventType == watch.Added {
 		vmap.policy.AddNetNamespace(netns)
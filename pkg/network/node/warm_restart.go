@@ -0,0 +1,137 @@
+package node
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/sdn/pkg/util/ovs"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// When the node restarts and finds the bridge already set up with the current flow
+// schema (a "warm restart"), it keeps the existing OVS flows in place rather than
+// recreating them, so that traffic is not interrupted. The informers then re-add the
+// flows of every existing service, namespace, and egress policy (replacing the old
+// flows atomically), but nothing would remove the flows of objects that were deleted
+// while the node was not running. So during a warm restart, the checkpoint tracks
+// which flow owners had flows at startup and have not been re-added since, and once
+// the node has caught up with the cluster, their flows are deleted.
+//
+// (The pods' flows are not re-added on a warm restart, since the pods are still
+// attached; see podManager.InitRunningPods. The HostSubnet flows have no owner, and
+// are handled by hostSubnetWatcher.removeStaleHostSubnets.)
+
+// warmRestartSettleTime is how long to wait after the informers have synced before
+// removing stale flows, to give the informers' handlers (and the NetworkPolicy
+// plugin's deferred syncs) time to re-add the flows that are still needed
+const warmRestartSettleTime = time.Minute
+
+// warmRestartOwnerClasses are the classes of flow owners whose flows are all
+// re-added by the informers at startup
+var warmRestartOwnerClasses = map[flowOwnerClass]bool{
+	flowOwnerService: true,
+	flowOwnerPolicy:  true,
+	flowOwnerEgress:  true,
+}
+
+// flowCookieRegexp matches the cookie (or cookie match) of an added or deleted flow
+var flowCookieRegexp = regexp.MustCompile(`\bcookie=(0x[0-9a-fA-F]+)`)
+
+// startWarmRestart records the owners of the flows currently in OVS, so that
+// finishWarmRestart can remove the flows of the ones that are not re-added. It
+// returns the number of owners found.
+func (cp *ovsCheckpoint) startWarmRestart() (int, error) {
+	flows, err := cp.Interface.DumpFlows("")
+	if err != nil {
+		return 0, fmt.Errorf("could not dump flows: %v", err)
+	}
+
+	owners := make(map[flowOwner]bool)
+	for _, flow := range flows {
+		parsed, err := ovs.ParseFlow(ovs.ParseForDump, flow)
+		if err != nil {
+			continue
+		}
+		if owner, ok := parseFlowOwner(parsed.Cookie); ok && warmRestartOwnerClasses[owner.class] {
+			owners[owner] = true
+		}
+	}
+
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	cp.warmRestartOwners = owners
+	return len(owners), nil
+}
+
+// revalidateOwnersWithLock removes the owners of flows (which have just been added
+// or deleted) from cp.warmRestartOwners. Must be called with the lock held.
+func (cp *ovsCheckpoint) revalidateOwnersWithLock(flows []string) {
+	for _, flow := range flows {
+		match := flowCookieRegexp.FindStringSubmatch(flow)
+		if match == nil {
+			continue
+		}
+		if owner, ok := parseFlowOwner(match[1]); ok {
+			delete(cp.warmRestartOwners, owner)
+		}
+	}
+}
+
+// finishWarmRestart deletes the flows of the owners recorded by startWarmRestart
+// that have not been re-added since, and stops tracking owners. It returns the
+// owners whose flows were deleted.
+func (cp *ovsCheckpoint) finishWarmRestart() ([]flowOwner, error) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	stale := make([]flowOwner, 0, len(cp.warmRestartOwners))
+	for owner := range cp.warmRestartOwners {
+		stale = append(stale, owner)
+	}
+	cp.warmRestartOwners = nil
+	if len(stale) == 0 {
+		return nil, nil
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		return stale[i].value() < stale[j].value()
+	})
+
+	// We hold the lock, so this has to bypass checkpointTx and journal the
+	// deletions itself
+	otx := cp.Interface.NewTransaction()
+	for _, owner := range stale {
+		otx.DeleteFlows(owner.match())
+	}
+	if err := otx.Commit(); err != nil {
+		return nil, err
+	}
+	if cp.valid {
+		for _, owner := range stale {
+			match := owner.match()
+			cp.journal = append(cp.journal, func(otx ovs.Transaction) { otx.DeleteFlows(match) })
+		}
+	}
+	return stale, nil
+}
+
+// finishWarmRestart removes the flows of objects that were deleted while the node
+// was not running, once the node has caught up after a warm restart. It must be
+// called after the informers have synced.
+func (node *OsdnNode) finishWarmRestart() {
+	time.Sleep(warmRestartSettleTime)
+
+	stale, err := node.ovsCheckpoint.finishWarmRestart()
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("could not remove stale OVS flows after warm restart: %v", err))
+		return
+	}
+	for _, owner := range stale {
+		klog.Infof("Removed stale OVS flows of deleted %s (cookie %s) after warm restart", owner.class, owner.cookie("0"))
+	}
+	klog.Infof("Warm restart complete; removed the flows of %d deleted objects", len(stale))
+}
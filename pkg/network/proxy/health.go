@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/kubernetes/pkg/proxy/healthcheck"
+)
+
+// SyncHealthTracker is a healthcheck.ProxierHealthUpdater that keeps track of
+// whether the proxy is syncing its rules in a timely manner, so that this can be
+// reported as part of the node's health. Updates are passed on to another
+// ProxierHealthUpdater, if one is given.
+type SyncHealthTracker struct {
+	next          healthcheck.ProxierHealthUpdater
+	healthTimeout time.Duration
+	clock         clock.Clock
+
+	lock        sync.Mutex
+	lastQueued  time.Time
+	lastUpdated time.Time
+}
+
+// NewSyncHealthTracker creates a SyncHealthTracker that is unhealthy if a queued
+// update has not been processed after healthTimeout. next may be nil.
+func NewSyncHealthTracker(next healthcheck.ProxierHealthUpdater, healthTimeout time.Duration) *SyncHealthTracker {
+	return &SyncHealthTracker{
+		next:          next,
+		healthTimeout: healthTimeout,
+		clock:         clock.RealClock{},
+	}
+}
+
+// QueuedUpdate is part of healthcheck.ProxierHealthUpdater
+func (t *SyncHealthTracker) QueuedUpdate() {
+	t.lock.Lock()
+	t.lastQueued = t.clock.Now()
+	t.lock.Unlock()
+
+	if t.next != nil {
+		t.next.QueuedUpdate()
+	}
+}
+
+// Updated is part of healthcheck.ProxierHealthUpdater
+func (t *SyncHealthTracker) Updated() {
+	t.lock.Lock()
+	t.lastUpdated = t.clock.Now()
+	t.lock.Unlock()
+
+	if t.next != nil {
+		t.next.Updated()
+	}
+}
+
+// Run is part of healthcheck.ProxierHealthUpdater
+func (t *SyncHealthTracker) Run() error {
+	if t.next == nil {
+		return fmt.Errorf("no healthz server to run")
+	}
+	return t.next.Run()
+}
+
+// CheckHealth returns an error if the proxy has not yet synced its rules, or if
+// it has had an update queued for longer than the health timeout.
+func (t *SyncHealthTracker) CheckHealth() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.lastUpdated.IsZero() {
+		return fmt.Errorf("proxy rules have not been synced yet")
+	}
+	if t.lastQueued.After(t.lastUpdated) {
+		if pending := t.clock.Since(t.lastQueued); pending >= t.healthTimeout {
+			return fmt.Errorf("proxy rules have not been synced since %s (update pending for %v)",
+				t.lastUpdated.Format(time.RFC3339), pending.Round(time.Second))
+		}
+	}
+	return nil
+}
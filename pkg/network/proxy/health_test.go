@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+func TestSyncHealthTracker(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	next := &fakeHealthzServer{}
+	tracker := NewSyncHealthTracker(next, time.Minute)
+	tracker.clock = fakeClock
+
+	if err := tracker.CheckHealth(); err == nil {
+		t.Fatalf("unexpected success before initial sync")
+	}
+
+	tracker.QueuedUpdate()
+	fakeClock.Step(time.Second)
+	tracker.Updated()
+	if err := tracker.CheckHealth(); err != nil {
+		t.Fatalf("unexpected error after sync: %v", err)
+	}
+	if next.queued != 1 || next.updated != 1 {
+		t.Fatalf("updates not passed through: %#v", next)
+	}
+
+	// A queued update is fine until it has been pending for the timeout
+	fakeClock.Step(time.Second)
+	tracker.QueuedUpdate()
+	fakeClock.Step(30 * time.Second)
+	if err := tracker.CheckHealth(); err != nil {
+		t.Fatalf("unexpected error with recently-queued update: %v", err)
+	}
+	fakeClock.Step(30 * time.Second)
+	if err := tracker.CheckHealth(); err == nil {
+		t.Fatalf("unexpected success with stale queued update")
+	}
+
+	tracker.Updated()
+	if err := tracker.CheckHealth(); err != nil {
+		t.Fatalf("unexpected error after sync: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -14,9 +15,13 @@ import (
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	corev1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/kubernetes/pkg/proxy"
+	"k8s.io/kubernetes/pkg/proxy/healthcheck"
+	proxymetrics "k8s.io/kubernetes/pkg/proxy/metrics"
 	"k8s.io/kubernetes/pkg/util/async"
 
 	unidlingapi "github.com/openshift/api/unidling/v1alpha1"
+	"github.com/openshift/sdn/pkg/network/node/metrics"
+	sdnproxymetrics "github.com/openshift/sdn/pkg/network/proxy/metrics"
 )
 
 // HybridizableProxy is an extra interface we layer on top of Provider
@@ -50,19 +55,71 @@ type hybridProxierService struct {
 	knownService   bool
 	knownEndpoints bool
 
-	// cached info about the Service/Endpoints
+	// cached info about the Service/Endpoints. Depending on whether the proxies
+	// use Endpoints or EndpointSlices, only one of emptyEndpoints and
+	// endpointSlices is used.
 	serviceHasIdleAnnotation bool
 	emptyEndpoints           *corev1.Endpoints
+	endpointSlices           map[string]*discoveryv1.EndpointSlice
 
 	// idling/unidling state
 	isIdled   bool
 	unidledAt *time.Time
+	// whether the service has been switched back to the main proxy but has not
+	// had ready endpoints since
+	awaitingEndpoints bool
+
+	// when the service was last switched between proxies (or first seen)
+	proxySince time.Time
+
+	// whether the service is counted in HybridProxier.idledServices
+	countedIdled bool
 }
 
 const unidlingEndpointsLag = time.Minute
 
 func (hsvc *hybridProxierService) shouldBeIdled() bool {
-	return hsvc.serviceHasIdleAnnotation && hsvc.emptyEndpoints != nil
+	return hsvc.serviceHasIdleAnnotation && hsvc.hasEmptyEndpoints()
+}
+
+// hasEmptyEndpoints returns whether the service's Endpoints, or all of its
+// EndpointSlices, exist but contain no ready addresses
+func (hsvc *hybridProxierService) hasEmptyEndpoints() bool {
+	if hsvc.endpointSlices != nil {
+		if len(hsvc.endpointSlices) == 0 {
+			return false
+		}
+		for _, slice := range hsvc.endpointSlices {
+			if sliceHasReadyEndpoints(slice) {
+				return false
+			}
+		}
+		return true
+	}
+	return hsvc.emptyEndpoints != nil
+}
+
+// hasReadyEndpoints returns whether the service's Endpoints, or any of its
+// EndpointSlices, contain ready addresses
+func (hsvc *hybridProxierService) hasReadyEndpoints() bool {
+	if hsvc.endpointSlices != nil {
+		for _, slice := range hsvc.endpointSlices {
+			if sliceHasReadyEndpoints(slice) {
+				return true
+			}
+		}
+		return false
+	}
+	return hsvc.knownEndpoints && hsvc.emptyEndpoints == nil
+}
+
+func (hsvc *hybridProxierService) sortedEndpointSlices() []*discoveryv1.EndpointSlice {
+	slices := make([]*discoveryv1.EndpointSlice, 0, len(hsvc.endpointSlices))
+	for _, slice := range hsvc.endpointSlices {
+		slices = append(slices, slice)
+	}
+	sort.Slice(slices, func(i, j int) bool { return slices[i].Name < slices[j].Name })
+	return slices
 }
 
 func (hsvc *hybridProxierService) unidlingProxyWantsEndpoints() bool {
@@ -82,9 +139,16 @@ type HybridProxier struct {
 
 	serviceLister corev1listers.ServiceLister
 	syncRunner    *async.BoundedFrequencyRunner
+	healthzServer healthcheck.ProxierHealthUpdater
+
+	// onServiceUnidled, if set, is called (with serviceLock held) when a service
+	// that was switched back to the main proxy has ready endpoints
+	onServiceUnidled func(types.NamespacedName)
 
 	serviceLock sync.Mutex
 	services    map[types.NamespacedName]*hybridProxierService
+	// the number of known services currently handled by the unidling proxy
+	idledServices int
 }
 
 func NewHybridProxier(
@@ -92,15 +156,18 @@ func NewHybridProxier(
 	unidlingProxy HybridizableProxy,
 	minSyncPeriod time.Duration,
 	serviceLister corev1listers.ServiceLister,
+	healthzServer healthcheck.ProxierHealthUpdater,
 ) *HybridProxier {
 	p := &HybridProxier{
 		mainProxy:     mainProxy,
 		unidlingProxy: unidlingProxy,
 
 		serviceLister: serviceLister,
+		healthzServer: healthzServer,
 
 		services: make(map[types.NamespacedName]*hybridProxierService),
 	}
+	metrics.RegisterMetrics()
 
 	p.syncRunner = async.NewBoundedFrequencyRunner("sync-runner", p.syncProxyRules, minSyncPeriod, time.Hour, 4)
 
@@ -113,20 +180,35 @@ func NewHybridProxier(
 	return p
 }
 
-func (proxier *HybridProxier) OnNodeAdd(node *corev1.Node) {
-	// TODO implement https://github.com/kubernetes/enhancements/pull/640
+// SetServiceUnidledHandler sets a function to call when a service that was idled
+// has ready endpoints again
+func (p *HybridProxier) SetServiceUnidledHandler(handler func(types.NamespacedName)) {
+	p.serviceLock.Lock()
+	defer p.serviceLock.Unlock()
+	p.onServiceUnidled = handler
 }
 
-func (proxier *HybridProxier) OnNodeUpdate(oldNode, node *corev1.Node) {
-	// TODO implement https://github.com/kubernetes/enhancements/pull/640
+// Node events are passed through to both proxies; the main proxy needs the
+// labels of the local node to honor EndpointSlice topology hints.
+
+func (p *HybridProxier) OnNodeAdd(node *corev1.Node) {
+	p.unidlingProxy.OnNodeAdd(node)
+	p.mainProxy.OnNodeAdd(node)
+}
+
+func (p *HybridProxier) OnNodeUpdate(oldNode, node *corev1.Node) {
+	p.unidlingProxy.OnNodeUpdate(oldNode, node)
+	p.mainProxy.OnNodeUpdate(oldNode, node)
 }
 
-func (proxier *HybridProxier) OnNodeDelete(node *corev1.Node) {
-	// TODO implement https://github.com/kubernetes/enhancements/pull/640
+func (p *HybridProxier) OnNodeDelete(node *corev1.Node) {
+	p.unidlingProxy.OnNodeDelete(node)
+	p.mainProxy.OnNodeDelete(node)
 }
 
-func (proxier *HybridProxier) OnNodeSynced() {
-	// TODO implement https://github.com/kubernetes/enhancements/pull/640
+func (p *HybridProxier) OnNodeSynced() {
+	p.unidlingProxy.OnNodeSynced()
+	p.mainProxy.OnNodeSynced()
 }
 
 // getService locks p.serviceLock and then gets/creates the hybridProxierService for
@@ -166,10 +248,18 @@ func (p *HybridProxier) releaseService(svcName types.NamespacedName) {
 			p.mainProxy.OnServiceDelete(service)
 			p.unidlingProxy.OnServiceAdd(service)
 			if !hsvc.unidlingProxyWantsEndpoints() {
-				p.unidlingProxy.OnEndpointsAdd(hsvc.emptyEndpoints)
+				if hsvc.endpointSlices != nil {
+					for _, slice := range hsvc.sortedEndpointSlices() {
+						p.unidlingProxy.OnEndpointSliceAdd(slice)
+					}
+				} else {
+					p.unidlingProxy.OnEndpointsAdd(hsvc.emptyEndpoints)
+				}
 			}
 			hsvc.isIdled = true
 			hsvc.unidledAt = nil
+			hsvc.awaitingEndpoints = false
+			hsvc.proxySince = time.Now()
 		} else {
 			klog.Infof("switching svc %s to main proxy", svcName)
 			p.unidlingProxy.OnServiceDelete(service)
@@ -177,7 +267,26 @@ func (p *HybridProxier) releaseService(svcName types.NamespacedName) {
 			hsvc.isIdled = false
 			now := time.Now()
 			hsvc.unidledAt = &now
+			hsvc.proxySince = now
+			hsvc.awaitingEndpoints = true
+		}
+	}
+
+	if hsvc.awaitingEndpoints && hsvc.hasReadyEndpoints() {
+		hsvc.awaitingEndpoints = false
+		if p.onServiceUnidled != nil {
+			p.onServiceUnidled(svcName)
+		}
+	}
+
+	if idled := hsvc.knownService && hsvc.isIdled; idled != hsvc.countedIdled {
+		if idled {
+			p.idledServices++
+		} else {
+			p.idledServices--
 		}
+		hsvc.countedIdled = idled
+		metrics.HybridProxyIdledServices.Set(float64(p.idledServices))
 	}
 
 	if !hsvc.knownService && !hsvc.knownEndpoints {
@@ -185,6 +294,54 @@ func (p *HybridProxier) releaseService(svcName types.NamespacedName) {
 	}
 }
 
+// ServiceProxyState describes which proxy is currently handling a service
+type ServiceProxyState struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Proxy is either "main" or "unidling"
+	Proxy string `json:"proxy"`
+	// Since is when the service was switched to Proxy (or first seen, if it
+	// has never been switched)
+	Since metav1.Time `json:"since"`
+	// UnidledAt is when the service was last unidled, if that was recently
+	// enough that the unidling proxy is still tracking its endpoints
+	UnidledAt *metav1.Time `json:"unidledAt,omitempty"`
+}
+
+// ServiceProxyStates returns the state of every service known to the HybridProxier
+func (p *HybridProxier) ServiceProxyStates() []ServiceProxyState {
+	p.serviceLock.Lock()
+	defer p.serviceLock.Unlock()
+
+	states := make([]ServiceProxyState, 0, len(p.services))
+	for svcName, hsvc := range p.services {
+		if !hsvc.knownService {
+			continue
+		}
+		state := ServiceProxyState{
+			Namespace: svcName.Namespace,
+			Name:      svcName.Name,
+			Proxy:     "main",
+			Since:     metav1.NewTime(hsvc.proxySince),
+		}
+		if hsvc.isIdled {
+			state.Proxy = "unidling"
+		}
+		if hsvc.unidlingProxyWantsEndpoints() && hsvc.unidledAt != nil {
+			unidledAt := metav1.NewTime(*hsvc.unidledAt)
+			state.UnidledAt = &unidledAt
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Namespace != states[j].Namespace {
+			return states[i].Namespace < states[j].Namespace
+		}
+		return states[i].Name < states[j].Name
+	})
+	return states
+}
+
 func serviceHasIdleAnnotation(service *corev1.Service) bool {
 	_, annotationSet := service.Annotations[unidlingapi.IdledAtAnnotation]
 	return annotationSet
@@ -197,6 +354,9 @@ func (p *HybridProxier) OnServiceAdd(service *corev1.Service) {
 
 	hsvc.knownService = true
 	hsvc.serviceHasIdleAnnotation = serviceHasIdleAnnotation(service)
+	if hsvc.proxySince.IsZero() {
+		hsvc.proxySince = time.Now()
+	}
 
 	// Services should never actually be created pre-idled. But if we do end up
 	// getting an OnServiceAdd for an already-idle Service due to dropped/compressed
@@ -233,6 +393,7 @@ func (p *HybridProxier) OnServiceDelete(service *corev1.Service) {
 
 	hsvc.knownService = false
 	hsvc.serviceHasIdleAnnotation = false
+	sdnproxymetrics.DeleteServiceMetrics(service.Namespace, service.Name)
 
 	if hsvc.isIdled {
 		klog.V(6).Infof("del svc %s in unidling proxy", svcName)
@@ -321,62 +482,17 @@ func endpointSliceServiceName(slice *discoveryv1.EndpointSlice) string {
 	return serviceName
 }
 
-func sliceToEndpoints(slice *discoveryv1.EndpointSlice) *corev1.Endpoints {
-	if slice == nil {
-		return nil
-	}
-
-	endpoints := &corev1.Endpoints{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "Endpoints",
-			APIVersion: "v1",
-		},
-		ObjectMeta: slice.ObjectMeta,
-		Subsets: []corev1.EndpointSubset{
-			{
-				Addresses: []corev1.EndpointAddress{},
-				Ports:     []corev1.EndpointPort{},
-			},
-		},
-	}
-	endpoints.Name = endpointSliceServiceName(slice)
+// sliceHasReadyEndpoints returns whether slice has any ready endpoint addresses
+func sliceHasReadyEndpoints(slice *discoveryv1.EndpointSlice) bool {
 	for _, ep := range slice.Endpoints {
-		addr := corev1.EndpointAddress{
-			NodeName:  ep.NodeName,
-			TargetRef: ep.TargetRef,
-		}
-		if ep.Hostname != nil {
-			addr.Hostname = *ep.Hostname
-		}
-		for _, ip := range ep.Addresses {
-			addr.IP = ip
-			endpoints.Subsets[0].Addresses = append(endpoints.Subsets[0].Addresses, addr)
-		}
-	}
-	for _, slicePort := range slice.Ports {
-		port := corev1.EndpointPort{AppProtocol: slicePort.AppProtocol}
-		if slicePort.Name != nil {
-			port.Name = *slicePort.Name
+		if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+			continue
 		}
-		if slicePort.Port != nil {
-			port.Port = *slicePort.Port
-		}
-		if slicePort.Protocol != nil {
-			port.Protocol = *slicePort.Protocol
-		}
-		endpoints.Subsets[0].Ports = append(endpoints.Subsets[0].Ports, port)
-	}
-
-	return endpoints
-}
-
-func endpointsIfEmptySlice(slice *discoveryv1.EndpointSlice) *corev1.Endpoints {
-	for _, ep := range slice.Endpoints {
 		if len(ep.Addresses) > 0 {
-			return nil
+			return true
 		}
 	}
-	return sliceToEndpoints(slice)
+	return false
 }
 
 func (p *HybridProxier) OnEndpointSliceAdd(slice *discoveryv1.EndpointSlice) {
@@ -384,13 +500,16 @@ func (p *HybridProxier) OnEndpointSliceAdd(slice *discoveryv1.EndpointSlice) {
 	hsvc := p.getService(svcName)
 	defer p.releaseService(svcName)
 
+	if hsvc.endpointSlices == nil {
+		hsvc.endpointSlices = make(map[string]*discoveryv1.EndpointSlice)
+	}
+	hsvc.endpointSlices[slice.Name] = slice
 	hsvc.knownEndpoints = true
-	hsvc.emptyEndpoints = endpointsIfEmptySlice(slice)
 
 	klog.V(6).Infof("hybrid proxy: add slice %s", svcName)
 	p.mainProxy.OnEndpointSliceAdd(slice)
 	if hsvc.unidlingProxyWantsEndpoints() {
-		p.unidlingProxy.OnEndpointsAdd(sliceToEndpoints(slice))
+		p.unidlingProxy.OnEndpointSliceAdd(slice)
 	}
 }
 
@@ -399,14 +518,25 @@ func (p *HybridProxier) OnEndpointSliceUpdate(oldSlice, slice *discoveryv1.Endpo
 	hsvc := p.getService(svcName)
 	defer p.releaseService(svcName)
 
-	hsvc.emptyEndpoints = endpointsIfEmptySlice(slice)
+	if hsvc.endpointSlices == nil {
+		hsvc.endpointSlices = make(map[string]*discoveryv1.EndpointSlice)
+	}
+	hsvc.endpointSlices[slice.Name] = slice
+	hsvc.knownEndpoints = true
 
 	klog.V(6).Infof("hybrid proxy: update slice %s", svcName)
 	p.mainProxy.OnEndpointSliceUpdate(oldSlice, slice)
 	if hsvc.unidlingProxyWantsEndpoints() {
-		p.unidlingProxy.OnEndpointsUpdate(sliceToEndpoints(oldSlice), sliceToEndpoints(slice))
+		p.unidlingProxy.OnEndpointSliceUpdate(oldSlice, slice)
 	} else if hsvc.unidlingPeriodHasExpired() {
-		p.unidlingProxy.OnEndpointsDelete(sliceToEndpoints(oldSlice))
+		// The unidling proxy no longer needs any of the service's slices
+		for _, other := range hsvc.sortedEndpointSlices() {
+			if other.Name == slice.Name {
+				p.unidlingProxy.OnEndpointSliceDelete(oldSlice)
+			} else {
+				p.unidlingProxy.OnEndpointSliceDelete(other)
+			}
+		}
 		hsvc.unidledAt = nil
 	}
 }
@@ -416,27 +546,38 @@ func (p *HybridProxier) OnEndpointSliceDelete(slice *discoveryv1.EndpointSlice)
 	hsvc := p.getService(svcName)
 	defer p.releaseService(svcName)
 
-	hsvc.knownEndpoints = false
-	hsvc.emptyEndpoints = nil
+	delete(hsvc.endpointSlices, slice.Name)
+	hsvc.knownEndpoints = len(hsvc.endpointSlices) > 0
 
 	klog.V(6).Infof("hybrid proxy: del slice %s", svcName)
 	p.mainProxy.OnEndpointSliceDelete(slice)
 	if hsvc.unidlingProxyWantsEndpoints() {
-		p.unidlingProxy.OnEndpointsDelete(sliceToEndpoints(slice))
-		hsvc.unidledAt = nil
+		p.unidlingProxy.OnEndpointSliceDelete(slice)
+		if !hsvc.knownEndpoints {
+			hsvc.unidledAt = nil
+		}
 	}
 }
 
 func (p *HybridProxier) OnEndpointSlicesSynced() {
 	klog.V(6).Infof("hybrid proxy: endpointslices synced")
-	p.unidlingProxy.OnEndpointsSynced()
+	p.unidlingProxy.OnEndpointSlicesSynced()
 	p.mainProxy.OnEndpointSlicesSynced()
 }
 
 // Sync is called to synchronize the proxier state to iptables
 // this doesn't take immediate effect - rather, it requests that the
 // BoundedFrequencyRunner call syncProxyRules()
+//
+// Like the upstream proxiers, this marks an update as queued for healthz and
+// metrics purposes; the main proxy marks it as done when it next syncs. (The
+// main proxy does the same itself when it gets an event, but changes that only
+// affect the unidling proxy only pass through here.)
 func (p *HybridProxier) Sync() {
+	if p.healthzServer != nil {
+		p.healthzServer.QueuedUpdate()
+	}
+	proxymetrics.SyncProxyRulesLastQueuedTimestamp.SetToCurrentTime()
 	p.syncRunner.Run()
 }
 
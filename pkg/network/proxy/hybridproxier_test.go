@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"context"
+	"encoding/json"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -9,8 +11,14 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ktypes "k8s.io/apimachinery/pkg/types"
 	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/component-base/metrics/testutil"
 
 	unidlingapi "github.com/openshift/api/unidling/v1alpha1"
+	"github.com/openshift/sdn/pkg/network/node/metrics"
+	sdnproxymetrics "github.com/openshift/sdn/pkg/network/proxy/metrics"
 )
 
 func makeService(namespace, name string) *corev1.Service {
@@ -58,6 +66,26 @@ func deleteServiceAndWait(svc *corev1.Service, proxy *OsdnProxy) error {
 	})
 }
 
+// hasNeedPodsSignalsMetric returns whether the unidling NeedPods signal metric has a
+// series for the given service
+func hasNeedPodsSignalsMetric(t *testing.T, namespace, name string) bool {
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error gathering metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != sdnproxymetrics.SDNNamespace+"_"+sdnproxymetrics.SDNSubsystem+"_"+sdnproxymetrics.UnidlingNeedPodsSignalsKey {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if testutil.LabelsMatch(metric, map[string]string{"namespace": namespace, "service": name}) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func TestHybridProxy(t *testing.T) {
 	proxy, mainProxy, unidlingProxy, err := newTestOsdnProxy(true)
 	if err != nil {
@@ -134,7 +162,7 @@ func TestHybridProxy(t *testing.T) {
 	}
 	err = unidlingProxy.assertEvents("after idling first service",
 		"add service testns/one",
-		"add endpoints testns/one -",
+		"add endpointslice testns/one-slice1 -",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -155,7 +183,7 @@ func TestHybridProxy(t *testing.T) {
 	}
 	err = unidlingProxy.assertEvents("after unidling first service",
 		"delete service testns/one",
-		"update endpoints testns/one 1.2.3.4",
+		"update endpointslice testns/one-slice1 1.2.3.4",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -173,7 +201,7 @@ func TestHybridProxy(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 	err = unidlingProxy.assertEvents("after modifying first service",
-		"update endpoints testns/one 5.6.7.8",
+		"update endpointslice testns/one-slice1 5.6.7.8",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -194,7 +222,7 @@ func TestHybridProxy(t *testing.T) {
 		"update endpointslice testns/one-slice1 9.10.11.12",
 	)
 	unidlingProxy.assertEvents("after re-modifying first service",
-		"delete endpoints testns/one 5.6.7.8",
+		"delete endpointslice testns/one-slice1 5.6.7.8",
 	)
 
 	// Change the endpoints back; the unidling proxy should not see the event
@@ -258,7 +286,7 @@ func TestHybridProxy(t *testing.T) {
 	}
 	err = unidlingProxy.assertEvents("after idling second service",
 		"add service testns/two",
-		"add endpoints testns/two -",
+		"add endpointslice testns/two-slice1 -",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -279,7 +307,7 @@ func TestHybridProxy(t *testing.T) {
 	}
 	err = unidlingProxy.assertEvents("after unidling second service",
 		"delete service testns/two",
-		"update endpoints testns/two 9.10.11.12",
+		"update endpointslice testns/two-slice1 9.10.11.12",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -339,18 +367,23 @@ func TestHybridProxy(t *testing.T) {
 	}
 	err = unidlingProxy.assertEvents("after idling third service",
 		"add service testns/three",
-		"add endpoints testns/three -",
+		"add endpointslice testns/three-slice1 -",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 
-	// Now delete it
+	// Now delete it; its unidling metrics should go away too
+	sdnproxymetrics.RegisterMetrics()
+	sdnproxymetrics.UnidlingNeedPodsSignals.WithLabelValues("testns", "three").Inc()
 	err = deleteServiceAndWait(svc3idled, proxy)
 	if err != nil {
 		t.Fatalf("unexpected error deleting service: %v", err)
 	}
 	proxy.OnServiceDelete(svc3idled)
+	if hasNeedPodsSignalsMetric(t, "testns", "three") {
+		t.Fatalf("NeedPods signal metric for deleted service was not deleted")
+	}
 
 	err = mainProxy.assertNoEvents("after deleting third service")
 	if err != nil {
@@ -373,7 +406,7 @@ func TestHybridProxy(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 	err = unidlingProxy.assertEvents("after deleting third endpoints",
-		"delete endpoints testns/three -",
+		"delete endpointslice testns/three-slice1 -",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -408,7 +441,7 @@ func TestHybridProxy(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 	err = unidlingProxy.assertEvents("after cleanup",
-		"delete endpoints testns/two 9.10.11.12",
+		"delete endpointslice testns/two-slice1 9.10.11.12",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -444,17 +477,27 @@ func TestHybridProxyPreIdled(t *testing.T) {
 	}
 	err = unidlingProxy.assertEvents("after creating pre-idled service",
 		"add service testns/pre-idled",
-		"add endpoints testns/pre-idled -",
+		"add endpointslice testns/pre-idled-slice1 -",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 
 	// Now un-idle the service
+	var unidled []ktypes.NamespacedName
+	proxy.SetServiceUnidledHandler(func(name ktypes.NamespacedName) {
+		unidled = append(unidled, name)
+	})
 	svcpiUnidled := makeService("testns", "pre-idled")
 	proxy.OnServiceUpdate(svcpi, svcpiUnidled)
+	if len(unidled) != 0 {
+		t.Fatalf("service unidled before it had endpoints: %v", unidled)
+	}
 	_, slicepiUnidled := makeEndpoints("testns", "pre-idled", "1.2.3.4")
 	proxy.OnEndpointSliceUpdate(slicepi, slicepiUnidled)
+	if len(unidled) != 1 || unidled[0].String() != "testns/pre-idled" {
+		t.Fatalf("unexpected unidled services %v", unidled)
+	}
 
 	err = mainProxy.assertEvents("after unidling pre-idled service",
 		"add service testns/pre-idled",
@@ -465,7 +508,7 @@ func TestHybridProxyPreIdled(t *testing.T) {
 	}
 	err = unidlingProxy.assertEvents("after unidling pre-idled service",
 		"delete service testns/pre-idled",
-		"update endpoints testns/pre-idled 1.2.3.4",
+		"update endpointslice testns/pre-idled-slice1 1.2.3.4",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -487,7 +530,7 @@ func TestHybridProxyPreIdled(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 	err = unidlingProxy.assertEvents("after deleting pre-idled service",
-		"delete endpoints testns/pre-idled 1.2.3.4",
+		"delete endpointslice testns/pre-idled-slice1 1.2.3.4",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -544,7 +587,7 @@ func TestHybridProxyReIdling(t *testing.T) {
 	}
 	err = unidlingProxy.assertEvents("after idling re-idle service",
 		"add service testns/re-idle",
-		"add endpoints testns/re-idle -",
+		"add endpointslice testns/re-idle-slice1 -",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -562,7 +605,7 @@ func TestHybridProxyReIdling(t *testing.T) {
 	}
 	err = unidlingProxy.assertEvents("after unidling re-idle service",
 		"delete service testns/re-idle",
-		"update endpoints testns/re-idle 1.2.3.4",
+		"update endpointslice testns/re-idle-slice1 1.2.3.4",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -582,7 +625,7 @@ func TestHybridProxyReIdling(t *testing.T) {
 	}
 	err = unidlingProxy.assertEvents("after re-idling re-idle service",
 		"add service testns/re-idle",
-		"update endpoints testns/re-idle -",
+		"update endpointslice testns/re-idle-slice1 -",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -601,7 +644,7 @@ func TestHybridProxyReIdling(t *testing.T) {
 	}
 	err = unidlingProxy.assertEvents("after unidling re-idle service",
 		"delete service testns/re-idle",
-		"update endpoints testns/re-idle 1.2.3.4",
+		"update endpointslice testns/re-idle-slice1 1.2.3.4",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -629,8 +672,8 @@ func TestHybridProxyReIdling(t *testing.T) {
 	}
 	err = unidlingProxy.assertEvents("after re-idling re-idle service after time passed",
 		"add service testns/re-idle",
-		"delete endpoints testns/re-idle 1.2.3.4",
-		"add endpoints testns/re-idle -",
+		"delete endpointslice testns/re-idle-slice1 1.2.3.4",
+		"add endpointslice testns/re-idle-slice1 -",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -659,7 +702,7 @@ func TestHybridProxyReIdling(t *testing.T) {
 	}
 	err = unidlingProxy.assertEvents("after deleting re-idle service",
 		"delete service testns/re-idle",
-		"delete endpoints testns/re-idle -",
+		"delete endpointslice testns/re-idle-slice1 -",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -848,3 +891,206 @@ func TestHybridProxyNoSlices(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 }
+
+func TestHybridProxyMultipleSlices(t *testing.T) {
+	proxy, mainProxy, unidlingProxy, err := newTestOsdnProxy(true)
+	if err != nil {
+		t.Fatalf("unexpected error creating OsdnProxy: %v", err)
+	}
+
+	// Create a Service with two EndpointSlices
+	svc := makeService("testns", "multi")
+	err = createServiceAndWait(svc, proxy)
+	if err != nil {
+		t.Fatalf("unexpected error creating service: %v", err)
+	}
+	proxy.OnServiceAdd(svc)
+
+	_, slice1 := makeEndpoints("testns", "multi", "1.2.3.4")
+	_, slice2 := makeEndpoints("testns", "multi", "5.6.7.8")
+	slice2.Name = "multi-slice2"
+	proxy.OnEndpointSliceAdd(slice1)
+	proxy.OnEndpointSliceAdd(slice2)
+
+	err = mainProxy.assertEvents("after creating service",
+		"add service testns/multi",
+		"add endpointslice testns/multi-slice1 1.2.3.4",
+		"add endpointslice testns/multi-slice2 5.6.7.8",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Emptying one slice is not enough to idle the service
+	svcIdled := svc.DeepCopy()
+	svcIdled.Annotations[unidlingapi.IdledAtAnnotation] = "now"
+	proxy.OnServiceUpdate(svc, svcIdled)
+	_, slice1Idled := makeEndpoints("testns", "multi")
+	proxy.OnEndpointSliceUpdate(slice1, slice1Idled)
+
+	err = mainProxy.assertEvents("after emptying first slice",
+		"update service testns/multi",
+		"update endpointslice testns/multi-slice1 -",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = unidlingProxy.assertNoEvents("after emptying first slice")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// A slice whose endpoints are all not-ready counts as empty, and the
+	// unidling proxy gets all of the service's slices
+	slice2NotReady := slice2.DeepCopy()
+	notReady := false
+	slice2NotReady.Endpoints[0].Conditions.Ready = &notReady
+	proxy.OnEndpointSliceUpdate(slice2, slice2NotReady)
+
+	err = mainProxy.assertEvents("after idling service",
+		"delete service testns/multi",
+		"update endpointslice testns/multi-slice2 5.6.7.8",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = unidlingProxy.assertEvents("after idling service",
+		"add service testns/multi",
+		"add endpointslice testns/multi-slice1 -",
+		"add endpointslice testns/multi-slice2 5.6.7.8",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Deleting one slice doesn't change anything, but when the other becomes
+	// ready the service is unidled
+	proxy.OnEndpointSliceDelete(slice1Idled)
+	proxy.OnEndpointSliceUpdate(slice2NotReady, slice2)
+
+	err = mainProxy.assertEvents("after unidling service",
+		"delete endpointslice testns/multi-slice1 -",
+		"add service testns/multi",
+		"update endpointslice testns/multi-slice2 5.6.7.8",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = unidlingProxy.assertEvents("after unidling service",
+		"delete endpointslice testns/multi-slice1 -",
+		"delete service testns/multi",
+		"update endpointslice testns/multi-slice2 5.6.7.8",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestHybridProxyNodeEvents(t *testing.T) {
+	proxy, mainProxy, unidlingProxy, err := newTestOsdnProxy(true)
+	if err != nil {
+		t.Fatalf("unexpected error creating OsdnProxy: %v", err)
+	}
+
+	// Node events (needed by the main proxy for topology hints) go to both proxies
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node1",
+			Labels: map[string]string{corev1.LabelTopologyZone: "zone-a"},
+		},
+	}
+	proxy.OnNodeAdd(node)
+	updatedNode := node.DeepCopy()
+	updatedNode.Labels[corev1.LabelTopologyZone] = "zone-b"
+	proxy.OnNodeUpdate(node, updatedNode)
+	proxy.OnNodeDelete(updatedNode)
+
+	for _, tp := range []*testProxy{mainProxy, unidlingProxy} {
+		err = tp.assertEvents("after node events",
+			"add node node1",
+			"update node node1",
+			"delete node node1",
+		)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+}
+
+type fakeHealthzServer struct {
+	queued  int
+	updated int
+}
+
+func (hz *fakeHealthzServer) QueuedUpdate() { hz.queued++ }
+func (hz *fakeHealthzServer) Updated()      { hz.updated++ }
+func (hz *fakeHealthzServer) Run() error    { return nil }
+
+func TestHybridProxyHealthz(t *testing.T) {
+	kubeInformers := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), time.Hour)
+	hz := &fakeHealthzServer{}
+	hybridProxy := NewHybridProxier(newTestProxy("main", true), newTestProxy("unidling", true), 0,
+		kubeInformers.Core().V1().Services().Lister(), hz)
+
+	// Syncs requested via the HybridProxier (eg, for changes that only affect the
+	// unidling proxy) are reported as queued updates
+	hybridProxy.Sync()
+	if hz.queued != 1 {
+		t.Fatalf("expected 1 queued update, got %d", hz.queued)
+	}
+}
+
+func TestHybridProxyServiceProxyStates(t *testing.T) {
+	proxy, _, _, err := newTestOsdnProxy(true)
+	if err != nil {
+		t.Fatalf("unexpected error creating OsdnProxy: %v", err)
+	}
+	hybridProxy := proxy.baseProxy.(*HybridProxier)
+
+	// One normal service and one idled service
+	svc := makeService("testns", "normal")
+	if err := createServiceAndWait(svc, proxy); err != nil {
+		t.Fatalf("unexpected error creating service: %v", err)
+	}
+	proxy.OnServiceAdd(svc)
+	_, slice := makeEndpoints("testns", "normal", "1.2.3.4")
+	proxy.OnEndpointSliceAdd(slice)
+
+	_, sliceIdled := makeEndpoints("testns", "idled")
+	proxy.OnEndpointSliceAdd(sliceIdled)
+	svcIdled := makeService("testns", "idled")
+	svcIdled.Annotations[unidlingapi.IdledAtAnnotation] = "now"
+	if err := createServiceAndWait(svcIdled, proxy); err != nil {
+		t.Fatalf("unexpected error creating service: %v", err)
+	}
+	proxy.OnServiceAdd(svcIdled)
+
+	states := hybridProxy.ServiceProxyStates()
+	if len(states) != 2 ||
+		states[0].Name != "idled" || states[0].Proxy != "unidling" || states[0].Since.IsZero() ||
+		states[1].Name != "normal" || states[1].Proxy != "main" || states[1].Since.IsZero() {
+		t.Fatalf("unexpected states %#v", states)
+	}
+	if idled, err := testutil.GetGaugeMetricValue(metrics.HybridProxyIdledServices); err != nil || idled != 1 {
+		t.Fatalf("unexpected idled metric %v (%v)", idled, err)
+	}
+
+	// Unidling the service switches it back
+	svcUnidled := makeService("testns", "idled")
+	proxy.OnServiceUpdate(svcIdled, svcUnidled)
+	_, sliceUnidled := makeEndpoints("testns", "idled", "5.6.7.8")
+	proxy.OnEndpointSliceUpdate(sliceIdled, sliceUnidled)
+
+	rec := httptest.NewRecorder()
+	proxy.ServeServiceProxyStates(rec, httptest.NewRequest("GET", "/debug/proxy/services", nil))
+	states = nil
+	if err := json.Unmarshal(rec.Body.Bytes(), &states); err != nil {
+		t.Fatalf("unexpected error decoding %q: %v", rec.Body.String(), err)
+	}
+	if len(states) != 2 || states[0].Name != "idled" || states[0].Proxy != "main" || states[0].UnidledAt == nil {
+		t.Fatalf("unexpected states %#v", states)
+	}
+	if idled, err := testutil.GetGaugeMetricValue(metrics.HybridProxyIdledServices); err != nil || idled != 0 {
+		t.Fatalf("unexpected idled metric %v (%v)", idled, err)
+	}
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+	kexec "k8s.io/utils/exec"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// serviceCommentRE matches an iptables-save -c line for a service proxy rule,
+// capturing the packet count and the "namespace/name" of the service
+var serviceCommentRE = regexp.MustCompile(`^\[(\d+):\d+\] -A KUBE-\S+ .*--comment "?([^"/\s:]+/[^"\s:]+)`)
+
+// IdleDetector tracks new connections to each service (as counted by the service
+// proxy's iptables rules on this node) and reports the time that each service last
+// had any in the node's service activity ConfigMap (see
+// common.ServiceActivityLabel). The SDN controller aggregates the nodes' reports and
+// marks services that have been quiet on every node as idle candidates.
+type IdleDetector struct {
+	kClient       kubernetes.Interface
+	serviceLister corelisters.ServiceLister
+	execer        kexec.Interface
+	saveCommand   string
+	nodeName      string
+
+	// reportInterval is how often the counters are read and (if any service has
+	// had new connections) the ConfigMap is updated
+	reportInterval time.Duration
+
+	lastCounts map[string]uint64
+	// lastActivity is the time each service (by "namespace/name") last had new
+	// connections on this node
+	lastActivity map[string]time.Time
+}
+
+// NewIdleDetector returns an IdleDetector for nodeName, for an idle detection
+// period of period
+func NewIdleDetector(kClient kubernetes.Interface, serviceLister corelisters.ServiceLister, execer kexec.Interface, protocol utiliptables.Protocol, nodeName string, period time.Duration) *IdleDetector {
+	saveCommand := "iptables-save"
+	if protocol == utiliptables.ProtocolIPv6 {
+		saveCommand = "ip6tables-save"
+	}
+	return &IdleDetector{
+		kClient:        kClient,
+		serviceLister:  serviceLister,
+		execer:         execer,
+		saveCommand:    saveCommand,
+		nodeName:       nodeName,
+		reportInterval: common.IdleDetectionReportInterval(period),
+		lastCounts:     make(map[string]uint64),
+		lastActivity:   make(map[string]time.Time),
+	}
+}
+
+// Run reports service activity until stopCh is closed
+func (d *IdleDetector) Run(stopCh <-chan struct{}) {
+	klog.Infof("Starting service activity reporting every %v", d.reportInterval)
+	utilwait.Until(d.check, d.reportInterval, stopCh)
+}
+
+// parseServiceConnectionCounts parses the output of "iptables-save -c -t nat" and
+// returns the total packet count of each service's proxy rules. Since only the first
+// packet of each connection traverses the nat table, this increases exactly when the
+// service gets new connections.
+func parseServiceConnectionCounts(save []byte) map[string]uint64 {
+	counts := make(map[string]uint64)
+	for _, line := range strings.Split(string(save), "\n") {
+		match := serviceCommentRE.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		count, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		counts[match[2]] += count
+	}
+	return counts
+}
+
+// update records the latest counts and returns the set of services that have had
+// new connections since the last call. If a service's count went down (because its
+// rules were rewritten), any connections are treated as new.
+func (d *IdleDetector) update(counts map[string]uint64) map[string]bool {
+	active := make(map[string]bool)
+	for name, count := range counts {
+		last, existed := d.lastCounts[name]
+		if !existed || count < last {
+			last = 0
+		}
+		if count > last {
+			active[name] = true
+		}
+	}
+	d.lastCounts = counts
+	return active
+}
+
+func (d *IdleDetector) check() {
+	save, err := d.execer.Command(d.saveCommand, "-c", "-t", string(utiliptables.TableNAT)).Output()
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to read service proxy rule counters for idle detection: %v", err))
+		return
+	}
+	if d.recordActivity(d.update(parseServiceConnectionCounts(save)), time.Now()) {
+		if err := d.report(); err != nil {
+			utilruntime.HandleError(fmt.Errorf("failed to report service activity: %v", err))
+		}
+	}
+}
+
+// recordActivity updates lastActivity for the services in active, and forgets
+// services that no longer exist. It returns true if anything changed.
+func (d *IdleDetector) recordActivity(active map[string]bool, now time.Time) bool {
+	changed := false
+	for name := range active {
+		d.lastActivity[name] = now
+		changed = true
+	}
+	for name := range d.lastActivity {
+		namespace, svcName := splitServiceName(name)
+		if _, err := d.serviceLister.Services(namespace).Get(svcName); kerrors.IsNotFound(err) {
+			delete(d.lastActivity, name)
+			changed = true
+		}
+	}
+	return changed
+}
+
+func splitServiceName(name string) (string, string) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 {
+		return "", name
+	}
+	return parts[0], parts[1]
+}
+
+// report writes lastActivity to the node's service activity ConfigMap
+func (d *IdleDetector) report() error {
+	data := make(map[string]string, len(d.lastActivity))
+	for name, t := range d.lastActivity {
+		namespace, svcName := splitServiceName(name)
+		data[common.ServiceActivityKey(namespace, svcName)] = t.UTC().Format(time.RFC3339)
+	}
+
+	configMaps := d.kClient.CoreV1().ConfigMaps(common.NodeSDNLeaseNamespace)
+	name := common.ServiceActivityConfigMapName(d.nodeName)
+	cm, err := configMaps.Get(context.TODO(), name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		_, err = configMaps.Create(context.TODO(), &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: common.NodeSDNLeaseNamespace,
+				Labels:    map[string]string{common.ServiceActivityLabel: "true"},
+			},
+			Data: data,
+		}, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+	cm.Data = data
+	_, err = configMaps.Update(context.TODO(), cm, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+func TestParseServiceConnectionCounts(t *testing.T) {
+	save := `# Generated by iptables-save
+*nat
+:KUBE-SERVICES - [0:0]
+[5:300] -A PREROUTING -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+[3:180] -A KUBE-SERVICES -d 172.30.0.10/32 -p tcp -m comment --comment "ns1/web:http cluster IP" -m tcp --dport 80 -j KUBE-SVC-AAAA
+[2:120] -A KUBE-SERVICES -d 172.30.0.10/32 -p tcp -m comment --comment "ns1/web:https cluster IP" -m tcp --dport 443 -j KUBE-SVC-BBBB
+[1:60] -A KUBE-NODEPORTS -p tcp -m comment --comment ns1/web:http -m tcp --dport 30080 -j KUBE-SVC-AAAA
+[0:0] -A KUBE-SERVICES -d 172.30.0.11/32 -p udp -m comment --comment "ns2/dns:dns cluster IP" -m udp --dport 53 -j KUBE-SVC-CCCC
+[7:420] -A OPENSHIFT-MASQUERADE -s 10.128.0.0/14 -m comment --comment "masquerade pod-to-service and pod-to-external traffic" -j MASQUERADE
+COMMIT
+`
+	counts := parseServiceConnectionCounts([]byte(save))
+	expected := map[string]uint64{
+		"ns1/web": 6,
+		"ns2/dns": 0,
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("expected %v, got %v", expected, counts)
+	}
+}
+
+func TestIdleDetection(t *testing.T) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	web := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ns1", Name: "web"}}
+	kClient := fake.NewSimpleClientset(web)
+	kubeInformers := informers.NewSharedInformerFactory(kClient, 0)
+	serviceInformer := kubeInformers.Core().V1().Services()
+	if err := serviceInformer.Informer().GetStore().Add(web); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := NewIdleDetector(kClient, serviceInformer.Lister(), nil, utiliptables.ProtocolIPv4, "node1", time.Hour)
+
+	active := d.update(map[string]uint64{"ns1/web": 5, "ns2/dns": 0})
+	if !reflect.DeepEqual(active, map[string]bool{"ns1/web": true}) {
+		t.Fatalf("unexpected active services %v", active)
+	}
+	active = d.update(map[string]uint64{"ns1/web": 5, "ns2/dns": 1})
+	if !reflect.DeepEqual(active, map[string]bool{"ns2/dns": true}) {
+		t.Fatalf("unexpected active services %v", active)
+	}
+	// Rewritten rules start counting again
+	active = d.update(map[string]uint64{"ns1/web": 2, "ns2/dns": 1})
+	if !reflect.DeepEqual(active, map[string]bool{"ns1/web": true}) {
+		t.Fatalf("unexpected active services %v", active)
+	}
+
+	// Nothing is reported until there is activity
+	if d.recordActivity(nil, start) {
+		t.Fatalf("unexpected change with no activity")
+	}
+	// ns2/dns doesn't exist, so it is forgotten again
+	if !d.recordActivity(map[string]bool{"ns1/web": true, "ns2/dns": true}, start) {
+		t.Fatalf("expected change with new activity")
+	}
+	if err := d.report(); err != nil {
+		t.Fatalf("unexpected error reporting activity: %v", err)
+	}
+	cm, err := kClient.CoreV1().ConfigMaps(common.NodeSDNLeaseNamespace).Get(context.TODO(), common.ServiceActivityConfigMapName("node1"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting ConfigMap: %v", err)
+	}
+	if expected := map[string]string{"ns1.web": "2021-06-01T12:00:00Z"}; !reflect.DeepEqual(cm.Data, expected) || cm.Labels[common.ServiceActivityLabel] != "true" {
+		t.Fatalf("unexpected ConfigMap %#v", cm)
+	}
+
+	if !d.recordActivity(map[string]bool{"ns1/web": true}, start.Add(10*time.Minute)) {
+		t.Fatalf("expected change with new activity")
+	}
+	if err := d.report(); err != nil {
+		t.Fatalf("unexpected error reporting activity: %v", err)
+	}
+	cm, err = kClient.CoreV1().ConfigMaps(common.NodeSDNLeaseNamespace).Get(context.TODO(), common.ServiceActivityConfigMapName("node1"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting ConfigMap: %v", err)
+	}
+	if expected := map[string]string{"ns1.web": "2021-06-01T12:10:00Z"}; !reflect.DeepEqual(cm.Data, expected) {
+		t.Fatalf("unexpected ConfigMap data %v", cm.Data)
+	}
+}
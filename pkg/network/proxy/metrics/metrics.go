@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	SDNNamespace = "openshift"
+	SDNSubsystem = "sdn"
+
+	UnidlingNeedPodsSignalsKey = "unidling_needpods_signals_total"
+	UnidlingWakeDurationKey    = "unidling_wake_duration_seconds"
+)
+
+var (
+	UnidlingNeedPodsSignals = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      UnidlingNeedPodsSignalsKey,
+			Help:      "Cumulative number of times traffic to an idled service caused it to be woken, by service",
+		},
+		[]string{"namespace", "service"},
+	)
+
+	UnidlingWakeDuration = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Namespace: SDNNamespace,
+			Subsystem: SDNSubsystem,
+			Name:      UnidlingWakeDurationKey,
+			Help:      "Time in seconds from the first traffic to an idled service until it had endpoints",
+			Buckets:   metrics.ExponentialBuckets(0.5, 2, 10),
+		},
+	)
+)
+
+var registerMetrics sync.Once
+
+// Register all proxy metrics.
+func RegisterMetrics() {
+	registerMetrics.Do(func() {
+		legacyregistry.MustRegister(UnidlingNeedPodsSignals)
+		legacyregistry.MustRegister(UnidlingWakeDuration)
+	})
+}
+
+// DeleteServiceMetrics deletes the per-service metrics of a deleted service
+func DeleteServiceMetrics(namespace, name string) {
+	UnidlingNeedPodsSignals.Delete(map[string]string{"namespace": namespace, "service": name})
+}
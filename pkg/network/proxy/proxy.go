@@ -2,8 +2,11 @@ package proxy
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
+	"sort"
 	"sync"
 	"time"
 
@@ -18,11 +21,14 @@ import (
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/pkg/proxy/apis"
+	"k8s.io/kubernetes/pkg/proxy/healthcheck"
 
 	osdnv1 "github.com/openshift/api/network/v1"
 	osdnclient "github.com/openshift/client-go/network/clientset/versioned"
 	osdninformers "github.com/openshift/client-go/network/informers/externalversions"
 	"github.com/openshift/sdn/pkg/network/common"
+	"github.com/openshift/sdn/pkg/network/node/metrics"
 )
 
 type firewallItem struct {
@@ -40,11 +46,19 @@ type proxyEndpointSlice struct {
 	blocked       bool
 }
 
+type proxyFirewall struct {
+	name     string
+	priority int
+	items    []firewallItem
+}
+
 type proxyNamespace struct {
 	global bool
 
-	firewalls    map[ktypes.UID][]firewallItem
-	activePolicy *ktypes.UID
+	firewalls map[ktypes.UID]*proxyFirewall
+	// activeFirewall is the concatenation of all of the items in firewalls, in
+	// priority order
+	activeFirewall []firewallItem
 
 	blockableEndpoints      map[ktypes.UID]*proxyEndpoints
 	blockableEndpointSlices map[ktypes.UID]*proxyEndpointSlice
@@ -77,9 +91,11 @@ func New(kClient kubernetes.Interface,
 	kubeInformers informers.SharedInformerFactory,
 	osdnClient osdnclient.Interface,
 	osdnInformers osdninformers.SharedInformerFactory,
-	minSyncPeriod time.Duration) (*OsdnProxy, error) {
+	minSyncPeriod time.Duration,
+	egressDNSResolvConf string,
+	egressDNSServers []string) (*OsdnProxy, error) {
 
-	egressDNS, err := common.NewEgressDNS(true, false)
+	egressDNS, err := common.NewEgressDNS(true, false, egressDNSResolvConf, egressDNSServers, metrics.ObserveEgressDNSResolution)
 	if err != nil {
 		return nil, err
 	}
@@ -94,7 +110,7 @@ func New(kClient kubernetes.Interface,
 	}, nil
 }
 
-func (proxy *OsdnProxy) SetBaseProxies(mainProxy, unidlingProxy HybridizableProxy) {
+func (proxy *OsdnProxy) SetBaseProxies(mainProxy, unidlingProxy HybridizableProxy, healthzServer healthcheck.ProxierHealthUpdater) {
 	if unidlingProxy == nil {
 		proxy.baseProxy = mainProxy
 	} else {
@@ -102,10 +118,33 @@ func (proxy *OsdnProxy) SetBaseProxies(mainProxy, unidlingProxy HybridizableProx
 			mainProxy, unidlingProxy,
 			proxy.minSyncPeriod,
 			proxy.kubeInformers.Core().V1().Services().Lister(),
+			healthzServer,
 		)
 	}
 }
 
+// SetServiceUnidledHandler sets a function to call when an idled service gets
+// endpoints again, if unidling is enabled
+func (proxy *OsdnProxy) SetServiceUnidledHandler(handler func(ktypes.NamespacedName)) {
+	if hybridProxy, ok := proxy.baseProxy.(*HybridProxier); ok {
+		hybridProxy.SetServiceUnidledHandler(handler)
+	}
+}
+
+// ServeServiceProxyStates is an HTTP handler returning the HybridProxier's
+// ServiceProxyStates as JSON
+func (proxy *OsdnProxy) ServeServiceProxyStates(w http.ResponseWriter, r *http.Request) {
+	hybridProxy, ok := proxy.baseProxy.(*HybridProxier)
+	if !ok {
+		http.Error(w, "unidling is not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(hybridProxy.ServiceProxyStates()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (proxy *OsdnProxy) Start(waitChan chan<- bool) error {
 	klog.Infof("Starting multitenant SDN proxy endpoint filter")
 
@@ -145,7 +184,7 @@ func (proxy *OsdnProxy) getNamespace(name string) *proxyNamespace {
 	ns := proxy.namespaces[name]
 	if ns == nil {
 		ns = &proxyNamespace{
-			firewalls:               make(map[ktypes.UID][]firewallItem),
+			firewalls:               make(map[ktypes.UID]*proxyFirewall),
 			blockableEndpoints:      make(map[ktypes.UID]*proxyEndpoints),
 			blockableEndpointSlices: make(map[ktypes.UID]*proxyEndpointSlice),
 		}
@@ -234,8 +273,16 @@ func (proxy *OsdnProxy) updateEgressNetworkPolicy(policy osdnv1.EgressNetworkPol
 		return
 	}
 
+	rules := policy.Spec.Egress
+	if common.IsEgressNetworkPolicyAuditOnly(&policy) {
+		// Audit-only policies never block traffic, so they don't affect which
+		// endpoints are allowed.
+		klog.V(5).Infof("Ignoring rules of audit-only EgressNetworkPolicy %s/%s", policy.Namespace, policy.Name)
+		rules = nil
+	}
+
 	firewall := []firewallItem{}
-	for _, rule := range policy.Spec.Egress {
+	for _, rule := range rules {
 		if len(rule.To.CIDRSelector) > 0 {
 			selector := rule.To.CIDRSelector
 			if selector == "0.0.0.0/32" {
@@ -250,7 +297,7 @@ func (proxy *OsdnProxy) updateEgressNetworkPolicy(policy osdnv1.EgressNetworkPol
 			}
 			firewall = append(firewall, firewallItem{rule.Type, cidr})
 		} else if len(rule.To.DNSName) > 0 {
-			cidrs := proxy.egressDNS.GetNetCIDRs(rule.To.DNSName)
+			cidrs := proxy.egressDNS.GetPolicyNetCIDRs(&policy, rule.To.DNSName)
 			for _, cidr := range cidrs {
 				firewall = append(firewall, firewallItem{rule.Type, &cidr})
 			}
@@ -262,25 +309,16 @@ func (proxy *OsdnProxy) updateEgressNetworkPolicy(policy osdnv1.EgressNetworkPol
 
 	// Add/Update/Delete firewall rules for the namespace
 	if len(firewall) > 0 {
-		ns.firewalls[policy.UID] = firewall
-	} else {
-		delete(ns.firewalls, policy.UID)
-	}
-
-	// Set active policy for the namespace
-	if len(ns.firewalls) == 1 {
-		for uid := range ns.firewalls {
-			ns.activePolicy = &uid
-			klog.Infof("Applied firewall egress network policy: %q to namespace: %q", uid, policy.Namespace)
+		ns.firewalls[policy.UID] = &proxyFirewall{
+			name:     policy.Name,
+			priority: common.GetEgressNetworkPolicyPriority(&policy),
+			items:    firewall,
 		}
+		klog.Infof("Applied firewall egress network policy: %q to namespace: %q", policy.UID, policy.Namespace)
 	} else {
-		ns.activePolicy = nil
-
-		if len(ns.firewalls) > 1 {
-			// We only allow one policy per namespace otherwise it's hard to determine which policy to apply first
-			utilruntime.HandleError(fmt.Errorf("Found multiple egress policies, dropping all firewall rules for namespace: %q", policy.Namespace))
-		}
+		delete(ns.firewalls, policy.UID)
 	}
+	ns.updateActiveFirewall()
 
 	// Update endpoints and slices
 	for _, pep := range ns.blockableEndpoints {
@@ -337,10 +375,30 @@ func (proxy *OsdnProxy) endpointSliceBlockable(ns *proxyNamespace, slice *discov
 	return false
 }
 
+// Merges ns.firewalls into ns.activeFirewall, ordered the same way as
+// common.SortEgressNetworkPolicies. Assumes lock is held
+func (ns *proxyNamespace) updateActiveFirewall() {
+	firewalls := make([]*proxyFirewall, 0, len(ns.firewalls))
+	for _, fw := range ns.firewalls {
+		firewalls = append(firewalls, fw)
+	}
+	sort.Slice(firewalls, func(i, j int) bool {
+		if firewalls[i].priority != firewalls[j].priority {
+			return firewalls[i].priority > firewalls[j].priority
+		}
+		return firewalls[i].name < firewalls[j].name
+	})
+
+	ns.activeFirewall = nil
+	for _, fw := range firewalls {
+		ns.activeFirewall = append(ns.activeFirewall, fw.items...)
+	}
+}
+
 // Assumes lock is held
 func (ns *proxyNamespace) firewallBlocks(ipStr string) bool {
 	ip := net.ParseIP(ipStr)
-	for _, item := range ns.firewalls[*ns.activePolicy] {
+	for _, item := range ns.activeFirewall {
 		if item.net.Contains(ip) {
 			return item.ruleType == osdnv1.EgressNetworkPolicyRuleDeny
 		}
@@ -353,9 +411,6 @@ func (ns *proxyNamespace) firewallBlocks(ipStr string) bool {
 func (proxy *OsdnProxy) endpointsBlocked(ns *proxyNamespace, ep *corev1.Endpoints) bool {
 	if len(ns.firewalls) == 0 {
 		return false
-	} else if ns.activePolicy == nil {
-		// Block all connections if active policy is not set
-		return true
 	}
 
 	for _, ss := range ep.Subsets {
@@ -374,9 +429,6 @@ func (proxy *OsdnProxy) endpointsBlocked(ns *proxyNamespace, ep *corev1.Endpoint
 func (proxy *OsdnProxy) endpointSliceBlocked(ns *proxyNamespace, slice *discoveryv1.EndpointSlice) bool {
 	if len(ns.firewalls) == 0 {
 		return false
-	} else if ns.activePolicy == nil {
-		// Block all connections if active policy is not set
-		return true
 	}
 
 	for _, ep := range slice.Endpoints {
@@ -390,6 +442,16 @@ func (proxy *OsdnProxy) endpointSliceBlocked(ns *proxyNamespace, slice *discover
 	return false
 }
 
+// isProxiedElsewhere returns true if obj is labeled to be handled by a different
+// service proxy implementation (eg, MetalLB), in which case we ignore it. The
+// label is copied from the Service to its Endpoints and EndpointSlices. The
+// openshift-sdn-node informers already filter these out; this catches objects
+// delivered by informers that don't.
+func isProxiedElsewhere(obj metav1.Object) bool {
+	_, ok := obj.GetLabels()[apis.LabelServiceProxyName]
+	return ok
+}
+
 // Assumes lock is held
 func (proxy *OsdnProxy) checkInitialized() {
 	if proxy.servicesSynced && proxy.endpointsSynced && proxy.waitChan != nil {
@@ -400,6 +462,10 @@ func (proxy *OsdnProxy) checkInitialized() {
 }
 
 func (proxy *OsdnProxy) OnEndpointsAdd(ep *corev1.Endpoints) {
+	if isProxiedElsewhere(ep) {
+		return
+	}
+
 	proxy.Lock()
 	defer proxy.Unlock()
 
@@ -416,6 +482,17 @@ func (proxy *OsdnProxy) OnEndpointsAdd(ep *corev1.Endpoints) {
 }
 
 func (proxy *OsdnProxy) OnEndpointsUpdate(old, ep *corev1.Endpoints) {
+	switch wasSkipped, skipped := isProxiedElsewhere(old), isProxiedElsewhere(ep); {
+	case wasSkipped && skipped:
+		return
+	case wasSkipped:
+		proxy.OnEndpointsAdd(ep)
+		return
+	case skipped:
+		proxy.OnEndpointsDelete(old)
+		return
+	}
+
 	proxy.Lock()
 	defer proxy.Unlock()
 
@@ -454,6 +531,10 @@ func (proxy *OsdnProxy) OnEndpointsUpdate(old, ep *corev1.Endpoints) {
 }
 
 func (proxy *OsdnProxy) OnEndpointsDelete(ep *corev1.Endpoints) {
+	if isProxiedElsewhere(ep) {
+		return
+	}
+
 	proxy.Lock()
 	defer proxy.Unlock()
 
@@ -484,6 +565,10 @@ func (proxy *OsdnProxy) OnEndpointsSynced() {
 }
 
 func (proxy *OsdnProxy) OnEndpointSliceAdd(slice *discoveryv1.EndpointSlice) {
+	if isProxiedElsewhere(slice) {
+		return
+	}
+
 	proxy.Lock()
 	defer proxy.Unlock()
 
@@ -500,6 +585,17 @@ func (proxy *OsdnProxy) OnEndpointSliceAdd(slice *discoveryv1.EndpointSlice) {
 }
 
 func (proxy *OsdnProxy) OnEndpointSliceUpdate(old, slice *discoveryv1.EndpointSlice) {
+	switch wasSkipped, skipped := isProxiedElsewhere(old), isProxiedElsewhere(slice); {
+	case wasSkipped && skipped:
+		return
+	case wasSkipped:
+		proxy.OnEndpointSliceAdd(slice)
+		return
+	case skipped:
+		proxy.OnEndpointSliceDelete(old)
+		return
+	}
+
 	proxy.Lock()
 	defer proxy.Unlock()
 
@@ -538,6 +634,10 @@ func (proxy *OsdnProxy) OnEndpointSliceUpdate(old, slice *discoveryv1.EndpointSl
 }
 
 func (proxy *OsdnProxy) OnEndpointSliceDelete(slice *discoveryv1.EndpointSlice) {
+	if isProxiedElsewhere(slice) {
+		return
+	}
+
 	proxy.Lock()
 	defer proxy.Unlock()
 
@@ -584,15 +684,31 @@ func (proxier *OsdnProxy) OnNodeSynced() {
 }
 
 func (proxy *OsdnProxy) OnServiceAdd(service *corev1.Service) {
+	if isProxiedElsewhere(service) {
+		klog.V(4).Infof("sdn proxy: ignoring svc %s/%s handled by service proxy %q", service.Namespace, service.Name, service.Labels[apis.LabelServiceProxyName])
+		return
+	}
 	klog.V(4).Infof("sdn proxy: add svc %s/%s: %v", service.Namespace, service.Name, service)
 	proxy.baseProxy.OnServiceAdd(service)
 }
 
 func (proxy *OsdnProxy) OnServiceUpdate(oldService, service *corev1.Service) {
-	proxy.baseProxy.OnServiceUpdate(oldService, service)
+	switch wasSkipped, skipped := isProxiedElsewhere(oldService), isProxiedElsewhere(service); {
+	case wasSkipped && skipped:
+		return
+	case wasSkipped:
+		proxy.OnServiceAdd(service)
+	case skipped:
+		proxy.OnServiceDelete(oldService)
+	default:
+		proxy.baseProxy.OnServiceUpdate(oldService, service)
+	}
 }
 
 func (proxy *OsdnProxy) OnServiceDelete(service *corev1.Service) {
+	if isProxiedElsewhere(service) {
+		return
+	}
 	proxy.baseProxy.OnServiceDelete(service)
 }
 
@@ -224,12 +224,15 @@ func (tp *testProxy) OnEndpointSlicesSynced() {
 }
 
 func (tp *testProxy) OnNodeAdd(node *corev1.Node) {
+	tp.events = append(tp.events, fmt.Sprintf("add node %s", node.Name))
 }
 
 func (tp *testProxy) OnNodeUpdate(oldNode, node *corev1.Node) {
+	tp.events = append(tp.events, fmt.Sprintf("update node %s", node.Name))
 }
 
 func (tp *testProxy) OnNodeDelete(node *corev1.Node) {
+	tp.events = append(tp.events, fmt.Sprintf("delete node %s", node.Name))
 }
 
 func (tp *testProxy) OnNodeSynced() {
@@ -301,7 +304,7 @@ func newTestOsdnProxy(usesEndpointSlices bool) (*OsdnProxy, *testProxy, *testPro
 	kubeClient := fake.NewSimpleClientset()
 	kubeInformers := informers.NewSharedInformerFactory(kubeClient, time.Hour)
 
-	proxy, err := New(kubeClient, kubeInformers, nil, nil, 0)
+	proxy, err := New(kubeClient, kubeInformers, nil, nil, 0, "", nil)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -314,8 +317,8 @@ func newTestOsdnProxy(usesEndpointSlices bool) (*OsdnProxy, *testProxy, *testPro
 	}
 
 	mainProxy := newTestProxy("main", usesEndpointSlices)
-	unidlingProxy := newTestProxy("unidling", false)
-	proxy.SetBaseProxies(mainProxy, unidlingProxy)
+	unidlingProxy := newTestProxy("unidling", usesEndpointSlices)
+	proxy.SetBaseProxies(mainProxy, unidlingProxy, nil)
 
 	stopCh := make(chan struct{})
 	proxy.kubeInformers.Start(stopCh)
@@ -487,7 +490,9 @@ func TestOsdnProxy(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 
-	// Now copy "three"s ENP to "two" too, which should totally break external connectivity
+	// Now copy "three"s ENP to "two" too. Since the policies have the same
+	// priority, "enp2a"s rules are evaluated first, followed by "enp2b"s, so the
+	// only additional thing blocked is what neither of them allows.
 	enp2b := enp3.DeepCopy()
 	enp2b.Namespace = namespaces[2].Name
 	enp2b.Name = "enp2b"
@@ -496,19 +501,28 @@ func TestOsdnProxy(t *testing.T) {
 
 	err = tp.assertEvents("after copying second EgressNetworkPolicy to namespace two",
 		"delete endpointslice two/extfar-slice1 1.2.3.4",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Giving "enp2b" a higher priority puts its deny-all rule first, blocking
+	// everything except what it explicitly allows
+	enp2b = enp2b.DeepCopy()
+	enp2b.Annotations = map[string]string{common.EgressNetworkPolicyPriorityAnnotation: "1"}
+	proxy.handleAddOrUpdateEgressNetworkPolicy(enp2b, nil, watch.Modified)
+
+	err = tp.assertEvents("after raising priority of second EgressNetworkPolicy in namespace two",
 		"delete endpointslice two/extnear-slice1 192.168.2.5",
-		"delete endpointslice two/extexcept-slice1 192.168.1.1",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 
-	// Now delete the first ENP, which should result in the second becoming active
-	// (meaning "two" will allow the same things as "three")
+	// Now delete the first ENP, which should have no effect since the second
+	// one blocks everything it would have
 	proxy.handleDeleteEgressNetworkPolicy(enp2a)
-	err = tp.assertEvents("after deleting first EgressNetworkPolicy from namespace two",
-		"add endpointslice two/extexcept-slice1 192.168.1.1",
-	)
+	err = tp.assertNoEvents("after deleting first EgressNetworkPolicy from namespace two")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -634,3 +648,56 @@ func TestOsdnProxy(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 }
+
+func TestOsdnProxyServiceProxyName(t *testing.T) {
+	proxy, tp, _, err := newTestOsdnProxy(false)
+	if err != nil {
+		t.Fatalf("unexpected error creating OsdnProxy: %v", err)
+	}
+	proxy.SetBaseProxies(tp, nil, nil)
+
+	label := func(obj metav1.Object) {
+		obj.SetLabels(map[string]string{"service.kubernetes.io/service-proxy-name": "metallb"})
+	}
+
+	// Services and endpoints for another proxy are ignored
+	svc := makeService("testns", "other")
+	label(svc)
+	ep, _ := makeEndpoints("testns", "other", "10.130.0.5")
+	label(ep)
+	proxy.OnServiceAdd(svc)
+	proxy.OnEndpointsAdd(ep)
+	if err := tp.assertNoEvents("after adding labeled service"); err != nil {
+		t.Fatal(err)
+	}
+
+	// If the label is removed, they show up as new
+	unlabeledSvc := makeService("testns", "other")
+	unlabeledEp, _ := makeEndpoints("testns", "other", "10.130.0.5")
+	proxy.OnServiceUpdate(svc, unlabeledSvc)
+	proxy.OnEndpointsUpdate(ep, unlabeledEp)
+	err = tp.assertEvents("after removing label",
+		"add service testns/other",
+		"add endpoints testns/other 10.130.0.5",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// And if it's added back, they go away again
+	proxy.OnServiceUpdate(unlabeledSvc, svc)
+	proxy.OnEndpointsUpdate(unlabeledEp, ep)
+	err = tp.assertEvents("after re-adding label",
+		"delete service testns/other",
+		"delete endpoints testns/other 10.130.0.5",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.OnEndpointsDelete(ep)
+	proxy.OnServiceDelete(svc)
+	if err := tp.assertNoEvents("after deleting labeled service"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,146 @@
+package unidler
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/kubernetes/pkg/proxy"
+	utilproxy "k8s.io/kubernetes/pkg/proxy/util"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+)
+
+const (
+	// unidlerContainerChain redirects traffic arriving at the node (including from
+	// pods, via tun0) for idled services to the trap sockets
+	unidlerContainerChain utiliptables.Chain = "OPENSHIFT-UNIDLER-CONTAINER"
+	// unidlerHostChain redirects traffic from the node itself for idled services
+	unidlerHostChain utiliptables.Chain = "OPENSHIFT-UNIDLER-HOST"
+)
+
+type portalChain struct {
+	chain    utiliptables.Chain
+	srcChain utiliptables.Chain
+	comment  string
+}
+
+var portalChains = []portalChain{
+	{unidlerContainerChain, utiliptables.ChainPrerouting, "handle idled services"},
+	{unidlerHostChain, utiliptables.ChainOutput, "handle idled services"},
+}
+
+// ensurePortalChains creates the unidler chains and the jumps to them
+func ensurePortalChains(ipt utiliptables.Interface) error {
+	for _, pc := range portalChains {
+		if _, err := ipt.EnsureChain(utiliptables.TableNAT, pc.chain); err != nil {
+			return fmt.Errorf("failed to ensure chain %s: %v", pc.chain, err)
+		}
+		args := []string{"-m", "comment", "--comment", pc.comment, "-j", string(pc.chain)}
+		if _, err := ipt.EnsureRule(utiliptables.Prepend, utiliptables.TableNAT, pc.srcChain, args...); err != nil {
+			return fmt.Errorf("failed to ensure jump from %s to %s: %v", pc.srcChain, pc.chain, err)
+		}
+	}
+	return nil
+}
+
+// CleanupLeftovers removes all iptables rules and chains created by the unidler
+func CleanupLeftovers(ipt utiliptables.Interface) (encounteredError bool) {
+	for _, pc := range portalChains {
+		args := []string{"-m", "comment", "--comment", pc.comment, "-j", string(pc.chain)}
+		if err := ipt.DeleteRule(utiliptables.TableNAT, pc.srcChain, args...); err != nil && !utiliptables.IsNotFoundError(err) {
+			klog.Errorf("Error removing unidler rule from %s: %v", pc.srcChain, err)
+			encounteredError = true
+		}
+		if err := ipt.FlushChain(utiliptables.TableNAT, pc.chain); err != nil && !utiliptables.IsNotFoundError(err) {
+			klog.Errorf("Error flushing unidler chain %s: %v", pc.chain, err)
+			encounteredError = true
+			continue
+		}
+		if err := ipt.DeleteChain(utiliptables.TableNAT, pc.chain); err != nil && !utiliptables.IsNotFoundError(err) {
+			klog.Errorf("Error deleting unidler chain %s: %v", pc.chain, err)
+			encounteredError = true
+		}
+	}
+	return encounteredError
+}
+
+// portalRules returns iptables-restore input that replaces the contents of the
+// unidler chains with rules redirecting each trapped service port to its socket.
+// Must be called with p.mu held.
+func (p *Proxier) portalRules() []byte {
+	containerRules := []string{}
+	hostRules := []string{}
+
+	svcPortNames := make([]proxy.ServicePortName, 0, len(p.servicePorts))
+	for svcPortName := range p.servicePorts {
+		svcPortNames = append(svcPortNames, svcPortName)
+	}
+	sort.Slice(svcPortNames, func(i, j int) bool {
+		return svcPortNames[i].String() < svcPortNames[j].String()
+	})
+
+	for _, svcPortName := range svcPortNames {
+		info := p.servicePorts[svcPortName]
+		proxyPort := info.socket.ListenPort()
+
+		destIPs := []string{info.clusterIP.String()}
+		destIPs = append(destIPs, info.externalIPs...)
+		destIPs = append(destIPs, info.lbIPs...)
+		for _, destIP := range destIPs {
+			ip := net.ParseIP(destIP)
+			if ip == nil {
+				continue
+			}
+			match := portalMatch(svcPortName, info.protocol, info.port) + " -d " + utilproxy.ToCIDR(ip)
+			containerRules = append(containerRules, match+" "+p.containerTarget(proxyPort))
+			hostRules = append(hostRules, match+" "+p.hostTarget(proxyPort))
+		}
+		if info.nodePort != 0 {
+			match := portalMatch(svcPortName, info.protocol, info.nodePort) + " -m addrtype --dst-type LOCAL"
+			containerRules = append(containerRules, match+" "+p.containerTarget(proxyPort))
+			hostRules = append(hostRules, match+" "+p.hostTarget(proxyPort))
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("*nat\n")
+	fmt.Fprintf(&buf, ":%s - [0:0]\n", unidlerContainerChain)
+	fmt.Fprintf(&buf, ":%s - [0:0]\n", unidlerHostChain)
+	for _, rule := range containerRules {
+		fmt.Fprintf(&buf, "-A %s %s\n", unidlerContainerChain, rule)
+	}
+	for _, rule := range hostRules {
+		fmt.Fprintf(&buf, "-A %s %s\n", unidlerHostChain, rule)
+	}
+	buf.WriteString("COMMIT\n")
+	return buf.Bytes()
+}
+
+func portalMatch(svcPortName proxy.ServicePortName, protocol v1.Protocol, destPort int) string {
+	proto := strings.ToLower(string(protocol))
+	return fmt.Sprintf("-m comment --comment %q -p %s -m %s --dport %d", svcPortName.String(), proto, proto, destPort)
+}
+
+// containerTarget returns the target for traffic arriving at the node. If we are
+// listening on all addresses then REDIRECT works, sending the traffic to the
+// primary address of the incoming interface; otherwise we have to DNAT to the
+// address we are listening on.
+func (p *Proxier) containerTarget(proxyPort int) string {
+	if p.listenIP.IsUnspecified() {
+		return fmt.Sprintf("-j REDIRECT --to-ports %d", proxyPort)
+	}
+	return fmt.Sprintf("-j DNAT --to-destination %s", net.JoinHostPort(p.listenIP.String(), strconv.Itoa(proxyPort)))
+}
+
+// hostTarget returns the target for locally-generated traffic. REDIRECT would
+// send it to localhost, from which replies can't be NATed back correctly, so
+// we always DNAT to a real address of the node.
+func (p *Proxier) hostTarget(proxyPort int) string {
+	return fmt.Sprintf("-j DNAT --to-destination %s", net.JoinHostPort(p.hostIP.String(), strconv.Itoa(proxyPort)))
+}
@@ -0,0 +1,268 @@
+package unidler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// EventSignalerName, WebhookSignalerName, ResourceSignalerName, and
+	// PendingSignalerName are the names of the available NeedPodsSignalers
+	EventSignalerName    = "event"
+	WebhookSignalerName  = "webhook"
+	ResourceSignalerName = "resource"
+	PendingSignalerName  = "pending"
+
+	// DefaultPendingWakeTTL is how long a service stays pending after its last
+	// NeedPods signal, by default
+	DefaultPendingWakeTTL = 5 * time.Minute
+
+	signalerTimeout = 5 * time.Second
+)
+
+// NeedPodsRequest is the body of the request that the webhook signaler POSTs
+type NeedPodsRequest struct {
+	Namespace string      `json:"namespace"`
+	Service   string      `json:"service"`
+	Port      string      `json:"port"`
+	Time      metav1.Time `json:"time"`
+}
+
+type webhookSignaler struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSignaler constructs a NeedPodsSignaler which signals by POSTing a
+// JSON-encoded NeedPodsRequest to url.
+func NewWebhookSignaler(url string) NeedPodsSignaler {
+	return &webhookSignaler{
+		url:    url,
+		client: &http.Client{Timeout: signalerTimeout},
+	}
+}
+
+func (sig *webhookSignaler) NeedPods(serviceName types.NamespacedName, port string) error {
+	body, err := json.Marshal(&NeedPodsRequest{
+		Namespace: serviceName.Namespace,
+		Service:   serviceName.Name,
+		Port:      port,
+		Time:      metav1.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := sig.client.Post(sig.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned %s", sig.url, resp.Status)
+	}
+	return nil
+}
+
+type resourceSignaler struct {
+	client   dynamic.Interface
+	resource schema.GroupVersionResource
+}
+
+// NewResourceSignaler constructs a NeedPodsSignaler which signals by setting
+// status.needPodsAt and status.needPodsPort on the object of type resource with the
+// same namespace and name as the service. (The object is not created if it does not
+// already exist.)
+func NewResourceSignaler(client dynamic.Interface, resource schema.GroupVersionResource) NeedPodsSignaler {
+	return &resourceSignaler{
+		client:   client,
+		resource: resource,
+	}
+}
+
+func (sig *resourceSignaler) NeedPods(serviceName types.NamespacedName, port string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"needPodsAt":   metav1.Now(),
+			"needPodsPort": port,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), signalerTimeout)
+	defer cancel()
+	_, err = sig.client.Resource(sig.resource).Namespace(serviceName.Namespace).Patch(ctx, serviceName.Name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+	if err != nil {
+		return fmt.Errorf("could not update %s %s: %v", sig.resource.Resource, serviceName, err)
+	}
+	return nil
+}
+
+type multiSignaler []NeedPodsSignaler
+
+// NewMultiSignaler constructs a NeedPodsSignaler which signals using each of signalers
+func NewMultiSignaler(signalers ...NeedPodsSignaler) NeedPodsSignaler {
+	if len(signalers) == 1 {
+		return signalers[0]
+	}
+	return multiSignaler(signalers)
+}
+
+func (sigs multiSignaler) NeedPods(serviceName types.NamespacedName, port string) error {
+	var errs []error
+	for _, sig := range sigs {
+		if err := sig.NeedPods(serviceName, port); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// PendingWake is a service that needs pods, as reported by a PendingWakeSignaler
+type PendingWake struct {
+	Namespace string   `json:"namespace"`
+	Service   string   `json:"service"`
+	Ports     []string `json:"ports"`
+	// FirstSignal and LastSignal are the times of the first and most recent
+	// NeedPods signals since the service became pending, and Signals is how many
+	// there have been
+	FirstSignal metav1.Time `json:"firstSignal"`
+	LastSignal  metav1.Time `json:"lastSignal"`
+	Signals     int         `json:"signals"`
+}
+
+// PendingWakeList is the result of PendingWakeSignaler's HTTP handler
+type PendingWakeList struct {
+	// Count is len(Services), for autoscalers that need a single number (eg, a
+	// KEDA "metrics-api" trigger with valueLocation "count")
+	Count    int           `json:"count"`
+	Services []PendingWake `json:"services"`
+}
+
+// PendingWakeSignaler is a NeedPodsSignaler which records the services that need
+// pods, so that external autoscalers can poll for them and scale idled workloads up
+// themselves. A service stays pending until it is Forgotten (once it has endpoints
+// again) or ttl has passed since its last NeedPods signal. Each node only knows
+// about the signals from its own unidling proxy; the master merges the nodes' lists.
+type PendingWakeSignaler struct {
+	ttl time.Duration
+
+	lock    sync.Mutex
+	pending map[types.NamespacedName]*PendingWake
+}
+
+// NewPendingWakeSignaler constructs a PendingWakeSignaler which keeps services
+// pending for ttl after their last NeedPods signal
+func NewPendingWakeSignaler(ttl time.Duration) *PendingWakeSignaler {
+	return &PendingWakeSignaler{
+		ttl:     ttl,
+		pending: make(map[types.NamespacedName]*PendingWake),
+	}
+}
+
+func (sig *PendingWakeSignaler) NeedPods(serviceName types.NamespacedName, port string) error {
+	sig.lock.Lock()
+	defer sig.lock.Unlock()
+
+	now := metav1.Now()
+	sig.expireWithLock(now.Time)
+	wake := sig.pending[serviceName]
+	if wake == nil {
+		wake = &PendingWake{
+			Namespace:   serviceName.Namespace,
+			Service:     serviceName.Name,
+			FirstSignal: now,
+		}
+		sig.pending[serviceName] = wake
+	}
+	wake.LastSignal = now
+	wake.Signals++
+	for _, p := range wake.Ports {
+		if p == port {
+			return nil
+		}
+	}
+	wake.Ports = append(wake.Ports, port)
+	sort.Strings(wake.Ports)
+	return nil
+}
+
+// Forget removes serviceName from the pending services, because it no longer needs
+// pods
+func (sig *PendingWakeSignaler) Forget(serviceName types.NamespacedName) {
+	sig.lock.Lock()
+	defer sig.lock.Unlock()
+
+	delete(sig.pending, serviceName)
+}
+
+// expireWithLock removes the services whose last signal was more than ttl before
+// now. Must be called with the lock held.
+func (sig *PendingWakeSignaler) expireWithLock(now time.Time) {
+	for serviceName, wake := range sig.pending {
+		if now.Sub(wake.LastSignal.Time) > sig.ttl {
+			delete(sig.pending, serviceName)
+		}
+	}
+}
+
+// PendingWakes returns the pending services in namespace (or in all namespaces,
+// if namespace is ""), sorted by namespace and name
+func (sig *PendingWakeSignaler) PendingWakes(namespace string) []PendingWake {
+	sig.lock.Lock()
+	defer sig.lock.Unlock()
+
+	sig.expireWithLock(time.Now())
+	wakes := make([]PendingWake, 0, len(sig.pending))
+	for _, wake := range sig.pending {
+		if namespace != "" && wake.Namespace != namespace {
+			continue
+		}
+		w := *wake
+		w.Ports = append([]string{}, wake.Ports...)
+		wakes = append(wakes, w)
+	}
+	sort.Slice(wakes, func(i, j int) bool {
+		if wakes[i].Namespace != wakes[j].Namespace {
+			return wakes[i].Namespace < wakes[j].Namespace
+		}
+		return wakes[i].Service < wakes[j].Service
+	})
+	return wakes
+}
+
+// ServeHTTP returns a JSON-encoded PendingWakeList of the pending services. The
+// "namespace" and "service" query parameters restrict the list to a namespace or a
+// single service.
+func (sig *PendingWakeSignaler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	namespace, service := params.Get("namespace"), params.Get("service")
+	if service != "" && namespace == "" {
+		http.Error(w, "\"service\" requires \"namespace\"", http.StatusBadRequest)
+		return
+	}
+
+	list := PendingWakeList{Services: []PendingWake{}}
+	for _, wake := range sig.PendingWakes(namespace) {
+		if service == "" || wake.Service == service {
+			list.Services = append(list.Services, wake)
+		}
+	}
+	list.Count = len(list.Services)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&list); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
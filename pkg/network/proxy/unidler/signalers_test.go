@@ -0,0 +1,170 @@
+package unidler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+func TestWebhookSignaler(t *testing.T) {
+	requests := make(chan *NeedPodsRequest, 1)
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &NeedPodsRequest{}
+		if r.Method != http.MethodPost {
+			t.Errorf("unexpected method %s", r.Method)
+		} else if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			t.Errorf("could not decode request: %v", err)
+		}
+		requests <- req
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sig := NewWebhookSignaler(server.URL)
+	serviceName := types.NamespacedName{Namespace: "testns", Name: "idled"}
+	if err := sig.NeedPods(serviceName, "http"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	req := <-requests
+	if req.Namespace != "testns" || req.Service != "idled" || req.Port != "http" || req.Time.IsZero() {
+		t.Fatalf("unexpected request %#v", req)
+	}
+
+	status = http.StatusInternalServerError
+	if err := sig.NeedPods(serviceName, "http"); err == nil {
+		t.Fatalf("unexpected success with failing webhook")
+	}
+	<-requests
+}
+
+func TestResourceSignaler(t *testing.T) {
+	type patchRequest struct {
+		method, path, contentType string
+		body                      map[string]map[string]interface{}
+	}
+	requests := make(chan *patchRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &patchRequest{
+			method:      r.Method,
+			path:        r.URL.Path,
+			contentType: r.Header.Get("Content-Type"),
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &req.body); err != nil {
+			t.Errorf("could not decode patch %q: %v", string(data), err)
+		}
+		requests <- req
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"apiVersion":"example.com/v1","kind":"Scaler","metadata":{"namespace":"testns","name":"idled"}}`))
+	}))
+	defer server.Close()
+
+	client, err := dynamic.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	gvr, _ := schema.ParseResourceArg("scalers.v1.example.com")
+	sig := NewResourceSignaler(client, *gvr)
+	if err := sig.NeedPods(types.NamespacedName{Namespace: "testns", Name: "idled"}, "http"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req := <-requests
+	if req.method != http.MethodPatch || req.path != "/apis/example.com/v1/namespaces/testns/scalers/idled/status" || req.contentType != string(types.MergePatchType) {
+		t.Fatalf("unexpected request %s %s (%s)", req.method, req.path, req.contentType)
+	}
+	status := req.body["status"]
+	if status["needPodsPort"] != "http" || status["needPodsAt"] == nil {
+		t.Fatalf("unexpected patch %v", req.body)
+	}
+}
+
+func TestMultiSignaler(t *testing.T) {
+	sig1 := &fakeSignaler{signals: make(chan string, 1)}
+	sig2 := &fakeSignaler{signals: make(chan string, 1)}
+	sig := NewMultiSignaler(sig1, sig2)
+	if err := sig.NeedPods(types.NamespacedName{Namespace: "testns", Name: "idled"}, "http"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, s := range []*fakeSignaler{sig1, sig2} {
+		if signal := <-s.signals; signal != "testns/idled:http" {
+			t.Fatalf("unexpected NeedPods signal %q", signal)
+		}
+	}
+}
+
+func TestPendingWakeSignaler(t *testing.T) {
+	sig := NewPendingWakeSignaler(time.Minute)
+	for _, signal := range []struct {
+		namespace, name, port string
+	}{
+		{"testns", "idled", "http"},
+		{"testns", "idled", "https"},
+		{"testns", "idled", "http"},
+		{"otherns", "other", "dns"},
+		{"testns", "expired", "http"},
+	} {
+		if err := sig.NeedPods(types.NamespacedName{Namespace: signal.namespace, Name: signal.name}, signal.port); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	sig.pending[types.NamespacedName{Namespace: "testns", Name: "expired"}].LastSignal.Time = time.Now().Add(-2 * time.Minute)
+
+	wakes := sig.PendingWakes("")
+	if len(wakes) != 2 || wakes[0].Service != "other" || wakes[1].Service != "idled" {
+		t.Fatalf("unexpected pending wakes %#v", wakes)
+	}
+	if wakes[1].Signals != 3 || len(wakes[1].Ports) != 2 || wakes[1].Ports[0] != "http" || wakes[1].Ports[1] != "https" {
+		t.Fatalf("unexpected pending wake %#v", wakes[1])
+	}
+
+	server := httptest.NewServer(sig)
+	defer server.Close()
+	for _, tc := range []struct {
+		query string
+		count int
+	}{
+		{"", 2},
+		{"?namespace=testns", 1},
+		{"?namespace=testns&service=idled", 1},
+		{"?namespace=testns&service=other", 0},
+	} {
+		resp, err := http.Get(server.URL + tc.query)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		list := &PendingWakeList{}
+		err = json.NewDecoder(resp.Body).Decode(list)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("could not decode %q result: %v", tc.query, err)
+		}
+		if list.Count != tc.count || len(list.Services) != tc.count {
+			t.Fatalf("expected %d services for %q, got %#v", tc.count, tc.query, list)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "?service=idled")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status %s for service without namespace", resp.Status)
+	}
+
+	sig.Forget(types.NamespacedName{Namespace: "testns", Name: "idled"})
+	wakes = sig.PendingWakes("")
+	if len(wakes) != 1 || wakes[0].Service != "other" {
+		t.Fatalf("unexpected pending wakes after Forget %#v", wakes)
+	}
+}
@@ -1,18 +1,44 @@
 package unidler
 
 import (
+	"fmt"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	"k8s.io/apimachinery/pkg/types"
 	utilnet "k8s.io/apimachinery/pkg/util/net"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/events"
-	"k8s.io/kubernetes/pkg/proxy/userspace"
-	"k8s.io/kubernetes/pkg/util/iptables"
-	utilexec "k8s.io/utils/exec"
+	"k8s.io/kubernetes/pkg/proxy"
+	proxymetrics "k8s.io/kubernetes/pkg/proxy/metrics"
+	"k8s.io/kubernetes/pkg/util/async"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
 
 	unidlingapi "github.com/openshift/api/unidling/v1alpha1"
+	"github.com/openshift/sdn/pkg/network/proxy/metrics"
+)
+
+const (
+	// HeldConnectionTimeoutAnnotation can be set on a Service to a duration (eg,
+	// "30s") to override how long TCP connections to the idled service are held
+	// waiting for it to get endpoints (up to 10 minutes)
+	HeldConnectionTimeoutAnnotation = "network.openshift.io/unidling-connection-timeout"
+	// MaxHeldConnectionsAnnotation can be set on a Service to override how many TCP
+	// connections to each port of the idled service are held at once (up to 1024);
+	// beyond that the oldest connections are dropped
+	MaxHeldConnectionsAnnotation = "network.openshift.io/unidling-max-connections"
+	// MaxHeldDatagramsAnnotation can be set on a Service to override how many UDP
+	// datagrams from each client to each port of the idled service are held until
+	// it has endpoints (up to 64); beyond that the oldest datagrams are dropped
+	MaxHeldDatagramsAnnotation = "network.openshift.io/unidling-max-datagrams"
 )
 
 type NeedPodsSignaler interface {
@@ -48,11 +74,557 @@ func NewEventSignaler(eventRecorder events.EventRecorder) NeedPodsSignaler {
 	}
 }
 
-// NewUnidlerProxier creates a new Proxier for the given LoadBalancer and address which fires off
-// unidling signals connections and traffic.  It is intended to be used as one half of a HybridProxier.
-func NewUnidlerProxier(loadBalancer userspace.LoadBalancer, listenIP net.IP, iptables iptables.Interface, exec utilexec.Interface, pr utilnet.PortRange, syncPeriod, minSyncPeriod, udpIdleTimeout time.Duration, nodePortAddresses []string, signaler NeedPodsSignaler) (*userspace.Proxier, error) {
-	newFunc := func(protocol v1.Protocol, ip net.IP, port int) (userspace.ProxySocket, error) {
-		return newUnidlerSocket(protocol, ip, port, signaler)
+// servicePortInfo is the state of a single trapped service port
+type servicePortInfo struct {
+	clusterIP   net.IP
+	port        int
+	protocol    v1.Protocol
+	nodePort    int
+	externalIPs []string
+	lbIPs       []string
+
+	// heldConnTimeout is how long TCP connections (or UDP datagrams) are held
+	// waiting for endpoints, maxHeldConns is how many TCP connections can be held at
+	// once, and maxHeldDatagrams is how many UDP datagrams per client can be held
+	heldConnTimeout  time.Duration
+	maxHeldConns     int
+	maxHeldDatagrams int
+
+	// affinityTimeout is the ClientIP session affinity timeout, or 0 if the
+	// service doesn't use session affinity. (The affinity is lost once the service
+	// is unidled; see NextEndpoint.)
+	affinityTimeout time.Duration
+
+	socket unidlerSocket
+	alive  int32
+}
+
+func (info *servicePortInfo) isAlive() bool {
+	return atomic.LoadInt32(&info.alive) != 0
+}
+
+func (info *servicePortInfo) setAlive(alive bool) {
+	var value int32
+	if alive {
+		value = 1
+	}
+	atomic.StoreInt32(&info.alive, value)
+}
+
+// sameConfig returns whether info was created for the same service port
+// configuration as other, in which case its socket can be reused
+func (info *servicePortInfo) sameConfig(other *servicePortInfo) bool {
+	return info.clusterIP.Equal(other.clusterIP) &&
+		info.port == other.port &&
+		info.protocol == other.protocol &&
+		info.nodePort == other.nodePort &&
+		stringsEqual(info.externalIPs, other.externalIPs) &&
+		stringsEqual(info.lbIPs, other.lbIPs) &&
+		info.heldConnTimeout == other.heldConnTimeout &&
+		info.maxHeldConns == other.maxHeldConns &&
+		info.maxHeldDatagrams == other.maxHeldDatagrams &&
+		info.affinityTimeout == other.affinityTimeout
+}
+
+// affinityState records the endpoint that a client was last sent to
+type affinityState struct {
+	endpoint string
+	lastUsed time.Time
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Proxier catches connections to idled services and signals that the services
+// need pods. Traffic to each idled service port is redirected by iptables to a
+// local "trap" socket, which holds on to TCP connections (and UDP datagrams) until
+// the service has endpoints again and then connects them through. It is intended to be used as
+// one half of a HybridProxier; the other half handles the service once it has
+// been unidled.
+type Proxier struct {
+	listenIP net.IP
+	hostIP   net.IP
+	iptables utiliptables.Interface
+	signaler NeedPodsSignaler
+
+	heldConnTimeout time.Duration
+
+	syncRunner *async.BoundedFrequencyRunner
+
+	mu              sync.Mutex
+	services        map[types.NamespacedName]*v1.Service
+	servicePorts    map[proxy.ServicePortName]*servicePortInfo
+	endpoints       map[proxy.ServicePortName][]string
+	endpointsIndex  map[proxy.ServicePortName]int
+	affinity        map[proxy.ServicePortName]map[string]*affinityState
+	endpointSlices  map[types.NamespacedName]map[string]*discoveryv1.EndpointSlice
+	servicesSynced  bool
+	endpointsSynced bool
+}
+
+var _ proxy.Provider = &Proxier{}
+
+// NewUnidlerProxier creates a new Proxier listening on listenIP which fires off
+// unidling signals for connections and traffic to the services it is given. TCP
+// connections and UDP datagrams are held for up to heldConnTimeout waiting for the
+// service to get endpoints.
+func NewUnidlerProxier(listenIP net.IP, iptables utiliptables.Interface, syncPeriod, minSyncPeriod, heldConnTimeout time.Duration, signaler NeedPodsSignaler) (*Proxier, error) {
+	if listenIP.Equal(net.IPv4(127, 0, 0, 1)) || listenIP.Equal(net.IPv6loopback) {
+		return nil, fmt.Errorf("can't listen on localhost for unidling")
+	}
+	// hostIP is where host-originated traffic gets DNATed to, since REDIRECT
+	// doesn't work for locally-generated traffic
+	hostIP, err := utilnet.ResolveBindAddress(listenIP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select a host interface: %v", err)
+	}
+	if err := ensurePortalChains(iptables); err != nil {
+		return nil, err
+	}
+	metrics.RegisterMetrics()
+
+	p := &Proxier{
+		listenIP: listenIP,
+		hostIP:   hostIP,
+		iptables: iptables,
+		signaler: signaler,
+
+		heldConnTimeout: heldConnTimeout,
+
+		services:       make(map[types.NamespacedName]*v1.Service),
+		servicePorts:   make(map[proxy.ServicePortName]*servicePortInfo),
+		endpoints:      make(map[proxy.ServicePortName][]string),
+		endpointsIndex: make(map[proxy.ServicePortName]int),
+		affinity:       make(map[proxy.ServicePortName]map[string]*affinityState),
+		endpointSlices: make(map[types.NamespacedName]map[string]*discoveryv1.EndpointSlice),
+	}
+	p.syncRunner = async.NewBoundedFrequencyRunner("unidler-sync-runner", p.syncProxyRules, minSyncPeriod, syncPeriod, 4)
+	return p, nil
+}
+
+func (p *Proxier) OnServiceAdd(service *v1.Service) {
+	p.OnServiceUpdate(nil, service)
+}
+
+func (p *Proxier) OnServiceUpdate(oldService, service *v1.Service) {
+	svcName := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+	p.mu.Lock()
+	p.services[svcName] = service
+	p.mu.Unlock()
+	p.Sync()
+}
+
+func (p *Proxier) OnServiceDelete(service *v1.Service) {
+	svcName := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+	p.mu.Lock()
+	delete(p.services, svcName)
+	p.mu.Unlock()
+	p.Sync()
+}
+
+func (p *Proxier) OnServiceSynced() {
+	p.mu.Lock()
+	p.servicesSynced = true
+	p.mu.Unlock()
+	p.Sync()
+}
+
+// Endpoints changes take effect immediately rather than on the next sync, since
+// held connections are waiting for them.
+
+func (p *Proxier) OnEndpointsAdd(endpoints *v1.Endpoints) {
+	p.OnEndpointsUpdate(nil, endpoints)
+}
+
+func (p *Proxier) OnEndpointsUpdate(oldEndpoints, endpoints *v1.Endpoints) {
+	svcName := types.NamespacedName{Namespace: endpoints.Namespace, Name: endpoints.Name}
+	newEndpoints := make(map[proxy.ServicePortName][]string)
+	for _, subset := range endpoints.Subsets {
+		for _, port := range subset.Ports {
+			svcPortName := proxy.ServicePortName{NamespacedName: svcName, Port: port.Name, Protocol: port.Protocol}
+			for _, addr := range subset.Addresses {
+				newEndpoints[svcPortName] = append(newEndpoints[svcPortName], net.JoinHostPort(addr.IP, strconv.Itoa(int(port.Port))))
+			}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.setServiceEndpoints(svcName, newEndpoints)
+}
+
+func (p *Proxier) OnEndpointsDelete(endpoints *v1.Endpoints) {
+	svcName := types.NamespacedName{Namespace: endpoints.Namespace, Name: endpoints.Name}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.setServiceEndpoints(svcName, nil)
+}
+
+// setServiceEndpoints replaces the endpoints of svcName's ports with newEndpoints.
+// Must be called with p.mu held.
+func (p *Proxier) setServiceEndpoints(svcName types.NamespacedName, newEndpoints map[proxy.ServicePortName][]string) {
+	for svcPortName := range p.endpoints {
+		if svcPortName.NamespacedName == svcName {
+			if _, ok := newEndpoints[svcPortName]; !ok {
+				delete(p.endpoints, svcPortName)
+				delete(p.endpointsIndex, svcPortName)
+			}
+		}
+	}
+	for svcPortName, eps := range newEndpoints {
+		p.endpoints[svcPortName] = eps
+	}
+}
+
+func (p *Proxier) OnEndpointsSynced() {
+	p.mu.Lock()
+	p.endpointsSynced = true
+	p.mu.Unlock()
+	p.Sync()
+}
+
+func endpointSliceServiceName(slice *discoveryv1.EndpointSlice) types.NamespacedName {
+	name := slice.Labels[discoveryv1.LabelServiceName]
+	if name == "" {
+		name = slice.Name
+	}
+	return types.NamespacedName{Namespace: slice.Namespace, Name: name}
+}
+
+func (p *Proxier) OnEndpointSliceAdd(slice *discoveryv1.EndpointSlice) {
+	p.OnEndpointSliceUpdate(nil, slice)
+}
+
+func (p *Proxier) OnEndpointSliceUpdate(oldSlice, slice *discoveryv1.EndpointSlice) {
+	svcName := endpointSliceServiceName(slice)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.endpointSlices[svcName] == nil {
+		p.endpointSlices[svcName] = make(map[string]*discoveryv1.EndpointSlice)
+	}
+	p.endpointSlices[svcName][slice.Name] = slice
+	p.syncEndpointSlices(svcName)
+}
+
+func (p *Proxier) OnEndpointSliceDelete(slice *discoveryv1.EndpointSlice) {
+	svcName := endpointSliceServiceName(slice)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.endpointSlices[svcName], slice.Name)
+	if len(p.endpointSlices[svcName]) == 0 {
+		delete(p.endpointSlices, svcName)
+	}
+	p.syncEndpointSlices(svcName)
+}
+
+func (p *Proxier) OnEndpointSlicesSynced() {
+	p.OnEndpointsSynced()
+}
+
+// syncEndpointSlices updates svcName's endpoints from all of its EndpointSlices.
+// Must be called with p.mu held.
+func (p *Proxier) syncEndpointSlices(svcName types.NamespacedName) {
+	newEndpoints := make(map[proxy.ServicePortName][]string)
+	for _, slice := range p.endpointSlices[svcName] {
+		for _, port := range slice.Ports {
+			if port.Port == nil {
+				continue
+			}
+			svcPortName := proxy.ServicePortName{NamespacedName: svcName}
+			if port.Name != nil {
+				svcPortName.Port = *port.Name
+			}
+			if port.Protocol != nil {
+				svcPortName.Protocol = *port.Protocol
+			}
+			for _, ep := range slice.Endpoints {
+				if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+					continue
+				}
+				for _, addr := range ep.Addresses {
+					newEndpoints[svcPortName] = append(newEndpoints[svcPortName], net.JoinHostPort(addr, strconv.Itoa(int(*port.Port))))
+				}
+			}
+		}
+	}
+	p.setServiceEndpoints(svcName, newEndpoints)
+}
+
+func (p *Proxier) OnNodeAdd(node *v1.Node) {
+}
+
+func (p *Proxier) OnNodeUpdate(oldNode, node *v1.Node) {
+}
+
+func (p *Proxier) OnNodeDelete(node *v1.Node) {
+}
+
+func (p *Proxier) OnNodeSynced() {
+}
+
+// ServiceHasEndpoints returns whether svcPortName currently has any endpoints
+func (p *Proxier) ServiceHasEndpoints(svcPortName proxy.ServicePortName) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.endpoints[svcPortName]) > 0
+}
+
+// NextEndpoint returns the next endpoint of svcPortName for a connection from
+// srcAddr. If the service uses ClientIP session affinity, this is the endpoint the
+// client was last sent to, unless that was longer ago than the affinity timeout or
+// sessionAffinityReset is true (eg, because the previous endpoint could not be
+// reached). Otherwise endpoints are picked round-robin.
+//
+// The affinity only covers the connections that the unidler itself forwards. It is
+// not handed off when the service is switched back to the main proxy, which keeps
+// its own affinity state (eg, in iptables "recent" lists) that starts out empty, so
+// a client's first connection after unidling may go to a different endpoint than
+// its held connections did.
+func (p *Proxier) NextEndpoint(svcPortName proxy.ServicePortName, srcAddr net.Addr, sessionAffinityReset bool) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	eps := p.endpoints[svcPortName]
+	if len(eps) == 0 {
+		return "", fmt.Errorf("no endpoints available for service %q", svcPortName)
+	}
+
+	var clientIP string
+	var affinityTimeout time.Duration
+	if info := p.servicePorts[svcPortName]; info != nil && info.affinityTimeout > 0 && srcAddr != nil {
+		if host, _, err := net.SplitHostPort(srcAddr.String()); err == nil {
+			clientIP = host
+			affinityTimeout = info.affinityTimeout
+		}
+	}
+	now := time.Now()
+	if clientIP != "" && !sessionAffinityReset {
+		if state := p.affinity[svcPortName][clientIP]; state != nil && now.Sub(state.lastUsed) < affinityTimeout {
+			for _, ep := range eps {
+				if ep == state.endpoint {
+					state.lastUsed = now
+					klog.V(4).Infof("Using session affinity endpoint %s for client %s of service %q", ep, clientIP, svcPortName)
+					return ep, nil
+				}
+			}
+		}
+	}
+
+	index := p.endpointsIndex[svcPortName] % len(eps)
+	p.endpointsIndex[svcPortName] = index + 1
+	if clientIP != "" {
+		p.setAffinity(svcPortName, clientIP, eps[index], now, affinityTimeout)
+	}
+	return eps[index], nil
+}
+
+// setAffinity records that clientIP was sent to endpoint, and drops expired
+// affinity records for svcPortName. Must be called with p.mu held.
+func (p *Proxier) setAffinity(svcPortName proxy.ServicePortName, clientIP, endpoint string, now time.Time, timeout time.Duration) {
+	clients := p.affinity[svcPortName]
+	if clients == nil {
+		clients = make(map[string]*affinityState)
+		p.affinity[svcPortName] = clients
+	}
+	for ip, state := range clients {
+		if now.Sub(state.lastUsed) >= timeout {
+			delete(clients, ip)
+		}
+	}
+	clients[clientIP] = &affinityState{endpoint: endpoint, lastUsed: now}
+}
+
+// Sync requests that the proxy rules be synchronized
+func (p *Proxier) Sync() {
+	p.syncRunner.Run()
+}
+
+// SyncLoop runs periodic work. It does not return.
+func (p *Proxier) SyncLoop() {
+	p.syncRunner.Loop(utilwait.NeverStop)
+}
+
+func (p *Proxier) SyncProxyRules() {
+	p.syncProxyRules()
+}
+
+func (p *Proxier) SetSyncRunner(b *async.BoundedFrequencyRunner) {
+	p.syncRunner = b
+}
+
+// getServicePorts returns the service ports that should be trapped, based on p.services.
+// Must be called with p.mu held.
+func (p *Proxier) getServicePorts() map[proxy.ServicePortName]*servicePortInfo {
+	servicePorts := make(map[proxy.ServicePortName]*servicePortInfo)
+	for svcName, service := range p.services {
+		clusterIP := net.ParseIP(service.Spec.ClusterIP)
+		if clusterIP == nil {
+			// headless or ExternalName service
+			continue
+		}
+		var lbIPs []string
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				lbIPs = append(lbIPs, ingress.IP)
+			}
+		}
+		heldConnTimeout, maxHeldConns := p.heldConnLimits(service)
+		maxHeldDatagrams := getMaxHeldDatagrams(service)
+		affinityTimeout := getAffinityTimeout(service)
+		for i := range service.Spec.Ports {
+			port := &service.Spec.Ports[i]
+			svcPortName := proxy.ServicePortName{NamespacedName: svcName, Port: port.Name, Protocol: port.Protocol}
+			servicePorts[svcPortName] = &servicePortInfo{
+				clusterIP:   clusterIP,
+				port:        int(port.Port),
+				protocol:    port.Protocol,
+				nodePort:    int(port.NodePort),
+				externalIPs: service.Spec.ExternalIPs,
+				lbIPs:       lbIPs,
+
+				heldConnTimeout:  heldConnTimeout,
+				maxHeldConns:     maxHeldConns,
+				maxHeldDatagrams: maxHeldDatagrams,
+				affinityTimeout:  affinityTimeout,
+			}
+		}
+	}
+	return servicePorts
+}
+
+// heldConnLimits returns the held connection timeout and maximum number of held
+// connections for service, taking into account its annotations
+func (p *Proxier) heldConnLimits(service *v1.Service) (time.Duration, int) {
+	timeout := p.heldConnTimeout
+	if value, ok := service.Annotations[HeldConnectionTimeoutAnnotation]; ok {
+		if parsed, err := time.ParseDuration(value); err != nil || parsed <= 0 {
+			utilruntime.HandleError(fmt.Errorf("Ignoring invalid %s annotation %q on service %s/%s", HeldConnectionTimeoutAnnotation, value, service.Namespace, service.Name))
+		} else if parsed > maxHeldConnectionTimeout {
+			utilruntime.HandleError(fmt.Errorf("Limiting %s annotation %q on service %s/%s to %v", HeldConnectionTimeoutAnnotation, value, service.Namespace, service.Name, maxHeldConnectionTimeout))
+			timeout = maxHeldConnectionTimeout
+		} else {
+			timeout = parsed
+		}
+	}
+
+	maxConns := MaxHeldConnections
+	if value, ok := service.Annotations[MaxHeldConnectionsAnnotation]; ok {
+		if parsed, err := strconv.Atoi(value); err != nil || parsed <= 0 {
+			utilruntime.HandleError(fmt.Errorf("Ignoring invalid %s annotation %q on service %s/%s", MaxHeldConnectionsAnnotation, value, service.Namespace, service.Name))
+		} else if parsed > maxHeldConnectionsLimit {
+			utilruntime.HandleError(fmt.Errorf("Limiting %s annotation %q on service %s/%s to %d", MaxHeldConnectionsAnnotation, value, service.Namespace, service.Name, maxHeldConnectionsLimit))
+			maxConns = maxHeldConnectionsLimit
+		} else {
+			maxConns = parsed
+		}
+	}
+
+	return timeout, maxConns
+}
+
+// getMaxHeldDatagrams returns the maximum number of held UDP datagrams per client
+// for service, taking into account its annotations
+func getMaxHeldDatagrams(service *v1.Service) int {
+	maxDatagrams := MaxHeldDatagrams
+	if value, ok := service.Annotations[MaxHeldDatagramsAnnotation]; ok {
+		if parsed, err := strconv.Atoi(value); err != nil || parsed <= 0 {
+			utilruntime.HandleError(fmt.Errorf("Ignoring invalid %s annotation %q on service %s/%s", MaxHeldDatagramsAnnotation, value, service.Namespace, service.Name))
+		} else if parsed > maxHeldDatagramsLimit {
+			utilruntime.HandleError(fmt.Errorf("Limiting %s annotation %q on service %s/%s to %d", MaxHeldDatagramsAnnotation, value, service.Namespace, service.Name, maxHeldDatagramsLimit))
+			maxDatagrams = maxHeldDatagramsLimit
+		} else {
+			maxDatagrams = parsed
+		}
+	}
+	return maxDatagrams
+}
+
+// getAffinityTimeout returns the ClientIP session affinity timeout of service, or 0
+// if it doesn't use session affinity
+func getAffinityTimeout(service *v1.Service) time.Duration {
+	if service.Spec.SessionAffinity != v1.ServiceAffinityClientIP {
+		return 0
+	}
+	seconds := v1.DefaultClientIPServiceAffinitySeconds
+	if cfg := service.Spec.SessionAffinityConfig; cfg != nil && cfg.ClientIP != nil && cfg.ClientIP.TimeoutSeconds != nil {
+		seconds = *cfg.ClientIP.TimeoutSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// syncProxyRules opens and closes trap sockets to match the current set of
+// services, and then rewrites the iptables rules that redirect to them.
+func (p *Proxier) syncProxyRules() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.servicesSynced || !p.endpointsSynced {
+		klog.V(2).Info("Not syncing unidler rules until services and endpoints have been received")
+		return
+	}
+
+	start := time.Now()
+	defer func() {
+		klog.V(4).Infof("unidler syncProxyRules took %v", time.Since(start))
+	}()
+
+	wanted := p.getServicePorts()
+	for svcPortName, info := range p.servicePorts {
+		if newInfo, ok := wanted[svcPortName]; ok && info.sameConfig(newInfo) {
+			continue
+		}
+		klog.V(2).Infof("Closing unidling trap for %s", svcPortName)
+		p.closeServicePort(svcPortName, info)
+	}
+	for svcPortName, info := range wanted {
+		if _, ok := p.servicePorts[svcPortName]; ok {
+			continue
+		}
+		if err := p.openServicePort(svcPortName, info); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Failed to open unidling trap for %s: %v", svcPortName, err))
+			continue
+		}
+		klog.V(2).Infof("Opened unidling trap for %s on port %d", svcPortName, info.socket.ListenPort())
+	}
+
+	if err := p.iptables.Restore(utiliptables.TableNAT, p.portalRules(), utiliptables.NoFlushTables, utiliptables.RestoreCounters); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Failed to sync unidler iptables rules: %v", err))
+		proxymetrics.IptablesRestoreFailuresTotal.Inc()
+	}
+}
+
+// openServicePort opens a trap socket for svcPortName and starts its proxy loop.
+// Must be called with p.mu held.
+func (p *Proxier) openServicePort(svcPortName proxy.ServicePortName, info *servicePortInfo) error {
+	socket, err := newUnidlerSocket(info.protocol, p.listenIP, p.signaler)
+	if err != nil {
+		return err
+	}
+	info.socket = socket
+	info.setAlive(true)
+	p.servicePorts[svcPortName] = info
+
+	go func() {
+		defer utilruntime.HandleCrash()
+		socket.ProxyLoop(svcPortName, info, p)
+	}()
+	return nil
+}
+
+// closeServicePort closes svcPortName's trap socket. Must be called with p.mu held.
+func (p *Proxier) closeServicePort(svcPortName proxy.ServicePortName, info *servicePortInfo) {
+	delete(p.servicePorts, svcPortName)
+	delete(p.affinity, svcPortName)
+	info.setAlive(false)
+	if err := info.socket.Close(); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Failed to close unidling trap for %s: %v", svcPortName, err))
 	}
-	return userspace.NewCustomProxier(loadBalancer, listenIP, iptables, exec, pr, syncPeriod, minSyncPeriod, udpIdleTimeout, nodePortAddresses, newFunc)
 }
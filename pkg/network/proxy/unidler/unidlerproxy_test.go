@@ -0,0 +1,577 @@
+package unidler
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/component-base/metrics/testutil"
+	"k8s.io/kubernetes/pkg/proxy"
+	"k8s.io/kubernetes/pkg/util/async"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+
+	"github.com/openshift/sdn/pkg/network/proxy/metrics"
+)
+
+type fakeIPTables struct {
+	utiliptables.Interface
+	restored []byte
+}
+
+func (f *fakeIPTables) Restore(table utiliptables.Table, data []byte, flush utiliptables.FlushFlag, counters utiliptables.RestoreCountersFlag) error {
+	f.restored = data
+	return nil
+}
+
+type fakeSignaler struct {
+	signals chan string
+}
+
+func (sig *fakeSignaler) NeedPods(serviceName types.NamespacedName, port string) error {
+	sig.signals <- serviceName.String() + ":" + port
+	return nil
+}
+
+func newTestProxier(ipt utiliptables.Interface, signaler NeedPodsSignaler) *Proxier {
+	localhost := net.ParseIP("127.0.0.1")
+	p := &Proxier{
+		listenIP: localhost,
+		hostIP:   localhost,
+		iptables: ipt,
+		signaler: signaler,
+
+		heldConnTimeout: DefaultHeldConnectionTimeout,
+
+		services:       make(map[types.NamespacedName]*v1.Service),
+		servicePorts:   make(map[proxy.ServicePortName]*servicePortInfo),
+		endpoints:      make(map[proxy.ServicePortName][]string),
+		endpointsIndex: make(map[proxy.ServicePortName]int),
+		affinity:       make(map[proxy.ServicePortName]map[string]*affinityState),
+		endpointSlices: make(map[types.NamespacedName]map[string]*discoveryv1.EndpointSlice),
+	}
+	p.syncRunner = async.NewBoundedFrequencyRunner("test-sync-runner", p.syncProxyRules, 0, time.Hour, 1)
+	return p
+}
+
+func TestUnidlerProxier(t *testing.T) {
+	metrics.RegisterMetrics()
+	ipt := &fakeIPTables{}
+	signaler := &fakeSignaler{signals: make(chan string, 10)}
+	p := newTestProxier(ipt, signaler)
+
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "testns", Name: "idled"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "172.30.0.10",
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, Protocol: v1.ProtocolTCP},
+			},
+		},
+	}
+	emptyEndpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "testns", Name: "idled"},
+	}
+	p.OnServiceAdd(service)
+	p.OnEndpointsAdd(emptyEndpoints)
+
+	// Nothing happens until we're synced
+	p.syncProxyRules()
+	if ipt.restored != nil || len(p.servicePorts) != 0 {
+		t.Fatalf("unexpected sync before initial sync was complete")
+	}
+	p.OnServiceSynced()
+	p.OnEndpointsSynced()
+	p.syncProxyRules()
+
+	svcPortName := proxy.ServicePortName{NamespacedName: types.NamespacedName{Namespace: "testns", Name: "idled"}, Port: "http", Protocol: v1.ProtocolTCP}
+	info := p.servicePorts[svcPortName]
+	if info == nil {
+		t.Fatalf("no trap socket opened for %s", svcPortName)
+	}
+	trapAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(info.socket.ListenPort()))
+	rules := string(ipt.restored)
+	for _, chain := range []utiliptables.Chain{unidlerContainerChain, unidlerHostChain} {
+		expected := "-A " + string(chain) + ` -m comment --comment "testns/idled:http" -p tcp -m tcp --dport 80 -d 172.30.0.10/32 -j DNAT --to-destination ` + trapAddr
+		if !strings.Contains(rules, expected) {
+			t.Fatalf("expected rule %q in:\n%s", expected, rules)
+		}
+	}
+
+	// A backend for the service once it is unidled
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error creating backend: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		// the data the client sent while the connection was held is replayed
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			conn.Close()
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+
+	// Connecting to the trap signals that the service needs pods
+	client, err := net.Dial("tcp", trapAddr)
+	if err != nil {
+		t.Fatalf("unexpected error connecting to trap: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("unexpected error writing to trap: %v", err)
+	}
+	select {
+	case signal := <-signaler.signals:
+		if signal != "testns/idled:http" {
+			t.Fatalf("unexpected NeedPods signal %q", signal)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for NeedPods signal")
+	}
+
+	// Once the service has endpoints and is handed off to the main proxy, the
+	// held connection is connected through to the endpoint
+	backendAddr := backend.Addr().(*net.TCPAddr)
+	p.OnEndpointsUpdate(emptyEndpoints, &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "testns", Name: "idled"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "127.0.0.1"}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: int32(backendAddr.Port), Protocol: v1.ProtocolTCP}},
+		}},
+	})
+	p.OnServiceDelete(service)
+	p.syncProxyRules()
+	if len(p.servicePorts) != 0 {
+		t.Fatalf("trap socket not closed")
+	}
+	if bytes.Contains(ipt.restored, []byte("testns/idled")) {
+		t.Fatalf("unexpected rules left over:\n%s", string(ipt.restored))
+	}
+
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	data, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("unexpected error reading from held connection: %v", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("unexpected data from held connection: %q", string(data))
+	}
+
+	signals, err := testutil.GetCounterMetricValue(metrics.UnidlingNeedPodsSignals.WithLabelValues("testns", "idled"))
+	if err != nil || signals != 1 {
+		t.Fatalf("unexpected NeedPods signal count %v (%v)", signals, err)
+	}
+	wakes, err := testutil.GetHistogramFromGatherer(legacyregistry.DefaultGatherer, "openshift_sdn_unidling_wake_duration_seconds")
+	if err != nil || wakes.GetSampleCount() != 1 {
+		t.Fatalf("unexpected wake duration histogram %v (%v)", wakes, err)
+	}
+}
+
+func TestUnidlerEndpointSlices(t *testing.T) {
+	p := newTestProxier(&fakeIPTables{}, &fakeSignaler{signals: make(chan string, 10)})
+
+	portName := "http"
+	port := int32(8080)
+	protocol := v1.ProtocolTCP
+	makeSlice := func(name string, ready bool, ips ...string) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "testns",
+				Name:      name,
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "idled"},
+			},
+			Ports: []discoveryv1.EndpointPort{{Name: &portName, Port: &port, Protocol: &protocol}},
+			Endpoints: []discoveryv1.Endpoint{{
+				Addresses:  ips,
+				Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+			}},
+		}
+	}
+	svcPortName := proxy.ServicePortName{NamespacedName: types.NamespacedName{Namespace: "testns", Name: "idled"}, Port: "http", Protocol: v1.ProtocolTCP}
+
+	// Empty and not-ready slices don't provide endpoints
+	slice1 := makeSlice("idled-1", true)
+	slice2 := makeSlice("idled-2", false, "10.128.0.5")
+	p.OnEndpointSliceAdd(slice1)
+	p.OnEndpointSliceAdd(slice2)
+	if p.ServiceHasEndpoints(svcPortName) {
+		t.Fatalf("unexpected endpoints %v", p.endpoints)
+	}
+
+	// Endpoints from all slices are used
+	slice1Ready := makeSlice("idled-1", true, "10.128.0.4")
+	slice2Ready := makeSlice("idled-2", true, "10.128.0.5")
+	p.OnEndpointSliceUpdate(slice1, slice1Ready)
+	p.OnEndpointSliceUpdate(slice2, slice2Ready)
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		ep, err := p.NextEndpoint(svcPortName, nil, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		seen[ep] = true
+	}
+	if !seen["10.128.0.4:8080"] || !seen["10.128.0.5:8080"] {
+		t.Fatalf("unexpected endpoints %v", seen)
+	}
+
+	// Deleting one slice leaves the other's endpoints
+	p.OnEndpointSliceDelete(slice1Ready)
+	if ep, err := p.NextEndpoint(svcPortName, nil, false); err != nil || ep != "10.128.0.5:8080" {
+		t.Fatalf("unexpected endpoint %q (%v)", ep, err)
+	}
+	p.OnEndpointSliceDelete(slice2Ready)
+	if p.ServiceHasEndpoints(svcPortName) || len(p.endpointSlices) != 0 {
+		t.Fatalf("unexpected leftover endpoints %v / %v", p.endpoints, p.endpointSlices)
+	}
+}
+
+func TestUnidlerSCTP(t *testing.T) {
+	signaler := &fakeSignaler{signals: make(chan string, 10)}
+	socket, err := newUnidlerSocket(v1.ProtocolSCTP, net.ParseIP("127.0.0.1"), signaler)
+	if err != nil {
+		t.Skipf("SCTP not available: %v", err)
+	}
+	defer socket.Close()
+
+	svcPortName := proxy.ServicePortName{NamespacedName: types.NamespacedName{Namespace: "testns", Name: "idled"}, Port: "sctp", Protocol: v1.ProtocolSCTP}
+	info := &servicePortInfo{socket: socket}
+	info.setAlive(true)
+	p := newTestProxier(&fakeIPTables{}, signaler)
+	go socket.ProxyLoop(svcPortName, info, p)
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, syscall.IPPROTO_SCTP)
+	if err != nil {
+		t.Fatalf("unexpected error creating SCTP socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	sa := &syscall.SockaddrInet4{Port: socket.ListenPort()}
+	copy(sa.Addr[:], net.ParseIP("127.0.0.1").To4())
+	if err := syscall.Connect(fd, sa); err != nil {
+		t.Fatalf("unexpected error connecting to trap: %v", err)
+	}
+
+	select {
+	case signal := <-signaler.signals:
+		if signal != "testns/idled:sctp" {
+			t.Fatalf("unexpected NeedPods signal %q", signal)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for NeedPods signal")
+	}
+}
+
+func TestUnidlerUDP(t *testing.T) {
+	signaler := &fakeSignaler{signals: make(chan string, 10)}
+	socket, err := newUnidlerSocket(v1.ProtocolUDP, net.ParseIP("127.0.0.1"), signaler)
+	if err != nil {
+		t.Fatalf("unexpected error creating trap socket: %v", err)
+	}
+	defer socket.Close()
+
+	svcPortName := proxy.ServicePortName{NamespacedName: types.NamespacedName{Namespace: "testns", Name: "idled"}, Port: "dns", Protocol: v1.ProtocolUDP}
+	info := &servicePortInfo{socket: socket, heldConnTimeout: DefaultHeldConnectionTimeout, maxHeldDatagrams: 2}
+	info.setAlive(true)
+	p := newTestProxier(&fakeIPTables{}, signaler)
+	go socket.ProxyLoop(svcPortName, info, p)
+
+	// An echo server for the service once it is unidled
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected error creating backend: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, UDPBufferSize)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(append([]byte("echo "), buf[:n]...), addr)
+		}
+	}()
+
+	client, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(socket.ListenPort())))
+	if err != nil {
+		t.Fatalf("unexpected error connecting to trap: %v", err)
+	}
+	defer client.Close()
+	for _, data := range []string{"one", "two", "three"} {
+		if _, err := client.Write([]byte(data)); err != nil {
+			t.Fatalf("unexpected error writing to trap: %v", err)
+		}
+	}
+	select {
+	case signal := <-signaler.signals:
+		if signal != "testns/idled:dns" {
+			t.Fatalf("unexpected NeedPods signal %q", signal)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for NeedPods signal")
+	}
+	// Let the trap socket read the remaining datagrams
+	time.Sleep(100 * time.Millisecond)
+
+	backendPort := backend.LocalAddr().(*net.UDPAddr).Port
+	p.OnEndpointsAdd(&v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "testns", Name: "idled"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "127.0.0.1"}},
+			Ports:     []v1.EndpointPort{{Name: "dns", Port: int32(backendPort), Protocol: v1.ProtocolUDP}},
+		}},
+	})
+
+	// Only the newest 2 datagrams were held, and are delivered in order, followed
+	// by anything sent after the service got endpoints
+	buf := make([]byte, UDPBufferSize)
+	for i, expected := range []string{"echo two", "echo three", "echo four"} {
+		if i == 2 {
+			if _, err := client.Write([]byte("four")); err != nil {
+				t.Fatalf("unexpected error writing to trap: %v", err)
+			}
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("unexpected error reading reply %d: %v", i, err)
+		}
+		if string(buf[:n]) != expected {
+			t.Fatalf("expected reply %q, got %q", expected, string(buf[:n]))
+		}
+	}
+}
+
+func TestHeldDatagramLimits(t *testing.T) {
+	list := newDatagramList(2, time.Minute, "testns/idled:dns")
+	start := time.Now()
+	addrs := []*net.UDPAddr{}
+	for i := 0; i < maxHeldDatagramClients+1; i++ {
+		addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000 + i}
+		addrs = append(addrs, addr)
+		list.Add(&datagram{data: []byte("data"), addr: addr}, start.Add(time.Duration(i)*time.Second))
+	}
+	// The oldest client was dropped to make room
+	if len(list.clients) != maxHeldDatagramClients || list.index[addrs[0].String()] != nil || list.clients[0].addr != addrs[1] {
+		t.Fatalf("unexpected held clients %v", list.clients)
+	}
+
+	list.Add(&datagram{data: []byte("more"), addr: addrs[1]}, start)
+	list.Add(&datagram{data: []byte("even more"), addr: addrs[1]}, start)
+	if len(list.clients[0].datagrams) != 2 || string(list.clients[0].datagrams[0]) != "more" {
+		t.Fatalf("unexpected held datagrams %q", list.clients[0].datagrams)
+	}
+
+	// Clients time out in the order they were first seen
+	list.Expire(start.Add(time.Minute + 10*time.Second))
+	if len(list.clients) != maxHeldDatagramClients-10 || list.clients[0].addr != addrs[11] {
+		t.Fatalf("unexpected held clients after expiry %v", list.clients)
+	}
+	if len(list.Take()) != maxHeldDatagramClients-10 || list.Len() != 0 {
+		t.Fatalf("unexpected held datagrams after Take")
+	}
+}
+
+func TestHeldConnBuffering(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	hc := newHeldConn(server, 0)
+	if _, err := client.Write([]byte("GET / HTTP/1.1\r\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !hc.stopBuffering() {
+		t.Fatalf("unexpected client close")
+	}
+	if hc.buffered.String() != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("unexpected buffered data %q", hc.buffered.String())
+	}
+	hc.Close()
+
+	// Connections closed by the client are dropped to make room for new ones
+	list := newConnectionList(2, time.Second, time.Minute, "testns/idled:http")
+	clients := []net.Conn{}
+	for i := 0; i < 2; i++ {
+		client, server := net.Pipe()
+		defer client.Close()
+		clients = append(clients, client)
+		list.Add(server)
+	}
+	clients[0].Close()
+	<-list.conns[0].done
+	client3, server3 := net.Pipe()
+	defer client3.Close()
+	list.Add(server3)
+	if list.Len() != 2 || list.conns[0].isClosed() || list.conns[1].Conn != server3 {
+		t.Fatalf("unexpected held connections %v", list.conns)
+	}
+	list.Clear()
+}
+
+func TestHeldConnLimits(t *testing.T) {
+	p := newTestProxier(&fakeIPTables{}, &fakeSignaler{signals: make(chan string, 10)})
+
+	testcases := []struct {
+		name            string
+		annotations     map[string]string
+		expectedTimeout time.Duration
+		expectedMax     int
+	}{
+		{
+			name:            "defaults",
+			expectedTimeout: DefaultHeldConnectionTimeout,
+			expectedMax:     MaxHeldConnections,
+		},
+		{
+			name: "overridden",
+			annotations: map[string]string{
+				HeldConnectionTimeoutAnnotation: "30s",
+				MaxHeldConnectionsAnnotation:    "100",
+			},
+			expectedTimeout: 30 * time.Second,
+			expectedMax:     100,
+		},
+		{
+			name: "invalid",
+			annotations: map[string]string{
+				HeldConnectionTimeoutAnnotation: "soon",
+				MaxHeldConnectionsAnnotation:    "-1",
+			},
+			expectedTimeout: DefaultHeldConnectionTimeout,
+			expectedMax:     MaxHeldConnections,
+		},
+		{
+			name: "too large",
+			annotations: map[string]string{
+				HeldConnectionTimeoutAnnotation: "24h",
+				MaxHeldConnectionsAnnotation:    "1000000",
+			},
+			expectedTimeout: maxHeldConnectionTimeout,
+			expectedMax:     maxHeldConnectionsLimit,
+		},
+	}
+
+	for _, tc := range testcases {
+		service := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "testns", Name: "idled", Annotations: tc.annotations},
+			Spec: v1.ServiceSpec{
+				ClusterIP: "172.30.0.10",
+				Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+			},
+		}
+		p.services = map[types.NamespacedName]*v1.Service{{Namespace: "testns", Name: "idled"}: service}
+		for _, info := range p.getServicePorts() {
+			if info.heldConnTimeout != tc.expectedTimeout || info.maxHeldConns != tc.expectedMax {
+				t.Fatalf("%s: expected %v/%d, got %v/%d", tc.name, tc.expectedTimeout, tc.expectedMax, info.heldConnTimeout, info.maxHeldConns)
+			}
+		}
+	}
+}
+
+func TestMaxHeldDatagrams(t *testing.T) {
+	for value, expected := range map[string]int{
+		"":        MaxHeldDatagrams,
+		"32":      32,
+		"0":       MaxHeldDatagrams,
+		"1000000": maxHeldDatagramsLimit,
+	} {
+		service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "testns", Name: "idled"}}
+		if value != "" {
+			service.Annotations = map[string]string{MaxHeldDatagramsAnnotation: value}
+		}
+		if got := getMaxHeldDatagrams(service); got != expected {
+			t.Errorf("%q: expected %d, got %d", value, expected, got)
+		}
+	}
+}
+
+func TestUnidlerSessionAffinity(t *testing.T) {
+	p := newTestProxier(&fakeIPTables{}, &fakeSignaler{signals: make(chan string, 10)})
+
+	svcPortName := proxy.ServicePortName{NamespacedName: types.NamespacedName{Namespace: "testns", Name: "idled"}, Port: "http", Protocol: v1.ProtocolTCP}
+	timeout := int32(60)
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "testns", Name: "idled"},
+		Spec: v1.ServiceSpec{
+			ClusterIP:       "172.30.0.10",
+			Ports:           []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+			SessionAffinity: v1.ServiceAffinityClientIP,
+			SessionAffinityConfig: &v1.SessionAffinityConfig{
+				ClientIP: &v1.ClientIPConfig{TimeoutSeconds: &timeout},
+			},
+		},
+	}
+	p.services = map[types.NamespacedName]*v1.Service{{Namespace: "testns", Name: "idled"}: service}
+	p.servicePorts = p.getServicePorts()
+	if info := p.servicePorts[svcPortName]; info == nil || info.affinityTimeout != time.Minute {
+		t.Fatalf("unexpected service port info %#v", info)
+	}
+	p.endpoints[svcPortName] = []string{"10.128.0.4:8080", "10.128.0.5:8080", "10.128.0.6:8080"}
+
+	client1 := &net.TCPAddr{IP: net.ParseIP("10.129.0.2"), Port: 40000}
+	client1b := &net.TCPAddr{IP: net.ParseIP("10.129.0.2"), Port: 40001}
+	client2 := &net.TCPAddr{IP: net.ParseIP("10.129.0.3"), Port: 40000}
+
+	// Each connection from a client goes to the same endpoint
+	ep1, err := p.NextEndpoint(svcPortName, client1, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ep2, _ := p.NextEndpoint(svcPortName, client2, false)
+	if ep2 == ep1 {
+		t.Fatalf("expected client2 to be sent to a different endpoint than %s", ep1)
+	}
+	for i := 0; i < 3; i++ {
+		if ep, _ := p.NextEndpoint(svcPortName, client1b, false); ep != ep1 {
+			t.Fatalf("expected client1 to be sent to %s again, got %s", ep1, ep)
+		}
+	}
+
+	// Resetting affinity picks a new endpoint, which is then remembered
+	epReset, _ := p.NextEndpoint(svcPortName, client1, true)
+	if epReset == ep1 {
+		t.Fatalf("expected reset to pick an endpoint other than %s", ep1)
+	}
+	if ep, _ := p.NextEndpoint(svcPortName, client1, false); ep != epReset {
+		t.Fatalf("expected client1 to be sent to %s after reset, got %s", epReset, ep)
+	}
+
+	// Expired affinity is ignored
+	p.affinity[svcPortName]["10.129.0.2"].lastUsed = time.Now().Add(-2 * time.Minute)
+	if ep, _ := p.NextEndpoint(svcPortName, client1, false); ep == epReset {
+		t.Fatalf("expected expired affinity for %s to be ignored", epReset)
+	}
+
+	// Affinity to an endpoint that has gone away is ignored
+	p.endpoints[svcPortName] = []string{"10.128.0.7:8080"}
+	if ep, _ := p.NextEndpoint(svcPortName, client2, false); ep != "10.128.0.7:8080" {
+		t.Fatalf("unexpected endpoint %s", ep)
+	}
+
+	// Without session affinity, endpoints are picked round-robin
+	service.Spec.SessionAffinity = v1.ServiceAffinityNone
+	p.servicePorts = p.getServicePorts()
+	p.endpoints[svcPortName] = []string{"10.128.0.4:8080", "10.128.0.5:8080"}
+	epA, _ := p.NextEndpoint(svcPortName, client1, false)
+	epB, _ := p.NextEndpoint(svcPortName, client1, false)
+	if epA == epB {
+		t.Fatalf("expected round-robin endpoints, got %s twice", epA)
+	}
+}
@@ -1,10 +1,14 @@
 package unidler
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"net"
-	"strconv"
+	"os"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"k8s.io/klog/v2"
@@ -12,7 +16,8 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/kubernetes/pkg/proxy"
-	"k8s.io/kubernetes/pkg/proxy/userspace"
+
+	"github.com/openshift/sdn/pkg/network/proxy/metrics"
 )
 
 const (
@@ -23,7 +28,7 @@ const (
 var endpointDialTimeout = []time.Duration{250 * time.Millisecond, 500 * time.Millisecond, 1 * time.Second, 2 * time.Second}
 
 type connectionList struct {
-	conns   []heldConn
+	conns   []*heldConn
 	maxSize int
 
 	tickSize       time.Duration
@@ -31,16 +36,77 @@ type connectionList struct {
 	timeout        time.Duration
 
 	svcName string
+
+	// when we signaled that the service needs pods
+	signaledAt time.Time
 }
 
+// heldConn is a connection being held until the service has endpoints. Data sent
+// by the client in the meantime is read into buffered (up to maxBufferedBytes), so
+// that we notice if the client goes away, and is replayed to the endpoint when the
+// connection is finally proxied.
 type heldConn struct {
 	net.Conn
 	connectedAt time.Duration
+
+	buffered bytes.Buffer
+	// done is closed when bufferInput returns; clientClosed may only be read after that
+	done         chan struct{}
+	clientClosed bool
+}
+
+func newHeldConn(conn net.Conn, connectedAt time.Duration) *heldConn {
+	hc := &heldConn{
+		Conn:        conn,
+		connectedAt: connectedAt,
+		done:        make(chan struct{}),
+	}
+	go hc.bufferInput()
+	return hc
+}
+
+// bufferInput reads from the client until the buffer is full, the client closes
+// the connection, or stopBuffering is called
+func (hc *heldConn) bufferInput() {
+	defer close(hc.done)
+	buf := make([]byte, 4096)
+	for hc.buffered.Len() < maxBufferedBytes {
+		if remaining := maxBufferedBytes - hc.buffered.Len(); remaining < len(buf) {
+			buf = buf[:remaining]
+		}
+		n, err := hc.Conn.Read(buf)
+		hc.buffered.Write(buf[:n])
+		if err != nil {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				hc.clientClosed = true
+			}
+			return
+		}
+	}
+}
+
+// isClosed returns whether the client is known to have closed the connection
+func (hc *heldConn) isClosed() bool {
+	select {
+	case <-hc.done:
+		return hc.clientClosed
+	default:
+		return false
+	}
+}
+
+// stopBuffering stops reading from the client, and returns false if the client
+// closed the connection while it was held
+func (hc *heldConn) stopBuffering() bool {
+	hc.Conn.SetReadDeadline(time.Now())
+	<-hc.done
+	hc.Conn.SetReadDeadline(time.Time{})
+	return !hc.clientClosed
 }
 
 func newConnectionList(maxSize int, tickSize time.Duration, timeout time.Duration, svcName string) *connectionList {
 	return &connectionList{
-		conns:          []heldConn{},
+		conns:          []*heldConn{},
 		maxSize:        maxSize,
 		tickSize:       tickSize,
 		timeSinceStart: 0,
@@ -51,14 +117,16 @@ func newConnectionList(maxSize int, tickSize time.Duration, timeout time.Duratio
 
 func (l *connectionList) Add(conn net.Conn) {
 	if len(l.conns) >= l.maxSize {
-		// TODO: look for closed connections
+		l.cleanClosedConnections()
+	}
+	if len(l.conns) >= l.maxSize {
 		utilruntime.HandleError(fmt.Errorf("max connections exceeded while waiting for idled service %s to awaken, dropping oldest", l.svcName))
-		var oldConn net.Conn
+		var oldConn *heldConn
 		oldConn, l.conns = l.conns[0], l.conns[1:]
 		oldConn.Close()
 	}
 
-	l.conns = append(l.conns, heldConn{conn, l.timeSinceStart})
+	l.conns = append(l.conns, newHeldConn(conn, l.timeSinceStart))
 }
 
 func (l *connectionList) Tick() {
@@ -86,12 +154,21 @@ func (l *connectionList) cleanOldConnections() {
 	}
 }
 
-func (l *connectionList) GetConns() []net.Conn {
-	conns := make([]net.Conn, len(l.conns))
-	for i, conn := range l.conns {
-		conns[i] = conn.Conn
+// cleanClosedConnections drops connections that the client has already closed
+func (l *connectionList) cleanClosedConnections() {
+	conns := l.conns[:0]
+	for _, conn := range l.conns {
+		if conn.isClosed() {
+			conn.Close()
+		} else {
+			conns = append(conns, conn)
+		}
 	}
-	return conns
+	l.conns = conns
+}
+
+func (l *connectionList) GetConns() []*heldConn {
+	return l.conns
 }
 
 func (l *connectionList) Len() int {
@@ -103,20 +180,72 @@ func (l *connectionList) Clear() {
 		conn.Close()
 	}
 
-	l.conns = []heldConn{}
+	l.conns = []*heldConn{}
 }
 
 var (
-	// MaxHeldConnections is the maximum number of TCP connections per service that
-	// will be held by the unidler at once (new connections will cause older ones
-	// to be dropped after the limit is reached)
+	// MaxHeldConnections is the default maximum number of TCP connections per
+	// service port that will be held by the unidler at once (new connections will
+	// cause older ones to be dropped after the limit is reached)
 	MaxHeldConnections = 16
 
+	// MaxHeldDatagrams is the default maximum number of UDP datagrams per client
+	// that will be held by the unidler until the service has endpoints (new
+	// datagrams will cause older ones to be dropped after the limit is reached)
+	MaxHeldDatagrams = 16
+
+	// DefaultHeldConnectionTimeout is the default for how long a TCP connection (or
+	// UDP datagrams) to an idled service will be held waiting for the service to get
+	// endpoints
+	DefaultHeldConnectionTimeout = 120 * time.Second
+
+	// maxHeldConnectionsLimit and maxHeldConnectionTimeout are the largest values
+	// that MaxHeldConnectionsAnnotation and HeldConnectionTimeoutAnnotation can
+	// raise the held connection limit and timeout to, since the held connections'
+	// sockets and buffers are held on the node
+	maxHeldConnectionsLimit  = 1024
+	maxHeldConnectionTimeout = 10 * time.Minute
+	// maxHeldDatagramsLimit is the largest value that MaxHeldDatagramsAnnotation
+	// can raise the held datagram limit to
+	maxHeldDatagramsLimit = 64
+
 	needPodsWaitTimeout = 120 * time.Second
 	needPodsTickLen     = 5 * time.Second
+
+	// maxBufferedBytes is the maximum amount of data that will be read from a held
+	// TCP connection before the service has endpoints
+	maxBufferedBytes = 64 * 1024
+
+	// maxHeldDatagramClients is the maximum number of clients per UDP service port
+	// whose datagrams will be held at once
+	maxHeldDatagramClients = 64
+
+	// udpSessionTimeout is how long the unidler keeps relaying replies from an
+	// endpoint to a client of a newly-unidled UDP service after the last reply
+	udpSessionTimeout = 10 * time.Second
 )
 
-func newUnidlerSocket(protocol corev1.Protocol, ip net.IP, port int, signaler NeedPodsSignaler) (userspace.ProxySocket, error) {
+// unidlerSocket is a socket that idled service traffic is redirected to
+type unidlerSocket interface {
+	// Addr gets the net.Addr for the socket
+	Addr() net.Addr
+	// Close stops the socket from accepting incoming connections
+	Close() error
+	// ProxyLoop handles incoming connections for the specified service
+	ProxyLoop(service proxy.ServicePortName, info *servicePortInfo, endpoints endpointPicker)
+	// ListenPort returns the host port that the socket is listening on
+	ListenPort() int
+}
+
+// endpointPicker tracks the endpoints of services being unidled
+type endpointPicker interface {
+	ServiceHasEndpoints(service proxy.ServicePortName) bool
+	NextEndpoint(service proxy.ServicePortName, srcAddr net.Addr, sessionAffinityReset bool) (string, error)
+}
+
+// newUnidlerSocket creates an unidlerSocket listening on ip on a port chosen by
+// the kernel
+func newUnidlerSocket(protocol corev1.Protocol, ip net.IP, signaler NeedPodsSignaler) (unidlerSocket, error) {
 	host := ""
 	if ip != nil {
 		host = ip.String()
@@ -124,13 +253,14 @@ func newUnidlerSocket(protocol corev1.Protocol, ip net.IP, port int, signaler Ne
 
 	switch strings.ToUpper(string(protocol)) {
 	case "TCP":
-		listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
 		if err != nil {
 			return nil, err
 		}
+		port := listener.Addr().(*net.TCPAddr).Port
 		return &tcpUnidlerSocket{Listener: listener, port: port, signaler: signaler}, nil
 	case "UDP":
-		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, "0"))
 		if err != nil {
 			return nil, err
 		}
@@ -138,12 +268,19 @@ func newUnidlerSocket(protocol corev1.Protocol, ip net.IP, port int, signaler Ne
 		if err != nil {
 			return nil, err
 		}
+		port := conn.LocalAddr().(*net.UDPAddr).Port
 		return &udpUnidlerSocket{UDPConn: conn, port: port, signaler: signaler}, nil
+	case "SCTP":
+		listener, port, err := listenSCTP(ip)
+		if err != nil {
+			return nil, err
+		}
+		return &sctpUnidlerSocket{Listener: listener, port: port, signaler: signaler}, nil
 	}
 	return nil, fmt.Errorf("unknown protocol %q", protocol)
 }
 
-// tcpUnidlerSocket implements proxySocket.  Close() is implemented by net.Listener.  When Close() is called,
+// tcpUnidlerSocket implements unidlerSocket.  Close() is implemented by net.Listener.  When Close() is called,
 // no new connections are allowed but existing connections are left untouched.
 type tcpUnidlerSocket struct {
 	net.Listener
@@ -155,20 +292,26 @@ func (tcp *tcpUnidlerSocket) ListenPort() int {
 	return tcp.port
 }
 
-func (tcp *tcpUnidlerSocket) waitForEndpoints(ch chan<- interface{}, service proxy.ServicePortName, loadBalancer userspace.LoadBalancer) {
-	defer close(ch)
+// waitForEndpoints closes ch once service has endpoints. If stop is closed first, it
+// returns without closing ch.
+func waitForEndpoints(ch chan<- interface{}, stop <-chan struct{}, service proxy.ServicePortName, endpoints endpointPicker) {
 	for {
-		if loadBalancer.ServiceHasEndpoints(service) {
+		if endpoints.ServiceHasEndpoints(service) {
 			// we have endpoints now, so we're finished
+			close(ch)
 			return
 		}
 
 		// otherwise, wait a bit before checking for endpoints again
-		time.Sleep(endpointDialTimeout[0])
+		select {
+		case <-stop:
+			return
+		case <-time.After(endpointDialTimeout[0]):
+		}
 	}
 }
 
-func (tcp *tcpUnidlerSocket) acceptConns(ch chan<- net.Conn, svcInfo *userspace.ServiceInfo) {
+func (tcp *tcpUnidlerSocket) acceptConns(ch chan<- net.Conn, svcInfo *servicePortInfo) {
 	defer close(ch)
 
 	// Block until a connection is made.
@@ -183,7 +326,7 @@ func (tcp *tcpUnidlerSocket) acceptConns(ch chan<- net.Conn, svcInfo *userspace.
 			if isClosedError(err) {
 				return
 			}
-			if !svcInfo.IsAlive() {
+			if !svcInfo.isAlive() {
 				// Then the service port was just closed so the accept failure is to be expected.
 				return
 			}
@@ -200,14 +343,14 @@ func (tcp *tcpUnidlerSocket) acceptConns(ch chan<- net.Conn, svcInfo *userspace.
 // (and thus the hybrid proxy has switched this service over to using the normal proxy).  Connections will
 // be gradually timed out and dropped off the list of connections on a per-connection basis.  The list of current
 // connections is returned, in addition to whether or not we should retry this method.
-func (tcp *tcpUnidlerSocket) awaitAwakening(service proxy.ServicePortName, loadBalancer userspace.LoadBalancer, inConns <-chan net.Conn, endpointsAvail chan<- interface{}) (*connectionList, bool) {
+func (tcp *tcpUnidlerSocket) awaitAwakening(service proxy.ServicePortName, svcInfo *servicePortInfo, endpoints endpointPicker, inConns <-chan net.Conn, endpointsAvail chan<- interface{}) (*connectionList, bool) {
 	// collect connections and wait for endpoints to be available
 	sent_need_pods := false
 	timeout_started := false
 	ticker := time.NewTicker(needPodsTickLen)
 	defer ticker.Stop()
 	svcName := fmt.Sprintf("%s/%s:%s", service.Namespace, service.Name, service.Port)
-	allConns := newConnectionList(MaxHeldConnections, needPodsTickLen, needPodsWaitTimeout, svcName)
+	allConns := newConnectionList(svcInfo.maxHeldConns, needPodsTickLen, svcInfo.heldConnTimeout, svcName)
 
 	for {
 		select {
@@ -217,9 +360,9 @@ func (tcp *tcpUnidlerSocket) awaitAwakening(service proxy.ServicePortName, loadB
 				return allConns, false
 			}
 
-			if !sent_need_pods && !loadBalancer.ServiceHasEndpoints(service) {
+			if !sent_need_pods && !endpoints.ServiceHasEndpoints(service) {
 				klog.V(4).Infof("unidling TCP proxy sent unidle event to wake up service %s/%s:%s", service.Namespace, service.Name, service.Port)
-				tcp.signaler.NeedPods(service.NamespacedName, service.Port)
+				allConns.signaledAt = signalNeedPods(tcp.signaler, service)
 
 				// only send NeedPods once
 				sent_need_pods = true
@@ -227,9 +370,9 @@ func (tcp *tcpUnidlerSocket) awaitAwakening(service proxy.ServicePortName, loadB
 			}
 
 			if allConns.Len() == 0 {
-				if !loadBalancer.ServiceHasEndpoints(service) {
+				if !endpoints.ServiceHasEndpoints(service) {
 					// notify us when endpoints are available
-					go tcp.waitForEndpoints(endpointsAvail, service, loadBalancer)
+					go waitForEndpoints(endpointsAvail, nil, service, endpoints)
 				}
 			}
 
@@ -246,8 +389,8 @@ func (tcp *tcpUnidlerSocket) awaitAwakening(service proxy.ServicePortName, loadB
 	}
 }
 
-func (tcp *tcpUnidlerSocket) ProxyLoop(service proxy.ServicePortName, svcInfo *userspace.ServiceInfo, loadBalancer userspace.LoadBalancer) {
-	if !svcInfo.IsAlive() {
+func (tcp *tcpUnidlerSocket) ProxyLoop(service proxy.ServicePortName, svcInfo *servicePortInfo, endpoints endpointPicker) {
+	if !svcInfo.isAlive() {
 		// The service port was closed or replaced.
 		return
 	}
@@ -263,7 +406,7 @@ func (tcp *tcpUnidlerSocket) ProxyLoop(service proxy.ServicePortName, svcInfo *u
 		klog.V(4).Infof("unidling TCP proxy start/reset for service %s/%s:%s", service.Namespace, service.Name, service.Port)
 
 		var cont bool
-		if allConns, cont = tcp.awaitAwakening(service, loadBalancer, inConns, endpointsAvail); !cont {
+		if allConns, cont = tcp.awaitAwakening(service, svcInfo, endpoints, inConns, endpointsAvail); !cont {
 			break
 		}
 	}
@@ -276,29 +419,92 @@ func (tcp *tcpUnidlerSocket) ProxyLoop(service proxy.ServicePortName, svcInfo *u
 			close(endpointsAvail)
 			// this shouldn't happen (ok should always be false)
 		}
-	case <-time.NewTimer(needPodsWaitTimeout).C:
+	case <-time.NewTimer(svcInfo.heldConnTimeout).C:
 		if allConns.Len() > 0 {
 			utilruntime.HandleError(fmt.Errorf("timed out %v TCP connections while waiting for idled service %s/%s:%s to awaken.", allConns.Len(), service.Namespace, service.Name, service.Port))
 			allConns.Clear()
 		}
 		return
 	}
+	observeWakeDuration(allConns.signaledAt)
 	klog.V(4).Infof("unidling TCP proxy got endpoints for service %s/%s:%s, connecting %v accumulated connections", service.Namespace, service.Name, service.Port, allConns.Len())
 
 	for _, inConn := range allConns.GetConns() {
+		if !inConn.stopBuffering() {
+			klog.V(4).Infof("Held TCP connection from %v to %v was closed by the client", inConn.RemoteAddr(), inConn.LocalAddr())
+			inConn.Close()
+			continue
+		}
 		klog.V(3).Infof("Accepted TCP connection from %v to %v", inConn.RemoteAddr(), inConn.LocalAddr())
-		outConn, err := userspace.TryConnectEndpoints(service, inConn.(*net.TCPConn).RemoteAddr(), "tcp", loadBalancer)
+		outConn, err := tryConnectEndpoints(service, inConn.RemoteAddr(), "tcp", endpoints)
 		if err != nil {
-			utilruntime.HandleError(fmt.Errorf("Failed to connect to balancer: %v", err))
+			utilruntime.HandleError(fmt.Errorf("Failed to connect to endpoints: %v", err))
 			inConn.Close()
 			continue
 		}
+		// Replay whatever the client sent while it was waiting
+		if inConn.buffered.Len() > 0 {
+			if _, err := outConn.Write(inConn.buffered.Bytes()); err != nil {
+				utilruntime.HandleError(fmt.Errorf("Failed to send buffered data to endpoint: %v", err))
+				inConn.Close()
+				outConn.Close()
+				continue
+			}
+		}
 		// Spin up an async copy loop.
-		go userspace.ProxyTCP(inConn.(*net.TCPConn), outConn.(*net.TCPConn))
+		go proxyTCP(inConn.Conn.(*net.TCPConn), outConn.(*net.TCPConn))
 	}
 }
 
-// udpUnidlerSocket implements proxySocket.  Close() is implemented by net.UDPConn.  When Close() is called,
+// tryConnectEndpoints attempts to connect to the next available endpoint for the given
+// service, cycling through until it is able to successfully connect, or it has tried
+// with all timeouts in endpointDialTimeout. The first attempt respects srcAddr's
+// session affinity, if any; later attempts pick a new endpoint.
+func tryConnectEndpoints(service proxy.ServicePortName, srcAddr net.Addr, protocol string, endpoints endpointPicker) (net.Conn, error) {
+	sessionAffinityReset := false
+	for _, dialTimeout := range endpointDialTimeout {
+		endpoint, err := endpoints.NextEndpoint(service, srcAddr, sessionAffinityReset)
+		if err != nil {
+			return nil, err
+		}
+		klog.V(3).Infof("Mapped service %q to endpoint %s", service, endpoint)
+		outConn, err := net.DialTimeout(protocol, endpoint, dialTimeout)
+		if err != nil {
+			if isTooManyFDsError(err) {
+				panic("Dial failed: " + err.Error())
+			}
+			klog.Errorf("Dial failed: %v", err)
+			sessionAffinityReset = true
+			continue
+		}
+		return outConn, nil
+	}
+	return nil, fmt.Errorf("failed to connect to an endpoint")
+}
+
+// proxyTCP proxies data bi-directionally between in and out.
+func proxyTCP(in, out *net.TCPConn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	klog.V(4).Infof("Creating proxy between %v <-> %v <-> %v <-> %v",
+		in.RemoteAddr(), in.LocalAddr(), out.LocalAddr(), out.RemoteAddr())
+	go copyBytes("from backend", in, out, &wg)
+	go copyBytes("to backend", out, in, &wg)
+	wg.Wait()
+}
+
+func copyBytes(direction string, dest, src *net.TCPConn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	n, err := io.Copy(dest, src)
+	if err != nil && !isClosedError(err) {
+		klog.Errorf("I/O error: %v", err)
+	}
+	klog.V(4).Infof("Copied %d bytes %s: %s -> %s", n, direction, src.RemoteAddr(), dest.RemoteAddr())
+	dest.Close()
+	src.Close()
+}
+
+// udpUnidlerSocket implements unidlerSocket.  Close() is implemented by net.UDPConn.  When Close() is called,
 // no new connections are allowed and existing connections are broken.
 // TODO: We could lame-duck this ourselves, if it becomes important.
 type udpUnidlerSocket struct {
@@ -315,65 +521,396 @@ func (udp *udpUnidlerSocket) Addr() net.Addr {
 	return udp.LocalAddr()
 }
 
-// readFromSock tries to read from a socket, returning true if we should continue trying
-// to read again, or false if no further reads should be made.
-func (udp *udpUnidlerSocket) readFromSock(buffer []byte, svcInfo *userspace.ServiceInfo) bool {
-	if !svcInfo.IsAlive() {
-		// The service port was closed or replaced.
-		return false
+// datagram is a UDP datagram received from a client of an idled service
+type datagram struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// heldClient is a client of an idled UDP service whose datagrams are being held
+// until the service has endpoints
+type heldClient struct {
+	addr       *net.UDPAddr
+	datagrams  [][]byte
+	receivedAt time.Time
+}
+
+// datagramList holds the datagrams sent to an idled UDP service port, per client,
+// until the service has endpoints
+type datagramList struct {
+	// clients is ordered by when each client's first datagram was received
+	clients []*heldClient
+	index   map[string]*heldClient
+
+	maxDatagrams int
+	timeout      time.Duration
+
+	svcName string
+}
+
+func newDatagramList(maxDatagrams int, timeout time.Duration, svcName string) *datagramList {
+	return &datagramList{
+		index:        make(map[string]*heldClient),
+		maxDatagrams: maxDatagrams,
+		timeout:      timeout,
+		svcName:      svcName,
 	}
+}
 
-	// Block until data arrives.
-	// TODO: Accumulate a histogram of n or something, to fine tune the buffer size.
-	_, _, err := udp.ReadFrom(buffer)
+func (l *datagramList) Add(dg *datagram, now time.Time) {
+	key := dg.addr.String()
+	client := l.index[key]
+	if client == nil {
+		if len(l.clients) >= maxHeldDatagramClients {
+			utilruntime.HandleError(fmt.Errorf("max clients exceeded while waiting for idled service %s to awaken, dropping oldest", l.svcName))
+			l.drop(1)
+		}
+		client = &heldClient{addr: dg.addr, receivedAt: now}
+		l.clients = append(l.clients, client)
+		l.index[key] = client
+	}
+	if len(client.datagrams) >= l.maxDatagrams {
+		utilruntime.HandleError(fmt.Errorf("max datagrams exceeded for client %s while waiting for idled service %s to awaken, dropping oldest", key, l.svcName))
+		client.datagrams = client.datagrams[1:]
+	}
+	client.datagrams = append(client.datagrams, dg.data)
+}
+
+// Expire drops the datagrams of clients that have been waiting longer than the timeout
+func (l *datagramList) Expire(now time.Time) {
+	expired := 0
+	for expired < len(l.clients) && now.Sub(l.clients[expired].receivedAt) >= l.timeout {
+		expired++
+	}
+	if expired > 0 {
+		utilruntime.HandleError(fmt.Errorf("timed out datagrams from %v clients while waiting for idled service %s to awaken.", expired, l.svcName))
+		l.drop(expired)
+	}
+}
+
+// drop drops the datagrams of the n oldest clients
+func (l *datagramList) drop(n int) {
+	for _, client := range l.clients[:n] {
+		delete(l.index, client.addr.String())
+	}
+	l.clients = l.clients[n:]
+}
+
+// Take returns the held clients and empties the list
+func (l *datagramList) Take() []*heldClient {
+	clients := l.clients
+	l.clients = nil
+	l.index = make(map[string]*heldClient)
+	return clients
+}
+
+func (l *datagramList) Len() int {
+	n := 0
+	for _, client := range l.clients {
+		n += len(client.datagrams)
+	}
+	return n
+}
+
+// udpSessions tracks the connections from the unidler to the endpoints of a newly
+// unidled UDP service, per client, until the service is handed off to the main proxy
+type udpSessions struct {
+	mu    sync.Mutex
+	conns map[string]net.Conn
+}
+
+// getSession returns the connection for client, connecting to an endpoint and starting to
+// relay its replies if there isn't one yet
+func (udp *udpUnidlerSocket) getSession(sessions *udpSessions, service proxy.ServicePortName, client *net.UDPAddr, endpoints endpointPicker) (net.Conn, error) {
+	key := client.String()
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	if conn, ok := sessions.conns[key]; ok {
+		return conn, nil
+	}
+	conn, err := tryConnectEndpoints(service, client, "udp", endpoints)
 	if err != nil {
-		if e, ok := err.(net.Error); ok {
-			if e.Temporary() {
-				klog.V(1).Infof("ReadFrom had a temporary failure: %v", err)
-				return true
+		return nil, err
+	}
+	sessions.conns[key] = conn
+	go udp.relayReplies(sessions, client, conn)
+	return conn, nil
+}
+
+// relayReplies sends datagrams from outConn back to client, until no reply has been
+// received for udpSessionTimeout or the unidler socket is closed
+func (udp *udpUnidlerSocket) relayReplies(sessions *udpSessions, client *net.UDPAddr, outConn net.Conn) {
+	defer func() {
+		sessions.mu.Lock()
+		defer sessions.mu.Unlock()
+		if sessions.conns[client.String()] == outConn {
+			delete(sessions.conns, client.String())
+		}
+		outConn.Close()
+	}()
+
+	buffer := make([]byte, UDPBufferSize)
+	for {
+		outConn.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		n, err := outConn.Read(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); (!ok || !netErr.Timeout()) && !isClosedError(err) {
+				klog.V(4).Infof("Error reading UDP reply from %v: %v", outConn.RemoteAddr(), err)
 			}
+			return
+		}
+		if _, err := udp.WriteToUDP(buffer[:n], client); err != nil {
+			if !isClosedError(err) {
+				utilruntime.HandleError(fmt.Errorf("Failed to relay UDP reply to %v: %v", client, err))
+			}
+			return
 		}
-		utilruntime.HandleError(fmt.Errorf("ReadFrom failed, exiting ProxyLoop: %v", err))
-		return false
 	}
+}
+
+func (sessions *udpSessions) closeAll() {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	for _, conn := range sessions.conns {
+		conn.Close()
+	}
+}
+
+// forward sends data from client to an endpoint of service
+func (udp *udpUnidlerSocket) forward(sessions *udpSessions, service proxy.ServicePortName, client *net.UDPAddr, data [][]byte, endpoints endpointPicker) {
+	outConn, err := udp.getSession(sessions, service, client, endpoints)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Failed to connect to endpoints: %v", err))
+		return
+	}
+	for _, d := range data {
+		if _, err := outConn.Write(d); err != nil {
+			utilruntime.HandleError(fmt.Errorf("Failed to send UDP datagram to endpoint %v: %v", outConn.RemoteAddr(), err))
+			return
+		}
+	}
+}
+
+// readDatagrams reads datagrams from the socket until it is closed
+func (udp *udpUnidlerSocket) readDatagrams(ch chan<- *datagram, svcInfo *servicePortInfo) {
+	defer close(ch)
 
-	return true
+	// TODO: Accumulate a histogram of n or something, to fine tune the buffer size.
+	buffer := make([]byte, UDPBufferSize)
+	for svcInfo.isAlive() {
+		n, addr, err := udp.ReadFromUDP(buffer)
+		if err != nil {
+			if e, ok := err.(net.Error); ok {
+				if e.Temporary() {
+					klog.V(1).Infof("ReadFrom had a temporary failure: %v", err)
+					continue
+				}
+			}
+			if !isClosedError(err) && svcInfo.isAlive() {
+				utilruntime.HandleError(fmt.Errorf("ReadFrom failed, exiting ProxyLoop: %v", err))
+			}
+			return
+		}
+		ch <- &datagram{data: append([]byte(nil), buffer[:n]...), addr: addr}
+	}
 }
 
-func (udp *udpUnidlerSocket) sendWakeup(svcPortName proxy.ServicePortName, svcInfo *userspace.ServiceInfo) *time.Timer {
+func (udp *udpUnidlerSocket) sendWakeup(svcPortName proxy.ServicePortName, svcInfo *servicePortInfo) (*time.Timer, time.Time) {
 	timeoutTimer := time.NewTimer(needPodsWaitTimeout)
 	klog.V(4).Infof("unidling proxy sent unidle event to wake up service %s/%s:%s", svcPortName.Namespace, svcPortName.Name, svcPortName.Port)
-	udp.signaler.NeedPods(svcPortName.NamespacedName, svcPortName.Port)
+	signaledAt := signalNeedPods(udp.signaler, svcPortName)
 
-	return timeoutTimer
+	return timeoutTimer, signaledAt
 }
 
-func (udp *udpUnidlerSocket) ProxyLoop(svcPortName proxy.ServicePortName, svcInfo *userspace.ServiceInfo, loadBalancer userspace.LoadBalancer) {
-	// just drop the packets on the floor until we have endpoints
-	var buffer [UDPBufferSize]byte
-
+// ProxyLoop holds the datagrams sent to the service (up to svcInfo.maxHeldDatagrams
+// per client, for up to svcInfo.heldConnTimeout) while signaling that it needs pods,
+// and then sends them on to the first available endpoint, relaying the replies.
+// Datagrams received after that, until the service is handed off to the main proxy,
+// are forwarded the same way.
+func (udp *udpUnidlerSocket) ProxyLoop(svcPortName proxy.ServicePortName, svcInfo *servicePortInfo, endpoints endpointPicker) {
 	klog.V(4).Infof("unidling proxy UDP proxy waiting for data for service %s/%s:%s", svcPortName.Namespace, svcPortName.Name, svcPortName.Port)
 
-	if !udp.readFromSock(buffer[0:], svcInfo) {
-		return
+	datagrams := make(chan *datagram)
+	go udp.readDatagrams(datagrams, svcInfo)
+
+	svcName := fmt.Sprintf("%s/%s:%s", svcPortName.Namespace, svcPortName.Name, svcPortName.Port)
+	held := newDatagramList(svcInfo.maxHeldDatagrams, svcInfo.heldConnTimeout, svcName)
+	sessions := &udpSessions{conns: make(map[string]net.Conn)}
+	defer sessions.closeAll()
+
+	ticker := time.NewTicker(needPodsTickLen)
+	defer ticker.Stop()
+
+	var wakeupTimeoutTimer *time.Timer
+	var signaledAt time.Time
+	var endpointsAvail chan interface{}
+	stopWaiting := make(chan struct{})
+	defer close(stopWaiting)
+	awake := false
+
+	for {
+		select {
+		case dg, ok := <-datagrams:
+			if !ok {
+				// The socket is closed when the service is handed off to the main proxy
+				if !awake && endpoints.ServiceHasEndpoints(svcPortName) {
+					observeWakeDuration(signaledAt)
+				}
+				if held.Len() > 0 {
+					utilruntime.HandleError(fmt.Errorf("dropped %v UDP datagrams held for idled service %s", held.Len(), svcName))
+				}
+				return
+			}
+
+			if awake {
+				udp.forward(sessions, svcPortName, dg.addr, [][]byte{dg.data}, endpoints)
+				continue
+			}
+
+			// reset the timer whenever we receive data, and only signal if
+			// the timer had timed out when we reset it (so only send one event
+			// for each "burst" of data we get).
+			if wakeupTimeoutTimer == nil {
+				wakeupTimeoutTimer, signaledAt = udp.sendWakeup(svcPortName, svcInfo)
+			} else if active := wakeupTimeoutTimer.Reset(needPodsWaitTimeout); !active {
+				wakeupTimeoutTimer, signaledAt = udp.sendWakeup(svcPortName, svcInfo)
+			}
+
+			if endpointsAvail == nil {
+				// notify us when endpoints are available
+				endpointsAvail = make(chan interface{})
+				go waitForEndpoints(endpointsAvail, stopWaiting, svcPortName, endpoints)
+			}
+			held.Add(dg, time.Now())
+			klog.V(4).Infof("unidling UDP proxy is holding %v datagrams while waiting for service %s to unidle", held.Len(), svcName)
+
+		case <-endpointsAvail:
+			awake = true
+			endpointsAvail = nil
+			observeWakeDuration(signaledAt)
+			clients := held.Take()
+			klog.V(4).Infof("unidling UDP proxy got endpoints for service %s, sending held datagrams from %v clients", svcName, len(clients))
+			for _, client := range clients {
+				udp.forward(sessions, svcPortName, client.addr, client.datagrams, endpoints)
+			}
+
+		case <-ticker.C:
+			held.Expire(time.Now())
+		}
 	}
+}
 
-	wakeupTimeoutTimer := udp.sendWakeup(svcPortName, svcInfo)
+// listenSCTP creates a listening one-to-one style SCTP socket on ip, on a port chosen
+// by the kernel. Go has no native SCTP support, but such a socket behaves enough
+// like a TCP socket that net.FileListener can wrap it.
+func listenSCTP(ip net.IP) (net.Listener, int, error) {
+	family := syscall.AF_INET
+	var sa syscall.Sockaddr
+	if ip != nil && ip.To4() == nil {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{}
+		copy(sa6.Addr[:], ip.To16())
+		sa = sa6
+	} else {
+		sa4 := &syscall.SockaddrInet4{}
+		if ip != nil {
+			copy(sa4.Addr[:], ip.To4())
+		}
+		sa = sa4
+	}
 
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_SCTP)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not create SCTP socket: %v", err)
+	}
+	file := os.NewFile(uintptr(fd), "sctp-unidler")
+	// net.FileListener dups the fd, so we can always close ours
+	defer file.Close()
+
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, 0, fmt.Errorf("could not bind SCTP socket: %v", err)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		return nil, 0, fmt.Errorf("could not listen on SCTP socket: %v", err)
+	}
+	var port int
+	bound, err := syscall.Getsockname(fd)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not get SCTP socket address: %v", err)
+	}
+	switch bound := bound.(type) {
+	case *syscall.SockaddrInet4:
+		port = bound.Port
+	case *syscall.SockaddrInet6:
+		port = bound.Port
+	}
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	return listener, port, nil
+}
+
+// sctpUnidlerSocket implements unidlerSocket. Close() is implemented by net.Listener.
+// Since we can't proxy SCTP, associations to an idled SCTP service are closed
+// immediately after signaling that the service needs pods, and clients are expected
+// to retry.
+type sctpUnidlerSocket struct {
+	net.Listener
+	port     int
+	signaler NeedPodsSignaler
+}
+
+func (sctp *sctpUnidlerSocket) ListenPort() int {
+	return sctp.port
+}
+
+func (sctp *sctpUnidlerSocket) ProxyLoop(service proxy.ServicePortName, svcInfo *servicePortInfo, endpoints endpointPicker) {
+	var lastSignal time.Time
 	for {
-		if !udp.readFromSock(buffer[0:], svcInfo) {
-			break
+		inConn, err := sctp.Accept()
+		if err != nil {
+			if isTooManyFDsError(err) {
+				panic("Accept failed: " + err.Error())
+			}
+			if isClosedError(err) || !svcInfo.isAlive() {
+				if endpoints.ServiceHasEndpoints(service) {
+					observeWakeDuration(lastSignal)
+				}
+				return
+			}
+			utilruntime.HandleError(fmt.Errorf("Accept failed: %v", err))
+			continue
 		}
+		inConn.Close()
 
-		// reset the timer whenever we receive data, and only signal if we've
-		// the timer had timed out when we reset it (so only send one even for
-		// each "burst" of data we get).
-		if active := wakeupTimeoutTimer.Reset(needPodsWaitTimeout); !active {
-			wakeupTimeoutTimer = udp.sendWakeup(svcPortName, svcInfo)
+		// Signal once per needPodsWaitTimeout, like the UDP socket does
+		if time.Since(lastSignal) >= needPodsWaitTimeout && !endpoints.ServiceHasEndpoints(service) {
+			klog.V(4).Infof("unidling SCTP proxy sent unidle event to wake up service %s/%s:%s", service.Namespace, service.Name, service.Port)
+			lastSignal = signalNeedPods(sctp.signaler, service)
 		}
 	}
 }
 
+// signalNeedPods signals that service needs pods, and returns the time it did so
+func signalNeedPods(signaler NeedPodsSignaler, service proxy.ServicePortName) time.Time {
+	metrics.UnidlingNeedPodsSignals.WithLabelValues(service.Namespace, service.Name).Inc()
+	if err := signaler.NeedPods(service.NamespacedName, service.Port); err != nil {
+		utilruntime.HandleError(fmt.Errorf("Failed to signal that service %s needs pods: %v", service, err))
+	}
+	return time.Now()
+}
+
+// observeWakeDuration records how long a service took to get endpoints after we
+// signaled that it needed pods at signaledAt
+func observeWakeDuration(signaledAt time.Time) {
+	if !signaledAt.IsZero() {
+		metrics.UnidlingWakeDuration.Observe(time.Since(signaledAt).Seconds())
+	}
+}
+
 func isTooManyFDsError(err error) bool {
 	return strings.Contains(err.Error(), "too many open files")
 }
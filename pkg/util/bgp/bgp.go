@@ -0,0 +1,548 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Port is the standard BGP port
+	Port = 179
+
+	// DefaultHoldTime is the hold time proposed to peers if Config.HoldTime is unset
+	DefaultHoldTime = 90 * time.Second
+
+	connectTimeout       = 10 * time.Second
+	connectRetryInterval = 10 * time.Second
+	writeTimeout         = 10 * time.Second
+
+	headerLength     = 19
+	maxMessageLength = 4096
+
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+
+	// asTrans is sent in place of a 4-octet AS number to peers that only
+	// understand 2-octet AS numbers (RFC 6793)
+	asTrans = 23456
+
+	paramCapabilities  = 2
+	capMultiprotocol   = 1
+	capGracefulRestart = 64
+	capFourOctetAS     = 65
+
+	// Graceful restart capability flags (RFC 4724)
+	gracefulRestartState      = 0x8000
+	gracefulRestartForwarding = 0x80
+	maxGracefulRestartTime    = 4095 * time.Second
+
+	attrFlagOptional   = 0x80
+	attrFlagTransitive = 0x40
+
+	attrOrigin    = 1
+	attrASPath    = 2
+	attrNextHop   = 3
+	attrLocalPref = 5
+	attrAS4Path   = 17
+
+	originIGP        = 0
+	asSequence       = 2
+	defaultLocalPref = 100
+
+	// NOTIFICATION error codes and subcodes (RFC 4271 section 4.5)
+	errMessageHeader          = 1
+	errOpenMessage            = 2
+	errHoldTimerExpired       = 4
+	errFiniteStateMachine     = 5
+	errCease                  = 6
+	errUnsupportedVersion     = 1
+	errBadPeerAS              = 2
+	errUnacceptableHoldTime   = 6
+	errConnectionNotSynchron  = 1
+	errBadMessageLength       = 2
+	errAdministrativeShutdown = 2
+)
+
+// Config is the configuration of a Speaker
+type Config struct {
+	// LocalAS is the local autonomous system number
+	LocalAS uint32
+	// RouterID is the (IPv4) BGP identifier of the speaker
+	RouterID net.IP
+	// NextHop is the (IPv4) next hop advertised for Prefixes
+	NextHop net.IP
+	// Prefixes are the IPv4 prefixes to advertise
+	Prefixes []*net.IPNet
+	// HoldTime is the hold time to propose to peers; if unset, DefaultHoldTime
+	HoldTime time.Duration
+	// GracefulRestartTime, if set, enables graceful restart (RFC 4724): peers that
+	// support it keep using our routes for up to GracefulRestartTime after our
+	// session goes down without a NOTIFICATION (eg, because we are restarting),
+	// rather than withdrawing them immediately.
+	GracefulRestartTime time.Duration
+	// Restarted indicates that the speaker is starting after a restart during which
+	// forwarding to Prefixes has been preserved, which it reports to peers with
+	// graceful restart. (It only applies to the first session with each peer.)
+	Restarted bool
+}
+
+// Peer is a BGP neighbor
+type Peer struct {
+	// Address is the peer's address, as "host:port"
+	Address string
+	// AS is the peer's autonomous system number. If it is the same as the local
+	// AS then the session is iBGP, otherwise eBGP.
+	AS uint32
+}
+
+// Speaker advertises a set of prefixes to a set of peers, reconnecting to each
+// peer whenever its session goes down
+type Speaker struct {
+	config Config
+	peers  []Peer
+
+	lock        sync.Mutex
+	established map[string]bool
+	// restarting is the set of peers we have not yet had a session with since
+	// restarting, if config.Restarted
+	restarting map[string]bool
+}
+
+// NewSpeaker returns a new Speaker, which will not connect to its peers until Run
+// is called.
+func NewSpeaker(config Config, peers []Peer) (*Speaker, error) {
+	if config.LocalAS == 0 {
+		return nil, fmt.Errorf("local AS number must be set")
+	}
+	if config.RouterID.To4() == nil {
+		return nil, fmt.Errorf("router ID %q is not an IPv4 address", config.RouterID)
+	}
+	if config.NextHop.To4() == nil {
+		return nil, fmt.Errorf("next hop %q is not an IPv4 address", config.NextHop)
+	}
+	for _, prefix := range config.Prefixes {
+		if prefix.IP.To4() == nil {
+			return nil, fmt.Errorf("prefix %s is not an IPv4 prefix", prefix)
+		}
+	}
+	if config.HoldTime == 0 {
+		config.HoldTime = DefaultHoldTime
+	} else if config.HoldTime < 3*time.Second || config.HoldTime > 65535*time.Second {
+		return nil, fmt.Errorf("hold time %v must be between 3s and 65535s", config.HoldTime)
+	}
+	if config.GracefulRestartTime < 0 || config.GracefulRestartTime > maxGracefulRestartTime {
+		return nil, fmt.Errorf("graceful restart time %v must be between 0s and %v", config.GracefulRestartTime, maxGracefulRestartTime)
+	}
+	for _, peer := range peers {
+		if peer.AS == 0 {
+			return nil, fmt.Errorf("AS number of peer %s must be set", peer.Address)
+		}
+		if _, _, err := net.SplitHostPort(peer.Address); err != nil {
+			return nil, fmt.Errorf("bad peer address %q: %v", peer.Address, err)
+		}
+	}
+
+	s := &Speaker{
+		config:      config,
+		peers:       peers,
+		established: make(map[string]bool),
+		restarting:  make(map[string]bool),
+	}
+	if config.Restarted {
+		for _, peer := range peers {
+			s.restarting[peer.Address] = true
+		}
+	}
+	return s, nil
+}
+
+// Run connects to each of the speaker's peers (in the background) until stopCh is
+// closed.
+func (s *Speaker) Run(stopCh <-chan struct{}) {
+	for _, peer := range s.peers {
+		peer := peer
+		go utilwait.Until(func() {
+			if err := s.runSession(peer, stopCh); err != nil {
+				klog.Warningf("BGP session with %s failed: %v", peer.Address, err)
+			}
+		}, connectRetryInterval, stopCh)
+	}
+}
+
+// Established returns the addresses of the peers that the speaker currently has
+// an established session with.
+func (s *Speaker) Established() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var peers []string
+	for peer := range s.established {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+func (s *Speaker) setEstablished(peer Peer, established bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if established {
+		s.established[peer.Address] = true
+		delete(s.restarting, peer.Address)
+	} else {
+		delete(s.established, peer.Address)
+	}
+}
+
+// notificationError is an error that is reported to the peer (with a NOTIFICATION
+// message) before closing the session
+type notificationError struct {
+	code    uint8
+	subcode uint8
+	msg     string
+}
+
+func (err *notificationError) Error() string {
+	return err.msg
+}
+
+func newNotificationError(code, subcode uint8, format string, args ...interface{}) error {
+	return &notificationError{code: code, subcode: subcode, msg: fmt.Sprintf(format, args...)}
+}
+
+func (s *Speaker) isRestarting(peer Peer) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.restarting[peer.Address]
+}
+
+// session is a single connection to a peer
+type session struct {
+	speaker *Speaker
+	peer    Peer
+	conn    net.Conn
+
+	// writeLock serializes writes to conn
+	writeLock sync.Mutex
+
+	// holdTime, fourOctetAS and gracefulRestart are negotiated from the peer's
+	// OPEN message
+	holdTime        time.Duration
+	fourOctetAS     bool
+	gracefulRestart bool
+}
+
+func (s *Speaker) runSession(peer Peer, stopCh <-chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", peer.Address, connectTimeout)
+	if err != nil {
+		return err
+	}
+	sess := &session{speaker: s, peer: peer, conn: conn}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stopCh:
+			// If the peer supports graceful restart, closing the session without
+			// a NOTIFICATION makes it keep our routes until we reconnect
+			if !sess.gracefulRestart {
+				sess.sendNotification(errCease, errAdministrativeShutdown)
+			}
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	err = sess.run()
+	select {
+	case <-stopCh:
+		return nil
+	default:
+	}
+	if notifErr, ok := err.(*notificationError); ok {
+		sess.sendNotification(notifErr.code, notifErr.subcode)
+	}
+	return err
+}
+
+// run runs the session until it fails
+func (sess *session) run() error {
+	config := &sess.speaker.config
+
+	if err := sess.send(msgOpen, sess.openMessage()); err != nil {
+		return err
+	}
+	msgType, body, err := sess.read(config.HoldTime)
+	if err != nil {
+		return err
+	}
+	if msgType != msgOpen {
+		return sess.unexpectedMessage(msgType, body, "OPEN")
+	}
+	if err := sess.handleOpen(body); err != nil {
+		return err
+	}
+
+	if err := sess.send(msgKeepalive, nil); err != nil {
+		return err
+	}
+	msgType, body, err = sess.read(sess.holdTime)
+	if err != nil {
+		return err
+	}
+	if msgType != msgKeepalive {
+		return sess.unexpectedMessage(msgType, body, "KEEPALIVE")
+	}
+
+	klog.Infof("BGP session with %s (AS %d) established; advertising %v", sess.peer.Address, sess.peer.AS, config.Prefixes)
+	sess.speaker.setEstablished(sess.peer, true)
+	defer sess.speaker.setEstablished(sess.peer, false)
+
+	if err := sess.send(msgUpdate, sess.updateMessage()); err != nil {
+		return err
+	}
+	// End-of-RIB marker (an empty UPDATE), which tells peers that we have sent
+	// all of our routes, so they can drop any stale routes retained from before
+	// a graceful restart
+	if err := sess.send(msgUpdate, []byte{0, 0, 0, 0}); err != nil {
+		return err
+	}
+
+	if sess.holdTime > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go utilwait.Until(func() {
+			if err := sess.send(msgKeepalive, nil); err != nil {
+				klog.V(2).Infof("Could not send BGP KEEPALIVE to %s: %v", sess.peer.Address, err)
+			}
+		}, sess.holdTime/3, done)
+	}
+
+	for {
+		msgType, body, err := sess.read(sess.holdTime)
+		if err != nil {
+			return err
+		}
+		switch msgType {
+		case msgKeepalive, msgUpdate:
+			// We don't install routes learned from peers
+		case msgNotification:
+			return notificationToError(body)
+		default:
+			return newNotificationError(errFiniteStateMachine, 0, "unexpected message type %d", msgType)
+		}
+	}
+}
+
+func (sess *session) unexpectedMessage(msgType uint8, body []byte, expected string) error {
+	if msgType == msgNotification {
+		return notificationToError(body)
+	}
+	return newNotificationError(errFiniteStateMachine, 0, "expected %s, got message type %d", expected, msgType)
+}
+
+// read reads a message from the peer, failing with a hold timer error if the peer
+// doesn't send anything within holdTime (if it is non-zero)
+func (sess *session) read(holdTime time.Duration) (uint8, []byte, error) {
+	if holdTime > 0 {
+		sess.conn.SetReadDeadline(time.Now().Add(holdTime))
+	} else {
+		sess.conn.SetReadDeadline(time.Time{})
+	}
+	msgType, body, err := readMessage(sess.conn)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return 0, nil, newNotificationError(errHoldTimerExpired, 0, "hold timer expired")
+	}
+	return msgType, body, err
+}
+
+func (sess *session) send(msgType uint8, body []byte) error {
+	sess.writeLock.Lock()
+	defer sess.writeLock.Unlock()
+
+	sess.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return writeMessage(sess.conn, msgType, body)
+}
+
+func (sess *session) sendNotification(code, subcode uint8) {
+	if err := sess.send(msgNotification, []byte{code, subcode}); err != nil {
+		klog.V(2).Infof("Could not send BGP NOTIFICATION to %s: %v", sess.peer.Address, err)
+	}
+}
+
+// openMessage returns the body of our OPEN message
+func (sess *session) openMessage() []byte {
+	config := &sess.speaker.config
+
+	as := uint16(asTrans)
+	if config.LocalAS <= 0xffff {
+		as = uint16(config.LocalAS)
+	}
+	caps := []byte{
+		capMultiprotocol, 4, 0, 1, 0, 1, // IPv4 unicast
+		capFourOctetAS, 4, 0, 0, 0, 0,
+	}
+	binary.BigEndian.PutUint32(caps[8:], config.LocalAS)
+	if config.GracefulRestartTime > 0 {
+		flags := uint16(config.GracefulRestartTime / time.Second)
+		afiFlags := byte(0)
+		if sess.speaker.isRestarting(sess.peer) {
+			flags |= gracefulRestartState
+			afiFlags = gracefulRestartForwarding
+		}
+		caps = append(caps, capGracefulRestart, 6, byte(flags>>8), byte(flags), 0, 1, 1, afiFlags)
+	}
+
+	body := []byte{4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(body[1:], as)
+	binary.BigEndian.PutUint16(body[3:], uint16(config.HoldTime/time.Second))
+	body = append(body, config.RouterID.To4()...)
+	body = append(body, byte(len(caps)+2), paramCapabilities, byte(len(caps)))
+	return append(body, caps...)
+}
+
+// handleOpen validates the peer's OPEN message and negotiates the session
+// parameters from it
+func (sess *session) handleOpen(body []byte) error {
+	if len(body) < 10 || len(body) < 10+int(body[9]) {
+		return newNotificationError(errMessageHeader, errBadMessageLength, "bad OPEN message length %d", len(body))
+	}
+	if body[0] != 4 {
+		return newNotificationError(errOpenMessage, errUnsupportedVersion, "unsupported BGP version %d", body[0])
+	}
+	peerAS := uint32(binary.BigEndian.Uint16(body[1:]))
+	holdTime := time.Duration(binary.BigEndian.Uint16(body[3:])) * time.Second
+
+	params := body[10 : 10+int(body[9])]
+	for len(params) >= 2 && len(params) >= 2+int(params[1]) {
+		paramType, value := params[0], params[2:2+int(params[1])]
+		params = params[2+int(params[1]):]
+		if paramType != paramCapabilities {
+			continue
+		}
+		for len(value) >= 2 && len(value) >= 2+int(value[1]) {
+			capCode, capValue := value[0], value[2:2+int(value[1])]
+			value = value[2+int(value[1]):]
+			switch {
+			case capCode == capFourOctetAS && len(capValue) == 4:
+				sess.fourOctetAS = true
+				peerAS = binary.BigEndian.Uint32(capValue)
+			case capCode == capGracefulRestart && len(capValue) >= 2:
+				sess.gracefulRestart = sess.speaker.config.GracefulRestartTime > 0
+			}
+		}
+	}
+
+	if peerAS != sess.peer.AS {
+		return newNotificationError(errOpenMessage, errBadPeerAS, "peer has AS %d, expected %d", peerAS, sess.peer.AS)
+	}
+	if holdTime == time.Second || holdTime == 2*time.Second {
+		return newNotificationError(errOpenMessage, errUnacceptableHoldTime, "unacceptable hold time %v", holdTime)
+	}
+	sess.holdTime = sess.speaker.config.HoldTime
+	if holdTime < sess.holdTime {
+		sess.holdTime = holdTime
+	}
+	return nil
+}
+
+// updateMessage returns the body of an UPDATE message advertising our prefixes
+func (sess *session) updateMessage() []byte {
+	config := &sess.speaker.config
+	ibgp := sess.peer.AS == config.LocalAS
+
+	var attrs []byte
+	attrs = appendAttr(attrs, attrFlagTransitive, attrOrigin, []byte{originIGP})
+	// On eBGP sessions, the AS_PATH contains just our own AS; on iBGP sessions it
+	// is empty.
+	var asPath, as4Path []byte
+	if !ibgp {
+		if sess.fourOctetAS {
+			asPath = []byte{asSequence, 1, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(asPath[2:], config.LocalAS)
+		} else {
+			asPath = []byte{asSequence, 1, 0, 0}
+			if config.LocalAS <= 0xffff {
+				binary.BigEndian.PutUint16(asPath[2:], uint16(config.LocalAS))
+			} else {
+				binary.BigEndian.PutUint16(asPath[2:], asTrans)
+				as4Path = []byte{asSequence, 1, 0, 0, 0, 0}
+				binary.BigEndian.PutUint32(as4Path[2:], config.LocalAS)
+			}
+		}
+	}
+	attrs = appendAttr(attrs, attrFlagTransitive, attrASPath, asPath)
+	attrs = appendAttr(attrs, attrFlagTransitive, attrNextHop, config.NextHop.To4())
+	if ibgp {
+		localPref := make([]byte, 4)
+		binary.BigEndian.PutUint32(localPref, defaultLocalPref)
+		attrs = appendAttr(attrs, attrFlagTransitive, attrLocalPref, localPref)
+	}
+	if as4Path != nil {
+		attrs = appendAttr(attrs, attrFlagOptional|attrFlagTransitive, attrAS4Path, as4Path)
+	}
+
+	body := []byte{0, 0, 0, 0}
+	binary.BigEndian.PutUint16(body[2:], uint16(len(attrs)))
+	body = append(body, attrs...)
+	for _, prefix := range config.Prefixes {
+		ones, _ := prefix.Mask.Size()
+		body = append(body, byte(ones))
+		body = append(body, prefix.IP.To4()[:(ones+7)/8]...)
+	}
+	return body
+}
+
+func appendAttr(attrs []byte, flags, attrType uint8, value []byte) []byte {
+	return append(append(attrs, flags, attrType, byte(len(value))), value...)
+}
+
+func notificationToError(body []byte) error {
+	if len(body) < 2 {
+		return fmt.Errorf("peer sent NOTIFICATION")
+	}
+	return fmt.Errorf("peer sent NOTIFICATION with error code %d/%d", body[0], body[1])
+}
+
+// readMessage reads a BGP message, returning its type and body
+func readMessage(r io.Reader) (uint8, []byte, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if !bytes.Equal(header[:16], bytes.Repeat([]byte{0xff}, 16)) {
+		return 0, nil, newNotificationError(errMessageHeader, errConnectionNotSynchron, "bad message marker")
+	}
+	length := int(binary.BigEndian.Uint16(header[16:]))
+	if length < headerLength || length > maxMessageLength {
+		return 0, nil, newNotificationError(errMessageHeader, errBadMessageLength, "bad message length %d", length)
+	}
+	body := make([]byte, length-headerLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[18], body, nil
+}
+
+// writeMessage writes a BGP message with the given type and body
+func writeMessage(w io.Writer, msgType uint8, body []byte) error {
+	msg := bytes.Repeat([]byte{0xff}, headerLength)
+	binary.BigEndian.PutUint16(msg[16:], uint16(headerLength+len(body)))
+	msg[18] = msgType
+	_, err := w.Write(append(msg, body...))
+	return err
+}
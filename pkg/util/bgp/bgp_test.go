@@ -0,0 +1,325 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakePeer accepts a single BGP session
+type fakePeer struct {
+	t        *testing.T
+	listener net.Listener
+}
+
+func newFakePeer(t *testing.T) *fakePeer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	return &fakePeer{t: t, listener: listener}
+}
+
+func (fp *fakePeer) accept() net.Conn {
+	conn, err := fp.listener.Accept()
+	if err != nil {
+		fp.t.Fatalf("Could not accept connection: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+func (fp *fakePeer) expect(conn net.Conn, expectedType uint8) []byte {
+	msgType, body, err := readMessage(conn)
+	if err != nil {
+		fp.t.Fatalf("Could not read message: %v", err)
+	}
+	if msgType != expectedType {
+		fp.t.Fatalf("Expected message type %d, got %d (%v)", expectedType, msgType, body)
+	}
+	return body
+}
+
+// expectSkippingKeepalives is like expect, but ignores any KEEPALIVE messages
+func (fp *fakePeer) expectSkippingKeepalives(conn net.Conn, expectedType uint8) []byte {
+	for {
+		msgType, body, err := readMessage(conn)
+		if err != nil {
+			fp.t.Fatalf("Could not read message: %v", err)
+		}
+		if msgType == expectedType {
+			return body
+		} else if msgType != msgKeepalive {
+			fp.t.Fatalf("Expected message type %d, got %d (%v)", expectedType, msgType, body)
+		}
+	}
+}
+
+func (fp *fakePeer) send(conn net.Conn, msgType uint8, body []byte) {
+	if err := writeMessage(conn, msgType, body); err != nil {
+		fp.t.Fatalf("Could not write message: %v", err)
+	}
+}
+
+// fakeOpen returns an OPEN message from a peer in the given AS
+func fakeOpen(as uint32, fourOctetAS bool, holdTime uint16) []byte {
+	body := []byte{4, 0, 0, 0, 0, 192, 168, 0, 1}
+	binary.BigEndian.PutUint16(body[3:], holdTime)
+	if !fourOctetAS {
+		binary.BigEndian.PutUint16(body[1:], uint16(as))
+		return append(body, 0)
+	}
+	binary.BigEndian.PutUint16(body[1:], asTrans)
+	caps := []byte{paramCapabilities, 6, capFourOctetAS, 4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(caps[4:], as)
+	body = append(body, byte(len(caps)))
+	return append(body, caps...)
+}
+
+type parsedUpdate struct {
+	attrs map[uint8][]byte
+	nlri  []string
+}
+
+func parseUpdate(t *testing.T, body []byte) parsedUpdate {
+	if len(body) < 4 || binary.BigEndian.Uint16(body) != 0 {
+		t.Fatalf("Bad UPDATE %v", body)
+	}
+	attrLen := int(binary.BigEndian.Uint16(body[2:]))
+	attrs, nlri := body[4:4+attrLen], body[4+attrLen:]
+
+	update := parsedUpdate{attrs: make(map[uint8][]byte)}
+	for len(attrs) > 0 {
+		attrType, length := attrs[1], int(attrs[2])
+		update.attrs[attrType] = attrs[3 : 3+length]
+		attrs = attrs[3+length:]
+	}
+	for len(nlri) > 0 {
+		ones := int(nlri[0])
+		ip := make(net.IP, 4)
+		copy(ip, nlri[1:1+(ones+7)/8])
+		update.nlri = append(update.nlri, (&net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)}).String())
+		nlri = nlri[1+(ones+7)/8:]
+	}
+	return update
+}
+
+func newTestSpeaker(t *testing.T, localAS uint32, peers ...Peer) *Speaker {
+	_, prefix, _ := net.ParseCIDR("10.128.2.0/23")
+	s, err := NewSpeaker(Config{
+		LocalAS:  localAS,
+		RouterID: net.ParseIP("192.168.0.2"),
+		NextHop:  net.ParseIP("192.168.0.2"),
+		Prefixes: []*net.IPNet{prefix},
+		HoldTime: 30 * time.Second,
+	}, peers)
+	if err != nil {
+		t.Fatalf("Unexpected error creating speaker: %v", err)
+	}
+	return s
+}
+
+func TestSpeaker(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		localAS     uint32
+		peerAS      uint32
+		fourOctetAS bool
+		asPath      []byte
+		as4Path     []byte
+		localPref   bool
+	}{
+		{
+			name:    "eBGP",
+			localAS: 64512,
+			peerAS:  64513,
+			asPath:  []byte{asSequence, 1, 0xfc, 0x00},
+		},
+		{
+			name:        "eBGP with 4-octet AS",
+			localAS:     4200000000,
+			peerAS:      64513,
+			fourOctetAS: true,
+			asPath:      []byte{asSequence, 1, 0xfa, 0x56, 0xea, 0x00},
+		},
+		{
+			name:    "eBGP with 4-octet AS to old peer",
+			localAS: 4200000000,
+			peerAS:  64513,
+			asPath:  []byte{asSequence, 1, 0x5b, 0xa0},
+			as4Path: []byte{asSequence, 1, 0xfa, 0x56, 0xea, 0x00},
+		},
+		{
+			name:      "iBGP",
+			localAS:   64512,
+			peerAS:    64512,
+			asPath:    []byte{},
+			localPref: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fp := newFakePeer(t)
+			defer fp.listener.Close()
+			peer := Peer{Address: fp.listener.Addr().String(), AS: tc.peerAS}
+			s := newTestSpeaker(t, tc.localAS, peer)
+			stopCh := make(chan struct{})
+			s.Run(stopCh)
+
+			conn := fp.accept()
+			defer conn.Close()
+			open := fp.expect(conn, msgOpen)
+			if open[0] != 4 || binary.BigEndian.Uint16(open[3:]) != 30 || !net.IP(open[5:9]).Equal(net.ParseIP("192.168.0.2")) {
+				t.Fatalf("Bad OPEN %v", open)
+			}
+			fp.send(conn, msgOpen, fakeOpen(tc.peerAS, tc.fourOctetAS, 90))
+			fp.expect(conn, msgKeepalive)
+			fp.send(conn, msgKeepalive, nil)
+
+			update := parseUpdate(t, fp.expect(conn, msgUpdate))
+			if !reflect.DeepEqual(update.nlri, []string{"10.128.2.0/23"}) {
+				t.Fatalf("Unexpected NLRI %v", update.nlri)
+			}
+			if !reflect.DeepEqual(update.attrs[attrOrigin], []byte{originIGP}) {
+				t.Fatalf("Unexpected ORIGIN %v", update.attrs[attrOrigin])
+			}
+			if !reflect.DeepEqual(update.attrs[attrNextHop], []byte{192, 168, 0, 2}) {
+				t.Fatalf("Unexpected NEXT_HOP %v", update.attrs[attrNextHop])
+			}
+			if !reflect.DeepEqual(update.attrs[attrASPath], tc.asPath) {
+				t.Fatalf("Unexpected AS_PATH %v", update.attrs[attrASPath])
+			}
+			if !reflect.DeepEqual(update.attrs[attrAS4Path], tc.as4Path) {
+				t.Fatalf("Unexpected AS4_PATH %v", update.attrs[attrAS4Path])
+			}
+			if _, ok := update.attrs[attrLocalPref]; ok != tc.localPref {
+				t.Fatalf("Unexpected LOCAL_PREF %v", update.attrs[attrLocalPref])
+			}
+			if eor := fp.expect(conn, msgUpdate); !reflect.DeepEqual(eor, []byte{0, 0, 0, 0}) {
+				t.Fatalf("Expected End-of-RIB, got %v", eor)
+			}
+			if established := s.Established(); !reflect.DeepEqual(established, []string{peer.Address}) {
+				t.Fatalf("Unexpected established peers %v", established)
+			}
+
+			// Stopping the speaker closes the session
+			close(stopCh)
+			notification := fp.expectSkippingKeepalives(conn, msgNotification)
+			if notification[0] != errCease {
+				t.Fatalf("Unexpected NOTIFICATION %v", notification)
+			}
+		})
+	}
+}
+
+// findCapability returns the value of capability capCode in an OPEN message, or nil
+func findCapability(open []byte, capCode uint8) []byte {
+	params := open[10 : 10+int(open[9])]
+	for len(params) >= 2 {
+		value := params[2 : 2+int(params[1])]
+		params = params[2+int(params[1]):]
+		for len(value) >= 2 {
+			if value[0] == capCode {
+				return value[2 : 2+int(value[1])]
+			}
+			value = value[2+int(value[1]):]
+		}
+	}
+	return nil
+}
+
+func TestSpeakerGracefulRestart(t *testing.T) {
+	fp := newFakePeer(t)
+	defer fp.listener.Close()
+	peer := Peer{Address: fp.listener.Addr().String(), AS: 64513}
+	_, prefix, _ := net.ParseCIDR("10.128.2.0/23")
+	s, err := NewSpeaker(Config{
+		LocalAS:             64512,
+		RouterID:            net.ParseIP("192.168.0.2"),
+		NextHop:             net.ParseIP("192.168.0.2"),
+		Prefixes:            []*net.IPNet{prefix},
+		GracefulRestartTime: 120 * time.Second,
+		Restarted:           true,
+	}, []Peer{peer})
+	if err != nil {
+		t.Fatalf("Unexpected error creating speaker: %v", err)
+	}
+	stopCh := make(chan struct{})
+	s.Run(stopCh)
+
+	conn := fp.accept()
+	defer conn.Close()
+	// Restart state and forwarding state preserved for IPv4 unicast
+	if gr := findCapability(fp.expect(conn, msgOpen), capGracefulRestart); !reflect.DeepEqual(gr, []byte{0x80, 120, 0, 1, 1, 0x80}) {
+		t.Fatalf("Unexpected graceful restart capability %v", gr)
+	}
+	open := fakeOpen(64513, false, 90)
+	open = append(open[:9], 6, paramCapabilities, 4, capGracefulRestart, 2, 0, 0)
+	fp.send(conn, msgOpen, open)
+	fp.expect(conn, msgKeepalive)
+	fp.send(conn, msgKeepalive, nil)
+	fp.expect(conn, msgUpdate)
+	fp.expect(conn, msgUpdate)
+	// Later sessions don't claim to be restarting
+	if s.isRestarting(peer) {
+		t.Fatalf("Speaker still restarting after session was established")
+	}
+
+	// Stopping closes the session without a NOTIFICATION, so the peer keeps our routes
+	close(stopCh)
+	for {
+		msgType, _, err := readMessage(conn)
+		if err != nil {
+			break
+		}
+		if msgType != msgKeepalive {
+			t.Fatalf("Unexpected message type %d", msgType)
+		}
+	}
+}
+
+func TestSpeakerBadOpen(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		open    []byte
+		subcode uint8
+	}{
+		{
+			name:    "wrong AS",
+			open:    fakeOpen(64514, true, 90),
+			subcode: errBadPeerAS,
+		},
+		{
+			name:    "bad hold time",
+			open:    fakeOpen(64513, false, 2),
+			subcode: errUnacceptableHoldTime,
+		},
+		{
+			name:    "bad version",
+			open:    append([]byte{3}, fakeOpen(64513, false, 90)[1:]...),
+			subcode: errUnsupportedVersion,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fp := newFakePeer(t)
+			defer fp.listener.Close()
+			s := newTestSpeaker(t, 64512, Peer{Address: fp.listener.Addr().String(), AS: 64513})
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			s.Run(stopCh)
+
+			conn := fp.accept()
+			defer conn.Close()
+			fp.expect(conn, msgOpen)
+			fp.send(conn, msgOpen, tc.open)
+			notification := fp.expect(conn, msgNotification)
+			if notification[0] != errOpenMessage || notification[1] != tc.subcode {
+				t.Fatalf("Unexpected NOTIFICATION %v", notification)
+			}
+			if established := s.Established(); len(established) != 0 {
+				t.Fatalf("Unexpected established peers %v", established)
+			}
+		})
+	}
+}
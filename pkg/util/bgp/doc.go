@@ -0,0 +1,3 @@
+// Package bgp provides a minimal BGP-4 speaker that advertises a fixed set of IPv4
+// prefixes to its peers. It does not accept or install routes learned from peers.
+package bgp
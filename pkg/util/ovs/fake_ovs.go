@@ -26,12 +26,13 @@ type ovsFake struct {
 	ports map[string]ovsPortInfo
 	// map of groupID to OVS group, makes it easier to add and delete groups
 	groups map[string]OVSGroup
+	meters map[string]int
 	flows  ovsFlows
 }
 
 // NewFake returns a new ovs.Interface
 func NewFake(bridge string) Interface {
-	return &ovsFake{bridge: bridge, groups: make(map[string]OVSGroup)}
+	return &ovsFake{bridge: bridge, groups: make(map[string]OVSGroup), meters: make(map[string]int)}
 }
 
 func (fake *ovsFake) AddBridge(properties ...string) error {
@@ -46,6 +47,7 @@ func (fake *ovsFake) AddBridge(properties ...string) error {
 func (fake *ovsFake) DeleteBridge() error {
 	fake.ports = nil
 	fake.flows = nil
+	fake.meters = make(map[string]int)
 	return nil
 }
 
@@ -159,6 +161,14 @@ func (fake *ovsFake) SetFrags(mode string) error {
 	return nil
 }
 
+func (fake *ovsFake) SetMeter(meterID uint32, pktps int) error {
+	if err := fake.ensureExists(); err != nil {
+		return err
+	}
+	fake.meters[fmt.Sprintf("%d", meterID)] = pktps
+	return nil
+}
+
 func (ovsif *ovsFake) Create(table string, values ...string) (string, error) {
 	if err := validateColumns(values...); err != nil {
 		return "", err
@@ -196,12 +206,14 @@ func (fake *ovsFake) Find(table string, columns []string, condition string) ([]m
 	}
 	results := make([]map[string]string, 0)
 	if (table == "Interface" || table == "interface") && strings.HasPrefix(condition, "external_ids:") {
-		parsed := strings.Split(condition[13:], "=")
+		negate := strings.Contains(condition, "!=")
+		parsed := strings.Split(strings.Replace(condition[13:], "!=", "=", 1), "=")
 		if len(parsed) != 2 {
 			return nil, fmt.Errorf("could not parse condition %q", condition)
 		}
+		value := strings.Trim(parsed[1], "\"")
 		for portName, portInfo := range fake.ports {
-			if portInfo.externalIDs[parsed[0]] == parsed[1] {
+			if (portInfo.externalIDs[parsed[0]] == value) != negate {
 				result := make(map[string]string)
 				for _, column := range columns {
 					if column == "name" {
@@ -291,6 +303,13 @@ func (fake *ovsFake) addFlowHelper(flow string) error {
 		return err
 	}
 	fixFlowFields(parsed)
+	for _, action := range parsed.Actions {
+		if action.Name == "meter" {
+			if _, exists := fake.meters[action.Value]; !exists {
+				return fmt.Errorf("flow %q uses nonexistent meter %s", flow, action.Value)
+			}
+		}
+	}
 
 	// If there is already an exact match for this flow, then the new flow replaces it.
 	for i := range fake.flows {
@@ -333,6 +352,10 @@ func (tx *ovsFakeTx) AddGroup(groupID uint32, groupType string, buckets []string
 	tx.groups = append(tx.groups, fmt.Sprintf("group add group_id=%d,type=%s,bucket=%s", groupID, groupType, strings.Join(buckets, "bucket=")))
 }
 
+func (tx *ovsFakeTx) ModifyGroup(groupID uint32, groupType string, buckets []string) {
+	tx.groups = append(tx.groups, fmt.Sprintf("group modify group_id=%d,type=%s,bucket=%s", groupID, groupType, strings.Join(buckets, "bucket=")))
+}
+
 func (tx *ovsFakeTx) DeleteGroup(groupID uint32) {
 	tx.groups = append(tx.groups, fmt.Sprintf("group delete group_id=%d", groupID))
 }
@@ -354,6 +377,18 @@ func (tx *ovsFakeTx) Commit() error {
 			tx.fake.groups[id] = *parsed
 
 		}
+		if strings.HasPrefix(group, "group modify") {
+			group = strings.TrimPrefix(group, "group modify ")
+			id := strings.TrimPrefix(strings.Split(group, ",")[0], "group_id=")
+			if _, exists := tx.fake.groups[id]; !exists {
+				return fmt.Errorf("cannot modify nonexistent group %s", id)
+			}
+			parsed, err := ParseGroup(group)
+			if err != nil {
+				return fmt.Errorf("cannot parse group %s for group modify: %v", group, err)
+			}
+			tx.fake.groups[id] = *parsed
+		}
 		if strings.HasPrefix(group, "group delete") {
 			group = strings.TrimPrefix(group, "group delete group_id=")
 			delete(tx.fake.groups, group)
@@ -386,6 +421,17 @@ func (tx *ovsFakeTx) Commit() error {
 	return err
 }
 
+// Trace checks that flow is valid, but doesn't simulate the packet
+func (fake *ovsFake) Trace(flow string, args ...interface{}) (string, error) {
+	if err := fake.ensureExists(); err != nil {
+		return "", err
+	}
+	if _, err := ParseFlow(ParseForFilter, flow, args...); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("ofproto/trace is not supported by the fake")
+}
+
 func (fake *ovsFake) DumpFlows(flow string, args ...interface{}) ([]string, error) {
 	if err := fake.ensureExists(); err != nil {
 		return nil, err
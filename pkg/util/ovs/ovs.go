@@ -35,8 +35,7 @@ type Interface interface {
 	// error if the interface is not currently a bridge port.)
 	DeletePort(port string) error
 
-	// DumpGroup dumps the groups table for the bridge and returns it as an array of stings
-	// Currently DumpGroups is only used in testing
+	// DumpGroups dumps the groups table for the bridge and returns it as an array of strings
 	DumpGroups() ([]string, error)
 
 	// GetOFPort returns the OpenFlow port number of a given network interface
@@ -47,6 +46,12 @@ type Interface interface {
 	// "ovs-ofctl set-frags")
 	SetFrags(mode string) error
 
+	// SetMeter creates the OpenFlow meter meterID, or modifies it if it already
+	// exists, so that it drops packets beyond pktps packets per second. Flows use
+	// the meter with a "meter:ID" action, which must come before their other
+	// actions. Modifying a meter leaves the flows that use it in place.
+	SetMeter(meterID uint32, pktps int) error
+
 	// Create creates a record in the OVS database, as with "ovs-vsctl create" and
 	// returns the UUID of the newly-created item.
 	// NOTE: This only works for QoS; for all other tables the created object will
@@ -81,6 +86,10 @@ type Interface interface {
 	// strings, one per flow. If flow is not "" then it describes the flows to dump.
 	DumpFlows(flow string, args ...interface{}) ([]string, error)
 
+	// Trace simulates sending a packet described by flow into the bridge, as with
+	// "ovs-appctl ofproto/trace", and returns the trace output
+	Trace(flow string, args ...interface{}) (string, error)
+
 	// NewTransaction begins a new OVS transaction.
 	NewTransaction() Transaction
 
@@ -101,6 +110,9 @@ type Transaction interface {
 	DeleteFlows(flow string, args ...interface{})
 
 	AddGroup(groupID uint32, groupType string, buckets []string)
+	// ModifyGroup prepares replacing the buckets of an existing group, without
+	// affecting the flows that use it.
+	ModifyGroup(groupID uint32, groupType string, buckets []string)
 	DeleteGroup(groupID uint32)
 
 	// Commit executes all cached flows as a single atomic transaction and
@@ -109,8 +121,9 @@ type Transaction interface {
 }
 
 const (
-	OVS_OFCTL = "ovs-ofctl"
-	OVS_VSCTL = "ovs-vsctl"
+	OVS_OFCTL  = "ovs-ofctl"
+	OVS_VSCTL  = "ovs-vsctl"
+	OVS_APPCTL = "ovs-appctl"
 )
 
 var ovsBackoff utilwait.Backoff = utilwait.Backoff{
@@ -141,7 +154,7 @@ func (ovsif *ovsExec) execWithStdin(cmd string, stdinArgs []string, args ...stri
 	logLevel := klog.Level(4)
 	switch cmd {
 	case OVS_OFCTL:
-		if args[0] == "dump-flows" {
+		if args[0] == "dump-flows" || args[0] == "dump-groups" {
 			logLevel = klog.Level(5)
 		}
 		args = append([]string{"-O", "OpenFlow13"}, args...)
@@ -275,11 +288,20 @@ func (ovsif *ovsExec) DeletePort(port string) error {
 	return err
 }
 
-// Currently DumpGroups is only used for testing
 func (ovsif *ovsExec) DumpGroups() ([]string, error) {
-	//stub
-	return nil, fmt.Errorf("Dump Groups is not implemented")
+	out, err := ovsif.exec(OVS_OFCTL, "dump-groups", ovsif.bridge)
+	if err != nil {
+		return nil, err
+	}
 
+	lines := strings.Split(out, "\n")
+	groups := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.Contains(line, "group_id=") {
+			groups = append(groups, strings.TrimSpace(line))
+		}
+	}
+	return groups, nil
 }
 
 func (ovsif *ovsExec) SetFrags(mode string) error {
@@ -398,6 +420,33 @@ func (ovsif *ovsExec) DumpFlows(flow string, args ...interface{}) ([]string, err
 	return flows, nil
 }
 
+func (ovsif *ovsExec) Trace(flow string, args ...interface{}) (string, error) {
+	if len(args) > 0 {
+		flow = fmt.Sprintf(flow, args...)
+	}
+	// Not retried, since the usual reason for failure is a bad flow
+	return ovsif.execWithStdin(OVS_APPCTL, nil, "ofproto/trace", ovsif.bridge, flow)
+}
+
+func (ovsif *ovsExec) SetMeter(meterID uint32, pktps int) error {
+	meter := fmt.Sprintf("meter=%d", meterID)
+	out, err := ovsif.exec(OVS_OFCTL, "dump-meters", ovsif.bridge, meter)
+	if err != nil {
+		return err
+	}
+	// Deleting a meter deletes every flow that uses it, so an existing meter is
+	// modified in place rather than being replaced
+	command := "add-meter"
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), meter+" ") {
+			command = "mod-meter"
+			break
+		}
+	}
+	_, err = ovsif.exec(OVS_OFCTL, command, ovsif.bridge, fmt.Sprintf("%s,pktps,band=type=drop,rate=%d", meter, pktps))
+	return err
+}
+
 func (ovsif *ovsExec) NewTransaction() Transaction {
 	return &ovsExecTx{ovsif: ovsif, mods: []string{}}
 }
@@ -445,6 +494,10 @@ func (tx *ovsExecTx) AddGroup(groupID uint32, groupType string, buckets []string
 	tx.mods = append(tx.mods, fmt.Sprintf("group add group_id=%d,type=%s,bucket=%s", groupID, groupType, strings.Join(buckets, "bucket=")))
 }
 
+func (tx *ovsExecTx) ModifyGroup(groupID uint32, groupType string, buckets []string) {
+	tx.mods = append(tx.mods, fmt.Sprintf("group modify group_id=%d,type=%s,bucket=%s", groupID, groupType, strings.Join(buckets, "bucket=")))
+}
+
 func (tx *ovsExecTx) DeleteGroup(groupID uint32) {
 	tx.mods = append(tx.mods, fmt.Sprintf("group delete group_id=%d", groupID))
 }
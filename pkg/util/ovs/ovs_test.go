@@ -175,6 +175,30 @@ func TestDumpFlows(t *testing.T) {
 	ensureTestResults(t, fexec)
 }
 
+func TestSetMeter(t *testing.T) {
+	fexec := normalSetup()
+	addTestResult(t, fexec, "ovs-ofctl -O OpenFlow13 dump-meters br0 meter=1", "OFPST_METER_CONFIG reply (OF1.3) (xid=0x2):\n", nil)
+	addTestResult(t, fexec, "ovs-ofctl -O OpenFlow13 add-meter br0 meter=1,pktps,band=type=drop,rate=100", "", nil)
+	addTestResult(t, fexec, "ovs-ofctl -O OpenFlow13 dump-meters br0 meter=1", `OFPST_METER_CONFIG reply (OF1.3) (xid=0x2):
+meter=1 pktps bands=
+type=drop rate=100
+`, nil)
+	addTestResult(t, fexec, "ovs-ofctl -O OpenFlow13 mod-meter br0 meter=1,pktps,band=type=drop,rate=50", "", nil)
+
+	ovsif, err := New(fexec, "br0")
+	if err != nil {
+		t.Fatalf("Unexpected error from ovs.New(): %v", err)
+	}
+	if err := ovsif.SetMeter(1, 100); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := ovsif.SetMeter(1, 50); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ensureTestResults(t, fexec)
+}
+
 func TestOVSMissing(t *testing.T) {
 	fexec := missingSetup()
 	ovsif, err := New(fexec, "br0")
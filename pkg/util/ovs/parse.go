@@ -313,8 +313,9 @@ func ParseFlow(ptype ParseType, flow string, args ...interface{}) (*OvsFlow, err
 	if (fieldSet(parsed, "udp_src") || fieldSet(parsed, "udp_dst")) && !fieldSet(parsed, "udp") {
 		return nil, fmt.Errorf("bad flow %q (specified udp_src/udp_dst without udp)", flow)
 	}
-	if (fieldSet(parsed, "tp_src") || fieldSet(parsed, "tp_dst")) && !(fieldSet(parsed, "tcp") || fieldSet(parsed, "udp")) {
-		return nil, fmt.Errorf("bad flow %q (specified tp_src/tp_dst without tcp/udp)", flow)
+	if (fieldSet(parsed, "tp_src") || fieldSet(parsed, "tp_dst")) &&
+		!(fieldSet(parsed, "tcp") || fieldSet(parsed, "udp") || fieldSet(parsed, "sctp") || fieldSet(parsed, "tcp6") || fieldSet(parsed, "udp6") || fieldSet(parsed, "sctp6")) {
+		return nil, fmt.Errorf("bad flow %q (specified tp_src/tp_dst without tcp/udp/sctp)", flow)
 	}
 	if fieldSet(parsed, "ip_frag") && (fieldSet(parsed, "tcp") || fieldSet(parsed, "udp")) {
 		return nil, fmt.Errorf("bad flow %q (specified ip_frag with tcp/udp)", flow)
@@ -373,9 +374,9 @@ func fieldMatches(val, match string, ptype ParseType) bool {
 	// reach the final check.)
 	split := strings.Split(match, "/")
 	if len(split) == 2 {
-		matchNum, err1 := strconv.ParseUint(split[0], 0, 32)
-		mask, err2 := strconv.ParseUint(split[1], 0, 32)
-		valNum, err3 := strconv.ParseUint(val, 0, 32)
+		matchNum, err1 := strconv.ParseUint(split[0], 0, 64)
+		mask, err2 := strconv.ParseUint(split[1], 0, 64)
+		valNum, err3 := strconv.ParseUint(val, 0, 64)
 		if err1 == nil && err2 == nil && err3 == nil {
 			if (matchNum & mask) == (valNum & mask) {
 				return true
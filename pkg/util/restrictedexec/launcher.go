@@ -0,0 +1,46 @@
+package restrictedexec
+
+import (
+	"runtime"
+)
+
+// Launcher starts commands from a single, dedicated OS thread, so that they inherit
+// per-thread state (such as a reduced capability set, or no_new_privs) that has been
+// set up on that thread only. This works even if the process was built with cgo,
+// when such state can't be changed for every thread of the process.
+type Launcher struct {
+	requests chan func()
+}
+
+// NewLauncher starts a Launcher, calling setup on its thread before any commands
+// are started. If setup fails, the thread exits and the error is returned.
+func NewLauncher(setup func() error) (*Launcher, error) {
+	l := &Launcher{requests: make(chan func())}
+	errCh := make(chan error)
+	go func() {
+		// The thread is never unlocked, so that nothing else ever runs on it,
+		// and so that Go discards it rather than reusing it if we exit
+		runtime.LockOSThread()
+		if err := setup(); err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- nil
+		for f := range l.requests {
+			f()
+		}
+	}()
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// run calls f on the Launcher's thread and returns its result
+func (l *Launcher) run(f func() error) error {
+	done := make(chan error, 1)
+	l.requests <- func() {
+		done <- f()
+	}
+	return <-done
+}
@@ -0,0 +1,290 @@
+// Package restrictedexec provides a k8s.io/utils/exec.Interface that runs helper
+// commands with a minimal environment, a timeout, and a cap on the size of their
+// output, and that reports their failures uniformly.
+package restrictedexec
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+	"k8s.io/utils/exec"
+)
+
+const (
+	// DefaultTimeout is the default limit on the time a command may run
+	DefaultTimeout = 5 * time.Minute
+	// DefaultMaxOutput is the default limit on the size of a command's output. (This
+	// needs to be large enough for iptables-save and ovs-ofctl dump-flows on very
+	// large clusters.)
+	DefaultMaxOutput = 256 * 1024 * 1024
+
+	defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// Reasons passed to Config.OnFailure
+const (
+	// FailureExit is a command exiting non-0 (which the caller may expect)
+	FailureExit = "exit"
+	// FailureTimeout is a command being killed after Config.Timeout
+	FailureTimeout = "timeout"
+	// FailureOutputLimit is a command being killed for exceeding Config.MaxOutput
+	FailureOutputLimit = "output_limit"
+	// FailureError is any other error, such as the command not being found
+	FailureError = "error"
+)
+
+// Config is the configuration of a restricted exec.Interface
+type Config struct {
+	// Timeout, if non-0, is the time after which a command run with Run(), Output(),
+	// or CombinedOutput() is killed. Commands run with Start() and Wait() (eg,
+	// long-running monitors) are not limited.
+	Timeout time.Duration
+
+	// MaxOutput, if non-0, is the number of bytes of stdout (or stderr) after which
+	// a command run with Run(), Output(), or CombinedOutput() is killed.
+	MaxOutput int
+
+	// OnFailure, if set, is called with the base name of the command and the
+	// reason each time a command fails (eg, to update metrics)
+	OnFailure func(command, reason string)
+
+	// Launcher, if set, is used to start every command, so that they inherit
+	// any restrictions set up on its thread
+	Launcher *Launcher
+}
+
+// DefaultConfig is the Config used by New() if no other Config is given
+var DefaultConfig = Config{
+	Timeout:   DefaultTimeout,
+	MaxOutput: DefaultMaxOutput,
+}
+
+type restrictedExec struct {
+	execer exec.Interface
+	config Config
+	env    []string
+}
+
+// New returns an exec.Interface that runs commands with the limits in config. The
+// commands are always run with a minimal environment (just PATH, any OVS_*
+// variables, and LC_ALL=C), rather than inheriting the environment of the caller.
+func New(config Config) exec.Interface {
+	return newRestrictedExec(exec.New(), config)
+}
+
+func newRestrictedExec(execer exec.Interface, config Config) *restrictedExec {
+	return &restrictedExec{
+		execer: execer,
+		config: config,
+		env:    minimalEnv(os.Environ()),
+	}
+}
+
+// minimalEnv returns the subset of environ that is passed to commands
+func minimalEnv(environ []string) []string {
+	env := []string{"LC_ALL=C"}
+	havePath := false
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, "PATH=") {
+			havePath = true
+			env = append(env, kv)
+		} else if strings.HasPrefix(kv, "OVS_") {
+			env = append(env, kv)
+		}
+	}
+	if !havePath {
+		env = append(env, "PATH="+defaultPath)
+	}
+	return env
+}
+
+func (re *restrictedExec) Command(cmd string, args ...string) exec.Cmd {
+	return re.CommandContext(context.Background(), cmd, args...)
+}
+
+func (re *restrictedExec) CommandContext(ctx context.Context, cmd string, args ...string) exec.Cmd {
+	ctx, cancel := context.WithCancel(ctx)
+	rc := &restrictedCmd{
+		Cmd:    re.execer.CommandContext(ctx, cmd, args...),
+		name:   filepath.Base(cmd),
+		config: re.config,
+		cancel: cancel,
+	}
+	rc.Cmd.SetEnv(re.env)
+	return rc
+}
+
+func (re *restrictedExec) LookPath(file string) (string, error) {
+	return re.execer.LookPath(file)
+}
+
+// restrictedCmd is an exec.Cmd that enforces config when it is run
+type restrictedCmd struct {
+	exec.Cmd
+
+	name   string
+	config Config
+	cancel context.CancelFunc
+
+	stdout io.Writer
+	stderr io.Writer
+
+	// timedOut and outputExceeded are set (to 1) when the command is killed for
+	// exceeding a limit
+	timedOut       int32
+	outputExceeded int32
+}
+
+func (rc *restrictedCmd) SetStdout(out io.Writer) {
+	rc.stdout = out
+	rc.Cmd.SetStdout(out)
+}
+
+func (rc *restrictedCmd) SetStderr(out io.Writer) {
+	rc.stderr = out
+	rc.Cmd.SetStderr(out)
+}
+
+func (rc *restrictedCmd) Run() error {
+	return rc.run(rc.stdout, rc.stderr)
+}
+
+func (rc *restrictedCmd) CombinedOutput() ([]byte, error) {
+	var b bytes.Buffer
+	err := rc.run(&b, &b)
+	return b.Bytes(), err
+}
+
+func (rc *restrictedCmd) Output() ([]byte, error) {
+	var b bytes.Buffer
+	err := rc.run(&b, rc.stderr)
+	return b.Bytes(), err
+}
+
+// start starts the command, on config.Launcher's thread if there is one
+func (rc *restrictedCmd) start() error {
+	if rc.config.Launcher == nil {
+		return rc.Cmd.Start()
+	}
+	return rc.config.Launcher.run(rc.Cmd.Start)
+}
+
+func (rc *restrictedCmd) Start() error {
+	err := rc.start()
+	if err != nil {
+		rc.cancel()
+		rc.recordFailure(err)
+	}
+	return err
+}
+
+func (rc *restrictedCmd) Wait() error {
+	err := rc.Cmd.Wait()
+	rc.cancel()
+	if err != nil {
+		rc.recordFailure(err)
+	}
+	return err
+}
+
+// run runs the command to completion, with stdout and stderr (which may be nil, or
+// the same writer) limited to config.MaxOutput bytes
+func (rc *restrictedCmd) run(stdout, stderr io.Writer) error {
+	defer rc.cancel()
+
+	if rc.config.MaxOutput > 0 {
+		var limitedStdout io.Writer
+		if stdout != nil {
+			limitedStdout = rc.newLimitedWriter(stdout)
+			rc.Cmd.SetStdout(limitedStdout)
+		}
+		if stderr != nil {
+			if stderr == stdout {
+				// Let os/exec see that they're the same, so it uses a
+				// single pipe and they share the limit
+				rc.Cmd.SetStderr(limitedStdout)
+			} else {
+				rc.Cmd.SetStderr(rc.newLimitedWriter(stderr))
+			}
+		}
+	} else {
+		if stdout != nil {
+			rc.Cmd.SetStdout(stdout)
+		}
+		if stderr != nil {
+			rc.Cmd.SetStderr(stderr)
+		}
+	}
+
+	if rc.config.Timeout > 0 {
+		timer := time.AfterFunc(rc.config.Timeout, func() {
+			atomic.StoreInt32(&rc.timedOut, 1)
+			rc.cancel()
+		})
+		defer timer.Stop()
+	}
+
+	err := rc.start()
+	if err == nil {
+		err = rc.Cmd.Wait()
+	}
+	if err == nil {
+		return nil
+	}
+	if atomic.LoadInt32(&rc.timedOut) == 1 {
+		err = fmt.Errorf("%s timed out after %v", rc.name, rc.config.Timeout)
+	} else if atomic.LoadInt32(&rc.outputExceeded) == 1 {
+		err = fmt.Errorf("%s output exceeded %d bytes", rc.name, rc.config.MaxOutput)
+	}
+	rc.recordFailure(err)
+	return err
+}
+
+func (rc *restrictedCmd) recordFailure(err error) {
+	reason := FailureError
+	if atomic.LoadInt32(&rc.timedOut) == 1 {
+		reason = FailureTimeout
+	} else if atomic.LoadInt32(&rc.outputExceeded) == 1 {
+		reason = FailureOutputLimit
+	} else if _, ok := err.(exec.ExitError); ok {
+		reason = FailureExit
+	}
+	if reason != FailureExit {
+		// Exit errors are often expected (eg, "iptables -C") so leave them
+		// to the caller
+		klog.V(2).Infof("Error running %s: %v", rc.name, err)
+	}
+	if rc.config.OnFailure != nil {
+		rc.config.OnFailure(rc.name, reason)
+	}
+}
+
+// limitedWriter passes writes through to w until max bytes have been written, and
+// then kills the command
+type limitedWriter struct {
+	w         io.Writer
+	remaining int
+	rc        *restrictedCmd
+}
+
+func (rc *restrictedCmd) newLimitedWriter(w io.Writer) *limitedWriter {
+	return &limitedWriter{w: w, remaining: rc.config.MaxOutput, rc: rc}
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > lw.remaining {
+		atomic.StoreInt32(&lw.rc.outputExceeded, 1)
+		lw.rc.cancel()
+		return 0, fmt.Errorf("output exceeded %d bytes", lw.rc.config.MaxOutput)
+	}
+	lw.remaining -= len(p)
+	return lw.w.Write(p)
+}
@@ -0,0 +1,116 @@
+package restrictedexec
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"k8s.io/utils/exec"
+)
+
+func TestMinimalEnv(t *testing.T) {
+	env := minimalEnv([]string{"HOME=/root", "PATH=/usr/bin:/bin", "OVS_RUNDIR=/var/run/openvswitch", "KUBECONFIG=/etc/kubeconfig"})
+	expected := []string{"LC_ALL=C", "PATH=/usr/bin:/bin", "OVS_RUNDIR=/var/run/openvswitch"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("expected %v, got %v", expected, env)
+	}
+
+	env = minimalEnv([]string{"HOME=/root"})
+	expected = []string{"LC_ALL=C", "PATH=" + defaultPath}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("expected %v, got %v", expected, env)
+	}
+}
+
+func TestRestrictedExec(t *testing.T) {
+	os.Setenv("RESTRICTEDEXEC_TEST", "leaked")
+	defer os.Unsetenv("RESTRICTEDEXEC_TEST")
+
+	failures := make(map[string]int)
+	execer := New(Config{
+		Timeout:   time.Second,
+		MaxOutput: 1000,
+		OnFailure: func(command, reason string) {
+			failures[command+" "+reason]++
+		},
+	})
+
+	// Environment
+	out, err := execer.Command("sh", "-c", "echo ${RESTRICTEDEXEC_TEST:-unset} $LC_ALL").CombinedOutput()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(out) != "unset C\n" {
+		t.Fatalf("unexpected output %q", string(out))
+	}
+
+	// Exit errors are passed through unchanged
+	_, err = execer.Command("sh", "-c", "exit 3").CombinedOutput()
+	if ee, ok := err.(exec.ExitError); !ok || ee.ExitStatus() != 3 {
+		t.Fatalf("expected exit status 3, got %v", err)
+	}
+
+	// Timeout
+	start := time.Now()
+	err = execer.Command("sleep", "10").Run()
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("command was not killed after timeout")
+	}
+
+	// Output limit
+	out, err = execer.Command("sh", "-c", "head -c 5000 /dev/zero").Output()
+	if err == nil || !strings.Contains(err.Error(), "output exceeded") {
+		t.Fatalf("expected output limit error, got %v", err)
+	}
+	if len(out) > 1000 {
+		t.Fatalf("expected output to be limited, got %d bytes", len(out))
+	}
+	out, err = execer.Command("sh", "-c", "head -c 500 /dev/zero").Output()
+	if err != nil || len(out) != 500 {
+		t.Fatalf("unexpected result %d bytes / %v", len(out), err)
+	}
+
+	expected := map[string]int{
+		"sh exit":         1,
+		"sleep timeout":   1,
+		"sh output_limit": 1,
+	}
+	if !reflect.DeepEqual(failures, expected) {
+		t.Fatalf("expected failures %v, got %v", expected, failures)
+	}
+}
+
+func TestLauncher(t *testing.T) {
+	// no_new_privs is per-thread, and can be set without privileges
+	launcher, err := NewLauncher(func() error {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, 38 /* PR_SET_NO_NEW_PRIVS */, 1, 0); errno != 0 {
+			return errno
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error starting launcher: %v", err)
+	}
+
+	execer := New(Config{Launcher: launcher})
+	for i := 0; i < 3; i++ {
+		out, err := execer.Command("grep", "NoNewPrivs", "/proc/self/status").CombinedOutput()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fields := strings.Fields(string(out)); len(fields) != 2 || fields[1] != "1" {
+			t.Fatalf("command did not inherit no_new_privs: %q", string(out))
+		}
+	}
+
+	_, err = NewLauncher(func() error { return syscall.EPERM })
+	if err != syscall.EPERM {
+		t.Fatalf("expected setup error, got %v", err)
+	}
+}